@@ -0,0 +1,476 @@
+// Command rdpscan probes RDP servers with grdp: the protocols they
+// negotiate, their NTLM identity or whether they enforce NLA. In login
+// mode it checks a user and password against a single server.
+//
+//	rdpscan [flags] [target ...]
+//
+// Targets are read from the arguments, the file of -f or, without
+// either, stdin, one per line; see grdp.ParseTarget for their syntax.
+// The password of login mode is read from RDPSCAN_PASSWORD so that it
+// is not seen in the process list. The exit status is 1 when a target
+// failed, the login was refused or the scan was interrupted, 2 for a
+// usage error. SIGINT or SIGTERM stops the scan, the probes in flight
+// are given -grace to end and are aborted by a second one.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/icodeface/grdp"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/protocol/x224"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// environment variable of the password of login mode
+const PASSWORD_ENV = "RDPSCAN_PASSWORD"
+
+const (
+	MODE_PROBE     = "probe"
+	MODE_NTLM_INFO = "ntlm-info"
+	MODE_NLA_CHECK = "nla-check"
+	MODE_LOGIN     = "login"
+)
+
+const (
+	EXIT_OK     = 0
+	EXIT_FAILED = 1
+	EXIT_USAGE  = 2
+)
+
+func main() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr, signals))
+}
+
+type config struct {
+	mode        string
+	file        string
+	concurrency int
+	timeout     time.Duration
+	output      string
+	user        string
+	domain      string
+	grace       time.Duration
+	downgrade   bool
+	targets     []string
+}
+
+func parseFlags(args []string, stderr io.Writer) (*config, error) {
+	c := &config{}
+	fs := flag.NewFlagSet("rdpscan", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&c.mode, "mode", MODE_PROBE, "probe, ntlm-info, nla-check or login")
+	fs.StringVar(&c.file, "f", "", "file of targets, one per line, - for stdin")
+	fs.IntVar(&c.concurrency, "c", 64, "probes at a time")
+	fs.DurationVar(&c.timeout, "timeout", grdp.ProbeTimeout, "for each target, dial included")
+	fs.StringVar(&c.output, "o", "text", "output format: text, json or csv")
+	fs.StringVar(&c.user, "user", "", "user of login mode, the password is read from "+PASSWORD_ENV)
+	fs.StringVar(&c.domain, "domain", "", "domain of the user of login mode")
+	fs.BoolVar(&c.downgrade, "downgrade", false, "offer HYBRID, then SSL, then standard RDP security after each negotiation failure")
+	fs.DurationVar(&c.grace, "grace", grdp.DefaultStopTimeout, "wait for the probes in flight after an interrupt")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: rdpscan [flags] [target ...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c.targets = fs.Args()
+	switch c.mode {
+	case MODE_PROBE, MODE_NTLM_INFO, MODE_NLA_CHECK, MODE_LOGIN:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", c.mode)
+	}
+	switch c.output {
+	case "text", "json", "csv":
+	default:
+		return nil, fmt.Errorf("unknown output format %q", c.output)
+	}
+	if c.concurrency < 1 {
+		return nil, fmt.Errorf("concurrency %d", c.concurrency)
+	}
+	if c.timeout <= 0 {
+		return nil, fmt.Errorf("timeout %v", c.timeout)
+	}
+	if c.file != "" && len(c.targets) > 0 {
+		return nil, errors.New("targets given both as arguments and with -f")
+	}
+	if c.mode == MODE_LOGIN && c.user == "" {
+		return nil, errors.New("login mode needs -user")
+	}
+	return c, nil
+}
+
+/**
+ * The first of interrupts stops the scan: no target is probed anymore,
+ * those in flight are given the grace period. A second one aborts them
+ */
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer, interrupts <-chan os.Signal) int {
+	c, err := parseFlags(args, stderr)
+	if err == flag.ErrHelp {
+		return EXIT_OK
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "rdpscan:", err)
+		return EXIT_USAGE
+	}
+	// the protocol layers log through glog, only their failures are of interest here
+	glog.SetLogger(log.New(stderr, "", log.LstdFlags))
+	glog.SetLevel(glog.NONE)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	scan := scanner(c)
+	interrupted := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupts:
+		case <-ctx.Done():
+			return
+		}
+		close(interrupted)
+		if c.mode == MODE_LOGIN {
+			cancel()
+			return
+		}
+		go scan.Stop()
+		select {
+		case <-interrupts:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	targets := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(targets)
+		readErr <- readTargets(ctx, c, stdin, targets)
+	}()
+
+	out := newOutput(c.output, stdout)
+	var s summary
+	if c.mode == MODE_LOGIN {
+		r, err := login(ctx, c, targets)
+		if err != nil {
+			fmt.Fprintln(stderr, "rdpscan:", err)
+			return EXIT_USAGE
+		}
+		s.add(r)
+		out.write(r)
+	} else {
+		for result := range scan.Scan(ctx, targets, c.concurrency) {
+			r := newRecord(result)
+			s.add(r)
+			out.write(r)
+		}
+	}
+	// the targets left are not read
+	cancel()
+	if err = out.flush(); err != nil {
+		fmt.Fprintln(stderr, "rdpscan:", err)
+		return EXIT_FAILED
+	}
+	// stdin may be left blocked in a read after an interrupt
+	select {
+	case err = <-readErr:
+	case <-interrupted:
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "rdpscan:", err)
+		return EXIT_FAILED
+	}
+	s.print(stderr, c.mode)
+	select {
+	case <-interrupted:
+		// targets may be left unprobed
+		fmt.Fprintln(stderr, "rdpscan: interrupted")
+		return EXIT_FAILED
+	default:
+	}
+	if s.errors > 0 {
+		return EXIT_FAILED
+	}
+	return EXIT_OK
+}
+
+// sends the targets of the arguments, or of the file or stdin, blank lines and # comments skipped
+func readTargets(ctx context.Context, c *config, stdin io.Reader, targets chan<- string) error {
+	send := func(target string) bool {
+		select {
+		case targets <- target:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	if len(c.targets) > 0 {
+		for _, target := range c.targets {
+			if !send(target) {
+				return nil
+			}
+		}
+		return nil
+	}
+	r := stdin
+	if c.file != "" && c.file != "-" {
+		f, err := os.Open(c.file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	lines := bufio.NewScanner(r)
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !send(line) {
+			return nil
+		}
+	}
+	return lines.Err()
+}
+
+func scanner(c *config) *grdp.Scanner {
+	s := grdp.NewScanner()
+	s.Timeout = c.timeout
+	s.StopTimeout = c.grace
+	s.NegotiationFlags = x224.RESTRICTED_ADMIN_MODE_REQUIRED
+	s.FingerprintNLA = c.mode == MODE_NTLM_INFO
+	s.CheckNLA = c.mode == MODE_NLA_CHECK
+	if c.downgrade {
+		s.Strategy = grdp.NEGOTIATE_DOWNGRADE
+	}
+	return s
+}
+
+/**
+ * Login to the only target, several would make a password spray: login
+ * mode checks a password on one server, it does not guess
+ */
+func login(ctx context.Context, c *config, targets <-chan string) (record, error) {
+	var addrs []string
+	for target := range targets {
+		expanded, err := grdp.ParseTarget(target)
+		if err != nil {
+			return record{}, err
+		}
+		addrs = append(addrs, expanded...)
+	}
+	if len(addrs) != 1 {
+		return record{}, fmt.Errorf("login mode takes a single target, %d given", len(addrs))
+	}
+	password, ok := os.LookupEnv(PASSWORD_ENV)
+	if !ok {
+		return record{}, fmt.Errorf("login mode reads the password from %s, it is not set", PASSWORD_ENV)
+	}
+	r := newHostRecord(addrs[0])
+	opts := []grdp.Option{grdp.WithHandshakeTimeout(c.timeout)}
+	if c.domain != "" {
+		opts = append(opts, grdp.WithDomain(c.domain))
+	}
+	g, err := grdp.New(addrs[0], opts...)
+	if err != nil {
+		return record{}, err
+	}
+	err = g.LoginContext(ctx, c.user, password)
+	outcome := grdp.ClassifyLogin(err)
+	r.Login = outcome.String()
+	// an outcome other than unknown is an answer of the server
+	r.Up = outcome != grdp.LOGIN_UNKNOWN
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r, nil
+}
+
+// line of the output for a target
+type record struct {
+	Host               string `json:"host"`
+	Port               int    `json:"port,omitempty"`
+	Up                 bool   `json:"up"`
+	SelectedProtocol   string `json:"selected_protocol,omitempty"`
+	NegotiationFailure string `json:"negotiation_failure,omitempty"`
+	NLA                string `json:"nla,omitempty"`
+	RestrictedAdmin    bool   `json:"restricted_admin,omitempty"`
+	NetBIOSDomain      string `json:"netbios_domain,omitempty"`
+	NetBIOSComputer    string `json:"netbios_computer,omitempty"`
+	DNSDomain          string `json:"dns_domain,omitempty"`
+	DNSComputer        string `json:"dns_computer,omitempty"`
+	OSVersion          string `json:"os_version,omitempty"`
+	Login              string `json:"login,omitempty"`
+	Error              string `json:"error,omitempty"`
+	// NLA enforced, told by the NLA check or by a HYBRID_REQUIRED_BY_SERVER failure
+	nlaEnforced bool
+}
+
+func newHostRecord(addr string) record {
+	r := record{Host: addr}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		r.Host = host
+		r.Port, _ = strconv.Atoi(port)
+	}
+	return r
+}
+
+func newRecord(result grdp.ScanResult) record {
+	r := newHostRecord(result.Host)
+	r.Up = result.Connected && result.Err == nil
+	if result.Err != nil {
+		r.Error = result.Err.Error()
+		return r
+	}
+	n := result.Negotiation
+	switch {
+	case !result.Negotiated:
+		r.SelectedProtocol = x224.ProtocolName(x224.PROTOCOL_RDP)
+	case n.Failed():
+		r.NegotiationFailure = x224.FailureCodeName(n.FailureCode)
+	default:
+		r.SelectedProtocol = x224.ProtocolName(n.SelectedProtocol)
+	}
+	if n.NLA != x224.NLA_UNKNOWN {
+		r.NLA = n.NLA.String()
+	}
+	r.nlaEnforced = n.NLA == x224.NLA_ENFORCED || (result.Negotiated && n.NLARequired())
+	r.RestrictedAdmin = result.RestrictedAdmin()
+	if info := result.ServerInfo; info != nil {
+		r.NetBIOSDomain = info.NetBIOSDomainName
+		r.NetBIOSComputer = info.NetBIOSComputerName
+		r.DNSDomain = info.DNSDomainName
+		r.DNSComputer = info.DNSComputerName
+		r.OSVersion = info.Version.String()
+	}
+	return r
+}
+
+var csvColumns = []string{"host", "port", "up", "selected_protocol", "negotiation_failure", "nla", "restricted_admin",
+	"netbios_domain", "netbios_computer", "dns_domain", "dns_computer", "os_version", "login", "error"}
+
+func (r record) csv() []string {
+	port := ""
+	if r.Port != 0 {
+		port = strconv.Itoa(r.Port)
+	}
+	return []string{r.Host, port, strconv.FormatBool(r.Up), r.SelectedProtocol, r.NegotiationFailure, r.NLA,
+		strconv.FormatBool(r.RestrictedAdmin), r.NetBIOSDomain, r.NetBIOSComputer, r.DNSDomain, r.DNSComputer,
+		r.OSVersion, r.Login, r.Error}
+}
+
+// host:port then the fields that are set
+func (r record) text() string {
+	fields := []string{net.JoinHostPort(r.Host, strconv.Itoa(r.Port))}
+	if r.Error != "" && r.Login == "" {
+		return fields[0] + " error: " + r.Error
+	}
+	add := func(name, value string) {
+		if value != "" {
+			fields = append(fields, name+"="+value)
+		}
+	}
+	add("protocol", r.SelectedProtocol)
+	add("failure", r.NegotiationFailure)
+	add("nla", r.NLA)
+	if r.RestrictedAdmin {
+		fields = append(fields, "restricted_admin")
+	}
+	add("domain", r.NetBIOSDomain)
+	add("computer", r.NetBIOSComputer)
+	add("dns_domain", r.DNSDomain)
+	add("dns_computer", r.DNSComputer)
+	add("os", r.OSVersion)
+	add("login", r.Login)
+	if r.Error != "" {
+		fields = append(fields, "error: "+r.Error)
+	}
+	return strings.Join(fields, " ")
+}
+
+// writes the records in a format, the first error is kept for flush
+type output struct {
+	format string
+	w      io.Writer
+	csv    *csv.Writer
+	enc    *json.Encoder
+	err    error
+}
+
+func newOutput(format string, w io.Writer) *output {
+	o := &output{format: format, w: w}
+	switch format {
+	case "csv":
+		o.csv = csv.NewWriter(w)
+		o.err = o.csv.Write(csvColumns)
+	case "json":
+		o.enc = json.NewEncoder(w)
+	}
+	return o
+}
+
+func (o *output) write(r record) {
+	if o.err != nil {
+		return
+	}
+	switch o.format {
+	case "csv":
+		o.err = o.csv.Write(r.csv())
+	case "json":
+		o.err = o.enc.Encode(r)
+	default:
+		_, o.err = fmt.Fprintln(o.w, r.text())
+	}
+}
+
+func (o *output) flush() error {
+	if o.csv != nil && o.err == nil {
+		o.csv.Flush()
+		o.err = o.csv.Error()
+	}
+	return o.err
+}
+
+type summary struct {
+	targets, up, nlaEnforced, authSucceeded, errors int
+}
+
+func (s *summary) add(r record) {
+	s.targets++
+	if r.Up {
+		s.up++
+	}
+	if r.nlaEnforced {
+		s.nlaEnforced++
+	}
+	if r.Login == grdp.LOGIN_SUCCESS.String() {
+		s.authSucceeded++
+	}
+	if r.Error != "" {
+		s.errors++
+	}
+}
+
+func (s *summary) print(w io.Writer, mode string) {
+	fmt.Fprintf(w, "%d targets: %d up, %d nla enforced", s.targets, s.up, s.nlaEnforced)
+	if mode == MODE_LOGIN {
+		fmt.Fprintf(w, ", %d auth succeeded", s.authSucceeded)
+	}
+	fmt.Fprintf(w, ", %d errors\n", s.errors)
+}
@@ -0,0 +1,308 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/protocol/nla"
+	"github.com/icodeface/grdp/protocol/x224"
+)
+
+// built by TestMain: go run exits with 1 whatever the status of the command
+var binary string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "rdpscan")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	binary = filepath.Join(dir, "rdpscan")
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	code := 1
+	if err = build.Run(); err == nil {
+		code = m.Run()
+	}
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// output of rdpscan run with args, env added to the environment
+func rdpscan(t *testing.T, stdin string, env []string, args ...string) (stdout, stderr string, code int) {
+	cmd := exec.Command(binary, args...)
+	cmd.Env = append(environ(), env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), code
+}
+
+// environment of the tests without the password
+func environ() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "RDPSCAN_PASSWORD=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// address of a port nothing listens on
+func closedPort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestProbe(t *testing.T) {
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponseFlags(x224.PROTOCOL_HYBRID, x224.RESTRICTED_ADMIN_MODE_SUPPORTED),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := rdpscan(t, "", nil, "-o", "json", srv.Addr())
+	if code != 0 {
+		t.Fatal(code, stderr)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	var r map[string]interface{}
+	if err = json.Unmarshal([]byte(stdout), &r); err != nil {
+		t.Fatal(stdout, err)
+	}
+	if r["host"] != "127.0.0.1" || r["up"] != true || r["selected_protocol"] != "PROTOCOL_HYBRID" || r["restricted_admin"] != true {
+		t.Error(r)
+	}
+	if expected := "1 targets: 1 up, 0 nla enforced, 0 errors\n"; stderr != expected {
+		t.Error(stderr, "not equal to", expected)
+	}
+}
+
+func TestNLACheck(t *testing.T) {
+	srv, err := rdptest.NewServer(
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID), rdptest.ExpectClose()},
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER), rdptest.ExpectClose()},
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID), rdptest.ExpectClose()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the target comes from stdin, after a comment
+	stdout, stderr, code := rdpscan(t, "# lab\n"+srv.Addr()+"\n", nil, "-mode", "nla-check", "-o", "csv")
+	if code != 0 {
+		t.Fatal(code, stderr)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "host,port,up,") ||
+		!strings.HasPrefix(lines[1], "127.0.0.1,"+srv.Addr()[len("127.0.0.1:"):]+",true,PROTOCOL_HYBRID,,enforced,") {
+		t.Error(stdout)
+	}
+	if expected := "1 targets: 1 up, 1 nla enforced, 0 errors\n"; stderr != expected {
+		t.Error(stderr, "not equal to", expected)
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	legacy := []rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.StandardSecurityOnly(), rdptest.ExpectClose()}
+	srv, err := rdptest.NewServer(legacy, legacy, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := rdpscan(t, "", nil, "-downgrade", srv.Addr())
+	if code != 0 {
+		t.Fatal(code, stderr)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	if expected := srv.Addr() + " protocol=PROTOCOL_RDP\n"; stdout != expected {
+		t.Error(stdout, "not equal to", expected)
+	}
+}
+
+func TestTargetsFile(t *testing.T) {
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "rdpscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	refused := closedPort(t)
+	file := filepath.Join(dir, "targets")
+	if err = ioutil.WriteFile(file, []byte(srv.Addr()+"\n\n"+refused+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := rdpscan(t, "", nil, "-f", file)
+	if code != 1 {
+		t.Error(code, "not equal to", 1, stderr)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(stdout, srv.Addr()+" protocol=PROTOCOL_SSL\n") || !strings.Contains(stdout, refused+" error: ") {
+		t.Error(stdout)
+	}
+	if expected := "2 targets: 1 up, 0 nla enforced, 1 errors\n"; stderr != expected {
+		t.Error(stderr, "not equal to", expected)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+		rdptest.StartTLS(nil),
+		rdptest.ReadNTLMNegotiate(),
+		rdptest.SendNTLMChallenge(0xe28a8235),
+		rdptest.ReadTSRequest(),
+		rdptest.SendNTStatus(nla.STATUS_LOGON_FAILURE),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, code := rdpscan(t, "", []string{"RDPSCAN_PASSWORD=secret"}, "-mode", "login", "-user", "alice", srv.Addr())
+	if code != 1 {
+		t.Error(code, "not equal to", 1, stderr)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	if !strings.HasPrefix(stdout, srv.Addr()+" login=LOGIN_BAD_CREDENTIALS error: ") {
+		t.Error(stdout)
+	}
+	if expected := "1 targets: 1 up, 0 nla enforced, 0 auth succeeded, 1 errors\n"; stderr != expected {
+		t.Error(stderr, "not equal to", expected)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	password := []string{"RDPSCAN_PASSWORD=secret"}
+	tests := []struct {
+		name string
+		env  []string
+		args []string
+	}{
+		{"mode", nil, []string{"-mode", "spray", "127.0.0.1"}},
+		{"format", nil, []string{"-o", "xml", "127.0.0.1"}},
+		{"no user", password, []string{"-mode", "login", "127.0.0.1"}},
+		{"no password", nil, []string{"-mode", "login", "-user", "alice", "127.0.0.1"}},
+		// login checks one server, it is no spray over targets
+		{"login targets", password, []string{"-mode", "login", "-user", "alice", "127.0.0.1", "127.0.0.2"}},
+		{"login ports", password, []string{"-mode", "login", "-user", "alice", "127.0.0.1:3389,3390"}},
+	}
+	for _, test := range tests {
+		stdout, _, code := rdpscan(t, "", test.env, test.args...)
+		if code != 2 || stdout != "" {
+			t.Error(test.name, code, stdout)
+		}
+	}
+}
+
+// rdpscan started with args against a server answering after delay,
+// interrupted by signals once the server read the connection request
+func interrupt(t *testing.T, delay time.Duration, signals int, args ...string) (stdout, stderr string, code int, d time.Duration) {
+	requested := make(chan struct{})
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		func(s *rdptest.Session) error {
+			close(requested)
+			return nil
+		},
+		rdptest.Sleep(delay),
+		rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	cmd := exec.Command(binary, append(args, srv.Addr())...)
+	cmd.Env = environ()
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-requested:
+	case <-time.After(30 * time.Second):
+		t.Fatal("no connection request")
+	}
+	start := time.Now()
+	for i := 0; i < signals; i++ {
+		if i > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		cmd.Process.Signal(os.Interrupt)
+	}
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), code, time.Since(start)
+}
+
+func TestInterrupt(t *testing.T) {
+	// the probe in flight ends within the grace period, its result is written
+	stdout, stderr, code, _ := interrupt(t, 300*time.Millisecond, 1, "-timeout", "30s", "-grace", "30s")
+	if code != 1 || !strings.HasSuffix(stdout, " protocol=PROTOCOL_SSL\n") ||
+		stderr != "1 targets: 1 up, 0 nla enforced, 0 errors\nrdpscan: interrupted\n" {
+		t.Error(code, stdout, stderr)
+	}
+
+	// it is aborted after the grace period, or by a second signal
+	for _, test := range []struct {
+		signals int
+		args    []string
+	}{
+		{1, []string{"-timeout", "30s", "-grace", "100ms"}},
+		{2, []string{"-timeout", "30s", "-grace", "30s"}},
+	} {
+		stdout, stderr, code, d := interrupt(t, 10*time.Second, test.signals, test.args...)
+		if code != 1 || d > 5*time.Second {
+			t.Error(test.signals, code, d)
+		}
+		// whether the aborted probe is delivered before the scan ends is a race
+		if strings.Contains(stdout, "protocol=") || !strings.Contains(stderr, " targets: 0 up, ") ||
+			!strings.HasSuffix(stderr, "rdpscan: interrupted\n") {
+			t.Error(test.signals, stdout, stderr)
+		}
+	}
+}
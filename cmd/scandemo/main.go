@@ -0,0 +1,97 @@
+// Command scandemo scans synthetic hosts with grdp.Scanner: a local
+// listener answers part of them as an NLA server, the others point to
+// a closed port.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/icodeface/grdp"
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/protocol/x224"
+	"net"
+	"os"
+	"time"
+)
+
+func main() {
+	count := flag.Int("hosts", 1000, "number of synthetic hosts")
+	listening := flag.Int("listening", 800, "hosts answered by the listener, the others are refused")
+	concurrency := flag.Int("concurrency", 64, "probes at a time")
+	flag.Parse()
+	if *listening > *count {
+		*listening = *count
+	}
+
+	scenarios := make([][]rdptest.Step, *listening)
+	for i := range scenarios {
+		scenarios[i] = []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+			rdptest.ExpectClose(),
+		}
+	}
+	srv, err := rdptest.NewServer(scenarios...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer srv.Close()
+	refused, err := closedPort()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	hosts := make(chan string)
+	go func() {
+		defer close(hosts)
+		for i := 0; i < *count; i++ {
+			if i < *listening {
+				hosts <- srv.Addr()
+			} else {
+				hosts <- refused
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	scanner := grdp.NewScanner()
+	scanner.Timeout = 2 * time.Second
+	scanner.ProgressInterval = 100 * time.Millisecond
+	scanner.Progress = func(p grdp.ScanProgress) {
+		fmt.Fprintf(os.Stderr, "\r%d/%d done, %d in flight, eta %v ", p.Completed, p.Total, p.InFlight, p.ETA.Round(time.Millisecond))
+	}
+	start := time.Now()
+	var negotiated, failed int
+	var rtt time.Duration
+	for result := range scanner.Scan(ctx, hosts, *concurrency) {
+		if result.Err != nil {
+			failed++
+			continue
+		}
+		negotiated++
+		rtt += result.RTT
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Printf("%d hosts in %v: %d negotiated, %d failed\n", *count, time.Since(start), negotiated, failed)
+	if negotiated > 0 {
+		fmt.Printf("mean rtt %v\n", rtt/time.Duration(negotiated))
+	}
+	if err = srv.Wait(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// address of a port nothing listens on
+func closedPort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
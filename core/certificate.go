@@ -0,0 +1,50 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+/**
+ * Certificate presented by the server during StartTLS. The common name
+ * is usually the machine name, NotBefore hints at when it was installed
+ */
+type CertificateInfo struct {
+	CommonName string
+	// subject alternative names
+	DNSNames    []string
+	IPAddresses []net.IP
+	Issuer      string
+	NotBefore   time.Time
+	NotAfter    time.Time
+	// hex of the serial number
+	SerialNumber string
+	// hex of the SHA-256 of the DER certificate
+	SHA256 string
+}
+
+func NewCertificateInfo(cert *x509.Certificate) *CertificateInfo {
+	sum := sha256.Sum256(cert.Raw)
+	return &CertificateInfo{
+		CommonName:   cert.Subject.CommonName,
+		DNSNames:     cert.DNSNames,
+		IPAddresses:  cert.IPAddresses,
+		Issuer:       cert.Issuer.String(),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		SerialNumber: cert.SerialNumber.Text(16),
+		SHA256:       hex.EncodeToString(sum[:]),
+	}
+}
+
+// certificate of the server once StartTLS or StartNLA completed its handshake
+func (s *SocketLayer) PeerCertificate() (*CertificateInfo, bool) {
+	state, ok := s.TLSState()
+	if !ok || len(state.PeerCertificates) == 0 {
+		return nil, false
+	}
+	return NewCertificateInfo(state.PeerCertificates[0]), true
+}
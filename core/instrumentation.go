@@ -0,0 +1,253 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+ * phases reported to Instrumentation and logged, x224, tls, nla, mcs
+ * and license happen inside connect. The layers log mcs, sec and pdu
+ * as they take over
+ */
+const (
+	PHASE_DIAL    = "dial"
+	PHASE_PROXY   = "proxy"
+	PHASE_X224    = "x224"
+	PHASE_CONNECT = "connect"
+	PHASE_TLS     = "tls"
+	PHASE_NLA     = "nla"
+	PHASE_MCS     = "mcs"
+	PHASE_SEC     = "sec"
+	PHASE_PDU     = "pdu"
+	// from the MCS connect response to the end of licensing
+	PHASE_LICENSE = "license"
+)
+
+/**
+ * Callbacks for a metrics system. BytesRead and BytesWritten count what
+ * the layers exchange through the SocketLayer, after TLS. They are called
+ * from the reading goroutines of each connection, implementations must
+ * be safe for concurrent use and return quickly
+ */
+type Instrumentation interface {
+	ConnOpened(addr string)
+	// reason is the error that ended the attempt, nil when it succeeded
+	ConnClosed(reason error)
+	BytesRead(n int)
+	BytesWritten(n int)
+	PhaseStarted(name string)
+	PhaseEnded(name string)
+	// outcome of CredSSP, nil when the credentials were accepted
+	AuthResult(outcome error)
+}
+
+// the default, does nothing
+type NopInstrumentation struct{}
+
+func (NopInstrumentation) ConnOpened(addr string)   {}
+func (NopInstrumentation) ConnClosed(reason error)  {}
+func (NopInstrumentation) BytesRead(n int)          {}
+func (NopInstrumentation) BytesWritten(n int)       {}
+func (NopInstrumentation) PhaseStarted(name string) {}
+func (NopInstrumentation) PhaseEnded(name string)   {}
+func (NopInstrumentation) AuthResult(outcome error) {}
+
+// totals of a CountingInstrumentation
+type InstrumentationCounts struct {
+	ConnsOpened    int
+	ConnsClosed    int
+	ConnsFailed    int
+	BytesRead      int64
+	BytesWritten   int64
+	Phases         map[string]int
+	PhaseDurations map[string]time.Duration
+	AuthSuccesses  int
+	AuthFailures   int
+}
+
+// Instrumentation aggregating counts, for users without a metrics system
+type CountingInstrumentation struct {
+	mu      sync.Mutex
+	counts  InstrumentationCounts
+	started map[string]time.Time
+}
+
+func NewCountingInstrumentation() *CountingInstrumentation {
+	return &CountingInstrumentation{
+		counts: InstrumentationCounts{
+			Phases:         make(map[string]int),
+			PhaseDurations: make(map[string]time.Duration),
+		},
+		started: make(map[string]time.Time),
+	}
+}
+
+// copy of the totals so far
+func (c *CountingInstrumentation) Counts() InstrumentationCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := c.counts
+	counts.Phases = make(map[string]int)
+	for name, n := range c.counts.Phases {
+		counts.Phases[name] = n
+	}
+	counts.PhaseDurations = make(map[string]time.Duration)
+	for name, d := range c.counts.PhaseDurations {
+		counts.PhaseDurations[name] = d
+	}
+	return counts
+}
+
+func (c *CountingInstrumentation) ConnOpened(addr string) {
+	c.mu.Lock()
+	c.counts.ConnsOpened++
+	c.mu.Unlock()
+}
+
+func (c *CountingInstrumentation) ConnClosed(reason error) {
+	c.mu.Lock()
+	c.counts.ConnsClosed++
+	if reason != nil {
+		c.counts.ConnsFailed++
+	}
+	c.mu.Unlock()
+}
+
+func (c *CountingInstrumentation) BytesRead(n int) {
+	c.mu.Lock()
+	c.counts.BytesRead += int64(n)
+	c.mu.Unlock()
+}
+
+func (c *CountingInstrumentation) BytesWritten(n int) {
+	c.mu.Lock()
+	c.counts.BytesWritten += int64(n)
+	c.mu.Unlock()
+}
+
+func (c *CountingInstrumentation) PhaseStarted(name string) {
+	c.mu.Lock()
+	c.started[name] = time.Now()
+	c.mu.Unlock()
+}
+
+// counted once started, durations of concurrent phases with the same name mix up
+func (c *CountingInstrumentation) PhaseEnded(name string) {
+	c.mu.Lock()
+	if start, ok := c.started[name]; ok {
+		delete(c.started, name)
+		c.counts.Phases[name]++
+		c.counts.PhaseDurations[name] += time.Since(start)
+	}
+	c.mu.Unlock()
+}
+
+func (c *CountingInstrumentation) AuthResult(outcome error) {
+	c.mu.Lock()
+	if outcome == nil {
+		c.counts.AuthSuccesses++
+	} else {
+		c.counts.AuthFailures++
+	}
+	c.mu.Unlock()
+}
+
+// calls all the instrumentations, see io.MultiWriter
+type multiInstrumentation []Instrumentation
+
+func MultiInstrumentation(instrs ...Instrumentation) Instrumentation {
+	return multiInstrumentation(append([]Instrumentation{}, instrs...))
+}
+
+func (m multiInstrumentation) ConnOpened(addr string) {
+	for _, i := range m {
+		i.ConnOpened(addr)
+	}
+}
+
+func (m multiInstrumentation) ConnClosed(reason error) {
+	for _, i := range m {
+		i.ConnClosed(reason)
+	}
+}
+
+func (m multiInstrumentation) BytesRead(n int) {
+	for _, i := range m {
+		i.BytesRead(n)
+	}
+}
+
+func (m multiInstrumentation) BytesWritten(n int) {
+	for _, i := range m {
+		i.BytesWritten(n)
+	}
+}
+
+func (m multiInstrumentation) PhaseStarted(name string) {
+	for _, i := range m {
+		i.PhaseStarted(name)
+	}
+}
+
+func (m multiInstrumentation) PhaseEnded(name string) {
+	for _, i := range m {
+		i.PhaseEnded(name)
+	}
+}
+
+func (m multiInstrumentation) AuthResult(outcome error) {
+	for _, i := range m {
+		i.AuthResult(outcome)
+	}
+}
+
+/**
+ * Instrumentation timing the phases of one connection, from their
+ * PhaseStarted to their PhaseEnded read on the clock now. A phase
+ * started again adds up
+ */
+type PhaseTimer struct {
+	NopInstrumentation
+	now       func() time.Time
+	mu        sync.Mutex
+	started   map[string]time.Time
+	durations map[string]time.Duration
+}
+
+func NewPhaseTimer(now func() time.Time) *PhaseTimer {
+	return &PhaseTimer{
+		now:       now,
+		started:   make(map[string]time.Time),
+		durations: make(map[string]time.Duration),
+	}
+}
+
+func (t *PhaseTimer) PhaseStarted(name string) {
+	now := t.now()
+	t.mu.Lock()
+	t.started[name] = now
+	t.mu.Unlock()
+}
+
+// ignored when the phase did not start
+func (t *PhaseTimer) PhaseEnded(name string) {
+	now := t.now()
+	t.mu.Lock()
+	if start, ok := t.started[name]; ok {
+		delete(t.started, name)
+		t.durations[name] += now.Sub(start)
+	}
+	t.mu.Unlock()
+}
+
+// copy of the durations of the phases that ended
+func (t *PhaseTimer) Durations() map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	durations := make(map[string]time.Duration, len(t.durations))
+	for name, d := range t.durations {
+		durations[name] = d
+	}
+	return durations
+}
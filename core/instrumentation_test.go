@@ -0,0 +1,163 @@
+package core_test
+
+import (
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/protocol/nla"
+)
+
+type fakeAuthenticator struct{}
+
+func (fakeAuthenticator) InitSecContext(in []byte) ([]byte, bool, error) {
+	if in == nil {
+		return []byte("negotiate"), false, nil
+	}
+	return []byte("authenticate"), true, nil
+}
+
+func (fakeAuthenticator) Wrap(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (fakeAuthenticator) Unwrap(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+/**
+ * CredSSP server accepting any credentials, version 2 binds the public key incremented.
+ * With stall it then sends nothing until the client closes
+ */
+func serveCredSSP(t *testing.T, conn net.Conn, stall bool) {
+	defer conn.Close()
+	cert := serverCertificate(t)
+	tlsConn := stdtls.Server(conn, &stdtls.Config{Certificates: []stdtls.Certificate{cert}})
+	x509Cert, _ := x509.ParseCertificate(cert.Certificate[0])
+	var info struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+	asn1.Unmarshal(x509Cert.RawSubjectPublicKeyInfo, &info)
+	pubKeyAuth := append([]byte{}, info.PublicKey.Bytes...)
+	pubKeyAuth[0]++
+
+	replies := []*nla.TSRequest{
+		{Version: 2, NegoTokens: []nla.NegoToken{{Data: []byte("challenge")}}},
+		{Version: 2, PubKeyAuth: pubKeyAuth},
+		nil,
+	}
+	buff := make([]byte, 4096)
+	for _, reply := range replies {
+		if _, err := tlsConn.Read(buff); err != nil {
+			t.Error(err)
+			return
+		}
+		if reply != nil {
+			data, _ := asn1.Marshal(*reply)
+			tlsConn.Write(data)
+		}
+	}
+	if stall {
+		io.Copy(ioutil.Discard, tlsConn)
+	}
+}
+
+func TestSocketLayerInstrumentation(t *testing.T) {
+	client, server := net.Pipe()
+	go serveCredSSP(t, server, false)
+
+	instr := core.NewCountingInstrumentation()
+	layer := core.NewSocketLayer(client, nla.NewCredSSP(fakeAuthenticator{}, "CORP", "alice", "secret"), glog.Default())
+	defer layer.Close()
+	layer.SetInstrumentation(instr)
+	if err := layer.StartNLA(); err != nil {
+		t.Fatal(err)
+	}
+	counts := instr.Counts()
+	if counts.AuthSuccesses != 1 || counts.AuthFailures != 0 {
+		t.Error(counts.AuthSuccesses, counts.AuthFailures, "not equal to", 1, 0)
+	}
+	if counts.Phases[core.PHASE_TLS] != 1 || counts.Phases[core.PHASE_NLA] != 1 {
+		t.Error(counts.Phases, "not equal to", "tls and nla once")
+	}
+	// the CredSSP messages, counted above TLS
+	if counts.BytesRead == 0 || counts.BytesWritten == 0 {
+		t.Error("bytes", counts.BytesRead, counts.BytesWritten)
+	}
+}
+
+func TestCountingInstrumentation(t *testing.T) {
+	instr := core.NewCountingInstrumentation()
+	instr.ConnOpened("10.0.0.1:3389")
+	instr.PhaseEnded(core.PHASE_DIAL)
+	instr.PhaseStarted(core.PHASE_DIAL)
+	instr.PhaseEnded(core.PHASE_DIAL)
+	instr.AuthResult(nla.ErrLogonFailure)
+	instr.ConnClosed(nla.ErrLogonFailure)
+	counts := instr.Counts()
+	if counts.ConnsOpened != 1 || counts.ConnsClosed != 1 || counts.ConnsFailed != 1 || counts.AuthFailures != 1 {
+		t.Errorf("%+v", counts)
+	}
+	// an end without a start is not counted
+	if counts.Phases[core.PHASE_DIAL] != 1 {
+		t.Error(counts.Phases[core.PHASE_DIAL], "not equal to", 1)
+	}
+}
+
+// clock moving forward by step at each reading
+func steppingClock(step time.Duration) func() time.Time {
+	now := time.Unix(0, 0)
+	return func() time.Time {
+		now = now.Add(step)
+		return now
+	}
+}
+
+func TestPhaseTimer(t *testing.T) {
+	timer := core.NewPhaseTimer(steppingClock(time.Millisecond))
+	timer.PhaseStarted(core.PHASE_DIAL)
+	timer.PhaseEnded(core.PHASE_DIAL)
+	timer.PhaseStarted(core.PHASE_TLS)
+	timer.PhaseEnded(core.PHASE_NLA)
+	timer.PhaseEnded(core.PHASE_TLS)
+	// a second TLS handshake adds up
+	timer.PhaseStarted(core.PHASE_TLS)
+	timer.PhaseEnded(core.PHASE_TLS)
+	timer.PhaseStarted(core.PHASE_MCS)
+	durations := timer.Durations()
+	expected := map[string]time.Duration{core.PHASE_DIAL: time.Millisecond, core.PHASE_TLS: 3 * time.Millisecond}
+	if len(durations) != len(expected) {
+		t.Fatal(durations, "not equal to", expected)
+	}
+	for name, d := range expected {
+		if durations[name] != d {
+			t.Error(name, durations[name], "not equal to", d)
+		}
+	}
+}
+
+func TestMultiInstrumentation(t *testing.T) {
+	a, b := core.NewCountingInstrumentation(), core.NewCountingInstrumentation()
+	instr := core.MultiInstrumentation(a, b)
+	instr.ConnOpened("10.0.0.1:3389")
+	instr.BytesRead(3)
+	instr.BytesWritten(5)
+	instr.PhaseStarted(core.PHASE_DIAL)
+	instr.PhaseEnded(core.PHASE_DIAL)
+	instr.AuthResult(nil)
+	instr.ConnClosed(nil)
+	for _, counts := range []core.InstrumentationCounts{a.Counts(), b.Counts()} {
+		if counts.ConnsOpened != 1 || counts.ConnsClosed != 1 || counts.BytesRead != 3 || counts.BytesWritten != 5 ||
+			counts.Phases[core.PHASE_DIAL] != 1 || counts.AuthSuccesses != 1 {
+			t.Errorf("%+v", counts)
+		}
+	}
+}
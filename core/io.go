@@ -2,70 +2,116 @@ package core
 
 import (
 	"encoding/binary"
-	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/icodeface/grdp/glog"
 	"io"
 )
 
 type ReadBytesComplete func(result []byte, err error)
 
+// the owner of the reader closed it, nothing more will be read
+var ErrReadCancelled = errors.New("read cancelled")
+
 func StartReadBytes(len int, r io.Reader, cb ReadBytesComplete) {
+	StartReadBytesUntil(nil, len, r, cb)
+}
+
+/**
+ * Read len bytes in the background and call cb exactly once. Once done
+ * is closed cb gets ErrReadCancelled instead of the result, the owner
+ * closes r along with done so that a pending read returns at once
+ */
+func StartReadBytesUntil(done <-chan struct{}, len int, r io.Reader, cb ReadBytesComplete) {
 	b := make([]byte, len)
 	go func() {
+		select {
+		case <-done:
+			cb(nil, ErrReadCancelled)
+			return
+		default:
+		}
 		_, err := io.ReadFull(r, b)
-		glog.Debug("GetBytes: ", hex.EncodeToString(b))
+		select {
+		case <-done:
+			cb(nil, ErrReadCancelled)
+			return
+		default:
+		}
+		if glog.IsDebug() {
+			glog.Debug("GetBytes: ", Dump(b, DumpMax))
+		}
 		cb(b, err)
 	}()
 }
 
+/**
+ * The Read helpers below read fixed size fields with io.ReadFull, a
+ * truncated input fails with io.ErrUnexpectedEOF and the value is
+ * zero, even when nothing at all was left to read
+ */
 func ReadBytes(len int, r io.Reader) ([]byte, error) {
+	// a length computed from the input, smaller than the header it counts
+	if len < 0 {
+		return nil, fmt.Errorf("read %d bytes", len)
+	}
 	b := make([]byte, len)
 	length, err := io.ReadFull(r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	return b[:length], err
 }
 
+// the next len bytes, r is left where it was
+func Peek(n int, r io.ReadSeeker) ([]byte, error) {
+	b, err := ReadBytes(n, r)
+	if _, serr := r.Seek(-int64(len(b)), io.SeekCurrent); serr != nil && err == nil {
+		err = serr
+	}
+	return b, err
+}
+
 func ReadByte(r io.Reader) (byte, error) {
 	b, err := ReadBytes(1, r)
-	return b[0], err
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
 }
 
 func ReadUInt8(r io.Reader) (uint8, error) {
-	b, err := ReadBytes(1, r)
-	return uint8(b[0]), err
+	return ReadByte(r)
 }
 
 func ReadUint16LE(r io.Reader) (uint16, error) {
-	b := make([]byte, 2)
-	_, err := io.ReadFull(r, b)
+	b, err := ReadBytes(2, r)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	return binary.LittleEndian.Uint16(b), nil
 }
 
 func ReadUint16BE(r io.Reader) (uint16, error) {
-	b := make([]byte, 2)
-	_, err := io.ReadFull(r, b)
+	b, err := ReadBytes(2, r)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	return binary.BigEndian.Uint16(b), nil
 }
 
 func ReadUInt32LE(r io.Reader) (uint32, error) {
-	b := make([]byte, 4)
-	_, err := io.ReadFull(r, b)
+	b, err := ReadBytes(4, r)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	return binary.LittleEndian.Uint32(b), nil
 }
 
 func ReadUInt32BE(r io.Reader) (uint32, error) {
-	b := make([]byte, 4)
-	_, err := io.ReadFull(r, b)
+	b, err := ReadBytes(4, r)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	return binary.BigEndian.Uint32(b), nil
 }
@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"encoding/hex"
 	"github.com/icodeface/grdp/core"
+	"io"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestWriteUInt16LE(t *testing.T) {
@@ -16,3 +20,79 @@ func TestWriteUInt16LE(t *testing.T) {
 		t.Error(result, "not equals to", expected)
 	}
 }
+
+func TestReadTruncated(t *testing.T) {
+	reads := []struct {
+		name string
+		size int
+		read func(r io.Reader) error
+	}{
+		{"ReadByte", 1, func(r io.Reader) error { _, err := core.ReadByte(r); return err }},
+		{"ReadUInt8", 1, func(r io.Reader) error { _, err := core.ReadUInt8(r); return err }},
+		{"ReadUint16LE", 2, func(r io.Reader) error { _, err := core.ReadUint16LE(r); return err }},
+		{"ReadUint16BE", 2, func(r io.Reader) error { _, err := core.ReadUint16BE(r); return err }},
+		{"ReadUInt32LE", 4, func(r io.Reader) error { _, err := core.ReadUInt32LE(r); return err }},
+		{"ReadUInt32BE", 4, func(r io.Reader) error { _, err := core.ReadUInt32BE(r); return err }},
+		{"ReadBytes", 8, func(r io.Reader) error { _, err := core.ReadBytes(8, r); return err }},
+	}
+	for _, c := range reads {
+		// nothing left, then one byte short
+		for _, n := range []int{0, c.size - 1} {
+			if err := c.read(bytes.NewReader(make([]byte, n))); err != io.ErrUnexpectedEOF {
+				t.Error(c.name, n, err, "not equal to", io.ErrUnexpectedEOF)
+			}
+		}
+	}
+}
+
+func TestReadUInt32BE(t *testing.T) {
+	r := bytes.NewReader([]byte{1, 2, 3, 4, 5})
+	result, err := core.ReadUInt32BE(r)
+	if err != nil || result != 0x01020304 {
+		t.Error(result, err, "not equal to", 0x01020304)
+	}
+	if _, err = core.ReadUint16LE(r); err != io.ErrUnexpectedEOF {
+		t.Error(err, "not equal to", io.ErrUnexpectedEOF)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	r := bytes.NewReader([]byte{1, 2, 3})
+	b, err := core.Peek(2, r)
+	if err != nil || hex.EncodeToString(b) != "0102" {
+		t.Error(hex.EncodeToString(b), err, "not equal to", "0102")
+	}
+	if r.Len() != 3 {
+		t.Error(r.Len(), "not equal to", 3)
+	}
+	b, err = core.Peek(4, r)
+	if err != io.ErrUnexpectedEOF || r.Len() != 3 {
+		t.Error(err, r.Len(), "not equal to", io.ErrUnexpectedEOF, 3)
+	}
+}
+
+func TestStartReadBytesUntilCancel(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		var calls int32
+		result := make(chan error, 2)
+		core.StartReadBytesUntil(done, 4, client, func(s []byte, err error) {
+			atomic.AddInt32(&calls, 1)
+			result <- err
+		})
+		// the owner closes while the read is in flight
+		go server.Write([]byte{1, 2})
+		close(done)
+		client.Close()
+
+		if err := <-result; err != core.ErrReadCancelled {
+			t.Error(err, "not equal to", core.ErrReadCancelled)
+		}
+		time.Sleep(time.Millisecond)
+		if n := atomic.LoadInt32(&calls); n != 1 {
+			t.Fatal("callback called", n, "times")
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// bytes of a packet written to the debug log, the rest is only counted
+var DumpMax = 256
+
+// bytes of a packet that must not be logged
+type Range struct {
+	Offset int
+	Length int
+}
+
+/**
+ * Offset, hex and ASCII rows of at most max bytes of data, each row
+ * starts with a line break. Build it only when glog.IsDebug()
+ */
+func Dump(data []byte, max int) string {
+	return Redact(data, max, nil)
+}
+
+// Dump with the bytes in ranges masked
+func Redact(data []byte, max int, ranges []Range) string {
+	n := len(data)
+	if max >= 0 && n > max {
+		n = max
+	}
+	masked := func(i int) bool {
+		for _, r := range ranges {
+			if i >= r.Offset && i < r.Offset+r.Length {
+				return true
+			}
+		}
+		return false
+	}
+	var b strings.Builder
+	for row := 0; row < n; row += 16 {
+		fmt.Fprintf(&b, "\n%04x ", row)
+		ascii := make([]byte, 0, 16)
+		for i := row; i < row+16; i++ {
+			if i%16 == 8 {
+				b.WriteByte(' ')
+			}
+			switch {
+			case i >= n:
+				b.WriteString("   ")
+			case masked(i):
+				b.WriteString(" **")
+				ascii = append(ascii, '*')
+			default:
+				fmt.Fprintf(&b, " %02x", data[i])
+				if data[i] >= 0x20 && data[i] < 0x7f {
+					ascii = append(ascii, data[i])
+				} else {
+					ascii = append(ascii, '.')
+				}
+			}
+		}
+		fmt.Fprintf(&b, "  |%s|", ascii)
+	}
+	if n < len(data) {
+		fmt.Fprintf(&b, " (+%d more)", len(data)-n)
+	}
+	return b.String()
+}
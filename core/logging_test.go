@@ -0,0 +1,34 @@
+package core_test
+
+import (
+	"github.com/icodeface/grdp/core"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	data := []byte("\x03\x00\x00\x13hello, world!\x00\x01\x02")
+	result := core.Dump(data, 18)
+	expected := "\n0000  03 00 00 13 68 65 6c 6c  6f 2c 20 77 6f 72 6c 64  |....hello, world|" +
+		"\n0010  21 00" + strings.Repeat(" ", 45) + "|!.|" +
+		" (+2 more)"
+	if result != expected {
+		t.Error(result, "not equal to", expected)
+	}
+	expected = "\n0000  03 00 00 13" + strings.Repeat(" ", 39) + "|....|"
+	if result = core.Dump(data[:4], core.DumpMax); result != expected {
+		t.Error(result, "not equal to", expected)
+	}
+	if result = core.Dump(nil, core.DumpMax); result != "" {
+		t.Error(result, "not equal to", "")
+	}
+}
+
+func TestRedact(t *testing.T) {
+	data := []byte("user\x00pass\x00")
+	result := core.Redact(data, core.DumpMax, []core.Range{{Offset: 5, Length: 4}})
+	expected := "\n0000  75 73 65 72 00 ** ** **  ** 00" + strings.Repeat(" ", 20) + "|user.****.|"
+	if result != expected {
+		t.Error(result, "not equal to", expected)
+	}
+}
@@ -1,46 +1,205 @@
 package core
 
 import (
-	"encoding/hex"
+	"bufio"
+	"bytes"
+	"encoding/asn1"
+	"errors"
 	"fmt"
 	"github.com/icodeface/grdp/glog"
 	"github.com/icodeface/grdp/protocol/nla"
 	"github.com/icodeface/tls"
+	"io"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+/**
+ * how long to wait for a Restricted Admin refusal after the credentials
+ * are sent, when SetRestrictedAdminWait is not called. An accepting
+ * server sends nothing until the MCS connect initial, so silence for
+ * that long is taken as acceptance: a heuristic, a slow server refusing
+ * later is reported as accepting
+ */
+var RestrictedAdminWait = time.Second
+
+var ErrTLSHandshake = errors.New("tls handshake failed")
+
+// a TPKT header and its body usually come with a single read
+const readBufferSize = 16 * 1024
+
+// nothing was received for the idle timeout, the connection is closed
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// the server only speaks TLS versions below the configured MinVersion
+func IsTLSVersionError(err error) bool {
+	return errors.Is(err, ErrTLSHandshake) && strings.Contains(err.Error(), "protocol version")
+}
+
+/**
+ * Failed TLS handshake with what the server sent so far, errors.Is
+ * matches ErrTLSHandshake
+ */
+type TLSHandshakeError struct {
+	// random of the ServerHello, nil when the server did not answer with one
+	ServerRandom []byte
+	// alert sent by the server, "protocol version not supported"...
+	Alert string
+	Err   error
+}
+
+func (e *TLSHandshakeError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrTLSHandshake, e.Err)
+}
+
+func (e *TLSHandshakeError) Is(target error) bool {
+	return target == ErrTLSHandshake
+}
+
+func (e *TLSHandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// permissive configuration of StartTLS, servers mostly use self signed certificates
+func DefaultTLSConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify:       true,
+		MinVersion:               tls.VersionTLS10,
+		MaxVersion:               tls.VersionTLS13,
+		PreferServerCipherSuites: true,
+	}
+}
+
 type SocketLayer struct {
-	conn    net.Conn
-	tlsConn *tls.Conn
-	ntlm    *nla.NTLMv2
+	conn        net.Conn
+	tlsConn     *tls.Conn
+	reader      *bufio.Reader
+	tlsConfig   *tls.Config
+	cssp        *nla.CredSSP
+	idleTimeout time.Duration
+	adminWait   time.Duration
+	idleTimer   *time.Timer
+	idleExpired int32
+	done        chan struct{}
+	closeOnce   sync.Once
+	instr       Instrumentation
+	log         glog.Logger
+	// guards tlsConn, StartTLS sets it in the reader goroutine, and readDeadline
+	mu sync.Mutex
+	// of SetDeadline and SetReadDeadline, put back after the Restricted Admin wait
+	readDeadline time.Time
 }
 
-func NewSocketLayer(conn net.Conn, ntlm *nla.NTLMv2) *SocketLayer {
+func NewSocketLayer(conn net.Conn, cssp *nla.CredSSP, log glog.Logger) *SocketLayer {
 	l := &SocketLayer{
 		conn:    conn,
 		tlsConn: nil,
-		ntlm:    ntlm,
+		cssp:    cssp,
+		reader:  bufio.NewReaderSize(conn, readBufferSize),
+		done:    make(chan struct{}),
+		instr:   NopInstrumentation{},
+		log:     log,
 	}
 	return l
 }
 
+// the connection in use, TLS once started
+func (s *SocketLayer) activeConn() net.Conn {
+	if tlsConn := s.secured(); tlsConn != nil {
+		return tlsConn
+	}
+	return s.conn
+}
+
+// the TLS connection once StartTLS started it, nil before
+func (s *SocketLayer) secured() *tls.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tlsConn
+}
+
 func (s *SocketLayer) Read(b []byte) (n int, err error) {
-	if s.tlsConn != nil {
-		return s.tlsConn.Read(b)
+	n, err = s.reader.Read(b)
+	if n > 0 {
+		s.instr.BytesRead(n)
+		if s.idleTimer != nil {
+			s.idleTimer.Reset(s.idleTimeout)
+		}
 	}
-	return s.conn.Read(b)
+	if err != nil && atomic.LoadInt32(&s.idleExpired) != 0 {
+		err = fmt.Errorf("%w after %v: %v", ErrIdleTimeout, s.idleTimeout, err)
+	}
+	return n, err
 }
 
 func (s *SocketLayer) Write(b []byte) (n int, err error) {
-	if s.tlsConn != nil {
-		return s.tlsConn.Write(b)
+	n, err = s.activeConn().Write(b)
+	if n > 0 {
+		s.instr.BytesWritten(n)
+	}
+	return n, err
+}
+
+// receives the byte counts, TLS and NLA phases and the CredSSP outcome
+func (s *SocketLayer) SetInstrumentation(instr Instrumentation) {
+	s.instr = instr
+}
+
+func (s *SocketLayer) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	return s.activeConn().SetDeadline(t)
+}
+
+func (s *SocketLayer) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	return s.activeConn().SetReadDeadline(t)
+}
+
+func (s *SocketLayer) SetWriteDeadline(t time.Time) error {
+	return s.activeConn().SetWriteDeadline(t)
+}
+
+/**
+ * Close the connection when nothing is received for d, pending and
+ * later reads fail with ErrIdleTimeout. Set it before the layers above
+ * start reading, 0 disables it
+ */
+func (s *SocketLayer) SetIdleTimeout(d time.Duration) {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+	s.idleTimeout = d
+	if d > 0 {
+		s.idleTimer = time.AfterFunc(d, func() {
+			atomic.StoreInt32(&s.idleExpired, 1)
+			s.conn.Close()
+		})
 	}
-	return s.conn.Write(b)
+}
+
+// closed by Close, pending StartReadBytesUntil reads are then cancelled
+func (s *SocketLayer) Done() <-chan struct{} {
+	return s.done
 }
 
 func (s *SocketLayer) Close() error {
-	if s.tlsConn != nil {
-		err := s.tlsConn.Close()
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	if tlsConn := s.secured(); tlsConn != nil {
+		err := tlsConn.Close()
 		if err != nil {
 			return err
 		}
@@ -48,72 +207,212 @@ func (s *SocketLayer) Close() error {
 	return s.conn.Close()
 }
 
+/**
+ * Bytes received but not read yet, they are removed from the layer.
+ * Only meaningful between two messages, StartTLS hands them to the
+ * TLS handshake
+ */
+func (s *SocketLayer) TakeBuffered() []byte {
+	buffered, _ := s.reader.Peek(s.reader.Buffered())
+	b := append([]byte{}, buffered...)
+	s.reader.Discard(len(b))
+	return b
+}
+
+// connection whose first reads return bytes already received
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// keeps the first bytes received, the start of the server handshake flight
+type recordingConn struct {
+	net.Conn
+	received []byte
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if left := 64 - len(c.received); left > 0 {
+		if left > n {
+			left = n
+		}
+		c.received = append(c.received, b[:left]...)
+	}
+	return n, err
+}
+
+/**
+ * random of a ServerHello starting the server flight
+ * @see https://tools.ietf.org/html/rfc5246#section-7.4.1.3
+ */
+func serverHelloRandom(b []byte) []byte {
+	// record header, handshake header, server_version then random
+	if len(b) < 43 || b[0] != 0x16 || b[5] != 0x02 {
+		return nil
+	}
+	return append([]byte{}, b[11:43]...)
+}
+
+// how long silence after the Restricted Admin credentials means acceptance, see RestrictedAdminWait
+func (s *SocketLayer) SetRestrictedAdminWait(d time.Duration) {
+	s.adminWait = d
+}
+
+// used by StartTLS instead of DefaultTLSConfig, it is cloned
+func (s *SocketLayer) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
+
 func (s *SocketLayer) StartTLS() error {
-	glog.Info("StartTLS")
-	config := &tls.Config{
-		InsecureSkipVerify:       true,
-		MinVersion:               tls.VersionTLS10,
-		MaxVersion:               tls.VersionTLS13,
-		PreferServerCipherSuites: true,
+	s.log.Debug("socket StartTLS")
+	s.instr.PhaseStarted(PHASE_TLS)
+	defer s.instr.PhaseEnded(PHASE_TLS)
+	config := DefaultTLSConfig()
+	if s.tlsConfig != nil {
+		config = s.tlsConfig.Clone()
+	}
+	recorder := &recordingConn{Conn: s.handshakeConn()}
+	tlsConn := tls.Client(recorder, config)
+	s.mu.Lock()
+	s.tlsConn = tlsConn
+	s.mu.Unlock()
+	s.reader = bufio.NewReaderSize(tlsConn, readBufferSize)
+	if err := tlsConn.Handshake(); err != nil {
+		e := &TLSHandshakeError{ServerRandom: serverHelloRandom(recorder.received), Err: err}
+		if i := strings.Index(err.Error(), "remote error: tls: "); i >= 0 {
+			e.Alert = err.Error()[i+len("remote error: tls: "):]
+		}
+		return e
+	}
+	return nil
+}
+
+/**
+ * Server side of StartTLS: the handshake of the client is answered with
+ * config, which holds the certificate. For servers and test harnesses
+ */
+func (s *SocketLayer) AcceptTLS(config *tls.Config) error {
+	s.log.Debug("socket AcceptTLS")
+	tlsConn := tls.Server(s.handshakeConn(), config)
+	s.mu.Lock()
+	s.tlsConn = tlsConn
+	s.mu.Unlock()
+	s.reader = bufio.NewReaderSize(tlsConn, readBufferSize)
+	return tlsConn.Handshake()
+}
+
+// the connection to start TLS on, the bytes already buffered come first
+func (s *SocketLayer) handshakeConn() net.Conn {
+	if buffered := s.TakeBuffered(); len(buffered) > 0 {
+		return &prefixConn{s.conn, io.MultiReader(bytes.NewReader(buffered), s.conn)}
+	}
+	return s.conn
+}
+
+// negotiated TLS version, 0 before StartTLS
+func (s *SocketLayer) TLSVersion() uint16 {
+	if state, ok := s.TLSState(); ok {
+		return state.Version
+	}
+	return 0
+}
+
+// state of the TLS channel once StartTLS or StartNLA completed its handshake
+func (s *SocketLayer) TLSState() (*tls.ConnectionState, bool) {
+	tlsConn := s.secured()
+	if tlsConn == nil {
+		return nil, false
+	}
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete {
+		return nil, false
 	}
-	s.tlsConn = tls.Client(s.conn, config)
-	return s.tlsConn.Handshake()
+	return &state, true
 }
 
 func (s *SocketLayer) StartNLA() error {
-	glog.Info("StartNLA")
+	return s.startNLA(false)
+}
+
+/**
+ * StartNLA for PROTOCOL_HYBRID_EX: CredSSP is followed by the Early User
+ * Authorization Result of the server, an *nla.AuthorizationError when
+ * it denies the user
+ */
+func (s *SocketLayer) StartNLAEx() error {
+	return s.startNLA(true)
+}
+
+func (s *SocketLayer) startNLA(earlyAuth bool) error {
+	s.log.Debug("socket StartNLA")
 	err := s.StartTLS()
 	if err != nil {
-		glog.Info("start tls failed", err)
 		return err
 	}
-	req := nla.EncodeDERTRequest([]nla.Message{s.ntlm.GetNegotiateMessage()}, "", "")
-	_, err = s.Write(req)
+	pubKey, err := s.serverPublicKey()
 	if err != nil {
-		glog.Info("send NegotiateMessage", err)
 		return err
 	}
-
-	resp := make([]byte, 1024)
-	n, err := s.Read(resp)
-	if err != nil {
-		return fmt.Errorf("read %s", err)
-	}
-	return s.recvChallenge(resp[:n])
+	s.instr.PhaseStarted(PHASE_NLA)
+	err = s.credSSP(pubKey, earlyAuth)
+	s.instr.PhaseEnded(PHASE_NLA)
+	s.instr.AuthResult(err)
+	return err
 }
 
-func (s *SocketLayer) recvChallenge(data []byte) error {
-	glog.Debug("recvChallenge", hex.EncodeToString(data))
-	tsreq, err := nla.DecodeDERTRequest(data)
+func (s *SocketLayer) credSSP(pubKey []byte, earlyAuth bool) error {
+	err := s.cssp.Handshake(s, pubKey)
 	if err != nil {
 		return err
 	}
-
-	// get pubkey
-
-	pubkey := ""
-
-	msg := s.ntlm.GetAuthenticateMessage(tsreq.NegoTokens[0].Data)
-	req := nla.EncodeDERTRequest([]nla.Message{msg}, "", pubkey)
-	_, err = s.Write(req)
-	if err != nil {
-		glog.Info("send AuthenticateMessage", err)
-		return err
+	if earlyAuth {
+		// the server answers whether or not it restricted the logon
+		return nla.RecvEarlyUserAuthResult(s)
 	}
-
-	//resp := make([]byte, 1024)
-	//_, err = s.Read(resp)
-	//if err != nil {
-	//	return err
-	//}
-	//return s.recvPubKeyInc(resp)
-
-	fmt.Println("todo")
-	return nil
-
+	if !s.cssp.RestrictedAdmin() {
+		return nil
+	}
+	// a refusal arrives before we send anything else
+	wait := s.adminWait
+	if wait == 0 {
+		wait = RestrictedAdminWait
+	}
+	s.mu.Lock()
+	deadline := s.readDeadline
+	s.mu.Unlock()
+	until := time.Now().Add(wait)
+	// the deadline of the layer is kept when it comes first
+	capped := !deadline.IsZero() && deadline.Before(until)
+	if capped {
+		until = deadline
+	}
+	s.conn.SetReadDeadline(until)
+	defer s.conn.SetReadDeadline(deadline)
+	err = s.cssp.RecvRestrictedAdminResult(s)
+	if err == nil && capped && !time.Now().Before(deadline) {
+		// silence up to the deadline of the layer is not an acceptance
+		return fmt.Errorf("restricted admin result: %w", os.ErrDeadlineExceeded)
+	}
+	return err
 }
 
-func (s *SocketLayer) recvPubKeyInc(data []byte) error {
-	// todo
-	return nil
+// SubjectPublicKey of the server certificate, the value CredSSP binds to
+func (s *SocketLayer) serverPublicKey() ([]byte, error) {
+	state, ok := s.TLSState()
+	if !ok || len(state.PeerCertificates) == 0 {
+		return nil, errors.New("no server certificate")
+	}
+	var info struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(state.PeerCertificates[0].RawSubjectPublicKeyInfo, &info); err != nil {
+		return nil, fmt.Errorf("read server public key %v", err)
+	}
+	return info.PublicKey.Bytes, nil
 }
@@ -0,0 +1,360 @@
+package core_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/protocol/nla"
+	"github.com/icodeface/grdp/protocol/tpkt"
+	"github.com/icodeface/tls"
+)
+
+// background reads keep logging between tests
+func init() {
+	glog.SetLogger(log.New(ioutil.Discard, "", 0))
+}
+
+func serverCertificate(t *testing.T) stdtls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "rdp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdtls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TLS server accepting at most maxVersion
+func startTLS(t *testing.T, maxVersion uint16, config *tls.Config) (*core.SocketLayer, error) {
+	client, server := net.Pipe()
+	go func() {
+		conn := stdtls.Server(server, &stdtls.Config{
+			Certificates: []stdtls.Certificate{serverCertificate(t)},
+			MinVersion:   stdtls.VersionTLS10,
+			MaxVersion:   maxVersion,
+		})
+		conn.Handshake()
+		server.Close()
+	}()
+	layer := core.NewSocketLayer(client, nil, glog.Default())
+	layer.SetTLSConfig(config)
+	return layer, layer.StartTLS()
+}
+
+func TestStartTLSVersion(t *testing.T) {
+
+	layer, err := startTLS(t, stdtls.VersionTLS12, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.TLSVersion() != tls.VersionTLS12 {
+		t.Errorf("tls version %x", layer.TLSVersion())
+	}
+
+	_, err = startTLS(t, stdtls.VersionTLS11, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12})
+	if !errors.Is(err, core.ErrTLSHandshake) || !core.IsTLSVersionError(err) {
+		t.Error("expected a protocol version error", err)
+	}
+}
+
+func TestSocketLayerDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	layer := core.NewSocketLayer(client, nil, glog.Default())
+	defer layer.Close()
+
+	layer.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := layer.Read(make([]byte, 1))
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Error("expected a timeout", err)
+	}
+}
+
+// a server accepting Restricted Admin then stalling still fails the reads at the deadline
+func TestSocketLayerRestrictedAdminDeadline(t *testing.T) {
+	tests := []struct {
+		name     string
+		wait     time.Duration
+		deadline time.Duration
+		accepted bool
+	}{
+		{"wait first", 20 * time.Millisecond, 300 * time.Millisecond, true},
+		{"deadline first", time.Hour, 300 * time.Millisecond, false},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go serveCredSSP(t, server, true)
+		cssp := nla.NewCredSSP(fakeAuthenticator{}, "", "", "")
+		cssp.SetRestrictedAdmin(true)
+		layer := core.NewSocketLayer(client, cssp, glog.Default())
+		layer.SetRestrictedAdminWait(test.wait)
+		deadline := time.Now().Add(test.deadline)
+		layer.SetDeadline(deadline)
+
+		// whether the silence was taken as acceptance, then the error of the next read
+		type outcome struct {
+			accepted bool
+			err      error
+		}
+		done := make(chan outcome, 1)
+		go func() {
+			if err := layer.StartNLA(); err != nil {
+				done <- outcome{false, err}
+				return
+			}
+			_, err := layer.Read(make([]byte, 1))
+			done <- outcome{true, err}
+		}()
+		select {
+		case o := <-done:
+			if !errors.Is(o.err, os.ErrDeadlineExceeded) {
+				t.Error(test.name, "expected a timeout", o.err)
+			}
+			if time.Now().Before(deadline) {
+				t.Error(test.name, "timed out before the deadline")
+			}
+			if o.accepted != test.accepted {
+				t.Error(test.name, "accepted", o.accepted, "not equal to", test.accepted)
+			}
+		case <-time.After(2 * time.Second):
+			t.Error(test.name, "no timeout at the deadline")
+		}
+		layer.Close()
+	}
+}
+
+func TestSocketLayerIdleTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	layer := core.NewSocketLayer(client, nil, glog.Default())
+	layer.SetIdleTimeout(100 * time.Millisecond)
+
+	// data keeps the connection alive, then the server stops responding
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(50 * time.Millisecond)
+			server.Write([]byte{0x03, 0x00, 0x00, 0x07, 0x02, 0xf0, 0x80})
+		}
+	}()
+	errc := make(chan error, 1)
+	received := 0
+	transport := tpkt.New(layer, glog.Default())
+	transport.On("data", func(s []byte) {
+		received++
+	}).On("error", func(err error) {
+		errc <- err
+	})
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, core.ErrIdleTimeout) {
+			t.Error(err, "is not", core.ErrIdleTimeout)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle timeout did not fire")
+	}
+	if received != 3 {
+		t.Error("received", received, "packets before the timeout")
+	}
+}
+
+func TestSocketLayerCloseLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	errc := make(chan error, 200)
+	for i := 0; i < 200; i++ {
+		client, server := net.Pipe()
+		layer := core.NewSocketLayer(client, nil, glog.Default())
+		tpkt.New(layer, glog.Default()).On("error", func(err error) {
+			errc <- err
+		})
+		layer.Close()
+		server.Close()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before+5 {
+		t.Error(n-before, "goroutines left after Close")
+	}
+	// closing is not an error of the connection
+	if len(errc) != 0 {
+		t.Error(<-errc)
+	}
+}
+
+func TestSocketLayerTLSUpgradeBoundary(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		// X224 connection confirm then TLS on the same connection
+		server.Write([]byte("confirm"))
+		conn := stdtls.Server(server, &stdtls.Config{Certificates: []stdtls.Certificate{serverCertificate(t)}})
+		conn.Write([]byte("encrypted"))
+		conn.Close()
+	}()
+
+	layer := core.NewSocketLayer(client, nil, glog.Default())
+	plain, err := core.ReadBytes(len("confirm"), layer)
+	if err != nil || string(plain) != "confirm" {
+		t.Fatal("plain read", string(plain), err)
+	}
+	if err = layer.StartTLS(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := core.ReadBytes(len("encrypted"), layer)
+	if err != nil || string(data) != "encrypted" {
+		t.Error("tls read", string(data), err)
+	}
+}
+
+func TestSocketLayerTakeBuffered(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		server.Write([]byte("headerbody"))
+		server.Close()
+	}()
+	layer := core.NewSocketLayer(client, nil, glog.Default())
+	header, _ := core.ReadBytes(len("header"), layer)
+	if string(header) != "header" {
+		t.Fatal(string(header))
+	}
+	if buffered := layer.TakeBuffered(); string(buffered) != "body" {
+		t.Error("buffered", string(buffered))
+	}
+	if n, err := layer.Read(make([]byte, 4)); n != 0 || err == nil {
+		t.Error("claimed bytes read again", n, err)
+	}
+}
+
+// counts the reads reaching the connection
+type countingConn struct {
+	net.Conn
+	r     *bytes.Reader
+	reads int
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	c.reads++
+	return c.r.Read(b)
+}
+
+// bitmap updates of a session read the way TPKT does, header then body
+func BenchmarkSocketLayerRead(b *testing.B) {
+	session := &bytes.Buffer{}
+	for i := 0; i < 1000; i++ {
+		size := 64 + (i*397)%4000
+		core.WriteUInt8(tpkt.FASTPATH_ACTION_X224, session)
+		core.WriteUInt8(0, session)
+		core.WriteUInt16BE(uint16(size+4), session)
+		session.Write(make([]byte, size))
+	}
+	reads := 0
+	for i := 0; i < b.N; i++ {
+		conn := &countingConn{r: bytes.NewReader(session.Bytes())}
+		layer := core.NewSocketLayer(conn, nil, glog.Default())
+		for {
+			header, err := core.ReadBytes(4, layer)
+			if err != nil {
+				break
+			}
+			size := int(header[2])<<8 | int(header[3])
+			core.ReadBytes(size-4, layer)
+		}
+		reads += conn.reads
+	}
+	b.ReportMetric(float64(reads)/float64(b.N)/1000, "reads/packet")
+}
+
+func TestStartTLSServerName(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	serverName := make(chan string, 1)
+	go func() {
+		cert := serverCertificate(t)
+		conn := stdtls.Server(server, &stdtls.Config{
+			GetCertificate: func(hello *stdtls.ClientHelloInfo) (*stdtls.Certificate, error) {
+				serverName <- hello.ServerName
+				return &cert, nil
+			},
+		})
+		conn.Handshake()
+		server.Close()
+	}()
+	layer := core.NewSocketLayer(client, nil, glog.Default())
+	layer.SetTLSConfig(&tls.Config{InsecureSkipVerify: true, ServerName: "broker.corp.local"})
+	if err := layer.StartTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if name := <-serverName; name != "broker.corp.local" {
+		t.Error("SNI", name)
+	}
+}
+
+func TestTLSHandshakeError(t *testing.T) {
+	// refused before any ServerHello
+	_, err := startTLS(t, stdtls.VersionTLS11, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS12})
+	var e *core.TLSHandshakeError
+	if !errors.As(err, &e) {
+		t.Fatal(err, "is not a TLSHandshakeError")
+	}
+	if e.Alert != "protocol version not supported" || e.ServerRandom != nil {
+		t.Errorf("alert %q server random %x", e.Alert, e.ServerRandom)
+	}
+
+	// verification of a self signed certificate fails after the ServerHello
+	_, err = startTLS(t, stdtls.VersionTLS12, &tls.Config{ServerName: "rdp", MaxVersion: tls.VersionTLS12})
+	if !errors.As(err, &e) || !errors.Is(err, core.ErrTLSHandshake) {
+		t.Fatal(err, "is not a TLSHandshakeError")
+	}
+	if len(e.ServerRandom) != 32 || e.Alert != "" {
+		t.Errorf("alert %q server random %x", e.Alert, e.ServerRandom)
+	}
+}
+
+func TestSocketLayerTLSState(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	cert := serverCertificate(t)
+	go func() {
+		conn := stdtls.Server(server, &stdtls.Config{Certificates: []stdtls.Certificate{cert}, MaxVersion: stdtls.VersionTLS12})
+		conn.Handshake()
+		server.Close()
+	}()
+	layer := core.NewSocketLayer(client, nil, glog.Default())
+	if state, ok := layer.TLSState(); ok || state != nil {
+		t.Error("tls state before StartTLS")
+	}
+	if err := layer.StartTLS(); err != nil {
+		t.Fatal(err)
+	}
+	state, ok := layer.TLSState()
+	if !ok || state.Version != tls.VersionTLS12 {
+		t.Fatal("tls state", state)
+	}
+	if len(state.PeerCertificates) != 1 || !bytes.Equal(state.PeerCertificates[0].Raw, cert.Certificate[0]) {
+		t.Error("peer certificate chain", state.PeerCertificates)
+	}
+}
@@ -0,0 +1,192 @@
+// Package testtransport provides an in memory core.Transport to unit
+// test a layer without the layers below it.
+package testtransport
+
+import (
+	"errors"
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/emission"
+	"io"
+	"sync"
+	"time"
+)
+
+// returned by Write once the transport was closed
+var ErrClosed = errors.New("transport closed")
+
+/**
+ * core.Transport whose inbound frames are injected by the test and
+ * whose writes are captured. Inbound events go to the listeners of the
+ * layer under test like the ones of a real layer, Emit returns once
+ * they did
+ */
+type MockTransport struct {
+	emission.Emitter
+	mu         sync.Mutex
+	writes     [][]byte
+	written    chan []byte
+	writeErr   error
+	writeDelay time.Duration
+	tlsErr     error
+	nlaErr     error
+	started    []string
+	closed     bool
+}
+
+var _ core.SecureTransport = (*MockTransport)(nil)
+
+func New() *MockTransport {
+	return &MockTransport{
+		Emitter: *emission.NewEmitter(),
+		written: make(chan []byte, 1024),
+	}
+}
+
+// nothing is read from the transport, frames come as "data" events
+func (m *MockTransport) Read(b []byte) (n int, err error) {
+	return 0, io.EOF
+}
+
+func (m *MockTransport) Write(b []byte) (n int, err error) {
+	m.mu.Lock()
+	delay, err, closed := m.writeDelay, m.writeErr, m.closed
+	m.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if closed {
+		return 0, ErrClosed
+	}
+	if err != nil {
+		return 0, err
+	}
+	data := append([]byte{}, b...)
+	m.mu.Lock()
+	m.writes = append(m.writes, data)
+	m.mu.Unlock()
+	select {
+	case m.written <- data:
+	default:
+	}
+	return len(b), nil
+}
+
+// emits "close" the first time
+func (m *MockTransport) Close() error {
+	m.mu.Lock()
+	closed := m.closed
+	m.closed = true
+	m.mu.Unlock()
+	if !closed {
+		m.Emit("close")
+	}
+	return nil
+}
+
+func (m *MockTransport) Closed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+// emits frame as "data", the way the layer below hands over a message
+func (m *MockTransport) Inject(frame []byte) {
+	m.Emit("data", frame)
+}
+
+// Inject from another go routine after d, for replies that race a write
+func (m *MockTransport) InjectAfter(d time.Duration, frame []byte) {
+	go func() {
+		time.Sleep(d)
+		m.Inject(frame)
+	}()
+}
+
+// emits "connect" with the arguments the layer under test expects
+func (m *MockTransport) Connect(args ...interface{}) {
+	m.Emit("connect", args...)
+}
+
+// emits "error", a failure of the layers below
+func (m *MockTransport) Fail(err error) {
+	m.Emit("error", err)
+}
+
+// returned by the next writes, nil to succeed again
+func (m *MockTransport) SetWriteError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writeErr = err
+}
+
+// Write sleeps d before it writes, a slow link
+func (m *MockTransport) SetWriteDelay(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writeDelay = d
+}
+
+// writes so far, one per Write call
+func (m *MockTransport) Writes() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([][]byte{}, m.writes...)
+}
+
+// waits for the next write not returned by NextWrite yet
+func (m *MockTransport) NextWrite(timeout time.Duration) ([]byte, bool) {
+	select {
+	case b := <-m.written:
+		return b, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+// returned by StartTLS, and by StartNLA unless SetStartNLAError
+func (m *MockTransport) SetStartTLSError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tlsErr = err
+}
+
+func (m *MockTransport) SetStartNLAError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nlaErr = err
+}
+
+func (m *MockTransport) StartTLS() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started = append(m.started, "tls")
+	return m.tlsErr
+}
+
+func (m *MockTransport) StartNLA() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started = append(m.started, "nla")
+	if m.tlsErr != nil {
+		return m.tlsErr
+	}
+	return m.nlaErr
+}
+
+// StartNLA of PROTOCOL_HYBRID_EX, recorded as "nla_ex"
+func (m *MockTransport) StartNLAEx() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started = append(m.started, "nla_ex")
+	if m.tlsErr != nil {
+		return m.tlsErr
+	}
+	return m.nlaErr
+}
+
+// "tls", "nla" and "nla_ex" in the order StartTLS, StartNLA and StartNLAEx were called
+func (m *MockTransport) Started() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.started...)
+}
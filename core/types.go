@@ -9,10 +9,22 @@ type Transport interface {
 
 	On(event, listener interface{}) *emission.Emitter
 	Once(event, listener interface{}) *emission.Emitter
+	ListenOnce(event, listener interface{}) emission.ListenerID
+	Remove(id emission.ListenerID) bool
 
 	Emit(event interface{}, arguments ...interface{}) *emission.Emitter
 }
 
+/**
+ * Transport able to secure the connection once X224 negotiated it, the
+ * TPKT layer. StartTLS for PROTOCOL_SSL, StartNLA for PROTOCOL_HYBRID
+ */
+type SecureTransport interface {
+	Transport
+	StartTLS() error
+	StartNLA() error
+}
+
 type FastPathListener interface {
 	RecvFastPath(secFlag byte, s []byte)
 }
@@ -7,9 +7,12 @@ package emission
 import (
 	"errors"
 	"fmt"
+	"github.com/icodeface/grdp/glog"
 	"os"
 	"reflect"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 )
 
 // Default number of maximum listeners for an event.
@@ -21,48 +24,142 @@ var ErrNoneFunction = errors.New("Kind of Value for listener is not Func.")
 // RecoveryListener ...
 type RecoveryListener func(interface{}, interface{}, error)
 
+// PanicError is emitted as an "error" when a listener panics, unless
+// a RecoveryListener has been set.
+type PanicError struct {
+	// Event whose listener panicked.
+	Event interface{}
+	// Value passed to panic.
+	Value interface{}
+	// Stack of the listener's go routine when it panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in %v listener: %v", e.Event, e.Value)
+}
+
+// Unwrap returns the value passed to panic when it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// ListenerID identifies a listener added with Listen or ListenOnce,
+// see Remove.
+type ListenerID uint64
+
+// lastID numbers the listeners of all emitters, the layers embed
+// copies of their Emitter.
+var lastID uint64
+
+// handler is a registered listener. removed is guarded by the
+// Emitter's mutex, a listener claimed by an Emit or removed is never
+// called again.
+type handler struct {
+	id      ListenerID
+	fn      reflect.Value
+	removed bool
+}
+
 // Emitter ...
 type Emitter struct {
 	// Mutex to prevent race conditions within the Emitter.
 	*sync.Mutex
-	// Map of event to a slice of listener function's reflect Values.
-	events map[interface{}][]reflect.Value
+	// Map of event to a slice of listeners.
+	events map[interface{}][]*handler
 	// Optional RecoveryListener to call when a panic occurs.
 	recoverer RecoveryListener
 	// Maximum listeners for debugging potential memory leaks.
 	maxListeners int
 
-	// Map of event to a slice of listener function's reflect Values.
-	onces map[interface{}][]reflect.Value
+	// Map of event to a slice of listeners called once.
+	onces map[interface{}][]*handler
+	// Listeners by id, for Remove.
+	ids map[ListenerID]*handler
 }
 
-// AddListener appends the listener argument to the event arguments slice
-// in the Emitter's events map. If the number of listeners for an event
-// is greater than the Emitter's maximum listeners then a warning is printed.
-// If the relect Value of the listener does not have a Kind of Func then
-// AddListener panics. If a RecoveryListener has been set then it is called
-// recovering from the panic.
-func (emitter *Emitter) AddListener(event, listener interface{}) *Emitter {
-	emitter.Lock()
-	defer emitter.Unlock()
+// add registers fn in listeners, the caller holds the mutex.
+func (emitter *Emitter) add(listeners map[interface{}][]*handler, event, fn interface{}) ListenerID {
+	value := reflect.ValueOf(fn)
 
-	fn := reflect.ValueOf(listener)
-
-	if reflect.Func != fn.Kind() {
+	if reflect.Func != value.Kind() {
 		if nil == emitter.recoverer {
 			panic(ErrNoneFunction)
 		} else {
-			emitter.recoverer(event, listener, ErrNoneFunction)
+			emitter.recoverer(event, fn, ErrNoneFunction)
 		}
 	}
 
-	if emitter.maxListeners != -1 && emitter.maxListeners < len(emitter.events[event])+1 {
+	if emitter.maxListeners != -1 && emitter.maxListeners < len(listeners[event])+1 {
 		fmt.Fprintf(os.Stdout, "Warning: event `%v` has exceeded the maximum "+
 			"number of listeners of %d.\n", event, emitter.maxListeners)
 	}
 
-	emitter.events[event] = append(emitter.events[event], fn)
+	l := &handler{id: ListenerID(atomic.AddUint64(&lastID, 1)), fn: value}
+	listeners[event] = append(listeners[event], l)
+	emitter.ids[l.id] = l
+	return l.id
+}
+
+// Listen appends the listener argument to the event arguments slice
+// in the Emitter's events map and returns its id for Remove. If the
+// reflect Value of the listener does not have a Kind of Func then Listen
+// panics. If a RecoveryListener has been set then it is called recovering
+// from the panic.
+func (emitter *Emitter) Listen(event, listener interface{}) ListenerID {
+	emitter.Lock()
+	defer emitter.Unlock()
+	return emitter.add(emitter.events, event, listener)
+}
+
+// ListenOnce is Listen for a listener called at most once.
+func (emitter *Emitter) ListenOnce(event, listener interface{}) ListenerID {
+	emitter.Lock()
+	defer emitter.Unlock()
+	return emitter.add(emitter.onces, event, listener)
+}
+
+// Remove removes the listener with the given id, it reports whether the
+// listener was still registered. Once Remove returned the listener is
+// not called anymore, a call that already started may still be running.
+// A listener called once is no longer registered once its Emit started.
+func (emitter *Emitter) Remove(id ListenerID) bool {
+	emitter.Lock()
+	defer emitter.Unlock()
+
+	l, ok := emitter.ids[id]
+	if !ok {
+		return false
+	}
+	emitter.removeLocked(l)
+	return true
+}
+
+// removeLocked unregisters l, the caller holds the mutex.
+func (emitter *Emitter) removeLocked(l *handler) {
+	l.removed = true
+	delete(emitter.ids, l.id)
+	for _, listeners := range []map[interface{}][]*handler{emitter.events, emitter.onces} {
+		for event, ls := range listeners {
+			for i, other := range ls {
+				if other == l {
+					listeners[event] = append(ls[:i:i], ls[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+}
 
+// AddListener appends the listener argument to the event arguments slice
+// in the Emitter's events map. If the number of listeners for an event
+// is greater than the Emitter's maximum listeners then a warning is printed.
+// If the relect Value of the listener does not have a Kind of Func then
+// AddListener panics. If a RecoveryListener has been set then it is called
+// recovering from the panic.
+func (emitter *Emitter) AddListener(event, listener interface{}) *Emitter {
+	emitter.Listen(event, listener)
 	return emitter
 }
 
@@ -74,7 +171,8 @@ func (emitter *Emitter) On(event, listener interface{}) *Emitter {
 // RemoveListener removes the listener argument from the event arguments slice
 // in the Emitter's events map.  If the reflect Value of the listener does not
 // have a Kind of Func then RemoveListener panics. If a RecoveryListener has
-// been set then it is called after recovering from the panic.
+// been set then it is called after recovering from the panic. Method values
+// of one method share their code pointer, use Remove to tell them apart.
 func (emitter *Emitter) RemoveListener(event, listener interface{}) *Emitter {
 	emitter.Lock()
 	defer emitter.Unlock()
@@ -89,28 +187,19 @@ func (emitter *Emitter) RemoveListener(event, listener interface{}) *Emitter {
 		}
 	}
 
-	if events, ok := emitter.events[event]; ok {
-		newEvents := []reflect.Value{}
-
-		for _, listener := range events {
-			if fn.Pointer() != listener.Pointer() {
-				newEvents = append(newEvents, listener)
-			}
+	var removed []*handler
+	for _, l := range emitter.events[event] {
+		if fn.Pointer() == l.fn.Pointer() {
+			removed = append(removed, l)
 		}
-
-		emitter.events[event] = newEvents
 	}
-
-	if events, ok := emitter.onces[event]; ok {
-		newEvents := []reflect.Value{}
-
-		for _, listener := range events {
-			if fn.Pointer() != listener.Pointer() {
-				newEvents = append(newEvents, listener)
-			}
+	for _, l := range emitter.onces[event] {
+		if fn.Pointer() == l.fn.Pointer() {
+			removed = append(removed, l)
 		}
-
-		emitter.onces[event] = newEvents
+	}
+	for _, l := range removed {
+		emitter.removeLocked(l)
 	}
 
 	return emitter
@@ -127,25 +216,7 @@ func (emitter *Emitter) Off(event, listener interface{}) *Emitter {
 // does not have a Kind of Func then Once panics. If a RecoveryListener
 // has been set then it is called after recovering from the panic.
 func (emitter *Emitter) Once(event, listener interface{}) *Emitter {
-	emitter.Lock()
-	defer emitter.Unlock()
-
-	fn := reflect.ValueOf(listener)
-
-	if reflect.Func != fn.Kind() {
-		if nil == emitter.recoverer {
-			panic(ErrNoneFunction)
-		} else {
-			emitter.recoverer(event, listener, ErrNoneFunction)
-		}
-	}
-
-	if emitter.maxListeners != -1 && emitter.maxListeners < len(emitter.onces[event])+1 {
-		fmt.Fprintf(os.Stdout, "Warning: event `%v` has exceeded the maximum "+
-			"number of listeners of %d.\n", event, emitter.maxListeners)
-	}
-
-	emitter.onces[event] = append(emitter.onces[event], fn)
+	emitter.ListenOnce(event, listener)
 	return emitter
 }
 
@@ -154,64 +225,57 @@ func (emitter *Emitter) Once(event, listener interface{}) *Emitter {
 // is called within its own go routine. The reflect package will panic if
 // the agruments supplied do not align the parameters of a listener function.
 // If a RecoveryListener has been set then it is called after recovering from
-// the panic.
+// the panic. The listeners called once are claimed before any is called,
+// one registered again from its own call waits for the next Emit.
 func (emitter *Emitter) Emit(event interface{}, arguments ...interface{}) *Emitter {
-	var (
-		listeners []reflect.Value
-		ok        bool
-	)
-
-	// Lock the mutex when reading from the Emitter's
-	// events map.
 	emitter.Lock()
-
-	if listeners, ok = emitter.events[event]; !ok {
-		// If the Emitter does not include the event in its
-		// event map, it has no listeners to Call yet.
-		emitter.Unlock()
-		goto ONCES
+	listeners := append([]*handler{}, emitter.events[event]...)
+	onces := emitter.onces[event]
+	delete(emitter.onces, event)
+	for _, l := range onces {
+		delete(emitter.ids, l.id)
 	}
-
-	// Unlock the mutex immediately following the read
-	// instead of deferring so that listeners registered
-	// with Once can aquire the mutex for removal.
 	emitter.Unlock()
-	emitter.callListeners(listeners, event, arguments...)
 
-ONCES:
-	// execute onces
-	emitter.Lock()
-	if listeners, ok = emitter.onces[event]; !ok {
-		emitter.Unlock()
-		return emitter
-	}
-	emitter.Unlock()
 	emitter.callListeners(listeners, event, arguments...)
-	// clear executed listeners
-	emitter.onces[event] = emitter.onces[event][len(listeners):]
+	emitter.callListeners(onces, event, arguments...)
 	return emitter
 }
 
-func (emitter *Emitter) callListeners(listeners []reflect.Value, event interface{}, arguments ...interface{}) {
+// isRemoved reports whether l was removed, after which it must not be called.
+func (emitter *Emitter) isRemoved(l *handler) bool {
+	emitter.Lock()
+	defer emitter.Unlock()
+	return l.removed
+}
+
+func (emitter *Emitter) callListeners(listeners []*handler, event interface{}, arguments ...interface{}) {
 	var wg sync.WaitGroup
 
 	wg.Add(len(listeners))
 
-	for _, fn := range listeners {
-		go func(fn reflect.Value) {
+	for _, l := range listeners {
+		go func(l *handler) {
 			defer wg.Done()
 
+			if emitter.isRemoved(l) {
+				return
+			}
+			fn := l.fn
+
 			// Recover from potential panics, supplying them to a
-			// RecoveryListener if one has been set, else allowing
-			// the panic to occur.
-			if nil != emitter.recoverer {
-				defer func() {
-					if r := recover(); nil != r {
+			// RecoveryListener if one has been set, else emitting
+			// them as an error.
+			defer func() {
+				if r := recover(); nil != r {
+					if nil != emitter.recoverer {
 						err := fmt.Errorf("%v", r)
 						emitter.recoverer(event, fn.Interface(), err)
+						return
 					}
-				}()
-			}
+					emitter.recovered(&PanicError{Event: event, Value: r, Stack: debug.Stack()})
+				}
+			}()
 
 			var values []reflect.Value
 
@@ -224,12 +288,23 @@ func (emitter *Emitter) callListeners(listeners []reflect.Value, event interface
 			}
 
 			fn.Call(values)
-		}(fn)
+		}(l)
 	}
 
 	wg.Wait()
 }
 
+// recovered emits the panic of a listener as an "error". A panic of an
+// "error" listener is only logged, emitting it would call the same
+// listener again.
+func (emitter *Emitter) recovered(err *PanicError) {
+	if err.Event == "error" {
+		glog.Error(err, string(err.Stack))
+		return
+	}
+	emitter.Emit("error", err)
+}
+
 // RecoverWith sets the listener to call when a panic occurs, recovering from
 // panics and attempting to keep the application from crashing.
 func (emitter *Emitter) RecoverWith(listener RecoveryListener) *Emitter {
@@ -266,8 +341,9 @@ func (emitter *Emitter) GetListenerCount(event interface{}) (count int) {
 func NewEmitter() (emitter *Emitter) {
 	emitter = new(Emitter)
 	emitter.Mutex = new(sync.Mutex)
-	emitter.events = make(map[interface{}][]reflect.Value)
+	emitter.events = make(map[interface{}][]*handler)
 	emitter.maxListeners = DefaultMaxListeners
-	emitter.onces = make(map[interface{}][]reflect.Value)
+	emitter.onces = make(map[interface{}][]*handler)
+	emitter.ids = make(map[ListenerID]*handler)
 	return
 }
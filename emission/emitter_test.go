@@ -0,0 +1,214 @@
+package emission_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/icodeface/grdp/emission"
+	"github.com/icodeface/grdp/glog"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRemove(t *testing.T) {
+	e := emission.NewEmitter()
+	var calls int32
+	id := e.Listen("data", func(int) { atomic.AddInt32(&calls, 1) })
+	e.Emit("data", 1)
+	if !e.Remove(id) {
+		t.Error("listener not removed")
+	}
+	if e.Remove(id) {
+		t.Error("listener removed twice")
+	}
+	e.Emit("data", 2)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error(n, "not equal to", 1)
+	}
+}
+
+func TestRemoveDuringEmit(t *testing.T) {
+	e := emission.NewEmitter()
+	var calls int32
+	var second emission.ListenerID
+	// the listeners of an Emit start together, the first one only
+	// returns once the second one was removed
+	var once sync.Once
+	started := make(chan struct{})
+	removed := make(chan struct{})
+	e.Listen("data", func() {
+		once.Do(func() { close(started) })
+		<-removed
+	})
+	second = e.Listen("data", func() {
+		<-removed
+		atomic.AddInt32(&calls, 1)
+	})
+	go func() {
+		<-started
+		e.Remove(second)
+		close(removed)
+	}()
+	e.Emit("data")
+	e.Emit("data")
+	// the removed listener may have started before Remove, never after
+	if n := atomic.LoadInt32(&calls); n > 1 {
+		t.Error(n, "not less or equal to", 1)
+	}
+}
+
+func TestRemoveFromListener(t *testing.T) {
+	e := emission.NewEmitter()
+	var calls int32
+	var id emission.ListenerID
+	id = e.Listen("data", func() {
+		atomic.AddInt32(&calls, 1)
+		e.Remove(id)
+	})
+	e.Emit("data")
+	e.Emit("data")
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error(n, "not equal to", 1)
+	}
+}
+
+func TestRemoveOnce(t *testing.T) {
+	e := emission.NewEmitter()
+	called := false
+	id := e.ListenOnce("data", func() { called = true })
+	if !e.Remove(id) {
+		t.Error("listener not removed")
+	}
+	e.Emit("data")
+	if called {
+		t.Error("removed listener called")
+	}
+
+	id = e.ListenOnce("data", func() {})
+	e.Emit("data")
+	if e.Remove(id) {
+		t.Error("listener removed after it was called")
+	}
+}
+
+func TestOnceConcurrentEmit(t *testing.T) {
+	e := emission.NewEmitter()
+	var calls int32
+	e.Once("data", func() { atomic.AddInt32(&calls, 1) })
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.Emit("data")
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error(n, "not equal to", 1)
+	}
+}
+
+func TestOnceFromListener(t *testing.T) {
+	e := emission.NewEmitter()
+	var calls int32
+	var listener func()
+	listener = func() {
+		// registered again for the next Emit, not this one
+		if atomic.AddInt32(&calls, 1) < 3 {
+			e.Once("data", listener)
+		}
+	}
+	e.Once("data", listener)
+	e.Emit("data")
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error(n, "not equal to", 1)
+	}
+	e.Emit("data")
+	e.Emit("data")
+	e.Emit("data")
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Error(n, "not equal to", 3)
+	}
+}
+
+func TestRemoveListener(t *testing.T) {
+	e := emission.NewEmitter()
+	called := false
+	listener := func() { called = true }
+	e.On("data", listener)
+	e.Once("data", listener)
+	e.Off("data", listener)
+	e.Emit("data")
+	if called {
+		t.Error("removed listener called")
+	}
+	if n := e.GetListenerCount("data"); n != 0 {
+		t.Error(n, "not equal to", 0)
+	}
+}
+
+// reads a length prefixed field, panics on a short input
+func readField(b []byte) []byte {
+	return b[1 : 1+int(b[0])]
+}
+
+func TestPanicEmitsError(t *testing.T) {
+	e := emission.NewEmitter()
+	errc := make(chan error, 1)
+	e.On("data", func(b []byte) {
+		readField(b)
+	}).On("error", func(err error) {
+		errc <- err
+	})
+	e.Emit("data", []byte{2, 'o', 'k'})
+	select {
+	case err := <-errc:
+		t.Error(err, "not equal to", nil)
+	default:
+	}
+
+	e.Emit("data", []byte{200, 'o', 'k'})
+	var err error
+	select {
+	case err = <-errc:
+	default:
+		t.Fatal("no error emitted")
+	}
+	var panicErr *emission.PanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatal(err, "not equal to", "*emission.PanicError")
+	}
+	if panicErr.Event != "data" {
+		t.Error(panicErr.Event, "not equal to", "data")
+	}
+	if !strings.Contains(string(panicErr.Stack), "readField") {
+		t.Error(string(panicErr.Stack), "not containing", "readField")
+	}
+}
+
+func TestPanicInErrorListener(t *testing.T) {
+	buff := &bytes.Buffer{}
+	glog.SetLogger(log.New(buff, "", 0))
+	glog.SetLevel(glog.ERROR)
+	defer glog.SetLogger(nil)
+	defer glog.SetLevel(glog.NONE)
+
+	e := emission.NewEmitter()
+	var calls int32
+	e.On("data", func() {
+		panic("bad data")
+	}).On("error", func(err error) {
+		atomic.AddInt32(&calls, 1)
+		panic(err)
+	})
+	e.Emit("data")
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Error(n, "not equal to", 1)
+	}
+	if !strings.Contains(buff.String(), "panic in error listener") {
+		t.Error(buff.String(), "not containing", "panic in error listener")
+	}
+}
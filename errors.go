@@ -0,0 +1,206 @@
+package grdp
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/protocol/lic"
+	"github.com/icodeface/grdp/protocol/nla"
+	"github.com/icodeface/grdp/protocol/pdu"
+	"github.com/icodeface/grdp/protocol/x224"
+)
+
+var (
+	ErrNLANotSupported = errors.New("server does not support NLA")
+	// the TLS channel failed before any authentication started
+	ErrTLSHandshake = core.ErrTLSHandshake
+	// NTLM was refused before the credentials were checked, retry WithKerberos
+	ErrNTLMDisabled = nla.ErrNTLMDisabled
+	// the connection given to NewClientFromConn was used by a previous attempt
+	ErrConnUsed = errors.New("connection already used")
+	// the server neither connected nor refused the client before the login timeout
+	ErrLoginTimeout = errors.New("login timed out")
+	// the connection outlived the handshake timeout, see WithHandshakeTimeout
+	ErrHandshakeTimeout = errors.New("handshake timed out")
+	// the server did not answer the connection request, see WithNegotiationTimeout
+	ErrNegotiationTimeout = x224.ErrNegotiationTimeout
+	// the server closed the connection before the client was connected
+	ErrConnClosed = errors.New("connection closed by the server")
+	// the call needs the session of a Login with WithKeepSession
+	ErrNoSession = errors.New("no session, login WithKeepSession first")
+	// the desktop was not painted before the timeout of Screenshot
+	ErrScreenshotTimeout = errors.New("screenshot timed out")
+	// an option of New is out of range or contradicts another one
+	ErrInvalidOption = errors.New("invalid option")
+)
+
+/**
+ * Classes of Login failures, test with errors.Is. Each failure is in
+ * at most one of them: the host is down, it refused the protocols, the
+ * TLS channel failed, NLA refused the credentials, the server denied
+ * the authorization or the license exchange failed after the
+ * credentials were accepted
+ */
+var (
+	// nothing listens on the port
+	ErrConnRefused = syscall.ECONNREFUSED
+	// errors.As gives the *NegotiationFailureError with its failure code
+	ErrNegotiationFailed = x224.ErrNegotiationFailed
+	// the server confirmed without negotiation, errors.As gives the
+	// *StandardSecurityError
+	ErrStandardSecurity = x224.ErrStandardSecurity
+	// the server sent an X224 disconnect request or error TPDU, errors.As
+	// gives the *DisconnectError with its reason
+	ErrDisconnected = x224.ErrDisconnected
+	// the logon was refused for the credentials or the account, errors.As
+	// gives the *nla.NTStatusError and errors.Is the ErrXXX below
+	ErrNLAAuthFailed = nla.ErrAuthFailed
+	// errors.As gives the *LicenseError with the licensing error of the server
+	ErrLicense = lic.ErrLicense
+	// the credentials were accepted but the early user authorization result
+	// of PROTOCOL_HYBRID_EX denied the logon, errors.As gives the
+	// *AuthorizationError
+	ErrAuthorizationDenied = nla.ErrAuthorizationDenied
+)
+
+type NegotiationFailureError = x224.NegotiationFailureError
+
+type StandardSecurityError = x224.StandardSecurityError
+
+type DisconnectError = x224.DisconnectError
+
+type LicenseError = lic.LicenseError
+
+type AuthorizationError = nla.AuthorizationError
+
+type CertificateInfo = core.CertificateInfo
+
+// reason sent by the server before it disconnected a kept session, see SessionErr
+type ErrorInfoError = pdu.ErrorInfoError
+
+// NLA failures, test with errors.Is
+var (
+	ErrLogonFailure            = nla.ErrLogonFailure
+	ErrAccountRestriction      = nla.ErrAccountRestriction
+	ErrAccountLocked           = nla.ErrAccountLocked
+	ErrAccountDisabled         = nla.ErrAccountDisabled
+	ErrAccountExpired          = nla.ErrAccountExpired
+	ErrPasswordExpired         = nla.ErrPasswordExpired
+	ErrPasswordMustChange      = nla.ErrPasswordMustChange
+	ErrLogonTypeNotGranted     = nla.ErrLogonTypeNotGranted
+	ErrAccessDenied            = nla.ErrAccessDenied
+	ErrLogonServer             = nla.ErrLogonServer
+	ErrSecurityPackage         = nla.ErrSecurityPackage
+	ErrServerAuthFailed        = nla.ErrServerAuthFailed
+	ErrRestrictedAdminRejected = nla.ErrRestrictedAdminRejected
+)
+
+/**
+ * What a login told about the credentials, see ClassifyLogin. The
+ * password of an account is known to be right for LOGIN_SUCCESS,
+ * LOGIN_PASSWORD_EXPIRED, LOGIN_ACCOUNT_RESTRICTED and
+ * LOGIN_LOGON_TYPE_NOT_GRANTED, see CredentialsValid
+ */
+type LoginOutcome int
+
+const (
+	LOGIN_SUCCESS LoginOutcome = iota
+	// wrong password or no such user, the server does not tell which
+	LOGIN_BAD_CREDENTIALS
+	// no further attempt succeeds until the lockout is over
+	LOGIN_ACCOUNT_LOCKED
+	// disabled or expired account
+	LOGIN_ACCOUNT_DISABLED
+	// expired or must be changed at the next logon
+	LOGIN_PASSWORD_EXPIRED
+	// logon hours or workstations
+	LOGIN_ACCOUNT_RESTRICTED
+	// the account may not log on through Remote Desktop Services
+	LOGIN_LOGON_TYPE_NOT_GRANTED
+	// the failure says nothing about the credentials
+	LOGIN_UNKNOWN
+)
+
+func (o LoginOutcome) String() string {
+	switch o {
+	case LOGIN_SUCCESS:
+		return "LOGIN_SUCCESS"
+	case LOGIN_BAD_CREDENTIALS:
+		return "LOGIN_BAD_CREDENTIALS"
+	case LOGIN_ACCOUNT_LOCKED:
+		return "LOGIN_ACCOUNT_LOCKED"
+	case LOGIN_ACCOUNT_DISABLED:
+		return "LOGIN_ACCOUNT_DISABLED"
+	case LOGIN_PASSWORD_EXPIRED:
+		return "LOGIN_PASSWORD_EXPIRED"
+	case LOGIN_ACCOUNT_RESTRICTED:
+		return "LOGIN_ACCOUNT_RESTRICTED"
+	case LOGIN_LOGON_TYPE_NOT_GRANTED:
+		return "LOGIN_LOGON_TYPE_NOT_GRANTED"
+	}
+	return "LOGIN_UNKNOWN"
+}
+
+// the server accepted the password, whatever it refused afterwards
+func (o LoginOutcome) CredentialsValid() bool {
+	switch o {
+	case LOGIN_SUCCESS, LOGIN_PASSWORD_EXPIRED, LOGIN_ACCOUNT_RESTRICTED, LOGIN_LOGON_TYPE_NOT_GRANTED:
+		return true
+	}
+	return false
+}
+
+/**
+ * Outcome of the error of Login or of SessionErr, from the errorCode of
+ * the TSRequest with NLA or the Set Error Info PDU of the server.
+ * A nil err is LOGIN_SUCCESS
+ */
+func ClassifyLogin(err error) LoginOutcome {
+	if err == nil {
+		return LOGIN_SUCCESS
+	}
+	var errorInfo *ErrorInfoError
+	if errors.As(err, &errorInfo) && errorInfo.Code == pdu.ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES {
+		return LOGIN_LOGON_TYPE_NOT_GRANTED
+	}
+	switch {
+	case errors.Is(err, ErrAccountLocked):
+		return LOGIN_ACCOUNT_LOCKED
+	case errors.Is(err, ErrAccountDisabled), errors.Is(err, ErrAccountExpired):
+		return LOGIN_ACCOUNT_DISABLED
+	case errors.Is(err, ErrPasswordExpired), errors.Is(err, ErrPasswordMustChange):
+		return LOGIN_PASSWORD_EXPIRED
+	case errors.Is(err, ErrAccountRestriction):
+		return LOGIN_ACCOUNT_RESTRICTED
+	case errors.Is(err, ErrLogonTypeNotGranted), errors.Is(err, ErrAuthorizationDenied):
+		return LOGIN_LOGON_TYPE_NOT_GRANTED
+	case errors.Is(err, ErrLogonFailure):
+		return LOGIN_BAD_CREDENTIALS
+	}
+	return LOGIN_UNKNOWN
+}
+
+// CredSSP failures retried over PROTOCOL_SSL by WithFallbackToSSL,
+// none of them tells anything about the credentials
+var sslFallbackErrors = []error{
+	ErrSecurityPackage,
+}
+
+func isSSLFallbackError(err error) bool {
+	for _, e := range sslFallbackErrors {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrHandshakeTimeout for a failure past the deadline, the reads and writes fail then
+func handshakeErr(err error, deadline time.Time) error {
+	if err != nil && err != ErrHandshakeTimeout && !time.Now().Before(deadline) {
+		return ErrHandshakeTimeout
+	}
+	return err
+}
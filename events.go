@@ -0,0 +1,126 @@
+package grdp
+
+import (
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/protocol/lic"
+	"github.com/icodeface/grdp/protocol/t125/gcc"
+	"github.com/icodeface/grdp/protocol/x224"
+	"github.com/icodeface/tls"
+	"time"
+)
+
+// step of a connection reported to the OnEvent handlers
+type EventType int
+
+const (
+	// the TCP connection is established, through the proxy if any
+	EventConnected EventType = iota + 1
+	// the server answered the connection request with a negotiation
+	EventNegotiated
+	// the TLS handshake completed
+	EventTLSEstablished
+	// CredSSP ended, Err is nil when the credentials were accepted
+	EventNLACompleted
+	// a licensing packet of the server, sent before the logon completes
+	EventLicenseReceived
+	// licensing is over, the server accepted the client
+	EventLogonSucceeded
+	// the connection is closed, Err is why, nil when it succeeded
+	EventDisconnected
+	// the attempt failed with Err
+	EventError
+)
+
+var eventTypeNames = map[EventType]string{
+	EventConnected:       "connected",
+	EventNegotiated:      "negotiated",
+	EventTLSEstablished:  "tls_established",
+	EventNLACompleted:    "nla_completed",
+	EventLicenseReceived: "license_received",
+	EventLogonSucceeded:  "logon_succeeded",
+	EventDisconnected:    "disconnected",
+	EventError:           "error",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+/**
+ * Step of a Login or FingerprintNLA, the fields of its layer are set,
+ * the others are zero
+ */
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Client.Host and the connection identifier, see Client.ConnID
+	Host   string
+	ConnID string
+	// remote address of EventConnected
+	Addr string
+	// answer of the server of EventNegotiated
+	Negotiation *x224.NegotiationResult
+	// channel of EventTLSEstablished
+	TLS *tls.ConnectionState
+	// packet of EventLicenseReceived
+	License *lic.LicensePacket
+	// core data of the server of EventLogonSucceeded, nil when it sent none
+	Server *gcc.ServerCoreData
+	// outcome of EventNLACompleted, EventDisconnected and EventError
+	Err error
+}
+
+/**
+ * Call fn with the events of the next attempts, after the handlers set
+ * before. It is called from the goroutines of the connection, in the
+ * order of the handshake, it must be safe for concurrent use and return
+ * quickly
+ */
+func (g *Client) OnEvent(fn func(Event)) {
+	g.mu.Lock()
+	g.eventHandlers = append(g.eventHandlers, fn)
+	g.mu.Unlock()
+}
+
+func (g *Client) emit(e Event) {
+	g.mu.Lock()
+	handlers := g.eventHandlers
+	g.mu.Unlock()
+	if len(handlers) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	e.Host = g.Host
+	e.ConnID = g.connID
+	for _, fn := range handlers {
+		fn(e)
+	}
+}
+
+/**
+ * Instrumentation of the SocketLayer of an attempt, the end of its TLS
+ * handshake and CredSSP become events
+ */
+type layerEvents struct {
+	core.Instrumentation
+	g     *Client
+	layer *core.SocketLayer
+}
+
+func (l *layerEvents) PhaseEnded(name string) {
+	l.Instrumentation.PhaseEnded(name)
+	if name != core.PHASE_TLS {
+		return
+	}
+	if state, ok := l.layer.TLSState(); ok {
+		l.g.emit(Event{Type: EventTLSEstablished, TLS: state})
+	}
+}
+
+func (l *layerEvents) AuthResult(outcome error) {
+	l.Instrumentation.AuthResult(outcome)
+	l.g.emit(Event{Type: EventNLACompleted, Err: outcome})
+}
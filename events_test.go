@@ -0,0 +1,178 @@
+package grdp_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/icodeface/grdp"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/protocol/nla"
+	"github.com/icodeface/grdp/protocol/x224"
+)
+
+// events of the handlers of g, in the order they came
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []grdp.Event
+}
+
+func recordEvents(g *grdp.Client) *eventRecorder {
+	r := &eventRecorder{}
+	g.OnEvent(func(e grdp.Event) {
+		r.mu.Lock()
+		r.events = append(r.events, e)
+		r.mu.Unlock()
+	})
+	return r
+}
+
+func (r *eventRecorder) types() []grdp.EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	types := []grdp.EventType{}
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func (r *eventRecorder) get(t grdp.EventType) (grdp.Event, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.events {
+		if e.Type == t {
+			return e, true
+		}
+	}
+	return grdp.Event{}, false
+}
+
+func equalTypes(a, b []grdp.EventType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOnEvent(t *testing.T) {
+	srv, err := rdptest.NewServer(append(sessionScenario, rdptest.ExpectDisconnect(), rdptest.ExpectClose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE)
+	r := recordEvents(g)
+	if err = g.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	expected := []grdp.EventType{grdp.EventConnected, grdp.EventNegotiated, grdp.EventTLSEstablished,
+		grdp.EventLicenseReceived, grdp.EventLogonSucceeded, grdp.EventDisconnected}
+	if types := r.types(); !equalTypes(types, expected) {
+		t.Fatal(types, "not equal to", expected)
+	}
+	for i, e := range r.events {
+		if e.Host != srv.Addr() || e.ConnID != g.ConnID() || e.Time.IsZero() {
+			t.Error(e.Type, e.Host, e.ConnID, e.Time)
+		}
+		if i > 0 && e.Time.Before(r.events[i-1].Time) {
+			t.Error(e.Type, "before", r.events[i-1].Type)
+		}
+	}
+	if e, _ := r.get(grdp.EventConnected); e.Addr != srv.Addr() {
+		t.Error(e.Addr, "not equal to", srv.Addr())
+	}
+	if e, _ := r.get(grdp.EventNegotiated); e.Negotiation == nil || e.Negotiation.SelectedProtocol != x224.PROTOCOL_SSL {
+		t.Error(e.Negotiation, "not equal to", "PROTOCOL_SSL")
+	}
+	if e, _ := r.get(grdp.EventTLSEstablished); e.TLS == nil || !e.TLS.HandshakeComplete {
+		t.Error(e.TLS, "not a completed handshake")
+	}
+	if e, _ := r.get(grdp.EventLicenseReceived); e.License == nil {
+		t.Error("no license packet")
+	}
+	if e, _ := r.get(grdp.EventLogonSucceeded); e.Server == nil || e.Server.RdpVersion != rdptest.ServerVersion {
+		t.Error(e.Server, "not the server core data")
+	}
+	if e, _ := r.get(grdp.EventDisconnected); e.Err != nil {
+		t.Error(e.Err, "not equal to", nil)
+	}
+}
+
+func TestOnEventFailure(t *testing.T) {
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+		rdptest.StartTLS(nil),
+		rdptest.ReadNTLMNegotiate(),
+		rdptest.SendNTLMChallenge(0xe28a8235),
+		rdptest.ReadTSRequest(),
+		rdptest.SendNTStatus(nla.STATUS_LOGON_FAILURE),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE)
+	r := recordEvents(g)
+	loginErr := g.Login("alice", "secret")
+	if !errors.Is(loginErr, grdp.ErrNLAAuthFailed) {
+		t.Fatal(loginErr, "not", grdp.ErrNLAAuthFailed)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	expected := []grdp.EventType{grdp.EventConnected, grdp.EventNegotiated, grdp.EventTLSEstablished,
+		grdp.EventNLACompleted, grdp.EventError, grdp.EventDisconnected}
+	if types := r.types(); !equalTypes(types, expected) {
+		t.Fatal(types, "not equal to", expected)
+	}
+	if e, _ := r.get(grdp.EventNLACompleted); e.Err == nil {
+		t.Error("credentials accepted")
+	}
+	for _, typ := range []grdp.EventType{grdp.EventError, grdp.EventDisconnected} {
+		if e, _ := r.get(typ); e.Err != loginErr {
+			t.Error(typ, e.Err, "not equal to", loginErr)
+		}
+	}
+}
+
+func TestOnEventDialError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := l.Addr().String()
+	l.Close()
+
+	g := grdp.NewClient(refused, glog.NONE)
+	r := recordEvents(g)
+	loginErr := g.Login("alice", "secret")
+	if types := r.types(); !equalTypes(types, []grdp.EventType{grdp.EventError}) {
+		t.Fatal(types, "not equal to", grdp.EventError)
+	}
+	if e, _ := r.get(grdp.EventError); e.Err != loginErr || e.Err == nil {
+		t.Error(e.Err, "not equal to", loginErr)
+	}
+	if _, err = g.FingerprintNLA(); err == nil {
+		t.Fatal("fingerprinted")
+	}
+	if types := r.types(); len(types) != 2 || types[1] != grdp.EventError {
+		t.Error(types, "not ending with", grdp.EventError)
+	}
+}
+
+func TestEventTypeString(t *testing.T) {
+	if grdp.EventTLSEstablished.String() != "tls_established" || grdp.EventType(0).String() != "unknown" {
+		t.Error(grdp.EventTLSEstablished, grdp.EventType(0))
+	}
+}
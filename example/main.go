@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/icodeface/grdp"
-	"github.com/icodeface/grdp/glog"
 	"github.com/icodeface/grdp/protocol/x224"
 	"strconv"
+	"time"
 )
 
 func main() {
@@ -14,11 +15,16 @@ func main() {
 		execute("192.168.2.108", strconv.Itoa(p))
 	}
 }
+
+var results = x224.NewFileResultWriter("./结果.txt")
+
 func execute(host, port string) (hostx, portx string) {
 	hosts := host + ":" + port
-	client := grdp.NewClient(hosts, glog.INFO)
-	client.Login("Administrator", "123456") //
-	if x224.FindSuccess == hosts {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	result, err := grdp.Probe(ctx, hosts, x224.PROTOCOL_SSL|x224.PROTOCOL_HYBRID)
+	if err == nil && result.Negotiated {
+		results.WriteResult(result.Negotiation)
 		return hosts, port
 		//fmt.Println(port + "	successful")
 	}
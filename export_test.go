@@ -0,0 +1,36 @@
+package grdp
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+)
+
+func DialHTTPProxy(proxy *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	return dialHTTPProxy(context.Background(), &net.Dialer{Timeout: timeout}, proxy, addr)
+}
+
+func Retryable(result ProbeResult, err error, retryRefused bool) bool {
+	return retryable(result, err, retryRefused)
+}
+
+// clock of the timings stubbed by f until restore is called
+func StubNow(f func() time.Time) (restore func()) {
+	now = f
+	return func() { now = time.Now }
+}
+
+// counts result in the Stats of s as a scan would
+func (s *Scanner) AddStats(result ScanResult) {
+	s.stats.add(result)
+}
+
+// quantile q of durations counted in buckets of bounds
+func Quantile(bounds []time.Duration, durations []time.Duration, q float64) time.Duration {
+	h := newHistogram(bounds)
+	for _, d := range durations {
+		h.add(d)
+	}
+	return h.quantile(q)
+}
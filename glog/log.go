@@ -5,6 +5,7 @@ import (
 	"sync"
 )
 
+// clients log concurrently, logger and level are used under mu
 var (
 	logger *log.Logger
 	level  LEVEL
@@ -22,55 +23,50 @@ const (
 )
 
 func SetLogger(l *log.Logger) {
+	mu.Lock()
+	defer mu.Unlock()
 	logger = l
 }
 
 func SetLevel(l LEVEL) {
+	mu.Lock()
+	defer mu.Unlock()
 	level = l
 }
 
-func checkLogger() {
-	if logger == nil && level != NONE {
-		panic("logger not inited")
+// whether Debug logs, to skip building expensive arguments
+func IsDebug() bool {
+	return enabled(DEBUG)
+}
+
+func enabled(l LEVEL) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return level <= l && logger != nil
+}
+
+func print(l LEVEL, prefix string, v []interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	// nothing is logged until SetLogger
+	if logger != nil && level <= l {
+		logger.SetPrefix(prefix)
+		logger.Println(v...)
 	}
 }
 
 func Debug(v ...interface{}) {
-	checkLogger()
-	if level <= DEBUG {
-		mu.Lock()
-		defer mu.Unlock()
-		logger.SetPrefix("[DEBUG]")
-		logger.Print(v)
-	}
+	print(DEBUG, "[DEBUG]", v)
 }
 
 func Info(v ...interface{}) {
-	checkLogger()
-	if level <= INFO {
-		mu.Lock()
-		defer mu.Unlock()
-		logger.SetPrefix("[INFO]")
-		logger.Print(v)
-	}
+	print(INFO, "[INFO]", v)
 }
 
 func Warn(v ...interface{}) {
-	checkLogger()
-	if level <= WARN {
-		mu.Lock()
-		defer mu.Unlock()
-		logger.SetPrefix("[WARN]")
-		logger.Print(v)
-	}
+	print(WARN, "[WARN]", v)
 }
 
 func Error(v ...interface{}) {
-	checkLogger()
-	if level <= ERROR {
-		mu.Lock()
-		defer mu.Unlock()
-		logger.SetPrefix("[ERROR]")
-		logger.Print(v)
-	}
+	print(ERROR, "[ERROR]", v)
 }
@@ -0,0 +1,153 @@
+package glog
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+/**
+ * Leveled logger with key-value fields, carried by each layer of a
+ * client so that lines can be told apart. Default and New write like
+ * the package functions, NewSlog adapts a log/slog logger
+ */
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+	// whether Debug logs, to skip building expensive fields
+	IsDebug() bool
+	// logger adding keyvals to each line
+	With(keyvals ...interface{}) Logger
+}
+
+type stdLogger struct {
+	// nil for the package logger and level
+	logger *log.Logger
+	level  LEVEL
+	fields string
+}
+
+// the package logger and level set by SetLogger and SetLevel
+func Default() Logger {
+	return &stdLogger{}
+}
+
+// logger of its own, independent of SetLogger and SetLevel
+func New(l *log.Logger, level LEVEL) Logger {
+	return &stdLogger{logger: l, level: level}
+}
+
+func (l *stdLogger) enabled(lv LEVEL) bool {
+	if l.logger == nil {
+		return enabled(lv)
+	}
+	return l.level <= lv && l.level != NONE
+}
+
+func (l *stdLogger) print(lv LEVEL, prefix, msg string, keyvals []interface{}) {
+	if !l.enabled(lv) {
+		return
+	}
+	line := msg + l.fields + formatFields(keyvals)
+	if l.logger != nil {
+		l.logger.Println(prefix + line)
+		return
+	}
+	switch lv {
+	case DEBUG:
+		Debug(line)
+	case INFO:
+		Info(line)
+	case WARN:
+		Warn(line)
+	default:
+		Error(line)
+	}
+}
+
+func (l *stdLogger) Debug(msg string, keyvals ...interface{}) {
+	l.print(DEBUG, "[DEBUG]", msg, keyvals)
+}
+
+func (l *stdLogger) Info(msg string, keyvals ...interface{}) {
+	l.print(INFO, "[INFO]", msg, keyvals)
+}
+
+func (l *stdLogger) Warn(msg string, keyvals ...interface{}) {
+	l.print(WARN, "[WARN]", msg, keyvals)
+}
+
+func (l *stdLogger) Error(msg string, keyvals ...interface{}) {
+	l.print(ERROR, "[ERROR]", msg, keyvals)
+}
+
+func (l *stdLogger) IsDebug() bool {
+	return l.enabled(DEBUG)
+}
+
+func (l *stdLogger) With(keyvals ...interface{}) Logger {
+	return &stdLogger{logger: l.logger, level: l.level, fields: l.fields + formatFields(keyvals)}
+}
+
+// " key=value" for each pair, a key without value is kept as is
+func formatFields(keyvals []interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 == len(keyvals) {
+			fmt.Fprintf(&b, " %v", keyvals[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+	return b.String()
+}
+
+// logger adding the current phase of a connection, shared by its layers
+type phaseLogger struct {
+	Logger
+	phase *atomic.Value
+}
+
+/**
+ * Logger adding a phase field which the layers update with SetPhase as
+ * the connection progresses
+ */
+func WithPhase(l Logger, phase string) Logger {
+	p := &phaseLogger{l, &atomic.Value{}}
+	p.phase.Store(phase)
+	return p
+}
+
+// update the phase of a logger from WithPhase, other loggers are left alone
+func SetPhase(l Logger, phase string) {
+	if p, ok := l.(*phaseLogger); ok {
+		p.phase.Store(phase)
+	}
+}
+
+func (p *phaseLogger) fields(keyvals []interface{}) []interface{} {
+	return append([]interface{}{"phase", p.phase.Load()}, keyvals...)
+}
+
+func (p *phaseLogger) Debug(msg string, keyvals ...interface{}) {
+	p.Logger.Debug(msg, p.fields(keyvals)...)
+}
+
+func (p *phaseLogger) Info(msg string, keyvals ...interface{}) {
+	p.Logger.Info(msg, p.fields(keyvals)...)
+}
+
+func (p *phaseLogger) Warn(msg string, keyvals ...interface{}) {
+	p.Logger.Warn(msg, p.fields(keyvals)...)
+}
+
+func (p *phaseLogger) Error(msg string, keyvals ...interface{}) {
+	p.Logger.Error(msg, p.fields(keyvals)...)
+}
+
+func (p *phaseLogger) With(keyvals ...interface{}) Logger {
+	return &phaseLogger{p.Logger.With(keyvals...), p.phase}
+}
@@ -0,0 +1,37 @@
+package glog_test
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/icodeface/grdp/glog"
+)
+
+func TestNew(t *testing.T) {
+	buff := &bytes.Buffer{}
+	logger := glog.New(log.New(buff, "", 0), glog.INFO).With("host", "rdp0", "conn", 1)
+	logger.Debug("hidden")
+	logger.Info("x224 connect", "err", nil, "odd")
+	expected := "[INFO]x224 connect host=rdp0 conn=1 err=<nil> odd\n"
+	if buff.String() != expected {
+		t.Error(buff.String(), "not equal to", expected)
+	}
+	if logger.IsDebug() {
+		t.Error("debug enabled at INFO")
+	}
+}
+
+func TestWithPhase(t *testing.T) {
+	buff := &bytes.Buffer{}
+	logger := glog.WithPhase(glog.New(log.New(buff, "", 0), glog.DEBUG).With("conn", "1a2b"), "x224")
+	layer := logger.With("layer", "tpkt")
+	layer.Debug("recvHeader")
+	glog.SetPhase(logger, "tls")
+	layer.Debug("recvData")
+	expected := "[DEBUG]recvHeader conn=1a2b layer=tpkt phase=x224\n" +
+		"[DEBUG]recvData conn=1a2b layer=tpkt phase=tls\n"
+	if buff.String() != expected {
+		t.Error(buff.String(), "not equal to", expected)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build go1.21
+// +build go1.21
+
+package glog
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// Logger writing to a log/slog logger, keyvals become attributes
+func NewSlog(l *slog.Logger) Logger {
+	return &slogLogger{l}
+}
+
+func (s *slogLogger) Debug(msg string, keyvals ...interface{}) {
+	s.l.Debug(msg, keyvals...)
+}
+
+func (s *slogLogger) Info(msg string, keyvals ...interface{}) {
+	s.l.Info(msg, keyvals...)
+}
+
+func (s *slogLogger) Warn(msg string, keyvals ...interface{}) {
+	s.l.Warn(msg, keyvals...)
+}
+
+func (s *slogLogger) Error(msg string, keyvals ...interface{}) {
+	s.l.Error(msg, keyvals...)
+}
+
+func (s *slogLogger) IsDebug() bool {
+	return s.l.Enabled(context.Background(), slog.LevelDebug)
+}
+
+func (s *slogLogger) With(keyvals ...interface{}) Logger {
+	return &slogLogger{s.l.With(keyvals...)}
+}
@@ -0,0 +1,34 @@
+//go:build go1.21
+// +build go1.21
+
+package glog_test
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/icodeface/grdp/glog"
+)
+
+func TestNewSlog(t *testing.T) {
+	buff := &bytes.Buffer{}
+	handler := slog.NewTextHandler(buff, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	logger := glog.NewSlog(slog.New(handler)).With("host", "rdp0")
+	logger.Debug("hidden")
+	logger.Warn("tls fallback", "conn", 1)
+	expected := "level=WARN msg=\"tls fallback\" host=rdp0 conn=1\n"
+	if buff.String() != expected {
+		t.Error(buff.String(), "not equal to", expected)
+	}
+	if logger.IsDebug() {
+		t.Error("debug enabled at INFO")
+	}
+}
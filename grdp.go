@@ -1,71 +1,932 @@
 package grdp
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/emission"
 	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/protocol/lic"
 	"github.com/icodeface/grdp/protocol/nla"
 	"github.com/icodeface/grdp/protocol/pdu"
 	"github.com/icodeface/grdp/protocol/sec"
 	"github.com/icodeface/grdp/protocol/t125"
+	"github.com/icodeface/grdp/protocol/t125/gcc"
 	"github.com/icodeface/grdp/protocol/tpkt"
 	"github.com/icodeface/grdp/protocol/x224"
+	"github.com/icodeface/tls"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"io"
 	"log"
 	"net"
+	"net/url"
 	"os"
-	"strings"
+	"sync"
 	"time"
 )
 
 type Client struct {
-	Host string // ip:port
-	tpkt *tpkt.TPKT
-	x224 *x224.X224
-	mcs  *t125.MCSClient
-	sec  *sec.Client
-	pdu  *pdu.Client
+	Host               string // ip:port
+	hostname           string
+	spn                string
+	domain             string
+	clientName         string
+	clientBuild        uint32
+	keyboardLayout     gcc.KeyboardLayout
+	keyboardType       gcc.KeyboardType
+	keyboardSubType    uint32
+	keyboardFnKeys     uint32
+	screen             *Screen
+	workstation        string
+	krb5               *client.Client
+	ntHash             []byte
+	lmCompatLevel      int
+	ntlm               *nla.NTLMv2
+	restrictedAdmin    bool
+	adminWait          time.Duration
+	cookie             string
+	routingToken       []byte
+	correlationID      *[16]byte
+	currentUser        bool
+	serverAuthWarnOnly bool
+	tlsConfig          *tls.Config
+	serverName         string
+	legacyTLSFallback  bool
+	tlsState           *tls.ConnectionState
+	fallbackToSSL      bool
+	fellBackToSSL      bool
+	licenseError       *lic.ErrorMessage
+	results            x224.ResultWriter
+	negotiation        *x224.NegotiationResult
+	serverCoreData     *gcc.ServerCoreData
+	timer              *core.PhaseTimer
+	timings            Timings
+	eventHandlers      []func(Event)
+	loginTimeout       time.Duration
+	handshakeTimeout   time.Duration
+	negotiationTimeout time.Duration
+	logLevel           glog.LEVEL
+	logLevelSet        bool
+	dialTimeout        time.Duration
+	protocols          uint32
+	optErr             error
+	keepSession        bool
+	mu                 sync.Mutex
+	session            *session
+	recordTranscript   bool
+	unsafeLogSecrets   bool
+	transcript         *nla.Transcript
+	conn               net.Conn
+	fromConn           bool
+	httpProxy          *url.URL
+	dialer             Dialer
+	instr              core.Instrumentation
+	metrics            Metrics
+	log                glog.Logger
+	fixedConnID        string
+	connID             string
+	tpkt               *tpkt.TPKT
+	x224               *x224.X224
+	mcs                *t125.MCSClient
+	sec                *sec.Client
+	pdu                *pdu.Client
 }
 
-func NewClient(host string, logLevel glog.LEVEL) *Client {
-	glog.SetLevel(logLevel)
-	logger := log.New(os.Stdout, "", 0)
-	glog.SetLogger(logger)
-	return &Client{
-		Host: host,
+// how long Login waits for the server by default, see WithLoginTimeout
+var DefaultLoginTimeout = 10 * time.Second
+
+/**
+ * how long a connection may take from its dial to the end of licensing
+ * by default, whatever the server is stuck in. See WithHandshakeTimeout
+ */
+var DefaultHandshakeTimeout = 15 * time.Second
+
+// how long a direct dial waits for the TCP connection by default, see WithDialTimeout
+var DefaultDialTimeout = 3 * time.Second
+
+/**
+ * Client of host, ip:port. The options are checked together once they
+ * are all applied, a value out of range or options that contradict
+ * each other give an error wrapping ErrInvalidOption. The package
+ * logger of glog is left as the application set it, unless
+ * WithLogLevel is given
+ */
+func New(host string, opts ...Option) (*Client, error) {
+	c := newClient(host, opts)
+	if c.optErr != nil {
+		return nil, c.optErr
+	}
+	return c, nil
+}
+
+/**
+ * Deprecated: use New, which reports invalid options. The client of
+ * NewClient returns their error from Login and FingerprintNLA
+ */
+func NewClient(host string, logLevel glog.LEVEL, opts ...Option) *Client {
+	return newClient(host, append([]Option{WithLogLevel(logLevel)}, opts...))
+}
+
+// client with opts applied, its optErr set when they are invalid
+func newClient(host string, opts []Option) *Client {
+	c := &Client{
+		Host:             host,
+		lmCompatLevel:    3,
+		loginTimeout:     DefaultLoginTimeout,
+		handshakeTimeout: DefaultHandshakeTimeout,
+		logLevel:         glog.INFO,
+		protocols:        x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID,
+		instr:            core.NopInstrumentation{},
+		timer:            core.NewPhaseTimer(now),
+		log:              glog.Default(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.optErr == nil {
+		c.optErr = c.checkOptions()
+	}
+	if c.metrics != nil {
+		c.instr = core.MultiInstrumentation(c.instr, metricsInstrumentation{m: c.metrics})
+	}
+	if c.logLevelSet {
+		glog.SetLevel(c.logLevel)
+		glog.SetLogger(log.New(os.Stdout, "", 0))
+	}
+	return c
+}
+
+/**
+ * Client over a connection dialed by the caller, an SSH port forward or
+ * a custom dialer. The client owns conn: the first Login or
+ * FingerprintNLA uses it and closes it, Close closes it when unused.
+ * A connection is used once so the TLS and SSL fallbacks fail with
+ * ErrConnUsed. WithHostname names the server for the TLS SNI, the SPN
+ * and the NTLM target. Invalid options are returned by Login and
+ * FingerprintNLA, see New
+ */
+func NewClientFromConn(conn net.Conn, opts ...Option) *Client {
+	c := newClient("", opts)
+	c.Host = c.hostname
+	c.conn = conn
+	c.fromConn = true
+	return c
+}
+
+// connection of the next attempt, the one given to NewClientFromConn or a new one
+func (g *Client) dial(ctx context.Context) (conn net.Conn, err error) {
+	g.connID = g.fixedConnID
+	if g.connID == "" {
+		g.connID = newConnID()
+	}
+	if g.fromConn {
+		g.mu.Lock()
+		conn, g.conn = g.conn, nil
+		g.mu.Unlock()
+		if conn == nil {
+			return nil, ErrConnUsed
+		}
+	} else if g.httpProxy != nil {
+		// the proxy hop is a phase of its own
+		g.phaseStarted(core.PHASE_PROXY)
+		conn, err = dialHTTPProxy(ctx, g.netDialer(), g.httpProxy, g.Host)
+		g.phaseEnded(core.PHASE_PROXY)
+	} else {
+		g.phaseStarted(core.PHASE_DIAL)
+		conn, err = g.netDialer().DialContext(ctx, "tcp", g.Host)
+		g.phaseEnded(core.PHASE_DIAL)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	g.instr.ConnOpened(g.Host)
+	g.emit(Event{Type: EventConnected, Addr: conn.RemoteAddr().String()})
+	return conn, nil
+}
+
+// the dialer of WithDialer, a direct one with DefaultDialTimeout by default
+func (g *Client) netDialer() Dialer {
+	if g.dialer != nil {
+		return g.dialer
+	}
+	timeout := g.dialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	return &net.Dialer{Timeout: timeout}
+}
+
+/**
+ * Close c once ctx is done, its pending reads, writes and handshakes
+ * then fail. stop ends the watch, c is not closed after it returned
+ */
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stopc := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stopc:
+		}
+	}()
+	return func() {
+		close(stopc)
+		wg.Wait()
+	}
+}
+
+// short random identifier of a connection in the logs
+func newConnID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// identifier of the last connection, the conn field of its log lines
+func (g *Client) ConnID() string {
+	return g.connID
+}
+
+// end of an attempt, err is its outcome
+func (g *Client) closeConn(conn net.Conn, err error) {
+	conn.Close()
+	g.instr.ConnClosed(err)
+	g.emit(Event{Type: EventDisconnected, Err: err})
+}
+
+/**
+ * Connection of a Login and its layers, kept open after a successful
+ * Login with WithKeepSession until Client.Close
+ */
+type session struct {
+	conn  net.Conn
+	layer *core.SocketLayer
+	x224  *x224.X224
+	mcs   *t125.MCSClient
+	pdu   *pdu.Client
+	// the server accepted the client, it is told about the disconnection
+	connected bool
+	// removes the listeners added by Login
+	removers []func()
+	once     sync.Once
+	mu       sync.Mutex
+	// first failure reported by the layers, see Client.SessionErr
+	err error
+	// closed with the first failure
+	failed chan struct{}
+	// closed once the client is activated, see Client.Screenshot
+	ready     chan struct{}
+	readyOnce sync.Once
+	// emitted by the layers, nil without WithMetrics
+	errors *layerErrors
+}
+
+type listener interface {
+	Listen(event, listener interface{}) emission.ListenerID
+	Remove(id emission.ListenerID) bool
+}
+
+func (s *session) listen(e listener, event string, fn interface{}) {
+	id := e.Listen(event, fn)
+	s.removers = append(s.removers, func() { e.Remove(id) })
+}
+
+func (s *session) fail(err error) {
+	if err == io.EOF {
+		err = ErrConnClosed
+	}
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+		close(s.failed)
+	}
+	s.mu.Unlock()
+}
+
+// disconnects from the server once, stops the readers and closes the connection
+func (s *session) close() (err error) {
+	s.once.Do(func() {
+		if s.connected {
+			s.mcs.SendDisconnectProviderUltimatum()
+			// closes the layer once the server was told
+			err = s.x224.Disconnect(x224.REASON_NORMAL)
+			if s.sessionErr() != nil {
+				// the server ended the session, it could not be told
+				err = nil
+			}
+		} else if s.x224 != nil {
+			// closes the layer
+			err = s.x224.Close()
+		} else if s.layer != nil {
+			err = s.layer.Close()
+		}
+		// the layer may have failed to close the TLS channel
+		s.conn.Close()
+		for _, remove := range s.removers {
+			remove()
+		}
+	})
+	return err
+}
+
+// end of an attempt, err is its outcome
+func (g *Client) endSession(s *session, err error) error {
+	closeErr := s.close()
+	if s.errors != nil {
+		s.errors.report(g.metrics)
+	}
+	g.instr.ConnClosed(err)
+	reason := err
+	if reason == nil {
+		// the server may have ended the kept session before
+		reason = s.sessionErr()
+	}
+	g.emit(Event{Type: EventDisconnected, Err: reason})
+	return closeErr
+}
+
+/**
+ * Disconnect the session kept by WithKeepSession, or close the
+ * connection given to NewClientFromConn when no attempt used it.
+ * Safe to call several times and from another goroutine
+ */
+func (g *Client) Close() error {
+	g.mu.Lock()
+	conn, s := g.conn, g.session
+	g.conn, g.session = nil, nil
+	g.mu.Unlock()
+	if s != nil {
+		return g.endSession(s, nil)
+	}
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+/**
+ * Why the server ended the session kept by WithKeepSession, nil while it
+ * is up or when there is none. A *ErrorInfoError when the server sent
+ * the reason, see ClassifyLogin, ErrConnClosed otherwise
+ */
+func (g *Client) SessionErr() error {
+	g.mu.Lock()
+	s := g.session
+	g.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.sessionErr()
+}
+
+// desktop of a session, see WithScreen
+type Screen struct {
+	Width, Height uint16
+	BitsPerPixel  uint16
+}
+
+/**
+ * Desktop the server gave the session kept by WithKeepSession in its
+ * demand active, false until the client is activated
+ */
+func (g *Client) Screen() (Screen, bool) {
+	g.mu.Lock()
+	s := g.session
+	g.mu.Unlock()
+	if s == nil {
+		return Screen{}, false
+	}
+	select {
+	case <-s.ready:
+	default:
+		return Screen{}, false
+	}
+	width, height := s.pdu.DesktopSize()
+	return Screen{Width: width, Height: height, BitsPerPixel: s.pdu.BitsPerPixel()}, true
+}
+
+func (s *session) sessionErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (g *Client) authenticator(domain, user, pwd string) (nla.Authenticator, error) {
+	if g.currentUser {
+		sspi, err := nla.NewSSPI(g.servicePrincipalName())
+		if err != nil {
+			return nil, err
+		}
+		return sspi, nil
+	}
+	if g.krb5 == nil {
+		ntlm := nla.NewNTLMv2(domain, user, pwd)
+		if g.ntHash != nil {
+			var err error
+			if ntlm, err = nla.NewNTLMv2FromHash(domain, user, g.ntHash); err != nil {
+				return nil, err
+			}
+		}
+		workstation := g.workstation
+		if workstation == "" {
+			workstation = g.clientName
+		}
+		ntlm.SetWorkstation(workstation)
+		ntlm.SetTargetName(g.servicePrincipalName())
+		ntlm.SetLmCompatibilityLevel(g.lmCompatLevel)
+		g.ntlm = ntlm
+		return ntlm, nil
+	}
+	return nla.NewKerberosClient(g.krb5, g.servicePrincipalName()), nil
+}
+
+// TERMSRV/host, same for NTLM and Kerberos
+func (g *Client) servicePrincipalName() string {
+	if g.spn != "" {
+		return g.spn
+	}
+	hostname := g.hostname
+	if hostname == "" {
+		hostname = g.Host
+	}
+	return nla.TermSrvSPN(hostname)
+}
+
+/**
+ * NTLM response type the server accepted in the last Login, empty when
+ * it refused the response, with Kerberos, or before CredSSP got that far
+ */
+func (g *Client) NTLMResponseType() nla.NTLMResponseType {
+	if g.ntlm == nil {
+		return ""
+	}
+	return g.ntlm.AcceptedResponseType()
+}
+
+// NTLM identity of the server, see FingerprintNLA
+type ServerInfo = nla.ServerInfo
+
+/**
+ * Read the NTLM CHALLENGE of the server without attempting a logon,
+ * no credentials are ever sent
+ */
+func (g *Client) FingerprintNLA() (*ServerInfo, error) {
+	if g.optErr != nil {
+		return nil, g.optErr
 	}
+	var info *ServerInfo
+	err := g.tlsFallback(func(config *tls.Config) (err error) {
+		info, err = g.fingerprintNLA(config)
+		return err
+	})
+	return info, err
+}
+
+func (g *Client) fingerprintNLA(config *tls.Config) (info *ServerInfo, err error) {
+	g.timer = core.NewPhaseTimer(now)
+	defer g.endTimings()
+	deadline := time.Now().Add(g.handshakeTimeout)
+	conn, err := g.dial(context.Background())
+	if err != nil {
+		g.countError(LAYER_DIAL)
+		err = fmt.Errorf("[dial err] %w", err)
+		g.emit(Event{Type: EventError, Err: err})
+		return nil, err
+	}
+	defer func() {
+		err = handshakeErr(err, deadline)
+		if err != nil {
+			g.emit(Event{Type: EventError, Err: err})
+		}
+		g.closeConn(conn, err)
+	}()
+	layer := core.NewSocketLayer(conn, nil, g.log.With("host", g.Host, "conn", g.connID))
+	layer.SetDeadline(deadline)
+	layer.SetTLSConfig(config)
+	layer.SetInstrumentation(&layerEvents{core.MultiInstrumentation(g.instr, g.timer), g, layer})
+	g.phaseStarted(core.PHASE_X224)
+	neg, err := x224.ProbeWithCookie(layer, x224.PROTOCOL_SSL|x224.PROTOCOL_HYBRID, 0, x224.RequestCookie(g.cookie, g.routingToken))
+	g.phaseEnded(core.PHASE_X224)
+	if err != nil {
+		g.countError(LAYER_X224)
+		return nil, errors.New(fmt.Sprintf("[x224 connect err] %v", err))
+	}
+	if neg != nil {
+		result := x224.NewNegotiationResult(g.Host, neg)
+		g.emit(Event{Type: EventNegotiated, Negotiation: &result})
+	}
+	if neg == nil || neg.Type != x224.TYPE_RDP_NEG_RSP ||
+		(neg.Result != x224.PROTOCOL_HYBRID && neg.Result != x224.PROTOCOL_HYBRID_EX) {
+		return nil, ErrNLANotSupported
+	}
+	err = layer.StartTLS()
+	g.tlsState, _ = layer.TLSState()
+	if err != nil {
+		g.countError(LAYER_TLS)
+		return nil, err
+	}
+	g.phaseStarted(core.PHASE_NLA)
+	defer g.phaseEnded(core.PHASE_NLA)
+	if info, err = nla.Fingerprint(layer); err != nil {
+		g.countError(LAYER_NLA)
+	}
+	return info, err
+}
+
+// TLS version of the last connection, 0 when TLS was not started
+func (g *Client) TLSVersion() uint16 {
+	if g.tlsState == nil {
+		return 0
+	}
+	return g.tlsState.Version
+}
+
+// TLS cipher suite of the last connection, 0 when TLS was not started
+func (g *Client) TLSCipherSuite() uint16 {
+	if g.tlsState == nil {
+		return 0
+	}
+	return g.tlsState.CipherSuite
+}
+
+// certificate of the server on the last connection, false when TLS was not started
+func (g *Client) ServerCertificate() (*CertificateInfo, bool) {
+	if g.tlsState == nil || len(g.tlsState.PeerCertificates) == 0 {
+		return nil, false
+	}
+	return core.NewCertificateInfo(g.tlsState.PeerCertificates[0]), true
+}
+
+// TLS state of the last connection, with the server certificate chain
+func (g *Client) TLSState() (*tls.ConnectionState, bool) {
+	return g.tlsState, g.tlsState != nil
+}
+
+// TLS configuration of a connection, a clone of WithTLSConfig with WithServerName or WithHostname applied
+func (g *Client) clientTLSConfig() *tls.Config {
+	config := core.DefaultTLSConfig()
+	if g.tlsConfig != nil {
+		config = g.tlsConfig.Clone()
+	}
+	if g.serverName != "" {
+		config.ServerName = g.serverName
+	} else if g.hostname != "" {
+		config.ServerName = g.hostname
+	}
+	return config
+}
+
+// run attempt once more with TLS 1.0 allowed when the server refused the configured versions
+func (g *Client) tlsFallback(attempt func(config *tls.Config) error) error {
+	config := g.clientTLSConfig()
+	err := attempt(config)
+	if err == nil || !g.legacyTLSFallback || !core.IsTLSVersionError(err) || config.MinVersion == tls.VersionTLS10 {
+		return err
+	}
+	g.log.Info("tls handshake failed, retry with TLS 1.0", "host", g.Host, "conn", g.connID, "phase", core.PHASE_TLS, "err", err)
+	config = config.Clone()
+	config.MinVersion = tls.VersionTLS10
+	return attempt(config)
 }
 
 func (g *Client) Login(user, pwd string) error {
-	conn, err := net.DialTimeout("tcp", g.Host, 3*time.Second)
+	return g.LoginContext(context.Background(), user, pwd)
+}
+
+/**
+ * Login that gives up once ctx is done and returns ctx.Err(), the
+ * connection is closed and its readers stopped. The TLS and SSL
+ * fallbacks are not attempted after that
+ */
+func (g *Client) LoginContext(ctx context.Context, user, pwd string) error {
+	if g.optErr != nil {
+		return g.optErr
+	}
+	g.fellBackToSSL = false
+	err := g.tlsFallback(func(config *tls.Config) error {
+		return g.login(ctx, user, pwd, config, g.protocols)
+	})
+	if err == nil || !g.fallbackToSSL || !isSSLFallbackError(err) {
+		return err
+	}
+	g.log.Info("credssp failed, retry with TLS only", "host", g.Host, "conn", g.connID, "phase", core.PHASE_NLA, "err", err)
+	g.fellBackToSSL = true
+	return g.tlsFallback(func(config *tls.Config) error {
+		return g.login(ctx, user, pwd, config, x224.PROTOCOL_SSL)
+	})
+}
+
+// CredSSP messages of the last Login, nil without WithNLATranscript
+func (g *Client) NLATranscript() *nla.Transcript {
+	return g.transcript
+}
+
+// correlation id sent by Login, see WithCorrelationID
+func (g *Client) CorrelationID() ([16]byte, bool) {
+	if g.correlationID == nil {
+		return [16]byte{}, false
+	}
+	return *g.correlationID, true
+}
+
+// the last Login was retried over PROTOCOL_SSL, see WithFallbackToSSL
+func (g *Client) FellBackToSSL() bool {
+	return g.fellBackToSSL
+}
+
+/**
+ * licensing error of the last Login, nil when the server issued a
+ * license or accepted the client. Its String is the evidence of RDS
+ * licensing findings, "ERR_NO_LICENSE_SERVER (ST_TOTAL_ABORT)"
+ */
+func (g *Client) LicenseError() *lic.ErrorMessage {
+	return g.licenseError
+}
+
+/**
+ * Negotiation answered by the server to the last Login, RDP_NEG_RSP
+ * with the selected protocol or RDP_NEG_FAILURE with its code. False
+ * when the server did not confirm the connection with a negotiation
+ */
+func (g *Client) Negotiation() (x224.NegotiationResult, bool) {
+	if g.negotiation == nil {
+		return x224.NegotiationResult{}, false
+	}
+	return *g.negotiation, true
+}
+
+/**
+ * Core data of the server of the last Login, its RDP version and early
+ * capability flags from the MCS connect response. False when the login
+ * did not get past licensing
+ */
+func (g *Client) ServerCoreData() (gcc.ServerCoreData, bool) {
+	if g.serverCoreData == nil {
+		return gcc.ServerCoreData{}, false
+	}
+	return *g.serverCoreData, true
+}
+
+// RDP version of the server of the last Login, 0 when unknown, see ServerCoreData
+func (g *Client) ServerVersion() gcc.RDPVersion {
+	data, _ := g.ServerCoreData()
+	return data.RdpVersion
+}
+
+// RNS_UD_SC_* early capability flags of the server of the last Login, see ServerCoreData
+func (g *Client) ServerEarlyCapabilityFlags() uint32 {
+	data, _ := g.ServerCoreData()
+	return data.EarlyCapabilityFlags
+}
+
+func (g *Client) login(ctx context.Context, user, pwd string, config *tls.Config, protocol uint32) (err error) {
+	g.timer = core.NewPhaseTimer(now)
+	defer g.endTimings()
+	g.licenseError = nil
+	g.negotiation = nil
+	g.serverCoreData = nil
+	// a new Login ends the session kept by the previous one
+	g.mu.Lock()
+	previous := g.session
+	g.session = nil
+	g.mu.Unlock()
+	if previous != nil {
+		g.endSession(previous, nil)
+	}
+	deadline := time.Now().Add(g.handshakeTimeout)
+	conn, err := g.dial(ctx)
 	if err != nil {
-		return errors.New(fmt.Sprintf("[dial err] %v", err))
+		if err != ctx.Err() {
+			g.countError(LAYER_DIAL)
+			err = fmt.Errorf("[dial err] %w", err)
+		}
+		g.emit(Event{Type: EventError, Err: err})
+		return err
 	}
-	defer conn.Close()
+	s := &session{conn: conn, failed: make(chan struct{}), ready: make(chan struct{})}
+	defer func() {
+		if err == nil && g.keepSession {
+			s.layer.SetDeadline(time.Time{})
+			g.mu.Lock()
+			g.session = s
+			g.mu.Unlock()
+			return
+		}
+		if err != nil {
+			g.emit(Event{Type: EventError, Err: err})
+		}
+		g.endSession(s, err)
+	}()
 
-	domain := strings.Split(g.Host, ":")[0]
+	// DOMAIN\user and user@domain carry theirs, WithDomain or a local account otherwise
+	domain, user := nla.ParseCredentialName(user)
+	if domain == "" {
+		domain = g.domain
+	}
 
-	g.tpkt = tpkt.New(core.NewSocketLayer(conn, nla.NewNTLMv2(domain, user, pwd)))
-	g.x224 = x224.New(g.tpkt)
-	g.mcs = t125.NewMCSClient(g.x224)
-	g.sec = sec.NewClient(g.mcs)
-	g.pdu = pdu.NewClient(g.sec)
+	auth, err := g.authenticator(domain, user, pwd)
+	if err != nil {
+		return err
+	}
+	cssp := nla.NewCredSSP(auth, domain, user, pwd)
+	if g.currentUser {
+		// the password of the logged on user is unknown, empty credentials are delegated
+		cssp = nla.NewCredSSP(auth, "", "", "")
+	}
+	cssp.SetRestrictedAdmin(g.restrictedAdmin)
+	cssp.SetServerAuthWarnOnly(g.serverAuthWarnOnly)
+	cssp.SetLogger(g.log.With("host", g.Host, "conn", g.connID, "phase", core.PHASE_NLA))
+	if g.recordTranscript {
+		g.transcript = nla.NewTranscript(g.unsafeLogSecrets)
+		cssp.SetTranscript(g.transcript)
+	}
+	log := glog.WithPhase(g.log.With("host", g.Host, "conn", g.connID), core.PHASE_X224)
+	layer := core.NewSocketLayer(conn, cssp, log)
+	// a server stuck in any layer fails its reads and writes at the deadline
+	layer.SetDeadline(deadline)
+	layer.SetTLSConfig(config)
+	layer.SetRestrictedAdminWait(g.adminWait)
+	layer.SetInstrumentation(&layerEvents{core.MultiInstrumentation(g.instr, g.timer), g, layer})
+	// the readers stop with the layer, a cancelled ctx closes it at once
+	s.layer = layer
+	stop := closeOnDone(ctx, layer)
+	defer stop()
+	g.tpkt = tpkt.New(layer, log)
+	g.x224 = x224.New(g.tpkt, log)
+	g.mcs = t125.NewMCSClient(g.x224, log)
+	g.sec = sec.NewClient(g.mcs, log)
+	g.pdu = pdu.NewClient(g.sec, log)
+	s.x224, s.mcs, s.pdu = g.x224, g.mcs, g.pdu
+	if g.metrics != nil {
+		s.errors = &layerErrors{}
+		for i, layer := range []listener{g.tpkt, g.x224, g.mcs, g.sec, g.pdu} {
+			s.listen(layer, "error", s.errors.listener(i))
+		}
+	}
 
+	coreData := g.mcs.ClientCoreData()
+	if g.clientName != "" {
+		coreData.SetClientName(g.clientName)
+		g.sec.SetMachineName(g.clientName)
+	}
+	if g.clientBuild != 0 {
+		coreData.ClientBuild = g.clientBuild
+	}
+	if g.keyboardLayout != 0 {
+		coreData.KbdLayout = g.keyboardLayout
+	}
+	if g.screen != nil {
+		coreData.SetScreen(g.screen.Width, g.screen.Height, g.screen.BitsPerPixel)
+	}
+	if g.keyboardType != 0 {
+		coreData.KeyboardType = uint32(g.keyboardType)
+		coreData.KeyboardSubType = g.keyboardSubType
+		coreData.KeyboardFnKeys = g.keyboardFnKeys
+	}
 	g.sec.SetUser(user)
 	g.sec.SetPwd(pwd)
 	g.sec.SetDomain(domain)
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		g.sec.SetClientAddress(addr.IP)
+	}
 
 	g.tpkt.SetFastPathListener(g.pdu)
 	g.pdu.SetFastPathSender(g.tpkt)
 
-	g.x224.SetRequestedProtocol(x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID)
+	// TLS and NLA failures come back through the layers
+	errc := make(chan error, 1)
+	s.listen(g.pdu, "error", func(e error) {
+		select {
+		case errc <- e:
+		default:
+		}
+	})
+	licc := make(chan *lic.ErrorMessage, 1)
+	s.listen(g.sec, "license", func(p *lic.LicensePacket) {
+		g.emit(Event{Type: EventLicenseReceived, License: p})
+		message, ok := p.LicensingMessage.(*lic.ErrorMessage)
+		if !ok || message.ValidClient() {
+			return
+		}
+		log.Info("license error: " + message.String())
+		select {
+		case licc <- message:
+		default:
+		}
+	})
+
+	// licensing is over, the server accepted the client
+	connected := make(chan *gcc.ServerCoreData, 1)
+	s.listen(g.sec, "connect", func(_ *gcc.ClientCoreData, serverData *gcc.ServerCoreData, _, _ uint16) {
+		g.phaseEnded(core.PHASE_LICENSE)
+		g.emit(Event{Type: EventLogonSucceeded, Server: serverData})
+		connected <- serverData
+	})
+	s.listen(g.pdu, "close", func() {
+		select {
+		case errc <- ErrConnClosed:
+		default:
+		}
+	})
+	s.listen(g.pdu, "error", s.fail)
+	s.listen(g.pdu, "ready", func() {
+		s.readyOnce.Do(func() { close(s.ready) })
+	})
+	s.listen(g.pdu, "close", func() {
+		s.fail(ErrConnClosed)
+	})
+	negc := make(chan x224.NegotiationResult, 1)
+	s.listen(g.x224, "negotiated", func(result x224.NegotiationResult) {
+		g.phaseEnded(core.PHASE_X224)
+		g.emit(Event{Type: EventNegotiated, Negotiation: &result})
+		negc <- result
+	})
+	// the MCS connect initial follows TLS and NLA, licensing the channel joins
+	s.listen(g.x224, "connect", func(x224.ProtocolSelection) {
+		g.phaseStarted(core.PHASE_MCS)
+	})
+	s.listen(g.mcs, "connect", func([]interface{}, []interface{}, uint16, []t125.MCSChannelInfo) {
+		g.phaseEnded(core.PHASE_MCS)
+		g.phaseStarted(core.PHASE_LICENSE)
+	})
+
+	g.x224.SetRequestedProtocol(protocol)
+	if g.negotiationTimeout > 0 {
+		g.x224.SetConfirmTimeout(g.negotiationTimeout)
+	}
+	if g.restrictedAdmin {
+		// as mstsc /restrictedAdmin does
+		g.x224.SetRequestFlags(x224.RESTRICTED_ADMIN_MODE_REQUIRED)
+	}
+	g.x224.SetCookie(g.cookie)
+	g.x224.SetRoutingToken(g.routingToken)
+	if g.correlationID != nil {
+		g.x224.SetCorrelationID(*g.correlationID)
+	}
+	g.x224.SetResultWriter(g.results)
 
+	g.phaseStarted(core.PHASE_CONNECT)
+	defer g.phaseEnded(core.PHASE_CONNECT)
+	if !time.Now().Before(deadline) {
+		return ErrHandshakeTimeout
+	}
+	g.phaseStarted(core.PHASE_X224)
 	err = g.x224.Connect(g.Host)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil {
 		return errors.New(fmt.Sprintf("[x224 connect err] %v", err))
 	}
 
-	fmt.Println(g)
-	time.Sleep(time.Millisecond * 2000)
+	log.Debug("connection request sent", "phase", core.PHASE_CONNECT)
+	timer := time.NewTimer(g.loginTimeout)
+	defer timer.Stop()
+	handshake := time.NewTimer(time.Until(deadline))
+	defer handshake.Stop()
+	select {
+	case g.serverCoreData = <-connected:
+		s.connected = true
+	case err = <-errc:
+	case <-ctx.Done():
+	case <-timer.C:
+		err = ErrLoginTimeout
+	case <-handshake.C:
+		err = ErrHandshakeTimeout
+	}
+	if err == io.EOF {
+		err = ErrConnClosed
+	}
+	err = handshakeErr(err, deadline)
+	// the failures caused by closing the connection are not reported
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	select {
+	case g.licenseError = <-licc:
+	default:
+	}
+	select {
+	case result := <-negc:
+		g.negotiation = &result
+	default:
+	}
+	g.tlsState, _ = g.tpkt.TLSState()
+	// the server gave up on licensing, whatever ended the connection afterwards
+	if err != nil && g.licenseError != nil && !errors.Is(err, ErrLicense) {
+		err = &LicenseError{Message: g.licenseError, Err: err}
+	}
 	return err
 }
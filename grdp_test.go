@@ -0,0 +1,1376 @@
+package grdp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/icodeface/grdp"
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/protocol/nla"
+	"github.com/icodeface/grdp/protocol/pdu"
+	"github.com/icodeface/grdp/protocol/t125/gcc"
+	"github.com/icodeface/grdp/protocol/x224"
+	"github.com/icodeface/tls"
+)
+
+// NLA server up to the NTLM CHALLENGE, the client closes the connection afterwards
+var nlaScenario = []rdptest.Step{
+	rdptest.ReadConnectionRequest(),
+	rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+	rdptest.StartTLS(nil),
+	rdptest.ReadNTLMNegotiate(),
+	rdptest.SendNTLMChallenge(0xe28a8235),
+	rdptest.ExpectClose(),
+}
+
+// runs steps on conn, the session comes once they are done
+func serve(t *testing.T, conn net.Conn, steps []rdptest.Step) <-chan *rdptest.Session {
+	done := make(chan *rdptest.Session, 1)
+	go func() {
+		s, err := rdptest.ServeConn(conn, steps...)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- s
+	}()
+	return done
+}
+
+func TestNewClientFromConn(t *testing.T) {
+	client, server := net.Pipe()
+	done := serve(t, server, nlaScenario)
+
+	g := grdp.NewClientFromConn(client, grdp.WithHostname("rdp0.corp.local"))
+	glog.SetLevel(glog.NONE)
+	info, err := g.FingerprintNLA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NegotiateFlags != 0xe28a8235 {
+		t.Errorf("0x%08x not equal to 0x%08x", info.NegotiateFlags, 0xe28a8235)
+	}
+	if state, ok := g.TLSState(); !ok || len(state.PeerCertificates) != 1 {
+		t.Error("no TLS state")
+	}
+	// the client owns the connection and closes it once used
+	session := <-done
+	if session.ServerName != "rdp0.corp.local" {
+		t.Error("SNI", session.ServerName)
+	}
+	if !session.Closed {
+		t.Error("connection not closed")
+	}
+	if _, err = g.FingerprintNLA(); !errors.Is(err, grdp.ErrConnUsed) {
+		t.Error(err, "not equal to", grdp.ErrConnUsed)
+	}
+	if err = g.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithDialer(t *testing.T) {
+	client, server := net.Pipe()
+	done := serve(t, server, nlaScenario)
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+addr)
+		return client, nil
+	}
+	g := grdp.NewClient("rdp0.corp.local:3389", glog.NONE, grdp.WithDialer(grdp.DialFunc(dial)))
+	info, err := g.FingerprintNLA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NegotiateFlags != 0xe28a8235 {
+		t.Errorf("0x%08x not equal to 0x%08x", info.NegotiateFlags, 0xe28a8235)
+	}
+	if len(dialed) != 1 || dialed[0] != "tcp rdp0.corp.local:3389" {
+		t.Error(dialed, "not equal to", "tcp rdp0.corp.local:3389")
+	}
+	// the connection request, TLS and NTLM went through the pipe
+	if session := <-done; session.RequestedProtocols == 0 || !session.Closed {
+		t.Error(session.RequestedProtocols, session.Closed)
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	dialer := grdp.DialFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("not dialed")
+	})
+	tests := []struct {
+		name    string
+		options []grdp.Option
+		valid   bool
+	}{
+		{"defaults", nil, true},
+		{"log level", []grdp.Option{grdp.WithLogLevel(glog.NONE)}, true},
+		{"log level out of range", []grdp.Option{grdp.WithLogLevel(glog.NONE + 1)}, false},
+		{"nil logger", []grdp.Option{grdp.WithLogger(nil)}, false},
+		{"dial timeout", []grdp.Option{grdp.WithDialTimeout(time.Second)}, true},
+		{"zero dial timeout", []grdp.Option{grdp.WithDialTimeout(0)}, false},
+		{"dial timeout of a dialer", []grdp.Option{grdp.WithDialTimeout(time.Second), grdp.WithDialer(dialer)}, false},
+		{"nil dialer", []grdp.Option{grdp.WithDialer(nil)}, false},
+		{"negative login timeout", []grdp.Option{grdp.WithLoginTimeout(-time.Second)}, false},
+		{"zero handshake timeout", []grdp.Option{grdp.WithHandshakeTimeout(0)}, false},
+		{"zero negotiation timeout", []grdp.Option{grdp.WithNegotiationTimeout(0)}, false},
+		{"client build 0", []grdp.Option{grdp.WithClientBuild(0)}, false},
+		{"keyboard layout 0", []grdp.Option{grdp.WithKeyboardLayout(0)}, false},
+		{"us international", []grdp.Option{grdp.WithKeyboardLayout(gcc.US_INTERNATIONAL)}, true},
+		{"unknown keyboard layout", []grdp.Option{grdp.WithKeyboardLayout(0x12345678)}, false},
+		{"keyboard type", []grdp.Option{grdp.WithKeyboardType(gcc.KT_JAPANESE, 2, 12)}, true},
+		{"unknown keyboard type", []grdp.Option{grdp.WithKeyboardType(8, 0, 12)}, false},
+		{"full hd", []grdp.Option{grdp.WithScreen(1920, 1080, 32)}, true},
+		{"low bandwidth", []grdp.Option{grdp.WithScreen(800, 600, 8)}, true},
+		{"screen too wide", []grdp.Option{grdp.WithScreen(4097, 1080, 32)}, false},
+		{"odd color depth", []grdp.Option{grdp.WithScreen(800, 600, 12)}, false},
+		{"no function keys", []grdp.Option{grdp.WithKeyboardType(gcc.KT_IBM_101_102_KEYS, 0, 0)}, false},
+		{"nil tls config", []grdp.Option{grdp.WithTLSConfig(nil)}, false},
+		{"nil result writer", []grdp.Option{grdp.WithResultWriter(nil)}, false},
+		{"nil metrics", []grdp.Option{grdp.WithMetrics(nil)}, false},
+		{"lm compatibility level out of range", []grdp.Option{grdp.WithLmCompatibilityLevel(6)}, false},
+		{"ssl only", []grdp.Option{grdp.WithRequestedProtocols(x224.PROTOCOL_SSL)}, true},
+		{"rdp security", []grdp.Option{grdp.WithRequestedProtocols(x224.PROTOCOL_RDP)}, false},
+		{"rdp security with a tls config", []grdp.Option{grdp.WithRequestedProtocols(x224.PROTOCOL_RDP),
+			grdp.WithTLSConfig(&tls.Config{})}, false},
+		{"hybrid ex", []grdp.Option{grdp.WithRequestedProtocols(x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID | x224.PROTOCOL_HYBRID_EX)}, true},
+		{"hybrid ex without hybrid", []grdp.Option{grdp.WithRequestedProtocols(x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID_EX)}, false},
+		{"nla option without hybrid", []grdp.Option{grdp.WithRequestedProtocols(x224.PROTOCOL_SSL),
+			grdp.WithRestrictedAdmin()}, false},
+		{"nt hash", []grdp.Option{grdp.WithRestrictedAdmin(), grdp.WithNTHash(make([]byte, 16))}, true},
+		{"short nt hash", []grdp.Option{grdp.WithRestrictedAdmin(), grdp.WithNTHash(make([]byte, 15))}, false},
+		{"nt hash without restricted admin", []grdp.Option{grdp.WithNTHash(make([]byte, 16))}, false},
+		{"restricted admin wait", []grdp.Option{grdp.WithRestrictedAdmin(), grdp.WithRestrictedAdminWait(3 * time.Second)}, true},
+		{"zero restricted admin wait", []grdp.Option{grdp.WithRestrictedAdmin(), grdp.WithRestrictedAdminWait(0)}, false},
+		{"restricted admin wait without restricted admin", []grdp.Option{grdp.WithRestrictedAdminWait(time.Second)}, false},
+		{"empty cookie", []grdp.Option{grdp.WithCookie("")}, false},
+		{"correlation id", []grdp.Option{grdp.WithCorrelationID([16]byte{0x01})}, true},
+		{"correlation id starting with 0", []grdp.Option{grdp.WithCorrelationID([16]byte{})}, false},
+		{"correlation id with a carriage return", []grdp.Option{grdp.WithCorrelationID([16]byte{0x01, 0x0d})}, false},
+		{"empty routing token", []grdp.Option{grdp.WithRoutingToken(nil)}, false},
+		{"ssl fallback without ssl", []grdp.Option{grdp.WithRequestedProtocols(x224.PROTOCOL_HYBRID),
+			grdp.WithFallbackToSSL()}, false},
+	}
+	for _, test := range tests {
+		g, err := grdp.New("127.0.0.1:3389", append(test.options, grdp.WithLogLevel(glog.NONE))...)
+		if test.valid && (err != nil || g == nil) {
+			t.Error(test.name, err)
+		}
+		if !test.valid && (!errors.Is(err, grdp.ErrInvalidOption) || g != nil) {
+			t.Error(test.name, err, "not equal to", grdp.ErrInvalidOption)
+		}
+	}
+}
+
+func TestWithCookie(t *testing.T) {
+	tests := []struct {
+		option   grdp.Option
+		expected string
+	}{
+		{grdp.WithCookie("alice"), "Cookie: mstshash=alice"},
+		{grdp.WithRoutingToken([]byte("Cookie: msts=3640205228.15629.0000\r\n")), "Cookie: msts=3640205228.15629.0000"},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		done := serve(t, server, nlaScenario)
+		g := grdp.NewClientFromConn(client, test.option, grdp.WithLogLevel(glog.NONE))
+		if _, err := g.FingerprintNLA(); err != nil {
+			t.Fatal(err)
+		}
+		if session := <-done; session.Cookie != test.expected {
+			t.Error(session.Cookie, "not equal to", test.expected)
+		}
+	}
+}
+
+func TestWithCorrelationID(t *testing.T) {
+	id := [16]byte{0x5c, 0x2f, 0x1a, 0x77, 0x10, 0x42, 0x4e, 0x8b, 0x9d, 0x3c, 0x61, 0x28, 0xe4, 0x05, 0xb1, 0x96}
+	client, server := net.Pipe()
+	done := serve(t, server, []rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER),
+		rdptest.ExpectClose(),
+	})
+	g := grdp.NewClientFromConn(client, grdp.WithCorrelationID(id), grdp.WithLogLevel(glog.NONE))
+	if err := g.Login("alice", "secret"); !errors.Is(err, grdp.ErrNegotiationFailed) {
+		t.Error(err, "not equal to", grdp.ErrNegotiationFailed)
+	}
+	session := <-done
+	if !bytes.Equal(session.CorrelationID, id[:]) || session.RequestFlags != x224.CORRELATION_INFO_PRESENT ||
+		session.RequestedProtocols != x224.PROTOCOL_SSL|x224.PROTOCOL_HYBRID {
+		t.Errorf("%x %x %x", session.CorrelationID, session.RequestFlags, session.RequestedProtocols)
+	}
+	if sent, ok := g.CorrelationID(); !ok || sent != id {
+		t.Error(sent, ok, "not equal to", id)
+	}
+}
+
+func TestNewClientInvalidOption(t *testing.T) {
+	dialed := false
+	dialer := grdp.DialFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = true
+		return nil, errors.New("not dialed")
+	})
+	g := grdp.NewClient("127.0.0.1:3389", glog.NONE, grdp.WithDialer(dialer), grdp.WithLoginTimeout(0))
+	if err := g.Login("alice", "secret"); !errors.Is(err, grdp.ErrInvalidOption) {
+		t.Error(err, "not equal to", grdp.ErrInvalidOption)
+	}
+	if _, err := g.FingerprintNLA(); !errors.Is(err, grdp.ErrInvalidOption) {
+		t.Error(err, "not equal to", grdp.ErrInvalidOption)
+	}
+	if dialed {
+		t.Error("dialed with an invalid option")
+	}
+}
+
+func TestWithRequestedProtocols(t *testing.T) {
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER),
+		rdptest.Close(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := grdp.New(srv.Addr(), grdp.WithLogLevel(glog.NONE), grdp.WithRequestedProtocols(x224.PROTOCOL_SSL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = g.Login("alice", "secret"); !errors.Is(err, grdp.ErrNegotiationFailed) {
+		t.Error(err, "not equal to", grdp.ErrNegotiationFailed)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	if session := srv.Sessions()[0]; session.RequestedProtocols != x224.PROTOCOL_SSL {
+		t.Error(session.RequestedProtocols, "not equal to", x224.PROTOCOL_SSL)
+	}
+}
+
+func TestNewClientFromConnClose(t *testing.T) {
+	client, server := net.Pipe()
+	g := grdp.NewClientFromConn(client)
+	glog.SetLevel(glog.NONE)
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Error(err, "not equal to", io.EOF)
+	}
+}
+
+func TestInstrumentation(t *testing.T) {
+	client, server := net.Pipe()
+	done := serve(t, server, nlaScenario)
+
+	instr := grdp.NewCountingInstrumentation()
+	g := grdp.NewClientFromConn(client, grdp.WithInstrumentation(instr))
+	glog.SetLevel(glog.NONE)
+	if _, err := g.FingerprintNLA(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	counts := instr.Counts()
+	if counts.ConnsOpened != 1 || counts.ConnsClosed != 1 || counts.ConnsFailed != 0 {
+		t.Error(counts.ConnsOpened, counts.ConnsClosed, counts.ConnsFailed, "not equal to", 1, 1, 0)
+	}
+	if counts.BytesRead == 0 || counts.BytesWritten == 0 {
+		t.Error("bytes", counts.BytesRead, counts.BytesWritten)
+	}
+	for _, phase := range []string{core.PHASE_X224, core.PHASE_TLS, core.PHASE_NLA} {
+		if counts.Phases[phase] != 1 {
+			t.Error(phase, counts.Phases[phase], "not equal to", 1)
+		}
+	}
+}
+
+// log output shared by the goroutines of a client
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines of the output, a dump continues its line
+func (b *lockedBuffer) Lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n[")
+}
+
+// X224 server confirming without negotiation, which the client refuses
+var confirmScenario = []rdptest.Step{
+	rdptest.ReadConnectionRequest(),
+	rdptest.ConfirmWithoutNegotiation(),
+}
+
+func TestLoggerPerClient(t *testing.T) {
+	hosts := []string{"rdp0.corp.local", "rdp1.corp.local"}
+	outputs := make([]*lockedBuffer, len(hosts))
+	clients := make([]*grdp.Client, len(hosts))
+	for i, host := range hosts {
+		client, server := net.Pipe()
+		serve(t, server, append(sessionScenario, rdptest.ExpectDisconnect(), rdptest.ExpectClose()))
+		outputs[i] = &lockedBuffer{}
+		logger := glog.New(log.New(outputs[i], "", 0), glog.DEBUG)
+		clients[i] = grdp.NewClientFromConn(client, grdp.WithHostname(host), grdp.WithLogger(logger))
+	}
+	glog.SetLevel(glog.NONE)
+
+	var wg sync.WaitGroup
+	for _, g := range clients {
+		wg.Add(1)
+		go func(g *grdp.Client) {
+			defer wg.Done()
+			g.Login("alice", "secret")
+		}(g)
+	}
+	wg.Wait()
+
+	for i, host := range hosts {
+		lines := outputs[i].Lines()
+		if len(lines) < 2 {
+			t.Fatal(host, "logged", lines)
+		}
+		fields := "host=" + host + " conn=" + clients[i].ConnID() + " phase="
+		layers := make(map[string]bool)
+		for _, line := range lines {
+			if !strings.Contains(line, fields) {
+				t.Error(host, "logged", line)
+			}
+			// [LEVEL]layer message
+			layers[strings.Fields(line[strings.Index(line, "]")+1:])[0]] = true
+		}
+		for _, layer := range []string{"tpkt", "x224", "socket", "mcs", "sec", "PDU"} {
+			if !layers[layer] {
+				t.Error(host, "no line from", layer, layers)
+			}
+		}
+	}
+	if clients[0].ConnID() == clients[1].ConnID() || len(clients[0].ConnID()) != 8 {
+		t.Error("connection ids", clients[0].ConnID(), clients[1].ConnID())
+	}
+}
+
+func TestPackageLogger(t *testing.T) {
+	var out lockedBuffer
+	glog.SetLogger(log.New(&out, "", 0))
+	glog.SetLevel(glog.INFO)
+	defer glog.SetLevel(glog.NONE)
+
+	// the application set the package logger, a client leaves it be
+	if _, err := grdp.New("127.0.0.1:3389"); err != nil {
+		t.Fatal(err)
+	}
+	glog.Info("application")
+	if lines := out.Lines(); len(lines) != 1 || !strings.Contains(lines[0], "application") {
+		t.Error(lines, "not equal to", []string{"application"})
+	}
+
+	if _, err := grdp.New("127.0.0.1:3389", grdp.WithLogLevel(glog.NONE)); err != nil {
+		t.Fatal(err)
+	}
+	glog.Error("client")
+	if lines := out.Lines(); len(lines) != 1 {
+		t.Error(lines, "logged after WithLogLevel")
+	}
+}
+
+func TestWithConnID(t *testing.T) {
+	client, server := net.Pipe()
+	serve(t, server, confirmScenario)
+	output := &lockedBuffer{}
+	logger := glog.New(log.New(output, "", 0), glog.DEBUG)
+	g := grdp.NewClientFromConn(client, grdp.WithLogger(logger), grdp.WithConnID("scan-42"))
+	glog.SetLevel(glog.NONE)
+	g.Login("alice", "secret")
+	if g.ConnID() != "scan-42" {
+		t.Error(g.ConnID(), "not equal to", "scan-42")
+	}
+	for _, line := range output.Lines() {
+		if !strings.Contains(line, "conn=scan-42 phase=x224") {
+			t.Error(line)
+		}
+	}
+}
+
+func TestFingerprintNLAScenarios(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []rdptest.Step
+		err   error
+	}{
+		{"nla", nlaScenario, nil},
+		{"ssl only", []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+			rdptest.ExpectClose(),
+		}, grdp.ErrNLANotSupported},
+		{"negotiation failure", []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			// SSL_REQUIRED_BY_SERVER
+			rdptest.NegotiationFailure(0x00000001),
+			rdptest.ExpectClose(),
+		}, grdp.ErrNLANotSupported},
+		{"rdp 4.0", []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.ConfirmWithoutNegotiation(),
+			rdptest.ExpectClose(),
+		}, grdp.ErrNLANotSupported},
+	}
+	for _, test := range tests {
+		srv, err := rdptest.NewServer(test.steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := grdp.NewClient(srv.Addr(), glog.NONE)
+		info, err := g.FingerprintNLA()
+		if !errors.Is(err, test.err) {
+			t.Error(test.name, err, "not equal to", test.err)
+		}
+		if test.err == nil && (info == nil || info.NegotiateFlags != 0xe28a8235) {
+			t.Error(test.name, info, "not equal to", "flags 0xe28a8235")
+		}
+		if err = srv.Wait(); err != nil {
+			t.Error(test.name, err)
+		}
+		if session := srv.Sessions()[0]; session.RequestedProtocols != x224.PROTOCOL_SSL|x224.PROTOCOL_HYBRID {
+			t.Error(test.name, session.RequestedProtocols, "not equal to", x224.PROTOCOL_SSL|x224.PROTOCOL_HYBRID)
+		}
+	}
+}
+
+func TestLegacyTLSFallback(t *testing.T) {
+	tls10 := &stdtls.Config{MinVersion: stdtls.VersionTLS10, MaxVersion: stdtls.VersionTLS10}
+	srv, err := rdptest.NewServer(
+		[]rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+			rdptest.RefuseTLS(tls10),
+		},
+		[]rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+			rdptest.StartTLS(tls10),
+			rdptest.ReadNTLMNegotiate(),
+			rdptest.SendNTLMChallenge(0xe28a8235),
+			rdptest.ExpectClose(),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := core.DefaultTLSConfig()
+	config.MinVersion = tls.VersionTLS12
+	g := grdp.NewClient(srv.Addr(), glog.NONE, grdp.WithTLSConfig(config), grdp.WithLegacyTLSFallback())
+	if _, err := g.FingerprintNLA(); err != nil {
+		t.Fatal(err)
+	}
+	if g.TLSVersion() != tls.VersionTLS10 {
+		t.Errorf("0x%04x not equal to 0x%04x", g.TLSVersion(), tls.VersionTLS10)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTLSVersions(t *testing.T) {
+	// the TLS package of the client only offers TLS 1.3 when enabled
+	tls13 := strings.Contains(os.Getenv("GODEBUG"), "tls13=1")
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		pinned := &stdtls.Config{MinVersion: version, MaxVersion: version}
+		steps := []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+			rdptest.StartTLS(pinned),
+			rdptest.MCSConnect(),
+			rdptest.LicenseValidClient(),
+			rdptest.ExpectDisconnect(),
+			rdptest.ExpectClose(),
+		}
+		refused := version == tls.VersionTLS13 && !tls13
+		if refused {
+			steps = []rdptest.Step{
+				rdptest.ReadConnectionRequest(),
+				rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+				rdptest.RefuseTLS(pinned),
+			}
+		}
+		srv, err := rdptest.NewServer(steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := core.DefaultTLSConfig()
+		config.MinVersion = tls.VersionTLS12
+		g := grdp.NewClient(srv.Addr(), glog.NONE, grdp.WithTLSConfig(config))
+		err = g.Login("alice", "secret")
+		if refused {
+			if !core.IsTLSVersionError(err) {
+				t.Error(err, "not a TLS version error")
+			}
+		} else {
+			if err != nil {
+				t.Error(err)
+			}
+			if g.TLSVersion() != version {
+				t.Errorf("0x%04x not equal to 0x%04x", g.TLSVersion(), version)
+			}
+			if g.TLSCipherSuite() == 0 {
+				t.Error("no cipher suite")
+			}
+		}
+		if err = srv.Wait(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestServerCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notBefore := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(0x1234abcd),
+		Subject:      pkix.Name{CommonName: "WIN-SRV01"},
+		DNSNames:     []string{"win-srv01.corp.local"},
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.AddDate(1, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &stdtls.Config{Certificates: []stdtls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+		rdptest.StartTLS(config),
+		rdptest.ReadNTLMNegotiate(),
+		rdptest.SendNTLMChallenge(0xe28a8235),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE)
+	if _, ok := g.ServerCertificate(); ok {
+		t.Error("certificate before any connection")
+	}
+	if _, err = g.FingerprintNLA(); err != nil {
+		t.Fatal(err)
+	}
+	cert, ok := g.ServerCertificate()
+	if !ok {
+		t.Fatal("no certificate")
+	}
+	sum := sha256.Sum256(der)
+	if cert.CommonName != "WIN-SRV01" || len(cert.DNSNames) != 1 || cert.DNSNames[0] != "win-srv01.corp.local" {
+		t.Error(cert.CommonName, cert.DNSNames, "not equal to", "WIN-SRV01", "win-srv01.corp.local")
+	}
+	if cert.Issuer != "CN=WIN-SRV01" || cert.SerialNumber != "1234abcd" || cert.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Error(cert.Issuer, cert.SerialNumber, cert.SHA256)
+	}
+	if !cert.NotBefore.Equal(notBefore) || !cert.NotAfter.Equal(notBefore.AddDate(1, 0, 0)) {
+		t.Error(cert.NotBefore, cert.NotAfter, "not equal to", notBefore)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoginWithoutNegotiation(t *testing.T) {
+	srv, err := rdptest.NewServer(confirmScenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE)
+	err = g.Login("alice", "secret")
+	var standard *grdp.StandardSecurityError
+	if !errors.Is(err, grdp.ErrStandardSecurity) || !errors.As(err, &standard) ||
+		standard.Host != srv.Addr() || standard.Requested != x224.PROTOCOL_SSL|x224.PROTOCOL_HYBRID {
+		t.Error(err, "not equal to", grdp.ErrStandardSecurity)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoginMalformedConfirm(t *testing.T) {
+	for _, confirm := range []string{"0ed0000012340002010800", "0ed000001234000101080001000000"} {
+		payload, _ := hex.DecodeString(confirm)
+		srv, err := rdptest.NewServer([]rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.SendTPKT(payload),
+			rdptest.ExpectClose(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the server keeps the connection open, the error ends the login
+		g := grdp.NewClient(srv.Addr(), glog.NONE, grdp.WithLoginTimeout(5*time.Second))
+		start := time.Now()
+		err = g.Login("alice", "secret")
+		if err == nil || !strings.HasPrefix(err.Error(), "x224 read connection confirm: ") {
+			t.Error(confirm, err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Error(confirm, "failed after", d)
+		}
+		if err = srv.Wait(); err != nil {
+			t.Error(confirm, err)
+		}
+	}
+}
+
+func TestLoginNegotiationTimeout(t *testing.T) {
+	addr, accepted, closeListener := hangingListener(t)
+	defer closeListener()
+	g := grdp.NewClient(addr, glog.NONE, grdp.WithNegotiationTimeout(100*time.Millisecond))
+	start := time.Now()
+	err := g.Login("alice", "secret")
+	<-accepted
+	if !errors.Is(err, grdp.ErrNegotiationTimeout) {
+		t.Error(err, "not equal to", grdp.ErrNegotiationTimeout)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Error("timed out after", d)
+	}
+}
+
+func TestLoginDisconnect(t *testing.T) {
+	tests := []struct {
+		step     rdptest.Step
+		expected grdp.DisconnectError
+	}{
+		{rdptest.DisconnectRequest(x224.REASON_CONNECTION_REFUSED), grdp.DisconnectError{Type: x224.TPDU_DISCONNECT_REQUEST, Reason: x224.REASON_CONNECTION_REFUSED}},
+		{rdptest.ErrorTPDU(x224.CAUSE_INVALID_TPDU_TYPE), grdp.DisconnectError{Type: x224.TPDU_ERROR, Reason: x224.CAUSE_INVALID_TPDU_TYPE}},
+	}
+	for _, test := range tests {
+		srv, err := rdptest.NewServer([]rdptest.Step{rdptest.ReadConnectionRequest(), test.step, rdptest.ExpectClose()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := grdp.NewClient(srv.Addr(), glog.NONE)
+		err = g.Login("alice", "secret")
+		var disconnect *grdp.DisconnectError
+		test.expected.Host = srv.Addr()
+		if !errors.Is(err, grdp.ErrDisconnected) || !errors.As(err, &disconnect) || *disconnect != test.expected {
+			t.Error(err, "not equal to", test.expected)
+		}
+		if _, ok := g.Negotiation(); ok {
+			t.Error("negotiated")
+		}
+		if err = srv.Wait(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestLoginNegotiation(t *testing.T) {
+	tests := []struct {
+		name     string
+		step     rdptest.Step
+		expected x224.NegotiationResult
+		options  []grdp.Option
+		// of the connection request
+		flags byte
+	}{
+		{"response", rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+			x224.NegotiationResult{Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: x224.PROTOCOL_SSL}, nil, 0},
+		{"failure", rdptest.NegotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER),
+			x224.NegotiationResult{Type: x224.TYPE_RDP_NEG_FAILURE, FailureCode: x224.HYBRID_REQUIRED_BY_SERVER}, nil, 0},
+		{"restricted admin", rdptest.NegotiationResponseFlags(x224.PROTOCOL_SSL, x224.RESTRICTED_ADMIN_MODE_SUPPORTED),
+			x224.NegotiationResult{Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: x224.PROTOCOL_SSL, Flags: x224.RESTRICTED_ADMIN_MODE_SUPPORTED},
+			[]grdp.Option{grdp.WithRestrictedAdmin()}, x224.RESTRICTED_ADMIN_MODE_REQUIRED},
+	}
+	for _, test := range tests {
+		srv, err := rdptest.NewServer([]rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			test.step,
+			rdptest.Close(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := grdp.NewClient(srv.Addr(), glog.NONE, test.options...)
+		err = g.Login("alice", "secret")
+		var failure *x224.NegotiationFailureError
+		if test.expected.Failed() && (!errors.As(err, &failure) || failure.Code != test.expected.FailureCode) {
+			t.Error(test.name, err, "not equal to", "HYBRID_REQUIRED_BY_SERVER")
+		}
+		test.expected.Host = srv.Addr()
+		if result, ok := g.Negotiation(); !ok || result != test.expected {
+			t.Error(test.name, result, "not equal to", test.expected)
+		}
+		if err = srv.Wait(); err != nil {
+			t.Error(test.name, err)
+		}
+		if flags := srv.Sessions()[0].RequestFlags; flags != test.flags {
+			t.Error(test.name, flags, "not equal to", test.flags)
+		}
+	}
+}
+
+func TestLoginContextCancel(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelled := make(chan time.Time, 1)
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+		rdptest.StartTLS(nil),
+		rdptest.ReadNTLMNegotiate(),
+		// the client waits for the CHALLENGE
+		func(s *rdptest.Session) error {
+			cancelled <- time.Now()
+			cancel()
+			return nil
+		},
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE, grdp.WithFallbackToSSL())
+	err = g.LoginContext(ctx, "alice", "secret")
+	returned := time.Now()
+	if err != context.Canceled {
+		t.Error(err, "not equal to", context.Canceled)
+	}
+	if d := returned.Sub(<-cancelled); d > 100*time.Millisecond {
+		t.Error(d, "longer than", 100*time.Millisecond)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	// the readers of the layers end with the connection
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		buf := make([]byte, 1<<16)
+		t.Error(n, "goroutines left, expected", goroutines, string(buf[:runtime.Stack(buf, true)]))
+	}
+}
+
+func TestScreenshot(t *testing.T) {
+	var area rdptest.Rect
+	srv, err := rdptest.NewServer(append(sessionScenario,
+		rdptest.Activate(8, 4),
+		rdptest.ReadRefreshRect(&area),
+		rdptest.SendBitmapUpdate(
+			// uncompressed 16bpp, bottom up: a green row then a red one
+			rdptest.Bitmap{Left: 0, Top: 0, Width: 8, Height: 2, BitsPerPixel: 16,
+				Data: append(bytes.Repeat([]byte{0xe0, 0x07}, 8), bytes.Repeat([]byte{0x00, 0xf8}, 8)...)},
+			// interleaved RLE, a blue color run then a foreground run, white xor blue
+			rdptest.Bitmap{Left: 0, Top: 2, Width: 8, Height: 2, BitsPerPixel: 16, Compressed: true,
+				Data: []byte{0x68, 0x1f, 0x00, 0x28}},
+		),
+		rdptest.ExpectDisconnect(), rdptest.ExpectClose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE, grdp.WithKeepSession())
+	if err = g.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	img, err := g.Screenshot(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Close()
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	if area != (rdptest.Rect{Left: 0, Top: 0, Right: 7, Bottom: 3}) {
+		t.Error(area, "not the desktop")
+	}
+	// the way a caller saves it
+	var b bytes.Buffer
+	if err = png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds() != image.Rect(0, 0, 8, 4) {
+		t.Fatal(decoded.Bounds(), "not equal to", image.Rect(0, 0, 8, 4))
+	}
+	rows := []color.RGBA{{0xff, 0, 0, 0xff}, {0, 0xff, 0, 0xff}, {0xff, 0xff, 0, 0xff}, {0, 0, 0xff, 0xff}}
+	for y, c := range rows {
+		for x := 0; x < 8; x++ {
+			if got := color.RGBAModel.Convert(decoded.At(x, y)); got != c {
+				t.Error(x, y, got, "not equal to", c)
+			}
+		}
+	}
+}
+
+func TestScreen(t *testing.T) {
+	srv, err := rdptest.NewServer(append(sessionScenario,
+		rdptest.Activate(8, 4),
+		rdptest.ExpectDisconnect(), rdptest.ExpectClose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE, grdp.WithKeepSession(), grdp.WithScreen(1920, 1080, 32))
+	if err = g.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	// the demand active comes after Login
+	deadline := time.Now().Add(5 * time.Second)
+	screen, ok := g.Screen()
+	for !ok && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		screen, ok = g.Screen()
+	}
+	g.Close()
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	// the bitmap capability of rdptest asks for 16 bpp
+	if expected := (grdp.Screen{Width: 8, Height: 4, BitsPerPixel: 16}); !ok || screen != expected {
+		t.Error(screen, ok, "not equal to", expected)
+	}
+	block := srv.Sessions()[0].ClientCoreData
+	if len(block) != 0xd8 {
+		t.Fatal(hex.EncodeToString(block), "not a core data block")
+	}
+	// 1920x1080 then postBeta2ColorDepth to earlyCapabilityFlags: 24 bpp,
+	// only 32 bpp supported and RNS_UD_CS_WANT_32BPP_SESSION
+	if got := hex.EncodeToString(block[8:12]); got != "80073804" {
+		t.Error(got, "not equal to", "80073804")
+	}
+	if got := hex.EncodeToString(block[132:146]); got != "04ca010000000000180008000300" {
+		t.Error(got, "not equal to", "04ca010000000000180008000300")
+	}
+}
+
+func TestScreenWithoutSession(t *testing.T) {
+	g := grdp.NewClient("127.0.0.1:3389", glog.NONE)
+	if screen, ok := g.Screen(); ok {
+		t.Error(screen, "without a session")
+	}
+}
+
+func TestScreenshotWithoutSession(t *testing.T) {
+	g := grdp.NewClient("127.0.0.1:3389", glog.NONE)
+	if _, err := g.Screenshot(time.Second); err != grdp.ErrNoSession {
+		t.Error(err, "not equal to", grdp.ErrNoSession)
+	}
+}
+
+func TestSessionErr(t *testing.T) {
+	srv, err := rdptest.NewServer(append(sessionScenario,
+		rdptest.SetErrorInfo(pdu.ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES), rdptest.Close()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE, grdp.WithKeepSession())
+	defer g.Close()
+	if err = g.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for g.SessionErr() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var errorInfo *grdp.ErrorInfoError
+	if err = g.SessionErr(); !errors.As(err, &errorInfo) || errorInfo.Code != pdu.ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES {
+		t.Fatal(err, "not ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES")
+	}
+	if outcome := grdp.ClassifyLogin(err); outcome != grdp.LOGIN_LOGON_TYPE_NOT_GRANTED {
+		t.Error(outcome, "not equal to", grdp.LOGIN_LOGON_TYPE_NOT_GRANTED)
+	}
+}
+
+func TestLoginContextDeadline(t *testing.T) {
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		// the server never confirms
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	g := grdp.NewClient(srv.Addr(), glog.NONE)
+	start := time.Now()
+	err = g.LoginContext(ctx, "alice", "secret")
+	if err != context.DeadlineExceeded {
+		t.Error(err, "not equal to", context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error(d, "longer than", time.Second)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoginServerGone(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []rdptest.Step
+		err   error
+	}{
+		{"closed", []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.Close(),
+		}, grdp.ErrConnClosed},
+		{"silent", []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.ExpectClose(),
+		}, grdp.ErrLoginTimeout},
+	}
+	for _, test := range tests {
+		srv, err := rdptest.NewServer(test.steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := grdp.NewClient(srv.Addr(), glog.NONE, grdp.WithLoginTimeout(50*time.Millisecond))
+		start := time.Now()
+		if err = g.Login("alice", "secret"); err != test.err {
+			t.Error(test.name, err, "not equal to", test.err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Error(test.name, d, "longer than", time.Second)
+		}
+		if err = srv.Wait(); err != nil {
+			t.Error(test.name, err)
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	// accepts the connections and never answers them
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	// the server picks TLS then never answers the client hello
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+		rdptest.Sleep(time.Second),
+		rdptest.Close(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := []grdp.Option{grdp.WithLogLevel(glog.NONE),
+		grdp.WithLoginTimeout(time.Minute), grdp.WithHandshakeTimeout(100 * time.Millisecond)}
+	for _, addr := range []string{l.Addr().String(), srv.Addr()} {
+		g, err := grdp.New(addr, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if err = g.Login("alice", "secret"); err != grdp.ErrHandshakeTimeout {
+			t.Error(addr, err, "not equal to", grdp.ErrHandshakeTimeout)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Error(addr, d, "longer than", time.Second)
+		}
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	g, err := grdp.New(l.Addr().String(), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = g.FingerprintNLA(); err != grdp.ErrHandshakeTimeout {
+		t.Error(err, "not equal to", grdp.ErrHandshakeTimeout)
+	}
+}
+
+func TestLoginErrorClass(t *testing.T) {
+	classes := []error{grdp.ErrConnRefused, grdp.ErrNegotiationFailed, grdp.ErrTLSHandshake, grdp.ErrNLAAuthFailed, grdp.ErrLicense}
+	// nothing listens on the port of a closed listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name  string
+		steps []rdptest.Step
+		class error
+	}{
+		{"refused", nil, grdp.ErrConnRefused},
+		{"negotiation", []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.NegotiationFailure(x224.SSL_NOT_ALLOWED_BY_SERVER),
+			rdptest.ExpectClose(),
+		}, grdp.ErrNegotiationFailed},
+		{"tls", []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+			rdptest.Close(),
+		}, grdp.ErrTLSHandshake},
+		{"nla", []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+			rdptest.StartTLS(nil),
+			rdptest.ReadNTLMNegotiate(),
+			rdptest.SendNTLMChallenge(0xe28a8235),
+			rdptest.ReadTSRequest(),
+			rdptest.SendNTStatus(nla.STATUS_LOGON_FAILURE),
+			rdptest.ExpectClose(),
+		}, grdp.ErrNLAAuthFailed},
+	}
+	for _, test := range tests {
+		addr := refused
+		var srv *rdptest.Server
+		if test.steps != nil {
+			if srv, err = rdptest.NewServer(test.steps); err != nil {
+				t.Fatal(err)
+			}
+			addr = srv.Addr()
+		}
+		g := grdp.NewClient(addr, glog.NONE)
+		err := g.Login("alice", "secret")
+		for _, class := range classes {
+			if errors.Is(err, class) != (class == test.class) {
+				t.Error(test.name, err, "errors.Is", class, class == test.class)
+			}
+		}
+		if srv != nil {
+			if err = srv.Wait(); err != nil {
+				t.Error(test.name, err)
+			}
+		}
+	}
+}
+
+func TestClassifyLogin(t *testing.T) {
+	tests := []struct {
+		err     error
+		outcome grdp.LoginOutcome
+		valid   bool
+	}{
+		{nil, grdp.LOGIN_SUCCESS, true},
+		{&nla.NTStatusError{Status: nla.STATUS_WRONG_PASSWORD}, grdp.LOGIN_BAD_CREDENTIALS, false},
+		{&nla.NTStatusError{Status: nla.STATUS_NO_SUCH_USER}, grdp.LOGIN_BAD_CREDENTIALS, false},
+		{&nla.NTStatusError{Status: nla.STATUS_LOGON_FAILURE}, grdp.LOGIN_BAD_CREDENTIALS, false},
+		{&nla.NTStatusError{Status: nla.STATUS_ACCOUNT_LOCKED_OUT}, grdp.LOGIN_ACCOUNT_LOCKED, false},
+		{&nla.NTStatusError{Status: nla.STATUS_ACCOUNT_DISABLED}, grdp.LOGIN_ACCOUNT_DISABLED, false},
+		{&nla.NTStatusError{Status: nla.STATUS_ACCOUNT_EXPIRED}, grdp.LOGIN_ACCOUNT_DISABLED, false},
+		{&nla.NTStatusError{Status: nla.STATUS_PASSWORD_EXPIRED}, grdp.LOGIN_PASSWORD_EXPIRED, true},
+		{&nla.NTStatusError{Status: nla.STATUS_PASSWORD_MUST_CHANGE}, grdp.LOGIN_PASSWORD_EXPIRED, true},
+		{&nla.NTStatusError{Status: nla.STATUS_INVALID_LOGON_HOURS}, grdp.LOGIN_ACCOUNT_RESTRICTED, true},
+		{&nla.NTStatusError{Status: nla.STATUS_LOGON_TYPE_NOT_GRANTED}, grdp.LOGIN_LOGON_TYPE_NOT_GRANTED, true},
+		{&grdp.ErrorInfoError{Code: pdu.ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES}, grdp.LOGIN_LOGON_TYPE_NOT_GRANTED, true},
+		{&grdp.AuthorizationError{Result: nla.AUTHZ_ACCESS_DENIED}, grdp.LOGIN_LOGON_TYPE_NOT_GRANTED, true},
+		{&grdp.ErrorInfoError{Code: pdu.ERRINFO_IDLE_TIMEOUT}, grdp.LOGIN_UNKNOWN, false},
+		{&nla.NTStatusError{Status: nla.SEC_E_INVALID_TOKEN}, grdp.LOGIN_UNKNOWN, false},
+		{grdp.ErrConnRefused, grdp.LOGIN_UNKNOWN, false},
+		{grdp.ErrLoginTimeout, grdp.LOGIN_UNKNOWN, false},
+	}
+	for _, test := range tests {
+		// as Login wraps it
+		err := test.err
+		if err != nil {
+			err = fmt.Errorf("login: %w", err)
+		}
+		outcome := grdp.ClassifyLogin(err)
+		if outcome != test.outcome {
+			t.Error(test.err, outcome, "not equal to", test.outcome)
+		}
+		if outcome.CredentialsValid() != test.valid {
+			t.Error(outcome, "CredentialsValid", outcome.CredentialsValid(), "not equal to", test.valid)
+		}
+	}
+}
+
+func TestLoginAccountLocked(t *testing.T) {
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+		rdptest.StartTLS(nil),
+		rdptest.ReadNTLMNegotiate(),
+		rdptest.SendNTLMChallenge(0xe28a8235),
+		rdptest.ReadTSRequest(),
+		rdptest.SendNTStatus(nla.STATUS_ACCOUNT_LOCKED_OUT),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE)
+	err = g.Login("alice", "secret")
+	if outcome := grdp.ClassifyLogin(err); outcome != grdp.LOGIN_ACCOUNT_LOCKED {
+		t.Error(err, outcome, "not equal to", grdp.LOGIN_ACCOUNT_LOCKED)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+// server accepting the client over TLS, licensing included
+var sessionScenario = []rdptest.Step{
+	rdptest.ReadConnectionRequest(),
+	rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+	rdptest.StartTLS(nil),
+	rdptest.MCSConnect(),
+	rdptest.LicenseValidClient(),
+}
+
+func TestLoginConnected(t *testing.T) {
+	srv, err := rdptest.NewServer(append(sessionScenario, rdptest.ExpectDisconnect(), rdptest.ExpectClose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE)
+	if err = g.Login("alice", "secret"); err != nil {
+		t.Error(err)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	// without WithKeepSession Login disconnects before it returns
+	if session := srv.Sessions()[0]; !session.Disconnected || !session.Closed {
+		t.Error(session.Disconnected, session.Closed, "not equal to", true, true)
+	}
+}
+
+// UTF-16LE of s and its null terminator
+func utf16z(s string) []byte {
+	b := []byte{}
+	for _, ch := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(ch), byte(ch>>8))
+	}
+	return append(b, 0, 0)
+}
+
+func TestLoginIPv6(t *testing.T) {
+	srv, err := rdptest.NewServerAddr("[::1]:0", append(sessionScenario, rdptest.ExpectDisconnect(), rdptest.ExpectClose()))
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	if !strings.HasPrefix(srv.Addr(), "[::1]:") {
+		t.Fatal(srv.Addr(), "not an IPv6 literal")
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE)
+	if err = g.Login("alice", "secret"); err != nil {
+		t.Error(err)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	info := srv.Sessions()[0].ClientInfo
+	// clientAddressFamily AF_INET6, cbClientAddress then clientAddress
+	address := utf16z("::1")
+	extended := append([]byte{0x17, 0, byte(len(address)), 0}, address...)
+	if !bytes.Contains(info, extended) {
+		t.Error(hex.EncodeToString(info), "not containing", hex.EncodeToString(extended))
+	}
+}
+
+func TestLoginDomain(t *testing.T) {
+	tests := []struct {
+		user    string
+		options []grdp.Option
+		domain  string
+	}{
+		// a local account, not the address of the host
+		{"alice", nil, ""},
+		{"CORP\\alice", nil, "CORP"},
+		{"alice@corp.example.com", nil, "corp.example.com"},
+		{".\\alice", nil, ""},
+		{"alice", []grdp.Option{grdp.WithDomain("CORP")}, "CORP"},
+		{"OTHER\\alice", []grdp.Option{grdp.WithDomain("CORP")}, "OTHER"},
+	}
+	for _, test := range tests {
+		srv, err := rdptest.NewServer(append(sessionScenario, rdptest.ExpectDisconnect(), rdptest.ExpectClose()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := grdp.NewClient(srv.Addr(), glog.NONE, test.options...)
+		if err = g.Login(test.user, "secret"); err != nil {
+			t.Error(test.user, err)
+		}
+		if err = srv.Wait(); err != nil {
+			t.Fatal(test.user, err)
+		}
+		info := srv.Sessions()[0].ClientInfo
+		// codePage, flags, cbDomain, cbUserName, cbPassword, cbAlternateShell
+		// and cbWorkingDir then Domain and UserName
+		domain, user := utf16z(test.domain), utf16z("alice")
+		if len(info) < 18+len(domain)+len(user) {
+			t.Fatal(test.user, hex.EncodeToString(info), "too short")
+		}
+		if !bytes.Equal(info[8:12], []byte{byte(len(domain) - 2), 0, byte(len(user) - 2), 0}) {
+			t.Error(test.user, hex.EncodeToString(info[8:12]), "not the sizes of", test.domain, "alice")
+		}
+		if !bytes.Equal(info[18:18+len(domain)], domain) || !bytes.Equal(info[18+len(domain):18+len(domain)+len(user)], user) {
+			t.Error(test.user, hex.EncodeToString(info[18:]), "not starting with", hex.EncodeToString(domain), hex.EncodeToString(user))
+		}
+	}
+}
+
+func TestLoginClientCoreData(t *testing.T) {
+	tests := []struct {
+		options []grdp.Option
+		// kbdLayout, clientBuild then clientName
+		expected []byte
+		// keyboardType, keyboardSubType and keyboardFunctionKey
+		keyboard []byte
+	}{
+		{nil, append([]byte{0x09, 0x04, 0, 0, 0xce, 0x0e, 0, 0}, utf16z("mstsc")...),
+			[]byte{4, 0, 0, 0, 0, 0, 0, 0, 12, 0, 0, 0}},
+		{[]grdp.Option{grdp.WithClientName("SCANNER-01"), grdp.WithClientBuild(2600), grdp.WithKeyboardLayout(gcc.FRENCH),
+			grdp.WithKeyboardType(gcc.KT_JAPANESE, 2, 12)},
+			append([]byte{0x0c, 0x04, 0, 0, 0x28, 0x0a, 0, 0}, utf16z("SCANNER-01")...),
+			[]byte{7, 0, 0, 0, 2, 0, 0, 0, 12, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		srv, err := rdptest.NewServer(append(sessionScenario, rdptest.ExpectDisconnect(), rdptest.ExpectClose()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := grdp.NewClient(srv.Addr(), glog.NONE, test.options...)
+		if err = g.Login("alice", "secret"); err != nil {
+			t.Error(err)
+		}
+		if err = srv.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		// after the block header and the fields up to sasSequence
+		block := srv.Sessions()[0].ClientCoreData
+		if len(block) != 0xd8 || !bytes.Equal(block[16:16+len(test.expected)], test.expected) {
+			t.Fatal(hex.EncodeToString(block), "not containing", hex.EncodeToString(test.expected))
+		}
+		if !bytes.Equal(block[56:68], test.keyboard) {
+			t.Error(hex.EncodeToString(block[56:68]), "not equal to", hex.EncodeToString(test.keyboard))
+		}
+	}
+}
+
+func TestServerCoreData(t *testing.T) {
+	srv, err := rdptest.NewServer(append(sessionScenario, rdptest.ExpectDisconnect(), rdptest.ExpectClose()),
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationResponse(x224.PROTOCOL_SSL), rdptest.Close()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE)
+	if _, ok := g.ServerCoreData(); ok || g.ServerVersion() != 0 {
+		t.Error(g.ServerVersion(), "known before Login")
+	}
+	if err = g.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	// rdptest echoes requestedProtocols, PROTOCOL_SSL | PROTOCOL_HYBRID
+	expected := gcc.ServerCoreData{RdpVersion: gcc.RDP_VERSION_10_7, ClientRequestedProtocol: x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID, EarlyCapabilityFlags: gcc.RNS_UD_SC_DYNAMIC_DST_SUPPORTED}
+	if data, ok := g.ServerCoreData(); !ok || data != expected {
+		t.Error(data, ok, "not equal to", expected)
+	}
+	if g.ServerVersion() != gcc.RDP_VERSION_10_7 || g.ServerVersion().String() != "RDP 10.7" {
+		t.Error(g.ServerVersion(), "not equal to", gcc.RDP_VERSION_10_7)
+	}
+	if g.ServerEarlyCapabilityFlags() != rdptest.ServerEarlyCapabilityFlags {
+		t.Error(g.ServerEarlyCapabilityFlags(), "not equal to", rdptest.ServerEarlyCapabilityFlags)
+	}
+
+	// the next Login does not get to the MCS connect response
+	if err = g.Login("alice", "secret"); err == nil {
+		t.Error("login succeeded")
+	}
+	if data, ok := g.ServerCoreData(); ok || g.ServerVersion() != 0 {
+		t.Error(data, "kept from the previous Login")
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKeepSession(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	srv, err := rdptest.NewServer(append(sessionScenario, rdptest.ExpectDisconnect(), rdptest.ExpectClose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE, grdp.WithKeepSession())
+	if err = g.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	// closed from another goroutine, more than once
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.Close()
+		}()
+	}
+	wg.Wait()
+	if err = g.Close(); err != nil {
+		t.Error(err)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	if session := srv.Sessions()[0]; !session.Disconnected || !session.Closed || session.DisconnectReason != x224.REASON_NORMAL {
+		t.Error(session.Disconnected, session.Closed, session.DisconnectReason, "not equal to", true, true, x224.REASON_NORMAL)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		buf := make([]byte, 1<<16)
+		t.Error(n, "goroutines left, expected", goroutines, string(buf[:runtime.Stack(buf, true)]))
+	}
+}
@@ -0,0 +1,311 @@
+/**
+ * A x224.ResultWriter posting the results as JSON to an HTTP endpoint,
+ * in batches and in the background
+ */
+package httpresult
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/icodeface/grdp/protocol/x224"
+)
+
+var (
+	// the queue of a Writer stayed full, the result is not posted
+	ErrResultDropped = errors.New("result dropped, the http queue is full")
+	// WriteResult after Close
+	ErrWriterClosed = errors.New("result writer closed")
+)
+
+/**
+ * Settings of a Writer, the zero value of a field picks its
+ * default
+ */
+type Config struct {
+	// where the batches are posted
+	URL string
+	// sent as "Authorization: Bearer <token>" when set
+	BearerToken string
+	// results per POST, 1 by default
+	BatchSize int
+	// the partial batch is posted every FlushInterval, 1s by default
+	FlushInterval time.Duration
+	// results waiting to be posted, 1024 by default
+	QueueSize int
+	// how long WriteResult waits for room in a full queue before it
+	// drops the result, 100ms by default
+	MaxBlock time.Duration
+	// POSTs of a batch answered with a 5xx or failing, 3 by default
+	MaxAttempts int
+	// wait before the second POST of a batch, doubled for each next one,
+	// 500ms by default
+	Backoff time.Duration
+	// nil for a client giving up after 10s
+	Client *http.Client
+}
+
+/**
+ * Posts the results as JSON to a URL, a batch being an array of objects
+ * with the columns of a x224.CSVResultWriter as keys. The POSTs are
+ * made in the background: WriteResult only queues the result, it fails
+ * with ErrResultDropped when the queue stayed full MaxBlock long. Flush
+ * or Close post what is queued
+ */
+type Writer struct {
+	config  Config
+	queue   chan x224.NegotiationResult
+	flushc  chan chan error
+	done    chan struct{}
+	mu      sync.RWMutex
+	closed  bool
+	dropped int64
+	failed  int64
+}
+
+func New(config Config) (*Writer, error) {
+	if u, err := url.Parse(config.URL); err != nil {
+		return nil, err
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("http results url %q", config.URL)
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Second
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1024
+	}
+	if config.MaxBlock <= 0 {
+		config.MaxBlock = 100 * time.Millisecond
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 3
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = 500 * time.Millisecond
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	w := &Writer{
+		config: config,
+		queue:  make(chan x224.NegotiationResult, config.QueueSize),
+		flushc: make(chan chan error),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *Writer) WriteResult(result x224.NegotiationResult) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	select {
+	case w.queue <- result:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(w.config.MaxBlock)
+	defer timer.Stop()
+	select {
+	case w.queue <- result:
+		return nil
+	case <-timer.C:
+		atomic.AddInt64(&w.dropped, 1)
+		return ErrResultDropped
+	}
+}
+
+// results dropped because the queue was full
+func (w *Writer) Dropped() int64 {
+	return atomic.LoadInt64(&w.dropped)
+}
+
+// results of the batches that could not be posted
+func (w *Writer) Failed() int64 {
+	return atomic.LoadInt64(&w.failed)
+}
+
+/**
+ * Post the queued results now, in batches of BatchSize. The error is
+ * the first of the batches that could not be posted since the last
+ * Flush, see Failed
+ */
+func (w *Writer) Flush() error {
+	reply := make(chan error, 1)
+	select {
+	case w.flushc <- reply:
+		return <-reply
+	case <-w.done:
+		return ErrWriterClosed
+	}
+}
+
+/**
+ * Post the queued results and stop, WriteResult then fails with
+ * ErrWriterClosed. The error is the one of Flush, safe to call several
+ * times
+ */
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		<-w.done
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+	err := w.Flush()
+	close(w.queue)
+	<-w.done
+	return err
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	var batch []x224.NegotiationResult
+	// first failure since the last Flush
+	var first error
+	post := func() {
+		if err := w.post(batch); err != nil && first == nil {
+			first = err
+		}
+		batch = nil
+	}
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case result, ok := <-w.queue:
+			if !ok {
+				return
+			}
+			batch = append(batch, result)
+			if len(batch) >= w.config.BatchSize {
+				post()
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				post()
+			}
+		case reply := <-w.flushc:
+			for {
+				drained := false
+				for !drained && len(batch) < w.config.BatchSize {
+					select {
+					case result := <-w.queue:
+						batch = append(batch, result)
+					default:
+						drained = true
+					}
+				}
+				if len(batch) == 0 {
+					break
+				}
+				post()
+			}
+			reply <- first
+			first = nil
+		}
+	}
+}
+
+// result as posted, the keys are the CSV columns
+type jsonResult struct {
+	Host             string  `json:"host"`
+	Port             int     `json:"port,omitempty"`
+	SelectedProtocol string  `json:"selected_protocol,omitempty"`
+	NLARequired      *bool   `json:"nla_required,omitempty"`
+	Error            string  `json:"error,omitempty"`
+	NLA              string  `json:"nla"`
+	RestrictedAdmin  bool    `json:"restricted_admin"`
+	ProductVersion   string  `json:"product_version,omitempty"`
+	TLSCommonName    string  `json:"tls_cn,omitempty"`
+	NTLMHostname     string  `json:"ntlm_hostname,omitempty"`
+	LatencyMS        float64 `json:"latency_ms,omitempty"`
+}
+
+func newJSONResult(result x224.NegotiationResult) jsonResult {
+	r := jsonResult{Host: result.Host, NLA: result.NLA.String(),
+		RestrictedAdmin: result.RestrictedAdminSupported(), ProductVersion: result.ProductVersion,
+		TLSCommonName: result.TLSCommonName, NTLMHostname: result.NTLMHostname, LatencyMS: result.RTT.Seconds() * 1000}
+	if enforced, known := result.NLAEnforced(); known {
+		r.NLARequired = &enforced
+	}
+	if host, port, err := net.SplitHostPort(result.Host); err == nil {
+		r.Host = host
+		r.Port, _ = strconv.Atoi(port)
+	}
+	if result.Failed() {
+		r.Error = x224.FailureCodeName(result.FailureCode)
+	} else {
+		r.SelectedProtocol = x224.ProtocolName(result.SelectedProtocol)
+	}
+	return r
+}
+
+// POSTs batch, again after a 5xx or a failure up to MaxAttempts
+func (w *Writer) post(batch []x224.NegotiationResult) error {
+	results := make([]jsonResult, len(batch))
+	for i, result := range batch {
+		results[i] = newJSONResult(result)
+	}
+	body, err := json.Marshal(results)
+	if err != nil {
+		atomic.AddInt64(&w.failed, int64(len(batch)))
+		return err
+	}
+	backoff := w.config.Backoff
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = w.send(body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.config.MaxAttempts {
+			atomic.AddInt64(&w.failed, int64(len(batch)))
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// retry is set for the failures worth another POST
+func (w *Writer) send(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.config.BearerToken)
+	}
+	resp, err := w.config.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	return resp.StatusCode >= 500, fmt.Errorf("http results %s", resp.Status)
+}
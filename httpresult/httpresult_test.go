@@ -0,0 +1,202 @@
+package httpresult_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp/httpresult"
+	"github.com/icodeface/grdp/protocol/x224"
+)
+
+// requests received by a results server
+type resultsServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	batches [][]map[string]interface{}
+	headers []http.Header
+	// status of the next responses, 200 once they are used
+	statuses []int
+	// closed to let the handler answer, nil to answer at once
+	hold chan struct{}
+}
+
+func newResultsServer(statuses ...int) *resultsServer {
+	s := &resultsServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.hold != nil {
+			<-s.hold
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.headers = append(s.headers, r.Header)
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		if status == http.StatusOK {
+			var batch []map[string]interface{}
+			json.Unmarshal(body, &batch)
+			s.batches = append(s.batches, batch)
+		}
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+// hosts of each batch received
+func (s *resultsServer) hosts() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hosts := [][]string{}
+	for _, batch := range s.batches {
+		b := []string{}
+		for _, result := range batch {
+			b = append(b, fmt.Sprint(result["host"]))
+		}
+		hosts = append(hosts, b)
+	}
+	return hosts
+}
+
+func sslResult(host string) x224.NegotiationResult {
+	return x224.NegotiationResult{Host: host + ":3389", Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: x224.PROTOCOL_SSL}
+}
+
+func TestWriterBatches(t *testing.T) {
+	srv := newResultsServer()
+	defer srv.Close()
+	w, err := httpresult.New(httpresult.Config{
+		URL: srv.URL, BearerToken: "s3cr3t", BatchSize: 2, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"} {
+		if err := w.WriteResult(sslResult(host)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[[10.0.0.1 10.0.0.2] [10.0.0.3 10.0.0.4] [10.0.0.5]]"
+	if hosts := fmt.Sprint(srv.hosts()); hosts != expected {
+		t.Error(hosts, "not equal to", expected)
+	}
+	for _, header := range srv.headers {
+		if header.Get("Authorization") != "Bearer s3cr3t" || header.Get("Content-Type") != "application/json" {
+			t.Error(header)
+		}
+	}
+	result := srv.batches[0][0]
+	if result["port"] != float64(3389) || result["selected_protocol"] != "PROTOCOL_SSL" ||
+		result["nla_required"] != nil || result["nla"] != "unknown" {
+		t.Error(result)
+	}
+	if err = w.WriteResult(sslResult("10.0.0.6")); err != httpresult.ErrWriterClosed {
+		t.Error(err, "not equal to", httpresult.ErrWriterClosed)
+	}
+	if err = w.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriterFlushInterval(t *testing.T) {
+	srv := newResultsServer()
+	defer srv.Close()
+	w, err := httpresult.New(httpresult.Config{URL: srv.URL, BatchSize: 10, FlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.WriteResult(sslResult("10.0.0.1"))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.hosts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if hosts := fmt.Sprint(srv.hosts()); hosts != "[[10.0.0.1]]" {
+		t.Error(hosts, "not equal to", "[[10.0.0.1]]")
+	}
+	// no header without a token
+	if auth := srv.headers[0].Get("Authorization"); auth != "" {
+		t.Error(auth)
+	}
+}
+
+func TestWriterRetry(t *testing.T) {
+	srv := newResultsServer(http.StatusServiceUnavailable, http.StatusBadGateway)
+	defer srv.Close()
+	w, err := httpresult.New(httpresult.Config{URL: srv.URL, FlushInterval: time.Hour, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteResult(sslResult("10.0.0.1"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.headers) != 3 || fmt.Sprint(srv.hosts()) != "[[10.0.0.1]]" || w.Failed() != 0 {
+		t.Error(len(srv.headers), srv.hosts(), w.Failed(), "not equal to", 3, "[[10.0.0.1]]", 0)
+	}
+
+	// a 4xx is not retried, 5xx are up to MaxAttempts
+	for _, statuses := range [][]int{{http.StatusUnauthorized}, {500, 500}} {
+		srv := newResultsServer(statuses...)
+		w, err := httpresult.New(httpresult.Config{URL: srv.URL, FlushInterval: time.Hour,
+			MaxAttempts: 2, Backoff: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteResult(sslResult("10.0.0.1"))
+		w.WriteResult(sslResult("10.0.0.2"))
+		err = w.Flush()
+		srv.Close()
+		w.Close()
+		if err == nil || w.Failed() != 1 || len(srv.headers) != len(statuses)+1 || fmt.Sprint(srv.hosts()) != "[[10.0.0.2]]" {
+			t.Error(statuses, err, w.Failed(), len(srv.headers), srv.hosts())
+		}
+	}
+}
+
+func TestWriterOverflow(t *testing.T) {
+	srv := newResultsServer()
+	srv.hold = make(chan struct{})
+	defer srv.Close()
+	w, err := httpresult.New(httpresult.Config{URL: srv.URL, QueueSize: 1, MaxBlock: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first is being posted, the second waits in the queue
+	w.WriteResult(sslResult("10.0.0.1"))
+	deadline := time.Now().Add(5 * time.Second)
+	for w.WriteResult(sslResult("10.0.0.2")) != nil && time.Now().Before(deadline) {
+	}
+	start := time.Now()
+	if err = w.WriteResult(sslResult("10.0.0.3")); !errors.Is(err, httpresult.ErrResultDropped) {
+		t.Error(err, "not equal to", httpresult.ErrResultDropped)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("blocked", d)
+	}
+	close(srv.hold)
+	if err = w.Close(); err != nil {
+		t.Error(err)
+	}
+	if hosts := fmt.Sprint(srv.hosts()); hosts != "[[10.0.0.1] [10.0.0.2]]" || w.Dropped() < 1 {
+		t.Error(hosts, w.Dropped())
+	}
+}
+
+func TestNewURL(t *testing.T) {
+	for _, u := range []string{"", "10.0.0.1:8080", "ftp://10.0.0.1/", "http://", "http://%zz"} {
+		if _, err := httpresult.New(httpresult.Config{URL: u}); err == nil {
+			t.Error(u, "accepted")
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Package fuzztest holds the invariants shared by the fuzz targets of
+// the parsers.
+package fuzztest
+
+import (
+	"errors"
+	"github.com/icodeface/grdp/emission"
+	"runtime"
+	"testing"
+)
+
+// bytes a parser may allocate for one input, lengths read from the
+// wire must be checked against what is left before allocating
+var MaxAlloc uint64 = 16 << 20
+
+/**
+ * Run parse on one input, it fails when parse allocated more than
+ * MaxAlloc. A panic fails the fuzz target by itself
+ */
+func Check(t testing.TB, parse func()) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	parse()
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > MaxAlloc {
+		t.Errorf("allocated %d bytes, more than %d", n, MaxAlloc)
+	}
+}
+
+/**
+ * "error" listener failing on a panic of a layer, the emitter recovers
+ * them and emits an emission.PanicError instead
+ */
+func NoPanic(t testing.TB) func(error) {
+	return func(err error) {
+		var panicErr *emission.PanicError
+		if errors.As(err, &panicErr) {
+			t.Errorf("%v\n%s", panicErr, panicErr.Stack)
+		}
+	}
+}
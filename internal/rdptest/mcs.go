@@ -0,0 +1,213 @@
+package rdptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// user id of the client, 1007 once the MCS user channel base is added
+const mcsUserID = 6
+
+// x224 data header of the MCS packets
+var x224Data = []byte{0x02, 0xf0, 0x80}
+
+// reads a TPKT packet carrying x224 data, the MCS packet comes back
+func readMCS(s *Session) ([]byte, error) {
+	payload, err := readTPKT(s.conn)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(payload, x224Data) {
+		return nil, fmt.Errorf("not x224 data % x", payload)
+	}
+	return payload[len(x224Data):], nil
+}
+
+func sendMCS(s *Session, pdu []byte) error {
+	_, err := s.conn.Write(tpkt(append(append([]byte{}, x224Data...), pdu...)))
+	return err
+}
+
+/**
+ * RDP version and early capability flags of the SC_CORE block of the
+ * connect response, RDP 10.7 and RNS_UD_SC_DYNAMIC_DST_SUPPORTED
+ */
+const (
+	ServerVersion              = 0x0008000c
+	ServerEarlyCapabilityFlags = 0x00000002
+)
+
+// GCC conference create response, SC_CORE echoes requestedProtocols
+func conferenceCreateResponse(requestedProtocols uint32) []byte {
+	blocks := make([]byte, 36)
+	binary.LittleEndian.PutUint32(blocks, 0x00100c01) // SC_CORE, 16 bytes
+	binary.LittleEndian.PutUint32(blocks[4:], ServerVersion)
+	binary.LittleEndian.PutUint32(blocks[8:], requestedProtocols)
+	binary.LittleEndian.PutUint32(blocks[12:], ServerEarlyCapabilityFlags)
+	binary.LittleEndian.PutUint32(blocks[16:], 0x000c0c02) // SC_SECURITY, no encryption
+	binary.LittleEndian.PutUint32(blocks[28:], 0x00080c03) // SC_NET
+	binary.LittleEndian.PutUint16(blocks[32:], 1003)
+	// node id, tag, result, set of one user data, the h221 server key
+	body := append([]byte{0x14, 0x76, 0x0a, 0x01, 0x01, 0x00, 0x01, 0xc0, 0x00, 'M', 'c', 'D', 'n', byte(len(blocks))}, blocks...)
+	return append([]byte{0x00, 0x05, 0x00, 0x14, 0x7c, 0x00, 0x01, byte(len(body))}, body...)
+}
+
+// MCS connect response carrying the GCC conference create response
+func connectResponse(requestedProtocols uint32) []byte {
+	domainParameters, _ := hex.DecodeString("301a" +
+		"020122" + "020103" + "020100" + "020101" + "020100" + "020101" + "020300fff8" + "020102")
+	userData := conferenceCreateResponse(requestedProtocols)
+	body := append([]byte{0x0a, 0x01, 0x00, 0x02, 0x01, 0x00}, domainParameters...)
+	body = append(body, 0x04, byte(len(userData)))
+	body = append(body, userData...)
+	return append([]byte{0x7f, 0x66, byte(len(body))}, body...)
+}
+
+/**
+ * Answers the MCS connect initial, attach user and channel joins of the
+ * client, up to the client info packet it then sends
+ */
+func MCSConnect() Step {
+	return func(s *Session) error {
+		initial, err := readMCS(s)
+		if err != nil {
+			return err
+		}
+		// the GCC user data follow the client h221 key, CS_CORE first then its length
+		if i := bytes.Index(initial, []byte("Duca")); i >= 0 {
+			if j := bytes.Index(initial[i:], []byte{0x01, 0xc0}); j >= 0 && i+j+4 <= len(initial) {
+				start := i + j
+				if end := start + int(binary.LittleEndian.Uint16(initial[start+2:])); end <= len(initial) {
+					s.ClientCoreData = initial[start:end]
+				}
+			}
+		}
+		if err := sendMCS(s, connectResponse(s.RequestedProtocols)); err != nil {
+			return err
+		}
+		// erect domain and attach user requests
+		for i := 0; i < 2; i++ {
+			if _, err := readMCS(s); err != nil {
+				return err
+			}
+		}
+		if err := sendMCS(s, []byte{0x2e, 0x00, 0x00, mcsUserID}); err != nil {
+			return err
+		}
+		// global then user channel
+		for _, channel := range []uint16{1003, 1001 + mcsUserID} {
+			request, err := readMCS(s)
+			if err != nil {
+				return err
+			}
+			if len(request) != 5 || request[0] != 0x38 {
+				return fmt.Errorf("not a channel join request % x", request)
+			}
+			confirm := []byte{0x3e, 0x00, 0x00, mcsUserID, byte(channel >> 8), byte(channel), byte(channel >> 8), byte(channel)}
+			if err := sendMCS(s, confirm); err != nil {
+				return err
+			}
+		}
+		// client info
+		request, err := readMCS(s)
+		if err != nil {
+			return err
+		}
+		s.ClientInfo, err = sendDataPayload(request)
+		return err
+	}
+}
+
+/**
+ * user data of an MCS send data request
+ * @see ITU-T T.125 SendDataRequest
+ */
+func sendData(request []byte) ([]byte, error) {
+	// initiator, channel id, data priority and segmentation then a PER length
+	if len(request) < 7 || request[0] != 0x64 {
+		return nil, fmt.Errorf("not a send data request % x", request)
+	}
+	start := 7
+	if request[6]&0x80 != 0 {
+		start = 8
+	}
+	if len(request) < start {
+		return nil, fmt.Errorf("short send data request % x", request)
+	}
+	return request[start:], nil
+}
+
+// data of an MCS send data request, after its security header
+func sendDataPayload(request []byte) ([]byte, error) {
+	data, err := sendData(request)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("short send data request % x", request)
+	}
+	return data[4:], nil
+}
+
+// MCS send data indication on the global channel, packet is below 128 bytes
+func sendGlobal(s *Session, packet []byte) error {
+	indication := []byte{0x68, 0x00, mcsUserID, 0x03, 0xeb, 0x70, byte(len(packet))}
+	return sendMCS(s, append(indication, packet...))
+}
+
+// sends a license packet, security header included, on the global channel
+func SendLicense(packet []byte) Step {
+	return func(s *Session) error {
+		return sendGlobal(s, packet)
+	}
+}
+
+/**
+ * sends a Set Error Info PDU on the global channel, without security
+ * header as the connection is secured by TLS
+ * @see MS-RDPBCGR 2.2.5.1.1 Set Error Info PDU Data
+ */
+func SetErrorInfo(code uint32) Step {
+	// share control header, share data header then errorInfo
+	pdu := []byte{22, 0, 0x17, 0, 0xea, 0x03,
+		0xea, 0x03, 0x01, 0x00, 0, 0x01, 8, 0, 0x2f, 0, 0, 0,
+		byte(code), byte(code >> 8), byte(code >> 16), byte(code >> 24)}
+	return func(s *Session) error {
+		return sendGlobal(s, pdu)
+	}
+}
+
+// license error STATUS_VALID_CLIENT, the client is connected without a license
+func LicenseValidClient() Step {
+	packet, _ := hex.DecodeString("80000000" + "ff031000070000000200000004000000")
+	return SendLicense(packet)
+}
+
+// waits for the MCS disconnect provider ultimatum and the X224 disconnect request
+func ExpectDisconnect() Step {
+	return func(s *Session) error {
+		ultimatum, err := readMCS(s)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(ultimatum, []byte{0x21, 0x80}) {
+			return fmt.Errorf("not a disconnect provider ultimatum % x", ultimatum)
+		}
+		request, err := readTPKT(s.conn)
+		if err != nil {
+			return err
+		}
+		if len(request) != 7 || request[0] != 6 || request[1] != 0x80 {
+			return fmt.Errorf("not a disconnect request % x", request)
+		}
+		// to the reference of the connection confirm
+		if ref := binary.BigEndian.Uint16(request[2:]); ref != 0x1234 {
+			return fmt.Errorf("disconnect request to reference 0x%04x", ref)
+		}
+		s.DisconnectReason = request[6]
+		s.Disconnected = true
+		return nil
+	}
+}
@@ -0,0 +1,77 @@
+package rdptest
+
+import (
+	"encoding/asn1"
+	"errors"
+	"github.com/icodeface/grdp/protocol/nla"
+)
+
+// reads the TSRequest carrying the NTLM NEGOTIATE, over TLS
+func ReadNTLMNegotiate() Step {
+	return func(s *Session) error {
+		b := make([]byte, 4096)
+		n, err := s.conn.Read(b)
+		if err != nil {
+			return err
+		}
+		req, err := nla.DecodeDERTRequest(b[:n])
+		if err != nil {
+			return err
+		}
+		if len(req.NegoTokens) != 1 {
+			return errors.New("expected a negotiate message")
+		}
+		return nil
+	}
+}
+
+// answers the NEGOTIATE with a CHALLENGE of the given flags
+func SendNTLMChallenge(negotiateFlags uint32) Step {
+	return func(s *Session) error {
+		challenge := nla.NewChallengeMessage()
+		challenge.NegotiateFlags = negotiateFlags
+		data, err := asn1.Marshal(nla.TSRequest{Version: 6, NegoTokens: []nla.NegoToken{{Data: challenge.Serialize()}}})
+		if err != nil {
+			return err
+		}
+		_, err = s.conn.Write(data)
+		return err
+	}
+}
+
+// answers the NEGOTIATE with a CHALLENGE message as captured
+func SendNTLMChallengeMessage(message []byte) Step {
+	return func(s *Session) error {
+		data, err := asn1.Marshal(nla.TSRequest{Version: 6, NegoTokens: []nla.NegoToken{{Data: message}}})
+		if err != nil {
+			return err
+		}
+		_, err = s.conn.Write(data)
+		return err
+	}
+}
+
+// reads the next TSRequest of the client, the AUTHENTICATE once the CHALLENGE was sent
+func ReadTSRequest() Step {
+	return func(s *Session) error {
+		b := make([]byte, 4096)
+		n, err := s.conn.Read(b)
+		if err != nil {
+			return err
+		}
+		_, err = nla.DecodeDERTRequest(b[:n])
+		return err
+	}
+}
+
+// answers with a TSRequest errorCode, STATUS_LOGON_FAILURE...
+func SendNTStatus(status uint32) Step {
+	return func(s *Session) error {
+		data, err := asn1.Marshal(nla.TSRequest{Version: 6, ErrorCode: int(int32(status))})
+		if err != nil {
+			return err
+		}
+		_, err = s.conn.Write(data)
+		return err
+	}
+}
@@ -0,0 +1,169 @@
+package rdptest
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// shareId of the demand active, the client sends it back in its PDUs
+const shareID = 0x000103ea
+
+// share control header of a PDU from the server channel
+func shareControl(pduType uint16, body []byte) []byte {
+	b := make([]byte, 6, 6+len(body))
+	binary.LittleEndian.PutUint16(b, uint16(6+len(body)))
+	binary.LittleEndian.PutUint16(b[2:], pduType)
+	binary.LittleEndian.PutUint16(b[4:], 1002)
+	return append(b, body...)
+}
+
+// data PDU, share data header included
+func dataPDU(pduType2 byte, data []byte) []byte {
+	b := make([]byte, 12, 12+len(data))
+	binary.LittleEndian.PutUint32(b, shareID)
+	// pad1Octet, streamId then uncompressedLength
+	b[5] = 0x01
+	binary.LittleEndian.PutUint16(b[6:], uint16(4+len(data)))
+	b[8] = pduType2
+	return shareControl(0x17, append(b, data...))
+}
+
+// demand active of a desktop of width x height, with the general and bitmap capabilities
+func demandActive(width, height uint16) []byte {
+	general := []byte{0x01, 0x00, 24, 0x00,
+		0x01, 0x00, 0x03, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00,
+		// FASTPATH_OUTPUT_SUPPORTED | NO_BITMAP_COMPRESSION_HDR
+		0x01, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x01}
+	bitmap := []byte{0x02, 0x00, 28, 0x00,
+		16, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x00,
+		byte(width), byte(width >> 8), byte(height), byte(height >> 8),
+		0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+	caps := append(append([]byte{0x02, 0x00, 0x00, 0x00}, general...), bitmap...)
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint32(body, shareID)
+	binary.LittleEndian.PutUint16(body[4:], 4)
+	binary.LittleEndian.PutUint16(body[6:], uint16(len(caps)))
+	body = append(body, "RDP\x00"...)
+	body = append(body, caps...)
+	// sessionId
+	body = append(body, 0, 0, 0, 0)
+	return shareControl(0x11, body)
+}
+
+// reads a PDU of the client and checks its type, pduType2 for a data PDU
+func readPDU(s *Session, pduType uint16, pduType2 byte) ([]byte, error) {
+	request, err := readMCS(s)
+	if err != nil {
+		return nil, err
+	}
+	// the client has no security header once the connection is secured by TLS
+	pdu, err := sendData(request)
+	if err != nil {
+		return nil, err
+	}
+	if len(pdu) < 6 || binary.LittleEndian.Uint16(pdu[2:]) != pduType {
+		return nil, fmt.Errorf("not a PDU of type 0x%02x % x", pduType, pdu)
+	}
+	if pduType == 0x17 && (len(pdu) < 18 || pdu[14] != pduType2) {
+		return nil, fmt.Errorf("not a data PDU of type 0x%02x % x", pduType2, pdu)
+	}
+	return pdu, nil
+}
+
+/**
+ * Capability exchange and connection finalization of a width x height
+ * desktop, after the licensing. The client is then "ready"
+ * @see MS-RDPBCGR 1.3.1.1 Connection Sequence
+ */
+func Activate(width, height uint16) Step {
+	return func(s *Session) error {
+		if err := sendGlobal(s, demandActive(width, height)); err != nil {
+			return err
+		}
+		if _, err := readPDU(s, 0x13, 0); err != nil {
+			return err
+		}
+		// synchronize, cooperate, request control and font list
+		for _, pduType2 := range []byte{0x1f, 0x14, 0x14, 0x27} {
+			if _, err := readPDU(s, 0x17, pduType2); err != nil {
+				return err
+			}
+		}
+		for _, pdu := range [][]byte{
+			dataPDU(0x1f, []byte{0x01, 0x00, 0xea, 0x03}),
+			dataPDU(0x14, []byte{0x04, 0x00, 0, 0, 0, 0, 0, 0}),
+			dataPDU(0x14, []byte{0x02, 0x00, 0xef, 0x03, 0xea, 0x03, 0x01, 0x00}),
+			dataPDU(0x28, []byte{0, 0, 0, 0, 0x03, 0x00, 0x04, 0x00}),
+		} {
+			if err := sendGlobal(s, pdu); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// the areas of the next refresh rect PDU of the client, see ReadRefreshRect
+type Rect struct {
+	Left, Top, Right, Bottom uint16
+}
+
+// reads a refresh rect PDU, its first area goes to *area
+func ReadRefreshRect(area *Rect) Step {
+	return func(s *Session) error {
+		pdu, err := readPDU(s, 0x17, 0x21)
+		if err != nil {
+			return err
+		}
+		// numberOfAreas, pad3Octets then the inclusive rectangles
+		data := pdu[18:]
+		if len(data) < 12 || data[0] == 0 {
+			return fmt.Errorf("refresh rect without area % x", data)
+		}
+		area.Left = binary.LittleEndian.Uint16(data[4:])
+		area.Top = binary.LittleEndian.Uint16(data[6:])
+		area.Right = binary.LittleEndian.Uint16(data[8:])
+		area.Bottom = binary.LittleEndian.Uint16(data[10:])
+		return nil
+	}
+}
+
+// TS_BITMAP_DATA of a rectangle, see SendBitmapUpdate
+type Bitmap struct {
+	Left, Top, Width, Height uint16
+	BitsPerPixel             uint16
+	// BITMAP_COMPRESSION without the compressed data header
+	Compressed bool
+	Data       []byte
+}
+
+/**
+ * sends the bitmaps in one fast path bitmap update, without compression
+ * @see MS-RDPBCGR 2.2.9.1.2.1.2 Fast-Path Update
+ */
+func SendBitmapUpdate(bitmaps ...Bitmap) Step {
+	return func(s *Session) error {
+		update := []byte{0x01, 0x00, byte(len(bitmaps)), byte(len(bitmaps) >> 8)}
+		for _, b := range bitmaps {
+			var flags uint16
+			if b.Compressed {
+				// BITMAP_COMPRESSION | NO_BITMAP_COMPRESSION_HDR
+				flags = 0x0401
+			}
+			fields := make([]byte, 18)
+			for i, v := range []uint16{b.Left, b.Top, b.Left + b.Width - 1, b.Top + b.Height - 1,
+				b.Width, b.Height, b.BitsPerPixel, flags, uint16(len(b.Data))} {
+				binary.LittleEndian.PutUint16(fields[2*i:], v)
+			}
+			update = append(update, fields...)
+			update = append(update, b.Data...)
+		}
+		// FASTPATH_UPDATETYPE_BITMAP, single fragment, then its size
+		updates := append([]byte{0x01, byte(len(update)), byte(len(update) >> 8)}, update...)
+		// fast path output header and its length on two bytes
+		length := len(updates) + 3
+		packet := append([]byte{0x00, 0x80 | byte(length>>8), byte(length)}, updates...)
+		_, err := s.conn.Write(packet)
+		return err
+	}
+}
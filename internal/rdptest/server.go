@@ -0,0 +1,378 @@
+// Package rdptest runs scripted RDP servers for the tests of the client,
+// without network access.
+package rdptest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// how long a step waits for the client
+var StepTimeout = 5 * time.Second
+
+/**
+ * One step of a scenario, run in order on the server side of a
+ * connection. A step failing ends the scenario, Server.Wait returns
+ * its error
+ */
+type Step func(s *Session) error
+
+// what the client sent during a scenario
+type Session struct {
+	conn net.Conn
+	raw  net.Conn
+	// requestedProtocols of the X224 connection request, 0 without negotiation
+	RequestedProtocols uint32
+	// routing token or cookie of the X224 connection request, without its CR LF
+	Cookie string
+	// flags of the RDP_NEG_REQ
+	RequestFlags byte
+	// of the RDP_NEG_CORRELATION_INFO after the RDP_NEG_REQ, nil without one
+	CorrelationID []byte
+	// SNI of the TLS ClientHello
+	ServerName string
+	// the client closed the connection, see ExpectClose
+	Closed bool
+	// the client disconnected from MCS then X224, see ExpectDisconnect
+	Disconnected bool
+	// of the X224 disconnect request
+	DisconnectReason byte
+	// client info packet after its security header, see MCSConnect
+	ClientInfo []byte
+	// CS_CORE block of the connect initial, its header included
+	ClientCoreData []byte
+}
+
+// runs steps on conn and closes it
+func ServeConn(conn net.Conn, steps ...Step) (*Session, error) {
+	defer conn.Close()
+	s := &Session{conn: conn, raw: conn}
+	for i, step := range steps {
+		conn.SetDeadline(time.Now().Add(StepTimeout))
+		if err := step(s); err != nil {
+			return s, fmt.Errorf("step %d: %w", i, err)
+		}
+	}
+	return s, nil
+}
+
+/**
+ * Listener serving one scenario per accepted connection, in order.
+ * It stops accepting once each scenario got its connection
+ */
+type Server struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	sessions []*Session
+	err      error
+}
+
+func NewServer(scenarios ...[]Step) (*Server, error) {
+	return NewServerAddr("127.0.0.1:0", scenarios...)
+}
+
+// server listening on addr, "[::1]:0" for the IPv6 loopback
+func NewServerAddr(addr string, scenarios ...[]Step) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &Server{listener: l, sessions: make([]*Session, len(scenarios))}
+	srv.wg.Add(1)
+	go srv.serve(scenarios)
+	return srv, nil
+}
+
+func (srv *Server) serve(scenarios [][]Step) {
+	defer srv.wg.Done()
+	defer srv.listener.Close()
+	for i, steps := range scenarios {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			srv.fail(fmt.Errorf("scenario %d: %w", i, err))
+			return
+		}
+		srv.wg.Add(1)
+		go func(i int, steps []Step) {
+			defer srv.wg.Done()
+			s, err := ServeConn(conn, steps...)
+			srv.mu.Lock()
+			srv.sessions[i] = s
+			srv.mu.Unlock()
+			if err != nil {
+				srv.fail(fmt.Errorf("scenario %d: %w", i, err))
+			}
+		}(i, steps)
+	}
+}
+
+func (srv *Server) fail(err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.err == nil {
+		srv.err = err
+	}
+}
+
+// host:port to dial
+func (srv *Server) Addr() string {
+	return srv.listener.Addr().String()
+}
+
+// stops accepting, scenarios without a connection fail
+func (srv *Server) Close() error {
+	return srv.listener.Close()
+}
+
+// waits for the scenarios to end, the first failure
+func (srv *Server) Wait() error {
+	srv.wg.Wait()
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.err
+}
+
+// sessions by scenario, once Wait returned
+func (srv *Server) Sessions() []*Session {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]*Session{}, srv.sessions...)
+}
+
+// payload of the next TPKT packet
+func readTPKT(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 3 {
+		return nil, fmt.Errorf("not a tpkt packet 0x%02x", header[0])
+	}
+	size := int(binary.BigEndian.Uint16(header[2:]))
+	if size < 4 {
+		return nil, fmt.Errorf("tpkt bad packet size %d", size)
+	}
+	payload := make([]byte, size-4)
+	_, err := io.ReadFull(r, payload)
+	return payload, err
+}
+
+func tpkt(payload []byte) []byte {
+	b := []byte{3, 0, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(payload)+4))
+	return append(b, payload...)
+}
+
+// sends b as is
+func Send(b []byte) Step {
+	return func(s *Session) error {
+		_, err := s.conn.Write(b)
+		return err
+	}
+}
+
+// sends payload in a TPKT packet
+func SendTPKT(payload []byte) Step {
+	return Send(tpkt(payload))
+}
+
+// reads a TPKT packet and drops it
+func ReadTPKT() Step {
+	return func(s *Session) error {
+		_, err := readTPKT(s.conn)
+		return err
+	}
+}
+
+func Sleep(d time.Duration) Step {
+	return func(s *Session) error {
+		time.Sleep(d)
+		return nil
+	}
+}
+
+// closes the connection, the next steps fail
+func Close() Step {
+	return func(s *Session) error {
+		return s.conn.Close()
+	}
+}
+
+// resets the connection, the client reads ECONNRESET, the next steps fail
+func Reset() Step {
+	return func(s *Session) error {
+		if tcp, ok := s.raw.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		return s.raw.Close()
+	}
+}
+
+// waits for the client to close the connection, anything sent before fails
+func ExpectClose() Step {
+	return func(s *Session) error {
+		n, err := s.conn.Read(make([]byte, 1))
+		if n > 0 {
+			return errors.New("data received instead of close")
+		}
+		if err == io.EOF || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed) {
+			s.Closed = true
+			return nil
+		}
+		return err
+	}
+}
+
+// reads the X224 connection request
+func ReadConnectionRequest() Step {
+	return func(s *Session) error {
+		request, err := readTPKT(s.conn)
+		if err != nil {
+			return err
+		}
+		if len(request) < 2 || request[1]&0xf0 != 0xe0 {
+			return fmt.Errorf("not a connection request % x", request)
+		}
+		// RDP_NEG_REQ ends the request, but for a correlation info
+		end := len(request)
+		if end >= 7+8+36 && request[end-36] == 0x06 && request[end-34] == 36 {
+			s.CorrelationID = append([]byte{}, request[end-32:end-16]...)
+			end -= 36
+		}
+		if end >= 15 && request[end-8] == 0x01 {
+			s.RequestedProtocols = binary.LittleEndian.Uint32(request[end-4:])
+			s.RequestFlags = request[end-7]
+			end -= 8
+		}
+		if end > 7 {
+			s.Cookie = string(bytes.TrimSuffix(request[7:end], []byte("\r\n")))
+		}
+		return nil
+	}
+}
+
+func connectionConfirm(negType, flags byte, value uint32) []byte {
+	b := []byte{0x0e, 0xd0, 0, 0, 0x12, 0x34, 0, negType, flags, 8, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(b[11:], value)
+	return tpkt(b)
+}
+
+// connection confirm with RDP_NEG_RSP selecting protocol
+func NegotiationResponse(protocol uint32) Step {
+	return Send(connectionConfirm(0x02, 0, protocol))
+}
+
+// connection confirm with RDP_NEG_RSP selecting protocol with flags, RESTRICTED_ADMIN_MODE_SUPPORTED...
+func NegotiationResponseFlags(protocol uint32, flags byte) Step {
+	return Send(connectionConfirm(0x02, flags, protocol))
+}
+
+// connection confirm with RDP_NEG_FAILURE, SSL_REQUIRED_BY_SERVER...
+func NegotiationFailure(code uint32) Step {
+	return Send(connectionConfirm(0x03, 0, code))
+}
+
+/**
+ * connection confirm of a server with Standard RDP Security only, after
+ * ReadConnectionRequest: SSL_NOT_ALLOWED_BY_SERVER unless the request
+ * offered PROTOCOL_RDP alone
+ */
+func StandardSecurityOnly() Step {
+	return func(s *Session) error {
+		if s.RequestedProtocols != 0 {
+			return NegotiationFailure(0x00000002)(s)
+		}
+		return NegotiationResponse(0)(s)
+	}
+}
+
+// connection confirm without negotiation, an RDP 4.0 server
+func ConfirmWithoutNegotiation() Step {
+	return SendTPKT([]byte{0x06, 0xd0, 0, 0, 0x12, 0x34, 0})
+}
+
+// X224 disconnect request with reason, REASON_NORMAL...
+func DisconnectRequest(reason byte) Step {
+	return SendTPKT([]byte{0x06, 0x80, 0, 0, 0x12, 0x34, reason})
+}
+
+// X224 error TPDU with its reject cause, CAUSE_INVALID_TPDU_TYPE...
+func ErrorTPDU(cause byte) Step {
+	return SendTPKT([]byte{0x04, 0x70, 0, 0, cause})
+}
+
+// self signed certificate of StartTLS
+func Certificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "rdp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+/**
+ * TLS handshake with the first certificate of config, a generated one
+ * when it has none. config sets the versions and cipher suites and may
+ * be nil. The next steps run over TLS
+ */
+func StartTLS(config *tls.Config) Step {
+	return func(s *Session) error {
+		var cert tls.Certificate
+		var err error
+		if config != nil && len(config.Certificates) > 0 {
+			cert = config.Certificates[0]
+		} else if cert, err = Certificate(); err != nil {
+			return err
+		}
+		c := &tls.Config{}
+		if config != nil {
+			c = config.Clone()
+		}
+		c.Certificates = nil
+		c.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			s.ServerName = hello.ServerName
+			return &cert, nil
+		}
+		conn := tls.Server(s.raw, c)
+		if err := conn.Handshake(); err != nil {
+			return err
+		}
+		s.conn = conn
+		return nil
+	}
+}
+
+// TLS handshake the client must fail, its versions or cipher suites not supported
+func RefuseTLS(config *tls.Config) Step {
+	start := StartTLS(config)
+	return func(s *Session) error {
+		if err := start(s); err == nil {
+			return errors.New("tls handshake succeeded")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,190 @@
+/**
+ * Package replay feeds the server side of a recorded session through
+ * the receive pipeline of the client, tpkt, x224, mcs, sec then pdu,
+ * and summarizes the events it emits. A transcript is text:
+ *
+ *	# comment
+ *	> 0300002c27e00000000000...   bytes sent by the client
+ *	< 030000130ed00000123400...   bytes sent by the server
+ *
+ * Each line is a record, hex digits may be separated by spaces. The
+ * records are the plain RDP stream, the way the layers see it once TLS
+ * is started
+ */
+package replay
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/protocol/lic"
+	"github.com/icodeface/grdp/protocol/pdu"
+	"github.com/icodeface/grdp/protocol/sec"
+	"github.com/icodeface/grdp/protocol/t125"
+	"github.com/icodeface/grdp/protocol/tpkt"
+	"github.com/icodeface/grdp/protocol/x224"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long Replay waits for the pipeline once the server bytes are sent
+var Timeout = 5 * time.Second
+
+type Record struct {
+	FromServer bool
+	Data       []byte
+}
+
+type Transcript struct {
+	Records []Record
+}
+
+func Load(r io.Reader) (*Transcript, error) {
+	t := &Transcript{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var record Record
+		switch line[0] {
+		case '<':
+			record.FromServer = true
+		case '>':
+		default:
+			return nil, fmt.Errorf("line %d: expected < or >", n)
+		}
+		data, err := hex.DecodeString(strings.Join(strings.Fields(line[1:]), ""))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		record.Data = data
+		t.Records = append(t.Records, record)
+	}
+	return t, scanner.Err()
+}
+
+// bytes sent by the server, in order
+func (t *Transcript) ServerBytes() []byte {
+	var b []byte
+	for _, r := range t.Records {
+		if r.FromServer {
+			b = append(b, r.Data...)
+		}
+	}
+	return b
+}
+
+/**
+ * Events emitted while the pipeline parsed the server bytes, in order:
+ * "error <message>", "license <message>", "ready", "success" and
+ * "update". The connection ending after the last record is left out
+ */
+type Summary []string
+
+func (s Summary) String() string {
+	return strings.Join(s, "\n")
+}
+
+// the client records are not checked, its writes never fail once the server records ended
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// the records are plain, securing the connection is left out
+type plainTransport struct {
+	*tpkt.TPKT
+}
+
+func (plainTransport) StartTLS() error {
+	return nil
+}
+
+func (plainTransport) StartNLA() error {
+	return nil
+}
+
+/**
+ * Replay the server bytes of t against a client stack, the client
+ * writes are dropped. It stops at the first error, or once the bytes
+ * ran out and the connection closed
+ */
+func Replay(t *Transcript) (Summary, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	logger := glog.New(log.New(ioutil.Discard, "", 0), glog.NONE)
+	layer := core.NewSocketLayer(discardConn{client}, nil, logger)
+	defer layer.Close()
+	tp := tpkt.New(layer, logger)
+	x := x224.New(plainTransport{tp}, logger)
+	mcs := t125.NewMCSClient(x, logger)
+	sc := sec.NewClient(mcs, logger)
+	p := pdu.NewClient(sc, logger)
+	tp.SetFastPathListener(p)
+	p.SetFastPathSender(tp)
+
+	var mu sync.Mutex
+	var summary Summary
+	add := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		summary = append(summary, event)
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	p.On("error", func(err error) {
+		// the connection ended, parsers wrap their EOF
+		if err != io.EOF && err != io.ErrClosedPipe {
+			add("error " + err.Error())
+		}
+		once.Do(func() { close(done) })
+	}).On("close", func() {
+		once.Do(func() { close(done) })
+	}).On("ready", func() {
+		add("ready")
+	}).On("update", func(interface{}) {
+		add("update")
+	})
+	sc.On("success", func() {
+		add("success")
+	}).On("license", func(packet *lic.LicensePacket) {
+		if m, ok := packet.LicensingMessage.(*lic.ErrorMessage); ok {
+			add("license " + m.String())
+			return
+		}
+		add("license " + lic.MessageTypeName(packet.BMsgtype))
+	})
+
+	x.SetRequestedProtocol(x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID)
+	if err := x.Connect("replay"); err != nil {
+		return nil, err
+	}
+	go func() {
+		server.Write(t.ServerBytes())
+		server.Close()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(Timeout):
+		return nil, errors.New("replay timed out")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return append(Summary{}, summary...), nil
+}
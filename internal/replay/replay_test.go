@@ -0,0 +1,79 @@
+package replay_test
+
+import (
+	"flag"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/internal/replay"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// go test ./internal/replay -update writes the summaries of new transcripts
+var update = flag.Bool("update", false, "write the summaries of testdata")
+
+func init() {
+	glog.SetLogger(log.New(ioutil.Discard, "", 0))
+}
+
+func TestLoad(t *testing.T) {
+	tr, err := replay.Load(strings.NewReader("# comment\n\n> 0300 0004\n< 03000005\n< ff\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Records) != 3 || tr.Records[0].FromServer || !tr.Records[1].FromServer {
+		t.Error(tr.Records, "not equal to", "1 client then 2 server records")
+	}
+	if b := tr.ServerBytes(); string(b) != "\x03\x00\x00\x05\xff" {
+		t.Error(b, "not equal to", []byte{3, 0, 0, 5, 0xff})
+	}
+	for _, input := range []string{"0300", "< 030", "> zz"} {
+		if _, err := replay.Load(strings.NewReader(input)); err == nil {
+			t.Error(input, "loaded")
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	transcripts, _ := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	if len(transcripts) == 0 {
+		t.Fatal("no transcript in testdata")
+	}
+	for _, name := range transcripts {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, err := replay.Load(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		summary, err := replay.Replay(tr)
+		if err != nil {
+			t.Error(name, err)
+			continue
+		}
+		golden := strings.TrimSuffix(name, ".txt") + ".summary"
+		if *update {
+			ioutil.WriteFile(golden, []byte(summary.String()+"\n"), 0644)
+			continue
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Error(name, err)
+			continue
+		}
+		// a transcript stopping before any event checks nothing
+		if len(strings.TrimSpace(string(expected))) == 0 {
+			t.Error(golden, "is empty")
+			continue
+		}
+		if got := strings.TrimSpace(summary.String()); got != strings.TrimSpace(string(expected)) {
+			t.Errorf("%s\n%s\nnot equal to\n%s", name, got, expected)
+		}
+	}
+}
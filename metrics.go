@@ -0,0 +1,178 @@
+package grdp
+
+import (
+	"github.com/icodeface/grdp/core"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+/**
+ * Metrics of the probes of a Scanner and the attempts of a Client, see
+ * Scanner.Metrics and WithMetrics. A registry of a metrics system
+ * implements it, the prommetrics package exposes them to Prometheus.
+ * The methods are called from the goroutines of the connections, they
+ * must be safe for concurrent use and return quickly
+ */
+type Metrics interface {
+	// a probe of a scan ended, after its retries, outcome is an OUTCOME_*
+	ProbeDone(outcome string)
+	// a connection was opened, delta 1, or closed, delta -1
+	ConnectionsOpen(delta int)
+	// a core.PHASE_* of a connection ended after d
+	PhaseDuration(phase string, d time.Duration)
+	// bytes of the TPKT packets, after TLS
+	BytesRead(n int)
+	BytesWritten(n int)
+	// a connection failed in layer, a LAYER_*
+	Error(layer string)
+}
+
+// outcomes of Metrics.ProbeDone
+const (
+	// the server picked a protocol
+	OUTCOME_NEGOTIATED = "negotiated"
+	// the server answered with a failure code
+	OUTCOME_NEGOTIATION_FAILURE = "negotiation_failure"
+	// an RDP 4.0 server, without negotiation
+	OUTCOME_NO_NEGOTIATION = "no_negotiation"
+	// no answer, see ScanResult.Err
+	OUTCOME_ERROR = "error"
+)
+
+/**
+ * Layers of Metrics.Error, the one an error is counted in is the lowest
+ * that reported it: an error of tpkt goes up to pdu but counts for tpkt
+ */
+const (
+	LAYER_DIAL = "dial"
+	LAYER_TPKT = "tpkt"
+	LAYER_X224 = "x224"
+	LAYER_TLS  = "tls"
+	LAYER_NLA  = "nla"
+	LAYER_MCS  = "mcs"
+	LAYER_SEC  = "sec"
+	LAYER_PDU  = "pdu"
+)
+
+// the default, does nothing
+type NopMetrics struct{}
+
+func (NopMetrics) ProbeDone(outcome string)                    {}
+func (NopMetrics) ConnectionsOpen(delta int)                   {}
+func (NopMetrics) PhaseDuration(phase string, d time.Duration) {}
+func (NopMetrics) BytesRead(n int)                             {}
+func (NopMetrics) BytesWritten(n int)                          {}
+func (NopMetrics) Error(layer string)                          {}
+
+func probeOutcome(result ScanResult) string {
+	switch {
+	case result.Err != nil:
+		return OUTCOME_ERROR
+	case !result.Negotiated:
+		return OUTCOME_NO_NEGOTIATION
+	case result.Negotiation.Failed():
+		return OUTCOME_NEGOTIATION_FAILURE
+	}
+	return OUTCOME_NEGOTIATED
+}
+
+// the durations of the phases that ended
+func reportPhases(m Metrics, timer *core.PhaseTimer) {
+	for phase, d := range timer.Durations() {
+		m.PhaseDuration(phase, d)
+	}
+}
+
+// failure of an attempt of the client in layer, see WithMetrics
+func (g *Client) countError(layer string) {
+	if g.metrics != nil {
+		g.metrics.Error(layer)
+	}
+}
+
+// Instrumentation of the connections, bytes and their counts, for m
+type metricsInstrumentation struct {
+	core.NopInstrumentation
+	m Metrics
+}
+
+func (i metricsInstrumentation) ConnOpened(addr string)  { i.m.ConnectionsOpen(1) }
+func (i metricsInstrumentation) ConnClosed(reason error) { i.m.ConnectionsOpen(-1) }
+func (i metricsInstrumentation) BytesRead(n int)         { i.m.BytesRead(n) }
+func (i metricsInstrumentation) BytesWritten(n int)      { i.m.BytesWritten(n) }
+
+// conn counting what is read and written on it, for the probes without a SocketLayer
+type countingConn struct {
+	net.Conn
+	m Metrics
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.m.BytesRead(n)
+	}
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.m.BytesWritten(n)
+	}
+	return n, err
+}
+
+/**
+ * Errors emitted by the layers of a session. A layer emits again those
+ * of the layer under it, in goroutines of their own, so an error is
+ * only counted once the session ended, for the lowest layer
+ */
+type layerErrors struct {
+	mu     sync.Mutex
+	errs   []error
+	layers []int
+}
+
+// layers from the lowest
+var errorLayers = []string{LAYER_TPKT, LAYER_X224, LAYER_MCS, LAYER_SEC, LAYER_PDU}
+
+// listener of the "error" of errorLayers[layer]
+func (e *layerErrors) listener(layer int) func(error) {
+	return func(err error) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		for i := range e.errs {
+			if sameError(e.errs[i], err) {
+				if layer < e.layers[i] {
+					e.layers[i] = layer
+				}
+				return
+			}
+		}
+		e.errs = append(e.errs, err)
+		e.layers = append(e.layers, layer)
+	}
+}
+
+func (e *layerErrors) report(m Metrics) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, layer := range e.layers {
+		m.Error(errorLayers[layer])
+	}
+	e.errs, e.layers = nil, nil
+}
+
+// the same error value, == would panic on a value of an uncomparable type
+func sameError(a, b error) bool {
+	if a == nil || b == nil || reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return a == nil && b == nil
+	}
+	if !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	return a == b
+}
@@ -0,0 +1,175 @@
+package grdp_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp"
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/protocol/x224"
+)
+
+// totals of the calls to a Metrics
+type metricsRecorder struct {
+	mu           sync.Mutex
+	probes       map[string]int
+	open         int
+	opened       int
+	phases       map[string]int
+	bytesRead    int
+	bytesWritten int
+	errors       map[string]int
+}
+
+func newMetricsRecorder() *metricsRecorder {
+	return &metricsRecorder{probes: map[string]int{}, phases: map[string]int{}, errors: map[string]int{}}
+}
+
+func (r *metricsRecorder) ProbeDone(outcome string) {
+	r.mu.Lock()
+	r.probes[outcome]++
+	r.mu.Unlock()
+}
+
+func (r *metricsRecorder) ConnectionsOpen(delta int) {
+	r.mu.Lock()
+	r.open += delta
+	if delta > 0 {
+		r.opened++
+	}
+	r.mu.Unlock()
+}
+
+func (r *metricsRecorder) PhaseDuration(phase string, d time.Duration) {
+	r.mu.Lock()
+	r.phases[phase]++
+	r.mu.Unlock()
+}
+
+func (r *metricsRecorder) BytesRead(n int) {
+	r.mu.Lock()
+	r.bytesRead += n
+	r.mu.Unlock()
+}
+
+func (r *metricsRecorder) BytesWritten(n int) {
+	r.mu.Lock()
+	r.bytesWritten += n
+	r.mu.Unlock()
+}
+
+func (r *metricsRecorder) Error(layer string) {
+	r.mu.Lock()
+	r.errors[layer]++
+	r.mu.Unlock()
+}
+
+func equalCounts(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestScannerMetrics(t *testing.T) {
+	srv, err := rdptest.NewServer(
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationResponse(x224.PROTOCOL_SSL), rdptest.ExpectClose()},
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER), rdptest.ExpectClose()},
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.ConfirmWithoutNegotiation(), rdptest.ExpectClose()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := l.Addr().String()
+	l.Close()
+
+	hosts := make(chan string, 4)
+	hosts <- srv.Addr()
+	hosts <- srv.Addr()
+	hosts <- srv.Addr()
+	hosts <- refused
+	close(hosts)
+	r := newMetricsRecorder()
+	scanner := grdp.NewScanner()
+	scanner.Metrics = r
+	// one at a time, the scenarios are served in order
+	for range scanner.Scan(context.Background(), hosts, 1) {
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	expected := map[string]int{grdp.OUTCOME_NEGOTIATED: 1, grdp.OUTCOME_NEGOTIATION_FAILURE: 1,
+		grdp.OUTCOME_NO_NEGOTIATION: 1, grdp.OUTCOME_ERROR: 1}
+	if !equalCounts(r.probes, expected) {
+		t.Error(r.probes, "not equal to", expected)
+	}
+	if r.open != 0 || r.opened != 3 {
+		t.Error(r.open, r.opened, "not equal to", 0, 3)
+	}
+	if expected := map[string]int{core.PHASE_DIAL: 4, core.PHASE_X224: 3}; !equalCounts(r.phases, expected) {
+		t.Error(r.phases, "not equal to", expected)
+	}
+	// a connection request of 19 bytes, the confirms of 19, 19 and 11
+	if r.bytesWritten != 3*19 || r.bytesRead != 19+19+11 {
+		t.Error(r.bytesWritten, r.bytesRead, "not equal to", 3*19, 19+19+11)
+	}
+	if expected := map[string]int{grdp.LAYER_DIAL: 1}; !equalCounts(r.errors, expected) {
+		t.Error(r.errors, "not equal to", expected)
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	srv, err := rdptest.NewServer(
+		append(sessionScenario, rdptest.ExpectDisconnect(), rdptest.ExpectClose()),
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER), rdptest.ExpectClose()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newMetricsRecorder()
+	g, err := grdp.New(srv.Addr(), grdp.WithLogLevel(glog.NONE), grdp.WithMetrics(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = g.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	// the failure goes up from x224 to pdu, it is counted once
+	if err = g.Login("alice", "secret"); err == nil {
+		t.Fatal("logged in")
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	if r.open != 0 || r.opened != 2 {
+		t.Error(r.open, r.opened, "not equal to", 0, 2)
+	}
+	if expected := map[string]int{grdp.LAYER_X224: 1}; !equalCounts(r.errors, expected) {
+		t.Error(r.errors, "not equal to", expected)
+	}
+	for _, phase := range []string{core.PHASE_DIAL, core.PHASE_X224, core.PHASE_TLS, core.PHASE_MCS, core.PHASE_LICENSE} {
+		if r.phases[phase] < 1 {
+			t.Error(phase, "not reported", r.phases)
+		}
+	}
+	if r.bytesRead == 0 || r.bytesWritten == 0 {
+		t.Error(r.bytesRead, r.bytesWritten)
+	}
+	if len(r.probes) != 0 {
+		t.Error(r.probes, "counted as probes")
+	}
+}
@@ -0,0 +1,265 @@
+package grdp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/protocol/nla"
+	"github.com/icodeface/grdp/protocol/x224"
+	"net"
+	"strconv"
+	"time"
+)
+
+// how long Probe waits for the connection confirm when ctx has no deadline
+var ProbeTimeout = 5 * time.Second
+
+// answer of a server to the connection request of Probe
+type ProbeResult struct {
+	// host:port probed
+	Host string
+	Port int
+	// the TCP connection was established
+	Connected bool
+	// false for an RDP 4.0 server, it only speaks standard RDP security
+	Negotiated bool
+	// the protocol picked by the server or its failure code
+	Negotiation x224.NegotiationResult
+	// protocols offered by the connection request Negotiation answers
+	Requested uint32
+	// failures answered to the connection requests before it, see
+	// NEGOTIATE_DOWNGRADE
+	Downgrades []x224.NegotiationResult
+	// from the connection request sent to the connection confirm received
+	RTT time.Duration
+	// of a server that picked NLA, see Scanner.FingerprintNLA
+	Certificate *CertificateInfo
+	ServerInfo  *ServerInfo
+	// tls.VersionTLS12... of the fingerprint, 0 without one
+	TLSVersion uint16
+	// why Certificate or ServerInfo are missing, the negotiation stands
+	FingerprintErr error
+	// why Negotiation.NLA is unknown, see Scanner.CheckNLA
+	CheckNLAErr error
+	// dial, x224 and, with a fingerprint, tls and nla
+	Timings Timings `json:"timings"`
+}
+
+/**
+ * the server accepts restricted admin logons, see
+ * x224.NegotiationResult.RestrictedAdminSupported and ProbeWithFlags
+ */
+func (r ProbeResult) RestrictedAdmin() bool {
+	return r.Negotiated && r.Negotiation.RestrictedAdminSupported()
+}
+
+/**
+ * the negotiation with what else the probe learned of the server, as
+ * Scanner.Results records it
+ */
+func (r ProbeResult) record() x224.NegotiationResult {
+	record := r.Negotiation
+	record.RTT = r.RTT
+	if r.Certificate != nil {
+		record.TLSCommonName = r.Certificate.CommonName
+	}
+	if info := r.ServerInfo; info != nil {
+		record.NTLMHostname = info.DNSComputerName
+		if record.NTLMHostname == "" {
+			record.NTLMHostname = info.NetBIOSComputerName
+		}
+		// without NTLMSSP_NEGOTIATE_VERSION there is none
+		if info.Version.ProductMajorVersion != 0 {
+			record.ProductVersion = info.Version.String()
+		}
+	}
+	return record
+}
+
+// protocol the server would secure the connection with, PROTOCOL_RDP without negotiation
+func (r ProbeResult) SelectedProtocol() uint32 {
+	if !r.Negotiated {
+		return x224.PROTOCOL_RDP
+	}
+	return r.Negotiation.SelectedProtocol
+}
+
+/**
+ * Send the X224 connection request offering protocols to host and read
+ * the connection confirm, nothing else is sent: the connection is
+ * closed right after, before TLS, NLA or MCS. A negotiation failure is
+ * a result, see NegotiationResult.Failed
+ */
+func Probe(ctx context.Context, host string, protocols uint32) (ProbeResult, error) {
+	return probe(ctx, nil, host, protocols, 0, nil, false, nil)
+}
+
+/**
+ * Probe with the x224.RESTRICTED_ADMIN_MODE_REQUIRED... flags in the
+ * request, a server may only tell it supports restricted admin to a
+ * client requiring it
+ */
+func ProbeWithFlags(ctx context.Context, host string, protocols uint32, flags uint8) (ProbeResult, error) {
+	return probe(ctx, nil, host, protocols, flags, nil, false, nil)
+}
+
+/**
+ * How a probe offers the protocols, see Scanner.Strategy. A server
+ * answering a request it cannot serve with a failure looks dead to a
+ * single request when it only speaks Standard RDP Security
+ */
+type NegotiationStrategy int
+
+const (
+	// a single connection request offering Scanner.Protocols
+	NEGOTIATE_OFFERED NegotiationStrategy = iota
+	// a connection request per protocol of DowngradeProtocols, each on
+	// its own connection, the next one sent after a failure
+	NEGOTIATE_DOWNGRADE
+)
+
+// protocols offered in turn by NEGOTIATE_DOWNGRADE, PROTOCOL_RDP last
+var DowngradeProtocols = []uint32{x224.PROTOCOL_HYBRID, x224.PROTOCOL_SSL, x224.PROTOCOL_RDP}
+
+/**
+ * Probe with PROTOCOL_HYBRID, then PROTOCOL_SSL when the server
+ * answered with a failure, then PROTOCOL_RDP. The result is that of the
+ * last connection request, Requested tells the level that worked and
+ * Downgrades the failures before it
+ */
+func ProbeDowngrade(ctx context.Context, host string) (ProbeResult, error) {
+	return probeDowngrade(ctx, nil, host, 0, nil, false, nil)
+}
+
+func probeDowngrade(ctx context.Context, dialer Dialer, host string, flags uint8, cookie []byte, fingerprint bool, m Metrics) (ProbeResult, error) {
+	var downgrades []x224.NegotiationResult
+	for i, protocols := range DowngradeProtocols {
+		result, err := probe(ctx, dialer, host, protocols, flags, cookie, fingerprint, m)
+		if err != nil || !result.Negotiated || !result.Negotiation.Failed() || i == len(DowngradeProtocols)-1 {
+			result.Downgrades = downgrades
+			return result, err
+		}
+		downgrades = append(downgrades, result.Negotiation)
+	}
+	return ProbeResult{Host: host}, fmt.Errorf("%s: no DowngradeProtocols", host)
+}
+
+/**
+ * Probe with the connection opened by dialer, nil for a direct one.
+ * With fingerprint a server picking NLA goes on to the NTLM CHALLENGE.
+ * The connection is reported to m, nil for no metrics
+ */
+func probe(ctx context.Context, dialer Dialer, host string, protocols uint32, flags uint8, cookie []byte, fingerprint bool, m Metrics) (result ProbeResult, err error) {
+	result = ProbeResult{Host: host, Requested: protocols}
+	if m == nil {
+		m = NopMetrics{}
+	}
+	timer := core.NewPhaseTimer(now)
+	defer func() {
+		result.Timings = timingsOf(timer.Durations())
+		reportPhases(m, timer)
+	}()
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		result.Port, _ = strconv.Atoi(port)
+	}
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: DefaultDialTimeout}
+	}
+	timer.PhaseStarted(core.PHASE_DIAL)
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	timer.PhaseEnded(core.PHASE_DIAL)
+	if err != nil {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		m.Error(LAYER_DIAL)
+		return result, fmt.Errorf("[dial err] %w", err)
+	}
+	m.ConnectionsOpen(1)
+	defer m.ConnectionsOpen(-1)
+	defer conn.Close()
+	result.Connected = true
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	// a deadline of ctx closes the connection, its error is then ctx.Err()
+	if _, ok := ctx.Deadline(); !ok {
+		conn.SetDeadline(time.Now().Add(ProbeTimeout))
+	}
+
+	start := time.Now()
+	timer.PhaseStarted(core.PHASE_X224)
+	neg, err := x224.ProbeWithCookie(countingConn{conn, m}, protocols, flags, cookie)
+	timer.PhaseEnded(core.PHASE_X224)
+	result.RTT = time.Since(start)
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if err != nil {
+		m.Error(LAYER_X224)
+		var disconnect *x224.DisconnectError
+		if errors.As(err, &disconnect) {
+			disconnect.Host = host
+		}
+		return result, fmt.Errorf("[x224 probe err] %w", err)
+	}
+	if neg != nil {
+		result.Negotiated = true
+		result.Negotiation = x224.NewNegotiationResult(host, neg)
+	}
+	if fingerprint && result.Negotiated && !result.Negotiation.Failed() &&
+		(result.SelectedProtocol() == x224.PROTOCOL_HYBRID || result.SelectedProtocol() == x224.PROTOCOL_HYBRID_EX) {
+		result.FingerprintErr = fingerprintNLA(conn, &result, timer, m)
+		if ctx.Err() != nil {
+			result.FingerprintErr = ctx.Err()
+		}
+	}
+	return result, nil
+}
+
+// how a server treats NLA, see CheckNLA
+type NLAMode = x224.NLAMode
+
+/**
+ * Whether host enforces NLA, without credentials: a connection request
+ * offering PROTOCOL_SSL only then one offering PROTOCOL_HYBRID only,
+ * each on its own connection closed after the confirm. See
+ * x224.NLAModeOf for how their answers combine
+ */
+func CheckNLA(ctx context.Context, host string) (NLAMode, error) {
+	return checkNLA(ctx, nil, host, nil, nil)
+}
+
+func checkNLA(ctx context.Context, dialer Dialer, host string, cookie []byte, m Metrics) (NLAMode, error) {
+	var negotiations [2]x224.NegotiationResult
+	for i, protocols := range []uint32{x224.PROTOCOL_SSL, x224.PROTOCOL_HYBRID} {
+		result, err := probe(ctx, dialer, host, protocols, 0, cookie, false, m)
+		if err != nil {
+			return x224.NLA_UNKNOWN, err
+		}
+		negotiations[i] = result.Negotiation
+	}
+	return x224.NLAModeOf(negotiations[0], negotiations[1]), nil
+}
+
+// the certificate and the NTLM CHALLENGE of a server that picked NLA
+func fingerprintNLA(conn net.Conn, result *ProbeResult, timer *core.PhaseTimer, m Metrics) error {
+	layer := core.NewSocketLayer(conn, nil, glog.Default())
+	layer.SetInstrumentation(core.MultiInstrumentation(timer, metricsInstrumentation{m: m}))
+	if err := layer.StartTLS(); err != nil {
+		m.Error(LAYER_TLS)
+		return err
+	}
+	result.Certificate, _ = layer.PeerCertificate()
+	result.TLSVersion = layer.TLSVersion()
+	timer.PhaseStarted(core.PHASE_NLA)
+	info, err := nla.Fingerprint(layer)
+	timer.PhaseEnded(core.PHASE_NLA)
+	if err != nil {
+		m.Error(LAYER_NLA)
+		return err
+	}
+	result.ServerInfo = info
+	return nil
+}
@@ -0,0 +1,293 @@
+package grdp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp"
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/protocol/x224"
+)
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name       string
+		step       rdptest.Step
+		negotiated bool
+		expected   x224.NegotiationResult
+		protocol   uint32
+	}{
+		{"hybrid", rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID), true,
+			x224.NegotiationResult{Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: x224.PROTOCOL_HYBRID}, x224.PROTOCOL_HYBRID},
+		{"failure", rdptest.NegotiationFailure(x224.SSL_NOT_ALLOWED_BY_SERVER), true,
+			x224.NegotiationResult{Type: x224.TYPE_RDP_NEG_FAILURE, FailureCode: x224.SSL_NOT_ALLOWED_BY_SERVER}, 0},
+		{"rdp 4.0", rdptest.ConfirmWithoutNegotiation(), false,
+			x224.NegotiationResult{}, x224.PROTOCOL_RDP},
+	}
+	var protocols uint32 = x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID | x224.PROTOCOL_HYBRID_EX
+	for _, test := range tests {
+		// nothing follows the connection request
+		srv, err := rdptest.NewServer([]rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			test.step,
+			rdptest.ExpectClose(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := grdp.Probe(context.Background(), srv.Addr(), protocols)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if test.negotiated {
+			test.expected.Host = srv.Addr()
+		}
+		if result.Negotiated != test.negotiated || result.Negotiation != test.expected || result.SelectedProtocol() != test.protocol {
+			t.Error(test.name, result, "not equal to", test.expected)
+		}
+		if result.RTT <= 0 {
+			t.Error(test.name, result.RTT, "not a round trip time")
+		}
+		if err = srv.Wait(); err != nil {
+			t.Error(test.name, err)
+		}
+		if session := srv.Sessions()[0]; session.RequestedProtocols != protocols {
+			t.Error(test.name, session.RequestedProtocols, "not equal to", protocols)
+		}
+	}
+}
+
+func TestProbeRestrictedAdmin(t *testing.T) {
+	scenario := []rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponseFlags(x224.PROTOCOL_HYBRID, x224.EXTENDED_CLIENT_DATA_SUPPORTED|x224.RESTRICTED_ADMIN_MODE_SUPPORTED),
+		rdptest.ExpectClose(),
+	}
+	srv, err := rdptest.NewServer(scenario, scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := grdp.ProbeWithFlags(context.Background(), srv.Addr(), x224.PROTOCOL_HYBRID, x224.RESTRICTED_ADMIN_MODE_REQUIRED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.RestrictedAdmin() || result.Negotiation.Flags != 0x09 {
+		t.Errorf("flags 0x%02x without restricted admin", result.Negotiation.Flags)
+	}
+
+	scanner := grdp.NewScanner()
+	scanner.NegotiationFlags = x224.RESTRICTED_ADMIN_MODE_REQUIRED
+	hosts := make(chan string, 1)
+	hosts <- srv.Addr()
+	close(hosts)
+	for result := range scanner.Scan(context.Background(), hosts, 1) {
+		if result.Err != nil || !result.RestrictedAdmin() {
+			t.Error(result.Err, result.Negotiation, "without restricted admin")
+		}
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	for _, session := range srv.Sessions() {
+		if session.RequestFlags != x224.RESTRICTED_ADMIN_MODE_REQUIRED {
+			t.Error(session.RequestFlags, "not equal to", x224.RESTRICTED_ADMIN_MODE_REQUIRED)
+		}
+	}
+}
+
+func TestProbeDowngrade(t *testing.T) {
+	legacy := []rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.StandardSecurityOnly(), rdptest.ExpectClose()}
+	tests := []struct {
+		name      string
+		scenarios [][]rdptest.Step
+		requested []uint32
+		failed    bool
+	}{
+		{"legacy", [][]rdptest.Step{legacy, legacy, legacy},
+			[]uint32{x224.PROTOCOL_HYBRID, x224.PROTOCOL_SSL, x224.PROTOCOL_RDP}, false},
+		{"nla", [][]rdptest.Step{
+			{rdptest.ReadConnectionRequest(), rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID), rdptest.ExpectClose()},
+		}, []uint32{x224.PROTOCOL_HYBRID}, false},
+		{"tls", [][]rdptest.Step{
+			{rdptest.ReadConnectionRequest(), rdptest.NegotiationFailure(x224.SSL_REQUIRED_BY_SERVER), rdptest.ExpectClose()},
+			{rdptest.ReadConnectionRequest(), rdptest.NegotiationResponse(x224.PROTOCOL_SSL), rdptest.ExpectClose()},
+		}, []uint32{x224.PROTOCOL_HYBRID, x224.PROTOCOL_SSL}, false},
+		// each level refused, the last failure is the result
+		{"refused", [][]rdptest.Step{
+			{rdptest.ReadConnectionRequest(), rdptest.NegotiationFailure(x224.SSL_CERT_NOT_ON_SERVER), rdptest.ExpectClose()},
+			{rdptest.ReadConnectionRequest(), rdptest.NegotiationFailure(x224.SSL_CERT_NOT_ON_SERVER), rdptest.ExpectClose()},
+			{rdptest.ReadConnectionRequest(), rdptest.NegotiationFailure(x224.SSL_REQUIRED_BY_SERVER), rdptest.ExpectClose()},
+		}, []uint32{x224.PROTOCOL_HYBRID, x224.PROTOCOL_SSL, x224.PROTOCOL_RDP}, true},
+		// an RDP 4.0 server ignores the request
+		{"rdp4", [][]rdptest.Step{
+			{rdptest.ReadConnectionRequest(), rdptest.ConfirmWithoutNegotiation(), rdptest.ExpectClose()},
+		}, []uint32{x224.PROTOCOL_HYBRID}, false},
+	}
+	for _, test := range tests {
+		srv, err := rdptest.NewServer(test.scenarios...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := grdp.ProbeDowngrade(context.Background(), srv.Addr())
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if err = srv.Wait(); err != nil {
+			t.Error(test.name, err)
+		}
+		last := test.requested[len(test.requested)-1]
+		if result.Requested != last || len(result.Downgrades) != len(test.requested)-1 || result.Negotiation.Failed() != test.failed {
+			t.Error(test.name, result.Requested, result.Downgrades, result.Negotiation)
+		}
+		for _, downgrade := range result.Downgrades {
+			if !downgrade.Failed() {
+				t.Error(test.name, downgrade, "not a failure")
+			}
+		}
+		for i, session := range srv.Sessions() {
+			if session.RequestedProtocols != test.requested[i] {
+				t.Error(test.name, i, session.RequestedProtocols, "not equal to", test.requested[i])
+			}
+		}
+	}
+}
+
+func TestScanDowngrade(t *testing.T) {
+	legacy := []rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.StandardSecurityOnly(), rdptest.ExpectClose()}
+	srv, err := rdptest.NewServer(legacy, legacy, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := x224.NewMemoryResultWriter()
+	scanner := grdp.NewScanner()
+	scanner.Strategy = grdp.NEGOTIATE_DOWNGRADE
+	scanner.Results = results
+	hosts := make(chan string, 1)
+	hosts <- srv.Addr()
+	close(hosts)
+	for result := range scanner.Scan(context.Background(), hosts, 1) {
+		if result.Err != nil || result.Attempts != 1 || result.SelectedProtocol() != x224.PROTOCOL_RDP || result.Negotiation.Failed() {
+			t.Error(result.Err, result.Attempts, result.Negotiation)
+		}
+		if len(result.Downgrades) != 2 || result.Downgrades[0].FailureCode != x224.SSL_NOT_ALLOWED_BY_SERVER {
+			t.Error(result.Downgrades)
+		}
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	// the answer that worked is recorded
+	if recorded, ok := results.Result(srv.Addr()); !ok || recorded.Failed() || recorded.SelectedProtocol != x224.PROTOCOL_RDP {
+		t.Error(recorded, ok)
+	}
+}
+
+func TestProbeDisconnect(t *testing.T) {
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.DisconnectRequest(x224.REASON_CONNECTION_REFUSED),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := grdp.Probe(context.Background(), srv.Addr(), x224.PROTOCOL_SSL)
+	var disconnect *grdp.DisconnectError
+	if !errors.As(err, &disconnect) || disconnect.Host != srv.Addr() || disconnect.Reason != x224.REASON_CONNECTION_REFUSED {
+		t.Error(err, "not equal to", x224.REASON_CONNECTION_REFUSED)
+	}
+	if result.Negotiated {
+		t.Error(result.Negotiation, "not equal to", "no negotiation")
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScanCookie(t *testing.T) {
+	srv, err := rdptest.NewServer(
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationResponse(x224.PROTOCOL_SSL), rdptest.ExpectClose()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grdp.NewScanner()
+	s.Cookie = "alice"
+	hosts := make(chan string, 1)
+	hosts <- srv.Addr()
+	close(hosts)
+	for result := range s.Scan(context.Background(), hosts, 1) {
+		if result.Err != nil {
+			t.Error(result.Err)
+		}
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	if cookie := srv.Sessions()[0].Cookie; cookie != "Cookie: mstshash=alice" {
+		t.Error(cookie, "not equal to", "Cookie: mstshash=alice")
+	}
+}
+
+func TestProbeContext(t *testing.T) {
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		// the server never confirms
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = grdp.Probe(ctx, srv.Addr(), x224.PROTOCOL_SSL); err != context.DeadlineExceeded {
+		t.Error(err, "not equal to", context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error(d, "longer than", time.Second)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckNLA(t *testing.T) {
+	tests := []struct {
+		name        string
+		ssl, hybrid rdptest.Step
+		expected    grdp.NLAMode
+	}{
+		{"enforced", rdptest.NegotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER), rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+			x224.NLA_ENFORCED},
+		{"optional", rdptest.NegotiationResponse(x224.PROTOCOL_SSL), rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+			x224.NLA_OPTIONAL},
+		{"tls only", rdptest.NegotiationResponse(x224.PROTOCOL_SSL), rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+			x224.NLA_NOT_SUPPORTED},
+		{"rdp 4.0", rdptest.ConfirmWithoutNegotiation(), rdptest.ConfirmWithoutNegotiation(),
+			x224.NLA_NOT_SUPPORTED},
+	}
+	for _, test := range tests {
+		srv, err := rdptest.NewServer(
+			[]rdptest.Step{rdptest.ReadConnectionRequest(), test.ssl, rdptest.ExpectClose()},
+			[]rdptest.Step{rdptest.ReadConnectionRequest(), test.hybrid, rdptest.ExpectClose()},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mode, err := grdp.CheckNLA(context.Background(), srv.Addr())
+		if err != nil || mode != test.expected {
+			t.Error(test.name, mode, err, "not equal to", test.expected)
+		}
+		if err = srv.Wait(); err != nil {
+			t.Error(test.name, err)
+		}
+		for i, protocols := range []uint32{x224.PROTOCOL_SSL, x224.PROTOCOL_HYBRID} {
+			if session := srv.Sessions()[i]; session.RequestedProtocols != protocols {
+				t.Error(test.name, i, session.RequestedProtocols, "not equal to", protocols)
+			}
+		}
+	}
+}
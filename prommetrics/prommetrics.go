@@ -0,0 +1,112 @@
+/**
+ * grdp.Metrics exposed to Prometheus. It is a package of its own so
+ * that the programs not using it do not link the Prometheus client
+ */
+package prommetrics
+
+import (
+	"time"
+
+	"github.com/icodeface/grdp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/**
+ * Names of the metrics, after the namespace given to New:
+ * probes_total{outcome}, open_connections,
+ * handshake_duration_seconds{phase}, errors_total{layer},
+ * tpkt_read_bytes_total and tpkt_written_bytes_total
+ */
+const (
+	PROBES_TOTAL               = "probes_total"
+	OPEN_CONNECTIONS           = "open_connections"
+	HANDSHAKE_DURATION_SECONDS = "handshake_duration_seconds"
+	ERRORS_TOTAL               = "errors_total"
+	TPKT_READ_BYTES_TOTAL      = "tpkt_read_bytes_total"
+	TPKT_WRITTEN_BYTES_TOTAL   = "tpkt_written_bytes_total"
+)
+
+// buckets of handshake_duration_seconds, from 5ms to 10s
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// a grdp.Metrics registered to a Prometheus registry
+type Metrics struct {
+	probes       *prometheus.CounterVec
+	open         prometheus.Gauge
+	durations    *prometheus.HistogramVec
+	errors       *prometheus.CounterVec
+	bytesRead    prometheus.Counter
+	bytesWritten prometheus.Counter
+}
+
+/**
+ * Metrics registered to reg, their names prefixed with namespace and
+ * "_" unless it is empty. It fails when reg has metrics of these names
+ */
+func New(reg prometheus.Registerer, namespace string) (*Metrics, error) {
+	m := &Metrics{
+		probes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      PROBES_TOTAL,
+			Help:      "Probes of the scans by outcome, after their retries.",
+		}, []string{"outcome"}),
+		open: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      OPEN_CONNECTIONS,
+			Help:      "Connections to the servers open now.",
+		}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      HANDSHAKE_DURATION_SECONDS,
+			Help:      "Duration of the phases of the connections.",
+			Buckets:   DurationBuckets,
+		}, []string{"phase"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      ERRORS_TOTAL,
+			Help:      "Connections failed by layer.",
+		}, []string{"layer"}),
+		bytesRead: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      TPKT_READ_BYTES_TOTAL,
+			Help:      "Bytes of the TPKT packets read, TLS excluded.",
+		}),
+		bytesWritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      TPKT_WRITTEN_BYTES_TOTAL,
+			Help:      "Bytes of the TPKT packets written, TLS excluded.",
+		}),
+	}
+	for _, c := range []prometheus.Collector{m.probes, m.open, m.durations, m.errors, m.bytesRead, m.bytesWritten} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Metrics) ProbeDone(outcome string) {
+	m.probes.WithLabelValues(outcome).Inc()
+}
+
+func (m *Metrics) ConnectionsOpen(delta int) {
+	m.open.Add(float64(delta))
+}
+
+func (m *Metrics) PhaseDuration(phase string, d time.Duration) {
+	m.durations.WithLabelValues(phase).Observe(d.Seconds())
+}
+
+func (m *Metrics) BytesRead(n int) {
+	m.bytesRead.Add(float64(n))
+}
+
+func (m *Metrics) BytesWritten(n int) {
+	m.bytesWritten.Add(float64(n))
+}
+
+func (m *Metrics) Error(layer string) {
+	m.errors.WithLabelValues(layer).Inc()
+}
+
+var _ grdp.Metrics = (*Metrics)(nil)
@@ -0,0 +1,100 @@
+package prommetrics_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp"
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/prommetrics"
+	"github.com/icodeface/grdp/protocol/x224"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// the metrics page of reg, as a Prometheus server reads it
+func scrape(t *testing.T, reg *prometheus.Registry) string {
+	srv := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestScrape(t *testing.T) {
+	srv, err := rdptest.NewServer(
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationResponse(x224.PROTOCOL_SSL), rdptest.ExpectClose()},
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER), rdptest.ExpectClose()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := l.Addr().String()
+	l.Close()
+
+	reg := prometheus.NewRegistry()
+	m, err := prommetrics.New(reg, "rdpscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := grdp.NewScanner()
+	scanner.Metrics = m
+	scanner.Timeout = 5 * time.Second
+	hosts := make(chan string, 3)
+	hosts <- srv.Addr()
+	hosts <- srv.Addr()
+	hosts <- refused
+	close(hosts)
+	for range scanner.Scan(context.Background(), hosts, 1) {
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+
+	page := scrape(t, reg)
+	for _, line := range []string{
+		`rdpscan_probes_total{outcome="negotiated"} 1`,
+		`rdpscan_probes_total{outcome="negotiation_failure"} 1`,
+		`rdpscan_probes_total{outcome="error"} 1`,
+		`rdpscan_open_connections 0`,
+		`rdpscan_handshake_duration_seconds_count{phase="dial"} 3`,
+		`rdpscan_handshake_duration_seconds_count{phase="x224"} 2`,
+		`rdpscan_errors_total{layer="dial"} 1`,
+		`rdpscan_tpkt_read_bytes_total 38`,
+		`rdpscan_tpkt_written_bytes_total 38`,
+	} {
+		if !strings.Contains(page, line+"\n") {
+			t.Error(line, "not in", page)
+		}
+	}
+}
+
+func TestNewRegistered(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if _, err := prommetrics.New(reg, ""); err != nil {
+		t.Fatal(err)
+	}
+	// the names are taken
+	if _, err := prommetrics.New(reg, ""); err == nil {
+		t.Error("registered twice")
+	}
+	if _, err := prommetrics.New(reg, "other"); err != nil {
+		t.Error(err)
+	}
+}
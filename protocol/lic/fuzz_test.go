@@ -0,0 +1,28 @@
+//go:build go1.18
+// +build go1.18
+
+package lic_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/icodeface/grdp/internal/fuzztest"
+	"github.com/icodeface/grdp/protocol/lic"
+	"testing"
+)
+
+func FuzzLicensePacket(f *testing.F) {
+	f.Add(packet(licenseRequest...))
+	f.Add(packet("02032600", "00000000", "00000a00", "0102030405060708090a", "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf"))
+	f.Add(packet("03031c00", "09000400", "01020304", "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf"))
+	b, _ := hex.DecodeString("ff031000070000000200000004000000")
+	f.Add(b)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzztest.Check(t, func() {
+			p, err := lic.ReadLicensePacket(bytes.NewReader(data))
+			if err == nil && p.LicensingMessage == nil {
+				t.Error("no licensing message")
+			}
+		})
+	})
+}
@@ -1,8 +1,12 @@
 package lic
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/icodeface/grdp/core"
 	"io"
+	"unicode/utf16"
 )
 
 const (
@@ -16,6 +20,25 @@ const (
 	ERROR_ALERT                 = 0xFF
 )
 
+// binary blob type
+const (
+	BB_ANY_BLOB                 = 0x0000
+	BB_DATA_BLOB                = 0x0001
+	BB_RANDOM_BLOB              = 0x0002
+	BB_CERTIFICATE_BLOB         = 0x0003
+	BB_ERROR_BLOB               = 0x0004
+	BB_ENCRYPTED_DATA_BLOB      = 0x0009
+	BB_KEY_EXCHG_ALG_BLOB       = 0x000D
+	BB_SCOPE_BLOB               = 0x000E
+	BB_CLIENT_USER_NAME_BLOB    = 0x000F
+	BB_CLIENT_MACHINE_NAME_BLOB = 0x0010
+)
+
+// key exchange algorithm
+const (
+	KEY_EXCHANGE_ALG_RSA = 0x00000001
+)
+
 // error code
 const (
 	ERR_INVALID_SERVER_CERTIFICATE = 0x00000001
@@ -37,17 +60,336 @@ const (
 	ST_RESEND_LAST_MESSAGE  = 0x00000004
 )
 
+// name of an error code, its hex value when unknown
+func ErrorCodeName(code uint32) string {
+	switch code {
+	case ERR_INVALID_SERVER_CERTIFICATE:
+		return "ERR_INVALID_SERVER_CERTIFICATE"
+	case ERR_NO_LICENSE:
+		return "ERR_NO_LICENSE"
+	case ERR_INVALID_MAC:
+		return "ERR_INVALID_MAC"
+	case ERR_INVALID_SCOPE:
+		return "ERR_INVALID_SCOPE"
+	case ERR_NO_LICENSE_SERVER:
+		return "ERR_NO_LICENSE_SERVER"
+	case STATUS_VALID_CLIENT:
+		return "STATUS_VALID_CLIENT"
+	case ERR_INVALID_CLIENT:
+		return "ERR_INVALID_CLIENT"
+	case ERR_INVALID_PRODUCTID:
+		return "ERR_INVALID_PRODUCTID"
+	case ERR_INVALID_MESSAGE_LEN:
+		return "ERR_INVALID_MESSAGE_LEN"
+	}
+	return fmt.Sprintf("0x%08x", code)
+}
+
+// name of a state transition, its hex value when unknown
+func StateTransitionName(st uint32) string {
+	switch st {
+	case ST_TOTAL_ABORT:
+		return "ST_TOTAL_ABORT"
+	case ST_NO_TRANSITION:
+		return "ST_NO_TRANSITION"
+	case ST_RESET_PHASE_TO_START:
+		return "ST_RESET_PHASE_TO_START"
+	case ST_RESEND_LAST_MESSAGE:
+		return "ST_RESEND_LAST_MESSAGE"
+	}
+	return fmt.Sprintf("0x%08x", st)
+}
+
+/**
+ * @see MS-RDPBCGR LICENSE_ERROR_MESSAGE
+ */
 type ErrorMessage struct {
 	DwErrorCode        uint32
 	DwStateTransaction uint32
-	Blob               []byte
+	// bbErrorInfo, nil when the server left it out
+	Blob *LicenseBinaryBlob
+}
+
+// the server accepted the client without issuing a license
+func (m *ErrorMessage) ValidClient() bool {
+	return m.DwErrorCode == STATUS_VALID_CLIENT && m.DwStateTransaction == ST_NO_TRANSITION
+}
+
+// "ERR_NO_LICENSE_SERVER (ST_TOTAL_ABORT)"
+func (m *ErrorMessage) String() string {
+	return fmt.Sprintf("%s (%s)", ErrorCodeName(m.DwErrorCode), StateTransitionName(m.DwStateTransaction))
+}
+
+// the license exchange failed, test with errors.Is
+var ErrLicense = errors.New("license exchange failed")
+
+/**
+ * Failure of the license exchange, errors.Is matches ErrLicense.
+ * Message is the licensing error sent by the server before, if any
+ */
+type LicenseError struct {
+	Message *ErrorMessage
+	Err     error
+}
+
+func (e *LicenseError) Error() string {
+	if e.Message == nil {
+		return fmt.Sprintf("%v: %v", ErrLicense, e.Err)
+	}
+	return fmt.Sprintf("%v: %v: %v", ErrLicense, e.Message, e.Err)
+}
+
+func (e *LicenseError) Is(target error) bool {
+	return target == ErrLicense
+}
+
+func (e *LicenseError) Unwrap() error {
+	return e.Err
 }
 
-func readErrorMessage(r io.Reader) *ErrorMessage {
+func readErrorMessage(r *bytes.Reader) (*ErrorMessage, error) {
 	m := &ErrorMessage{}
-	m.DwErrorCode, _ = core.ReadUInt32LE(r)
-	m.DwStateTransaction, _ = core.ReadUInt32LE(r)
-	return m
+	var err error
+	if m.DwErrorCode, err = core.ReadUInt32LE(r); err != nil {
+		return nil, err
+	}
+	if m.DwStateTransaction, err = core.ReadUInt32LE(r); err != nil {
+		return nil, err
+	}
+	if r.Len() == 0 {
+		return m, nil
+	}
+	if m.Blob, err = readLicenseBinaryBlob(r, BB_ERROR_BLOB); err != nil {
+		return nil, fmt.Errorf("error info: %w", err)
+	}
+	return m, nil
+}
+
+// name of a bMsgType, its hex value when unknown
+func MessageTypeName(t uint8) string {
+	switch t {
+	case LICENSE_REQUEST:
+		return "LICENSE_REQUEST"
+	case PLATFORM_CHALLENGE:
+		return "PLATFORM_CHALLENGE"
+	case NEW_LICENSE:
+		return "NEW_LICENSE"
+	case UPGRADE_LICENSE:
+		return "UPGRADE_LICENSE"
+	case LICENSE_INFO:
+		return "LICENSE_INFO"
+	case NEW_LICENSE_REQUEST:
+		return "NEW_LICENSE_REQUEST"
+	case PLATFORM_CHALLENGE_RESPONSE:
+		return "PLATFORM_CHALLENGE_RESPONSE"
+	case ERROR_ALERT:
+		return "ERROR_ALERT"
+	}
+	return fmt.Sprintf("0x%02x", t)
+}
+
+// n bytes of r, the length comes from the packet and is checked first
+func readBytes(r *bytes.Reader, n int) ([]byte, error) {
+	if n > r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return core.ReadBytes(n, r)
+}
+
+/**
+ * @see MS-RDPBCGR LICENSE_BINARY_BLOB
+ */
+type LicenseBinaryBlob struct {
+	WBlobType uint16
+	WBlobLen  uint16
+	BlobData  []byte
+}
+
+// blobType is checked unless BB_ANY_BLOB, servers send empty blobs of any type
+func readLicenseBinaryBlob(r *bytes.Reader, blobType uint16) (*LicenseBinaryBlob, error) {
+	b := &LicenseBinaryBlob{}
+	var err error
+	if b.WBlobType, err = core.ReadUint16LE(r); err != nil {
+		return nil, err
+	}
+	if b.WBlobLen, err = core.ReadUint16LE(r); err != nil {
+		return nil, err
+	}
+	if blobType != BB_ANY_BLOB && b.WBlobLen != 0 && b.WBlobType != blobType {
+		return nil, fmt.Errorf("blob type 0x%04x, expected 0x%04x", b.WBlobType, blobType)
+	}
+	if b.BlobData, err = readBytes(r, int(b.WBlobLen)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+/**
+ * @see MS-RDPELE PRODUCT_INFO
+ */
+type ProductInfo struct {
+	DwVersion     uint32
+	CbCompanyName uint32
+	PbCompanyName []byte
+	CbProductId   uint32
+	PbProductId   []byte
+}
+
+// null terminated UTF-16LE
+func decodeUnicode(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := uint16(b[i]) | uint16(b[i+1])<<8
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+func (p *ProductInfo) CompanyName() string {
+	return decodeUnicode(p.PbCompanyName)
+}
+
+func (p *ProductInfo) ProductId() string {
+	return decodeUnicode(p.PbProductId)
+}
+
+func readProductInfo(r *bytes.Reader) (*ProductInfo, error) {
+	p := &ProductInfo{}
+	var err error
+	if p.DwVersion, err = core.ReadUInt32LE(r); err != nil {
+		return nil, err
+	}
+	if p.CbCompanyName, err = core.ReadUInt32LE(r); err != nil {
+		return nil, err
+	}
+	if p.CbCompanyName > uint32(r.Len()) {
+		return nil, fmt.Errorf("company name length %d: %w", p.CbCompanyName, io.ErrUnexpectedEOF)
+	}
+	if p.PbCompanyName, err = readBytes(r, int(p.CbCompanyName)); err != nil {
+		return nil, err
+	}
+	if p.CbProductId, err = core.ReadUInt32LE(r); err != nil {
+		return nil, err
+	}
+	if p.CbProductId > uint32(r.Len()) {
+		return nil, fmt.Errorf("product id length %d: %w", p.CbProductId, io.ErrUnexpectedEOF)
+	}
+	if p.PbProductId, err = readBytes(r, int(p.CbProductId)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+/**
+ * @see MS-RDPELE SERVER_LICENSE_REQUEST
+ */
+type ServerLicenseRequest struct {
+	ServerRandom      []byte
+	ProductInfo       *ProductInfo
+	KeyExchangeList   *LicenseBinaryBlob
+	ServerCertificate *LicenseBinaryBlob
+	ScopeList         []*LicenseBinaryBlob
+}
+
+// key exchange algorithms of the KeyExchangeList, KEY_EXCHANGE_ALG_RSA...
+func (m *ServerLicenseRequest) KeyExchangeAlgorithms() []uint32 {
+	r := bytes.NewReader(m.KeyExchangeList.BlobData)
+	var algs []uint32
+	for r.Len() >= 4 {
+		alg, _ := core.ReadUInt32LE(r)
+		algs = append(algs, alg)
+	}
+	return algs
+}
+
+// issuers of the ScopeList, null terminated ANSI strings
+func (m *ServerLicenseRequest) Scopes() []string {
+	scopes := make([]string, 0, len(m.ScopeList))
+	for _, b := range m.ScopeList {
+		scopes = append(scopes, string(bytes.TrimRight(b.BlobData, "\x00")))
+	}
+	return scopes
+}
+
+func readServerLicenseRequest(r *bytes.Reader) (*ServerLicenseRequest, error) {
+	m := &ServerLicenseRequest{}
+	var err error
+	if m.ServerRandom, err = readBytes(r, 32); err != nil {
+		return nil, fmt.Errorf("server random: %w", err)
+	}
+	if m.ProductInfo, err = readProductInfo(r); err != nil {
+		return nil, fmt.Errorf("product info: %w", err)
+	}
+	if m.KeyExchangeList, err = readLicenseBinaryBlob(r, BB_KEY_EXCHG_ALG_BLOB); err != nil {
+		return nil, fmt.Errorf("key exchange list: %w", err)
+	}
+	if m.ServerCertificate, err = readLicenseBinaryBlob(r, BB_CERTIFICATE_BLOB); err != nil {
+		return nil, fmt.Errorf("server certificate: %w", err)
+	}
+	scopeCount, err := core.ReadUInt32LE(r)
+	if err != nil {
+		return nil, fmt.Errorf("scope count: %w", err)
+	}
+	// a scope takes 4 bytes at least
+	if scopeCount > uint32(r.Len()/4) {
+		return nil, fmt.Errorf("scope count %d: %w", scopeCount, io.ErrUnexpectedEOF)
+	}
+	for i := uint32(0); i < scopeCount; i++ {
+		scope, err := readLicenseBinaryBlob(r, BB_SCOPE_BLOB)
+		if err != nil {
+			return nil, fmt.Errorf("scope %d: %w", i, err)
+		}
+		m.ScopeList = append(m.ScopeList, scope)
+	}
+	return m, nil
+}
+
+/**
+ * @see MS-RDPELE SERVER_PLATFORM_CHALLENGE
+ */
+type ServerPlatformChallenge struct {
+	ConnectFlags               uint32
+	EncryptedPlatformChallenge *LicenseBinaryBlob
+	MACData                    []byte
+}
+
+func readServerPlatformChallenge(r *bytes.Reader) (*ServerPlatformChallenge, error) {
+	m := &ServerPlatformChallenge{}
+	var err error
+	if m.ConnectFlags, err = core.ReadUInt32LE(r); err != nil {
+		return nil, fmt.Errorf("connect flags: %w", err)
+	}
+	if m.EncryptedPlatformChallenge, err = readLicenseBinaryBlob(r, BB_ANY_BLOB); err != nil {
+		return nil, fmt.Errorf("encrypted platform challenge: %w", err)
+	}
+	if m.MACData, err = readBytes(r, 16); err != nil {
+		return nil, fmt.Errorf("mac data: %w", err)
+	}
+	return m, nil
+}
+
+/**
+ * NEW_LICENSE and UPGRADE_LICENSE
+ * @see MS-RDPELE SERVER_NEW_LICENSE
+ */
+type ServerNewLicense struct {
+	EncryptedLicenseInfo *LicenseBinaryBlob
+	MACData              []byte
+}
+
+func readServerNewLicense(r *bytes.Reader) (*ServerNewLicense, error) {
+	m := &ServerNewLicense{}
+	var err error
+	if m.EncryptedLicenseInfo, err = readLicenseBinaryBlob(r, BB_ENCRYPTED_DATA_BLOB); err != nil {
+		return nil, fmt.Errorf("encrypted license info: %w", err)
+	}
+	if m.MACData, err = readBytes(r, 16); err != nil {
+		return nil, fmt.Errorf("mac data: %w", err)
+	}
+	return m, nil
 }
 
 type LicensePacket struct {
@@ -57,17 +399,41 @@ type LicensePacket struct {
 	LicensingMessage interface{}
 }
 
-func ReadLicensePacket(r io.Reader) *LicensePacket {
+func ReadLicensePacket(r io.Reader) (*LicensePacket, error) {
 	l := &LicensePacket{}
-	l.BMsgtype, _ = core.ReadUInt8(r)
-	l.Flag, _ = core.ReadUInt8(r)
-	l.WMsgSize, _ = core.ReadUint16LE(r)
+	var err error
+	if l.BMsgtype, err = core.ReadUInt8(r); err != nil {
+		return nil, err
+	}
+	if l.Flag, err = core.ReadUInt8(r); err != nil {
+		return nil, err
+	}
+	if l.WMsgSize, err = core.ReadUint16LE(r); err != nil {
+		return nil, err
+	}
+	if l.WMsgSize < 4 {
+		return nil, fmt.Errorf("license packet bad size %d", l.WMsgSize)
+	}
 
+	body, err := core.ReadBytes(int(l.WMsgSize-4), r)
+	if err != nil {
+		return nil, err
+	}
+	br := bytes.NewReader(body)
 	switch l.BMsgtype {
 	case ERROR_ALERT:
-		l.LicensingMessage = readErrorMessage(r)
+		l.LicensingMessage, err = readErrorMessage(br)
+	case LICENSE_REQUEST:
+		l.LicensingMessage, err = readServerLicenseRequest(br)
+	case PLATFORM_CHALLENGE:
+		l.LicensingMessage, err = readServerPlatformChallenge(br)
+	case NEW_LICENSE, UPGRADE_LICENSE:
+		l.LicensingMessage, err = readServerNewLicense(br)
 	default:
-		l.LicensingMessage, _ = core.ReadBytes(int(l.WMsgSize-4), r)
+		l.LicensingMessage = body
+	}
+	if err != nil {
+		return nil, fmt.Errorf("license %s: %w", MessageTypeName(l.BMsgtype), err)
 	}
-	return l
+	return l, nil
 }
@@ -0,0 +1,180 @@
+package lic_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/icodeface/grdp/protocol/lic"
+	"io"
+	"strings"
+	"testing"
+)
+
+// fields of a packet in hex
+func packet(fields ...string) []byte {
+	b, err := hex.DecodeString(strings.Join(fields, ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// SERVER_LICENSE_REQUEST with the fields MS-RDPELE describes,
+// with a shorter company name and product id
+var licenseRequest = []string{
+	"01036000",
+	// server random
+	"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+	// product info, version 6.0, "MS" and "A02"
+	"00000600", "06000000", "4d0053000000", "08000000", "4100300032000000",
+	// key exchange list, RSA
+	"0d000400", "01000000",
+	// server certificate, empty with TLS
+	"03000000",
+	// scope list, "microsoft.com"
+	"01000000", "0e000e00", "6d6963726f736f66742e636f6d00",
+}
+
+func TestReadLicensePacket(t *testing.T) {
+	b, _ := hex.DecodeString("ff031000070000000200000004000000")
+	p, err := lic.ReadLicensePacket(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, ok := p.LicensingMessage.(*lic.ErrorMessage)
+	if p.BMsgtype != lic.ERROR_ALERT || !ok || !message.ValidClient() || message.Blob == nil {
+		t.Error(p, "not equal to", "STATUS_VALID_CLIENT ST_NO_TRANSITION")
+	}
+}
+
+func TestErrorMessageString(t *testing.T) {
+	// without the optional error info
+	b := packet("ff030c00", "06000000", "01000000")
+	p, err := lic.ReadLicensePacket(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := p.LicensingMessage.(*lic.ErrorMessage)
+	if s := message.String(); s != "ERR_NO_LICENSE_SERVER (ST_TOTAL_ABORT)" {
+		t.Error(s, "not equal to", "ERR_NO_LICENSE_SERVER (ST_TOTAL_ABORT)")
+	}
+	if message.ValidClient() || message.Blob != nil {
+		t.Error(message, "not equal to", "invalid client without error info")
+	}
+
+	b = packet("ff031300", "0b000000", "05000000", "04000300", "414243")
+	p, err = lic.ReadLicensePacket(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message = p.LicensingMessage.(*lic.ErrorMessage)
+	if s := message.String(); s != "ERR_INVALID_PRODUCTID (0x00000005)" {
+		t.Error(s, "not equal to", "ERR_INVALID_PRODUCTID (0x00000005)")
+	}
+	if string(message.Blob.BlobData) != "ABC" {
+		t.Error(message.Blob.BlobData, "not equal to", "ABC")
+	}
+}
+
+func TestReadLicensePacketTruncated(t *testing.T) {
+	inputs := []string{
+		"",
+		"ff03",
+		"ff031000070000",
+		"0203100001020304",
+	}
+	for _, input := range inputs {
+		b, _ := hex.DecodeString(input)
+		if _, err := lic.ReadLicensePacket(bytes.NewReader(b)); err != io.ErrUnexpectedEOF {
+			t.Error(input, err, "not equal to", io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestReadServerLicenseRequest(t *testing.T) {
+	p, err := lic.ReadLicensePacket(bytes.NewReader(packet(licenseRequest...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := p.LicensingMessage.(*lic.ServerLicenseRequest)
+	if !ok {
+		t.Fatal(p.LicensingMessage, "not equal to", "*lic.ServerLicenseRequest")
+	}
+	if len(m.ServerRandom) != 32 || m.ServerRandom[31] != 0x1f {
+		t.Error(m.ServerRandom, "not equal to", "000102...1f")
+	}
+	if m.ProductInfo.DwVersion != 0x00060000 || m.ProductInfo.CompanyName() != "MS" || m.ProductInfo.ProductId() != "A02" {
+		t.Error(m.ProductInfo, "not equal to", "6.0 MS A02")
+	}
+	if algs := m.KeyExchangeAlgorithms(); len(algs) != 1 || algs[0] != lic.KEY_EXCHANGE_ALG_RSA {
+		t.Error(algs, "not equal to", []uint32{lic.KEY_EXCHANGE_ALG_RSA})
+	}
+	if m.ServerCertificate.WBlobLen != 0 {
+		t.Error(m.ServerCertificate.WBlobLen, "not equal to", 0)
+	}
+	if scopes := m.Scopes(); len(scopes) != 1 || scopes[0] != "microsoft.com" {
+		t.Error(scopes, "not equal to", []string{"microsoft.com"})
+	}
+}
+
+func TestReadServerPlatformChallenge(t *testing.T) {
+	b := packet("02032600", "00000000",
+		// encrypted challenge
+		"00000a00", "0102030405060708090a",
+		// mac
+		"a0a1a2a3a4a5a6a7a8a9aaabacadaeaf")
+	p, err := lic.ReadLicensePacket(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := p.LicensingMessage.(*lic.ServerPlatformChallenge)
+	if !ok {
+		t.Fatal(p.LicensingMessage, "not equal to", "*lic.ServerPlatformChallenge")
+	}
+	if len(m.EncryptedPlatformChallenge.BlobData) != 10 || len(m.MACData) != 16 || m.MACData[15] != 0xaf {
+		t.Error(m, "not equal to", "10 bytes challenge, 16 bytes mac")
+	}
+}
+
+func TestReadServerNewLicense(t *testing.T) {
+	for _, msgType := range []string{"03", "04"} {
+		b := packet(msgType, "031c00",
+			"09000400", "01020304",
+			"a0a1a2a3a4a5a6a7a8a9aaabacadaeaf")
+		p, err := lic.ReadLicensePacket(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, ok := p.LicensingMessage.(*lic.ServerNewLicense)
+		if !ok {
+			t.Fatal(p.LicensingMessage, "not equal to", "*lic.ServerNewLicense")
+		}
+		if !bytes.Equal(m.EncryptedLicenseInfo.BlobData, []byte{1, 2, 3, 4}) || len(m.MACData) != 16 {
+			t.Error(m, "not equal to", "01020304, 16 bytes mac")
+		}
+	}
+}
+
+func TestReadLicensePacketBadBody(t *testing.T) {
+	bad := append([]string{}, licenseRequest...)
+	// company name longer than the packet
+	bad[3] = "ff000000"
+	_, err := lic.ReadLicensePacket(bytes.NewReader(packet(bad...)))
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), "LICENSE_REQUEST") {
+		t.Error(err, "not equal to", "LICENSE_REQUEST unexpected EOF")
+	}
+
+	bad = append([]string{}, licenseRequest...)
+	// certificate blob as key exchange list
+	bad[7] = "03000400"
+	_, err = lic.ReadLicensePacket(bytes.NewReader(packet(bad...)))
+	if err == nil || !strings.Contains(err.Error(), "LICENSE_REQUEST: key exchange list") {
+		t.Error(err, "not equal to", "LICENSE_REQUEST: key exchange list")
+	}
+
+	// mac cut, the packet size matches the body
+	_, err = lic.ReadLicensePacket(bytes.NewReader(packet("03031800", "09000400", "01020304", "a0a1a2a3a4a5a6a7a8a9aaab")))
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), "NEW_LICENSE: mac data") {
+		t.Error(err, "not equal to", "NEW_LICENSE: mac data unexpected EOF")
+	}
+}
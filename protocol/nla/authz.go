@@ -0,0 +1,67 @@
+package nla
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/**
+ * authorizationResult of the Early User Authorization Result PDU, sent
+ * by the server after CredSSP when it selected PROTOCOL_HYBRID_EX
+ * @see MS-RDPBCGR 2.2.10.2
+ */
+const (
+	AUTHZ_SUCCESS       = 0x00000000
+	AUTHZ_ACCESS_DENIED = 0x00000005
+)
+
+// the credentials were accepted but the user may not log on, test with errors.Is
+var ErrAuthorizationDenied = errors.New("early user authorization denied")
+
+/**
+ * The Early User Authorization Result was not AUTHZ_SUCCESS: the user
+ * authenticated but is not allowed a remote session, errors.Is matches
+ * ErrAuthorizationDenied
+ */
+type AuthorizationError struct {
+	Result uint32
+}
+
+func (e *AuthorizationError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrAuthorizationDenied, AuthorizationResultName(e.Result))
+}
+
+func (e *AuthorizationError) Is(target error) bool {
+	return target == ErrAuthorizationDenied
+}
+
+func AuthorizationResultName(result uint32) string {
+	switch result {
+	case AUTHZ_SUCCESS:
+		return "AUTHZ_SUCCESS"
+	case AUTHZ_ACCESS_DENIED:
+		return "AUTHZ_ACCESS_DENIED"
+	}
+	return fmt.Sprintf("0x%08x", result)
+}
+
+/**
+ * Read the Early User Authorization Result PDU that follows CredSSP
+ * with PROTOCOL_HYBRID_EX, 4 bytes over TLS. nil for AUTHZ_SUCCESS, an
+ * *AuthorizationError for any other result
+ */
+func RecvEarlyUserAuthResult(r io.Reader) error {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("early user authorization result: %w", err)
+	}
+	if result := binary.LittleEndian.Uint32(b); result != AUTHZ_SUCCESS {
+		return &AuthorizationError{result}
+	}
+	return nil
+}
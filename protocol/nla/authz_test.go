@@ -0,0 +1,31 @@
+package nla_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/icodeface/grdp/protocol/nla"
+)
+
+func TestRecvEarlyUserAuthResult(t *testing.T) {
+	if err := nla.RecvEarlyUserAuthResult(bytes.NewReader([]byte{0, 0, 0, 0})); err != nil {
+		t.Error(err)
+	}
+
+	err := nla.RecvEarlyUserAuthResult(bytes.NewReader([]byte{5, 0, 0, 0}))
+	var authz *nla.AuthorizationError
+	if !errors.Is(err, nla.ErrAuthorizationDenied) || !errors.As(err, &authz) || authz.Result != nla.AUTHZ_ACCESS_DENIED {
+		t.Error(err, "not equal to", nla.ErrAuthorizationDenied)
+	}
+	if expected := "early user authorization denied: AUTHZ_ACCESS_DENIED"; err.Error() != expected {
+		t.Error(err.Error(), "not equal to", expected)
+	}
+
+	// the server closed the connection instead of answering
+	err = nla.RecvEarlyUserAuthResult(bytes.NewReader([]byte{0, 0}))
+	if !errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, nla.ErrAuthorizationDenied) {
+		t.Error(err, "not equal to", io.ErrUnexpectedEOF)
+	}
+}
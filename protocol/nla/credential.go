@@ -0,0 +1,26 @@
+package nla
+
+import (
+	"strings"
+)
+
+/**
+ * Split a logon name into domain and user, DOMAIN\user and user@domain are accepted.
+ * The domain is empty for a bare user name or the local machine form .\user
+ */
+func ParseCredentialName(s string) (domain, user string) {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "\\"); i >= 0 {
+		domain = s[:i]
+		// shell escaped DOMAIN\\user
+		user = strings.TrimLeft(s[i:], "\\")
+		if domain == "." {
+			domain = ""
+		}
+		return domain, user
+	}
+	if i := strings.LastIndex(s, "@"); i > 0 && i < len(s)-1 {
+		return s[i+1:], s[:i]
+	}
+	return "", s
+}
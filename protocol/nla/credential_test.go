@@ -0,0 +1,36 @@
+package nla_test
+
+import (
+	"testing"
+
+	"github.com/icodeface/grdp/protocol/nla"
+)
+
+func TestParseCredentialName(t *testing.T) {
+	cases := []struct {
+		name   string
+		domain string
+		user   string
+	}{
+		{"alice", "", "alice"},
+		{"CORP\\alice", "CORP", "alice"},
+		{"CORP\\\\alice", "CORP", "alice"},
+		{"corp.local\\alice", "corp.local", "alice"},
+		{".\\admin", "", "admin"},
+		{"\\alice", "", "alice"},
+		{"alice@corp.local", "corp.local", "alice"},
+		{"alice.smith@eu.corp.local", "eu.corp.local", "alice.smith"},
+		{"a@b@corp.local", "corp.local", "a@b"},
+		{"CORP\\alice@corp.local", "CORP", "alice@corp.local"},
+		{"alice@", "", "alice@"},
+		{"@corp.local", "", "@corp.local"},
+		{"  CORP\\alice ", "CORP", "alice"},
+		{"", "", ""},
+	}
+	for _, c := range cases {
+		domain, user := nla.ParseCredentialName(c.name)
+		if domain != c.domain || user != c.user {
+			t.Errorf("%q: %q %q not equal to %q %q", c.name, domain, user, c.domain, c.user)
+		}
+	}
+}
@@ -1,26 +1,74 @@
 package nla
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
 	"github.com/icodeface/grdp/glog"
 )
 
+var (
+	ErrRestrictedAdminRejected = errors.New("restricted admin rejected")
+	ErrServerAuthFailed        = errors.New("server authentication failed")
+)
+
+// highest CredSSP version supported, 5 and above bind pubKeyAuth with the client nonce
+const CREDSSP_VERSION = 6
+
+/**
+ * pubKeyAuth hash magic of CredSSP version 5 and above
+ * @see https://msdn.microsoft.com/en-us/library/cc226791.aspx
+ */
+const (
+	CLIENT_SERVER_HASH_MAGIC = "CredSSP Client-To-Server Binding Hash\x00"
+	SERVER_CLIENT_HASH_MAGIC = "CredSSP Server-To-Client Binding Hash\x00"
+)
+
 type NegoToken struct {
 	Data []byte `asn1:"explicit,tag:0"`
 }
 
 type TSRequest struct {
-	Version    int         `asn1:"explicit,tag:0"`
-	NegoTokens []NegoToken `asn1:"optional,explicit,tag:1"`
-	AuthInfo   string      `asn1:"optional,explicit,tag:2"`
-	PubKeyAuth string      `asn1:"optional,explicit,tag:3"`
-	ErrorCode  int         `asn1:"optional,explicit,tag:4"`
+	Version     int         `asn1:"explicit,tag:0"`
+	NegoTokens  []NegoToken `asn1:"optional,explicit,tag:1"`
+	AuthInfo    []byte      `asn1:"optional,explicit,tag:2"`
+	PubKeyAuth  []byte      `asn1:"optional,explicit,tag:3"`
+	ErrorCode   int         `asn1:"optional,explicit,tag:4"`
+	ClientNonce []byte      `asn1:"optional,explicit,tag:5"`
 }
 
+/**
+ * TSCredentials credType
+ * @see https://msdn.microsoft.com/en-us/library/cc226784.aspx
+ */
+const (
+	TS_PASSWORD_CREDS    = 1
+	TS_SMARTCARD_CREDS   = 2
+	TS_REMOTEGUARD_CREDS = 6
+)
+
+/**
+ * @see https://msdn.microsoft.com/en-us/library/cc226784.aspx
+ */
 type TSCredentials struct {
+	CredType    int    `asn1:"explicit,tag:0"`
+	Credentials []byte `asn1:"explicit,tag:1"`
 }
 
+/**
+ * @see https://msdn.microsoft.com/en-us/library/cc226785.aspx
+ */
 type TSPasswordCreds struct {
+	DomainName []byte `asn1:"explicit,tag:0"`
+	UserName   []byte `asn1:"explicit,tag:1"`
+	Password   []byte `asn1:"explicit,tag:2"`
 }
 
 type TSCspDataDetail struct {
@@ -44,11 +92,11 @@ func EncodeDERTRequest(msgs []Message, authInfo string, pubKeyAuth string) []byt
 	}
 
 	if len(authInfo) > 0 {
-		// todo
+		req.AuthInfo = []byte(authInfo)
 	}
 
 	if len(pubKeyAuth) > 0 {
-		// todo
+		req.PubKeyAuth = []byte(pubKeyAuth)
 	}
 
 	result, err := asn1.Marshal(req)
@@ -63,3 +111,322 @@ func DecodeDERTRequest(s []byte) (*TSRequest, error) {
 	_, err := asn1.Unmarshal(s, treq)
 	return treq, err
 }
+
+/**
+ * domain, user and password are UTF-16LE, every field is an OCTET STRING
+ * inside its explicit context tag, a nil one is an empty OCTET STRING
+ */
+func EncodeDERTCredentials(domain, user, password []byte) []byte {
+	passwordCreds, err := asn1.Marshal(TSPasswordCreds{domain, user, password})
+	if err != nil {
+		glog.Error(err)
+	}
+	result, err := asn1.Marshal(TSCredentials{TS_PASSWORD_CREDS, passwordCreds})
+	if err != nil {
+		glog.Error(err)
+	}
+	return result
+}
+
+func DecodeDERTCredentials(s []byte) (*TSPasswordCreds, error) {
+	creds := &TSCredentials{}
+	if rest, err := asn1.Unmarshal(s, creds); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after TSCredentials")
+	}
+	if creds.CredType != TS_PASSWORD_CREDS {
+		return nil, fmt.Errorf("unsupported credType %d", creds.CredType)
+	}
+	passwordCreds := &TSPasswordCreds{}
+	if rest, err := asn1.Unmarshal(creds.Credentials, passwordCreds); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after TSPasswordCreds")
+	}
+	return passwordCreds, nil
+}
+
+// SHA256(magic || nonce || SubjectPublicKey)
+func PubKeyAuthHash(magic string, nonce, pubKey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(magic))
+	h.Write(nonce)
+	h.Write(pubKey)
+	return h.Sum(nil)
+}
+
+/**
+ * The server proves it owns the TLS key by echoing the public key,
+ * incremented by one before version 5, hashed with the client nonce after
+ */
+func VerifyServerPubKeyAuth(version int, nonce, pubKey, pubKeyAuth []byte) error {
+	var expected []byte
+	if version >= 5 && len(nonce) > 0 {
+		expected = PubKeyAuthHash(SERVER_CLIENT_HASH_MAGIC, nonce, pubKey)
+	} else {
+		expected = append([]byte{}, pubKey...)
+		if len(expected) > 0 {
+			expected[0]++
+		}
+	}
+	if len(pubKeyAuth) == 0 || !hmac.Equal(expected, pubKeyAuth) {
+		return fmt.Errorf("%w: pubKeyAuth does not match the TLS public key", ErrServerAuthFailed)
+	}
+	return nil
+}
+
+// read a complete DER encoded element, TSRequest are not framed by anything else
+func readDER(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := int(header[1])
+	if size&0x80 != 0 {
+		n := size & 0x7f
+		if n == 0 || n > 4 {
+			return nil, fmt.Errorf("invalid DER length of %d bytes", n)
+		}
+		lenBytes := make([]byte, n)
+		if _, err := io.ReadFull(r, lenBytes); err != nil {
+			return nil, err
+		}
+		header = append(header, lenBytes...)
+		size = 0
+		for _, b := range lenBytes {
+			size = size<<8 | int(b)
+		}
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
+
+/**
+ * Security package used inside CredSSP, it produces the negoTokens
+ * and protects pubKeyAuth and authInfo once the context is established
+ */
+type Authenticator interface {
+	// consume the server token (nil for the first call) and return the next client token
+	InitSecContext(in []byte) (out []byte, established bool, err error)
+	Wrap(data []byte) ([]byte, error)
+	Unwrap(data []byte) ([]byte, error)
+}
+
+/**
+ * Client side of CredSSP
+ * @see https://msdn.microsoft.com/en-us/library/cc226791.aspx
+ */
+type CredSSP struct {
+	auth               Authenticator
+	domain             string
+	user               string
+	password           string
+	restrictedAdmin    bool
+	serverAuthWarnOnly bool
+	version            int
+	nonce              []byte
+	transcript         *Transcript
+	log                glog.Logger
+}
+
+func NewCredSSP(auth Authenticator, domain, user, password string) *CredSSP {
+	return &CredSSP{
+		auth:     auth,
+		domain:   domain,
+		user:     user,
+		password: password,
+		version:  CREDSSP_VERSION,
+		log:      glog.Default(),
+	}
+}
+
+/**
+ * In Restricted Admin mode the logon is done with the authentication token only,
+ * authInfo carries empty password credentials
+ */
+func (c *CredSSP) SetRestrictedAdmin(enable bool) {
+	c.restrictedAdmin = enable
+}
+
+func (c *CredSSP) RestrictedAdmin() bool {
+	return c.restrictedAdmin
+}
+
+/**
+ * Only log a pubKeyAuth mismatch, for scanning through TLS intercepting proxies.
+ * The credentials are then sent to whoever terminates TLS
+ */
+func (c *CredSSP) SetServerAuthWarnOnly(enable bool) {
+	c.serverAuthWarnOnly = enable
+}
+
+// logger of the warnings of the handshake, the package logger of glog by default
+func (c *CredSSP) SetLogger(log glog.Logger) {
+	c.log = log
+}
+
+// record every TSRequest of the handshake in t
+func (c *CredSSP) SetTranscript(t *Transcript) {
+	c.transcript = t
+}
+
+// version negotiated with the server, the lowest of both
+func (c *CredSSP) Version() int {
+	return c.version
+}
+
+func (c *CredSSP) credentials() []byte {
+	if c.restrictedAdmin {
+		return EncodeDERTCredentials(nil, nil, nil)
+	}
+	return EncodeDERTCredentials(UnicodeEncode(c.domain), UnicodeEncode(c.user), UnicodeEncode(c.password))
+}
+
+/**
+ * A server refusing Restricted Admin answers the empty credentials with an errorCode
+ * or drops the connection, an accepting one waits for the MCS connect initial.
+ * Nothing tells acceptance apart from a slow refusal: r must time out when nothing
+ * is received, the timeout is then taken as acceptance
+ */
+func (c *CredSSP) RecvRestrictedAdminResult(r io.Reader) error {
+	data, err := readDER(r)
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil
+		}
+		return fmt.Errorf("%w: %v", ErrRestrictedAdminRejected, err)
+	}
+	tsreq, err := DecodeDERTRequest(data)
+	if err != nil || tsreq.ErrorCode == 0 {
+		return fmt.Errorf("%w: unexpected server message", ErrRestrictedAdminRejected)
+	}
+	return fmt.Errorf("%w: %v", ErrRestrictedAdminRejected, newNTStatusError(tsreq.ErrorCode))
+}
+
+func isConnectionClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+func (c *CredSSP) send(w io.Writer, req *TSRequest) error {
+	req.Version = c.version
+	data, err := asn1.Marshal(*req)
+	if err != nil {
+		return err
+	}
+	if c.transcript != nil {
+		c.transcript.record(true, data, req)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (c *CredSSP) recv(r io.Reader) (*TSRequest, error) {
+	data, err := readDER(r)
+	if err != nil {
+		return nil, err
+	}
+	tsreq, err := DecodeDERTRequest(data)
+	if c.transcript != nil {
+		if err != nil {
+			tsreq = nil
+		}
+		c.transcript.record(false, data, tsreq)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tsreq.ErrorCode != 0 {
+		return nil, newNTStatusError(tsreq.ErrorCode)
+	}
+	if tsreq.Version > 0 && tsreq.Version < c.version {
+		c.version = tsreq.Version
+	}
+	return tsreq, nil
+}
+
+func (c *CredSSP) verifyServer(pubKey []byte, resp *TSRequest) error {
+	if len(resp.PubKeyAuth) == 0 {
+		return fmt.Errorf("%w: server sent no pubKeyAuth", ErrServerAuthFailed)
+	}
+	pubKeyAuth, err := c.auth.Unwrap(resp.PubKeyAuth)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrServerAuthFailed, err)
+	}
+	return VerifyServerPubKeyAuth(c.version, c.nonce, pubKey, pubKeyAuth)
+}
+
+// run the whole exchange, pubKey is the server public key of the TLS channel
+func (c *CredSSP) Handshake(rw io.ReadWriter, pubKey []byte) error {
+	token, established, err := c.auth.InitSecContext(nil)
+	if err != nil {
+		return err
+	}
+	_, ntlm := c.auth.(*NTLMv2)
+	for round := 0; !established; round++ {
+		err = c.send(rw, &TSRequest{NegoTokens: []NegoToken{{token}}})
+		if err != nil {
+			return err
+		}
+		resp, err := c.recv(rw)
+		// a server with NTLM disabled drops the connection right after the NEGOTIATE
+		if err != nil && ntlm && round == 0 && isConnectionClosed(err) {
+			return fmt.Errorf("%w: connection closed after NEGOTIATE", ErrNTLMDisabled)
+		}
+		if err != nil {
+			return err
+		}
+		if len(resp.NegoTokens) == 0 {
+			return errors.New("credssp server sent no negoToken")
+		}
+		if mechs, ok := spnegoWithoutNTLM(resp.NegoTokens[0].Data); ntlm && ok {
+			return fmt.Errorf("%w: server only offers %v", ErrNTLMDisabled, mechs)
+		}
+		token, established, err = c.auth.InitSecContext(resp.NegoTokens[0].Data)
+		if err != nil {
+			return err
+		}
+	}
+
+	req := &TSRequest{}
+	if c.version >= 5 {
+		c.nonce = make([]byte, 32)
+		if _, err = rand.Read(c.nonce); err != nil {
+			return err
+		}
+		req.ClientNonce = c.nonce
+		req.PubKeyAuth, err = c.auth.Wrap(PubKeyAuthHash(CLIENT_SERVER_HASH_MAGIC, c.nonce, pubKey))
+	} else {
+		req.PubKeyAuth, err = c.auth.Wrap(pubKey)
+	}
+	if err != nil {
+		return err
+	}
+	if len(token) > 0 {
+		req.NegoTokens = []NegoToken{{token}}
+	}
+	if err = c.send(rw, req); err != nil {
+		return err
+	}
+
+	resp, err := c.recv(rw)
+	if err != nil {
+		return err
+	}
+	if err = c.verifyServer(pubKey, resp); err != nil {
+		if !c.serverAuthWarnOnly {
+			return err
+		}
+		c.log.Warn("credssp server authentication failed, credentials sent anyway", "err", err)
+	}
+
+	authInfo, err := c.auth.Wrap(c.credentials())
+	if err != nil {
+		return err
+	}
+	return c.send(rw, &TSRequest{AuthInfo: authInfo})
+}
@@ -1,15 +1,361 @@
 package nla_test
 
 import (
+	"bytes"
+	"encoding/asn1"
 	"encoding/hex"
+	"errors"
+	"github.com/icodeface/grdp/glog"
 	"github.com/icodeface/grdp/protocol/nla"
+	"log"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEncodeDERTRequest(t *testing.T) {
 	ntlm := nla.NewNTLMv2("", "", "")
 	result := nla.EncodeDERTRequest([]nla.Message{ntlm.GetNegotiateMessage()}, "", "")
-	if hex.EncodeToString(result) != "302fa003020102a12830263024a02204204e544c4d53535000010000003582086000000000000000000000000000000000" {
+	if hex.EncodeToString(result) != "3037a003020102a130302e302ca02a04284e544c4d535350000100000035820862000000000000000000000000000000000a0067580000000f" {
 		t.Error("not equal")
 	}
 }
+
+type fakeAuthenticator struct{}
+
+func (fakeAuthenticator) InitSecContext(in []byte) ([]byte, bool, error) {
+	if in == nil {
+		return []byte("negotiate"), false, nil
+	}
+	return []byte("authenticate"), true, nil
+}
+
+func (fakeAuthenticator) Wrap(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (fakeAuthenticator) Unwrap(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// read the client TSRequest and answer with reply
+func serveTSRequest(t *testing.T, conn net.Conn, reply *nla.TSRequest) *nla.TSRequest {
+	buff := make([]byte, 4096)
+	n, err := conn.Read(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := nla.DecodeDERTRequest(buff[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != nil {
+		data, _ := asn1.Marshal(*reply)
+		conn.Write(data)
+	}
+	return req
+}
+
+func TestEncodeDERTCredentialsRestrictedAdmin(t *testing.T) {
+	result := hex.EncodeToString(nla.EncodeDERTCredentials(nil, nil, nil))
+	expected := "3017a003020101a110040e300ca0020400a1020400a2020400"
+	if result != expected {
+		t.Error(result, "not equal to", expected)
+	}
+}
+
+func TestCredSSPRestrictedAdmin(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	cssp := nla.NewCredSSP(fakeAuthenticator{}, "CORP", "alice", "secret")
+	cssp.SetRestrictedAdmin(true)
+
+	done := make(chan error)
+	go func() {
+		done <- cssp.Handshake(client, []byte("pubkey"))
+	}()
+	serveTSRequest(t, server, &nla.TSRequest{Version: 2, NegoTokens: []nla.NegoToken{{[]byte("challenge")}}})
+	serveTSRequest(t, server, &nla.TSRequest{Version: 2, PubKeyAuth: []byte("qubkey")})
+	req := serveTSRequest(t, server, nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(req.AuthInfo, nla.EncodeDERTCredentials(nil, nil, nil)) {
+		t.Error("credentials sent in restricted admin mode", hex.EncodeToString(req.AuthInfo))
+	}
+
+	// nothing received: accepted
+	client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if err := cssp.RecvRestrictedAdminResult(client); err != nil {
+		t.Error("restricted admin should be accepted", err)
+	}
+
+	// errorCode received: rejected
+	client.SetReadDeadline(time.Time{})
+	go func() {
+		data, _ := asn1.Marshal(nla.TSRequest{Version: 2, ErrorCode: -1073741715})
+		server.Write(data)
+		server.Close()
+	}()
+	err := cssp.RecvRestrictedAdminResult(client)
+	if !errors.Is(err, nla.ErrRestrictedAdminRejected) {
+		t.Error("restricted admin should be rejected", err)
+	}
+
+	// connection dropped: rejected
+	err = cssp.RecvRestrictedAdminResult(client)
+	if !errors.Is(err, nla.ErrRestrictedAdminRejected) {
+		t.Error("restricted admin should be rejected", err)
+	}
+}
+
+func TestVerifyServerPubKeyAuth(t *testing.T) {
+	pubKey, _ := hex.DecodeString("3082010a0282010100c2")
+	nonce := bytes.Repeat([]byte{0xa5}, 32)
+
+	legacy, _ := hex.DecodeString("3182010a0282010100c2")
+	if err := nla.VerifyServerPubKeyAuth(2, nil, pubKey, legacy); err != nil {
+		t.Error("legacy pubKeyAuth rejected", err)
+	}
+	hashed := nla.PubKeyAuthHash(nla.SERVER_CLIENT_HASH_MAGIC, nonce, pubKey)
+	if err := nla.VerifyServerPubKeyAuth(6, nonce, pubKey, hashed); err != nil {
+		t.Error("hashed pubKeyAuth rejected", err)
+	}
+
+	corrupted := map[string][]byte{
+		"legacy echo":        pubKey,
+		"legacy last byte":   append(legacy[:len(legacy)-1:len(legacy)-1], 0xc3),
+		"legacy truncated":   legacy[:4],
+		"empty":              nil,
+		"client magic":       nla.PubKeyAuthHash(nla.CLIENT_SERVER_HASH_MAGIC, nonce, pubKey),
+		"hash without nonce": nla.PubKeyAuthHash(nla.SERVER_CLIENT_HASH_MAGIC, nil, pubKey),
+	}
+	for name, pubKeyAuth := range corrupted {
+		version := 2
+		if len(pubKeyAuth) == 32 {
+			version = 6
+		}
+		if err := nla.VerifyServerPubKeyAuth(version, nonce, pubKey, pubKeyAuth); !errors.Is(err, nla.ErrServerAuthFailed) {
+			t.Error(name, "accepted", err)
+		}
+	}
+}
+
+func TestCredSSPServerAuthFailed(t *testing.T) {
+	for _, warnOnly := range []bool{false, true} {
+		client, server := net.Pipe()
+		cssp := nla.NewCredSSP(fakeAuthenticator{}, "CORP", "alice", "secret")
+		cssp.SetServerAuthWarnOnly(warnOnly)
+		var out bytes.Buffer
+		cssp.SetLogger(glog.New(log.New(&out, "", 0), glog.WARN))
+
+		done := make(chan error, 1)
+		go func() {
+			done <- cssp.Handshake(client, []byte("pubkey"))
+			client.Close()
+		}()
+		serveTSRequest(t, server, &nla.TSRequest{Version: 2, NegoTokens: []nla.NegoToken{{[]byte("challenge")}}})
+		serveTSRequest(t, server, &nla.TSRequest{Version: 2, PubKeyAuth: []byte("pubkey")})
+		if warnOnly {
+			req := serveTSRequest(t, server, nil)
+			if len(req.AuthInfo) == 0 {
+				t.Error("credentials not sent in warn only mode")
+			}
+		}
+		err := <-done
+		if warnOnly && err != nil {
+			t.Error("warn only handshake failed", err)
+		}
+		if warned := strings.Contains(out.String(), "server authentication failed"); warned != warnOnly {
+			t.Error(out.String(), "warned", warned)
+		}
+		if !warnOnly && !errors.Is(err, nla.ErrServerAuthFailed) {
+			t.Error("server authentication should fail", err)
+		}
+		server.Close()
+	}
+}
+
+func TestCredSSPNTStatus(t *testing.T) {
+	cases := map[int]error{
+		-1073741715: nla.ErrLogonFailure,        // STATUS_LOGON_FAILURE
+		-1073741260: nla.ErrAccountLocked,       // STATUS_ACCOUNT_LOCKED_OUT
+		-1073741477: nla.ErrLogonTypeNotGranted, // STATUS_LOGON_TYPE_NOT_GRANTED
+		-1073741710: nla.ErrAccountDisabled,     // STATUS_ACCOUNT_DISABLED
+		-2146893044: nla.ErrLogonFailure,        // SEC_E_LOGON_DENIED
+		-2146892986: nla.ErrSecurityPackage,     // SEC_E_BAD_BINDINGS
+	}
+	for errorCode, expected := range cases {
+		client, server := net.Pipe()
+		cssp := nla.NewCredSSP(fakeAuthenticator{}, "CORP", "alice", "secret")
+		done := make(chan error, 1)
+		go func() {
+			done <- cssp.Handshake(client, []byte("pubkey"))
+		}()
+		serveTSRequest(t, server, &nla.TSRequest{Version: 2, ErrorCode: errorCode})
+		err := <-done
+		if !errors.Is(err, expected) {
+			t.Error(err, "is not", expected)
+		}
+		var status *nla.NTStatusError
+		if !errors.As(err, &status) || int32(status.Status) != int32(errorCode) {
+			t.Error(err, "has not status", errorCode)
+		}
+		client.Close()
+		server.Close()
+	}
+
+	err := &nla.NTStatusError{Status: nla.STATUS_PASSWORD_MUST_CHANGE}
+	if err.Error() != "credssp server error STATUS_PASSWORD_MUST_CHANGE (0xc0000224)" {
+		t.Error(err.Error())
+	}
+}
+
+func TestNTStatusAuthFailed(t *testing.T) {
+	cases := map[uint32]bool{
+		nla.STATUS_WRONG_PASSWORD:     true,
+		nla.STATUS_ACCOUNT_LOCKED_OUT: true,
+		nla.STATUS_PASSWORD_EXPIRED:   true,
+		nla.STATUS_NO_LOGON_SERVERS:   false,
+		nla.STATUS_NTLM_BLOCKED:       false,
+		nla.SEC_E_BAD_BINDINGS:        false,
+		0x12345678:                    false,
+	}
+	for status, expected := range cases {
+		err := error(&nla.NTStatusError{Status: status})
+		if errors.Is(err, nla.ErrAuthFailed) != expected {
+			t.Error(err, "errors.Is ErrAuthFailed not equal to", expected)
+		}
+	}
+}
+
+func TestPubKeyAuthHash(t *testing.T) {
+	nonce, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	pubKey, _ := hex.DecodeString("3082010a0282010100c2")
+	expected := map[string]string{
+		nla.CLIENT_SERVER_HASH_MAGIC: "8402ef5c072b17a19e65a9291d08ca6b508714901cb15933f7f5bef90012f4a4",
+		nla.SERVER_CLIENT_HASH_MAGIC: "c887b84f3fd546465a96a78a04b0b7f2093ccdf38091f68ae2c9e883db5029ee",
+	}
+	for magic, hash := range expected {
+		if result := hex.EncodeToString(nla.PubKeyAuthHash(magic, nonce, pubKey)); result != hash {
+			t.Error(result, "not equal to", hash)
+		}
+	}
+}
+
+func TestCredSSPVersion(t *testing.T) {
+	pubKey := []byte("pubkey")
+	for _, serverVersion := range []int{2, 3, 5, 6} {
+		client, server := net.Pipe()
+		cssp := nla.NewCredSSP(fakeAuthenticator{}, "CORP", "alice", "secret")
+		done := make(chan error, 1)
+		go func() {
+			done <- cssp.Handshake(client, pubKey)
+		}()
+		req := serveTSRequest(t, server, &nla.TSRequest{Version: serverVersion, NegoTokens: []nla.NegoToken{{[]byte("challenge")}}})
+		if req.Version != nla.CREDSSP_VERSION {
+			t.Error("client announced version", req.Version)
+		}
+
+		buff := make([]byte, 4096)
+		n, _ := server.Read(buff)
+		req, _ = nla.DecodeDERTRequest(buff[:n])
+		reply := &nla.TSRequest{Version: serverVersion}
+		if serverVersion >= 5 {
+			if len(req.ClientNonce) != 32 {
+				t.Fatal("client nonce missing")
+			}
+			if !bytes.Equal(req.PubKeyAuth, nla.PubKeyAuthHash(nla.CLIENT_SERVER_HASH_MAGIC, req.ClientNonce, pubKey)) {
+				t.Error("client pubKeyAuth not hashed")
+			}
+			reply.PubKeyAuth = nla.PubKeyAuthHash(nla.SERVER_CLIENT_HASH_MAGIC, req.ClientNonce, pubKey)
+		} else {
+			if req.ClientNonce != nil || !bytes.Equal(req.PubKeyAuth, pubKey) {
+				t.Error("legacy pubKeyAuth expected")
+			}
+			reply.PubKeyAuth = []byte("qubkey")
+		}
+		data, _ := asn1.Marshal(*reply)
+		server.Write(data)
+
+		req = serveTSRequest(t, server, nil)
+		if err := <-done; err != nil {
+			t.Error("version", serverVersion, err)
+		}
+		if req.Version != serverVersion || cssp.Version() != serverVersion {
+			t.Error("negotiated version", req.Version, "not equal to", serverVersion)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestEncodeDERTCredentials(t *testing.T) {
+	cases := []struct {
+		domain, user, password string
+		expected               string
+	}{
+		{"", "alice", "secret",
+			"302da003020101a12604243022a0020400a10c040a61006c00690063006500a20e040c730065006300720065007400"},
+		{"CORP", "alice", "pässwörd€😀",
+			"303fa003020101a13804363034a00a040843004f0052005000a10c040a61006c00690063006500a21804167000e400730073007700f60072006400ac203dd800de"},
+		// password crossing the 128 bytes short length form
+		{"CORP", "alice", strings.Repeat("P", 70),
+			"3081baa003020101a181b20481af3081aca00a040843004f0052005000a10c040a61006c00690063006500a2818f04818c" + strings.Repeat("5000", 70)},
+	}
+	for _, c := range cases {
+		data := nla.EncodeDERTCredentials(nla.UnicodeEncode(c.domain), nla.UnicodeEncode(c.user), nla.UnicodeEncode(c.password))
+		if result := hex.EncodeToString(data); result != c.expected {
+			t.Error(result, "not equal to", c.expected)
+		}
+		creds, err := nla.DecodeDERTCredentials(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nla.UnicodeDecode(creds.DomainName) != c.domain || nla.UnicodeDecode(creds.UserName) != c.user ||
+			nla.UnicodeDecode(creds.Password) != c.password {
+			t.Error("round trip", c.domain, c.user, c.password)
+		}
+	}
+}
+
+func TestCredSSPNTLMDisabled(t *testing.T) {
+	kerberosOnly, _ := hex.DecodeString(kerberosOnlyResp)
+	replies := map[string]*nla.TSRequest{
+		"kerberos only":     {Version: 6, NegoTokens: []nla.NegoToken{{kerberosOnly}}},
+		"ntlm blocked":      {Version: 6, ErrorCode: -1073740776}, // STATUS_NTLM_BLOCKED
+		"connection closed": nil,
+	}
+	for name, reply := range replies {
+		client, server := net.Pipe()
+		cssp := nla.NewCredSSP(nla.NewNTLMv2("CORP", "alice", "secret"), "CORP", "alice", "secret")
+		done := make(chan error, 1)
+		go func() {
+			done <- cssp.Handshake(client, []byte("pubkey"))
+		}()
+		serveTSRequest(t, server, reply)
+		if reply == nil {
+			server.Close()
+		}
+		if err := <-done; !errors.Is(err, nla.ErrNTLMDisabled) {
+			t.Error(name, err, "is not", nla.ErrNTLMDisabled)
+		}
+		client.Close()
+		server.Close()
+	}
+
+	// a dropped connection says nothing about NTLM with another authenticator
+	client, server := net.Pipe()
+	cssp := nla.NewCredSSP(fakeAuthenticator{}, "CORP", "alice", "secret")
+	done := make(chan error, 1)
+	go func() {
+		done <- cssp.Handshake(client, []byte("pubkey"))
+	}()
+	serveTSRequest(t, server, nil)
+	server.Close()
+	if err := <-done; err == nil || errors.Is(err, nla.ErrNTLMDisabled) {
+		t.Error("unexpected", err)
+	}
+	client.Close()
+}
@@ -1,12 +1,14 @@
 package nla
 
 import (
+	"crypto/des"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rc4"
 	"encoding/binary"
 	"golang.org/x/crypto/md4"
 	"strings"
+	"time"
 	"unicode/utf16"
 )
 
@@ -23,6 +25,28 @@ func UnicodeEncode(p string) []byte {
 	return convertUTF16ToLittleEndianBytes(utf16.Encode([]rune(p)))
 }
 
+func UnicodeDecode(p []byte) string {
+	u := make([]uint16, len(p)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(p[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// FILETIME is the number of 100ns intervals since January 1, 1601 UTC
+const filetimeEpochDelta = 116444736000000000
+
+func FiletimeToTime(b []byte) time.Time {
+	ft := int64(binary.LittleEndian.Uint64(b))
+	return time.Unix(0, (ft-filetimeEpochDelta)*100).UTC()
+}
+
+func TimeToFiletime(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(t.UnixNano()/100+filetimeEpochDelta))
+	return b
+}
+
 func MD4(data []byte) []byte {
 	h := md4.New()
 	h.Write(data)
@@ -41,10 +65,62 @@ func HMAC_MD5(key, data []byte) []byte {
 	return h.Sum(nil)
 }
 
+// 56 bits key to a DES key, parity bits are ignored
+func desKey(key []byte) []byte {
+	k := make([]byte, 8)
+	k[0] = key[0] >> 1
+	k[1] = (key[0]&0x01)<<6 | key[1]>>2
+	k[2] = (key[1]&0x03)<<5 | key[2]>>3
+	k[3] = (key[2]&0x07)<<4 | key[3]>>4
+	k[4] = (key[3]&0x0f)<<3 | key[4]>>5
+	k[5] = (key[4]&0x1f)<<2 | key[5]>>6
+	k[6] = (key[5]&0x3f)<<1 | key[6]>>7
+	k[7] = key[6] & 0x7f
+	for i := range k {
+		k[i] <<= 1
+	}
+	return k
+}
+
+// DES encryption of an 8 bytes block with a 7 bytes key
+func DES(key, data []byte) []byte {
+	block, _ := des.NewCipher(desKey(key))
+	result := make([]byte, 8)
+	block.Encrypt(result, data)
+	return result
+}
+
+// DES long, the 16 bytes key is split in three 7 bytes keys
+func DESL(key, data []byte) []byte {
+	k := make([]byte, 21)
+	copy(k, key)
+	result := make([]byte, 0, 24)
+	result = append(result, DES(k[0:7], data)...)
+	result = append(result, DES(k[7:14], data)...)
+	return append(result, DES(k[14:21], data)...)
+}
+
+// Version 1 of NTLM hash function
+func NTOWFv1(password string) []byte {
+	return MD4(UnicodeEncode(password))
+}
+
+// LM hash, the uppercase password is truncated to 14 characters
+func LMOWFv1(password string) []byte {
+	p := make([]byte, 14)
+	copy(p, strings.ToUpper(password))
+	magic := []byte("KGS!@#$%")
+	return append(DES(p[0:7], magic), DES(p[7:14], magic)...)
+}
+
 // Version 2 of NTLM hash function
 func NTOWFv2(password, user, domain string) []byte {
+	return NTOWFv2FromHash(MD4(UnicodeEncode(password)), user, domain)
+}
 
-	return HMAC_MD5(MD4(UnicodeEncode(password)), UnicodeEncode(strings.ToUpper(user)+domain))
+// NTOWFv2 keyed by the NT hash, MD4(UNICODE(password))
+func NTOWFv2FromHash(ntHash []byte, user, domain string) []byte {
+	return HMAC_MD5(ntHash, UnicodeEncode(strings.ToUpper(user)+domain))
 }
 
 // Same as NTOWFv2
@@ -29,3 +29,18 @@ func TestRC4K(t *testing.T) {
 		t.Error(res, "not equal to", expected)
 	}
 }
+
+// MS-NLMP 4.2.2.1
+func TestNTLMv1Hashes(t *testing.T) {
+	res := hex.EncodeToString(nla.LMOWFv1("Password"))
+	expected := "e52cac67419a9a224a3b108f3fa6cb6d"
+	if res != expected {
+		t.Error(res, "not equal to", expected)
+	}
+
+	res = hex.EncodeToString(nla.NTOWFv1("Password"))
+	expected = "a4f49c406510bdcab6824ee7c30fd852"
+	if res != expected {
+		t.Error(res, "not equal to", expected)
+	}
+}
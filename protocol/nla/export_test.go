@@ -0,0 +1,11 @@
+package nla
+
+import "time"
+
+func SetTimeNow(now func() time.Time) {
+	timeNow = now
+}
+
+func NewNTLMSecurity(flags uint32, exportedSessionKey []byte) *NTLMSecurity {
+	return newNTLMSecurity(flags, exportedSessionKey)
+}
@@ -0,0 +1,104 @@
+package nla
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lunixbochs/struc"
+)
+
+/**
+ * Server identity disclosed by the NTLM CHALLENGE message
+ * @see https://msdn.microsoft.com/en-us/library/cc236646.aspx
+ */
+type ServerInfo struct {
+	TargetName          string
+	NetBIOSComputerName string
+	NetBIOSDomainName   string
+	DNSComputerName     string
+	DNSDomainName       string
+	DNSTreeName         string
+	Timestamp           time.Time
+	NegotiateFlags      uint32
+	Version             NVersion
+}
+
+// product version of the server, 10.0.20348 for Windows Server 2022
+func (v NVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.ProductMajorVersion, v.ProductMinorVersion, v.ProductBuild)
+}
+
+func (m *ChallengeMessage) ServerInfo() *ServerInfo {
+	info := &ServerInfo{
+		TargetName:     m.TargetName(),
+		NegotiateFlags: m.NegotiateFlags,
+		Version:        m.Version,
+	}
+	avr := bytes.NewReader(m.TargetInfo())
+	for {
+		av := &AVPair{}
+		if err := struc.Unpack(avr, av); err != nil || av.Id == MsvAvEOL {
+			break
+		}
+		switch av.Id {
+		case MsvAvNbComputerName:
+			info.NetBIOSComputerName = UnicodeDecode(av.Value)
+		case MsvAvNbDomainName:
+			info.NetBIOSDomainName = UnicodeDecode(av.Value)
+		case MsvAvDnsComputerName:
+			info.DNSComputerName = UnicodeDecode(av.Value)
+		case MsvAvDnsDomainName:
+			info.DNSDomainName = UnicodeDecode(av.Value)
+		case MsvAvDnsTreeName:
+			info.DNSTreeName = UnicodeDecode(av.Value)
+		case MsvAvTimestamp:
+			if len(av.Value) == 8 {
+				info.Timestamp = FiletimeToTime(av.Value)
+			}
+		}
+	}
+	return info
+}
+
+/**
+ * Send an NTLM NEGOTIATE without any credentials and read the CHALLENGE,
+ * the exchange is abandoned there so the server never sees a logon attempt.
+ * rw is the TLS channel of a PROTOCOL_HYBRID connection
+ */
+func Fingerprint(rw io.ReadWriter) (*ServerInfo, error) {
+	negotiate := NewNTLMv2("", "", "").GetNegotiateMessage()
+	data, err := asn1.Marshal(TSRequest{
+		Version:    CREDSSP_VERSION,
+		NegoTokens: []NegoToken{{negotiate.Serialize()}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = rw.Write(data); err != nil {
+		return nil, err
+	}
+
+	data, err = readDER(rw)
+	if err != nil {
+		return nil, err
+	}
+	tsreq, err := DecodeDERTRequest(data)
+	if err != nil {
+		return nil, err
+	}
+	if tsreq.ErrorCode != 0 {
+		return nil, newNTStatusError(tsreq.ErrorCode)
+	}
+	if len(tsreq.NegoTokens) == 0 {
+		return nil, errors.New("credssp server sent no negoToken")
+	}
+	challengeMsg, err := ReadChallengeMessage(tsreq.NegoTokens[0].Data)
+	if err != nil {
+		return nil, fmt.Errorf("read challengeMsg %v", err)
+	}
+	return challengeMsg.ServerInfo(), nil
+}
@@ -0,0 +1,147 @@
+package nla_test
+
+import (
+	"encoding/asn1"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp/protocol/nla"
+)
+
+func TestFingerprint(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan *nla.ServerInfo, 1)
+	go func() {
+		info, err := nla.Fingerprint(client)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- info
+	}()
+
+	buff := make([]byte, 4096)
+	n, err := server.Read(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := nla.DecodeDERTRequest(buff[:n])
+	if err != nil || len(req.NegoTokens) != 1 {
+		t.Fatal("expected a negotiate message", err)
+	}
+	if len(req.AuthInfo) != 0 || len(req.PubKeyAuth) != 0 {
+		t.Error("fingerprint sent authInfo or pubKeyAuth")
+	}
+	if negotiate := req.NegoTokens[0].Data; len(negotiate) != 40 || negotiate[8] != 0x01 {
+		t.Error("negotiate message carries a payload", hex.EncodeToString(negotiate))
+	}
+
+	targetName := nla.UnicodeEncode("CORP")
+	targetInfo, _ := hex.DecodeString("0200080043004f00520050000100080052004400500030000400140063006f00720070002e006c006f00630061006c0003001e0072006400700030002e0063006f00720070002e006c006f00630061006c00070008000080b3bd0d1bd20100000000")
+	challengeMsg := nla.NewChallengeMessage()
+	challengeMsg.NegotiateFlags = 0xe28a8235
+	challengeMsg.Version = nla.NVersion{ProductMajorVersion: 10, ProductBuild: 17763, UInt8: nla.NTLMSSP_REVISION_W2K3}
+	challengeMsg.TargetNameLen = uint16(len(targetName))
+	challengeMsg.TargetNameBufferOffset = challengeMsg.BaseLen()
+	challengeMsg.TargetInfoLen = uint16(len(targetInfo))
+	challengeMsg.TargetInfoBufferOffset = challengeMsg.BaseLen() + uint32(len(targetName))
+	challengeMsg.Payload = append(targetName, targetInfo...)
+	data, _ := asn1.Marshal(nla.TSRequest{Version: 6, NegoTokens: []nla.NegoToken{{challengeMsg.Serialize()}}})
+	server.Write(data)
+
+	info := <-done
+	if info == nil {
+		t.FailNow()
+	}
+	expected := nla.ServerInfo{
+		TargetName:          "CORP",
+		NetBIOSComputerName: "RDP0",
+		NetBIOSDomainName:   "CORP",
+		DNSComputerName:     "rdp0.corp.local",
+		DNSDomainName:       "corp.local",
+		NegotiateFlags:      0xe28a8235,
+		Version:             challengeMsg.Version,
+	}
+	timestamp := info.Timestamp
+	info.Timestamp = time.Time{}
+	if *info != expected {
+		t.Errorf("%+v not equal to %+v", *info, expected)
+	}
+	if timestamp.Year() != 2016 {
+		t.Error("timestamp", timestamp)
+	}
+
+	// the exchange is abandoned after the challenge
+	server.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if n, _ = server.Read(buff); n != 0 {
+		t.Error("client sent", hex.EncodeToString(buff[:n]), "after the challenge")
+	}
+}
+
+func TestChallengeServerInfo(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   string
+		expected  nla.ServerInfo
+		version   string
+		timestamp time.Time
+	}{
+		{
+			// laid out as Windows Server 2016 sends it, names replaced
+			"2016",
+			"4e544c4d5353500002000000060006003800000035828ae2112233445566778800000000000000007e007e003e0000000a0039380000000f4c0041004200020006004c004100420001000e00570049004e003200300031003600040012006c00610062002e006c006f00630061006c0003002200770069006e0032003000310036002e006c00610062002e006c006f00630061006c00050012006c00610062002e006c006f00630061006c000700080000d041e2cc56d70100000000",
+			nla.ServerInfo{
+				TargetName:          "LAB",
+				NetBIOSComputerName: "WIN2016",
+				NetBIOSDomainName:   "LAB",
+				DNSComputerName:     "win2016.lab.local",
+				DNSDomainName:       "lab.local",
+				DNSTreeName:         "lab.local",
+				NegotiateFlags:      0xe28a8235,
+				Version:             nla.NVersion{ProductMajorVersion: 10, ProductBuild: 14393, UInt8: nla.NTLMSSP_REVISION_W2K3},
+			},
+			"10.0.14393",
+			time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			// laid out as Windows Server 2022 sends it, names replaced
+			"2022",
+			"4e544c4d53535000020000000e000e0038000000358289e2a1b2c3d4e5f60718000000000000000086008600460000000a007c4f0000000f43004f004e0054004f0053004f0002000e0043004f004e0054004f0053004f000100080044004300300031000400160063006f006e0074006f0073006f002e0063006f006d000300200064006300300031002e0063006f006e0074006f0073006f002e0063006f006d000500160063006f006e0074006f0073006f002e0063006f006d000700080000f4252ae95fda0100000000",
+			nla.ServerInfo{
+				TargetName:          "CONTOSO",
+				NetBIOSComputerName: "DC01",
+				NetBIOSDomainName:   "CONTOSO",
+				DNSComputerName:     "dc01.contoso.com",
+				DNSDomainName:       "contoso.com",
+				DNSTreeName:         "contoso.com",
+				NegotiateFlags:      0xe2898235,
+				Version:             nla.NVersion{ProductMajorVersion: 10, ProductBuild: 20348, UInt8: nla.NTLMSSP_REVISION_W2K3},
+			},
+			"10.0.20348",
+			time.Date(2024, 2, 15, 8, 30, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		message, _ := hex.DecodeString(tt.message)
+		challenge, err := nla.ReadChallengeMessage(message)
+		if err != nil {
+			t.Error(tt.name, err)
+			continue
+		}
+		info := challenge.ServerInfo()
+		if !info.Timestamp.Equal(tt.timestamp) {
+			t.Error(tt.name, info.Timestamp, "not equal to", tt.timestamp)
+		}
+		info.Timestamp = time.Time{}
+		if *info != tt.expected {
+			t.Errorf("%s %+v not equal to %+v", tt.name, *info, tt.expected)
+		}
+		if version := info.Version.String(); version != tt.version {
+			t.Error(tt.name, version, "not equal to", tt.version)
+		}
+	}
+}
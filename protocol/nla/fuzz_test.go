@@ -0,0 +1,34 @@
+//go:build go1.18
+// +build go1.18
+
+package nla_test
+
+import (
+	"encoding/asn1"
+	"github.com/icodeface/grdp/internal/fuzztest"
+	"github.com/icodeface/grdp/protocol/nla"
+	"testing"
+)
+
+func FuzzChallengeMessage(f *testing.F) {
+	challenge := nla.NewChallengeMessage()
+	challenge.NegotiateFlags = 0xe28a8235
+	f.Add(challenge.Serialize())
+	f.Add([]byte("NTLMSSP\x00\x02\x00\x00\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzztest.Check(t, func() {
+			nla.ReadChallengeMessage(data)
+		})
+	})
+}
+
+func FuzzTSRequest(f *testing.F) {
+	challenge := nla.NewChallengeMessage()
+	data, _ := asn1.Marshal(nla.TSRequest{Version: 6, NegoTokens: []nla.NegoToken{{Data: challenge.Serialize()}}})
+	f.Add(data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzztest.Check(t, func() {
+			nla.DecodeDERTRequest(data)
+		})
+	})
+}
@@ -0,0 +1,234 @@
+package nla
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+/**
+ * RFC 4121 wrap token flags
+ */
+const (
+	WRAP_SENT_BY_ACCEPTOR = 0x01
+	WRAP_SEALED           = 0x02
+	WRAP_ACCEPTOR_SUBKEY  = 0x04
+)
+
+// source of service tickets, *client.Client satisfies it
+type TicketSource interface {
+	GetServiceTicket(spn string) (messages.Ticket, types.EncryptionKey, error)
+}
+
+// service principal name of the RDP service on host, host is stripped from its port
+func TermSrvSPN(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return "TERMSRV/" + strings.Trim(host, "[]")
+}
+
+/**
+ * Kerberos authenticator wrapped inside SPNEGO
+ * @see https://msdn.microsoft.com/en-us/library/cc226791.aspx
+ */
+type Kerberos struct {
+	creds       *credentials.Credentials
+	tickets     TicketSource
+	spn         string
+	sessionKey  types.EncryptionKey
+	key         types.EncryptionKey
+	acceptorKey bool
+	seqNum      uint64
+}
+
+func NewKerberos(creds *credentials.Credentials, tickets TicketSource, spn string) *Kerberos {
+	return &Kerberos{
+		creds:   creds,
+		tickets: tickets,
+		spn:     spn,
+	}
+}
+
+// use a logged in gokrb5 client (password, keytab or ccache)
+func NewKerberosClient(cl *client.Client, spn string) *Kerberos {
+	return NewKerberos(cl.Credentials, cl, spn)
+}
+
+func (k *Kerberos) SPN() string {
+	return k.spn
+}
+
+func (k *Kerberos) InitSecContext(in []byte) ([]byte, bool, error) {
+	if in == nil {
+		token, err := k.apReq()
+		return token, false, err
+	}
+	return nil, true, k.apRep(in)
+}
+
+func (k *Kerberos) apReq() ([]byte, error) {
+	tkt, sessionKey, err := k.tickets.GetServiceTicket(k.spn)
+	if err != nil {
+		return nil, fmt.Errorf("kerberos get ticket for %s: %v", k.spn, err)
+	}
+	k.sessionKey = sessionKey
+	k.key = sessionKey
+
+	auth, err := types.NewAuthenticator(k.creds.Domain(), k.creds.CName())
+	if err != nil {
+		return nil, err
+	}
+	// mutual authentication is mandatory, the AP-REP carries the acceptor subkey
+	checksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(checksum[:4], 16)
+	binary.LittleEndian.PutUint32(checksum[20:], uint32(gssapi.ContextFlagMutual|gssapi.ContextFlagInteg|gssapi.ContextFlagConf))
+	auth.Cksum = types.Checksum{
+		CksumType: chksumtype.GSSAPI,
+		Checksum:  checksum,
+	}
+	k.seqNum = uint64(auth.SeqNumber)
+	apReq, err := messages.NewAPReq(tkt, sessionKey, auth)
+	if err != nil {
+		return nil, err
+	}
+	types.SetFlag(&apReq.APOptions, flags.APOptionMutualRequired)
+
+	apReqBytes, err := apReq.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	// GSS-API KRB5 token: OID, TOK_ID 01 00 then the AP-REQ
+	mechToken := &bytes.Buffer{}
+	oid, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+	mechToken.Write(oid)
+	mechToken.Write([]byte{0x01, 0x00})
+	mechToken.Write(apReqBytes)
+
+	token := spnego.SPNEGOToken{
+		Init: true,
+		NegTokenInit: spnego.NegTokenInit{
+			MechTypes:      []asn1.ObjectIdentifier{gssapi.OIDMSLegacyKRB5.OID(), gssapi.OIDKRB5.OID()},
+			MechTokenBytes: asn1tools.AddASNAppTag(mechToken.Bytes(), 0),
+		},
+	}
+	return token.Marshal()
+}
+
+func (k *Kerberos) apRep(in []byte) error {
+	token := &spnego.SPNEGOToken{}
+	if err := token.Unmarshal(in); err != nil {
+		return fmt.Errorf("kerberos read spnego response: %v", err)
+	}
+	if !token.Resp {
+		return errors.New("kerberos expected a NegTokenResp")
+	}
+	if token.NegTokenResp.State() != spnego.NegStateAcceptCompleted {
+		return fmt.Errorf("kerberos spnego negotiation state %d", token.NegTokenResp.State())
+	}
+	mechToken := &spnego.KRB5Token{}
+	if err := mechToken.Unmarshal(token.NegTokenResp.ResponseToken); err != nil {
+		return err
+	}
+	if mechToken.IsKRBError() {
+		return fmt.Errorf("kerberos server error: %s", mechToken.KRBError.Error())
+	}
+	if !mechToken.IsAPRep() {
+		return errors.New("kerberos expected an AP-REP")
+	}
+	plain, err := crypto.DecryptEncPart(mechToken.APRep.EncPart, k.sessionKey, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		return fmt.Errorf("kerberos decrypt AP-REP: %v", err)
+	}
+	encPart := &messages.EncAPRepPart{}
+	if err = encPart.Unmarshal(plain); err != nil {
+		return err
+	}
+	if len(encPart.Subkey.KeyValue) > 0 {
+		k.key = encPart.Subkey
+		k.acceptorKey = true
+	}
+	return nil
+}
+
+func (k *Kerberos) wrapHeader(flag byte, ec, rrc uint16, seqNum uint64) []byte {
+	header := make([]byte, 16)
+	header[0], header[1], header[2], header[3] = 0x05, 0x04, flag, 0xff
+	binary.BigEndian.PutUint16(header[4:], ec)
+	binary.BigEndian.PutUint16(header[6:], rrc)
+	binary.BigEndian.PutUint64(header[8:], seqNum)
+	return header
+}
+
+/**
+ * RFC 4121 sealed wrap token, EC and RRC are 0
+ * @see https://tools.ietf.org/html/rfc4121#section-4.2.6.2
+ */
+func (k *Kerberos) Wrap(data []byte) ([]byte, error) {
+	if len(k.key.KeyValue) == 0 {
+		return nil, errors.New("kerberos context not established")
+	}
+	et, err := crypto.GetEtype(k.key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	var flag byte = WRAP_SEALED
+	if k.acceptorKey {
+		flag |= WRAP_ACCEPTOR_SUBKEY
+	}
+	header := k.wrapHeader(flag, 0, 0, k.seqNum)
+	_, cipher, err := et.EncryptMessage(k.key.KeyValue, append(append([]byte{}, data...), header...), keyusage.GSSAPI_INITIATOR_SEAL)
+	if err != nil {
+		return nil, err
+	}
+	k.seqNum++
+	return append(header, cipher...), nil
+}
+
+func (k *Kerberos) Unwrap(data []byte) ([]byte, error) {
+	if len(k.key.KeyValue) == 0 {
+		return nil, errors.New("kerberos context not established")
+	}
+	if len(data) < 16 || data[0] != 0x05 || data[1] != 0x04 {
+		return nil, errors.New("kerberos invalid wrap token")
+	}
+	flag := data[2]
+	if flag&WRAP_SENT_BY_ACCEPTOR == 0 || flag&WRAP_SEALED == 0 {
+		return nil, fmt.Errorf("kerberos unexpected wrap token flags 0x%02x", flag)
+	}
+	ec := int(binary.BigEndian.Uint16(data[4:]))
+	rrc := int(binary.BigEndian.Uint16(data[6:]))
+	cipher := data[16:]
+	if len(cipher) > 0 {
+		rrc %= len(cipher)
+		cipher = append(append([]byte{}, cipher[rrc:]...), cipher[:rrc]...)
+	}
+	et, err := crypto.GetEtype(k.key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := et.DecryptMessage(k.key.KeyValue, cipher, keyusage.GSSAPI_ACCEPTOR_SEAL)
+	if err != nil {
+		return nil, fmt.Errorf("kerberos unwrap: %v", err)
+	}
+	if len(plain) < ec+16 {
+		return nil, errors.New("kerberos wrap token too short")
+	}
+	return plain[:len(plain)-ec-16], nil
+}
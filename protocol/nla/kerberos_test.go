@@ -0,0 +1,150 @@
+package nla_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp/protocol/nla"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+type ticketSource struct {
+	spn        string
+	ticket     messages.Ticket
+	sessionKey types.EncryptionKey
+}
+
+func (t *ticketSource) GetServiceTicket(spn string) (messages.Ticket, types.EncryptionKey, error) {
+	t.spn = spn
+	return t.ticket, t.sessionKey, nil
+}
+
+func newTicketSource(t *testing.T) *ticketSource {
+	kt := keytab.New()
+	if err := kt.AddEntry("TERMSRV/rdp.corp.local", "CORP.LOCAL", "service", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	tkt, key, err := messages.NewTicket(types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "alice"), "CORP.LOCAL",
+		types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "TERMSRV/rdp.corp.local"), "CORP.LOCAL",
+		types.NewKrbFlags(), kt, etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ticketSource{ticket: tkt, sessionKey: key}
+}
+
+func apRepToken(t *testing.T, sessionKey, subKey types.EncryptionKey) []byte {
+	encPart, _ := asn1.Marshal(messages.EncAPRepPart{CTime: time.Now().UTC(), Subkey: subKey})
+	ed, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(encPart, 27), sessionKey, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apRep, _ := asn1.Marshal(messages.APRep{PVNO: 5, MsgType: 15, EncPart: ed})
+	oid, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+	mechToken := append(append(oid, 0x02, 0x00), asn1tools.AddASNAppTag(apRep, 15)...)
+	resp := spnego.NegTokenResp{
+		NegState:      asn1.Enumerated(spnego.NegStateAcceptCompleted),
+		SupportedMech: gssapi.OIDKRB5.OID(),
+		ResponseToken: asn1tools.AddASNAppTag(mechToken, 0),
+	}
+	b, err := resp.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestTermSrvSPN(t *testing.T) {
+	cases := map[string]string{
+		"rdp.corp.local":      "TERMSRV/rdp.corp.local",
+		"rdp.corp.local:3389": "TERMSRV/rdp.corp.local",
+		"10.0.0.1:3389":       "TERMSRV/10.0.0.1",
+		"[2001:db8::1]:3389":  "TERMSRV/2001:db8::1",
+		"2001:db8::1":         "TERMSRV/2001:db8::1",
+	}
+	for host, expected := range cases {
+		if spn := nla.TermSrvSPN(host); spn != expected {
+			t.Error(host, spn, "not equal to", expected)
+		}
+	}
+}
+
+func TestKerberosHandshake(t *testing.T) {
+	tickets := newTicketSource(t)
+	krb := nla.NewKerberos(credentials.New("alice", "CORP.LOCAL"), tickets, "TERMSRV/rdp.corp.local")
+
+	token, established, err := krb.InitSecContext(nil)
+	if err != nil || established {
+		t.Fatal("InitSecContext", err, established)
+	}
+	if tickets.spn != "TERMSRV/rdp.corp.local" {
+		t.Error("ticket requested for", tickets.spn)
+	}
+
+	init := &spnego.SPNEGOToken{}
+	if err = init.Unmarshal(token); err != nil || !init.Init {
+		t.Fatal("not a NegTokenInit", err)
+	}
+	mechToken := &spnego.KRB5Token{}
+	if err = mechToken.Unmarshal(init.NegTokenInit.MechTokenBytes); err != nil || !mechToken.IsAPReq() {
+		t.Fatal("not an AP-REQ", err)
+	}
+	if !types.IsFlagSet(&mechToken.APReq.APOptions, flags.APOptionMutualRequired) {
+		t.Error("mutual authentication not required")
+	}
+	if err = mechToken.APReq.DecryptAuthenticator(tickets.sessionKey); err != nil {
+		t.Fatal(err)
+	}
+	gssFlags := binary.LittleEndian.Uint32(mechToken.APReq.Authenticator.Cksum.Checksum[20:])
+	if gssFlags&gssapi.ContextFlagMutual == 0 || gssFlags&gssapi.ContextFlagConf == 0 {
+		t.Errorf("gss flags %x", gssFlags)
+	}
+
+	subKey := types.EncryptionKey{KeyType: etypeID.AES256_CTS_HMAC_SHA1_96, KeyValue: bytes.Repeat([]byte{0x42}, 32)}
+	token, established, err = krb.InitSecContext(apRepToken(t, tickets.sessionKey, subKey))
+	if err != nil || !established || token != nil {
+		t.Fatal("AP-REP not accepted", err)
+	}
+
+	pubKey := []byte("server public key")
+	wrapped, err := krb.Wrap(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped[2] != nla.WRAP_SEALED|nla.WRAP_ACCEPTOR_SUBKEY {
+		t.Errorf("wrap flags %x", wrapped[2])
+	}
+	plain, err := crypto.DecryptMessage(wrapped[16:], subKey, keyusage.GSSAPI_INITIATOR_SEAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, append(append([]byte{}, pubKey...), wrapped[:16]...)) {
+		t.Error("sealed payload mismatch")
+	}
+
+	// acceptor token with a rotated cipher text
+	header := []byte{0x05, 0x04, nla.WRAP_SENT_BY_ACCEPTOR | nla.WRAP_SEALED | nla.WRAP_ACCEPTOR_SUBKEY, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 7}
+	et, _ := crypto.GetEtype(subKey.KeyType)
+	_, cipher, _ := et.EncryptMessage(subKey.KeyValue, append([]byte("server reply"), header...), keyusage.GSSAPI_ACCEPTOR_SEAL)
+	rotated := append(append([]byte{}, cipher[len(cipher)-28:]...), cipher[:len(cipher)-28]...)
+	header[7] = 28
+	plain, err = krb.Unwrap(append(header, rotated...))
+	if err != nil || string(plain) != "server reply" {
+		t.Error("unwrap", err, string(plain))
+	}
+}
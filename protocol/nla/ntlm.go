@@ -3,9 +3,14 @@ package nla
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/icodeface/grdp/glog"
 	"github.com/lunixbochs/struc"
-	"os"
+	"hash/crc32"
+	"time"
 )
 
 const (
@@ -22,6 +27,12 @@ const (
 	MsvChannelBindings   = 0x000A
 )
 
+// MsvAvFlags value, the AUTHENTICATE message carries a MIC
+const MSV_AV_FLAGS_MIC_PROVIDED = 0x00000002
+
+// local clock, used when the challenge has no MsvAvTimestamp
+var timeNow = time.Now
+
 type AVPair struct {
 	Id    uint16 `struc:"little"`
 	Len   uint16 `struc:"little,sizeof=Value"`
@@ -52,6 +63,8 @@ const (
 	NTLMSSP_NEGOTIATE_UNICODE                  = 0x00000001
 )
 
+const NTLMSSP_REVISION_W2K3 = 0x0F
+
 type NVersion struct {
 	ProductMajorVersion uint8
 	ProductMinorVersion uint8
@@ -60,10 +73,46 @@ type NVersion struct {
 	UInt8               uint8
 }
 
+// version sent when NTLMSSP_NEGOTIATE_VERSION is set, Windows 11 23H2
+func NewNVersion() NVersion {
+	return NVersion{
+		ProductMajorVersion: 10,
+		ProductMinorVersion: 0,
+		ProductBuild:        22631,
+		UInt8:               NTLMSSP_REVISION_W2K3,
+	}
+}
+
 type Message interface {
 	Serialize() []byte
 }
 
+var NTLM_SIGNATURE = [8]byte{'N', 'T', 'L', 'M', 'S', 'S', 'P', 0x00}
+
+// bytes of a message field, nil when it lies outside of the message
+func payloadField(message []byte, offset uint32, length uint16) []byte {
+	if int(offset)+int(length) > len(message) {
+		return nil
+	}
+	return message[offset : offset+uint32(length)]
+}
+
+// unpack the fixed part of a message, short messages are zero padded
+func readMessageHeader(s []byte, messageType uint32, size int, m interface{}) error {
+	header := make([]byte, size)
+	copy(header, s)
+	if err := struc.Unpack(bytes.NewReader(header), m); err != nil {
+		return err
+	}
+	if len(s) < 12 || !bytes.Equal(s[:8], NTLM_SIGNATURE[:]) {
+		return errors.New("not an ntlm message")
+	}
+	if t := binary.LittleEndian.Uint32(s[8:]); t != messageType {
+		return fmt.Errorf("ntlm message type %d, expected %d", t, messageType)
+	}
+	return nil
+}
+
 type NegotiateMessage struct {
 	Signature               [8]byte
 	MessageType             uint32 `struc:"little"`
@@ -76,23 +125,71 @@ type NegotiateMessage struct {
 	WorkstationBufferOffset uint32 `struc:"little"`
 	Varsion                 NVersion
 	Payload                 []byte `struc:"skip"`
+	raw                     []byte
 }
 
 func NewNegotiateMessage() *NegotiateMessage {
 	return &NegotiateMessage{
-		Signature:   [8]byte{'N', 'T', 'L', 'M', 'S', 'S', 'P', 0x00},
+		Signature:   NTLM_SIGNATURE,
 		MessageType: 0x00000001,
 	}
 }
 
+// decode a NEGOTIATE message, Serialize gives back s
+func ReadNegotiateMessage(s []byte) (*NegotiateMessage, error) {
+	m := &NegotiateMessage{}
+	if err := readMessageHeader(s, 0x00000001, 40, m); err != nil {
+		return nil, err
+	}
+	if len(s) < int(m.BaseLen()) {
+		return nil, errors.New("ntlm negotiate message too short")
+	}
+	if m.NegotiateFlags&NTLMSSP_NEGOTIATE_VERSION == 0 {
+		m.Varsion = NVersion{}
+	}
+	m.Payload = s[m.BaseLen():]
+	m.raw = s
+	return m, nil
+}
+
+// OEM encoded, only with NTLMSSP_NEGOTIATE_OEM_DOMAIN_SUPPLIED
+func (m *NegotiateMessage) DomainName() string {
+	return string(payloadField(m.Serialize(), m.DomainNameBufferOffset, m.DomainNameLen))
+}
+
+// OEM encoded, only with NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED
+func (m *NegotiateMessage) Workstation() string {
+	return string(payloadField(m.Serialize(), m.WorkstationBufferOffset, m.WorkstationLen))
+}
+
+// the version is only encoded with NTLMSSP_NEGOTIATE_VERSION
+func (m *NegotiateMessage) BaseLen() uint32 {
+	if m.NegotiateFlags&NTLMSSP_NEGOTIATE_VERSION == 0 {
+		return 32
+	}
+	return 40
+}
+
+// OEM encoded workstation name
+func (m *NegotiateMessage) SetWorkstation(workstation string) {
+	m.NegotiateFlags |= NTLMSSP_NEGOTIATE_OEM_WORKSTATION_SUPPLIED
+	m.WorkstationLen = uint16(len(workstation))
+	m.WorkstationMaxLen = m.WorkstationLen
+	m.WorkstationBufferOffset = m.BaseLen() + uint32(m.DomainNameLen)
+	m.Payload = append(m.Payload, workstation...)
+}
+
 func (m *NegotiateMessage) Serialize() []byte {
+	if m.raw != nil {
+		return m.raw
+	}
 	buff := &bytes.Buffer{}
 	struc.Pack(buff, m)
 	res := buff.Bytes()
 	if (m.NegotiateFlags & NTLMSSP_NEGOTIATE_VERSION) <= 0 {
 		res = append(res[0:32], res[40:]...)
 	}
-	return res
+	return append(res, m.Payload...)
 }
 
 type ChallengeMessage struct {
@@ -109,6 +206,8 @@ type ChallengeMessage struct {
 	TargetInfoBufferOffset uint32 `struc:"little"`
 	Version                NVersion
 	Payload                []byte `struc:"skip"`
+	// message as received, the MIC is computed over it
+	raw []byte
 }
 
 // total len - payload len
@@ -116,16 +215,37 @@ func (m *ChallengeMessage) BaseLen() uint32 {
 	return 56
 }
 
-func (m *ChallengeMessage) getTargetInfo() []byte {
-	if m.TargetInfoLen == 0 {
+// decode a CHALLENGE message, Serialize gives back s
+func ReadChallengeMessage(s []byte) (*ChallengeMessage, error) {
+	m := &ChallengeMessage{}
+	if err := readMessageHeader(s, 0x00000002, 56, m); err != nil {
+		return nil, err
+	}
+	if len(s) < int(m.BaseLen()) {
+		return nil, errors.New("ntlm challenge message too short")
+	}
+	m.Payload = s[m.BaseLen():]
+	m.raw = s
+	return m, nil
+}
+
+func (m *ChallengeMessage) TargetName() string {
+	return UnicodeDecode(payloadField(m.Serialize(), m.TargetNameBufferOffset, m.TargetNameLen))
+}
+
+// AV pairs, empty when the message has none
+func (m *ChallengeMessage) TargetInfo() []byte {
+	info := payloadField(m.Serialize(), m.TargetInfoBufferOffset, m.TargetInfoLen)
+	if info == nil {
 		return make([]byte, 0)
 	}
-	offset := m.BaseLen()
-	start := m.TargetInfoBufferOffset - offset
-	return m.Payload[start : start+uint32(m.TargetInfoLen)]
+	return info
 }
 
 func (m *ChallengeMessage) Serialize() []byte {
+	if m.raw != nil {
+		return m.raw
+	}
 	buff := &bytes.Buffer{}
 	struc.Pack(buff, m)
 	buff.Write(m.Payload)
@@ -134,7 +254,7 @@ func (m *ChallengeMessage) Serialize() []byte {
 
 func NewChallengeMessage() *ChallengeMessage {
 	return &ChallengeMessage{
-		Signature:   [8]byte{'N', 'T', 'L', 'M', 'S', 'S', 'P', 0x00},
+		Signature:   NTLM_SIGNATURE,
 		MessageType: 0x00000002,
 	}
 }
@@ -164,16 +284,79 @@ type AuthenticateMessage struct {
 	Version                            NVersion
 	MIC                                [16]byte
 	Payload                            []byte `struc:"skip"`
+	raw                                []byte
 }
 
+// decode an AUTHENTICATE message, Serialize gives back s
+func ReadAuthenticateMessage(s []byte) (*AuthenticateMessage, error) {
+	m := &AuthenticateMessage{}
+	if err := readMessageHeader(s, 0x00000003, 88, m); err != nil {
+		return nil, err
+	}
+	if len(s) < 64 {
+		return nil, errors.New("ntlm authenticate message too short")
+	}
+	// version and MIC are only there when the payload starts after them
+	start := uint32(len(s))
+	for _, offset := range []uint32{m.DomainNameBufferOffset, m.UserNameBufferOffset, m.WorkstationBufferOffset,
+		m.LmChallengeResponseBufferOffset, m.NtChallengeResponseBufferOffset, m.EncryptedRandomSessionBufferOffset} {
+		if offset >= 64 && offset < start {
+			start = offset
+		}
+	}
+	if start < 72 {
+		m.Version = NVersion{}
+	}
+	if start < 88 {
+		m.MIC = [16]byte{}
+	}
+	if start < m.BaseLen() {
+		m.Payload = s[start:]
+	} else {
+		m.Payload = s[m.BaseLen():]
+	}
+	m.raw = s
+	return m, nil
+}
+
+func (m *AuthenticateMessage) DomainName() string {
+	return UnicodeDecode(payloadField(m.Serialize(), m.DomainNameBufferOffset, m.DomainNameLen))
+}
+
+func (m *AuthenticateMessage) UserName() string {
+	return UnicodeDecode(payloadField(m.Serialize(), m.UserNameBufferOffset, m.UserNameLen))
+}
+
+func (m *AuthenticateMessage) Workstation() string {
+	return UnicodeDecode(payloadField(m.Serialize(), m.WorkstationBufferOffset, m.WorkstationLen))
+}
+
+func (m *AuthenticateMessage) LmChallengeResponse() []byte {
+	return payloadField(m.Serialize(), m.LmChallengeResponseBufferOffset, m.LmChallengeResponseLen)
+}
+
+func (m *AuthenticateMessage) NtChallengeResponse() []byte {
+	return payloadField(m.Serialize(), m.NtChallengeResponseBufferOffset, m.NtChallengeResponseLen)
+}
+
+func (m *AuthenticateMessage) EncryptedRandomSessionKey() []byte {
+	return payloadField(m.Serialize(), m.EncryptedRandomSessionBufferOffset, m.EncryptedRandomSessionLen)
+}
+
+// the version field is always there, zeroed without NTLMSSP_NEGOTIATE_VERSION, so the MIC offset is fixed
 func (m *AuthenticateMessage) BaseLen() uint32 {
 	return 88
 }
 
+// offset of the MIC field, it follows the version
+func (m *AuthenticateMessage) MICOffset() int {
+	return 72
+}
+
 func NewAuthenticateMessage(negFlag uint32, domain, user, workstation string,
 	lmchallResp, ntchallResp, enRandomSessKey []byte) *AuthenticateMessage {
 	msg := &AuthenticateMessage{
-		Signature:      [8]byte{'N', 'T', 'L', 'M', 'S', 'S', 'P', 0x00},
+		Signature:      NTLM_SIGNATURE,
 		MessageType:    0x00000003,
 		NegotiateFlags: negFlag,
 	}
@@ -181,28 +364,34 @@ func NewAuthenticateMessage(negFlag uint32, domain, user, workstation string,
 
 	domainBytes := UnicodeEncode(domain)
 	msg.DomainNameLen = uint16(len(domainBytes))
+	msg.DomainNameMaxLen = msg.DomainNameLen
 	msg.DomainNameBufferOffset = msg.BaseLen()
 	payloadBuff.Write(domainBytes)
 
 	userBytes := UnicodeEncode(user)
 	msg.UserNameLen = uint16(len(userBytes))
+	msg.UserNameMaxLen = msg.UserNameLen
 	msg.UserNameBufferOffset = msg.DomainNameBufferOffset + uint32(msg.DomainNameLen)
 	payloadBuff.Write(userBytes)
 
 	wsBytes := UnicodeEncode(workstation)
 	msg.WorkstationLen = uint16(len(wsBytes))
+	msg.WorkstationMaxLen = msg.WorkstationLen
 	msg.WorkstationBufferOffset = msg.UserNameBufferOffset + uint32(msg.UserNameLen)
 	payloadBuff.Write(wsBytes)
 
 	msg.LmChallengeResponseLen = uint16(len(lmchallResp))
+	msg.LmChallengeResponseMaxLen = msg.LmChallengeResponseLen
 	msg.LmChallengeResponseBufferOffset = msg.WorkstationBufferOffset + uint32(msg.WorkstationLen)
 	payloadBuff.Write(lmchallResp)
 
 	msg.NtChallengeResponseLen = uint16(len(ntchallResp))
+	msg.NtChallengeResponseMaxLen = msg.NtChallengeResponseLen
 	msg.NtChallengeResponseBufferOffset = msg.LmChallengeResponseBufferOffset + uint32(msg.LmChallengeResponseLen)
 	payloadBuff.Write(ntchallResp)
 
 	msg.EncryptedRandomSessionLen = uint16(len(enRandomSessKey))
+	msg.EncryptedRandomSessionMaxLen = msg.EncryptedRandomSessionLen
 	msg.EncryptedRandomSessionBufferOffset = msg.NtChallengeResponseBufferOffset + uint32(msg.NtChallengeResponseLen)
 	payloadBuff.Write(enRandomSessKey)
 
@@ -211,6 +400,9 @@ func NewAuthenticateMessage(negFlag uint32, domain, user, workstation string,
 }
 
 func (m *AuthenticateMessage) Serialize() []byte {
+	if m.raw != nil {
+		return m.raw
+	}
 	buff := &bytes.Buffer{}
 	struc.Pack(buff, m)
 	buff.Write(m.Payload)
@@ -218,32 +410,111 @@ func (m *AuthenticateMessage) Serialize() []byte {
 	return res
 }
 
+/**
+ * Response sent in the AUTHENTICATE message, it depends on the LM compatibility level
+ * and on the extended session security negotiated by the server
+ */
+type NTLMResponseType string
+
+const (
+	NTLM_RESPONSE_V2     NTLMResponseType = "NTLMv2"
+	NTLM_RESPONSE_V1_ESS NTLMResponseType = "NTLMv1-ESS"
+	NTLM_RESPONSE_V1     NTLMResponseType = "NTLMv1"
+)
+
 type NTLMv2 struct {
-	domain              string
-	user                string
-	password            string
-	respKeyNT           []byte
-	respKeyLM           []byte
-	negotiateMessage    *NegotiateMessage
-	challengeMessage    *ChallengeMessage
-	authenticateMessage *AuthenticateMessage
+	domain               string
+	user                 string
+	password             string
+	workstation          string
+	targetName           string
+	lmCompatibilityLevel int
+	responseType         NTLMResponseType
+	ntHash               []byte
+	lmHash               []byte
+	respKeyNT            []byte
+	respKeyLM            []byte
+	negotiateMessage     *NegotiateMessage
+	challengeMessage     *ChallengeMessage
+	authenticateMessage  *AuthenticateMessage
+	security             *NTLMSecurity
+	// a message of the server was unwrapped with the session key
+	accepted bool
 }
 
 func NewNTLMv2(domain, user, password string) *NTLMv2 {
 	return &NTLMv2{
-		domain:    domain,
-		user:      user,
-		password:  password,
-		respKeyNT: NTOWFv2(password, user, domain),
-		respKeyLM: LMOWFv2(password, user, domain),
+		domain:               domain,
+		user:                 user,
+		password:             password,
+		lmCompatibilityLevel: 3,
+		ntHash:               NTOWFv1(password),
+		lmHash:               LMOWFv1(password),
+		respKeyNT:            NTOWFv2(password, user, domain),
+		respKeyLM:            LMOWFv2(password, user, domain),
 	}
 }
 
+// pass the hash, ntHash is MD4(UNICODE(password))
+func NewNTLMv2FromHash(domain, user string, ntHash []byte) (*NTLMv2, error) {
+	if len(ntHash) != 16 {
+		return nil, fmt.Errorf("ntlm hash must be 16 bytes, got %d", len(ntHash))
+	}
+	return &NTLMv2{
+		domain:               domain,
+		user:                 user,
+		lmCompatibilityLevel: 3,
+		ntHash:               ntHash,
+		respKeyNT:            NTOWFv2FromHash(ntHash, user, domain),
+	}, nil
+}
+
+// workstation name sent in the NEGOTIATE and AUTHENTICATE messages
+func (n *NTLMv2) SetWorkstation(workstation string) {
+	n.workstation = workstation
+}
+
+// service principal name sent in MsvAvTargetName, TERMSRV/host
+func (n *NTLMv2) SetTargetName(spn string) {
+	n.targetName = spn
+}
+
+/**
+ * Client LmCompatibilityLevel, 3 and above only send NTLMv2 responses,
+ * below NTLMv1 responses are sent, with the LM response for 0 and 1
+ * @see https://docs.microsoft.com/en-us/windows/security/threat-protection/security-policy-settings/network-security-lan-manager-authentication-level
+ */
+func (n *NTLMv2) SetLmCompatibilityLevel(level int) {
+	n.lmCompatibilityLevel = level
+}
+
+/**
+ * Response type of the last AUTHENTICATE message sent, whether or not
+ * the server accepted it, see AcceptedResponseType
+ */
+func (n *NTLMv2) SentResponseType() NTLMResponseType {
+	return n.responseType
+}
+
+/**
+ * Response type of the last AUTHENTICATE message once the server
+ * proved it accepted it: a message it sealed with the session key of
+ * the response was unwrapped, as its pubKeyAuth in CredSSP. Empty
+ * until then
+ */
+func (n *NTLMv2) AcceptedResponseType() NTLMResponseType {
+	if !n.accepted {
+		return ""
+	}
+	return n.responseType
+}
+
 // generate first handshake messgae
 func (n *NTLMv2) GetNegotiateMessage() *NegotiateMessage {
 	negoMsg := NewNegotiateMessage()
 	negoMsg.NegotiateFlags = NTLMSSP_NEGOTIATE_KEY_EXCH |
 		NTLMSSP_NEGOTIATE_128 |
+		NTLMSSP_NEGOTIATE_VERSION |
 		NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY |
 		NTLMSSP_NEGOTIATE_ALWAYS_SIGN |
 		NTLMSSP_NEGOTIATE_NTLM |
@@ -251,6 +522,10 @@ func (n *NTLMv2) GetNegotiateMessage() *NegotiateMessage {
 		NTLMSSP_NEGOTIATE_SIGN |
 		NTLMSSP_REQUEST_TARGET |
 		NTLMSSP_NEGOTIATE_UNICODE
+	negoMsg.Varsion = NewNVersion()
+	if n.workstation != "" {
+		negoMsg.SetWorkstation(n.workstation)
+	}
 	n.negotiateMessage = negoMsg
 	return n.negotiateMessage
 }
@@ -284,6 +559,34 @@ func (n *NTLMv2) ComputeResponse(respKeyNT, respKeyLM, serverChallenge, clientCh
 	return
 }
 
+/**
+ * NTLMv1 responses, with extended session security the NTLM2 session response.
+ * lmHash is nil when the LM response must be a copy of the NT response
+ * @see https://msdn.microsoft.com/en-us/library/cc236699.aspx
+ */
+func ComputeResponseV1(ntHash, lmHash, serverChallenge, clientChallenge []byte, ess bool) (ntChallResp, lmChallResp, keyExchangeKey []byte) {
+	sessionBaseKey := MD4(ntHash)
+	if ess {
+		challenge := append(append([]byte{}, serverChallenge...), clientChallenge...)
+		ntChallResp = DESL(ntHash, MD5(challenge)[:8])
+		lmChallResp = append(append([]byte{}, clientChallenge...), make([]byte, 16)...)
+		keyExchangeKey = HMAC_MD5(sessionBaseKey, challenge)
+		return
+	}
+	ntChallResp = DESL(ntHash, serverChallenge)
+	if lmHash != nil {
+		lmChallResp = DESL(lmHash, serverChallenge)
+	} else {
+		lmChallResp = ntChallResp
+	}
+	keyExchangeKey = sessionBaseKey
+	return
+}
+
+/**
+ * HMAC_MD5 of the three messages, the MIC field of the authenticate message must be zero
+ * @see https://msdn.microsoft.com/en-us/library/cc236676.aspx
+ */
 func MIC(exportedSessionKey []byte, negotiateMessage, challengeMessage, authenticateMessage Message) []byte {
 	buff := bytes.Buffer{}
 	buff.Write(negotiateMessage.Serialize())
@@ -292,6 +595,20 @@ func MIC(exportedSessionKey []byte, negotiateMessage, challengeMessage, authenti
 	return HMAC_MD5(exportedSessionKey, buff.Bytes())
 }
 
+/**
+ * a random session key is only exchanged with NTLMSSP_NEGOTIATE_KEY_EXCH,
+ * otherwise the key exchange key is used as is
+ * @see https://msdn.microsoft.com/en-us/library/cc236676.aspx
+ */
+func sessionKey(flags uint32, keyExchangeKey []byte) (exportedSessionKey, encryptedRandomSessionKey []byte) {
+	if flags&NTLMSSP_NEGOTIATE_KEY_EXCH == 0 {
+		return keyExchangeKey, make([]byte, 0)
+	}
+	exportedSessionKey = make([]byte, 16)
+	rand.Read(exportedSessionKey)
+	return exportedSessionKey, RC4K(keyExchangeKey, exportedSessionKey)
+}
+
 func SIGNKEY(exportedSessionKey []byte, isClient bool) []byte {
 	buff := bytes.NewBuffer(exportedSessionKey)
 	if isClient {
@@ -302,31 +619,18 @@ func SIGNKEY(exportedSessionKey []byte, isClient bool) []byte {
 	return MD5(buff.Bytes())
 }
 
-func (n *NTLMv2) GetAuthenticateMessage(s []byte) *AuthenticateMessage {
-	challengeMsg := &ChallengeMessage{}
-	err := struc.Unpack(bytes.NewReader(s), challengeMsg)
-	if err != nil {
-		glog.Error("read challengeMsg", err)
-		return nil
-	}
-	challengeMsg.Payload = s[challengeMsg.BaseLen():]
-	n.challengeMessage = challengeMsg
-
-	serverName := challengeMsg.getTargetInfo()
-	//serverChallenge := n.challengeMessage.ServerChallenge[:]
-	clientChallenge := make([]byte, 64)
-	_, err = rand.Read(clientChallenge)
-	if err != nil {
-		glog.Error("read clientChallenge", err)
-		return nil
-	}
-
-	computeMIC := false
-	var timestamp []byte
-	avr := bytes.NewReader(serverName)
+/**
+ * AV pairs of the challenge echoed in the NTLMv2 response, MsvAvFlags
+ * announces the MIC when the server sent a timestamp and MsvAvTargetName
+ * carries the SPN of the service
+ * @see https://msdn.microsoft.com/en-us/library/cc236700.aspx
+ */
+func clientTargetInfo(serverInfo []byte, targetName string) (targetInfo, timestamp []byte) {
+	pairs := make([]*AVPair, 0)
+	avr := bytes.NewReader(serverInfo)
 	for {
 		av := &AVPair{}
-		if err = struc.Unpack(avr, av); err != nil {
+		if err := struc.Unpack(avr, av); err != nil {
 			glog.Error("read av", err)
 			break
 		}
@@ -335,43 +639,277 @@ func (n *NTLMv2) GetAuthenticateMessage(s []byte) *AuthenticateMessage {
 		}
 		if av.Id == MsvAvTimestamp {
 			timestamp = av.Value
-			computeMIC = true
-			break
 		}
+		if av.Id == MsvAvTargetName && targetName != "" {
+			continue
+		}
+		pairs = append(pairs, av)
 	}
-	if timestamp == nil {
-		glog.Error("todo timestamp not found")
-		return nil
+
+	if timestamp != nil {
+		var flags *AVPair
+		for _, av := range pairs {
+			if av.Id == MsvAvFlags && av.Len == 4 {
+				flags = av
+			}
+		}
+		if flags == nil {
+			flags = &AVPair{Id: MsvAvFlags, Len: 4, Value: make([]byte, 4)}
+			pairs = append(pairs, flags)
+		}
+		binary.LittleEndian.PutUint32(flags.Value, binary.LittleEndian.Uint32(flags.Value)|MSV_AV_FLAGS_MIC_PROVIDED)
+	}
+	if targetName != "" {
+		name := UnicodeEncode(targetName)
+		pairs = append(pairs, &AVPair{Id: MsvAvTargetName, Len: uint16(len(name)), Value: name})
 	}
 
-	//ntChallengeResponse, lmChallengeResponse, keyExchangeKey := n.ComputeResponse(
-	//	n.respKeyNT, n.respKeyLM, serverChallenge, clientChallenge, timestamp, serverName)
-	exportedSessionKey := make([]byte, 128)
-	rand.Read(exportedSessionKey)
-	//encryptedRandomSessionKey := RC4K(keyExchangeKey, exportedSessionKey)
+	buff := &bytes.Buffer{}
+	for _, av := range pairs {
+		struc.Pack(buff, av)
+	}
+	struc.Pack(buff, &AVPair{Id: MsvAvEOL})
+	return buff.Bytes(), timestamp
+}
+
+func (n *NTLMv2) GetAuthenticateMessage(s []byte) (*AuthenticateMessage, error) {
+	challengeMsg, err := ReadChallengeMessage(s)
+	if err != nil {
+		glog.Error("read challengeMsg", err)
+		return nil, err
+	}
+	n.challengeMessage = challengeMsg
+	n.accepted = false
+
+	serverChallenge := challengeMsg.ServerChallenge[:]
+	clientChallenge := make([]byte, 8)
+	_, err = rand.Read(clientChallenge)
+	if err != nil {
+		glog.Error("read clientChallenge", err)
+		return nil, err
+	}
+
+	if n.lmCompatibilityLevel < 3 {
+		return n.getAuthenticateMessageV1(challengeMsg, clientChallenge)
+	}
+
+	// the server clock is preferred, the MIC is only sent along its timestamp
+	targetInfo, timestamp := clientTargetInfo(challengeMsg.TargetInfo(), n.targetName)
+	computeMIC := timestamp != nil
+	if !computeMIC {
+		timestamp = TimeToFiletime(timeNow())
+	}
+
+	// the NTLMv2 client challenge ends with 4 zero bytes after the AV pairs
+	serverName := append(targetInfo, 0x00, 0x00, 0x00, 0x00)
+	ntChallengeResponse, lmChallengeResponse, keyExchangeKey := n.ComputeResponse(
+		n.respKeyNT, n.respKeyLM, serverChallenge, clientChallenge, timestamp, serverName)
+	// the MIC replaces the LMv2 response, hash mode has no respKeyLM
+	if computeMIC || n.respKeyLM == nil {
+		lmChallengeResponse = make([]byte, 24)
+	}
+	exportedSessionKey, encryptedRandomSessionKey := sessionKey(challengeMsg.NegotiateFlags, keyExchangeKey)
 
 	n.authenticateMessage = NewAuthenticateMessage(challengeMsg.NegotiateFlags,
-		n.domain, n.user, "", nil, nil, nil)
+		n.domain, n.user, n.workstation, lmChallengeResponse, ntChallengeResponse, encryptedRandomSessionKey)
+	if challengeMsg.NegotiateFlags&NTLMSSP_NEGOTIATE_VERSION != 0 {
+		n.authenticateMessage.Version = NewNVersion()
+	}
 
 	if computeMIC {
-		copy(n.authenticateMessage.MIC[:], MIC(exportedSessionKey, n.negotiateMessage, n.challengeMessage, n.authenticateMessage)[:16])
+		copy(n.authenticateMessage.MIC[:], MIC(exportedSessionKey, n.negotiateMessage, n.challengeMessage, n.authenticateMessage))
 	}
 
-	// self._authenticateMessage = createAuthenticationMessage(challengeMessage.NegotiateFlags.value,
-	// domain, user, NtChallengeResponse, LmChallengeResponse, EncryptedRandomSessionKey, "")
+	n.responseType = NTLM_RESPONSE_V2
+	n.security = newNTLMSecurity(challengeMsg.NegotiateFlags, exportedSessionKey)
+	return n.authenticateMessage, nil
+}
 
-	//jj, _ := json.Marshal(challengeMsg)
-	//fmt.Println(string(jj))
-	//
-	//fmt.Println("Payload", string(challengeMsg.Payload[:]))
+/**
+ * NTLMv1 responses carry no AV pairs, there is no MIC. The NTLM2 session
+ * response goes with extended session security, the plain NTLMv1 and LM
+ * ones without
+ */
+func (n *NTLMv2) getAuthenticateMessageV1(challengeMsg *ChallengeMessage, clientChallenge []byte) (*AuthenticateMessage, error) {
+	ess := challengeMsg.NegotiateFlags&NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY != 0
+	// the key exchange key would then come from the LM hash, it is not requested
+	if !ess && challengeMsg.NegotiateFlags&NTLMSSP_NEGOTIATE_LM_KEY != 0 {
+		return nil, errors.New("ntlm v1 with NTLMSSP_NEGOTIATE_LM_KEY is not supported")
+	}
+	lmHash := n.lmHash
+	if n.lmCompatibilityLevel >= 2 {
+		lmHash = nil
+	}
+	ntChallengeResponse, lmChallengeResponse, keyExchangeKey := ComputeResponseV1(
+		n.ntHash, lmHash, challengeMsg.ServerChallenge[:], clientChallenge, ess)
+	exportedSessionKey, encryptedRandomSessionKey := sessionKey(challengeMsg.NegotiateFlags, keyExchangeKey)
 
-	os.Exit(0)
+	n.authenticateMessage = NewAuthenticateMessage(challengeMsg.NegotiateFlags,
+		n.domain, n.user, n.workstation, lmChallengeResponse, ntChallengeResponse, encryptedRandomSessionKey)
+	if challengeMsg.NegotiateFlags&NTLMSSP_NEGOTIATE_VERSION != 0 {
+		n.authenticateMessage.Version = NewNVersion()
+	}
+
+	n.responseType = NTLM_RESPONSE_V1
+	if ess {
+		n.responseType = NTLM_RESPONSE_V1_ESS
+	}
+	n.security = newNTLMSecurity(challengeMsg.NegotiateFlags, exportedSessionKey)
+	return n.authenticateMessage, nil
+}
+
+// Authenticator interface, NTLM is complete once the AUTHENTICATE message is built
+func (n *NTLMv2) InitSecContext(in []byte) ([]byte, bool, error) {
+	if in == nil {
+		return n.GetNegotiateMessage().Serialize(), false, nil
+	}
+	msg, err := n.GetAuthenticateMessage(in)
+	if err != nil {
+		return nil, false, err
+	}
+	return msg.Serialize(), true, nil
+}
 
-	//
-	//
-	//
-	//n.authenticateMessage = NewAuthenticateMessage()
-	// todo
+func (n *NTLMv2) Wrap(data []byte) ([]byte, error) {
+	if n.security == nil {
+		return nil, errors.New("ntlm context not established")
+	}
+	return n.security.GssEncrypt(data), nil
+}
+
+func (n *NTLMv2) Unwrap(data []byte) ([]byte, error) {
+	if n.security == nil {
+		return nil, errors.New("ntlm context not established")
+	}
+	plain, err := n.security.GssDecrypt(data)
+	if err == nil {
+		n.accepted = true
+	}
+	return plain, err
+}
+
+func SEALKEY(exportedSessionKey []byte, isClient bool) []byte {
+	buff := bytes.NewBuffer(exportedSessionKey)
+	if isClient {
+		buff.WriteString("session key to client-to-server sealing key magic constant\x00")
+	} else {
+		buff.WriteString("session key to server-to-client sealing key magic constant\x00")
+	}
+	return MD5(buff.Bytes())
+}
 
-	return n.authenticateMessage
+/**
+ * the sealing key is weakened to 56 or 40 bits unless NTLMSSP_NEGOTIATE_128 is set.
+ * Without extended session security it is the session key, both directions alike,
+ * as NTLMSSP_NEGOTIATE_LM_KEY is never negotiated
+ * @see https://msdn.microsoft.com/en-us/library/cc236711.aspx
+ */
+func sealKey(flags uint32, exportedSessionKey []byte, isClient bool) []byte {
+	if flags&NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY == 0 {
+		return exportedSessionKey
+	}
+	if flags&NTLMSSP_NEGOTIATE_128 != 0 {
+		return SEALKEY(exportedSessionKey, isClient)
+	}
+	if flags&NTLMSSP_NEGOTIATE_56 != 0 {
+		return SEALKEY(exportedSessionKey[:7], isClient)
+	}
+	return SEALKEY(exportedSessionKey[:5], isClient)
+}
+
+/**
+ * NTLM session security, each direction keeps its RC4 handle and
+ * sequence number for the whole session
+ * @see https://msdn.microsoft.com/en-us/library/cc236702.aspx
+ */
+type NTLMSecurity struct {
+	encryptHandle *rc4.Cipher
+	decryptHandle *rc4.Cipher
+	signingKey    []byte
+	verifyKey     []byte
+	seqNum        uint32
+	recvSeqNum    uint32
+	// the checksum is only sealed with NTLMSSP_NEGOTIATE_KEY_EXCH
+	keyExch bool
+	// NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY, else the MAC is a CRC32
+	ess bool
+}
+
+func newNTLMSecurity(flags uint32, exportedSessionKey []byte) *NTLMSecurity {
+	encryptHandle, _ := rc4.NewCipher(sealKey(flags, exportedSessionKey, true))
+	decryptHandle, _ := rc4.NewCipher(sealKey(flags, exportedSessionKey, false))
+	return &NTLMSecurity{
+		encryptHandle: encryptHandle,
+		decryptHandle: decryptHandle,
+		signingKey:    SIGNKEY(exportedSessionKey, true),
+		verifyKey:     SIGNKEY(exportedSessionKey, false),
+		keyExch:       flags&NTLMSSP_NEGOTIATE_KEY_EXCH != 0,
+		ess:           flags&NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY != 0,
+	}
+}
+
+/**
+ * MAC with extended session security
+ * @see https://msdn.microsoft.com/en-us/library/cc236703.aspx
+ */
+func (n *NTLMSecurity) mac(handle *rc4.Cipher, key []byte, seqNum uint32, data []byte) []byte {
+	if !n.ess {
+		return macV1(handle, seqNum, data)
+	}
+	seq := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seq, seqNum)
+	checksum := HMAC_MD5(key, append(seq, data...))[:8]
+	if n.keyExch {
+		handle.XORKeyStream(checksum, checksum)
+	}
+
+	signature := make([]byte, 0, 16)
+	signature = append(signature, 0x01, 0x00, 0x00, 0x00)
+	signature = append(signature, checksum...)
+	return append(signature, seq...)
+}
+
+/**
+ * MAC without extended session security, the random pad is sealed then
+ * sent as zero
+ * @see https://msdn.microsoft.com/en-us/library/cc236702.aspx
+ */
+func macV1(handle *rc4.Cipher, seqNum uint32, data []byte) []byte {
+	fields := make([]byte, 12)
+	binary.LittleEndian.PutUint32(fields[4:], crc32.ChecksumIEEE(data))
+	handle.XORKeyStream(fields, fields)
+	binary.LittleEndian.PutUint32(fields[8:], binary.LittleEndian.Uint32(fields[8:])^seqNum)
+
+	signature := make([]byte, 0, 16)
+	signature = append(signature, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	return append(signature, fields[4:]...)
+}
+
+// signature followed by the sealed data
+func (n *NTLMSecurity) GssEncrypt(data []byte) []byte {
+	sealed := make([]byte, len(data))
+	n.encryptHandle.XORKeyStream(sealed, data)
+	signature := n.mac(n.encryptHandle, n.signingKey, n.seqNum, data)
+	n.seqNum++
+	return append(signature, sealed...)
+}
+
+func (n *NTLMSecurity) GssDecrypt(data []byte) ([]byte, error) {
+	if len(data) < 16 {
+		return nil, errors.New("ntlm sealed message too short")
+	}
+	signature, sealed := data[:16], data[16:]
+	plain := make([]byte, len(sealed))
+	n.decryptHandle.XORKeyStream(plain, sealed)
+	// the server numbers its messages on its own, a replayed or dropped one breaks the MAC
+	expected := n.mac(n.decryptHandle, n.verifyKey, n.recvSeqNum, plain)
+	n.recvSeqNum++
+	if !n.ess {
+		// the random pad of the server is not checked
+		expected, signature = expected[8:], signature[8:]
+	}
+	if !bytes.Equal(expected, signature) {
+		return nil, errors.New("ntlm message signature mismatch")
+	}
+	return plain, nil
 }
@@ -2,10 +2,12 @@ package nla_test
 
 import (
 	"bytes"
+	"crypto/rc4"
 	"encoding/hex"
 	"github.com/icodeface/grdp/protocol/nla"
 	"github.com/lunixbochs/struc"
 	"testing"
+	"time"
 )
 
 func TestNewNegotiateMessage(t *testing.T) {
@@ -15,7 +17,7 @@ func TestNewNegotiateMessage(t *testing.T) {
 	struc.Pack(buff, negoMsg)
 
 	result := hex.EncodeToString(buff.Bytes())
-	expected := "4e544c4d535350000100000035820860000000000000000000000000000000000000000000000000"
+	expected := "4e544c4d535350000100000035820862000000000000000000000000000000000a0067580000000f"
 
 	if result != expected {
 		t.Error(result, " not equals to", expected)
@@ -59,3 +61,576 @@ func TestSIGNKEY(t *testing.T) {
 		t.Error(result, "not equal to", expected)
 	}
 }
+
+// MS-NLMP 4.2.4 NTLMv2 authentication
+func TestNTLMv2_MSNLMPVectors(t *testing.T) {
+	respKey := nla.NTOWFv2("Password", "User", "Domain")
+	if result := hex.EncodeToString(respKey); result != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Error(result, "not equal to", "0c868a403bfd7a93a3001ef22ef02e3f")
+	}
+
+	ntlm := nla.NewNTLMv2("Domain", "User", "Password")
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge, _ := hex.DecodeString("aaaaaaaaaaaaaaaa")
+	timestamp := make([]byte, 8)
+	serverName, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c005300650072007600650072000000000000000000")
+
+	ntChallResp, lmChallResp, sessionBaseKey := ntlm.ComputeResponse(respKey, respKey, serverChallenge, clientChallenge, timestamp, serverName)
+
+	expected := map[string]string{
+		"NTProofStr":          "68cd0ab851e51c96aabc927bebef6a1c",
+		"LmChallengeResponse": "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa",
+		"SessionBaseKey":      "8de40ccadbc14a82f15cb0ad0de95ca3",
+	}
+	result := map[string]string{
+		"NTProofStr":          hex.EncodeToString(ntChallResp[:16]),
+		"LmChallengeResponse": hex.EncodeToString(lmChallResp),
+		"SessionBaseKey":      hex.EncodeToString(sessionBaseKey),
+	}
+	for name := range expected {
+		if result[name] != expected[name] {
+			t.Error(name, result[name], "not equal to", expected[name])
+		}
+	}
+
+	randomSessionKey, _ := hex.DecodeString("55555555555555555555555555555555")
+	encrypted := hex.EncodeToString(nla.RC4K(sessionBaseKey, randomSessionKey))
+	if encrypted != "c5dad2544fc9799094ce1ce90bc9d03e" {
+		t.Error(encrypted, "not equal to", "c5dad2544fc9799094ce1ce90bc9d03e")
+	}
+}
+
+func TestNTLMv2_MIC(t *testing.T) {
+	ntlm := nla.NewNTLMv2("Domain", "User", "Password")
+	negotiate := ntlm.GetNegotiateMessage().Serialize()
+
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c00530065007200760065007200070008000090d336b734c30100000000")
+	challengeMsg := nla.NewChallengeMessage()
+	challengeMsg.NegotiateFlags = 0xe28a8235
+	copy(challengeMsg.ServerChallenge[:], []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef})
+	challengeMsg.TargetInfoLen = uint16(len(targetInfo))
+	challengeMsg.TargetInfoMaxLen = challengeMsg.TargetInfoLen
+	challengeMsg.TargetInfoBufferOffset = challengeMsg.BaseLen()
+	challengeMsg.Payload = targetInfo
+	challenge := challengeMsg.Serialize()
+
+	authMsg, err := ntlm.GetAuthenticateMessage(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authMsg.Serialize()
+
+	if authMsg.NtChallengeResponseMaxLen != authMsg.NtChallengeResponseLen ||
+		authMsg.EncryptedRandomSessionMaxLen != authMsg.EncryptedRandomSessionLen {
+		t.Error("max len not equal to len")
+	}
+	if !bytes.Equal(auth[authMsg.LmChallengeResponseBufferOffset:authMsg.NtChallengeResponseBufferOffset], make([]byte, 24)) {
+		t.Error("LmChallengeResponse must be zero when a MIC is sent")
+	}
+	ntChallResp := auth[authMsg.NtChallengeResponseBufferOffset : authMsg.NtChallengeResponseBufferOffset+uint32(authMsg.NtChallengeResponseLen)]
+	msvAvFlags, _ := hex.DecodeString("0600040002000000")
+	if !bytes.Contains(ntChallResp, msvAvFlags) {
+		t.Error("MsvAvFlags not set in", hex.EncodeToString(ntChallResp))
+	}
+
+	sessionBaseKey := nla.HMAC_MD5(nla.NTOWFv2("Password", "User", "Domain"), ntChallResp[:16])
+	encryptedKey := auth[authMsg.EncryptedRandomSessionBufferOffset : authMsg.EncryptedRandomSessionBufferOffset+16]
+	exportedSessionKey := nla.RC4K(sessionBaseKey, encryptedKey)
+
+	offset := authMsg.MICOffset()
+	mic := append([]byte{}, auth[offset:offset+16]...)
+	zeroed := append([]byte{}, auth...)
+	copy(zeroed[offset:offset+16], make([]byte, 16))
+	data := append(append(append([]byte{}, negotiate...), challenge...), zeroed...)
+	if expected := nla.HMAC_MD5(exportedSessionKey, data); !bytes.Equal(mic, expected) {
+		t.Error(hex.EncodeToString(mic), "not equal to", hex.EncodeToString(expected))
+	}
+}
+
+func TestNewNTLMv2FromHash(t *testing.T) {
+	if _, err := nla.NewNTLMv2FromHash("Domain", "User", make([]byte, 15)); err == nil {
+		t.Error("short hash accepted")
+	}
+
+	ntHash := nla.MD4(nla.UnicodeEncode("Password"))
+	if result, expected := nla.NTOWFv2FromHash(ntHash, "User", "Domain"), nla.NTOWFv2("Password", "User", "Domain"); !bytes.Equal(result, expected) {
+		t.Error(hex.EncodeToString(result), "not equal to", hex.EncodeToString(expected))
+	}
+
+	ntlm, err := nla.NewNTLMv2FromHash("Domain", "User", ntHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ntlm.GetNegotiateMessage()
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c00530065007200760065007200070008000090d336b734c30100000000")
+	challengeMsg := nla.NewChallengeMessage()
+	challengeMsg.NegotiateFlags = 0xe28a8235
+	challengeMsg.TargetInfoLen = uint16(len(targetInfo))
+	challengeMsg.TargetInfoBufferOffset = challengeMsg.BaseLen()
+	challengeMsg.Payload = targetInfo
+	authMsg, err := ntlm.GetAuthenticateMessage(challengeMsg.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := authMsg.Serialize()
+
+	// the password path must produce the same NTProofStr for the same blob
+	ntChallResp := auth[authMsg.NtChallengeResponseBufferOffset : authMsg.NtChallengeResponseBufferOffset+uint32(authMsg.NtChallengeResponseLen)]
+	ntProof := nla.HMAC_MD5(nla.NTOWFv2("Password", "User", "Domain"), append(challengeMsg.ServerChallenge[:], ntChallResp[16:]...))
+	if !bytes.Equal(ntProof, ntChallResp[:16]) {
+		t.Error("NTProofStr differs from the password computation")
+	}
+	if !bytes.Equal(auth[authMsg.LmChallengeResponseBufferOffset:authMsg.LmChallengeResponseBufferOffset+24], make([]byte, 24)) {
+		t.Error("LmChallengeResponse must be zero in hash mode")
+	}
+}
+
+func TestNegotiateMessageWorkstation(t *testing.T) {
+	cases := map[uint32]string{
+		// with version
+		nla.NTLMSSP_NEGOTIATE_VERSION: "4e544c4d535350000100000000200002000000000000000003000300280000000000000000000000575330",
+		// without version
+		0: "4e544c4d53535000010000000020000000000000000000000300030020000000575330",
+	}
+	for flags, expected := range cases {
+		negoMsg := nla.NewNegotiateMessage()
+		negoMsg.NegotiateFlags = flags
+		negoMsg.SetWorkstation("WS0")
+		result := negoMsg.Serialize()
+		if int(negoMsg.WorkstationBufferOffset)+int(negoMsg.WorkstationLen) != len(result) ||
+			string(result[negoMsg.WorkstationBufferOffset:]) != "WS0" {
+			t.Error("workstation offset", negoMsg.WorkstationBufferOffset, "inconsistent with", hex.EncodeToString(result))
+		}
+		if hex.EncodeToString(result) != expected {
+			t.Error(hex.EncodeToString(result), "not equal to", expected)
+		}
+	}
+}
+
+func TestAuthenticateMessageOffsets(t *testing.T) {
+	for _, workstation := range []string{"", "WS0"} {
+		authMsg := nla.NewAuthenticateMessage(nla.NTLMSSP_NEGOTIATE_VERSION, "Domain", "User", workstation,
+			make([]byte, 24), make([]byte, 48), make([]byte, 16))
+		result := authMsg.Serialize()
+		fields := []struct {
+			name   string
+			offset uint32
+			len    uint16
+			value  []byte
+		}{
+			{"domain", authMsg.DomainNameBufferOffset, authMsg.DomainNameLen, nla.UnicodeEncode("Domain")},
+			{"user", authMsg.UserNameBufferOffset, authMsg.UserNameLen, nla.UnicodeEncode("User")},
+			{"workstation", authMsg.WorkstationBufferOffset, authMsg.WorkstationLen, nla.UnicodeEncode(workstation)},
+			{"lm", authMsg.LmChallengeResponseBufferOffset, authMsg.LmChallengeResponseLen, make([]byte, 24)},
+			{"nt", authMsg.NtChallengeResponseBufferOffset, authMsg.NtChallengeResponseLen, make([]byte, 48)},
+			{"session key", authMsg.EncryptedRandomSessionBufferOffset, authMsg.EncryptedRandomSessionLen, make([]byte, 16)},
+		}
+		end := authMsg.BaseLen()
+		for _, f := range fields {
+			if f.offset != end || !bytes.Equal(result[f.offset:f.offset+uint32(f.len)], f.value) {
+				t.Error(workstation, f.name, "at", f.offset, "expected at", end)
+			}
+			end = f.offset + uint32(f.len)
+		}
+		if int(end) != len(result) {
+			t.Error("payload ends at", end, "message length", len(result))
+		}
+	}
+}
+
+func TestNTLMv2_TargetName(t *testing.T) {
+	for _, host := range []string{"rdp.corp.local:3389", "10.0.0.1:3389", "[2001:db8::1]:3389"} {
+		spn := nla.TermSrvSPN(host)
+		ntlm := nla.NewNTLMv2("Domain", "User", "Password")
+		ntlm.SetTargetName(spn)
+		ntlm.GetNegotiateMessage()
+
+		targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c00530065007200760065007200070008000090d336b734c30100000000")
+		challengeMsg := nla.NewChallengeMessage()
+		challengeMsg.NegotiateFlags = 0xe28a8235
+		challengeMsg.TargetInfoLen = uint16(len(targetInfo))
+		challengeMsg.TargetInfoBufferOffset = challengeMsg.BaseLen()
+		challengeMsg.Payload = targetInfo
+		authMsg, err := ntlm.GetAuthenticateMessage(challengeMsg.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth := authMsg.Serialize()
+		ntChallResp := auth[authMsg.NtChallengeResponseBufferOffset : authMsg.NtChallengeResponseBufferOffset+uint32(authMsg.NtChallengeResponseLen)]
+
+		name := nla.UnicodeEncode(spn)
+		pair := &bytes.Buffer{}
+		struc.Pack(pair, &nla.AVPair{Id: nla.MsvAvTargetName, Len: uint16(len(name)), Value: name})
+		// target name pair then MsvAvEOL and the 4 zero bytes closing the blob
+		if !bytes.HasSuffix(ntChallResp, append(pair.Bytes(), make([]byte, 8)...)) {
+			t.Error(host, "MsvAvTargetName", spn, "not found in", hex.EncodeToString(ntChallResp))
+		}
+	}
+}
+
+// MS-NLMP 4.2.2 and 4.2.3 NTLMv1 authentication
+func TestComputeResponseV1(t *testing.T) {
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge, _ := hex.DecodeString("aaaaaaaaaaaaaaaa")
+	randomSessionKey, _ := hex.DecodeString("55555555555555555555555555555555")
+	ntHash := nla.NTOWFv1("Password")
+
+	cases := []struct {
+		name   string
+		lmHash []byte
+		ess    bool
+		nt     string
+		lm     string
+		encKey string
+	}{
+		{"NTLMv1", nla.LMOWFv1("Password"), false,
+			"67c43011f30298a2ad35ece64f16331c44bdbed927841f94",
+			"98def7b87f88aa5dafe2df779688a172def11c7d5ccdef13",
+			"518822b1b3f350c8958682ecbb3e3cb7"},
+		{"NTLMv1 without LM", nil, false,
+			"67c43011f30298a2ad35ece64f16331c44bdbed927841f94",
+			"67c43011f30298a2ad35ece64f16331c44bdbed927841f94",
+			"518822b1b3f350c8958682ecbb3e3cb7"},
+		{"NTLMv1 with ESS", nla.LMOWFv1("Password"), true,
+			"7537f803ae367128ca458204bde7caf81e97ed2683267232",
+			"aaaaaaaaaaaaaaaa00000000000000000000000000000000",
+			""},
+	}
+	for _, c := range cases {
+		nt, lm, keyExchangeKey := nla.ComputeResponseV1(ntHash, c.lmHash, serverChallenge, clientChallenge, c.ess)
+		if hex.EncodeToString(nt) != c.nt {
+			t.Error(c.name, "NtChallengeResponse", hex.EncodeToString(nt), "not equal to", c.nt)
+		}
+		if hex.EncodeToString(lm) != c.lm {
+			t.Error(c.name, "LmChallengeResponse", hex.EncodeToString(lm), "not equal to", c.lm)
+		}
+		if c.ess {
+			if result := hex.EncodeToString(keyExchangeKey); result != "eb93429a8bd952f8b89c55b87f475edc" {
+				t.Error(c.name, "KeyExchangeKey", result)
+			}
+		} else if result := hex.EncodeToString(nla.RC4K(keyExchangeKey, randomSessionKey)); result != c.encKey {
+			t.Error(c.name, "EncryptedRandomSessionKey", result, "not equal to", c.encKey)
+		}
+	}
+}
+
+func TestNTLMv2_LmCompatibilityLevel(t *testing.T) {
+	tests := []struct {
+		level    int
+		ess      bool
+		expected nla.NTLMResponseType
+	}{
+		{1, true, nla.NTLM_RESPONSE_V1_ESS},
+		{1, false, nla.NTLM_RESPONSE_V1},
+		{3, true, nla.NTLM_RESPONSE_V2},
+		{3, false, nla.NTLM_RESPONSE_V2},
+	}
+	for _, test := range tests {
+		ntlm := nla.NewNTLMv2("Domain", "User", "Password")
+		ntlm.SetLmCompatibilityLevel(test.level)
+		ntlm.GetNegotiateMessage()
+		targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c00530065007200760065007200070008000090d336b734c30100000000")
+		challengeMsg := nla.NewChallengeMessage()
+		challengeMsg.NegotiateFlags = 0xe28a8235
+		if !test.ess {
+			challengeMsg.NegotiateFlags &^= nla.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY
+		}
+		challengeMsg.TargetInfoLen = uint16(len(targetInfo))
+		challengeMsg.TargetInfoBufferOffset = challengeMsg.BaseLen()
+		challengeMsg.Payload = targetInfo
+		authMsg, err := ntlm.GetAuthenticateMessage(challengeMsg.Serialize())
+		if err != nil {
+			t.Fatal(test.level, test.ess, err)
+		}
+		if ntlm.SentResponseType() != test.expected {
+			t.Error(test.level, test.ess, ntlm.SentResponseType(), "not equal to", test.expected)
+		}
+		if test.level < 3 && authMsg.NtChallengeResponseLen != 24 {
+			t.Error("NTLMv1 response length", authMsg.NtChallengeResponseLen)
+		}
+		// nothing of the server was unwrapped yet
+		if ntlm.AcceptedResponseType() != "" {
+			t.Error(test.level, test.ess, "accepted", ntlm.AcceptedResponseType())
+		}
+	}
+
+	// a CRC32 MAC has no direction, the client side seals as the server does
+	ntlm := nla.NewNTLMv2("Domain", "User", "Password")
+	ntlm.SetLmCompatibilityLevel(1)
+	ntlm.GetNegotiateMessage()
+	challengeMsg := nla.NewChallengeMessage()
+	challengeMsg.NegotiateFlags = 0xa2028235
+	if _, err := ntlm.GetAuthenticateMessage(challengeMsg.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	server := nla.NewNTLMSecurity(challengeMsg.NegotiateFlags, nla.MD4(nla.NTOWFv1("Password")))
+	if plain, err := ntlm.Unwrap(server.GssEncrypt([]byte("pubKeyAuth"))); err != nil || string(plain) != "pubKeyAuth" {
+		t.Error(plain, err)
+	}
+	if ntlm.AcceptedResponseType() != nla.NTLM_RESPONSE_V1 {
+		t.Error(ntlm.AcceptedResponseType(), "not equal to", nla.NTLM_RESPONSE_V1)
+	}
+}
+
+func TestNTLMv2_Timestamp(t *testing.T) {
+	// a local clock far from the server one
+	skewed := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	nla.SetTimeNow(func() time.Time { return skewed })
+	defer nla.SetTimeNow(time.Now)
+
+	withTimestamp, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c00530065007200760065007200070008000090d336b734c30100000000")
+	withoutTimestamp, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+	cases := []struct {
+		targetInfo []byte
+		timestamp  string
+		mic        bool
+	}{
+		{withTimestamp, "0090d336b734c301", true},
+		{withoutTimestamp, hex.EncodeToString(nla.TimeToFiletime(skewed)), false},
+	}
+	for _, c := range cases {
+		ntlm := nla.NewNTLMv2("Domain", "User", "Password")
+		ntlm.GetNegotiateMessage()
+		challengeMsg := nla.NewChallengeMessage()
+		challengeMsg.NegotiateFlags = 0xe28a8235
+		challengeMsg.TargetInfoLen = uint16(len(c.targetInfo))
+		challengeMsg.TargetInfoBufferOffset = challengeMsg.BaseLen()
+		challengeMsg.Payload = c.targetInfo
+		authMsg, err := ntlm.GetAuthenticateMessage(challengeMsg.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth := authMsg.Serialize()
+		ntChallResp := auth[authMsg.NtChallengeResponseBufferOffset : authMsg.NtChallengeResponseBufferOffset+uint32(authMsg.NtChallengeResponseLen)]
+
+		// NTProofStr, RespType, HiRespType, Reserved1, Reserved2 then the timestamp
+		if result := hex.EncodeToString(ntChallResp[24:32]); result != c.timestamp {
+			t.Error("timestamp", result, "not equal to", c.timestamp)
+		}
+		msvAvFlags, _ := hex.DecodeString("0600040002000000")
+		if bytes.Contains(ntChallResp, msvAvFlags) != c.mic {
+			t.Error("MsvAvFlags expected", c.mic)
+		}
+		if (authMsg.MIC != [16]byte{}) != c.mic {
+			t.Error("MIC expected", c.mic)
+		}
+	}
+
+	ft := nla.TimeToFiletime(skewed)
+	if !nla.FiletimeToTime(ft).Equal(skewed) {
+		t.Error(nla.FiletimeToTime(ft), "not equal to", skewed)
+	}
+}
+
+// MS-NLMP 4.2.4.3 CHALLENGE_MESSAGE, flags 0xe28a8233:
+// 56, KEY_EXCH, 128, VERSION, TARGET_INFO, EXTENDED_SESSIONSECURITY,
+// TARGET_TYPE_SERVER, ALWAYS_SIGN, NTLM, SEAL, SIGN, OEM, UNICODE
+func TestReadChallengeMessage(t *testing.T) {
+	data, _ := hex.DecodeString("4e544c4d53535000020000000c000c003800000033828ae20123456789abcdef00000000000000002400240044000000060070170000000f53006500720076006500720002000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+	challengeMsg, err := nla.ReadChallengeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challengeMsg.NegotiateFlags != 0xe28a8233 {
+		t.Errorf("flags %x", challengeMsg.NegotiateFlags)
+	}
+	if result := hex.EncodeToString(challengeMsg.ServerChallenge[:]); result != "0123456789abcdef" {
+		t.Error(result, "not equal to", "0123456789abcdef")
+	}
+	if challengeMsg.TargetName() != "Server" {
+		t.Error(challengeMsg.TargetName(), "not equal to", "Server")
+	}
+	if result := hex.EncodeToString(challengeMsg.TargetInfo()); result != "02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000" {
+		t.Error("target info", result)
+	}
+	if challengeMsg.Version.ProductMajorVersion != 6 || challengeMsg.Version.ProductBuild != 6000 {
+		t.Error("version", challengeMsg.Version)
+	}
+	if !bytes.Equal(challengeMsg.Serialize(), data) {
+		t.Error("Serialize does not give back the message")
+	}
+
+	// encoding the decoded fields gives the same message
+	encoded := nla.NewChallengeMessage()
+	encoded.NegotiateFlags = challengeMsg.NegotiateFlags
+	encoded.ServerChallenge = challengeMsg.ServerChallenge
+	encoded.TargetNameLen, encoded.TargetNameMaxLen = challengeMsg.TargetNameLen, challengeMsg.TargetNameMaxLen
+	encoded.TargetNameBufferOffset = challengeMsg.TargetNameBufferOffset
+	encoded.TargetInfoLen, encoded.TargetInfoMaxLen = challengeMsg.TargetInfoLen, challengeMsg.TargetInfoMaxLen
+	encoded.TargetInfoBufferOffset = challengeMsg.TargetInfoBufferOffset
+	encoded.Version = challengeMsg.Version
+	encoded.Payload = challengeMsg.Payload
+	if result := hex.EncodeToString(encoded.Serialize()); result != hex.EncodeToString(data) {
+		t.Error(result, "not equal to", hex.EncodeToString(data))
+	}
+}
+
+// MS-NLMP 4.2.4.3 AUTHENTICATE_MESSAGE, flags 0xe28a8235: as the CHALLENGE
+// with REQUEST_TARGET instead of OEM. The payload starts right after the
+// version, the example carries no MIC
+func TestReadAuthenticateMessage(t *testing.T) {
+	data, _ := hex.DecodeString("4e544c4d5353500003000000" +
+		"180018006c000000" + "5400540084000000" + "0c000c0048000000" +
+		"0800080054000000" + "100010005c000000" + "10001000d8000000" +
+		"35828ae2" + "0501280a0000000f" +
+		"44006f006d00610069006e00" + "5500730065007200" + "43004f004d0050005500540045005200" +
+		"86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" +
+		"68cd0ab851e51c96aabc927bebef6a1c01010000000000000000000000000000aaaaaaaaaaaaaaaa00000000" +
+		"02000c0044006f006d00610069006e0001000c005300650072007600650072000000000000000000" +
+		"c5dad2544fc9799094ce1ce90bc9d03e")
+	authMsg, err := nla.ReadAuthenticateMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authMsg.NegotiateFlags != 0xe28a8235 {
+		t.Errorf("flags %x", authMsg.NegotiateFlags)
+	}
+	if authMsg.DomainName() != "Domain" || authMsg.UserName() != "User" || authMsg.Workstation() != "COMPUTER" {
+		t.Error("names", authMsg.DomainName(), authMsg.UserName(), authMsg.Workstation())
+	}
+	if result := hex.EncodeToString(authMsg.LmChallengeResponse()); result != "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" {
+		t.Error("LmChallengeResponse", result)
+	}
+	if result := hex.EncodeToString(authMsg.NtChallengeResponse()[:16]); result != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Error("NTProofStr", result)
+	}
+	if result := hex.EncodeToString(authMsg.EncryptedRandomSessionKey()); result != "c5dad2544fc9799094ce1ce90bc9d03e" {
+		t.Error("EncryptedRandomSessionKey", result)
+	}
+	if authMsg.Version.ProductMajorVersion != 5 || authMsg.Version.ProductBuild != 2600 {
+		t.Error("version", authMsg.Version)
+	}
+	if authMsg.MIC != [16]byte{} {
+		t.Error("MIC read from the payload", hex.EncodeToString(authMsg.MIC[:]))
+	}
+	if !bytes.Equal(authMsg.Serialize(), data) {
+		t.Error("Serialize does not give back the message")
+	}
+}
+
+func TestAuthenticateMessageRoundTrip(t *testing.T) {
+	lm, nt, key := bytes.Repeat([]byte{1}, 24), bytes.Repeat([]byte{2}, 48), bytes.Repeat([]byte{3}, 16)
+	authMsg := nla.NewAuthenticateMessage(0xe28a8235, "Domain", "User", "WS0", lm, nt, key)
+	authMsg.MIC = [16]byte{0xaa, 0xbb}
+	data := authMsg.Serialize()
+
+	decoded, err := nla.ReadAuthenticateMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.MIC != authMsg.MIC || decoded.Version != authMsg.Version {
+		t.Error("MIC or version lost")
+	}
+	if decoded.DomainName() != "Domain" || decoded.UserName() != "User" || decoded.Workstation() != "WS0" {
+		t.Error("names", decoded.DomainName(), decoded.UserName(), decoded.Workstation())
+	}
+	if !bytes.Equal(decoded.LmChallengeResponse(), lm) || !bytes.Equal(decoded.NtChallengeResponse(), nt) ||
+		!bytes.Equal(decoded.EncryptedRandomSessionKey(), key) {
+		t.Error("responses lost")
+	}
+	if !bytes.Equal(decoded.Payload, authMsg.Payload) {
+		t.Error("payload", hex.EncodeToString(decoded.Payload), "not equal to", hex.EncodeToString(authMsg.Payload))
+	}
+}
+
+func TestReadNegotiateMessage(t *testing.T) {
+	for _, flags := range []uint32{nla.NTLMSSP_NEGOTIATE_VERSION, 0} {
+		negoMsg := nla.NewNegotiateMessage()
+		negoMsg.NegotiateFlags = flags
+		negoMsg.Varsion = nla.NewNVersion()
+		negoMsg.SetWorkstation("WS0")
+		data := negoMsg.Serialize()
+
+		decoded, err := nla.ReadNegotiateMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Workstation() != "WS0" || decoded.DomainName() != "" {
+			t.Error(flags, "workstation", decoded.Workstation(), "domain", decoded.DomainName())
+		}
+		if flags == 0 && decoded.Varsion != (nla.NVersion{}) {
+			t.Error("version read from the payload", decoded.Varsion)
+		}
+		if flags != 0 && decoded.Varsion != nla.NewNVersion() {
+			t.Error("version", decoded.Varsion, "not equal to", nla.NewNVersion())
+		}
+		if !bytes.Equal(decoded.Payload, negoMsg.Payload) {
+			t.Error(flags, "payload", hex.EncodeToString(decoded.Payload))
+		}
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	negotiate := nla.NewNTLMv2("", "", "").GetNegotiateMessage().Serialize()
+	if _, err := nla.ReadChallengeMessage(negotiate); err == nil {
+		t.Error("NEGOTIATE read as a CHALLENGE")
+	}
+	if _, err := nla.ReadAuthenticateMessage(negotiate); err == nil {
+		t.Error("NEGOTIATE read as an AUTHENTICATE")
+	}
+	if _, err := nla.ReadNegotiateMessage(negotiate[:20]); err == nil {
+		t.Error("truncated NEGOTIATE accepted")
+	}
+	if _, err := nla.ReadNegotiateMessage(append([]byte("NTLMSSQ\x00"), negotiate[8:]...)); err == nil {
+		t.Error("bad signature accepted")
+	}
+}
+
+// MS-NLMP 4.2.2.4, 4.2.3.4 and 4.2.4.4 GSS_WrapEx examples, sealing "Plaintext"
+func TestNTLMSecurity_GssEncrypt(t *testing.T) {
+	plaintext := nla.UnicodeEncode("Plaintext")
+	cases := []struct {
+		name       string
+		flags      uint32
+		sessionKey string
+		sealed     string
+	}{
+		// MS-NLMP 4.2.2.4, CRC32 checksum, the random pad sent as zero
+		{"NTLMv1", 0xe2028233, "55555555555555555555555555555555",
+			"010000000000000009dcd1df2e459d3656fe04d861f9319af0d7238a2e3b4d457fb8"},
+		// 56 bit sealing key, checksum not sealed without KEY_EXCH
+		{"NTLMv1 with ESS", 0x820a8233, "eb93429a8bd952f8b89c55b87f475edc",
+			"01000000ff2aeb52f681793a00000000a02372f6530273f3aa1eb90190ce5200c99d"},
+		// 128 bit sealing key, sealed checksum
+		{"NTLMv2", 0xe28a8233, "55555555555555555555555555555555",
+			"010000007fb38ec5c55d49760000000054e50165bf1936dc996020c1811b0f06fb5f"},
+	}
+	for _, c := range cases {
+		sessionKey, _ := hex.DecodeString(c.sessionKey)
+		security := nla.NewNTLMSecurity(c.flags, sessionKey)
+		if result := hex.EncodeToString(security.GssEncrypt(plaintext)); result != c.sealed {
+			t.Error(c.name, result, "not equal to", c.sealed)
+		}
+	}
+}
+
+func TestNTLMSecurity_SequenceNumbers(t *testing.T) {
+	sessionKey, _ := hex.DecodeString("55555555555555555555555555555555")
+	security := nla.NewNTLMSecurity(0xe28a8233, sessionKey)
+
+	// server side of the session, one RC4 handle for all its messages
+	handle, _ := rc4.NewCipher(nla.SEALKEY(sessionKey, false))
+	serverSeal := func(seqNum byte, data []byte) []byte {
+		sealed := make([]byte, len(data))
+		handle.XORKeyStream(sealed, data)
+		seq := []byte{seqNum, 0, 0, 0}
+		checksum := nla.HMAC_MD5(nla.SIGNKEY(sessionKey, false), append(seq, data...))[:8]
+		handle.XORKeyStream(checksum, checksum)
+		signature := append(append([]byte{0x01, 0x00, 0x00, 0x00}, checksum...), seq...)
+		return append(signature, sealed...)
+	}
+
+	for i, msg := range []string{"first", "second", "third"} {
+		if sealed := security.GssEncrypt([]byte(msg)); int(sealed[12]) != i {
+			t.Error(msg, "sent with sequence number", sealed[12])
+		}
+		plain, err := security.GssDecrypt(serverSeal(byte(i), []byte(msg)))
+		if err != nil || string(plain) != msg {
+			t.Error(msg, "not decrypted", err)
+		}
+	}
+	// out of sequence
+	if _, err := security.GssDecrypt(serverSeal(7, []byte("fourth"))); err == nil {
+		t.Error("message with a wrong sequence number accepted")
+	}
+}
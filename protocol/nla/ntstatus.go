@@ -0,0 +1,127 @@
+package nla
+
+import (
+	"errors"
+	"fmt"
+)
+
+/**
+ * NTSTATUS codes sent in the TSRequest errorCode
+ * @see https://msdn.microsoft.com/en-us/library/cc704588.aspx
+ */
+const (
+	STATUS_ACCESS_DENIED                  = 0xC0000022
+	STATUS_NO_LOGON_SERVERS               = 0xC000005E
+	STATUS_NO_SUCH_USER                   = 0xC0000064
+	STATUS_WRONG_PASSWORD                 = 0xC000006A
+	STATUS_LOGON_FAILURE                  = 0xC000006D
+	STATUS_ACCOUNT_RESTRICTION            = 0xC000006E
+	STATUS_INVALID_LOGON_HOURS            = 0xC000006F
+	STATUS_INVALID_WORKSTATION            = 0xC0000070
+	STATUS_PASSWORD_EXPIRED               = 0xC0000071
+	STATUS_ACCOUNT_DISABLED               = 0xC0000072
+	STATUS_TIME_DIFFERENCE_AT_DC          = 0xC0000133
+	STATUS_LOGON_TYPE_NOT_GRANTED         = 0xC000015B
+	STATUS_ACCOUNT_EXPIRED                = 0xC0000193
+	STATUS_PASSWORD_MUST_CHANGE           = 0xC0000224
+	STATUS_ACCOUNT_LOCKED_OUT             = 0xC0000234
+	STATUS_DOWNGRADE_DETECTED             = 0xC0000388
+	STATUS_AUTHENTICATION_FIREWALL_FAILED = 0xC0000413
+	STATUS_NTLM_BLOCKED                   = 0xC0000418
+)
+
+/**
+ * SSPI status codes, sent in errorCode when the security package itself fails
+ * @see https://msdn.microsoft.com/en-us/library/cc704587.aspx
+ */
+const (
+	SEC_E_UNSUPPORTED_FUNCTION        = 0x80090302
+	SEC_E_INVALID_TOKEN               = 0x80090308
+	SEC_E_LOGON_DENIED                = 0x8009030C
+	SEC_E_NO_AUTHENTICATING_AUTHORITY = 0x80090311
+	SEC_E_BAD_BINDINGS                = 0x80090346
+)
+
+var (
+	ErrLogonFailure        = errors.New("logon failure")
+	ErrAccountRestriction  = errors.New("account restriction")
+	ErrAccountLocked       = errors.New("account locked out")
+	ErrAccountDisabled     = errors.New("account disabled")
+	ErrAccountExpired      = errors.New("account expired")
+	ErrPasswordExpired     = errors.New("password expired")
+	ErrPasswordMustChange  = errors.New("password must change")
+	ErrLogonTypeNotGranted = errors.New("logon type not granted")
+	ErrAccessDenied        = errors.New("access denied")
+	ErrLogonServer         = errors.New("logon server unavailable")
+	ErrSecurityPackage     = errors.New("security package failure")
+	ErrNTLMDisabled        = errors.New("ntlm disabled on the server")
+	// any of the credential and account errors above, see NTStatusError.Is
+	ErrAuthFailed = errors.New("nla authentication failed")
+)
+
+var ntStatus = map[uint32]struct {
+	name string
+	err  error
+}{
+	STATUS_ACCESS_DENIED:                  {"STATUS_ACCESS_DENIED", ErrAccessDenied},
+	STATUS_NO_LOGON_SERVERS:               {"STATUS_NO_LOGON_SERVERS", ErrLogonServer},
+	STATUS_NO_SUCH_USER:                   {"STATUS_NO_SUCH_USER", ErrLogonFailure},
+	STATUS_WRONG_PASSWORD:                 {"STATUS_WRONG_PASSWORD", ErrLogonFailure},
+	STATUS_LOGON_FAILURE:                  {"STATUS_LOGON_FAILURE", ErrLogonFailure},
+	STATUS_ACCOUNT_RESTRICTION:            {"STATUS_ACCOUNT_RESTRICTION", ErrAccountRestriction},
+	STATUS_INVALID_LOGON_HOURS:            {"STATUS_INVALID_LOGON_HOURS", ErrAccountRestriction},
+	STATUS_INVALID_WORKSTATION:            {"STATUS_INVALID_WORKSTATION", ErrAccountRestriction},
+	STATUS_PASSWORD_EXPIRED:               {"STATUS_PASSWORD_EXPIRED", ErrPasswordExpired},
+	STATUS_ACCOUNT_DISABLED:               {"STATUS_ACCOUNT_DISABLED", ErrAccountDisabled},
+	STATUS_TIME_DIFFERENCE_AT_DC:          {"STATUS_TIME_DIFFERENCE_AT_DC", ErrLogonServer},
+	STATUS_LOGON_TYPE_NOT_GRANTED:         {"STATUS_LOGON_TYPE_NOT_GRANTED", ErrLogonTypeNotGranted},
+	STATUS_ACCOUNT_EXPIRED:                {"STATUS_ACCOUNT_EXPIRED", ErrAccountExpired},
+	STATUS_PASSWORD_MUST_CHANGE:           {"STATUS_PASSWORD_MUST_CHANGE", ErrPasswordMustChange},
+	STATUS_ACCOUNT_LOCKED_OUT:             {"STATUS_ACCOUNT_LOCKED_OUT", ErrAccountLocked},
+	STATUS_DOWNGRADE_DETECTED:             {"STATUS_DOWNGRADE_DETECTED", ErrAccessDenied},
+	STATUS_AUTHENTICATION_FIREWALL_FAILED: {"STATUS_AUTHENTICATION_FIREWALL_FAILED", ErrAccessDenied},
+	STATUS_NTLM_BLOCKED:                   {"STATUS_NTLM_BLOCKED", ErrNTLMDisabled},
+	SEC_E_UNSUPPORTED_FUNCTION:            {"SEC_E_UNSUPPORTED_FUNCTION", ErrSecurityPackage},
+	SEC_E_INVALID_TOKEN:                   {"SEC_E_INVALID_TOKEN", ErrSecurityPackage},
+	SEC_E_LOGON_DENIED:                    {"SEC_E_LOGON_DENIED", ErrLogonFailure},
+	SEC_E_NO_AUTHENTICATING_AUTHORITY:     {"SEC_E_NO_AUTHENTICATING_AUTHORITY", ErrLogonServer},
+	SEC_E_BAD_BINDINGS:                    {"SEC_E_BAD_BINDINGS", ErrSecurityPackage},
+}
+
+// errorCode of a TSRequest, errors.Is matches the ErrXXX it is mapped on
+type NTStatusError struct {
+	Status uint32
+}
+
+func (e *NTStatusError) Name() string {
+	if s, ok := ntStatus[e.Status]; ok {
+		return s.name
+	}
+	return "UNKNOWN"
+}
+
+func (e *NTStatusError) Error() string {
+	return fmt.Sprintf("credssp server error %s (0x%08x)", e.Name(), e.Status)
+}
+
+func (e *NTStatusError) Unwrap() error {
+	return ntStatus[e.Status].err
+}
+
+// the server refused the credentials or the account, not the security package
+func (e *NTStatusError) Is(target error) bool {
+	if target != ErrAuthFailed {
+		return false
+	}
+	switch ntStatus[e.Status].err {
+	case ErrLogonFailure, ErrAccountRestriction, ErrAccountLocked, ErrAccountDisabled,
+		ErrAccountExpired, ErrPasswordExpired, ErrPasswordMustChange, ErrLogonTypeNotGranted, ErrAccessDenied:
+		return true
+	}
+	return false
+}
+
+// TSRequest errorCode is a signed INTEGER
+func newNTStatusError(errorCode int) *NTStatusError {
+	return &NTStatusError{uint32(errorCode)}
+}
@@ -0,0 +1,48 @@
+package nla
+
+import (
+	"encoding/asn1"
+
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// NTLMSSP mechanism of SPNEGO
+var OID_NTLMSSP = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}
+
+/**
+ * Mechanisms offered by a SPNEGO token, the mechTypes of a NegTokenInit
+ * or the supportedMech of a NegTokenResp. ok is false for any other token,
+ * a raw NTLM message included
+ * @see https://tools.ietf.org/html/rfc4178#section-4.2
+ */
+func SPNEGOMechTypes(token []byte) (mechs []asn1.ObjectIdentifier, ok bool) {
+	if len(token) == 0 || (token[0] != 0x60 && token[0] != 0xa1) {
+		return nil, false
+	}
+	neg := &spnego.SPNEGOToken{}
+	if err := neg.Unmarshal(token); err != nil {
+		return nil, false
+	}
+	if neg.Init {
+		for _, mech := range neg.NegTokenInit.MechTypes {
+			mechs = append(mechs, asn1.ObjectIdentifier(mech))
+		}
+	} else if len(neg.NegTokenResp.SupportedMech) > 0 {
+		mechs = append(mechs, asn1.ObjectIdentifier(neg.NegTokenResp.SupportedMech))
+	}
+	return mechs, true
+}
+
+// a SPNEGO answer to our NTLM NEGOTIATE that does not offer NTLM
+func spnegoWithoutNTLM(token []byte) ([]asn1.ObjectIdentifier, bool) {
+	mechs, ok := SPNEGOMechTypes(token)
+	if !ok {
+		return nil, false
+	}
+	for _, mech := range mechs {
+		if mech.Equal(OID_NTLMSSP) {
+			return nil, false
+		}
+	}
+	return mechs, true
+}
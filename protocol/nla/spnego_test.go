@@ -0,0 +1,46 @@
+package nla_test
+
+import (
+	"encoding/asn1"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/icodeface/grdp/protocol/nla"
+)
+
+var (
+	oidMSKRB5 = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
+	oidKRB5   = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+)
+
+// Kerberos only answers of a domain with NTLM disabled
+const (
+	// NegTokenResp, negState reject, supportedMech KRB5
+	kerberosOnlyResp = "a1143012a0030a0102a10b06092a864886f712010202"
+	// NegTokenInit, mechTypes MS KRB5 and KRB5
+	kerberosOnlyInit = "602606062b0601050502a01c301aa018301606092a864882f71201020206092a864886f712010202"
+	// NegTokenInit, mechTypes MS KRB5, KRB5 and NTLMSSP
+	negotiateInit = "603206062b0601050502a0283026a0243022" +
+		"06092a864882f71201020206092a864886f712010202060a2b06010401823702020a"
+)
+
+func TestSPNEGOMechTypes(t *testing.T) {
+	cases := map[string][]asn1.ObjectIdentifier{
+		kerberosOnlyResp: {oidKRB5},
+		kerberosOnlyInit: {oidMSKRB5, oidKRB5},
+		negotiateInit:    {oidMSKRB5, oidKRB5, nla.OID_NTLMSSP},
+	}
+	for token, expected := range cases {
+		data, _ := hex.DecodeString(token)
+		mechs, ok := nla.SPNEGOMechTypes(data)
+		if !ok || !reflect.DeepEqual(mechs, expected) {
+			t.Error(token, mechs, "not equal to", expected)
+		}
+	}
+
+	challenge := nla.NewChallengeMessage().Serialize()
+	if _, ok := nla.SPNEGOMechTypes(challenge); ok {
+		t.Error("NTLM CHALLENGE read as SPNEGO")
+	}
+}
@@ -0,0 +1,56 @@
+package nla
+
+import (
+	"errors"
+)
+
+var ErrSSPIUnsupported = errors.New("sspi is only available on windows")
+
+/**
+ * Security context of an SSPI package, secur32 on Windows
+ * @see https://docs.microsoft.com/en-us/windows/win32/secauthn/sspi
+ */
+type SecurityContext interface {
+	// InitializeSecurityContext, in is nil on the first call
+	Initialize(in []byte) (out []byte, complete bool, err error)
+	// EncryptMessage, the security trailer followed by the sealed data
+	Encrypt(data []byte) ([]byte, error)
+	// DecryptMessage of a trailer followed by sealed data
+	Decrypt(data []byte) ([]byte, error)
+}
+
+/**
+ * Authenticator with the credentials of the logged on Windows user,
+ * the Negotiate package picks Kerberos or NTLM. See NewSSPI
+ */
+type SSPI struct {
+	ctx         SecurityContext
+	established bool
+}
+
+func NewSSPIFromContext(ctx SecurityContext) *SSPI {
+	return &SSPI{ctx: ctx}
+}
+
+func (s *SSPI) InitSecContext(in []byte) ([]byte, bool, error) {
+	out, complete, err := s.ctx.Initialize(in)
+	if err != nil {
+		return nil, false, err
+	}
+	s.established = complete
+	return out, complete, nil
+}
+
+func (s *SSPI) Wrap(data []byte) ([]byte, error) {
+	if !s.established {
+		return nil, errors.New("sspi context not established")
+	}
+	return s.ctx.Encrypt(data)
+}
+
+func (s *SSPI) Unwrap(data []byte) ([]byte, error) {
+	if !s.established {
+		return nil, errors.New("sspi context not established")
+	}
+	return s.ctx.Decrypt(data)
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+// +build !windows
+
+package nla
+
+func NewSSPI(spn string) (*SSPI, error) {
+	return nil, ErrSSPIUnsupported
+}
@@ -0,0 +1,87 @@
+package nla_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/icodeface/grdp/protocol/nla"
+)
+
+var _ nla.Authenticator = &nla.SSPI{}
+
+// canned InitializeSecurityContext outputs, encryption prefixes a fake trailer
+type cannedContext struct {
+	tokens [][]byte
+	inputs [][]byte
+}
+
+func (c *cannedContext) Initialize(in []byte) ([]byte, bool, error) {
+	c.inputs = append(c.inputs, in)
+	out := c.tokens[0]
+	c.tokens = c.tokens[1:]
+	return out, len(c.tokens) == 0, nil
+}
+
+func (c *cannedContext) Encrypt(data []byte) ([]byte, error) {
+	return append([]byte("trailer"), data...), nil
+}
+
+func (c *cannedContext) Decrypt(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte("trailer")) {
+		return nil, errors.New("no trailer")
+	}
+	return data[len("trailer"):], nil
+}
+
+func TestSSPIHandshake(t *testing.T) {
+	ctx := &cannedContext{tokens: [][]byte{[]byte("spnego init"), []byte("spnego ap-req")}}
+	sspi := nla.NewSSPIFromContext(ctx)
+	if _, err := sspi.Wrap([]byte("early")); err == nil {
+		t.Error("wrap before the context is established")
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	cssp := nla.NewCredSSP(sspi, "", "", "")
+	done := make(chan error, 1)
+	go func() {
+		done <- cssp.Handshake(client, []byte("pubkey"))
+	}()
+
+	req := serveTSRequest(t, server, &nla.TSRequest{Version: 3, NegoTokens: []nla.NegoToken{{[]byte("spnego resp")}}})
+	if len(req.NegoTokens) != 1 || string(req.NegoTokens[0].Data) != "spnego init" {
+		t.Fatal("first negoToken", req.NegoTokens)
+	}
+	pubKeyAuth := []byte("trailerpubkey")
+	pubKeyAuth[len("trailer")]++
+	req = serveTSRequest(t, server, &nla.TSRequest{Version: 3, PubKeyAuth: pubKeyAuth})
+	if len(req.NegoTokens) != 1 || string(req.NegoTokens[0].Data) != "spnego ap-req" {
+		t.Error("last negoToken not sent with pubKeyAuth", req.NegoTokens)
+	}
+	if string(req.PubKeyAuth) != "trailerpubkey" {
+		t.Error("pubKeyAuth", string(req.PubKeyAuth))
+	}
+	req = serveTSRequest(t, server, nil)
+	if !bytes.HasPrefix(req.AuthInfo, []byte("trailer")) {
+		t.Error("authInfo not encrypted", req.AuthInfo)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(ctx.inputs) != 2 || ctx.inputs[0] != nil || string(ctx.inputs[1]) != "spnego resp" {
+		t.Error("server tokens", ctx.inputs)
+	}
+}
+
+func TestNewSSPI(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a logged on domain user")
+	}
+	if _, err := nla.NewSSPI("TERMSRV/rdp.corp.local"); err != nla.ErrSSPIUnsupported {
+		t.Error(err, "not equal to", nla.ErrSSPIUnsupported)
+	}
+}
@@ -0,0 +1,213 @@
+//go:build windows
+// +build windows
+
+package nla
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	secur32                        = syscall.NewLazyDLL("secur32.dll")
+	procAcquireCredentialsHandleW  = secur32.NewProc("AcquireCredentialsHandleW")
+	procFreeCredentialsHandle      = secur32.NewProc("FreeCredentialsHandle")
+	procInitializeSecurityContextW = secur32.NewProc("InitializeSecurityContextW")
+	procCompleteAuthToken          = secur32.NewProc("CompleteAuthToken")
+	procDeleteSecurityContext      = secur32.NewProc("DeleteSecurityContext")
+	procQueryContextAttributesW    = secur32.NewProc("QueryContextAttributesW")
+	procEncryptMessage             = secur32.NewProc("EncryptMessage")
+	procDecryptMessage             = secur32.NewProc("DecryptMessage")
+	procFreeContextBuffer          = secur32.NewProc("FreeContextBuffer")
+)
+
+/**
+ * @see https://docs.microsoft.com/en-us/windows/win32/api/sspi/nf-sspi-initializesecuritycontextw
+ */
+const (
+	SECPKG_CRED_OUTBOUND    = 0x2
+	SECPKG_ATTR_SIZES       = 0x0
+	SECURITY_NATIVE_DREP    = 0x10
+	ISC_REQ_MUTUAL_AUTH     = 0x2
+	ISC_REQ_CONFIDENTIALITY = 0x10
+	ISC_REQ_USE_SESSION_KEY = 0x20
+	ISC_REQ_ALLOCATE_MEMORY = 0x100
+)
+
+const (
+	SEC_E_OK                    = 0x0
+	SEC_I_CONTINUE_NEEDED       = 0x00090312
+	SEC_I_COMPLETE_NEEDED       = 0x00090313
+	SEC_I_COMPLETE_AND_CONTINUE = 0x00090314
+)
+
+const (
+	SECBUFFER_VERSION = 0
+	SECBUFFER_DATA    = 1
+	SECBUFFER_TOKEN   = 2
+	SECBUFFER_STREAM  = 10
+)
+
+type secHandle struct {
+	lower uintptr
+	upper uintptr
+}
+
+type secBuffer struct {
+	size       uint32
+	bufferType uint32
+	buffer     *byte
+}
+
+type secBufferDesc struct {
+	version uint32
+	count   uint32
+	buffers *secBuffer
+}
+
+type secPkgContextSizes struct {
+	maxToken        uint32
+	maxSignature    uint32
+	blockSize       uint32
+	securityTrailer uint32
+}
+
+func sspiError(call string, status uintptr) error {
+	return fmt.Errorf("%s failed %w", call, newNTStatusError(int(int32(uint32(status)))))
+}
+
+// Negotiate context of the logged on user
+type windowsContext struct {
+	cred    secHandle
+	ctx     secHandle
+	hasCtx  bool
+	target  *uint16
+	trailer uint32
+}
+
+/**
+ * Authenticate as the logged on user through the Negotiate package,
+ * spn is the TERMSRV service principal name of the server
+ */
+func NewSSPI(spn string) (*SSPI, error) {
+	target, err := syscall.UTF16PtrFromString(spn)
+	if err != nil {
+		return nil, err
+	}
+	pkg, _ := syscall.UTF16PtrFromString("Negotiate")
+	c := &windowsContext{target: target}
+	var expiry int64
+	r, _, _ := procAcquireCredentialsHandleW.Call(0, uintptr(unsafe.Pointer(pkg)), SECPKG_CRED_OUTBOUND,
+		0, 0, 0, 0, uintptr(unsafe.Pointer(&c.cred)), uintptr(unsafe.Pointer(&expiry)))
+	if r != SEC_E_OK {
+		return nil, sspiError("AcquireCredentialsHandle", r)
+	}
+	runtime.SetFinalizer(c, (*windowsContext).free)
+	return NewSSPIFromContext(c), nil
+}
+
+func (c *windowsContext) free() {
+	if c.hasCtx {
+		procDeleteSecurityContext.Call(uintptr(unsafe.Pointer(&c.ctx)))
+	}
+	procFreeCredentialsHandle.Call(uintptr(unsafe.Pointer(&c.cred)))
+}
+
+func (c *windowsContext) Initialize(in []byte) ([]byte, bool, error) {
+	var inDesc *secBufferDesc
+	if len(in) > 0 {
+		inBuf := secBuffer{uint32(len(in)), SECBUFFER_TOKEN, &in[0]}
+		inDesc = &secBufferDesc{SECBUFFER_VERSION, 1, &inBuf}
+	}
+	outBuf := secBuffer{bufferType: SECBUFFER_TOKEN}
+	outDesc := secBufferDesc{SECBUFFER_VERSION, 1, &outBuf}
+	var ctx *secHandle
+	if c.hasCtx {
+		ctx = &c.ctx
+	}
+	var attrs uint32
+	var expiry int64
+	r, _, _ := procInitializeSecurityContextW.Call(uintptr(unsafe.Pointer(&c.cred)), uintptr(unsafe.Pointer(ctx)),
+		uintptr(unsafe.Pointer(c.target)),
+		ISC_REQ_MUTUAL_AUTH|ISC_REQ_CONFIDENTIALITY|ISC_REQ_USE_SESSION_KEY|ISC_REQ_ALLOCATE_MEMORY,
+		0, SECURITY_NATIVE_DREP, uintptr(unsafe.Pointer(inDesc)), 0, uintptr(unsafe.Pointer(&c.ctx)),
+		uintptr(unsafe.Pointer(&outDesc)), uintptr(unsafe.Pointer(&attrs)), uintptr(unsafe.Pointer(&expiry)))
+	switch r {
+	case SEC_E_OK, SEC_I_CONTINUE_NEEDED, SEC_I_COMPLETE_NEEDED, SEC_I_COMPLETE_AND_CONTINUE:
+	default:
+		return nil, false, sspiError("InitializeSecurityContext", r)
+	}
+	c.hasCtx = true
+
+	if r == SEC_I_COMPLETE_NEEDED || r == SEC_I_COMPLETE_AND_CONTINUE {
+		status, _, _ := procCompleteAuthToken.Call(uintptr(unsafe.Pointer(&c.ctx)), uintptr(unsafe.Pointer(&outDesc)))
+		if status != SEC_E_OK {
+			return nil, false, sspiError("CompleteAuthToken", status)
+		}
+	}
+
+	var out []byte
+	if outBuf.buffer != nil {
+		out = make([]byte, outBuf.size)
+		copy(out, (*[1 << 20]byte)(unsafe.Pointer(outBuf.buffer))[:outBuf.size:outBuf.size])
+		procFreeContextBuffer.Call(uintptr(unsafe.Pointer(outBuf.buffer)))
+	}
+
+	complete := r == SEC_E_OK || r == SEC_I_COMPLETE_NEEDED
+	if complete {
+		var sizes secPkgContextSizes
+		status, _, _ := procQueryContextAttributesW.Call(uintptr(unsafe.Pointer(&c.ctx)), SECPKG_ATTR_SIZES,
+			uintptr(unsafe.Pointer(&sizes)))
+		if status != SEC_E_OK {
+			return nil, false, sspiError("QueryContextAttributes", status)
+		}
+		c.trailer = sizes.securityTrailer
+	}
+	return out, complete, nil
+}
+
+func (c *windowsContext) Encrypt(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("sspi encrypt empty message")
+	}
+	buff := make([]byte, int(c.trailer)+len(data))
+	copy(buff[c.trailer:], data)
+	bufs := []secBuffer{
+		{c.trailer, SECBUFFER_TOKEN, &buff[0]},
+		{uint32(len(data)), SECBUFFER_DATA, &buff[c.trailer]},
+	}
+	desc := secBufferDesc{SECBUFFER_VERSION, uint32(len(bufs)), &bufs[0]}
+	r, _, _ := procEncryptMessage.Call(uintptr(unsafe.Pointer(&c.ctx)), 0, uintptr(unsafe.Pointer(&desc)), 0)
+	if r != SEC_E_OK {
+		return nil, sspiError("EncryptMessage", r)
+	}
+	// the trailer actually written may be shorter than the maximum
+	return append(buff[:bufs[0].size:bufs[0].size], buff[c.trailer:]...), nil
+}
+
+func (c *windowsContext) Decrypt(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("sspi decrypt empty message")
+	}
+	buff := append([]byte{}, data...)
+	bufs := []secBuffer{
+		{uint32(len(buff)), SECBUFFER_STREAM, &buff[0]},
+		{0, SECBUFFER_DATA, nil},
+	}
+	desc := secBufferDesc{SECBUFFER_VERSION, uint32(len(bufs)), &bufs[0]}
+	var qop uint32
+	r, _, _ := procDecryptMessage.Call(uintptr(unsafe.Pointer(&c.ctx)), uintptr(unsafe.Pointer(&desc)), 0,
+		uintptr(unsafe.Pointer(&qop)))
+	if r != SEC_E_OK {
+		return nil, sspiError("DecryptMessage", r)
+	}
+	// the data buffer is decrypted in place inside the stream
+	offset := uintptr(unsafe.Pointer(bufs[1].buffer)) - uintptr(unsafe.Pointer(&buff[0]))
+	if bufs[1].buffer == nil || offset+uintptr(bufs[1].size) > uintptr(len(buff)) {
+		return nil, errors.New("sspi decrypted data outside of the message")
+	}
+	return buff[offset : offset+uintptr(bufs[1].size)], nil
+}
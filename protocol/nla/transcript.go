@@ -0,0 +1,102 @@
+package nla
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// one TSRequest of the handshake
+type TranscriptEntry struct {
+	Time time.Time
+	Sent bool
+	// since the previous message, a slow DC shows as a long gap before the CHALLENGE
+	Latency       time.Duration
+	Length        int
+	Version       int
+	NegoTokenLen  int
+	AuthInfoLen   int
+	PubKeyAuthLen int
+	ErrorCode     uint32
+	// DER of the message, only recorded with unsafe secrets
+	Raw []byte
+}
+
+func (e *TranscriptEntry) String() string {
+	direction := "<-"
+	if e.Sent {
+		direction = "->"
+	}
+	s := fmt.Sprintf("%s %s +%v TSRequest len %d", direction, e.Time.Format("15:04:05.000"), e.Latency, e.Length)
+	if e.Version == 0 {
+		return s + " undecoded"
+	}
+	s += fmt.Sprintf(" version %d", e.Version)
+	if e.NegoTokenLen > 0 {
+		s += fmt.Sprintf(" negoToken %d", e.NegoTokenLen)
+	}
+	if e.PubKeyAuthLen > 0 {
+		s += fmt.Sprintf(" pubKeyAuth %d", e.PubKeyAuthLen)
+	}
+	if e.AuthInfoLen > 0 {
+		s += fmt.Sprintf(" authInfo %d", e.AuthInfoLen)
+	}
+	if e.ErrorCode != 0 {
+		s += " " + (&NTStatusError{e.ErrorCode}).Name()
+	}
+	if e.Raw != nil {
+		s += " " + hex.EncodeToString(e.Raw)
+	}
+	return s
+}
+
+/**
+ * TSRequest messages exchanged by CredSSP, for debugging interop failures.
+ * Only sizes are kept unless unsafe secrets are enabled, the raw DER then
+ * includes the sealed credentials
+ */
+type Transcript struct {
+	Entries []*TranscriptEntry
+	unsafe  bool
+}
+
+func NewTranscript(unsafeLogSecrets bool) *Transcript {
+	return &Transcript{
+		Entries: make([]*TranscriptEntry, 0),
+		unsafe:  unsafeLogSecrets,
+	}
+}
+
+// req is nil when data could not be decoded
+func (t *Transcript) record(sent bool, data []byte, req *TSRequest) {
+	e := &TranscriptEntry{
+		Time:   timeNow(),
+		Sent:   sent,
+		Length: len(data),
+	}
+	if n := len(t.Entries); n > 0 {
+		e.Latency = e.Time.Sub(t.Entries[n-1].Time)
+	}
+	if req != nil {
+		e.Version = req.Version
+		if len(req.NegoTokens) > 0 {
+			e.NegoTokenLen = len(req.NegoTokens[0].Data)
+		}
+		e.AuthInfoLen = len(req.AuthInfo)
+		e.PubKeyAuthLen = len(req.PubKeyAuth)
+		e.ErrorCode = uint32(req.ErrorCode)
+	}
+	if t.unsafe {
+		e.Raw = append([]byte{}, data...)
+	}
+	t.Entries = append(t.Entries, e)
+}
+
+func (t *Transcript) String() string {
+	lines := make([]string, 0, len(t.Entries))
+	for _, e := range t.Entries {
+		lines = append(lines, e.String())
+	}
+	return strings.Join(lines, "\n")
+}
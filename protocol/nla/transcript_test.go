@@ -0,0 +1,67 @@
+package nla_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp/protocol/nla"
+)
+
+func TestCredSSPTranscript(t *testing.T) {
+	for _, unsafe := range []bool{false, true} {
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		nla.SetTimeNow(func() time.Time {
+			now = now.Add(10 * time.Millisecond)
+			return now
+		})
+
+		client, server := net.Pipe()
+		transcript := nla.NewTranscript(unsafe)
+		cssp := nla.NewCredSSP(fakeAuthenticator{}, "CORP", "alice", "secret")
+		cssp.SetTranscript(transcript)
+		done := make(chan error, 1)
+		go func() {
+			done <- cssp.Handshake(client, []byte("pubkey"))
+		}()
+		serveTSRequest(t, server, &nla.TSRequest{Version: 2, NegoTokens: []nla.NegoToken{{[]byte("challenge")}}})
+		pubKey := []byte("pubkey")
+		pubKey[0]++
+		serveTSRequest(t, server, &nla.TSRequest{Version: 2, PubKeyAuth: pubKey})
+		serveTSRequest(t, server, nil)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		server.Close()
+
+		entries := transcript.Entries
+		if len(entries) != 5 {
+			t.Fatal(len(entries), "entries\n", transcript)
+		}
+		sent := []bool{true, false, true, false, true}
+		for i, e := range entries {
+			if e.Sent != sent[i] {
+				t.Error(i, "direction", e)
+			}
+			// the first message goes out before the version is negotiated
+			if i > 0 && e.Version != 2 {
+				t.Error(i, "version", e)
+			}
+			if i > 0 && e.Latency != 10*time.Millisecond {
+				t.Error(i, "latency", e.Latency)
+			}
+			if (e.Raw != nil) != unsafe {
+				t.Error(i, "raw message recorded", e.Raw != nil)
+			}
+		}
+		if entries[1].NegoTokenLen != len("challenge") || entries[3].PubKeyAuthLen != len(pubKey) || entries[4].AuthInfoLen == 0 {
+			t.Error("message summary\n", transcript)
+		}
+		if !unsafe && strings.Contains(transcript.String(), "secret") {
+			t.Error("credentials in the transcript\n", transcript)
+		}
+	}
+	nla.SetTimeNow(time.Now)
+}
@@ -0,0 +1,487 @@
+package pdu
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+
+	"github.com/icodeface/grdp/core"
+)
+
+/**
+ * flags of TS_BITMAP_DATA, NO_BITMAP_COMPRESSION_HDR is also a general capability flag
+ * @see https://msdn.microsoft.com/en-us/library/cc240612.aspx
+ */
+const (
+	BITMAP_COMPRESSION = 0x0001
+)
+
+// the bitmap decoders do not handle this color depth or codec
+var ErrBitmapNotSupported = errors.New("bitmap format not supported")
+
+// TS_BITMAP_DATA, the compressed data header is only read when present
+func readBitmapData(r io.Reader) (*BitmapData, error) {
+	b := &BitmapData{}
+	for _, field := range []*uint16{&b.DestLeft, &b.DestTop, &b.DestRight, &b.DestBottom,
+		&b.Width, &b.Height, &b.BitsPerPixel, &b.Flags, &b.BitmapLength} {
+		v, err := core.ReadUint16LE(r)
+		if err != nil {
+			return nil, err
+		}
+		*field = v
+	}
+	length := int(b.BitmapLength)
+	if b.Flags&BITMAP_COMPRESSION != 0 && b.Flags&NO_BITMAP_COMPRESSION_HDR == 0 {
+		if length < 8 {
+			return nil, fmt.Errorf("bitmap length %d shorter than its header", length)
+		}
+		b.BitmapComprHdr = &BitmapCompressedDataHeader{}
+		for _, field := range []*uint16{&b.BitmapComprHdr.CbCompFirstRowSize, &b.BitmapComprHdr.CbCompMainBodySize,
+			&b.BitmapComprHdr.CbScanWidth, &b.BitmapComprHdr.CbUncompressedSize} {
+			v, err := core.ReadUint16LE(r)
+			if err != nil {
+				return nil, err
+			}
+			*field = v
+		}
+		length -= 8
+	}
+	var err error
+	if b.BitmapDataStream, err = core.ReadBytes(length, r); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// TS_UPDATE_BITMAP_DATA, the same in the fast path and the slow path updates
+func readBitmapUpdate(r io.Reader) (*FastPathBitmapUpdateDataPDU, error) {
+	u := &FastPathBitmapUpdateDataPDU{}
+	var err error
+	if u.Header, err = core.ReadUint16LE(r); err != nil {
+		return nil, err
+	}
+	if u.NumberRectangles, err = core.ReadUint16LE(r); err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(u.NumberRectangles); i++ {
+		b, err := readBitmapData(r)
+		if err != nil {
+			return nil, err
+		}
+		u.Rectangles = append(u.Rectangles, *b)
+	}
+	return u, nil
+}
+
+// bytes of a pixel at a color depth, 0 when not supported
+func bytesPerPixel(bpp uint16) int {
+	switch bpp {
+	case 8:
+		return 1
+	case 15, 16:
+		return 2
+	case 24:
+		return 3
+	case 32:
+		return 4
+	}
+	return 0
+}
+
+/**
+ * Decode the bitmap into a Width x Height image, the caller draws the
+ * part within the destination rectangle. Uncompressed bitmaps of 15 to
+ * 32 bpp and interleaved RLE of 15 to 24 bpp are decoded, 8 bpp needs a
+ * palette and 32 bpp compressed bitmaps are planar
+ */
+func (b *BitmapData) RGBA() (*image.RGBA, error) {
+	size := bytesPerPixel(b.BitsPerPixel)
+	if size < 2 {
+		return nil, fmt.Errorf("%w: %d bpp", ErrBitmapNotSupported, b.BitsPerPixel)
+	}
+	width, height := int(b.Width), int(b.Height)
+	if width == 0 || height == 0 {
+		return image.NewRGBA(image.Rect(0, 0, width, height)), nil
+	}
+	// rows of an uncompressed bitmap are padded to 4 bytes, not the decoded ones
+	rowDelta := width * size
+	var pixels []byte
+	if b.Flags&BITMAP_COMPRESSION == 0 {
+		stride := (rowDelta + 3) &^ 3
+		if len(b.BitmapDataStream) < stride*height {
+			return nil, fmt.Errorf("bitmap %dx%d %d bpp of %d bytes", width, height, b.BitsPerPixel, len(b.BitmapDataStream))
+		}
+		pixels = make([]byte, rowDelta*height)
+		for y := 0; y < height; y++ {
+			copy(pixels[y*rowDelta:(y+1)*rowDelta], b.BitmapDataStream[y*stride:])
+		}
+	} else {
+		if size == 4 {
+			return nil, fmt.Errorf("%w: planar 32 bpp", ErrBitmapNotSupported)
+		}
+		pixels = make([]byte, rowDelta*height)
+		if err := rleDecompress(b.BitmapDataStream, pixels, rowDelta, size, whitePixel(b.BitsPerPixel)); err != nil {
+			return nil, err
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		// the rows are bottom up
+		row := pixels[(height-1-y)*rowDelta:]
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, pixelColor(row[x*size:], b.BitsPerPixel))
+		}
+	}
+	return img, nil
+}
+
+// little endian pixel of a 15 to 32 bpp bitmap
+func pixelColor(p []byte, bpp uint16) color.RGBA {
+	switch bpp {
+	case 15:
+		v := uint16(p[0]) | uint16(p[1])<<8
+		return color.RGBA{expand5(v >> 10), expand5(v >> 5), expand5(v), 0xff}
+	case 16:
+		v := uint16(p[0]) | uint16(p[1])<<8
+		g := uint8(v>>5) & 0x3f
+		return color.RGBA{expand5(v >> 11), g<<2 | g>>4, expand5(v), 0xff}
+	}
+	// BGR, the fourth byte of 32 bpp is not alpha
+	return color.RGBA{p[2], p[1], p[0], 0xff}
+}
+
+// 5 bits of v to 8 bits
+func expand5(v uint16) uint8 {
+	c := uint8(v) & 0x1f
+	return c<<3 | c>>2
+}
+
+func whitePixel(bpp uint16) uint32 {
+	switch bpp {
+	case 15:
+		return 0x7fff
+	case 16:
+		return 0xffff
+	}
+	return 0xffffff
+}
+
+/**
+ * Orders of the interleaved RLE, the regular ones are the 3 high bits
+ * of the order header, the lite ones the 4 high bits, the mega mega and
+ * special ones the whole byte
+ * @see https://msdn.microsoft.com/en-us/library/cc240593.aspx
+ */
+const (
+	REGULAR_BG_RUN           = 0x00
+	REGULAR_FG_RUN           = 0x01
+	REGULAR_FGBG_IMAGE       = 0x02
+	REGULAR_COLOR_RUN        = 0x03
+	REGULAR_COLOR_IMAGE      = 0x04
+	LITE_SET_FG_FG_RUN       = 0x0C
+	LITE_SET_FG_FGBG_IMAGE   = 0x0D
+	LITE_DITHERED_RUN        = 0x0E
+	MEGA_MEGA_BG_RUN         = 0xF0
+	MEGA_MEGA_FG_RUN         = 0xF1
+	MEGA_MEGA_FGBG_IMAGE     = 0xF2
+	MEGA_MEGA_COLOR_RUN      = 0xF3
+	MEGA_MEGA_COLOR_IMAGE    = 0xF4
+	MEGA_MEGA_SET_FG_RUN     = 0xF6
+	MEGA_MEGA_SET_FGBG_IMAGE = 0xF7
+	MEGA_MEGA_DITHERED_RUN   = 0xF8
+	SPECIAL_FGBG_1           = 0xF9
+	SPECIAL_FGBG_2           = 0xFA
+	SPECIAL_WHITE            = 0xFD
+	SPECIAL_BLACK            = 0xFE
+)
+
+const (
+	// bitmasks of the SPECIAL_FGBG orders, for 8 pixels
+	rleSpecialFgbg1Mask = 0x03
+	rleSpecialFgbg2Mask = 0x05
+	// unit of the length in the header of a regular or lite FGBG image
+	rleMaskedLengthUnits = 8
+)
+
+var errRLEOverrun = errors.New("rle bitmap overruns its data")
+
+// state of an interleaved RLE decompression
+type rleDecoder struct {
+	src      []byte
+	dst      []byte
+	pos      int
+	rowDelta int
+	size     int
+}
+
+func (d *rleDecoder) readByte() (byte, error) {
+	if len(d.src) < 1 {
+		return 0, errRLEOverrun
+	}
+	b := d.src[0]
+	d.src = d.src[1:]
+	return b, nil
+}
+
+func (d *rleDecoder) readPixel() (uint32, error) {
+	if len(d.src) < d.size {
+		return 0, errRLEOverrun
+	}
+	var p uint32
+	for i := 0; i < d.size; i++ {
+		p |= uint32(d.src[i]) << (8 * uint(i))
+	}
+	d.src = d.src[d.size:]
+	return p, nil
+}
+
+func (d *rleDecoder) writePixel(p uint32) error {
+	if d.pos+d.size > len(d.dst) {
+		return errRLEOverrun
+	}
+	for i := 0; i < d.size; i++ {
+		d.dst[d.pos+i] = byte(p >> (8 * uint(i)))
+	}
+	d.pos += d.size
+	return nil
+}
+
+// pixel one row above the next one written, the caller is past the first row
+func (d *rleDecoder) above() uint32 {
+	var p uint32
+	for i := 0; i < d.size; i++ {
+		p |= uint32(d.dst[d.pos-d.rowDelta+i]) << (8 * uint(i))
+	}
+	return p
+}
+
+// code of an order header
+func rleCode(header byte) byte {
+	switch {
+	case header&0xc0 != 0xc0:
+		return header >> 5
+	case header&0xf0 == 0xf0:
+		return header
+	}
+	return header >> 4
+}
+
+// run length of the order whose header was read
+func (d *rleDecoder) runLength(header, code byte) (int, error) {
+	switch code {
+	case REGULAR_FGBG_IMAGE, LITE_SET_FG_FGBG_IMAGE:
+		mask := byte(0x1f)
+		if code == LITE_SET_FG_FGBG_IMAGE {
+			mask = 0x0f
+		}
+		if n := int(header & mask); n != 0 {
+			return n * rleMaskedLengthUnits, nil
+		}
+		b, err := d.readByte()
+		return int(b) + 1, err
+	case REGULAR_BG_RUN, REGULAR_FG_RUN, REGULAR_COLOR_RUN, REGULAR_COLOR_IMAGE:
+		if n := int(header & 0x1f); n != 0 {
+			return n, nil
+		}
+		b, err := d.readByte()
+		return int(b) + 32, err
+	case LITE_SET_FG_FG_RUN, LITE_DITHERED_RUN:
+		if n := int(header & 0x0f); n != 0 {
+			return n, nil
+		}
+		b, err := d.readByte()
+		return int(b) + 16, err
+	case MEGA_MEGA_BG_RUN, MEGA_MEGA_FG_RUN, MEGA_MEGA_FGBG_IMAGE, MEGA_MEGA_COLOR_RUN,
+		MEGA_MEGA_COLOR_IMAGE, MEGA_MEGA_SET_FG_RUN, MEGA_MEGA_SET_FGBG_IMAGE, MEGA_MEGA_DITHERED_RUN:
+		lo, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		hi, err := d.readByte()
+		return int(lo) | int(hi)<<8, err
+	}
+	return 0, fmt.Errorf("rle unknown order 0x%02x", header)
+}
+
+// up to 8 pixels of a foreground/background image, one bit each from the lowest
+func (d *rleDecoder) fgbg(bitmask byte, fgPel uint32, bits int, firstLine bool) error {
+	for i := 0; i < bits; i++ {
+		var p uint32
+		if !firstLine {
+			p = d.above()
+		}
+		if bitmask&(1<<uint(i)) != 0 {
+			p ^= fgPel
+			if firstLine {
+				p = fgPel
+			}
+		}
+		if err := d.writePixel(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * Interleaved RLE decompression of src into dst, the rows of rowDelta
+ * bytes in the order of the bitmap, bottom up
+ * @see https://msdn.microsoft.com/en-us/library/dd240593.aspx
+ */
+func rleDecompress(src, dst []byte, rowDelta, size int, white uint32) error {
+	d := &rleDecoder{src: src, dst: dst, rowDelta: rowDelta, size: size}
+	fgPel := white
+	insertFgPel := false
+	firstLine := true
+	for len(d.src) > 0 {
+		if firstLine && d.pos >= rowDelta {
+			firstLine = false
+			insertFgPel = false
+		}
+		header, _ := d.readByte()
+		code := rleCode(header)
+
+		if code == REGULAR_BG_RUN || code == MEGA_MEGA_BG_RUN {
+			n, err := d.runLength(header, code)
+			if err != nil {
+				return err
+			}
+			for ; n > 0; n-- {
+				// the background is black on the first row
+				var p uint32
+				if !firstLine {
+					p = d.above()
+				}
+				if insertFgPel {
+					// two background runs in a row are separated by a foreground pixel
+					p ^= fgPel
+					insertFgPel = false
+				}
+				if err = d.writePixel(p); err != nil {
+					return err
+				}
+			}
+			insertFgPel = true
+			continue
+		}
+		insertFgPel = false
+
+		switch code {
+		case SPECIAL_FGBG_1, SPECIAL_FGBG_2:
+			mask := byte(rleSpecialFgbg1Mask)
+			if code == SPECIAL_FGBG_2 {
+				mask = rleSpecialFgbg2Mask
+			}
+			if err := d.fgbg(mask, fgPel, 8, firstLine); err != nil {
+				return err
+			}
+			continue
+		case SPECIAL_WHITE, SPECIAL_BLACK:
+			p := white
+			if code == SPECIAL_BLACK {
+				p = 0
+			}
+			if err := d.writePixel(p); err != nil {
+				return err
+			}
+			continue
+		}
+
+		n, err := d.runLength(header, code)
+		if err != nil {
+			return err
+		}
+		switch code {
+		case REGULAR_FG_RUN, MEGA_MEGA_FG_RUN, LITE_SET_FG_FG_RUN, MEGA_MEGA_SET_FG_RUN:
+			if code == LITE_SET_FG_FG_RUN || code == MEGA_MEGA_SET_FG_RUN {
+				if fgPel, err = d.readPixel(); err != nil {
+					return err
+				}
+			}
+			for ; n > 0; n-- {
+				p := fgPel
+				if !firstLine {
+					p ^= d.above()
+				}
+				if err = d.writePixel(p); err != nil {
+					return err
+				}
+			}
+		case LITE_DITHERED_RUN, MEGA_MEGA_DITHERED_RUN:
+			a, err := d.readPixel()
+			if err != nil {
+				return err
+			}
+			b, err := d.readPixel()
+			if err != nil {
+				return err
+			}
+			for ; n > 0; n-- {
+				if err = d.writePixel(a); err != nil {
+					return err
+				}
+				if err = d.writePixel(b); err != nil {
+					return err
+				}
+			}
+		case REGULAR_COLOR_RUN, MEGA_MEGA_COLOR_RUN:
+			p, err := d.readPixel()
+			if err != nil {
+				return err
+			}
+			for ; n > 0; n-- {
+				if err = d.writePixel(p); err != nil {
+					return err
+				}
+			}
+		case REGULAR_FGBG_IMAGE, MEGA_MEGA_FGBG_IMAGE, LITE_SET_FG_FGBG_IMAGE, MEGA_MEGA_SET_FGBG_IMAGE:
+			if code == LITE_SET_FG_FGBG_IMAGE || code == MEGA_MEGA_SET_FGBG_IMAGE {
+				if fgPel, err = d.readPixel(); err != nil {
+					return err
+				}
+			}
+			for n > 0 {
+				bitmask, err := d.readByte()
+				if err != nil {
+					return err
+				}
+				bits := 8
+				if n < bits {
+					bits = n
+				}
+				if err = d.fgbg(bitmask, fgPel, bits, firstLine); err != nil {
+					return err
+				}
+				n -= bits
+			}
+		case REGULAR_COLOR_IMAGE, MEGA_MEGA_COLOR_IMAGE:
+			if len(d.src) < n*size {
+				return errRLEOverrun
+			}
+			for ; n > 0; n-- {
+				p, _ := d.readPixel()
+				if err = d.writePixel(p); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("rle unknown order 0x%02x", header)
+		}
+	}
+	return nil
+}
+
+// draws the bitmap at its destination rectangle on img
+func (b *BitmapData) DrawOn(img draw.Image) error {
+	src, err := b.RGBA()
+	if err != nil {
+		return err
+	}
+	dst := image.Rect(int(b.DestLeft), int(b.DestTop), int(b.DestRight)+1, int(b.DestBottom)+1)
+	draw.Draw(img, dst, src, image.Point{}, draw.Src)
+	return nil
+}
@@ -0,0 +1,134 @@
+package pdu_test
+
+import (
+	"errors"
+	"image/color"
+	"testing"
+
+	"github.com/icodeface/grdp/core/testtransport"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/protocol/pdu"
+)
+
+var (
+	black = color.RGBA{0, 0, 0, 0xff}
+	white = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	red   = color.RGBA{0xff, 0, 0, 0xff}
+	green = color.RGBA{0, 0xff, 0, 0xff}
+	blue  = color.RGBA{0, 0, 0xff, 0xff}
+	cyan  = color.RGBA{0, 0xff, 0xff, 0xff}
+)
+
+func TestBitmapRGBA(t *testing.T) {
+	tests := []struct {
+		name   string
+		bitmap pdu.BitmapData
+		// rows top down
+		pixels [][]color.RGBA
+	}{
+		{"uncompressed 16bpp", pdu.BitmapData{Width: 3, Height: 2, BitsPerPixel: 16,
+			// bottom row then top row, each padded to 8 bytes
+			BitmapDataStream: []byte{0x00, 0xf8, 0xe0, 0x07, 0x1f, 0x00, 0, 0, 0xff, 0xff, 0x00, 0x00, 0xff, 0x07, 0, 0}},
+			[][]color.RGBA{{white, black, cyan}, {red, green, blue}}},
+		{"uncompressed 15bpp", pdu.BitmapData{Width: 2, Height: 1, BitsPerPixel: 15,
+			BitmapDataStream: []byte{0x00, 0x7c, 0x1f, 0x00}},
+			[][]color.RGBA{{red, blue}}},
+		{"uncompressed 24bpp", pdu.BitmapData{Width: 1, Height: 1, BitsPerPixel: 24,
+			BitmapDataStream: []byte{0xff, 0x00, 0x00, 0}},
+			[][]color.RGBA{{blue}}},
+		{"uncompressed 32bpp", pdu.BitmapData{Width: 1, Height: 1, BitsPerPixel: 32,
+			BitmapDataStream: []byte{0x00, 0xff, 0x00, 0x00}},
+			[][]color.RGBA{{green}}},
+		// color run on the first row, foreground run, background run then white above it
+		{"rle runs", pdu.BitmapData{Width: 4, Height: 2, BitsPerPixel: 16, Flags: pdu.BITMAP_COMPRESSION,
+			BitmapDataStream: []byte{0x64, 0x00, 0xf8, 0x22, 0x01, 0xfd}},
+			[][]color.RGBA{{cyan, cyan, red, white}, {red, red, red, red}}},
+		// two background runs in a row are split by a foreground pixel
+		{"rle background", pdu.BitmapData{Width: 4, Height: 1, BitsPerPixel: 16, Flags: pdu.BITMAP_COMPRESSION,
+			BitmapDataStream: []byte{0x01, 0x02, 0xc1, 0x1f, 0x00}},
+			[][]color.RGBA{{black, white, black, blue}}},
+		{"rle fgbg image", pdu.BitmapData{Width: 8, Height: 1, BitsPerPixel: 16, Flags: pdu.BITMAP_COMPRESSION,
+			BitmapDataStream: []byte{0xd1, 0xe0, 0x07, 0x05}},
+			[][]color.RGBA{{green, black, green, black, black, black, black, black}}},
+		{"rle dithered", pdu.BitmapData{Width: 4, Height: 1, BitsPerPixel: 16, Flags: pdu.BITMAP_COMPRESSION,
+			BitmapDataStream: []byte{0xe2, 0x00, 0xf8, 0x1f, 0x00}},
+			[][]color.RGBA{{red, blue, red, blue}}},
+		{"rle mega mega color image 24bpp", pdu.BitmapData{Width: 2, Height: 1, BitsPerPixel: 24, Flags: pdu.BITMAP_COMPRESSION,
+			BitmapDataStream: []byte{0xf4, 0x02, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff}},
+			[][]color.RGBA{{red, white}}},
+	}
+	for _, test := range tests {
+		img, err := test.bitmap.RGBA()
+		if err != nil {
+			t.Error(test.name, err)
+			continue
+		}
+		for y, row := range test.pixels {
+			for x, c := range row {
+				if got := img.RGBAAt(x, y); got != c {
+					t.Error(test.name, x, y, got, "not equal to", c)
+				}
+			}
+		}
+	}
+}
+
+func TestBitmapRGBAErrors(t *testing.T) {
+	for _, b := range []pdu.BitmapData{
+		{Width: 2, Height: 1, BitsPerPixel: 8, BitmapDataStream: []byte{0, 0, 0, 0}},
+		{Width: 1, Height: 1, BitsPerPixel: 32, Flags: pdu.BITMAP_COMPRESSION, BitmapDataStream: []byte{0x10}},
+	} {
+		if _, err := b.RGBA(); !errors.Is(err, pdu.ErrBitmapNotSupported) {
+			t.Error(b.BitsPerPixel, err, "not equal to", pdu.ErrBitmapNotSupported)
+		}
+	}
+	for _, b := range []pdu.BitmapData{
+		// short uncompressed data
+		{Width: 2, Height: 2, BitsPerPixel: 16, BitmapDataStream: []byte{0, 0, 0, 0}},
+		// a run past the end of the bitmap
+		{Width: 2, Height: 1, BitsPerPixel: 16, Flags: pdu.BITMAP_COMPRESSION, BitmapDataStream: []byte{0x63, 0, 0}},
+		// a color image past the end of the data
+		{Width: 2, Height: 1, BitsPerPixel: 16, Flags: pdu.BITMAP_COMPRESSION, BitmapDataStream: []byte{0x82, 0, 0}},
+	} {
+		if _, err := b.RGBA(); err == nil {
+			t.Error(b, "decoded")
+		}
+	}
+}
+
+func TestRecvFastPathFragments(t *testing.T) {
+	c := pdu.NewClient(testtransport.New(), glog.Default())
+	updates := make(chan []pdu.BitmapData, 1)
+	c.On("update", func(rectangles []pdu.BitmapData) {
+		updates <- rectangles
+	})
+	// TS_UPDATE_BITMAP_DATA of one uncompressed 1x1 24bpp rectangle at 2,3
+	update := []byte{0x01, 0x00, 0x01, 0x00,
+		0x02, 0x00, 0x03, 0x00, 0x02, 0x00, 0x03, 0x00, 0x01, 0x00, 0x01, 0x00, 0x18, 0x00, 0x00, 0x00, 0x04, 0x00,
+		0x00, 0x00, 0xff, 0x00}
+	// first then last fragment of the bitmap update
+	first := append([]byte{0x21, 10, 0}, update[:10]...)
+	last := append([]byte{0x11, byte(len(update) - 10), 0}, update[10:]...)
+	c.RecvFastPath(0, first)
+	select {
+	case <-updates:
+		t.Fatal("update before the last fragment")
+	default:
+	}
+	c.RecvFastPath(0, last)
+	select {
+	case rectangles := <-updates:
+		if len(rectangles) != 1 || rectangles[0].DestLeft != 2 || rectangles[0].DestTop != 3 {
+			t.Fatal(rectangles, "not one rectangle at 2,3")
+		}
+		img, err := rectangles[0].RGBA()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.RGBAAt(0, 0); got != red {
+			t.Error(got, "not equal to", red)
+		}
+	default:
+		t.Fatal("no update")
+	}
+}
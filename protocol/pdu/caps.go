@@ -2,11 +2,9 @@ package pdu
 
 import (
 	"bytes"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/icodeface/grdp/core"
-	"github.com/icodeface/grdp/glog"
 	"github.com/icodeface/grdp/protocol/t125/gcc"
 	"github.com/lunixbochs/struc"
 	"io"
@@ -535,6 +533,9 @@ func readCapability(r io.Reader) (Capability, error) {
 	if err != nil {
 		return nil, err
 	}
+	if capLen < 4 {
+		return nil, fmt.Errorf("capability 0x%04x bad length %d", capType, capLen)
+	}
 	capBytes, err := core.ReadBytes(int(capLen)-4, r)
 	if err != nil {
 		return nil, err
@@ -594,12 +595,9 @@ func readCapability(r io.Reader) (Capability, error) {
 	case CAPSETTYPE_SURFACE_COMMANDS:
 		c = &SurfaceCommandsCapability{}
 	default:
-		err := errors.New(fmt.Sprintf("unsupported Capability type 0x%04x", capType))
-		glog.Error(err)
-		return nil, err
+		return nil, errors.New(fmt.Sprintf("unsupported Capability type 0x%04x", capType))
 	}
 	if err := struc.Unpack(capReader, c); err != nil {
-		glog.Error("Capability unpack error", err, fmt.Sprintf("0x%04x", capType), hex.EncodeToString(capBytes))
 		return nil, err
 	}
 	return c, nil
@@ -5,9 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/icodeface/grdp/core"
-	"github.com/icodeface/grdp/glog"
 	"github.com/lunixbochs/struc"
 	"io"
+	"io/ioutil"
 )
 
 const (
@@ -45,6 +45,13 @@ const (
 	PDUTYPE2_MONITOR_LAYOUT_PDU          = 0x37
 )
 
+const (
+	UPDATETYPE_ORDERS      = 0x0000
+	UPDATETYPE_BITMAP      = 0x0001
+	UPDATETYPE_PALETTE     = 0x0002
+	UPDATETYPE_SYNCHRONIZE = 0x0003
+)
+
 const (
 	CTRLACTION_REQUEST_CONTROL = 0x0001
 	CTRLACTION_GRANTED_CONTROL = 0x0002
@@ -73,6 +80,19 @@ const (
 	FASTPATH_UPDATETYPE_POINTER      = 0xB
 )
 
+// fragmentation of a fast path update, bits 4 and 5 of its updateHeader
+const (
+	FASTPATH_FRAGMENT_SINGLE = 0x0
+	FASTPATH_FRAGMENT_LAST   = 0x1
+	FASTPATH_FRAGMENT_FIRST  = 0x2
+	FASTPATH_FRAGMENT_NEXT   = 0x3
+)
+
+// compression of a fast path update, bits 6 and 7 of its updateHeader
+const (
+	FASTPATH_OUTPUT_COMPRESSION_USED = 0x2
+)
+
 type ShareDataHeader struct {
 	SharedId           uint32 `struc:"little"`
 	Padding1           uint8  `struc:"little"`
@@ -149,7 +169,6 @@ func readDemandActivePDU(r io.Reader) (*DemandActivePDU, error) {
 	d.NumberCapabilities, err = core.ReadUint16LE(r)
 	d.Pad2Octets, err = core.ReadUint16LE(r)
 	d.CapabilitySets = make([]Capability, 0)
-	glog.Debug("NumberCapabilities is", d.NumberCapabilities)
 	for i := 0; i < int(d.NumberCapabilities); i++ {
 		c, err := readCapability(r)
 		if err != nil {
@@ -320,7 +339,6 @@ func readDataPDU(r io.Reader) (*DataPDU, error) {
 	header := &ShareDataHeader{}
 	err := struc.Unpack(r, header)
 	if err != nil {
-		glog.Error("read data pdu header error", err)
 		return nil, err
 	}
 	var d DataPDUData
@@ -335,14 +353,17 @@ func readDataPDU(r io.Reader) (*DataPDU, error) {
 		d = &ErrorInfoDataPDU{}
 	case PDUTYPE2_FONTMAP:
 		d = &FontMapDataPDU{}
+	case PDUTYPE2_UPDATE:
+		update, err := readUpdateDataPDU(r)
+		if err != nil {
+			return nil, err
+		}
+		return &DataPDU{Header: header, Data: update}, nil
 	default:
-		err = errors.New(fmt.Sprintf("Unknown data pdu type2 0x%02x", header.PDUType2))
-		glog.Error(err)
-		return nil, err
+		return nil, errors.New(fmt.Sprintf("Unknown data pdu type2 0x%02x", header.PDUType2))
 	}
 	err = struc.Unpack(r, d)
 	if err != nil {
-		glog.Error("read data pdu data error", err)
 		return nil, err
 	}
 	p := &DataPDU{
@@ -401,6 +422,57 @@ func (*ErrorInfoDataPDU) Type2() uint8 {
 	return PDUTYPE2_SET_ERROR_INFO_PDU
 }
 
+type InclusiveRectangle struct {
+	Left   uint16 `struc:"little"`
+	Top    uint16 `struc:"little"`
+	Right  uint16 `struc:"little"`
+	Bottom uint16 `struc:"little"`
+}
+
+// @see https://msdn.microsoft.com/en-us/library/cc240646.aspx
+type RefreshRectDataPDU struct {
+	NumberOfAreas  uint8                `struc:"little,sizeof=AreasToRefresh"`
+	Pad1Octet      uint8                `struc:"little"`
+	Pad2Octets     uint16               `struc:"little"`
+	AreasToRefresh []InclusiveRectangle `struc:"sizefrom=NumberOfAreas"`
+}
+
+func (*RefreshRectDataPDU) Type2() uint8 {
+	return PDUTYPE2_REFRESH_RECT
+}
+
+/**
+ * Slow path update, Data is nil but for the bitmap updates
+ * @see https://msdn.microsoft.com/en-us/library/cc240608.aspx
+ */
+type UpdateDataPDU struct {
+	UpdateType uint16
+	Data       UpdateData
+}
+
+func (*UpdateDataPDU) Type2() uint8 {
+	return PDUTYPE2_UPDATE
+}
+
+// the rest of r is the update, the caller bounds it to its share control header
+func readUpdateDataPDU(r io.Reader) (*UpdateDataPDU, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	u := &UpdateDataPDU{UpdateType: uint16(b[0]) | uint16(b[1])<<8}
+	if u.UpdateType == UPDATETYPE_BITMAP {
+		// TS_UPDATE_BITMAP_DATA starts with its updateType too
+		if u.Data, err = readBitmapUpdate(bytes.NewReader(b)); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
 type FontMapDataPDU struct {
 	NumberEntries   uint16 `struc:"little"`
 	TotalNumEntries uint16 `struc:"little"`
@@ -447,11 +519,27 @@ func (*FastPathBitmapUpdateDataPDU) FastPathUpdateType() uint8 {
 	return FASTPATH_UPDATETYPE_BITMAP
 }
 
+/**
+ * @see https://msdn.microsoft.com/en-us/library/cc240622.aspx
+ */
 type FastPathUpdatePDU struct {
 	UpdateHeader     uint8
 	CompressionFlags uint8
 	Size             uint16
-	Data             UpdateData
+	// nil for the updates not parsed and the fragments
+	Data UpdateData
+	// updateData of a fragment, put together by the Client
+	fragment []byte
+}
+
+// FASTPATH_UPDATETYPE_BITMAP...
+func (f *FastPathUpdatePDU) UpdateCode() uint8 {
+	return f.UpdateHeader & 0x0f
+}
+
+// FASTPATH_FRAGMENT_SINGLE...
+func (f *FastPathUpdatePDU) Fragmentation() uint8 {
+	return (f.UpdateHeader >> 4) & 0x03
 }
 
 func readFastPathUpdatePDU(r io.Reader) (*FastPathUpdatePDU, error) {
@@ -461,7 +549,12 @@ func readFastPathUpdatePDU(r io.Reader) (*FastPathUpdatePDU, error) {
 	if err != nil {
 		return nil, err
 	}
-	f.CompressionFlags, err = core.ReadUInt8(r)
+	// the compression flags are only there when compression is used
+	if (f.UpdateHeader>>6)&FASTPATH_OUTPUT_COMPRESSION_USED != 0 {
+		if f.CompressionFlags, err = core.ReadUInt8(r); err != nil {
+			return nil, err
+		}
+	}
 	f.Size, err = core.ReadUint16LE(r)
 	if err != nil {
 		return nil, err
@@ -470,24 +563,27 @@ func readFastPathUpdatePDU(r io.Reader) (*FastPathUpdatePDU, error) {
 	if err != nil {
 		return nil, err
 	}
-	var d UpdateData
-	switch f.UpdateHeader & 0xf {
-	case FASTPATH_UPDATETYPE_BITMAP:
-		d = &FastPathBitmapUpdateDataPDU{}
-	default:
-		glog.Debug("unsupported FastPathUpdatePDU data type", f.UpdateHeader)
-		d = nil
+	if f.Fragmentation() != FASTPATH_FRAGMENT_SINGLE {
+		f.fragment = dataBytes
+		return f, nil
 	}
-	if d != nil {
-		err = struc.Unpack(bytes.NewReader(dataBytes), d)
-		if err != nil {
-			return nil, err
-		}
+	f.Data, err = readUpdateData(f.UpdateCode(), dataBytes)
+	if err != nil {
+		return nil, err
 	}
-	f.Data = d
 	return f, nil
 }
 
+// updateData of a fast path update once its fragments are put together
+func readUpdateData(code uint8, data []byte) (UpdateData, error) {
+	switch code {
+	case FASTPATH_UPDATETYPE_BITMAP:
+		return readBitmapUpdate(bytes.NewReader(data))
+	}
+	// nil for the other updates, RecvFastPath logs their code
+	return nil, nil
+}
+
 type ShareControlHeader struct {
 	TotalLength uint16 `struc:"little"`
 	PDUType     uint16 `struc:"little"`
@@ -525,13 +621,19 @@ func readPDU(r io.Reader) (*PDU, error) {
 	case PDUTYPE_DEMANDACTIVEPDU:
 		d, err = readDemandActivePDU(r)
 	case PDUTYPE_DATAPDU:
-		d, err = readDataPDU(r)
+		// updates are read to their end, bound them to the PDU
+		var body []byte
+		if header.TotalLength < 6 {
+			return nil, fmt.Errorf("PDU bad total length %d", header.TotalLength)
+		}
+		if body, err = core.ReadBytes(int(header.TotalLength)-6, r); err != nil {
+			return nil, err
+		}
+		d, err = readDataPDU(bytes.NewReader(body))
 	case PDUTYPE_CONFIRMACTIVEPDU:
 		d, err = readConfirmActivePDU(r)
 	case PDUTYPE_DEACTIVATEALLPDU:
 		d, err = readDeactiveAllPDU(r)
-	default:
-		glog.Error("PDU invalid pdu type")
 	}
 	if err != nil {
 		return nil, err
@@ -0,0 +1,66 @@
+package pdu
+
+import "fmt"
+
+/**
+ * errorInfo of the Set Error Info PDU, the reason the server gives
+ * before it disconnects the client
+ * @see https://msdn.microsoft.com/en-us/library/cc240544.aspx
+ */
+const (
+	ERRINFO_NONE                              = 0x00000000
+	ERRINFO_RPC_INITIATED_DISCONNECT          = 0x00000001
+	ERRINFO_RPC_INITIATED_LOGOFF              = 0x00000002
+	ERRINFO_IDLE_TIMEOUT                      = 0x00000003
+	ERRINFO_LOGON_TIMEOUT                     = 0x00000004
+	ERRINFO_DISCONNECTED_BY_OTHERCONNECTION   = 0x00000005
+	ERRINFO_OUT_OF_MEMORY                     = 0x00000006
+	ERRINFO_SERVER_DENIED_CONNECTION          = 0x00000007
+	ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES    = 0x00000009
+	ERRINFO_SERVER_FRESH_CREDENTIALS_REQUIRED = 0x0000000A
+	ERRINFO_RPC_INITIATED_DISCONNECT_BYUSER   = 0x0000000B
+	ERRINFO_LOGOFF_BY_USER                    = 0x0000000C
+)
+
+var errorInfoNames = map[uint32]string{
+	ERRINFO_RPC_INITIATED_DISCONNECT:          "ERRINFO_RPC_INITIATED_DISCONNECT",
+	ERRINFO_RPC_INITIATED_LOGOFF:              "ERRINFO_RPC_INITIATED_LOGOFF",
+	ERRINFO_IDLE_TIMEOUT:                      "ERRINFO_IDLE_TIMEOUT",
+	ERRINFO_LOGON_TIMEOUT:                     "ERRINFO_LOGON_TIMEOUT",
+	ERRINFO_DISCONNECTED_BY_OTHERCONNECTION:   "ERRINFO_DISCONNECTED_BY_OTHERCONNECTION",
+	ERRINFO_OUT_OF_MEMORY:                     "ERRINFO_OUT_OF_MEMORY",
+	ERRINFO_SERVER_DENIED_CONNECTION:          "ERRINFO_SERVER_DENIED_CONNECTION",
+	ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES:    "ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES",
+	ERRINFO_SERVER_FRESH_CREDENTIALS_REQUIRED: "ERRINFO_SERVER_FRESH_CREDENTIALS_REQUIRED",
+	ERRINFO_RPC_INITIATED_DISCONNECT_BYUSER:   "ERRINFO_RPC_INITIATED_DISCONNECT_BYUSER",
+	ERRINFO_LOGOFF_BY_USER:                    "ERRINFO_LOGOFF_BY_USER",
+}
+
+// name of an errorInfo code, its hex value when it has none
+func ErrorInfoName(code uint32) string {
+	if name, ok := errorInfoNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%08x", code)
+}
+
+// Set Error Info PDU of the server, emitted as an error by the Client
+type ErrorInfoError struct {
+	Code uint32
+}
+
+func (e *ErrorInfoError) Error() string {
+	return fmt.Sprintf("server error info %s", ErrorInfoName(e.Code))
+}
+
+// reports p when it is a Set Error Info PDU, true when it was one
+func (c *Client) recvErrorInfo(p *PDU) bool {
+	dataPdu, ok := p.Message.(*DataPDU)
+	if !ok || dataPdu.Header.PDUType2 != PDUTYPE2_SET_ERROR_INFO_PDU {
+		return false
+	}
+	if code := dataPdu.Data.(*ErrorInfoDataPDU).ErrorInfo; code != ERRINFO_NONE {
+		c.Emit("error", &ErrorInfoError{Code: code})
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+//go:build go1.18
+// +build go1.18
+
+package pdu_test
+
+import (
+	"github.com/icodeface/grdp/core/testtransport"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/internal/fuzztest"
+	"github.com/icodeface/grdp/protocol/pdu"
+	"github.com/icodeface/grdp/protocol/t125/gcc"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func init() {
+	glog.SetLogger(log.New(ioutil.Discard, "", 0))
+	glog.SetLevel(glog.NONE)
+}
+
+func FuzzFastPathUpdate(f *testing.F) {
+	// bitmap update of a single empty rectangle
+	f.Add([]byte{0x01, 0x00, 0x16, 0x00, 0x01, 0x00, 0x01, 0x00,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x10, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{0x00, 0x00, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzztest.Check(t, func() {
+			c := pdu.NewClient(testtransport.New(), glog.Default())
+			c.On("error", fuzztest.NoPanic(t))
+			c.RecvFastPath(0, data)
+		})
+	})
+}
+
+// demand active then slow path PDUs, the way sec hands them over
+func FuzzPDUClient(f *testing.F) {
+	f.Add([]byte{0x0e, 0x00, 0x11, 0x00, 0xea, 0x03, 0xea, 0x03, 0x01, 0x00, 0x04, 0x00, 0x00, 0x00}, []byte{})
+	f.Add([]byte{}, []byte{0x06, 0x00, 0x16, 0x00, 0xea, 0x03})
+	f.Fuzz(func(t *testing.T, demandActive []byte, data []byte) {
+		fuzztest.Check(t, func() {
+			m := testtransport.New()
+			pdu.NewClient(m, glog.Default()).On("error", fuzztest.NoPanic(t))
+			m.Connect(gcc.NewClientCoreData(), gcc.NewServerCoreData(), uint16(1007), uint16(1003))
+			m.Inject(demandActive)
+			m.Inject(data)
+		})
+	})
+}
+
+// bitmaps of up to 16x16 pixels, the RLE decoder must not run past its buffers
+func FuzzBitmapRGBA(f *testing.F) {
+	f.Add(uint8(4), uint8(2), uint16(16), true, []byte{0x64, 0x00, 0xf8, 0x22, 0x01, 0xfd})
+	f.Add(uint8(2), uint8(1), uint16(24), true, []byte{0xf4, 0x02, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff})
+	f.Add(uint8(1), uint8(1), uint16(32), false, []byte{0x00, 0xff, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, width, height uint8, bpp uint16, compressed bool, data []byte) {
+		b := pdu.BitmapData{Width: uint16(width % 17), Height: uint16(height % 17), BitsPerPixel: bpp, BitmapDataStream: data}
+		if compressed {
+			b.Flags = pdu.BITMAP_COMPRESSION
+		}
+		fuzztest.Check(t, func() {
+			b.RGBA()
+		})
+	})
+}
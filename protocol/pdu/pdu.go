@@ -2,8 +2,6 @@ package pdu
 
 import (
 	"bytes"
-	"encoding/hex"
-	"fmt"
 	"github.com/icodeface/grdp/core"
 	"github.com/icodeface/grdp/emission"
 	"github.com/icodeface/grdp/glog"
@@ -19,12 +17,14 @@ type PDULayer struct {
 	serverCapabilities map[CapsType]Capability
 	clientCapabilities map[CapsType]Capability
 	fastPathSender     core.FastPathSender
+	log                glog.Logger
 }
 
-func NewPDULayer(t core.Transport) *PDULayer {
+func NewPDULayer(t core.Transport, log glog.Logger) *PDULayer {
 	p := &PDULayer{
 		Emitter:   *emission.NewEmitter(),
 		transport: t,
+		log:       log,
 		sharedId:  0x103EA,
 		serverCapabilities: map[CapsType]Capability{
 			CAPSTYPE_GENERAL: &GeneralCapability{
@@ -106,18 +106,20 @@ func (p *PDULayer) SetFastPathSender(f core.FastPathSender) {
 type Client struct {
 	*PDULayer
 	clientCoreData *gcc.ClientCoreData
+	// fast path update data put together from its fragments
+	fragment []byte
 }
 
-func NewClient(t core.Transport) *Client {
+func NewClient(t core.Transport, log glog.Logger) *Client {
 	c := &Client{
-		PDULayer: NewPDULayer(t),
+		PDULayer: NewPDULayer(t, log),
 	}
 	c.transport.Once("connect", c.connect)
 	return c
 }
 
-func (c *Client) connect(data *gcc.ClientCoreData, userId uint16, channelId uint16) {
-	glog.Debug("pdu connect")
+func (c *Client) connect(data *gcc.ClientCoreData, _ *gcc.ServerCoreData, userId uint16, channelId uint16) {
+	c.log.Debug("PDU connect")
 	c.clientCoreData = data
 	c.userId = userId
 	c.channelId = channelId
@@ -125,15 +127,21 @@ func (c *Client) connect(data *gcc.ClientCoreData, userId uint16, channelId uint
 }
 
 func (c *Client) recvDemandActivePDU(s []byte) {
-	glog.Debug("PDU recvDemandActivePDU", hex.EncodeToString(s))
+	if c.log.IsDebug() {
+		c.log.Debug("PDU recvDemandActivePDU", "data", core.Dump(s, core.DumpMax))
+	}
 	r := bytes.NewReader(s)
 	pdu, err := readPDU(r)
 	if err != nil {
-		glog.Error(err)
+		c.log.Error("PDU read error", "err", err)
+		return
+	}
+	if c.recvErrorInfo(pdu) {
+		c.transport.Once("data", c.recvDemandActivePDU)
 		return
 	}
 	if pdu.ShareCtrlHeader.PDUType != PDUTYPE_DEMANDACTIVEPDU {
-		glog.Info("PDU ignore message during connection sequence, type is", pdu.ShareCtrlHeader.PDUType)
+		c.log.Info("PDU ignore message during connection sequence", "type", pdu.ShareCtrlHeader.PDUType)
 		c.transport.Once("data", c.recvDemandActivePDU)
 		return
 	}
@@ -149,7 +157,7 @@ func (c *Client) recvDemandActivePDU(s []byte) {
 }
 
 func (c *Client) sendConfirmActivePDU() {
-	glog.Debug("PDU start sendConfirmActivePDU")
+	c.log.Debug("PDU start sendConfirmActivePDU")
 	generalCapa := c.clientCapabilities[CAPSTYPE_GENERAL].(*GeneralCapability)
 	generalCapa.OSMajorType = OSMAJORTYPE_WINDOWS
 	generalCapa.OSMinorType = OSMINORTYPE_WINDOWS_NT
@@ -158,7 +166,7 @@ func (c *Client) sendConfirmActivePDU() {
 	generalCapa.ExtraFlags |= FASTPATH_OUTPUT_SUPPORTED
 
 	bitmapCapa := c.clientCapabilities[CAPSTYPE_BITMAP].(*BitmapCapability)
-	bitmapCapa.PreferredBitsPerPixel = c.clientCoreData.HighColorDepth
+	bitmapCapa.PreferredBitsPerPixel = gcc.HighColor(c.clientCoreData.BitsPerPixel())
 	bitmapCapa.DesktopWidth = c.clientCoreData.DesktopWidth
 	bitmapCapa.DesktopHeight = c.clientCoreData.DesktopHeight
 
@@ -170,7 +178,7 @@ func (c *Client) sendConfirmActivePDU() {
 	inputCapa.KeyboardLayout = c.clientCoreData.KbdLayout
 	inputCapa.KeyboardType = c.clientCoreData.KeyboardType
 	inputCapa.KeyboardSubType = c.clientCoreData.KeyboardSubType
-	// inputCapa.KeyboardFunctionKey = c.clientCoreData.KeyboardFnKeys
+	inputCapa.KeyboardFunctionKey = c.clientCoreData.KeyboardFnKeys
 	inputCapa.ImeFileName = c.clientCoreData.ImeFileName
 
 	pdu := NewConfirmActivePDU()
@@ -182,7 +190,7 @@ func (c *Client) sendConfirmActivePDU() {
 }
 
 func (c *Client) sendClientFinalizeSynchronizePDU() {
-	glog.Debug("PDU start sendClientFinalizeSynchronizePDU")
+	c.log.Debug("PDU start sendClientFinalizeSynchronizePDU")
 	c.sendDataPDU(NewSynchronizeDataPDU(c.channelId))
 	c.sendDataPDU(&ControlDataPDU{Action: CTRLACTION_COOPERATE})
 	c.sendDataPDU(&ControlDataPDU{Action: CTRLACTION_REQUEST_CONTROL})
@@ -190,19 +198,23 @@ func (c *Client) sendClientFinalizeSynchronizePDU() {
 }
 
 func (c *Client) recvServerSynchronizePDU(s []byte) {
-	glog.Debug("PDU recvServerSynchronizePDU")
+	c.log.Debug("PDU recvServerSynchronizePDU")
 	r := bytes.NewReader(s)
 	pdu, err := readPDU(r)
 	if err != nil {
-		glog.Error(err)
+		c.log.Error("PDU read error", "err", err)
+		return
+	}
+	if c.recvErrorInfo(pdu) {
+		c.transport.Once("data", c.recvServerSynchronizePDU)
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
 	if !ok || dataPdu.Header.PDUType2 != PDUTYPE2_SYNCHRONIZE {
 		if ok {
-			glog.Error("recvServerSynchronizePDU ignore datapdu type2", dataPdu.Header.PDUType2)
+			c.log.Error("PDU recvServerSynchronizePDU ignore datapdu", "type2", dataPdu.Header.PDUType2)
 		} else {
-			glog.Error("recvServerSynchronizePDU ignore message type", pdu.ShareCtrlHeader.PDUType)
+			c.log.Error("PDU recvServerSynchronizePDU ignore message", "type", pdu.ShareCtrlHeader.PDUType)
 		}
 		c.transport.Once("data", c.recvServerSynchronizePDU)
 		return
@@ -211,25 +223,29 @@ func (c *Client) recvServerSynchronizePDU(s []byte) {
 }
 
 func (c *Client) recvServerControlCooperatePDU(s []byte) {
-	glog.Debug("PDU recvServerControlCooperatePDU")
+	c.log.Debug("PDU recvServerControlCooperatePDU")
 	r := bytes.NewReader(s)
 	pdu, err := readPDU(r)
 	if err != nil {
-		glog.Error(err)
+		c.log.Error("PDU read error", "err", err)
+		return
+	}
+	if c.recvErrorInfo(pdu) {
+		c.transport.Once("data", c.recvServerControlCooperatePDU)
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
 	if !ok || dataPdu.Header.PDUType2 != PDUTYPE2_CONTROL {
 		if ok {
-			glog.Error("recvServerControlCooperatePDU ignore datapdu type2", dataPdu.Header.PDUType2)
+			c.log.Error("PDU recvServerControlCooperatePDU ignore datapdu", "type2", dataPdu.Header.PDUType2)
 		} else {
-			glog.Error("recvServerControlCooperatePDU ignore message type", pdu.ShareCtrlHeader.PDUType)
+			c.log.Error("PDU recvServerControlCooperatePDU ignore message", "type", pdu.ShareCtrlHeader.PDUType)
 		}
 		c.transport.Once("data", c.recvServerControlCooperatePDU)
 		return
 	}
 	if dataPdu.Data.(*ControlDataPDU).Action != CTRLACTION_COOPERATE {
-		glog.Error("recvServerControlCooperatePDU ignore action", dataPdu.Data.(*ControlDataPDU).Action)
+		c.log.Error("PDU recvServerControlCooperatePDU ignore action", "action", dataPdu.Data.(*ControlDataPDU).Action)
 		c.transport.Once("data", c.recvServerControlCooperatePDU)
 		return
 	}
@@ -237,25 +253,29 @@ func (c *Client) recvServerControlCooperatePDU(s []byte) {
 }
 
 func (c *Client) recvServerControlGrantedPDU(s []byte) {
-	glog.Debug("PDU recvServerControlGrantedPDU")
+	c.log.Debug("PDU recvServerControlGrantedPDU")
 	r := bytes.NewReader(s)
 	pdu, err := readPDU(r)
 	if err != nil {
-		glog.Error(err)
+		c.log.Error("PDU read error", "err", err)
+		return
+	}
+	if c.recvErrorInfo(pdu) {
+		c.transport.Once("data", c.recvServerControlGrantedPDU)
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
 	if !ok || dataPdu.Header.PDUType2 != PDUTYPE2_CONTROL {
 		if ok {
-			glog.Error("recvServerControlGrantedPDU ignore datapdu type2", dataPdu.Header.PDUType2)
+			c.log.Error("PDU recvServerControlGrantedPDU ignore datapdu", "type2", dataPdu.Header.PDUType2)
 		} else {
-			glog.Error("recvServerControlGrantedPDU ignore message type", pdu.ShareCtrlHeader.PDUType)
+			c.log.Error("PDU recvServerControlGrantedPDU ignore message", "type", pdu.ShareCtrlHeader.PDUType)
 		}
 		c.transport.Once("data", c.recvServerControlGrantedPDU)
 		return
 	}
 	if dataPdu.Data.(*ControlDataPDU).Action != CTRLACTION_GRANTED_CONTROL {
-		glog.Error("recvServerControlGrantedPDU ignore action", dataPdu.Data.(*ControlDataPDU).Action)
+		c.log.Error("PDU recvServerControlGrantedPDU ignore action", "action", dataPdu.Data.(*ControlDataPDU).Action)
 		c.transport.Once("data", c.recvServerControlGrantedPDU)
 		return
 	}
@@ -263,19 +283,23 @@ func (c *Client) recvServerControlGrantedPDU(s []byte) {
 }
 
 func (c *Client) recvServerFontMapPDU(s []byte) {
-	glog.Debug("PDU recvServerFontMapPDU")
+	c.log.Debug("PDU recvServerFontMapPDU")
 	r := bytes.NewReader(s)
 	pdu, err := readPDU(r)
 	if err != nil {
-		glog.Error(err)
+		c.log.Error("PDU read error", "err", err)
+		return
+	}
+	if c.recvErrorInfo(pdu) {
+		c.transport.Once("data", c.recvServerFontMapPDU)
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
 	if !ok || dataPdu.Header.PDUType2 != PDUTYPE2_FONTMAP {
 		if ok {
-			glog.Error("recvServerFontMapPDU ignore datapdu type2", dataPdu.Header.PDUType2)
+			c.log.Error("PDU recvServerFontMapPDU ignore datapdu", "type2", dataPdu.Header.PDUType2)
 		} else {
-			glog.Error("recvServerFontMapPDU ignore message type", pdu.ShareCtrlHeader.PDUType)
+			c.log.Error("PDU recvServerFontMapPDU ignore message", "type", pdu.ShareCtrlHeader.PDUType)
 		}
 		return
 	}
@@ -284,31 +308,102 @@ func (c *Client) recvServerFontMapPDU(s []byte) {
 }
 
 func (c *Client) recvPDU(s []byte) {
-	fmt.Println("PDU recvPDU", hex.EncodeToString(s))
+	if c.log.IsDebug() {
+		c.log.Debug("PDU recvPDU", "data", core.Dump(s, core.DumpMax))
+	}
 	r := bytes.NewReader(s)
 	for r.Len() > 0 {
 		p, err := readPDU(r)
 		if err != nil {
-			glog.Error(err)
-			return
+			c.log.Error("PDU read error", "err", err)
+			break
 		}
-		if p.ShareCtrlHeader.PDUType == PDUTYPE_DEACTIVATEALLPDU {
-			c.transport.On("data", c.recvDemandActivePDU)
+		if c.recvErrorInfo(p) {
+			continue
+		}
+		switch p.ShareCtrlHeader.PDUType {
+		case PDUTYPE_DEACTIVATEALLPDU:
+			// the server activates the client again with a demand active
+			c.transport.Once("data", c.recvDemandActivePDU)
+			return
+		case PDUTYPE_DATAPDU:
+			if update, ok := p.Message.(*DataPDU).Data.(*UpdateDataPDU); ok {
+				if bitmap, ok := update.Data.(*FastPathBitmapUpdateDataPDU); ok {
+					c.Emit("update", bitmap.Rectangles)
+				}
+			}
 		}
 	}
+	c.transport.Once("data", c.recvPDU)
 }
 
 func (c *Client) RecvFastPath(secFlag byte, s []byte) {
-	glog.Debug("PDU RecvFastPath", hex.EncodeToString(s))
+	if c.log.IsDebug() {
+		c.log.Debug("PDU RecvFastPath", "data", core.Dump(s, core.DumpMax))
+	}
 	r := bytes.NewReader(s)
 	for r.Len() > 0 {
 		p, err := readFastPathUpdatePDU(r)
 		if err != nil {
-			glog.Error(err)
+			c.log.Error("PDU read error", "err", err)
 			return
 		}
-		if p.UpdateHeader == FASTPATH_UPDATETYPE_BITMAP {
-			c.Emit("update", p.Data.(*FastPathBitmapUpdateDataPDU).Rectangles)
+		switch p.Fragmentation() {
+		case FASTPATH_FRAGMENT_FIRST:
+			c.fragment = append([]byte{}, p.fragment...)
+			continue
+		case FASTPATH_FRAGMENT_NEXT, FASTPATH_FRAGMENT_LAST:
+			if c.fragment == nil {
+				c.log.Error("PDU RecvFastPath fragment without the first one")
+				continue
+			}
+			c.fragment = append(c.fragment, p.fragment...)
+			if p.Fragmentation() == FASTPATH_FRAGMENT_NEXT {
+				continue
+			}
+			data := c.fragment
+			c.fragment = nil
+			if p.Data, err = readUpdateData(p.UpdateCode(), data); err != nil {
+				c.log.Error("PDU read error", "err", err)
+				return
+			}
 		}
+		if bitmap, ok := p.Data.(*FastPathBitmapUpdateDataPDU); ok {
+			c.Emit("update", bitmap.Rectangles)
+		} else if p.Data == nil {
+			c.log.Debug("PDU RecvFastPath unsupported update", "code", p.UpdateCode())
+		}
+	}
+}
+
+// asks the server to send the area again, as bitmap updates
+func (c *Client) RefreshRect(left, top, right, bottom uint16) {
+	c.sendDataPDU(&RefreshRectDataPDU{
+		AreasToRefresh: []InclusiveRectangle{{Left: left, Top: top, Right: right, Bottom: bottom}},
+	})
+}
+
+/**
+ * Size of the desktop given by the server in its demand active, the
+ * one the client asked for before. Valid once the client is "ready"
+ */
+func (c *Client) DesktopSize() (width, height uint16) {
+	if bitmap, ok := c.serverCapabilities[CAPSTYPE_BITMAP].(*BitmapCapability); ok && bitmap.DesktopWidth != 0 {
+		return bitmap.DesktopWidth, bitmap.DesktopHeight
+	}
+	if c.clientCoreData != nil {
+		return c.clientCoreData.DesktopWidth, c.clientCoreData.DesktopHeight
+	}
+	return 0, 0
+}
+
+// bits per pixel of the session given by the server, see DesktopSize
+func (c *Client) BitsPerPixel() uint16 {
+	if bitmap, ok := c.serverCapabilities[CAPSTYPE_BITMAP].(*BitmapCapability); ok && bitmap.PreferredBitsPerPixel != 0 {
+		return uint16(bitmap.PreferredBitsPerPixel)
+	}
+	if c.clientCoreData != nil {
+		return c.clientCoreData.BitsPerPixel()
 	}
+	return 0
 }
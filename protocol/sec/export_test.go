@@ -0,0 +1,20 @@
+package sec
+
+import (
+	"github.com/icodeface/grdp/core"
+	"io"
+)
+
+func ReadSecurityHeader(r io.Reader) (uint16, uint16, error) {
+	h, err := readSecurityHeader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return h.securityFlag, h.securityFlagHi, nil
+}
+
+func SerializeInfo(domain, user, password []byte) ([]byte, core.Range) {
+	info := NewRDPInfo()
+	info.Domain, info.UserName, info.Password = domain, user, password
+	return info.Serialize(true), info.passwordRange()
+}
@@ -0,0 +1,46 @@
+//go:build go1.18
+// +build go1.18
+
+package sec_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/icodeface/grdp/core/testtransport"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/internal/fuzztest"
+	"github.com/icodeface/grdp/protocol/sec"
+	"github.com/icodeface/grdp/protocol/t125"
+	"github.com/icodeface/grdp/protocol/t125/gcc"
+	"testing"
+)
+
+func FuzzSecurityHeader(f *testing.F) {
+	f.Add([]byte{0x80, 0, 0x01, 0})
+	f.Add([]byte{0x80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzztest.Check(t, func() {
+			_, _, err := sec.ReadSecurityHeader(bytes.NewReader(data))
+			if (err == nil) != (len(data) >= 4) {
+				t.Error(len(data), err)
+			}
+		})
+	})
+}
+
+// licensing then channel data, the way MCS hands them over on the global channel
+func FuzzSecClient(f *testing.F) {
+	license, _ := hex.DecodeString("80000000" + "ff031000070000000200000004000000")
+	f.Add(license, []byte{0x01, 0x02})
+	f.Add([]byte{0x80, 0x00}, []byte{})
+	f.Fuzz(func(t *testing.T, license []byte, data []byte) {
+		fuzztest.Check(t, func() {
+			m := testtransport.New()
+			sec.NewClient(m, glog.Default()).On("error", fuzztest.NoPanic(t))
+			m.Connect([]interface{}{gcc.NewClientCoreData()}, []interface{}{}, uint16(1007),
+				[]t125.MCSChannelInfo{{ID: 1003, Name: "global"}})
+			m.Emit("global", license)
+			m.Emit("global", data)
+		})
+	})
+}
@@ -2,7 +2,6 @@ package sec
 
 import (
 	"bytes"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/icodeface/grdp/core"
@@ -13,6 +12,7 @@ import (
 	"github.com/icodeface/grdp/protocol/t125/gcc"
 	"github.com/lunixbochs/struc"
 	"io"
+	"net"
 	"unicode/utf16"
 )
 
@@ -146,16 +146,27 @@ func (o *RDPInfo) Serialize(hasExtended bool) []byte {
 	return buff.Bytes()
 }
 
+// bytes of Serialize holding the password
+func (o *RDPInfo) passwordRange() core.Range {
+	// CodePage, Flag and the five lengths come first
+	return core.Range{Offset: 18 + len(o.Domain) + len(o.UserName), Length: len(o.Password)}
+}
+
 type SecurityHeader struct {
 	securityFlag   uint16
 	securityFlagHi uint16
 }
 
-func readSecurityHeader(r io.Reader) *SecurityHeader {
+func readSecurityHeader(r io.Reader) (*SecurityHeader, error) {
 	s := &SecurityHeader{}
-	s.securityFlag, _ = core.ReadUint16LE(r)
-	s.securityFlagHi, _ = core.ReadUint16LE(r)
-	return s
+	var err error
+	if s.securityFlag, err = core.ReadUint16LE(r); err != nil {
+		return nil, err
+	}
+	if s.securityFlagHi, err = core.ReadUint16LE(r); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 type SEC struct {
@@ -165,9 +176,10 @@ type SEC struct {
 	machineName string
 	clientData  []interface{}
 	serverData  []interface{}
+	log         glog.Logger
 }
 
-func NewSEC(t core.Transport) *SEC {
+func NewSEC(t core.Transport, log glog.Logger) *SEC {
 	sec := &SEC{
 		*emission.NewEmitter(),
 		t,
@@ -175,6 +187,7 @@ func NewSEC(t core.Transport) *SEC {
 		"",
 		nil,
 		nil,
+		log,
 	}
 
 	t.On("close", func() {
@@ -198,7 +211,13 @@ func (s *SEC) Close() error {
 }
 
 func (s *SEC) sendFlagged(flag uint16, data []byte) {
-	glog.Debug("sendFlagged", hex.EncodeToString(data))
+	if s.log.IsDebug() {
+		var secrets []core.Range
+		if flag&INFO_PKT != 0 {
+			secrets = append(secrets, s.info.passwordRange())
+		}
+		s.log.Debug("sendFlagged", "data", core.Redact(data, core.DumpMax, secrets))
+	}
 	buff := &bytes.Buffer{}
 	core.WriteUInt16LE(flag, buff)
 	core.WriteUInt16LE(0, buff)
@@ -212,9 +231,9 @@ type Client struct {
 	channelId uint16
 }
 
-func NewClient(t core.Transport) *Client {
+func NewClient(t core.Transport, log glog.Logger) *Client {
 	c := &Client{
-		SEC: NewSEC(t),
+		SEC: NewSEC(t, log),
 	}
 	t.On("connect", c.connect)
 	return c
@@ -227,7 +246,7 @@ func (c *Client) SetUser(user string) {
 	}
 	core.WriteUInt16LE(0, buff)
 	c.info.UserName = buff.Bytes()
-	fmt.Println(c.info.UserName)
+	c.log.Debug("sec SetUser", "user", user)
 }
 
 func (c *Client) SetPwd(pwd string) {
@@ -248,8 +267,43 @@ func (c *Client) SetDomain(domain string) {
 	c.info.Domain = buff.Bytes()
 }
 
+// ClientMachineName of the new license request
+func (c *Client) SetMachineName(name string) {
+	c.machineName = name
+}
+
+/**
+ * Address of the client in the extended info, its local address on the
+ * connection: AF_INET or AF_INET6 and the address as text
+ * @see https://msdn.microsoft.com/en-us/library/cc240476.aspx
+ */
+func (c *Client) SetClientAddress(ip net.IP) {
+	var family uint16 = AF_INET6
+	if ip.To4() != nil {
+		family = AF_INET
+	}
+	buff := &bytes.Buffer{}
+	for _, ch := range utf16.Encode([]rune(ip.String())) {
+		core.WriteUInt16LE(ch, buff)
+	}
+	core.WriteUInt16LE(0, buff)
+	c.info.ExtendedInfo.ClientAddressFamily = family
+	c.info.ExtendedInfo.ClientAddress = buff.Bytes()
+}
+
+// core data of the server connect response, nil when it sent none
+func (c *Client) serverCoreData() *gcc.ServerCoreData {
+	for _, v := range c.serverData {
+		if data, ok := v.(*gcc.ServerCoreData); ok {
+			return data
+		}
+	}
+	return nil
+}
+
 func (c *Client) connect(clientData []interface{}, serverData []interface{}, userId uint16, channels []t125.MCSChannelInfo) {
-	glog.Debug("sec on connect")
+	glog.SetPhase(c.log, core.PHASE_SEC)
+	c.log.Debug("sec on connect")
 	c.clientData = clientData
 	c.serverData = serverData
 	c.userId = userId
@@ -268,24 +322,37 @@ func (c *Client) sendInfoPkt() {
 }
 
 func (c *Client) recvLicenceInfo(s []byte) {
-	glog.Debug("sec recvLicenceInfo", hex.EncodeToString(s))
+	if c.log.IsDebug() {
+		c.log.Debug("sec recvLicenceInfo", "data", core.Dump(s, core.DumpMax))
+	}
 	r := bytes.NewReader(s)
-	if (readSecurityHeader(r).securityFlag & LICENSE_PKT) <= 0 {
-		c.Emit("error", errors.New("NODE_RDP_PROTOCOL_PDU_SEC_BAD_LICENSE_HEADER"))
+	header, err := readSecurityHeader(r)
+	if err != nil {
+		c.Emit("error", &lic.LicenseError{Err: fmt.Errorf("sec read security header: %w", err)})
+		return
+	}
+	if (header.securityFlag & LICENSE_PKT) <= 0 {
+		c.Emit("error", &lic.LicenseError{Err: errors.New("NODE_RDP_PROTOCOL_PDU_SEC_BAD_LICENSE_HEADER")})
 		return
 	}
 
-	p := lic.ReadLicensePacket(r)
+	p, err := lic.ReadLicensePacket(r)
+	if err != nil {
+		c.Emit("error", &lic.LicenseError{Err: fmt.Errorf("sec read license packet: %w", err)})
+		return
+	}
+
+	c.Emit("license", p)
 
 	switch p.BMsgtype {
 	case lic.NEW_LICENSE:
-		glog.Info("sec NEW_LICENSE")
+		c.log.Info("sec NEW_LICENSE")
 		c.Emit("success")
 		goto connect
 	case lic.ERROR_ALERT:
-		glog.Info("sec ERROR_ALERT")
 		message := p.LicensingMessage.(*lic.ErrorMessage)
-		if message.DwErrorCode == lic.STATUS_VALID_CLIENT && message.DwStateTransaction == lic.ST_NO_TRANSITION {
+		c.log.Info("sec ERROR_ALERT", "license", message)
+		if message.ValidClient() {
 			goto connect
 		}
 		goto retry
@@ -296,14 +363,16 @@ func (c *Client) recvLicenceInfo(s []byte) {
 		c.sendClientChallengeResponse()
 		goto retry
 	default:
-		glog.Error("Not a valid license packet")
-		c.Emit("error", errors.New("Not a valid license packet"))
+		err := fmt.Errorf("sec unexpected license packet %s", lic.MessageTypeName(p.BMsgtype))
+		c.log.Error("Not a valid license packet", "err", err)
+		c.Emit("error", &lic.LicenseError{Err: err})
 		return
 	}
 
 connect:
 	c.transport.On("global", c.recvData)
-	c.Emit("connect", c.clientData[0].(*gcc.ClientCoreData), c.userId, c.channelId)
+	glog.SetPhase(c.log, core.PHASE_PDU)
+	c.Emit("connect", c.clientData[0].(*gcc.ClientCoreData), c.serverCoreData(), c.userId, c.channelId)
 	return
 
 retry:
@@ -312,15 +381,17 @@ retry:
 }
 
 func (c *Client) sendClientNewLicenseRequest() {
-	glog.Debug("sec sendClientNewLicenseRequest todo")
+	c.log.Debug("sec sendClientNewLicenseRequest todo")
 
 }
 
 func (c *Client) sendClientChallengeResponse() {
-	glog.Debug("sec sendClientChallengeResponse todo")
+	c.log.Debug("sec sendClientChallengeResponse todo")
 }
 
 func (c *Client) recvData(s []byte) {
-	glog.Debug("sec recvData", hex.EncodeToString(s))
+	if c.log.IsDebug() {
+		c.log.Debug("sec recvData", "data", core.Dump(s, core.DumpMax))
+	}
 	c.Emit("data", s)
 }
@@ -0,0 +1,164 @@
+package sec_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/icodeface/grdp/core/testtransport"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/protocol/lic"
+	"github.com/icodeface/grdp/protocol/sec"
+	"github.com/icodeface/grdp/protocol/t125"
+	"github.com/icodeface/grdp/protocol/t125/gcc"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+)
+
+func init() {
+	glog.SetLogger(log.New(ioutil.Discard, "", 0))
+}
+
+func TestReadSecurityHeader(t *testing.T) {
+	flag, flagHi, err := sec.ReadSecurityHeader(bytes.NewReader([]byte{0x80, 0, 0x01, 0}))
+	if err != nil || flag != sec.LICENSE_PKT || flagHi != 1 {
+		t.Error(flag, flagHi, err, "not equal to", sec.LICENSE_PKT, 1)
+	}
+	for _, input := range [][]byte{{}, {0x80}, {0x80, 0, 0x01}} {
+		if _, _, err := sec.ReadSecurityHeader(bytes.NewReader(input)); err != io.ErrUnexpectedEOF {
+			t.Error(input, err, "not equal to", io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestInfoPasswordRange(t *testing.T) {
+	password := []byte("s\x00e\x00c\x00\x00\x00")
+	data, r := sec.SerializeInfo([]byte("d\x00\x00\x00"), []byte("u\x00\x00\x00"), password)
+	if !bytes.Equal(data[r.Offset:r.Offset+r.Length], password) {
+		t.Error(data[r.Offset:r.Offset+r.Length], "not equal to", password)
+	}
+}
+
+func TestClientConnect(t *testing.T) {
+	m := testtransport.New()
+	c := sec.NewClient(m, glog.Default())
+	c.SetUser("u")
+	c.SetPwd("sec")
+	c.SetDomain("d")
+	var licenses []*lic.LicensePacket
+	connected := false
+	c.On("license", func(p *lic.LicensePacket) {
+		licenses = append(licenses, p)
+	}).On("connect", func(*gcc.ClientCoreData, *gcc.ServerCoreData, uint16, uint16) {
+		connected = true
+	})
+
+	m.Connect([]interface{}{gcc.NewClientCoreData()}, []interface{}{}, uint16(1007),
+		[]t125.MCSChannelInfo{{ID: 1003, Name: "global"}})
+	writes := m.Writes()
+	if len(writes) != 1 {
+		t.Fatal(len(writes), "not equal to", 1)
+	}
+	info, _ := sec.SerializeInfo([]byte("d\x00\x00\x00"), []byte("u\x00\x00\x00"), []byte("s\x00e\x00c\x00\x00\x00"))
+	expected := append([]byte{sec.INFO_PKT, 0, 0, 0}, info...)
+	if !bytes.Equal(writes[0], expected) {
+		t.Error(hex.EncodeToString(writes[0]), "not equal to", hex.EncodeToString(expected))
+	}
+
+	// license error STATUS_VALID_CLIENT, the server issues no license
+	licensePkt, _ := hex.DecodeString("80000000" + "ff031000070000000200000004000000")
+	m.Emit("global", licensePkt)
+	if len(licenses) != 1 || !connected {
+		t.Error(licenses, connected, "not equal to", "1 license packet, connected")
+	}
+}
+
+func TestClientLicenseRetry(t *testing.T) {
+	m := testtransport.New()
+	c := sec.NewClient(m, glog.Default())
+	var licenses []*lic.LicensePacket
+	connected := false
+	c.On("license", func(p *lic.LicensePacket) {
+		licenses = append(licenses, p)
+	}).On("connect", func(*gcc.ClientCoreData, *gcc.ServerCoreData, uint16, uint16) {
+		connected = true
+	})
+	m.Connect([]interface{}{gcc.NewClientCoreData()}, []interface{}{}, uint16(1007),
+		[]t125.MCSChannelInfo{{ID: 1003, Name: "global"}})
+
+	// ERR_NO_LICENSE_SERVER, the client waits for the next license packet
+	licensePkt, _ := hex.DecodeString("80000000" + "ff030c000600000001000000")
+	m.Emit("global", licensePkt)
+	if len(licenses) != 1 || connected {
+		t.Fatal(licenses, connected, "not equal to", "1 license packet, not connected")
+	}
+	message := licenses[0].LicensingMessage.(*lic.ErrorMessage)
+	if message.String() != "ERR_NO_LICENSE_SERVER (ST_TOTAL_ABORT)" {
+		t.Error(message, "not equal to", "ERR_NO_LICENSE_SERVER (ST_TOTAL_ABORT)")
+	}
+	m.Emit("global", licensePkt)
+	if len(licenses) != 2 {
+		t.Error(len(licenses), "not equal to", 2)
+	}
+}
+
+func TestClientLicenseError(t *testing.T) {
+	inputs := []string{
+		// not a license packet
+		"00000000" + "ff031000070000000200000004000000",
+		// truncated license error
+		"80000000" + "ff031000",
+		// a client message, never sent by the server
+		"80000000" + "13030400",
+	}
+	for _, input := range inputs {
+		m := testtransport.New()
+		c := sec.NewClient(m, glog.Default())
+		var errs []error
+		c.On("error", func(err error) {
+			errs = append(errs, err)
+		})
+		m.Connect([]interface{}{gcc.NewClientCoreData()}, []interface{}{}, uint16(1007),
+			[]t125.MCSChannelInfo{{ID: 1003, Name: "global"}})
+		licensePkt, _ := hex.DecodeString(input)
+		m.Emit("global", licensePkt)
+		var licenseErr *lic.LicenseError
+		if len(errs) != 1 || !errors.Is(errs[0], lic.ErrLicense) || !errors.As(errs[0], &licenseErr) {
+			t.Error(input, errs, "not equal to", lic.ErrLicense)
+		}
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	tests := []struct {
+		ip      string
+		family  byte
+		address string
+	}{
+		{"10.0.0.1", 0x02, "10.0.0.1"},
+		{"2001:db8::1", 0x17, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		m := testtransport.New()
+		c := sec.NewClient(m, glog.Default())
+		c.SetClientAddress(net.ParseIP(tt.ip))
+		m.Connect([]interface{}{gcc.NewClientCoreData()}, []interface{}{}, uint16(1007),
+			[]t125.MCSChannelInfo{{ID: 1003, Name: "global"}})
+		writes := m.Writes()
+		if len(writes) != 1 {
+			t.Fatal(len(writes), "not equal to", 1)
+		}
+		address := []byte{}
+		for _, ch := range tt.address {
+			address = append(address, byte(ch), 0)
+		}
+		address = append(address, 0, 0)
+		// after the security header and the empty info fields
+		extended := append([]byte{tt.family, 0, byte(len(address)), 0}, address...)
+		if info := writes[0][4:]; !bytes.Equal(info[28:28+len(extended)], extended) {
+			t.Error(hex.EncodeToString(info), "not containing", hex.EncodeToString(extended))
+		}
+	}
+}
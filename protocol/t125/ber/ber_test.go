@@ -0,0 +1,29 @@
+package ber_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/icodeface/grdp/protocol/t125/ber"
+)
+
+func TestReadInteger(t *testing.T) {
+	cases := map[string]int{
+		"02017f":       0x7f,
+		"02020100":     0x0100,
+		"0203010203":   0x010203,
+		"0203ff0000":   0xff0000,
+		"020401020304": 0x01020304,
+	}
+	for encoded, expected := range cases {
+		data, _ := hex.DecodeString(encoded)
+		n, err := ber.ReadInteger(bytes.NewReader(data))
+		if err != nil {
+			t.Error(encoded, err)
+		}
+		if n != expected {
+			t.Error(encoded, n, "not equal to", expected)
+		}
+	}
+}
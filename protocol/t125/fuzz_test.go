@@ -0,0 +1,76 @@
+//go:build go1.18
+// +build go1.18
+
+package t125_test
+
+import (
+	"bytes"
+	"github.com/icodeface/grdp/core/testtransport"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/internal/fuzztest"
+	"github.com/icodeface/grdp/protocol/t125"
+	"github.com/icodeface/grdp/protocol/t125/gcc"
+	"github.com/icodeface/grdp/protocol/x224"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func init() {
+	glog.SetLogger(log.New(ioutil.Discard, "", 0))
+	glog.SetLevel(glog.NONE)
+}
+
+// Connect-Response header, result, calledConnectId and domain parameters
+var connectResponse = []byte{
+	0x7f, 0x66, 0x2a,
+	0x0a, 0x01, 0x00,
+	0x02, 0x01, 0x00,
+	0x30, 0x1a, 0x02, 0x01, 0x22, 0x02, 0x01, 0x03, 0x02, 0x01, 0x00, 0x02, 0x01, 0x01,
+	0x02, 0x01, 0x00, 0x02, 0x01, 0x01, 0x02, 0x03, 0x00, 0xff, 0xf8, 0x02, 0x01, 0x02,
+	0x04, 0x00,
+}
+
+func FuzzConnectResponse(f *testing.F) {
+	f.Add(connectResponse)
+	f.Add([]byte{0x7f, 0x66})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzztest.Check(t, func() {
+			t125.ReadConnectResponse(bytes.NewReader(data))
+		})
+	})
+}
+
+// GCC conference create response with SC_CORE, SC_SECURITY and SC_NET
+var conferenceCreateResponse = []byte{
+	0x00, 0x05, 0x00, 0x14, 0x7c, 0x00, 0x01, 0x32,
+	0x14, 0x76, 0x0a, 0x01, 0x01, 0x00, 0x01, 0xc0, 0x00, 'M', 'c', 'D', 'n', 0x24,
+	0x01, 0x0c, 0x10, 0x00, 0x0c, 0x00, 0x08, 0x00, 0x03, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00,
+	0x02, 0x0c, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x03, 0x0c, 0x08, 0x00, 0xeb, 0x03, 0x00, 0x00,
+}
+
+func FuzzConferenceCreateResponse(f *testing.F) {
+	f.Add(conferenceCreateResponse)
+	f.Add([]byte{0x00, 0x05})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzztest.Check(t, func() {
+			gcc.ReadConferenceCreateResponse(data)
+		})
+	})
+}
+
+// connect response then MCS domain PDUs, the way x224 hands them over
+func FuzzMCSClient(f *testing.F) {
+	f.Add(connectResponse, []byte{0x2e, 0x00, 0x03, 0xe9})
+	f.Add([]byte{}, []byte{0x68, 0x00, 0x01, 0x03, 0xeb, 0x70, 0x00})
+	f.Fuzz(func(t *testing.T, response []byte, domain []byte) {
+		fuzztest.Check(t, func() {
+			m := testtransport.New()
+			t125.NewMCSClient(m, glog.Default()).On("error", fuzztest.NoPanic(t))
+			m.Connect(x224.ProtocolSelection{Requested: x224.PROTOCOL_SSL, Selected: x224.PROTOCOL_SSL})
+			m.Inject(response)
+			m.Inject(domain)
+		})
+	})
+}
@@ -2,10 +2,14 @@ package gcc
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/icodeface/grdp/core"
 	"github.com/icodeface/grdp/glog"
 	"github.com/icodeface/grdp/protocol/t125/per"
 	"github.com/lunixbochs/struc"
+	"unicode/utf16"
 )
 
 var t124_02_98_oid = []byte{0, 0, 20, 124, 0, 1}
@@ -86,6 +90,17 @@ const (
 	RNS_UD_CS_SUPPORT_HEARTBEAT_PDU             = 0x0400
 )
 
+/**
+ * earlyCapabilityFlags of the server core data
+ * @see http://msdn.microsoft.com/en-us/library/cc240517.aspx
+ */
+const (
+	RNS_UD_SC_EDGE_ACTIONS_SUPPORTED_V1  uint32 = 0x00000001
+	RNS_UD_SC_DYNAMIC_DST_SUPPORTED      uint32 = 0x00000002
+	RNS_UD_SC_EDGE_ACTIONS_SUPPORTED_V2  uint32 = 0x00000004
+	RNS_UD_SC_SKIP_CHANNELJOIN_SUPPORTED uint32 = 0x00000008
+)
+
 /**
  * @see http://msdn.microsoft.com/en-us/library/cc240510.aspx
  */
@@ -104,13 +119,42 @@ const (
 /**
  * @see http://msdn.microsoft.com/en-us/library/cc240510.aspx
  */
-type VERSION uint32
+type RDPVersion uint32
+
+// Deprecated: use RDPVersion
+type VERSION = RDPVersion
 
 const (
-	RDP_VERSION_4      VERSION = 0x00080001
-	RDP_VERSION_5_PLUS         = 0x00080004
+	RDP_VERSION_4      RDPVersion = 0x00080001
+	RDP_VERSION_5_PLUS RDPVersion = 0x00080004
+	RDP_VERSION_10_0   RDPVersion = 0x00080005
+	RDP_VERSION_10_1   RDPVersion = 0x00080006
+	RDP_VERSION_10_2   RDPVersion = 0x00080007
+	RDP_VERSION_10_3   RDPVersion = 0x00080008
+	RDP_VERSION_10_4   RDPVersion = 0x00080009
+	RDP_VERSION_10_5   RDPVersion = 0x0008000a
+	RDP_VERSION_10_6   RDPVersion = 0x0008000b
+	RDP_VERSION_10_7   RDPVersion = 0x0008000c
+	RDP_VERSION_10_8   RDPVersion = 0x0008000d
+	RDP_VERSION_10_9   RDPVersion = 0x0008000e
+	RDP_VERSION_10_10  RDPVersion = 0x0008000f
+	RDP_VERSION_10_11  RDPVersion = 0x00080010
+	RDP_VERSION_10_12  RDPVersion = 0x00080011
 )
 
+// "RDP 4.0", "RDP 5.0+" from 5.0 to 8.1, "RDP 10.x", the hex value when unknown
+func (v RDPVersion) String() string {
+	switch {
+	case v == RDP_VERSION_4:
+		return "RDP 4.0"
+	case v == RDP_VERSION_5_PLUS:
+		return "RDP 5.0+"
+	case v >= RDP_VERSION_10_0 && v <= RDP_VERSION_10_12:
+		return fmt.Sprintf("RDP 10.%d", v-RDP_VERSION_10_0)
+	}
+	return fmt.Sprintf("0x%08x", uint32(v))
+}
+
 type Sequence uint16
 
 const (
@@ -201,8 +245,44 @@ const (
 	KOREAN                             = 0x00000412
 	DUTCH                              = 0x00000413
 	NORWEGIAN                          = 0x00000414
+	POLISH                             = 0x00000415
+	PORTUGUESE_BRAZIL                  = 0x00000416
+	ROMANIAN                           = 0x00000418
+	RUSSIAN                            = 0x00000419
+	CROATIAN                           = 0x0000041a
+	SLOVAK                             = 0x0000041b
+	SWEDISH                            = 0x0000041d
+	THAI                               = 0x0000041e
+	TURKISH                            = 0x0000041f
+	UKRAINIAN                          = 0x00000422
+	SLOVENIAN                          = 0x00000424
+	CHINESE_PRC                        = 0x00000804
+	SWISS_GERMAN                       = 0x00000807
+	UNITED_KINGDOM                     = 0x00000809
+	LATIN_AMERICAN                     = 0x0000080a
+	BELGIAN_FRENCH                     = 0x0000080c
+	PORTUGUESE                         = 0x00000816
+	CANADIAN_FRENCH                    = 0x00001009
+	US_DVORAK                          = 0x00010409
+	US_INTERNATIONAL                   = 0x00020409
 )
 
+var keyboardLayouts = map[KeyboardLayout]bool{
+	ARABIC: true, BULGARIAN: true, CHINESE_US_KEYBOARD: true, CZECH: true, DANISH: true,
+	GERMAN: true, GREEK: true, US: true, SPANISH: true, FINNISH: true, FRENCH: true,
+	HEBREW: true, HUNGARIAN: true, ICELANDIC: true, ITALIAN: true, JAPANESE: true,
+	KOREAN: true, DUTCH: true, NORWEGIAN: true, POLISH: true, PORTUGUESE_BRAZIL: true,
+	ROMANIAN: true, RUSSIAN: true, CROATIAN: true, SLOVAK: true, SWEDISH: true, THAI: true,
+	TURKISH: true, UKRAINIAN: true, SLOVENIAN: true, CHINESE_PRC: true, SWISS_GERMAN: true,
+	UNITED_KINGDOM: true, LATIN_AMERICAN: true, BELGIAN_FRENCH: true, PORTUGUESE: true,
+	CANADIAN_FRENCH: true, US_DVORAK: true, US_INTERNATIONAL: true,
+}
+
+// layout is one of the layouts above
+func IsKnownKeyboardLayout(layout KeyboardLayout) bool {
+	return keyboardLayouts[layout]
+}
+
 /**
  * @see http://msdn.microsoft.com/en-us/library/cc240521.aspx
  */
@@ -219,7 +299,7 @@ type ChannelDef struct {
 }
 
 type ClientCoreData struct {
-	RdpVersion             VERSION        `struc:"uint32,little"`
+	RdpVersion             RDPVersion     `struc:"uint32,little"`
 	DesktopWidth           uint16         `struc:"little"`
 	DesktopHeight          uint16         `struc:"little"`
 	ColorDepth             ColorDepth     `struc:"little"`
@@ -246,12 +326,89 @@ type ClientCoreData struct {
 func NewClientCoreData() *ClientCoreData {
 	return &ClientCoreData{
 		RDP_VERSION_5_PLUS, 1280, 800, RNS_UD_COLOR_8BPP,
-		RNS_UD_SAS_DEL, US, 3790, [32]byte{'m', 's', 't', 's', 'c'}, KT_IBM_101_102_KEYS,
+		RNS_UD_SAS_DEL, US, 3790, clientName("mstsc"), KT_IBM_101_102_KEYS,
 		0, 12, [64]byte{}, RNS_UD_COLOR_8BPP, 1, 0, HIGH_COLOR_24BPP,
 		RNS_UD_15BPP_SUPPORT | RNS_UD_16BPP_SUPPORT | RNS_UD_24BPP_SUPPORT | RNS_UD_32BPP_SUPPORT,
 		RNS_UD_CS_SUPPORT_ERRINFO_PDU, [64]byte{}, 0, 0, 0}
 }
 
+/**
+ * clientName of the core data in UTF-16LE, null terminated so at most
+ * 15 characters are kept, a surrogate pair is never split
+ * @see https://msdn.microsoft.com/en-us/library/cc240510.aspx
+ */
+func clientName(name string) [32]byte {
+	var b [32]byte
+	units := utf16.Encode([]rune(name))
+	if len(units) > 15 {
+		units = units[:15]
+		if utf16.IsSurrogate(rune(units[14])) && units[14] < 0xdc00 {
+			units = units[:14]
+		}
+	}
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+func (data *ClientCoreData) SetClientName(name string) {
+	data.ClientName = clientName(name)
+}
+
+// desktop size and color depth a client may request
+func CheckScreen(width, height, colorDepth uint16) error {
+	if width < 200 || width > 4096 || height < 200 || height > 2048 {
+		return fmt.Errorf("desktop %dx%d not within 200x200 and 4096x2048", width, height)
+	}
+	switch colorDepth {
+	case 8, 15, 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("color depth %d not 8, 15, 16, 24 or 32", colorDepth)
+}
+
+/**
+ * Request a width x height desktop of colorDepth bits per pixel, see
+ * CheckScreen. The depth is given in postBeta2ColorDepth and
+ * highColorDepth, 32 bpp with RNS_UD_CS_WANT_32BPP_SESSION, and it is
+ * the only one of supportedColorDepths except for 8 bpp which has no flag
+ */
+func (data *ClientCoreData) SetScreen(width, height, colorDepth uint16) error {
+	if err := CheckScreen(width, height, colorDepth); err != nil {
+		return err
+	}
+	data.DesktopWidth, data.DesktopHeight = width, height
+	data.EarlyCapabilityFlags &^= RNS_UD_CS_WANT_32BPP_SESSION
+	switch colorDepth {
+	case 8:
+		data.PostBeta2ColorDepth, data.HighColorDepth = RNS_UD_COLOR_8BPP, HIGH_COLOR_8BPP
+		data.SupportedColorDepths = RNS_UD_15BPP_SUPPORT | RNS_UD_16BPP_SUPPORT | RNS_UD_24BPP_SUPPORT | RNS_UD_32BPP_SUPPORT
+	case 15:
+		data.PostBeta2ColorDepth, data.HighColorDepth = RNS_UD_COLOR_16BPP_555, HIGH_COLOR_15BPP
+		data.SupportedColorDepths = RNS_UD_15BPP_SUPPORT
+	case 16:
+		data.PostBeta2ColorDepth, data.HighColorDepth = RNS_UD_COLOR_16BPP_565, HIGH_COLOR_16BPP
+		data.SupportedColorDepths = RNS_UD_16BPP_SUPPORT
+	case 24:
+		data.PostBeta2ColorDepth, data.HighColorDepth = RNS_UD_COLOR_24BPP, HIGH_COLOR_24BPP
+		data.SupportedColorDepths = RNS_UD_24BPP_SUPPORT
+	case 32:
+		data.PostBeta2ColorDepth, data.HighColorDepth = RNS_UD_COLOR_24BPP, HIGH_COLOR_24BPP
+		data.SupportedColorDepths = RNS_UD_32BPP_SUPPORT
+		data.EarlyCapabilityFlags |= RNS_UD_CS_WANT_32BPP_SESSION
+	}
+	return nil
+}
+
+// bits per pixel the client asked for, see SetScreen
+func (data *ClientCoreData) BitsPerPixel() uint16 {
+	if data.EarlyCapabilityFlags&RNS_UD_CS_WANT_32BPP_SESSION != 0 {
+		return 32
+	}
+	return uint16(data.HighColorDepth)
+}
+
 func (data *ClientCoreData) Block() []byte {
 	buff := &bytes.Buffer{}
 	core.WriteUInt16LE(CS_CORE, buff) // 01C0
@@ -297,23 +454,45 @@ func (d *ClientSecurityData) Block() []byte {
 	return buff.Bytes()
 }
 
+/**
+ * clientRequestedProtocols and earlyCapabilityFlags are optional, zero
+ * when the server did not send them
+ * @see http://msdn.microsoft.com/en-us/library/cc240517.aspx
+ */
 type ServerCoreData struct {
-	RdpVersion              VERSION
+	RdpVersion              RDPVersion
 	ClientRequestedProtocol uint32 //optional
 	EarlyCapabilityFlags    uint32 //optional
-	raw                     []byte
 }
 
 func NewServerCoreData() *ServerCoreData {
 	return &ServerCoreData{
-		RDP_VERSION_5_PLUS, 0, 0, []byte{}}
+		RDP_VERSION_5_PLUS, 0, 0}
 }
 
 func (d *ServerCoreData) Serialize() []byte {
 	return []byte{}
 }
 
+func readServerCoreData(data []byte) (*ServerCoreData, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("gcc server core data of %d bytes", len(data))
+	}
+	d := &ServerCoreData{RdpVersion: RDPVersion(binary.LittleEndian.Uint32(data))}
+	if len(data) >= 8 {
+		d.ClientRequestedProtocol = binary.LittleEndian.Uint32(data[4:])
+	}
+	if len(data) >= 12 {
+		d.EarlyCapabilityFlags = binary.LittleEndian.Uint32(data[8:])
+	}
+	return d, nil
+}
+
+/**
+ * @see http://msdn.microsoft.com/en-us/library/cc240522.aspx
+ */
 type ServerNetworkData struct {
+	MCSChannelId   uint16
 	ChannelIdArray []uint16
 }
 
@@ -321,6 +500,25 @@ func NewServerNetworkData() *ServerNetworkData {
 	return &ServerNetworkData{}
 }
 
+func readServerNetworkData(data []byte) (*ServerNetworkData, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("gcc server network data of %d bytes", len(data))
+	}
+	d := &ServerNetworkData{MCSChannelId: binary.LittleEndian.Uint16(data)}
+	count := int(binary.LittleEndian.Uint16(data[2:]))
+	if len(data) < 4+2*count {
+		return nil, fmt.Errorf("gcc server network data of %d bytes for %d channels", len(data), count)
+	}
+	for i := 0; i < count; i++ {
+		d.ChannelIdArray = append(d.ChannelIdArray, binary.LittleEndian.Uint16(data[4+2*i:]))
+	}
+	return d, nil
+}
+
+/**
+ * raw holds the server random and certificate of standard RDP security
+ * @see http://msdn.microsoft.com/en-us/library/cc240518.aspx
+ */
 type ServerSecurityData struct {
 	EncryptionMethod uint32
 	EncryptionLevel  uint32
@@ -332,6 +530,16 @@ func NewServerSecurityData() *ServerSecurityData {
 		0, 0, []byte{}}
 }
 
+func readServerSecurityData(data []byte) (*ServerSecurityData, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("gcc server security data of %d bytes", len(data))
+	}
+	return &ServerSecurityData{
+		binary.LittleEndian.Uint32(data),
+		binary.LittleEndian.Uint32(data[4:]),
+		data[8:]}, nil
+}
+
 func MakeConferenceCreateRequest(userData []byte) []byte {
 	buff := &bytes.Buffer{}
 	per.WriteChoice(0, buff)                        // 00
@@ -348,9 +556,70 @@ func MakeConferenceCreateRequest(userData []byte) []byte {
 	return buff.Bytes()
 }
 
-func ReadConferenceCreateResponse(data []byte) []interface{} {
-	// todo
-	glog.Debug("ReadConferenceCreateResponse todo")
+/**
+ * @returns the server data blocks of the conference create response,
+ * *ServerCoreData, *ServerSecurityData and *ServerNetworkData, the
+ * other blocks are skipped
+ */
+func ReadConferenceCreateResponse(data []byte) ([]interface{}, error) {
+	r := bytes.NewReader(data)
+	if _, err := per.ReadChoice(r); err != nil {
+		return nil, err
+	}
+	if ok, err := per.ReadObjectIdentifier(t124_02_98_oid, r); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.New("gcc invalid object identifier")
+	}
+	per.ReadLength(r)
+	per.ReadChoice(r)
+	per.ReadInteger16(r) // node id
+	per.ReadInteger(r)   // tag
+	per.ReadEnumerates(r)
+	per.ReadNumberOfSet(r)
+	per.ReadChoice(r)
+	if ok, err := per.ReadOctetStream(h221_sc_key, 4, r); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.New("gcc invalid h221 server key")
+	}
+	size, err := per.ReadLength(r)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := core.ReadBytes(int(size), r)
+	if err != nil {
+		return nil, err
+	}
+
 	ret := make([]interface{}, 0)
-	return ret
+	for len(blocks) > 0 {
+		if len(blocks) < 4 {
+			return nil, fmt.Errorf("gcc truncated user data header %x", blocks)
+		}
+		typ := Message(binary.LittleEndian.Uint16(blocks))
+		length := int(binary.LittleEndian.Uint16(blocks[2:]))
+		if length < 4 || length > len(blocks) {
+			return nil, fmt.Errorf("gcc user data 0x%04x of %d bytes, %d left", uint16(typ), length, len(blocks))
+		}
+		var block interface{}
+		switch typ {
+		case SC_CORE:
+			block, err = readServerCoreData(blocks[4:length])
+		case SC_SECURITY:
+			block, err = readServerSecurityData(blocks[4:length])
+		case SC_NET:
+			block, err = readServerNetworkData(blocks[4:length])
+		default:
+			glog.Debug(fmt.Sprintf("gcc skip server user data 0x%04x", uint16(typ)))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if block != nil {
+			ret = append(ret, block)
+		}
+		blocks = blocks[length:]
+	}
+	return ret, nil
 }
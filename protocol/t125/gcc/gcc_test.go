@@ -0,0 +1,245 @@
+package gcc_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/protocol/t125/gcc"
+	"github.com/lunixbochs/struc"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func init() {
+	glog.SetLogger(log.New(ioutil.Discard, "", 0))
+}
+
+func TestClientCoreDataBlock(t *testing.T) {
+	data := gcc.NewClientCoreData()
+	data.SetClientName("SCANNER-01")
+	data.ClientBuild = 2600
+	data.KbdLayout = gcc.FRENCH
+	data.ServerSelectedProtocol = 1
+	// laid out field by field from TS_UD_CS_CORE
+	expected := strings.Join([]string{
+		"01c0d800",     // CS_CORE, 216 bytes
+		"04000800",     // RDP_VERSION_5_PLUS
+		"0005", "2003", // 1280x800
+		"01ca", "03aa", // RNS_UD_COLOR_8BPP, RNS_UD_SAS_DEL
+		"0c040000", // FRENCH
+		"280a0000", // build 2600
+		"5300430041004e004e00450052002d0030003100" + strings.Repeat("00", 12),
+		"04000000", "00000000", "0c000000", // IBM 101/102 keys, 12 function keys
+		strings.Repeat("00", 64),   // imeFileName
+		"01ca", "0100", "00000000", // postBeta2ColorDepth, clientProductId, serialNumber
+		"1800", "0f00", "0100", // HIGH_COLOR_24BPP, 15 to 32 bpp, RNS_UD_CS_SUPPORT_ERRINFO_PDU
+		strings.Repeat("00", 64), // clientDigProductId
+		"00", "00", "01000000",   // connectionType, pad1octet, PROTOCOL_SSL
+	}, "")
+	if block := hex.EncodeToString(data.Block()); block != expected {
+		t.Error(block, "not equal to", expected)
+	}
+}
+
+func TestClientCoreDataRoundTrip(t *testing.T) {
+	data := gcc.NewClientCoreData()
+	data.KbdLayout = gcc.US_INTERNATIONAL
+	data.KeyboardType = gcc.KT_JAPANESE
+	data.KeyboardSubType = 2
+	data.KeyboardFnKeys = 12
+	var got gcc.ClientCoreData
+	if err := struc.Unpack(bytes.NewReader(data.Block()[4:]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != *data {
+		t.Error(got, "not equal to", *data)
+	}
+}
+
+func TestClientCoreDataSetScreen(t *testing.T) {
+	tests := []struct {
+		width, height, colorDepth uint16
+		postBeta2                 gcc.ColorDepth
+		highColor                 gcc.HighColor
+		supported                 uint16
+		want32                    bool
+	}{
+		{800, 600, 8, gcc.RNS_UD_COLOR_8BPP, gcc.HIGH_COLOR_8BPP,
+			gcc.RNS_UD_15BPP_SUPPORT | gcc.RNS_UD_16BPP_SUPPORT | gcc.RNS_UD_24BPP_SUPPORT | gcc.RNS_UD_32BPP_SUPPORT, false},
+		{1024, 768, 15, gcc.RNS_UD_COLOR_16BPP_555, gcc.HIGH_COLOR_15BPP, gcc.RNS_UD_15BPP_SUPPORT, false},
+		{1024, 768, 16, gcc.RNS_UD_COLOR_16BPP_565, gcc.HIGH_COLOR_16BPP, gcc.RNS_UD_16BPP_SUPPORT, false},
+		{1280, 1024, 24, gcc.RNS_UD_COLOR_24BPP, gcc.HIGH_COLOR_24BPP, gcc.RNS_UD_24BPP_SUPPORT, false},
+		{1920, 1080, 32, gcc.RNS_UD_COLOR_24BPP, gcc.HIGH_COLOR_24BPP, gcc.RNS_UD_32BPP_SUPPORT, true},
+	}
+	for _, test := range tests {
+		data := gcc.NewClientCoreData()
+		// a 32 bpp session asked for before is dropped
+		data.SetScreen(800, 600, 32)
+		if err := data.SetScreen(test.width, test.height, test.colorDepth); err != nil {
+			t.Fatal(test.colorDepth, err)
+		}
+		if data.DesktopWidth != test.width || data.DesktopHeight != test.height ||
+			data.PostBeta2ColorDepth != test.postBeta2 || data.HighColorDepth != test.highColor ||
+			data.SupportedColorDepths != test.supported ||
+			(data.EarlyCapabilityFlags&gcc.RNS_UD_CS_WANT_32BPP_SESSION != 0) != test.want32 {
+			t.Error(test.colorDepth, *data)
+		}
+		if data.BitsPerPixel() != test.colorDepth {
+			t.Error(data.BitsPerPixel(), "not equal to", test.colorDepth)
+		}
+		if data.EarlyCapabilityFlags&gcc.RNS_UD_CS_SUPPORT_ERRINFO_PDU == 0 {
+			t.Error(test.colorDepth, "without RNS_UD_CS_SUPPORT_ERRINFO_PDU")
+		}
+	}
+	for _, screen := range [][3]uint16{{4097, 1080, 32}, {1920, 2049, 32}, {199, 600, 16}, {800, 600, 12}, {800, 600, 0}} {
+		data := gcc.NewClientCoreData()
+		if err := data.SetScreen(screen[0], screen[1], screen[2]); err == nil {
+			t.Error(screen, "accepted")
+		}
+		if data.DesktopWidth != 1280 || data.DesktopHeight != 800 {
+			t.Error(screen, "changed the desktop")
+		}
+	}
+}
+
+func TestIsKnownKeyboardLayout(t *testing.T) {
+	for _, layout := range []gcc.KeyboardLayout{gcc.US, gcc.FRENCH, gcc.UNITED_KINGDOM, gcc.US_DVORAK} {
+		if !gcc.IsKnownKeyboardLayout(layout) {
+			t.Errorf("0x%08x not known", layout)
+		}
+	}
+	for _, layout := range []gcc.KeyboardLayout{0, 0x0000ffff, 0x12345678} {
+		if gcc.IsKnownKeyboardLayout(layout) {
+			t.Errorf("0x%08x known", layout)
+		}
+	}
+}
+
+func TestClientCoreDataClientName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"", ""},
+		{"mstsc", "mstsc"},
+		{"WORKSTATION-0123456789", "WORKSTATION-012"},
+		// a surrogate pair at the limit is dropped whole
+		{"WORKSTATION-01\U0001F600", "WORKSTATION-01"},
+	}
+	for _, test := range tests {
+		data := gcc.NewClientCoreData()
+		data.SetClientName(test.name)
+		units := make([]uint16, 16)
+		for i := range units {
+			units[i] = uint16(data.ClientName[2*i]) | uint16(data.ClientName[2*i+1])<<8
+		}
+		n := 0
+		for n < len(units) && units[n] != 0 {
+			n++
+		}
+		if got := string(utf16.Decode(units[:n])); got != test.expected || n == 16 {
+			t.Error(test.name, got, "not equal to", test.expected)
+		}
+	}
+}
+
+// GCC conference create response around the server data blocks
+func conferenceCreateResponse(blocks string) []byte {
+	data, _ := hex.DecodeString(blocks)
+	body := append([]byte{0x14, 0x76, 0x0a, 0x01, 0x01, 0x00, 0x01, 0xc0, 0x00, 'M', 'c', 'D', 'n', byte(len(data))}, data...)
+	return append([]byte{0x00, 0x05, 0x00, 0x14, 0x7c, 0x00, 0x01, byte(len(body))}, body...)
+}
+
+func TestReadConferenceCreateResponse(t *testing.T) {
+	// the shapes of Windows 7, Server 2016 and Server 2022 answers, laid
+	// out field by field from TS_UD_SC_CORE, TS_UD_SC_SEC1 and TS_UD_SC_NET
+	tests := []struct {
+		name     string
+		blocks   string
+		core     gcc.ServerCoreData
+		channels []uint16
+	}{
+		{
+			"12 byte core without earlyCapabilityFlags",
+			"010c0c00" + "04000800" + "01000000" +
+				"020c0c00" + "00000000" + "00000000" +
+				"030c0800" + "eb030000",
+			gcc.ServerCoreData{RdpVersion: gcc.RDP_VERSION_5_PLUS, ClientRequestedProtocol: 1}, nil,
+		},
+		{
+			"16 byte core and a static channel",
+			"010c1000" + "06000800" + "03000000" + "03000000" +
+				"020c0c00" + "00000000" + "00000000" +
+				"030c0c00" + "eb030100" + "ec030000",
+			gcc.ServerCoreData{RdpVersion: gcc.RDP_VERSION_10_1, ClientRequestedProtocol: 3, EarlyCapabilityFlags: gcc.RNS_UD_SC_EDGE_ACTIONS_SUPPORTED_V1 | gcc.RNS_UD_SC_DYNAMIC_DST_SUPPORTED},
+			[]uint16{1004},
+		},
+		{
+			// SC_MCS_MSGCHANNEL is skipped
+			"16 byte core and a message channel",
+			"010c1000" + "0e000800" + "0b000000" + "0f000000" +
+				"020c0c00" + "00000000" + "00000000" +
+				"030c0800" + "eb030000" +
+				"040c0600" + "f003",
+			gcc.ServerCoreData{RdpVersion: gcc.RDP_VERSION_10_9, ClientRequestedProtocol: 11, EarlyCapabilityFlags: gcc.RNS_UD_SC_EDGE_ACTIONS_SUPPORTED_V1 | gcc.RNS_UD_SC_DYNAMIC_DST_SUPPORTED |
+				gcc.RNS_UD_SC_EDGE_ACTIONS_SUPPORTED_V2 | gcc.RNS_UD_SC_SKIP_CHANNELJOIN_SUPPORTED},
+			nil,
+		},
+	}
+	for _, test := range tests {
+		blocks, err := gcc.ReadConferenceCreateResponse(conferenceCreateResponse(test.blocks))
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if len(blocks) != 3 {
+			t.Fatal(test.name, len(blocks), "not equal to", 3)
+		}
+		if core, ok := blocks[0].(*gcc.ServerCoreData); !ok || *core != test.core {
+			t.Error(test.name, blocks[0], "not equal to", test.core)
+		}
+		if security, ok := blocks[1].(*gcc.ServerSecurityData); !ok || security.EncryptionMethod != 0 || security.EncryptionLevel != 0 {
+			t.Error(test.name, blocks[1], "not equal to", "no encryption")
+		}
+		network, ok := blocks[2].(*gcc.ServerNetworkData)
+		if !ok || network.MCSChannelId != 1003 || fmt.Sprint(network.ChannelIdArray) != fmt.Sprint(test.channels) {
+			t.Error(test.name, blocks[2], "not equal to", test.channels)
+		}
+	}
+}
+
+func TestReadConferenceCreateResponseInvalid(t *testing.T) {
+	valid := conferenceCreateResponse("010c0c00" + "04000800" + "00000000")
+	tests := map[string][]byte{
+		"empty":     {},
+		"truncated": valid[:len(valid)-1],
+		"oid":       append([]byte{0x00, 0x05, 0x00, 0x14, 0x7c, 0x00, 0x02}, valid[7:]...),
+		"key":       bytes.Replace(valid, []byte("McDn"), []byte("Duca"), 1),
+		"core":      conferenceCreateResponse("010c0600" + "0400"),
+		"length":    conferenceCreateResponse("010c0200"),
+		"network":   conferenceCreateResponse("030c0800" + "eb030200"),
+	}
+	for name, data := range tests {
+		if blocks, err := gcc.ReadConferenceCreateResponse(data); err == nil {
+			t.Error(name, blocks, "accepted")
+		}
+	}
+}
+
+func TestRDPVersionString(t *testing.T) {
+	tests := map[gcc.RDPVersion]string{
+		gcc.RDP_VERSION_4:      "RDP 4.0",
+		gcc.RDP_VERSION_5_PLUS: "RDP 5.0+",
+		gcc.RDP_VERSION_10_0:   "RDP 10.0",
+		gcc.RDP_VERSION_10_12:  "RDP 10.12",
+		0x00080012:             "0x00080012",
+	}
+	for version, expected := range tests {
+		if version.String() != expected {
+			t.Error(version.String(), "not equal to", expected)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package t125
 
 import (
 	"bytes"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/icodeface/grdp/core"
@@ -11,6 +10,7 @@ import (
 	"github.com/icodeface/grdp/protocol/t125/ber"
 	"github.com/icodeface/grdp/protocol/t125/gcc"
 	"github.com/icodeface/grdp/protocol/t125/per"
+	"github.com/icodeface/grdp/protocol/x224"
 	"io"
 )
 
@@ -208,15 +208,17 @@ type MCS struct {
 	recvOpCode MCSDomainPDU
 	sendOpCode MCSDomainPDU
 	channels   []MCSChannelInfo
+	log        glog.Logger
 }
 
-func NewMCS(t core.Transport, recvOpCode MCSDomainPDU, sendOpCode MCSDomainPDU) *MCS {
+func NewMCS(t core.Transport, recvOpCode MCSDomainPDU, sendOpCode MCSDomainPDU, log glog.Logger) *MCS {
 	m := &MCS{
 		*emission.NewEmitter(),
 		t,
 		recvOpCode,
 		sendOpCode,
 		[]MCSChannelInfo{{MCS_GLOBAL_CHANNEL, "global"}},
+		log,
 	}
 
 	m.transport.On("close", func() {
@@ -253,9 +255,9 @@ type MCSClient struct {
 	userId            uint16
 }
 
-func NewMCSClient(t core.Transport) *MCSClient {
+func NewMCSClient(t core.Transport, log glog.Logger) *MCSClient {
 	c := &MCSClient{
-		MCS:                NewMCS(t, SEND_DATA_INDICATION, SEND_DATA_REQUEST),
+		MCS:                NewMCS(t, SEND_DATA_INDICATION, SEND_DATA_REQUEST, log),
 		clientCoreData:     gcc.NewClientCoreData(),
 		clientNetworkData:  gcc.NewClientNetworkData(),
 		clientSecurityData: gcc.NewClientSecurityData(),
@@ -264,9 +266,19 @@ func NewMCSClient(t core.Transport) *MCSClient {
 	return c
 }
 
-func (c *MCSClient) connect(selectedProtocol uint32) {
-	glog.Debug("mcs client on connect", selectedProtocol)
-	c.clientCoreData.ServerSelectedProtocol = selectedProtocol
+// core data sent in the connect initial, set it up before the connection
+func (c *MCSClient) ClientCoreData() *gcc.ClientCoreData {
+	return c.clientCoreData
+}
+
+// core data of the server connect response, nil until it is received
+func (c *MCSClient) ServerCoreData() *gcc.ServerCoreData {
+	return c.serverCoreData
+}
+
+func (c *MCSClient) connect(selection x224.ProtocolSelection) {
+	c.log.Debug("mcs client on connect", "selected", selection.Selected)
+	c.clientCoreData.ServerSelectedProtocol = selection.Selected
 
 	// sendConnectInitial
 	userDataBuff := bytes.Buffer{}
@@ -287,12 +299,14 @@ func (c *MCSClient) connect(selectedProtocol uint32) {
 		c.Emit("error", errors.New(fmt.Sprintf("mcs sendConnectInitial write error %v", err)))
 		return
 	}
-	glog.Debug("mcs wait for data event")
+	c.log.Debug("mcs wait for data event")
 	c.transport.Once("data", c.recvConnectResponse)
 }
 
 func (c *MCSClient) recvConnectResponse(s []byte) {
-	glog.Debug("mcs recvConnectResponse", hex.EncodeToString(s))
+	if c.log.IsDebug() {
+		c.log.Debug("mcs recvConnectResponse", "data", core.Dump(s, core.DumpMax))
+	}
 	cResp, err := ReadConnectResponse(bytes.NewReader(s))
 	if err != nil {
 		c.Emit("error", errors.New(fmt.Sprintf("ReadConnectResponse %v", err)))
@@ -300,33 +314,26 @@ func (c *MCSClient) recvConnectResponse(s []byte) {
 	}
 
 	// record server gcc block
-	serverSettings := gcc.ReadConferenceCreateResponse(cResp.userData)
+	serverSettings, err := gcc.ReadConferenceCreateResponse(cResp.userData)
+	if err != nil {
+		c.Emit("error", errors.New(fmt.Sprintf("ReadConferenceCreateResponse %v", err)))
+		return
+	}
 	for _, v := range serverSettings {
-		switch v.(type) {
-		case gcc.ServerSecurityData:
-			{
-				c.serverSecurityData = v.(*gcc.ServerSecurityData)
-			}
-		case gcc.ServerCoreData:
-			{
-				c.serverCoreData = v.(*gcc.ServerCoreData)
-			}
-		case gcc.ServerNetworkData:
-			{
-				c.serverNetworkData = v.(*gcc.ServerNetworkData)
-			}
-		default:
-			err := errors.New(fmt.Sprintf("unhandle server gcc block %v %v", v, cResp.userData))
-			glog.Error(err)
-			c.Emit("error", err)
-			return
+		switch v := v.(type) {
+		case *gcc.ServerSecurityData:
+			c.serverSecurityData = v
+		case *gcc.ServerCoreData:
+			c.serverCoreData = v
+		case *gcc.ServerNetworkData:
+			c.serverNetworkData = v
 		}
 	}
 
-	glog.Debug("mcs sendErectDomainRequest")
+	c.log.Debug("mcs sendErectDomainRequest")
 	c.sendErectDomainRequest()
 
-	glog.Debug("mcs sendAttachUserRequest")
+	c.log.Debug("mcs sendAttachUserRequest")
 	c.sendAttachUserRequest()
 
 	c.transport.Once("data", c.recvAttachUserConfirm)
@@ -340,6 +347,19 @@ func (c *MCSClient) sendErectDomainRequest() {
 	c.transport.Write(buff.Bytes())
 }
 
+/**
+ * Tell the server the user ends the domain, before the connection is closed
+ * @see http://www.itu.int/rec/T-REC-T.125-199802-I/en
+ */
+func (c *MCSClient) SendDisconnectProviderUltimatum() error {
+	buff := &bytes.Buffer{}
+	// reason rn-user-requested, its 2 bits span the header and the next byte
+	writeMCSPDUHeader(DISCONNECT_PROVIDER_ULTIMATUM, 1, buff)
+	core.WriteUInt8(0x80, buff)
+	_, err := c.transport.Write(buff.Bytes())
+	return err
+}
+
 func (c *MCSClient) sendAttachUserRequest() {
 	buff := &bytes.Buffer{}
 	writeMCSPDUHeader(ATTACH_USER_REQUEST, 0, buff)
@@ -347,7 +367,9 @@ func (c *MCSClient) sendAttachUserRequest() {
 }
 
 func (c *MCSClient) recvAttachUserConfirm(s []byte) {
-	glog.Debug("mcs recvAttachUserConfirm", hex.EncodeToString(s))
+	if c.log.IsDebug() {
+		c.log.Debug("mcs recvAttachUserConfirm", "data", core.Dump(s, core.DumpMax))
+	}
 	r := bytes.NewReader(s)
 
 	option, err := core.ReadUInt8(r)
@@ -380,7 +402,7 @@ func (c *MCSClient) recvAttachUserConfirm(s []byte) {
 }
 
 func (c *MCSClient) connectChannels() {
-	glog.Debug("mcs connectChannels")
+	c.log.Debug("mcs connectChannels")
 	if c.channelsConnected == len(c.channels) {
 		c.transport.On("data", c.recvData)
 		// send client and sever gcc informations callback to sec
@@ -392,7 +414,7 @@ func (c *MCSClient) connectChannels() {
 		serverData := make([]interface{}, 0)
 		serverData = append(serverData, c.serverCoreData)
 		serverData = append(serverData, c.serverSecurityData)
-		glog.Debug("msc connectChannels callback to sec")
+		c.log.Debug("mcs connectChannels callback to sec")
 		c.Emit("connect", clientData, serverData, c.userId, c.channels)
 		return
 	}
@@ -404,7 +426,7 @@ func (c *MCSClient) connectChannels() {
 }
 
 func (c *MCSClient) sendChannelJoinRequest(channelId uint16) {
-	glog.Debug("mcs sendChannelJoinRequest")
+	c.log.Debug("mcs sendChannelJoinRequest", "channel", channelId)
 	buff := &bytes.Buffer{}
 	writeMCSPDUHeader(CHANNEL_JOIN_REQUEST, 0, buff)
 	per.WriteInteger16(c.userId-MCS_USERCHANNEL_BASE, buff)
@@ -413,7 +435,7 @@ func (c *MCSClient) sendChannelJoinRequest(channelId uint16) {
 }
 
 func (c *MCSClient) recvData(s []byte) {
-	glog.Debug("msc on data recvData")
+	c.log.Debug("mcs on data recvData")
 
 	r := bytes.NewReader(s)
 	option, err := core.ReadUInt8(r)
@@ -450,7 +472,7 @@ func (c *MCSClient) recvData(s []byte) {
 		}
 	}
 	if !found {
-		glog.Error("mcs receive data for an unconnected layer")
+		c.log.Error("mcs receive data for an unconnected layer", "channel", channelId)
 		return
 	}
 	left, err := core.ReadBytes(int(size), r)
@@ -458,12 +480,14 @@ func (c *MCSClient) recvData(s []byte) {
 		c.Emit("error", errors.New(fmt.Sprintf("mcs recvData get data error %v", err)))
 		return
 	}
-	glog.Debug("mcs emit channel", channelName)
+	c.log.Debug("mcs emit channel", "channel", channelName)
 	c.Emit(channelName, left)
 }
 
 func (c *MCSClient) recvChannelJoinConfirm(s []byte) {
-	glog.Debug("mcs recvChannelJoinConfirm", hex.EncodeToString(s))
+	if c.log.IsDebug() {
+		c.log.Debug("mcs recvChannelJoinConfirm", "data", core.Dump(s, core.DumpMax))
+	}
 	r := bytes.NewReader(s)
 	option, err := core.ReadUInt8(r)
 	if err != nil {
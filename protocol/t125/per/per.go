@@ -2,6 +2,7 @@ package per
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/icodeface/grdp/core"
 	"io"
 )
@@ -54,13 +55,16 @@ func WriteLength(value int, w io.Writer) {
 func ReadLength(r io.Reader) (uint16, error) {
 	b, err := core.ReadUInt8(r)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	var size uint16
 	if b&0x80 > 0 {
 		b = b &^ 0x80
 		size = uint16(b) << 8
-		left, _ := core.ReadUInt8(r)
+		left, err := core.ReadUInt8(r)
+		if err != nil {
+			return 0, err
+		}
 		size += uint16(left)
 	} else {
 		size = uint16(b)
@@ -68,6 +72,71 @@ func ReadLength(r io.Reader) (uint16, error) {
 	return size, nil
 }
 
+func ReadChoice(r io.Reader) (uint8, error) {
+	return core.ReadUInt8(r)
+}
+
+func ReadNumberOfSet(r io.Reader) (uint8, error) {
+	return core.ReadUInt8(r)
+}
+
+/**
+ * @returns integer of 1, 2 or 4 bytes preceded by its length
+ */
+func ReadInteger(r io.Reader) (uint32, error) {
+	size, err := ReadLength(r)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		n, err := core.ReadUInt8(r)
+		return uint32(n), err
+	case 2:
+		n, err := core.ReadUint16BE(r)
+		return uint32(n), err
+	case 4:
+		return core.ReadUInt32BE(r)
+	}
+	return 0, fmt.Errorf("per invalid integer size %d", size)
+}
+
+/**
+ * @param oid {array} oid expected
+ * @returns false when the object identifier read is another one
+ */
+func ReadObjectIdentifier(oid []byte, r io.Reader) (bool, error) {
+	size, err := ReadLength(r)
+	if err != nil {
+		return false, err
+	}
+	if size != 5 {
+		return false, nil
+	}
+	b, err := core.ReadBytes(5, r)
+	if err != nil {
+		return false, err
+	}
+	return b[0]>>4 == oid[0] && b[0]&0x0f == oid[1] && bytes.Equal(b[1:], oid[2:6]), nil
+}
+
+/**
+ * @param oStr {String} octet stream expected
+ * @param minValue {integer} as written by WriteOctetStream
+ * @returns false when the octet stream read is another one
+ */
+func ReadOctetStream(oStr string, minValue int, r io.Reader) (bool, error) {
+	size, err := ReadLength(r)
+	if err != nil {
+		return false, err
+	}
+	b, err := core.ReadBytes(int(size)+minValue, r)
+	if err != nil {
+		return false, err
+	}
+	return string(b) == oStr, nil
+}
+
 /**
  * @param oid {array} oid to write
  * @returns {type.Component} per encoded object identifier
@@ -0,0 +1,51 @@
+//go:build go1.18
+// +build go1.18
+
+package tpkt_test
+
+import (
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/internal/fuzztest"
+	"github.com/icodeface/grdp/protocol/tpkt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func FuzzTPKT(f *testing.F) {
+	f.Add([]byte{3, 0, 0, 8, 1, 2, 3, 4, 3, 0, 0, 7, 5, 6, 7})
+	f.Add([]byte{tpkt.FASTPATH_ACTION_X224, 0, 0, 2})
+	f.Add([]byte{0, 0x80, 8, 1, 2, 3, 4, 5})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzztest.Check(t, func() {
+			client, server := net.Pipe()
+			layer := core.NewSocketLayer(client, nil, glog.Default())
+			defer layer.Close()
+			done := make(chan struct{})
+			tp := tpkt.New(layer, glog.Default())
+			tp.SetFastPathListener(fastPathListener{})
+			var once sync.Once
+			tp.On("error", func(err error) {
+				fuzztest.NoPanic(t)(err)
+				once.Do(func() { close(done) })
+			}).On("close", func() {
+				once.Do(func() { close(done) })
+			})
+			go func() {
+				server.Write(data)
+				server.Close()
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Error("neither error nor close once the input ended")
+			}
+		})
+	})
+}
+
+type fastPathListener struct{}
+
+func (fastPathListener) RecvFastPath(secFlag byte, s []byte) {}
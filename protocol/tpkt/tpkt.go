@@ -2,10 +2,13 @@ package tpkt
 
 import (
 	"bytes"
-	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/icodeface/grdp/core"
 	"github.com/icodeface/grdp/emission"
 	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/tls"
+	"io"
 )
 
 // take idea from https://github.com/Madnikulin50/gordp
@@ -21,6 +24,27 @@ const (
 	FASTPATH_ACTION_X224     = 0x3
 )
 
+/**
+ * Bounds of the length of a packet, header included. The smallest
+ * carries an X224 data header, the length of a fast path packet has 15
+ * bits
+ * @see http://msdn.microsoft.com/en-us/library/cc240621.aspx
+ */
+const (
+	MIN_PACKET_LENGTH          = 7
+	MAX_PACKET_LENGTH          = 0xffff
+	MAX_FASTPATH_PACKET_LENGTH = 0x7fff
+)
+
+// bytes Write sends in one packet, its header takes the others
+const MAX_PAYLOAD_LENGTH = MAX_PACKET_LENGTH - 4
+
+// the server side, see NewServer, has no CredSSP
+var ErrServerNLA = errors.New("tpkt server does not support nla")
+
+// the data does not fit the length of a packet, test with errors.Is
+var ErrPDUTooLarge = errors.New("tpkt pdu too large")
+
 /**
  * TPKT layer of rdp stack
  */
@@ -29,14 +53,33 @@ type TPKT struct {
 	Conn             *core.SocketLayer
 	secFlag          byte
 	fastPathListener core.FastPathListener
+	log              glog.Logger
+	// certificate of the server side, see NewServer
+	serverTLS *tls.Config
+	// longest packet read, see SetMaxPacketLength
+	maxPacketLength int
 }
 
-func New(s *core.SocketLayer) *TPKT {
+var _ core.SecureTransport = (*TPKT)(nil)
+
+func New(s *core.SocketLayer, log glog.Logger) *TPKT {
 	t := &TPKT{
-		Emitter: *emission.NewEmitter(),
-		Conn:    s,
-		secFlag: 0}
-	core.StartReadBytes(2, s, t.recvHeader)
+		Emitter:         *emission.NewEmitter(),
+		Conn:            s,
+		secFlag:         0,
+		log:             log,
+		maxPacketLength: MAX_PACKET_LENGTH}
+	core.StartReadBytesUntil(s.Done(), 2, s, t.recvHeader)
+	return t
+}
+
+/**
+ * TPKT layer of the server side of a connection: StartTLS answers the
+ * handshake of the client with config, NLA is not supported
+ */
+func NewServer(s *core.SocketLayer, config *tls.Config, log glog.Logger) *TPKT {
+	t := New(s, log)
+	t.serverTLS = config
 	return t
 }
 
@@ -44,16 +87,61 @@ func (t *TPKT) Read(b []byte) (n int, err error) {
 	return t.Conn.Read(b)
 }
 
+/**
+ * packets longer than n, header included, are not read: the read loop
+ * stops with an error instead. MAX_PACKET_LENGTH when n <= 0
+ */
+func (t *TPKT) SetMaxPacketLength(n int) {
+	if n <= 0 || n > MAX_PACKET_LENGTH {
+		n = MAX_PACKET_LENGTH
+	}
+	t.maxPacketLength = n
+}
+
+// sends data in one packet, ErrPDUTooLarge over MAX_PAYLOAD_LENGTH bytes
 func (t *TPKT) Write(data []byte) (n int, err error) {
+	if len(data) > MAX_PAYLOAD_LENGTH {
+		return 0, fmt.Errorf("tpkt write %d bytes, over %d: %w", len(data), MAX_PAYLOAD_LENGTH, ErrPDUTooLarge)
+	}
 	buff := &bytes.Buffer{}
 	core.WriteUInt8(FASTPATH_ACTION_X224, buff)
 	core.WriteUInt8(0, buff)
 	core.WriteUInt16BE(uint16(len(data)+4), buff)
 	buff.Write(data)
-	glog.Debug("tpkt Write", hex.EncodeToString(buff.Bytes()))
+	if t.log.IsDebug() {
+		// the payload is logged by the layer that sent it
+		t.log.Debug("tpkt Write", "data", core.Dump(buff.Bytes(), 4))
+	}
 	return t.Conn.Write(buff.Bytes())
 }
 
+// state of the TLS channel below, see core.SocketLayer.TLSState
+func (t *TPKT) TLSState() (*tls.ConnectionState, bool) {
+	return t.Conn.TLSState()
+}
+
+// secures the connection below, see core.SocketLayer.StartTLS and AcceptTLS
+func (t *TPKT) StartTLS() error {
+	if t.serverTLS != nil {
+		return t.Conn.AcceptTLS(t.serverTLS)
+	}
+	return t.Conn.StartTLS()
+}
+
+func (t *TPKT) StartNLA() error {
+	if t.serverTLS != nil {
+		return ErrServerNLA
+	}
+	return t.Conn.StartNLA()
+}
+
+func (t *TPKT) StartNLAEx() error {
+	if t.serverTLS != nil {
+		return ErrServerNLA
+	}
+	return t.Conn.StartNLAEx()
+}
+
 func (t *TPKT) Close() error {
 	return t.Conn.Close()
 }
@@ -63,76 +151,136 @@ func (t *TPKT) SetFastPathListener(f core.FastPathListener) {
 }
 
 func (t *TPKT) SendFastPath(secFlag byte, data []byte) (n int, err error) {
+	if max := MAX_FASTPATH_PACKET_LENGTH - 3; len(data) > max {
+		return 0, fmt.Errorf("tpkt fastpath write %d bytes, over %d: %w", len(data), max, ErrPDUTooLarge)
+	}
 	buff := &bytes.Buffer{}
 	core.WriteUInt8(FASTPATH_ACTION_FASTPATH|((secFlag&0x3)<<6), buff)
 	core.WriteUInt16BE(uint16(len(data)+3)|0x8000, buff)
 	buff.Write(data)
-	glog.Debug("TPTK SendFastPath", hex.EncodeToString(buff.Bytes()))
+	if t.log.IsDebug() {
+		t.log.Debug("TPTK SendFastPath", "data", core.Dump(buff.Bytes(), core.DumpMax))
+	}
 	return t.Conn.Write(buff.Bytes())
 }
 
+/**
+ * Reports a failed read of the part of a packet, the read loop then
+ * stops. Nothing is reported when the connection was closed on purpose,
+ * "close" when the peer closed it between two packets
+ */
+func (t *TPKT) readFailed(part string, err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err {
+	case core.ErrReadCancelled:
+	case io.EOF:
+		t.log.Debug("tpkt connection closed by the peer")
+		t.Emit("close")
+	default:
+		t.Emit("error", fmt.Errorf("tpkt read %s: %w", part, err))
+	}
+	return true
+}
+
+// the header was read, the connection must not end before the packet does
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 func (t *TPKT) recvHeader(s []byte, err error) {
-	glog.Debug("tpkt recvHeader", hex.EncodeToString(s), err)
-	if err != nil {
-		t.Emit("error", err)
+	if t.log.IsDebug() {
+		t.log.Debug("tpkt recvHeader", "err", err, "data", core.Dump(s, core.DumpMax))
+	}
+	if t.readFailed("header", err) {
 		return
 	}
 	version := s[0]
 	if version == FASTPATH_ACTION_X224 {
-		glog.Debug("tptk recvHeader FASTPATH_ACTION_X224, wait for recvExtendedHeader")
-		core.StartReadBytes(2, t.Conn, t.recvExtendedHeader)
+		t.log.Debug("tptk recvHeader FASTPATH_ACTION_X224, wait for recvExtendedHeader")
+		core.StartReadBytesUntil(t.Conn.Done(), 2, t.Conn, t.recvExtendedHeader)
 	} else {
 		t.secFlag = (version >> 6) & 0x3
 		length := int(s[1])
 		if length&0x80 != 0 {
-			core.StartReadBytes(1, t.Conn, func(s []byte, err error) {
+			core.StartReadBytesUntil(t.Conn.Done(), 1, t.Conn, func(s []byte, err error) {
 				t.recvExtendedFastPathHeader(s, length, err)
 			})
 		} else {
-			//core.StartReadBytes(length-2, t.Conn, t.recvFastPath)
+			// the length counts the header
+			if length < 2 || length > t.maxPacketLength {
+				t.Emit("error", fmt.Errorf("tpkt bad fastpath size %d", length))
+				return
+			}
+			core.StartReadBytesUntil(t.Conn.Done(), length-2, t.Conn, t.recvFastPath)
 		}
 	}
 }
 
 func (t *TPKT) recvExtendedHeader(s []byte, err error) {
-	glog.Debug("tpkt recvExtendedHeader", hex.EncodeToString(s), err)
-	if err != nil {
+	if t.log.IsDebug() {
+		t.log.Debug("tpkt recvExtendedHeader", "err", err, "data", core.Dump(s, core.DumpMax))
+	}
+	if t.readFailed("header", unexpectedEOF(err)) {
 		return
 	}
 	r := bytes.NewReader(s)
-	size, _ := core.ReadUint16BE(r)
-	glog.Debug("tpkt wait recvData")
-	core.StartReadBytes(int(size-4), t.Conn, t.recvData)
+	size, err := core.ReadUint16BE(r)
+	if t.readFailed("header", err) {
+		return
+	}
+	if size < MIN_PACKET_LENGTH || int(size) > t.maxPacketLength {
+		t.Emit("error", fmt.Errorf("tpkt bad packet size %d", size))
+		return
+	}
+	t.log.Debug("tpkt wait recvData")
+	core.StartReadBytesUntil(t.Conn.Done(), int(size-4), t.Conn, t.recvData)
 }
 
 func (t *TPKT) recvData(s []byte, err error) {
-	glog.Debug("tpkt recvData", hex.EncodeToString(s), err)
-	if err != nil {
+	if t.log.IsDebug() {
+		t.log.Debug("tpkt recvData", "err", err, "data", core.Dump(s, core.DumpMax))
+	}
+	if t.readFailed("data", unexpectedEOF(err)) {
 		return
 	}
 	t.Emit("data", s)
-	glog.Debug("tpkt wait recvHeader")
-	core.StartReadBytes(2, t.Conn, t.recvHeader)
+	t.log.Debug("tpkt wait recvHeader")
+	core.StartReadBytesUntil(t.Conn.Done(), 2, t.Conn, t.recvHeader)
 }
 
 func (t *TPKT) recvExtendedFastPathHeader(s []byte, length int, err error) {
-	glog.Debug("tpkt recvExtendedFastPathHeader", hex.EncodeToString(s), length, err)
+	if t.log.IsDebug() {
+		t.log.Debug("tpkt recvExtendedFastPathHeader", "length", length, "err", err, "data", core.Dump(s, core.DumpMax))
+	}
+	if t.readFailed("fastpath header", unexpectedEOF(err)) {
+		return
+	}
 	r := bytes.NewReader(s)
 	rightPart, err := core.ReadUInt8(r)
 	if err != nil {
-		glog.Error("TPTK recvExtendedFastPathHeader", err)
+		t.log.Error("TPTK recvExtendedFastPathHeader", "err", err)
+		t.Emit("error", err)
 		return
 	}
 	leftPart := length & ^0x80
 	packetSize := (leftPart << 8) + int(rightPart)
-	core.StartReadBytes(packetSize-3, t.Conn, t.recvFastPath)
+	if packetSize < 3 || packetSize > t.maxPacketLength {
+		t.Emit("error", fmt.Errorf("tpkt bad fastpath size %d", packetSize))
+		return
+	}
+	core.StartReadBytesUntil(t.Conn.Done(), packetSize-3, t.Conn, t.recvFastPath)
 }
 
 func (t *TPKT) recvFastPath(s []byte, err error) {
-	glog.Debug("tpkt recvFastPath")
-	if err != nil {
+	t.log.Debug("tpkt recvFastPath")
+	if t.readFailed("fastpath", unexpectedEOF(err)) {
 		return
 	}
 	t.fastPathListener.RecvFastPath(t.secFlag, s)
-	core.StartReadBytes(2, t.Conn, t.recvHeader)
+	core.StartReadBytesUntil(t.Conn.Done(), 2, t.Conn, t.recvHeader)
 }
@@ -0,0 +1,252 @@
+package tpkt_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/protocol/tpkt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	glog.SetLogger(log.New(ioutil.Discard, "", 0))
+}
+
+// error emitted by the TPKT layer once the server sent input and hung up
+func recvError(t *testing.T, input []byte) error {
+	client, server := net.Pipe()
+	layer := core.NewSocketLayer(client, nil, glog.Default())
+	defer layer.Close()
+	errc := make(chan error, 1)
+	tpkt.New(layer, glog.Default()).On("data", func(s []byte) {
+		errc <- nil
+	}).On("error", func(err error) {
+		errc <- err
+	})
+	go func() {
+		server.Write(input)
+		server.Close()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error emitted")
+		return nil
+	}
+}
+
+func TestTPKTTruncated(t *testing.T) {
+	tests := []struct {
+		input []byte
+		part  string
+	}{
+		// header cut
+		{[]byte{tpkt.FASTPATH_ACTION_X224}, "header"},
+		// extended header cut
+		{[]byte{tpkt.FASTPATH_ACTION_X224, 0, 0}, "header"},
+		// body shorter than the header says
+		{[]byte{tpkt.FASTPATH_ACTION_X224, 0, 0, 9, 1, 2}, "data"},
+		// fast path length byte missing
+		{[]byte{0, 0x80}, "fastpath header"},
+		// fast path body cut
+		{[]byte{0, 0x80, 8, 1}, "fastpath"},
+	}
+	for _, test := range tests {
+		err := recvError(t, test.input)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Error(test.input, err, "not equal to", io.ErrUnexpectedEOF)
+		}
+		if expected := "tpkt read " + test.part + ": "; err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Error(test.input, err, "not prefixed by", expected)
+		}
+	}
+}
+
+func TestTPKTPeerClose(t *testing.T) {
+	client, server := net.Pipe()
+	layer := core.NewSocketLayer(client, nil, glog.Default())
+	defer layer.Close()
+	events := make(chan string, 3)
+	tpkt.New(layer, glog.Default()).On("data", func(s []byte) {
+		events <- fmt.Sprint("data ", s)
+	}).On("close", func() {
+		events <- "close"
+	}).On("error", func(err error) {
+		events <- fmt.Sprint("error ", err)
+	})
+	go func() {
+		server.Write([]byte{tpkt.FASTPATH_ACTION_X224, 0, 0, 7, 1, 2, 3})
+		server.Close()
+	}()
+	// the peer hung up between two packets, a single close follows them
+	for _, expected := range []string{"data [1 2 3]", "close"} {
+		select {
+		case event := <-events:
+			if event != expected {
+				t.Error(event, "not equal to", expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing emitted, expected", expected)
+		}
+	}
+	// closing our side afterwards is silent
+	layer.Close()
+	select {
+	case event := <-events:
+		t.Error(event, "emitted after close")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTPKTBadSize(t *testing.T) {
+	// shorter than an X224 data header
+	for _, size := range []byte{2, 6} {
+		err := recvError(t, []byte{tpkt.FASTPATH_ACTION_X224, 0, 0, size})
+		if err == nil || !strings.Contains(err.Error(), "bad packet size") {
+			t.Error(size, err, "not equal to", "bad packet size")
+		}
+	}
+	for _, input := range [][]byte{{0, 0x80, 2}, {0, 1}} {
+		err := recvError(t, input)
+		if err == nil || !strings.Contains(err.Error(), "bad fastpath size") {
+			t.Error(input, err, "not equal to", "bad fastpath size")
+		}
+	}
+}
+
+// fast path PDUs as "fastpath <secFlag> <data>", X224 ones as "x224 <data>"
+type orderedListener chan string
+
+func (l orderedListener) RecvFastPath(secFlag byte, s []byte) {
+	l <- fmt.Sprint("fastpath ", secFlag, " ", s)
+}
+
+func TestTPKTFastPathInterleaved(t *testing.T) {
+	client, server := net.Pipe()
+	layer := core.NewSocketLayer(client, nil, glog.Default())
+	defer layer.Close()
+	received := make(orderedListener, 5)
+	tp := tpkt.New(layer, glog.Default())
+	tp.SetFastPathListener(received)
+	tp.On("data", func(s []byte) {
+		received <- fmt.Sprint("x224 ", s)
+	})
+	go server.Write([]byte{
+		// fast path with a one byte length, secFlag 1
+		0x40, 4, 0xaa, 0xbb,
+		3, 0, 0, 7, 1, 2, 3,
+		0x00, 3, 0xcc,
+		// fast path with a two bytes length
+		0x00, 0x80, 4, 0xdd,
+		3, 0, 0, 8, 4, 5, 6, 7,
+	})
+	for _, expected := range []string{"fastpath 1 [170 187]", "x224 [1 2 3]", "fastpath 0 [204]", "fastpath 0 [221]", "x224 [4 5 6 7]"} {
+		select {
+		case s := <-received:
+			if s != expected {
+				t.Error(s, "not equal to", expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("nothing received, expected", expected)
+		}
+	}
+}
+
+func TestTPKTFraming(t *testing.T) {
+	client, server := net.Pipe()
+	layer := core.NewSocketLayer(client, nil, glog.Default())
+	defer layer.Close()
+	datac := make(chan []byte, 2)
+	tp := tpkt.New(layer, glog.Default())
+	tp.On("data", func(s []byte) {
+		datac <- s
+	})
+	// two packets in a single write
+	go server.Write([]byte{3, 0, 0, 8, 1, 2, 3, 4, 3, 0, 0, 7, 5, 6, 7})
+	for _, expected := range [][]byte{{1, 2, 3, 4}, {5, 6, 7}} {
+		select {
+		case s := <-datac:
+			if string(s) != string(expected) {
+				t.Error(s, "not equal to", expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no data emitted")
+		}
+	}
+
+	written := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 7)
+		io.ReadFull(server, b)
+		written <- b
+	}()
+	tp.Write([]byte{7, 8, 9})
+	if b := <-written; string(b) != string([]byte{3, 0, 0, 7, 7, 8, 9}) {
+		t.Error(b, "not equal to", []byte{3, 0, 0, 7, 7, 8, 9})
+	}
+}
+
+func TestTPKTWriteLength(t *testing.T) {
+	client, server := net.Pipe()
+	layer := core.NewSocketLayer(client, nil, glog.Default())
+	defer layer.Close()
+	tp := tpkt.New(layer, glog.Default())
+	written := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, tpkt.MAX_PACKET_LENGTH)
+		io.ReadFull(server, b)
+		written <- b
+	}()
+	// the longest payload fills the length
+	if n, err := tp.Write(make([]byte, tpkt.MAX_PAYLOAD_LENGTH)); n != tpkt.MAX_PACKET_LENGTH || err != nil {
+		t.Error(n, err)
+	}
+	if b := <-written; string(b[:4]) != string([]byte{3, 0, 0xff, 0xff}) {
+		t.Error(b[:4], "not equal to", []byte{3, 0, 0xff, 0xff})
+	}
+	// one byte more is not written
+	if n, err := tp.Write(make([]byte, tpkt.MAX_PAYLOAD_LENGTH+1)); n != 0 || !errors.Is(err, tpkt.ErrPDUTooLarge) {
+		t.Error(n, err, "not equal to", tpkt.ErrPDUTooLarge)
+	}
+	if n, err := tp.SendFastPath(0, make([]byte, tpkt.MAX_FASTPATH_PACKET_LENGTH-2)); n != 0 || !errors.Is(err, tpkt.ErrPDUTooLarge) {
+		t.Error(n, err, "not equal to", tpkt.ErrPDUTooLarge)
+	}
+}
+
+func TestTPKTMaxPacketLength(t *testing.T) {
+	inputs := [][]byte{
+		{tpkt.FASTPATH_ACTION_X224, 0, 0, 101},
+		{0, 101},
+		{0, 0x80, 101},
+	}
+	for _, input := range inputs {
+		client, server := net.Pipe()
+		layer := core.NewSocketLayer(client, nil, glog.Default())
+		errc := make(chan error, 1)
+		tp := tpkt.New(layer, glog.Default())
+		tp.SetMaxPacketLength(100)
+		tp.On("error", func(err error) {
+			errc <- err
+		})
+		// the body is never sent, the header alone is refused
+		go server.Write(input)
+		select {
+		case err := <-errc:
+			if !strings.Contains(err.Error(), "size 101") {
+				t.Error(input, err, "not equal to", "size 101")
+			}
+		case <-time.After(5 * time.Second):
+			t.Error(input, "no error emitted")
+		}
+		layer.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,78 @@
+//go:build go1.18
+// +build go1.18
+
+package x224_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/icodeface/grdp/core/testtransport"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/internal/fuzztest"
+	"github.com/icodeface/grdp/protocol/x224"
+	"io/ioutil"
+	"testing"
+)
+
+func FuzzX224Confirm(f *testing.F) {
+	for _, seed := range []string{
+		"030000130ed000001234000201080001000000",
+		"030000130ed000001234000301080001000000",
+		"0300000b06d00000123400",
+		"030000130ed000001234000201",
+	} {
+		b, _ := hex.DecodeString(seed)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzztest.Check(t, func() {
+			neg, err := x224.Probe(readWriter{bytes.NewReader(data), ioutil.Discard}, x224.PROTOCOL_SSL)
+			if err != nil && neg != nil {
+				t.Error("negotiation returned with", err)
+			}
+		})
+	})
+}
+
+// confirm then data, the way TPKT hands them over
+func FuzzX224Client(f *testing.F) {
+	confirm, _ := hex.DecodeString("0ed000001234000201080001000000")
+	f.Add(confirm, []byte{0x02, 0xf0, 0x80, 0x01})
+	f.Add([]byte{0x06}, []byte{0x02})
+	f.Fuzz(func(t *testing.T, confirm []byte, data []byte) {
+		fuzztest.Check(t, func() {
+			m := testtransport.New()
+			x := x224.New(m, glog.Default())
+			x.On("error", fuzztest.NoPanic(t))
+			x.Connect("fuzz")
+			m.Inject(confirm)
+			m.Inject(data)
+		})
+	})
+}
+
+// data TPDUs after the confirm, fragmented or not
+func FuzzX224Data(f *testing.F) {
+	f.Add([]byte{0x02, 0xf0, 0x80, 0x01}, []byte{}, []byte{})
+	f.Add([]byte{0x02, 0xf0, 0x00, 0x01}, []byte{0x02, 0xf0, 0x00}, []byte{0x02, 0xf0, 0x80, 0x02})
+	f.Add([]byte{0x02, 0xf0, 0x00, 0x01}, []byte{0x06, 0x80, 0, 0, 0x12, 0x34, 0x80}, []byte{0x04, 0x70, 0, 0, 0x02})
+	f.Add([]byte{0x02}, []byte{0x03, 0xf0, 0x80}, []byte{0x02, 0xf0, 0x81})
+	confirm, _ := hex.DecodeString("0ed000001234000201080001000000")
+	f.Fuzz(func(t *testing.T, first, second, third []byte) {
+		fuzztest.Check(t, func() {
+			m := testtransport.New()
+			x := x224.New(m, glog.Default())
+			x.On("error", fuzztest.NoPanic(t))
+			x.On("data", func(b []byte) {
+				if len(b) > x224.MAX_DATA_LENGTH {
+					t.Error(len(b), "bytes of data")
+				}
+			})
+			x.Connect("fuzz")
+			m.Inject(confirm)
+			for _, tpdu := range [][]byte{first, second, third} {
+				m.Inject(tpdu)
+			}
+		})
+	})
+}
@@ -0,0 +1,376 @@
+package x224
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// negotiation answered by a server to the connection request
+type NegotiationResult struct {
+	Host string
+	// TYPE_RDP_NEG_RSP or TYPE_RDP_NEG_FAILURE
+	Type NegotiationType
+	// PROTOCOL_* picked by the server, set with TYPE_RDP_NEG_RSP
+	SelectedProtocol uint32
+	// *_REQUIRED_BY_SERVER..., set with TYPE_RDP_NEG_FAILURE
+	FailureCode uint32
+	// RESTRICTED_ADMIN_MODE_SUPPORTED..., set with TYPE_RDP_NEG_RSP
+	Flags uint8
+	// whether the server enforces NLA, NLA_UNKNOWN unless it was checked
+	NLA NLAMode
+	// the rest is filled by the probes of a scan, zero otherwise
+	// from the connection request sent to the connection confirm received
+	RTT time.Duration
+	// common name of the TLS certificate, with a fingerprint of the server
+	TLSCommonName string
+	// DNS or else NetBIOS computer name of the NTLM CHALLENGE, with a fingerprint
+	NTLMHostname string
+	// Windows version of the NTLM CHALLENGE, 10.0.20348, with a fingerprint
+	ProductVersion string
+}
+
+// how a server treats NLA, see NLAModeOf
+type NLAMode int
+
+const (
+	NLA_UNKNOWN NLAMode = iota
+	// only PROTOCOL_HYBRID is accepted
+	NLA_ENFORCED
+	// PROTOCOL_HYBRID is accepted but PROTOCOL_SSL as well
+	NLA_OPTIONAL
+	NLA_NOT_SUPPORTED
+)
+
+func (m NLAMode) String() string {
+	switch m {
+	case NLA_ENFORCED:
+		return "enforced"
+	case NLA_OPTIONAL:
+		return "optional"
+	case NLA_NOT_SUPPORTED:
+		return "not_supported"
+	}
+	return "unknown"
+}
+
+func (m NLAMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// mode of its String, "unknown" or an empty text for NLA_UNKNOWN
+func (m *NLAMode) UnmarshalText(text []byte) error {
+	for _, mode := range []NLAMode{NLA_UNKNOWN, NLA_ENFORCED, NLA_OPTIONAL, NLA_NOT_SUPPORTED} {
+		if string(text) == mode.String() {
+			*m = mode
+			return nil
+		}
+	}
+	if len(text) == 0 {
+		*m = NLA_UNKNOWN
+		return nil
+	}
+	return fmt.Errorf("nla mode %q", text)
+}
+
+/**
+ * NLA mode of a server from its answers to a connection request with
+ * PROTOCOL_SSL only and one with PROTOCOL_HYBRID only, the zero result
+ * when it confirmed without a negotiation. A server refusing the first
+ * with HYBRID_REQUIRED_BY_SERVER then picking NLA enforces it, one
+ * picking NLA after accepting TLS alone has it optional. NLA_UNKNOWN
+ * when the answers contradict each other
+ */
+func NLAModeOf(ssl, hybrid NegotiationResult) NLAMode {
+	sslRefused := ssl.NLARequired()
+	hybridPicked := hybrid.Type == TYPE_RDP_NEG_RSP &&
+		(hybrid.SelectedProtocol == PROTOCOL_HYBRID || hybrid.SelectedProtocol == PROTOCOL_HYBRID_EX)
+	switch {
+	case sslRefused && hybridPicked:
+		return NLA_ENFORCED
+	case hybridPicked && ssl.Type == TYPE_RDP_NEG_RSP:
+		return NLA_OPTIONAL
+	case sslRefused || hybridPicked:
+		return NLA_UNKNOWN
+	}
+	return NLA_NOT_SUPPORTED
+}
+
+// result of the negotiation answered by host in its connection confirm
+func NewNegotiationResult(host string, neg *Negotiation) NegotiationResult {
+	result := NegotiationResult{Host: host, Type: neg.Type}
+	if neg.Type == TYPE_RDP_NEG_FAILURE {
+		result.FailureCode = neg.Result
+	} else {
+		result.SelectedProtocol = neg.Result
+		result.Flags = neg.Flag
+	}
+	return result
+}
+
+func (r NegotiationResult) Failed() bool {
+	return r.Type == TYPE_RDP_NEG_FAILURE
+}
+
+// the server refused a connection without NLA, only known when NLA was not requested
+func (r NegotiationResult) NLARequired() bool {
+	return r.Failed() && r.FailureCode == HYBRID_REQUIRED_BY_SERVER
+}
+
+/**
+ * whether the server enforces NLA: its NLA mode once checked, true
+ * when it refused a connection without NLA. Not known otherwise
+ */
+func (r NegotiationResult) NLAEnforced() (enforced, known bool) {
+	switch {
+	case r.NLA != NLA_UNKNOWN:
+		return r.NLA == NLA_ENFORCED, true
+	case r.NLARequired():
+		return true, true
+	}
+	return false, false
+}
+
+/**
+ * the server accepts restricted admin logons, CredSSP without the
+ * password delegated. A server may only tell a client requiring it
+ * with RESTRICTED_ADMIN_MODE_REQUIRED
+ */
+func (r NegotiationResult) RestrictedAdminSupported() bool {
+	return !r.Failed() && r.Flags&RESTRICTED_ADMIN_MODE_SUPPORTED != 0
+}
+
+// the server accepts Remote Credential Guard, see RestrictedAdminSupported
+func (r NegotiationResult) RedirectedAuthSupported() bool {
+	return !r.Failed() && r.Flags&REDIRECTED_AUTHENTICATION_MODE_SUPPORTED != 0
+}
+
+// the failure code as an error, nil for a response
+func (r NegotiationResult) Err() error {
+	if !r.Failed() {
+		return nil
+	}
+	return &NegotiationFailureError{r.Host, r.FailureCode}
+}
+
+/**
+ * Where the hosts that answered the negotiation are recorded, see
+ * X224.SetResultWriter. It is shared by the clients of a scan and
+ * called concurrently
+ */
+type ResultWriter interface {
+	WriteResult(result NegotiationResult) error
+}
+
+// appends a line per host to a file, created when missing
+type FileResultWriter struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileResultWriter(path string) *FileResultWriter {
+	return &FileResultWriter{path: path}
+}
+
+func (w *FileResultWriter) WriteResult(result NegotiationResult) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(result.Host + "\n"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+/**
+ * Columns of a CSVResultWriter. The host and port come from the
+ * host:port of the result, the error is the failure code name.
+ * nla_required is NLAEnforced, empty when not known. The
+ * product_version is the Windows version the server reported through
+ * NLA, not its RDP version
+ */
+const (
+	CSV_HOST              = "host"
+	CSV_PORT              = "port"
+	CSV_SELECTED_PROTOCOL = "selected_protocol"
+	CSV_NLA_REQUIRED      = "nla_required"
+	CSV_ERROR             = "error"
+	// NLAMode of the result, only set by the scans checking it
+	CSV_NLA = "nla"
+	// see NegotiationResult.RestrictedAdminSupported
+	CSV_RESTRICTED_ADMIN = "restricted_admin"
+	// empty unless the scan fingerprinted the server
+	CSV_PRODUCT_VERSION = "product_version"
+	CSV_TLS_CN          = "tls_cn"
+	CSV_NTLM_HOSTNAME   = "ntlm_hostname"
+	// RTT in milliseconds, empty unless the scan measured it
+	CSV_LATENCY_MS = "latency_ms"
+)
+
+// columns of NewCSVResultWriter when none are given
+var DefaultCSVColumns = []string{CSV_HOST, CSV_PORT, CSV_SELECTED_PROTOCOL, CSV_NLA_REQUIRED, CSV_ERROR}
+
+// appends a CSV record per host to a file, after a header row
+type CSVResultWriter struct {
+	path    string
+	columns []string
+	mu      sync.Mutex
+}
+
+/**
+ * The file is created with the header row, or truncated to it. With
+ * appendTo the records of an existing file are kept and its header is
+ * not repeated, it must have the same columns
+ */
+func NewCSVResultWriter(path string, appendTo bool, columns ...string) (*CSVResultWriter, error) {
+	if len(columns) == 0 {
+		columns = DefaultCSVColumns
+	}
+	for _, column := range columns {
+		switch column {
+		case CSV_HOST, CSV_PORT, CSV_SELECTED_PROTOCOL, CSV_NLA_REQUIRED, CSV_ERROR, CSV_NLA, CSV_RESTRICTED_ADMIN,
+			CSV_PRODUCT_VERSION, CSV_TLS_CN, CSV_NTLM_HOSTNAME, CSV_LATENCY_MS:
+		default:
+			return nil, fmt.Errorf("unknown csv column %q", column)
+		}
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !appendTo {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() == 0 {
+		cw := csv.NewWriter(f)
+		cw.Write(columns)
+		cw.Flush()
+		err = cw.Error()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &CSVResultWriter{path: path, columns: append([]string{}, columns...)}, nil
+}
+
+func (w *CSVResultWriter) WriteResult(result NegotiationResult) error {
+	host, port, err := net.SplitHostPort(result.Host)
+	if err != nil {
+		host, port = result.Host, ""
+	}
+	record := make([]string, len(w.columns))
+	for i, column := range w.columns {
+		switch column {
+		case CSV_HOST:
+			record[i] = host
+		case CSV_PORT:
+			record[i] = port
+		case CSV_SELECTED_PROTOCOL:
+			if !result.Failed() {
+				record[i] = ProtocolName(result.SelectedProtocol)
+			}
+		case CSV_NLA_REQUIRED:
+			if enforced, known := result.NLAEnforced(); known {
+				record[i] = fmt.Sprint(enforced)
+			}
+		case CSV_ERROR:
+			if result.Failed() {
+				record[i] = FailureCodeName(result.FailureCode)
+			}
+		case CSV_NLA:
+			record[i] = result.NLA.String()
+		case CSV_RESTRICTED_ADMIN:
+			record[i] = fmt.Sprint(result.RestrictedAdminSupported())
+		case CSV_PRODUCT_VERSION:
+			record[i] = result.ProductVersion
+		case CSV_TLS_CN:
+			record[i] = result.TLSCommonName
+		case CSV_NTLM_HOSTNAME:
+			record[i] = result.NTLMHostname
+		case CSV_LATENCY_MS:
+			if result.RTT > 0 {
+				record[i] = strconv.FormatFloat(result.RTT.Seconds()*1000, 'f', -1, 64)
+			}
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(f)
+	cw.Write(record)
+	cw.Flush()
+	err = cw.Error()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writes the results to all the writers, see io.MultiWriter
+type multiResultWriter []ResultWriter
+
+// a scan recorded by several writers, the first error is returned
+func MultiResultWriter(writers ...ResultWriter) ResultWriter {
+	return multiResultWriter(append([]ResultWriter{}, writers...))
+}
+
+func (m multiResultWriter) WriteResult(result NegotiationResult) error {
+	var first error
+	for _, w := range m {
+		if err := w.WriteResult(result); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// keeps the results in memory, in the order they were written
+type MemoryResultWriter struct {
+	mu      sync.Mutex
+	results []NegotiationResult
+}
+
+func NewMemoryResultWriter() *MemoryResultWriter {
+	return &MemoryResultWriter{}
+}
+
+func (w *MemoryResultWriter) WriteResult(result NegotiationResult) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.results = append(w.results, result)
+	return nil
+}
+
+func (w *MemoryResultWriter) Results() []NegotiationResult {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]NegotiationResult{}, w.results...)
+}
+
+// the result of host, the last one when it was written several times
+func (w *MemoryResultWriter) Result(host string) (NegotiationResult, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := len(w.results) - 1; i >= 0; i-- {
+		if w.results[i].Host == host {
+			return w.results[i], true
+		}
+	}
+	return NegotiationResult{}, false
+}
@@ -0,0 +1,189 @@
+package x224
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/glog"
+)
+
+// source reference of the connection confirms of a Server, as Windows servers send it
+const SERVER_REFERENCE = 0x1234
+
+/**
+ * Connection request received by a Server
+ * @see http://msdn.microsoft.com/en-us/library/cc240470.aspx
+ */
+type ConnectionRequest struct {
+	// source reference of the client
+	SrcRef uint16
+	// routingToken or cookie field without its CR LF, nil for none
+	Cookie []byte
+	// whether the request ends with an RDP_NEG_REQ, RDP 4.0 clients send none
+	Negotiation bool
+	// PROTOCOL_* offered by the client
+	RequestedProtocols uint32
+	// RESTRICTED_ADMIN_MODE_REQUIRED... of the RDP_NEG_REQ
+	Flags uint8
+	// of the RDP_NEG_CORRELATION_INFO, nil without one
+	CorrelationID []byte
+}
+
+// username of a "Cookie: mstshash=username" cookie, "" for a routing token
+func (r *ConnectionRequest) Username() string {
+	const prefix = "Cookie: mstshash="
+	if !bytes.HasPrefix(r.Cookie, []byte(prefix)) {
+		return ""
+	}
+	return string(r.Cookie[len(prefix):])
+}
+
+/**
+ * Connection request s from its length indicator up. Len is checked
+ * against s, the RDP_NEG_REQ is expected last but for a correlation info
+ */
+func readConnectionRequest(s []byte) (*ConnectionRequest, error) {
+	if len(s) < 7 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if MessageType(s[1]&0xf0) != TPDU_CONNECTION_REQUEST {
+		return nil, fmt.Errorf("x224 unexpected message type 0x%02x", s[1])
+	}
+	if int(s[0]) != len(s)-1 {
+		return nil, fmt.Errorf("x224 connection request length %d, %d bytes", s[0], len(s)-1)
+	}
+	r := &ConnectionRequest{SrcRef: binary.BigEndian.Uint16(s[4:])}
+	body := s[7:]
+	if n := len(body); n >= 8+CORRELATION_INFO_LENGTH && NegotiationType(body[n-CORRELATION_INFO_LENGTH]) == TYPE_RDP_CORRELATION_INFO &&
+		binary.LittleEndian.Uint16(body[n-CORRELATION_INFO_LENGTH+2:]) == CORRELATION_INFO_LENGTH {
+		info := body[n-CORRELATION_INFO_LENGTH:]
+		r.CorrelationID = append([]byte{}, info[4:20]...)
+		body = body[:n-CORRELATION_INFO_LENGTH]
+	}
+	if n := len(body); n >= 8 && NegotiationType(body[n-8]) == TYPE_RDP_NEG_REQ && binary.LittleEndian.Uint16(body[n-6:]) == 8 {
+		r.Negotiation = true
+		r.Flags = body[n-7]
+		r.RequestedProtocols = binary.LittleEndian.Uint32(body[n-4:])
+		body = body[:n-8]
+	}
+	if len(body) > 0 {
+		r.Cookie = append([]byte{}, bytes.TrimSuffix(body, []byte("\r\n"))...)
+	}
+	return r, nil
+}
+
+/**
+ * Answer of a Server to a connection request with an RDP_NEG_REQ: a
+ * TYPE_RDP_NEG_RSP with the selected protocol or a TYPE_RDP_NEG_FAILURE
+ * with its failure code
+ */
+type ServerPolicy func(request *ConnectionRequest) *Negotiation
+
+/**
+ * Policy of a server with the protocols of supported, PROTOCOL_RDP
+ * when 0: the strongest one requested by the client is selected, the
+ * failure code otherwise is the one of a Windows server
+ */
+func SelectProtocol(supported uint32) ServerPolicy {
+	return func(request *ConnectionRequest) *Negotiation {
+		for _, protocol := range []uint32{PROTOCOL_HYBRID_EX, PROTOCOL_HYBRID, PROTOCOL_SSL} {
+			if request.RequestedProtocols&supported&protocol != 0 {
+				return &Negotiation{TYPE_RDP_NEG_RSP, 0, 8, protocol}
+			}
+		}
+		switch {
+		case supported == PROTOCOL_RDP && request.RequestedProtocols == PROTOCOL_RDP:
+			return &Negotiation{TYPE_RDP_NEG_RSP, 0, 8, PROTOCOL_RDP}
+		case supported == PROTOCOL_RDP:
+			return &Negotiation{TYPE_RDP_NEG_FAILURE, 0, 8, SSL_NOT_ALLOWED_BY_SERVER}
+		case supported&PROTOCOL_SSL == 0:
+			return &Negotiation{TYPE_RDP_NEG_FAILURE, 0, 8, HYBRID_REQUIRED_BY_SERVER}
+		}
+		return &Negotiation{TYPE_RDP_NEG_FAILURE, 0, 8, SSL_REQUIRED_BY_SERVER}
+	}
+}
+
+/**
+ * Server side of the X224 layer, for test harnesses and honeypots. It
+ * emits "request" with the *ConnectionRequest, answers it with the
+ * policy, PROTOCOL_SSL only by default, then "connect" once the
+ * transport is secured, see tpkt.NewServer, and "data" with the
+ * payloads of the data TPDUs. Write, Close and Disconnect are those of
+ * the client side. NLA is not supported, the transport is closed after
+ * a negotiation failure
+ */
+type Server struct {
+	*X224
+	policy ServerPolicy
+}
+
+// the transport must not have received anything yet, create it at once after the TPKT layer
+func NewServer(t core.Transport, log glog.Logger) *Server {
+	s := &Server{New(t, log), SelectProtocol(PROTOCOL_SSL)}
+	s.host = ""
+	t.Once("data", s.recvConnectionRequest)
+	return s
+}
+
+func (s *Server) SetPolicy(policy ServerPolicy) {
+	s.policy = policy
+}
+
+func (s *Server) recvConnectionRequest(b []byte) {
+	if s.log.IsDebug() {
+		s.log.Debug("x224 recvConnectionRequest", "data", core.Dump(b, core.DumpMax))
+	}
+	request, err := readConnectionRequest(b)
+	if err != nil {
+		s.fail(fmt.Errorf("x224 read connection request: %w", err))
+		return
+	}
+	s.peerRef = request.SrcRef
+	s.requestedProtocol = request.RequestedProtocols
+	s.Emit("request", request)
+
+	// a client without negotiation only speaks standard RDP security
+	var neg *Negotiation
+	if request.Negotiation {
+		neg = s.policy(request)
+	}
+	if _, err = s.transport.Write(NewServerConnectionConfirm(request.SrcRef, SERVER_REFERENCE, neg).Serialize()); err != nil {
+		s.fail(fmt.Errorf("x224 write connection confirm: %w", err))
+		return
+	}
+	if neg == nil {
+		s.selected(PROTOCOL_RDP, 0)
+	} else {
+		s.negotiated(neg)
+		if neg.Type == TYPE_RDP_NEG_FAILURE {
+			s.log.Info("x224 server refused the protocols", "requested", ProtocolName(request.RequestedProtocols))
+			s.transport.Close()
+			return
+		}
+		s.selected(neg.Result, neg.Flag)
+	}
+
+	s.transport.On("data", s.recvData)
+	switch s.selectedProtocol {
+	case PROTOCOL_RDP:
+	case PROTOCOL_SSL:
+		secured, ok := s.transport.(core.SecureTransport)
+		if !ok {
+			s.fail(errors.New("x224 transport can not start tls"))
+			return
+		}
+		glog.SetPhase(s.log, core.PHASE_TLS)
+		if err := secured.StartTLS(); err != nil {
+			s.fail(fmt.Errorf("x224 accept tls: %w", err))
+			return
+		}
+	default:
+		s.fail(fmt.Errorf("x224 server can not secure %s", ProtocolName(s.selectedProtocol)))
+		return
+	}
+	s.Emit("connect", s.selection())
+}
@@ -0,0 +1,219 @@
+package x224_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp/core"
+	"github.com/icodeface/grdp/core/testtransport"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/protocol/tpkt"
+	"github.com/icodeface/grdp/protocol/x224"
+	"github.com/icodeface/tls"
+)
+
+func TestServerSSL(t *testing.T) {
+	cert, err := rdptest.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	errc := make(chan error, 2)
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: cert.Certificate, PrivateKey: cert.PrivateKey}}}
+	serverTransport := tpkt.NewServer(core.NewSocketLayer(serverConn, nil, glog.Default()), config, glog.Default())
+	server := x224.NewServer(serverTransport, glog.Default())
+	requests := make(chan *x224.ConnectionRequest, 1)
+	serverConnected := make(chan x224.ProtocolSelection, 1)
+	serverReceived := make(chan []byte, 1)
+	server.On("request", func(request *x224.ConnectionRequest) {
+		requests <- request
+	}).On("connect", func(selection x224.ProtocolSelection) {
+		serverConnected <- selection
+	}).On("data", func(b []byte) {
+		serverReceived <- b
+	}).On("error", func(err error) {
+		errc <- err
+	})
+
+	client := x224.New(tpkt.New(core.NewSocketLayer(clientConn, nil, glog.Default()), glog.Default()), glog.Default())
+	connected := make(chan x224.ProtocolSelection, 1)
+	received := make(chan []byte, 1)
+	client.On("connect", func(selection x224.ProtocolSelection) {
+		connected <- selection
+	}).On("data", func(b []byte) {
+		received <- b
+	}).On("error", func(err error) {
+		errc <- err
+	})
+	client.SetRequestedProtocol(x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID)
+	client.SetCookie("alice")
+	if err = client.Connect("server"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := x224.ProtocolSelection{Requested: x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID, Selected: x224.PROTOCOL_SSL}
+	for _, c := range []chan x224.ProtocolSelection{connected, serverConnected} {
+		select {
+		case selection := <-c:
+			if selection != expected {
+				t.Errorf("%+v not equal to %+v", selection, expected)
+			}
+		case err := <-errc:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("not connected")
+		}
+	}
+	request := <-requests
+	if request.Username() != "alice" || !request.Negotiation || request.RequestedProtocols != expected.Requested {
+		t.Errorf("%+v", request)
+	}
+	if negotiation, ok := client.Negotiation(); !ok || negotiation.SelectedProtocol != x224.PROTOCOL_SSL {
+		t.Error(negotiation, ok)
+	}
+
+	// data TPDUs both ways over TLS
+	if _, err = client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		c        chan []byte
+		expected string
+	}{{serverReceived, "ping"}, {received, "pong"}} {
+		select {
+		case b := <-test.c:
+			if string(b) != test.expected {
+				t.Error(string(b), "not equal to", test.expected)
+			}
+		case err := <-errc:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no data")
+		}
+	}
+	clientConn.Close()
+	serverConn.Close()
+}
+
+// connection request of a client requesting protocols, with the cookie of alice
+func connectionRequest(protocols uint32) []byte {
+	request := x224.NewClientConnectionRequestPDU(x224.RequestCookie("alice", nil))
+	request.ProtocolNeg.Type = x224.TYPE_RDP_NEG_REQ
+	request.ProtocolNeg.Result = protocols
+	return request.Serialize()
+}
+
+func TestServerCorrelationID(t *testing.T) {
+	id := [16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	client := testtransport.New()
+	x := x224.New(client, glog.Default())
+	x.SetCorrelationID(id)
+	x.SetCookie("alice")
+	if err := x.Connect("host"); err != nil {
+		t.Fatal(err)
+	}
+	m := testtransport.New()
+	server := x224.NewServer(m, glog.Default())
+	var requests []*x224.ConnectionRequest
+	server.On("request", func(request *x224.ConnectionRequest) {
+		requests = append(requests, request)
+	})
+	m.Inject(client.Writes()[0])
+	if len(requests) != 1 || !bytes.Equal(requests[0].CorrelationID, id[:]) || requests[0].Username() != "alice" ||
+		requests[0].Flags != x224.CORRELATION_INFO_PRESENT || requests[0].RequestedProtocols != x224.PROTOCOL_SSL|x224.PROTOCOL_HYBRID {
+		t.Errorf("%+v", requests)
+	}
+}
+
+func TestServerNegotiationFailure(t *testing.T) {
+	m := testtransport.New()
+	server := x224.NewServer(m, glog.Default())
+	var negotiated []x224.NegotiationResult
+	server.On("negotiated", func(result x224.NegotiationResult) {
+		negotiated = append(negotiated, result)
+	}).On("connect", func(x224.ProtocolSelection) {
+		t.Error("connected")
+	})
+	m.Inject(connectionRequest(x224.PROTOCOL_RDP))
+	expected := "0ed000001234000300080001000000"
+	if writes := m.Writes(); len(writes) != 1 || hex.EncodeToString(writes[0]) != expected {
+		t.Error(writes, "not equal to", expected)
+	}
+	if len(negotiated) != 1 || negotiated[0].FailureCode != x224.SSL_REQUIRED_BY_SERVER {
+		t.Error(negotiated)
+	}
+	if !m.Closed() || len(m.Started()) != 0 {
+		t.Error(m.Closed(), m.Started())
+	}
+}
+
+func TestServerWithoutNegotiation(t *testing.T) {
+	m := testtransport.New()
+	server := x224.NewServer(m, glog.Default())
+	var connected []x224.ProtocolSelection
+	var data []byte
+	server.On("connect", func(selection x224.ProtocolSelection) {
+		connected = append(connected, selection)
+	}).On("data", func(b []byte) {
+		data = b
+	})
+	// an RDP 4.0 client, neither cookie nor RDP_NEG_REQ
+	request, _ := hex.DecodeString("06e00000abcd00")
+	m.Inject(request)
+	// the confirm goes back to the reference of the client
+	expected := "06d0abcd123400"
+	if writes := m.Writes(); len(writes) != 1 || hex.EncodeToString(writes[0]) != expected {
+		t.Error(writes, "not equal to", expected)
+	}
+	if len(connected) != 1 || connected[0] != (x224.ProtocolSelection{}) || len(m.Started()) != 0 {
+		t.Error(connected, m.Started())
+	}
+	m.Inject([]byte{0x02, 0xf0, 0x80, 0x7f})
+	if !bytes.Equal(data, []byte{0x7f}) {
+		t.Error(data, "not equal to", []byte{0x7f})
+	}
+}
+
+func TestServerMalformedRequest(t *testing.T) {
+	m := testtransport.New()
+	server := x224.NewServer(m, glog.Default())
+	var emitted error
+	server.On("error", func(err error) {
+		emitted = err
+	})
+	// a connection confirm instead
+	request, _ := hex.DecodeString("06d00000123400")
+	m.Inject(request)
+	if emitted == nil || len(m.Writes()) != 0 || !m.Closed() {
+		t.Error(emitted, m.Writes(), m.Closed())
+	}
+}
+
+func TestSelectProtocol(t *testing.T) {
+	tests := []struct {
+		supported uint32
+		requested uint32
+		negType   x224.NegotiationType
+		result    uint32
+	}{
+		{x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID, x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID, x224.TYPE_RDP_NEG_RSP, x224.PROTOCOL_HYBRID},
+		{x224.PROTOCOL_SSL, x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID, x224.TYPE_RDP_NEG_RSP, x224.PROTOCOL_SSL},
+		{x224.PROTOCOL_SSL, x224.PROTOCOL_RDP, x224.TYPE_RDP_NEG_FAILURE, x224.SSL_REQUIRED_BY_SERVER},
+		{x224.PROTOCOL_HYBRID, x224.PROTOCOL_SSL, x224.TYPE_RDP_NEG_FAILURE, x224.HYBRID_REQUIRED_BY_SERVER},
+		{x224.PROTOCOL_RDP, x224.PROTOCOL_SSL, x224.TYPE_RDP_NEG_FAILURE, x224.SSL_NOT_ALLOWED_BY_SERVER},
+		{x224.PROTOCOL_RDP, x224.PROTOCOL_RDP, x224.TYPE_RDP_NEG_RSP, x224.PROTOCOL_RDP},
+	}
+	for _, test := range tests {
+		neg := x224.SelectProtocol(test.supported)(&x224.ConnectionRequest{Negotiation: true, RequestedProtocols: test.requested})
+		if neg.Type != test.negType || neg.Result != test.result {
+			t.Error(test.supported, test.requested, neg, "not equal to", test.negType, test.result)
+		}
+	}
+}
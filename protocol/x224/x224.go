@@ -2,14 +2,18 @@ package x224
 
 import (
 	"bytes"
-	"encoding/hex"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/icodeface/grdp/core"
 	"github.com/icodeface/grdp/emission"
 	"github.com/icodeface/grdp/glog"
 	"github.com/icodeface/grdp/protocol/tpkt"
 	"github.com/lunixbochs/struc"
-	"os"
+	"io"
+	"strings"
+	"sync"
+	"time"
 )
 
 // take idea from https://github.com/Madnikulin50/gordp
@@ -33,9 +37,10 @@ const (
 type NegotiationType byte
 
 const (
-	TYPE_RDP_NEG_REQ     NegotiationType = 0x01
-	TYPE_RDP_NEG_RSP                     = 0x02
-	TYPE_RDP_NEG_FAILURE                 = 0x03
+	TYPE_RDP_NEG_REQ          NegotiationType = 0x01
+	TYPE_RDP_NEG_RSP                          = 0x02
+	TYPE_RDP_NEG_FAILURE                      = 0x03
+	TYPE_RDP_CORRELATION_INFO                 = 0x06
 )
 
 /**
@@ -49,6 +54,252 @@ const (
 	PROTOCOL_HYBRID_EX        = 0x00000008
 )
 
+/**
+ * Flags of the negotiation request
+ * @see http://msdn.microsoft.com/en-us/library/cc240500.aspx
+ */
+const (
+	RESTRICTED_ADMIN_MODE_REQUIRED          uint8 = 0x01
+	REDIRECTED_AUTHENTICATION_MODE_REQUIRED       = 0x02
+	CORRELATION_INFO_PRESENT                      = 0x08
+)
+
+/**
+ * Flags of the negotiation response
+ * @see http://msdn.microsoft.com/en-us/library/cc240506.aspx
+ */
+const (
+	EXTENDED_CLIENT_DATA_SUPPORTED           uint8 = 0x01
+	DYNVC_GFX_PROTOCOL_SUPPORTED                   = 0x02
+	NEGRSP_FLAG_RESERVED                           = 0x04
+	RESTRICTED_ADMIN_MODE_SUPPORTED                = 0x08
+	REDIRECTED_AUTHENTICATION_MODE_SUPPORTED       = 0x10
+)
+
+// name of a selected protocol, its hex value when unknown
+func ProtocolName(protocol uint32) string {
+	switch protocol {
+	case PROTOCOL_RDP:
+		return "PROTOCOL_RDP"
+	case PROTOCOL_SSL:
+		return "PROTOCOL_SSL"
+	case PROTOCOL_HYBRID:
+		return "PROTOCOL_HYBRID"
+	case PROTOCOL_HYBRID_EX:
+		return "PROTOCOL_HYBRID_EX"
+	}
+	return fmt.Sprintf("0x%08x", protocol)
+}
+
+/**
+ * Failure code of a negotiation failure
+ * @see https://msdn.microsoft.com/en-us/library/cc240507.aspx
+ */
+const (
+	SSL_REQUIRED_BY_SERVER                = 0x00000001
+	SSL_NOT_ALLOWED_BY_SERVER             = 0x00000002
+	SSL_CERT_NOT_ON_SERVER                = 0x00000003
+	INCONSISTENT_FLAGS                    = 0x00000004
+	HYBRID_REQUIRED_BY_SERVER             = 0x00000005
+	SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER = 0x00000006
+)
+
+// name of a failure code, its hex value when unknown
+func FailureCodeName(code uint32) string {
+	switch code {
+	case SSL_REQUIRED_BY_SERVER:
+		return "SSL_REQUIRED_BY_SERVER"
+	case SSL_NOT_ALLOWED_BY_SERVER:
+		return "SSL_NOT_ALLOWED_BY_SERVER"
+	case SSL_CERT_NOT_ON_SERVER:
+		return "SSL_CERT_NOT_ON_SERVER"
+	case INCONSISTENT_FLAGS:
+		return "INCONSISTENT_FLAGS"
+	case HYBRID_REQUIRED_BY_SERVER:
+		return "HYBRID_REQUIRED_BY_SERVER"
+	case SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER:
+		return "SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER"
+	}
+	return fmt.Sprintf("0x%08x", code)
+}
+
+// the server refused the requested protocols, test with errors.Is
+var ErrNegotiationFailed = errors.New("x224 negotiation failure")
+
+/**
+ * The server refused the requested protocols, emitted on "error" after
+ * "negotiated". SSL_NOT_ALLOWED_BY_SERVER means TLS is not configured,
+ * HYBRID_REQUIRED_BY_SERVER that NLA is required. errors.Is matches
+ * ErrNegotiationFailed
+ */
+type NegotiationFailureError struct {
+	Host string
+	Code uint32
+}
+
+func (e *NegotiationFailureError) Error() string {
+	return fmt.Sprintf("%v %s", ErrNegotiationFailed, FailureCodeName(e.Code))
+}
+
+func (e *NegotiationFailureError) Is(target error) bool {
+	return target == ErrNegotiationFailed
+}
+
+/**
+ * Reason of a disconnect request TPDU
+ * @see ITU-T X.224 13.5.3 d)
+ */
+const (
+	REASON_NOT_SPECIFIED         = 0x00
+	REASON_CONGESTION            = 0x01
+	REASON_SESSION_NOT_ATTACHED  = 0x02
+	REASON_ADDRESS_UNKNOWN       = 0x03
+	REASON_NORMAL                = 0x80
+	REASON_REMOTE_CONGESTION     = 0x81
+	REASON_NEGOTIATION_FAILED    = 0x82
+	REASON_DUPLICATE_REFERENCE   = 0x83
+	REASON_MISMATCHED_REFERENCES = 0x84
+	REASON_PROTOCOL_ERROR        = 0x85
+	REASON_REFERENCE_OVERFLOW    = 0x87
+	REASON_CONNECTION_REFUSED    = 0x88
+	REASON_INVALID_HEADER_LENGTH = 0x8a
+)
+
+/**
+ * Reject cause of an error TPDU
+ * @see ITU-T X.224 13.12.3 c)
+ */
+const (
+	CAUSE_NOT_SPECIFIED           = 0x00
+	CAUSE_INVALID_PARAMETER_CODE  = 0x01
+	CAUSE_INVALID_TPDU_TYPE       = 0x02
+	CAUSE_INVALID_PARAMETER_VALUE = 0x03
+)
+
+func ReasonName(reason uint8) string {
+	switch reason {
+	case REASON_NOT_SPECIFIED:
+		return "REASON_NOT_SPECIFIED"
+	case REASON_CONGESTION:
+		return "REASON_CONGESTION"
+	case REASON_SESSION_NOT_ATTACHED:
+		return "REASON_SESSION_NOT_ATTACHED"
+	case REASON_ADDRESS_UNKNOWN:
+		return "REASON_ADDRESS_UNKNOWN"
+	case REASON_NORMAL:
+		return "REASON_NORMAL"
+	case REASON_REMOTE_CONGESTION:
+		return "REASON_REMOTE_CONGESTION"
+	case REASON_NEGOTIATION_FAILED:
+		return "REASON_NEGOTIATION_FAILED"
+	case REASON_DUPLICATE_REFERENCE:
+		return "REASON_DUPLICATE_REFERENCE"
+	case REASON_MISMATCHED_REFERENCES:
+		return "REASON_MISMATCHED_REFERENCES"
+	case REASON_PROTOCOL_ERROR:
+		return "REASON_PROTOCOL_ERROR"
+	case REASON_REFERENCE_OVERFLOW:
+		return "REASON_REFERENCE_OVERFLOW"
+	case REASON_CONNECTION_REFUSED:
+		return "REASON_CONNECTION_REFUSED"
+	case REASON_INVALID_HEADER_LENGTH:
+		return "REASON_INVALID_HEADER_LENGTH"
+	}
+	return fmt.Sprintf("0x%02x", reason)
+}
+
+func CauseName(cause uint8) string {
+	switch cause {
+	case CAUSE_NOT_SPECIFIED:
+		return "CAUSE_NOT_SPECIFIED"
+	case CAUSE_INVALID_PARAMETER_CODE:
+		return "CAUSE_INVALID_PARAMETER_CODE"
+	case CAUSE_INVALID_TPDU_TYPE:
+		return "CAUSE_INVALID_TPDU_TYPE"
+	case CAUSE_INVALID_PARAMETER_VALUE:
+		return "CAUSE_INVALID_PARAMETER_VALUE"
+	}
+	return fmt.Sprintf("0x%02x", cause)
+}
+
+// the server ended the connection at the X224 layer, test with errors.Is
+var ErrDisconnected = errors.New("x224 disconnected by the server")
+
+/**
+ * The server sent a disconnect request or an error TPDU, emitted on
+ * "disconnect" then "error", the transport is closed after. errors.Is
+ * matches ErrDisconnected
+ */
+type DisconnectError struct {
+	Host string
+	// TPDU_DISCONNECT_REQUEST or TPDU_ERROR
+	Type MessageType
+	// REASON_* of a disconnect request, CAUSE_* of an error TPDU
+	Reason uint8
+}
+
+func (e *DisconnectError) Error() string {
+	if e.Type == TPDU_ERROR {
+		return fmt.Sprintf("%v, error %s", ErrDisconnected, CauseName(e.Reason))
+	}
+	return fmt.Sprintf("%v, %s", ErrDisconnected, ReasonName(e.Reason))
+}
+
+func (e *DisconnectError) Is(target error) bool {
+	return target == ErrDisconnected
+}
+
+// the disconnect request or error TPDU s, nil for another TPDU
+func readDisconnect(s []byte) *DisconnectError {
+	if len(s) < 2 {
+		return nil
+	}
+	// LI, code, dst-ref then src-ref and reason, or reject cause
+	switch MessageType(s[1] & 0xf0) {
+	case TPDU_DISCONNECT_REQUEST:
+		e := &DisconnectError{Type: TPDU_DISCONNECT_REQUEST}
+		if len(s) >= 7 {
+			e.Reason = s[6]
+		}
+		return e
+	case TPDU_ERROR:
+		e := &DisconnectError{Type: TPDU_ERROR}
+		if len(s) >= 5 {
+			e.Reason = s[4]
+		}
+		return e
+	}
+	return nil
+}
+
+// how long Connect waits for the connection confirm, see SetConfirmTimeout
+var DefaultConfirmTimeout = 5 * time.Second
+
+// no connection confirm came before the confirm timeout, emitted on "error"
+var ErrNegotiationTimeout = errors.New("x224 connection confirm timed out")
+
+// the server only speaks standard RDP security, test with errors.Is
+var ErrStandardSecurity = errors.New("x224 server confirmed without negotiation")
+
+/**
+ * The server confirmed a request offering Requested without a
+ * negotiation: an RDP 4.0 server or Windows Server 2003 picking
+ * PROTOCOL_RDP, emitted on "error" instead of "negotiated". errors.Is
+ * matches ErrStandardSecurity
+ */
+type StandardSecurityError struct {
+	Host      string
+	Requested uint32
+}
+
+func (e *StandardSecurityError) Error() string {
+	return fmt.Sprintf("%v, %s selected", ErrStandardSecurity, ProtocolName(PROTOCOL_RDP))
+}
+
+func (e *StandardSecurityError) Is(target error) bool {
+	return target == ErrStandardSecurity
+}
+
 /**
  * Use to negotiate security layer of RDP stack
  * In node-rdpjs only ssl is available
@@ -64,6 +315,9 @@ type Negotiation struct {
 	Result uint32          `struc:"little"`
 }
 
+// struc fills in the default options it shares on first use, a race between probes
+var strucOptions = &struc.Options{PtrSize: 32}
+
 func NewNegotiation() *Negotiation {
 	return &Negotiation{0, 0, 0x0008 /*constant*/, PROTOCOL_RDP}
 }
@@ -81,15 +335,78 @@ type ClientConnectionRequestPDU struct {
 	Padding3    uint8
 	Cookie      []byte
 	ProtocolNeg *Negotiation
+	// after ProtocolNeg with CORRELATION_INFO_PRESENT, nil for none
+	CorrelationInfo *CorrelationInfo
 }
 
+// bytes of the RDP_NEG_CORRELATION_INFO
+const CORRELATION_INFO_LENGTH = 36
+
+/**
+ * RDP_NEG_CORRELATION_INFO, the correlation id of a connection shows in
+ * the event logs of the server
+ * @see MS-RDPBCGR 2.2.1.1.2
+ */
+type CorrelationInfo struct {
+	Type          NegotiationType
+	Flags         uint8
+	Length        uint16
+	CorrelationID [16]byte
+	Reserved      [16]byte
+}
+
+func NewCorrelationInfo(id [16]byte) *CorrelationInfo {
+	return &CorrelationInfo{TYPE_RDP_CORRELATION_INFO, 0, CORRELATION_INFO_LENGTH, id, [16]byte{}}
+}
+
+func (c *CorrelationInfo) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(uint8(c.Type), buff)
+	core.WriteUInt8(c.Flags, buff)
+	core.WriteUInt16LE(c.Length, buff)
+	buff.Write(c.CorrelationID[:])
+	buff.Write(c.Reserved[:])
+	return buff.Bytes()
+}
+
+/**
+ * cookie is the routingToken or the cookie field without its CR LF, see
+ * RequestCookie, nil for none
+ */
 func NewClientConnectionRequestPDU(coockie []byte) *ClientConnectionRequestPDU {
 	x := ClientConnectionRequestPDU{0, TPDU_CONNECTION_REQUEST, 0, 0, 0,
-		coockie, NewNegotiation()}
+		coockie, NewNegotiation(), nil}
 	x.Len = uint8(len(x.Serialize()) - 1)
 	return &x
 }
 
+// the length indicator of a TPDU is a byte, 255 is reserved
+const MAX_COOKIE_LENGTH = 254 - 6 - 2 - 8
+
+/**
+ * Cookie field of a connection request: routingToken as given by a
+ * connection broker, "Cookie: msts=3640205228.15629.0000" for instance,
+ * or else "Cookie: mstshash=username" that brokers and load balancers
+ * route on. nil when both are empty. It is cut to MAX_COOKIE_LENGTH
+ * @see http://msdn.microsoft.com/en-us/library/cc240470.aspx
+ */
+func RequestCookie(username string, routingToken []byte) []byte {
+	var cookie []byte
+	if len(routingToken) > 0 {
+		cookie = bytes.TrimSuffix(routingToken, []byte("\r\n"))
+	} else if username != "" {
+		// a line break would end the field
+		if i := strings.IndexAny(username, "\r\n"); i >= 0 {
+			username = username[:i]
+		}
+		cookie = []byte("Cookie: mstshash=" + username)
+	}
+	if len(cookie) > MAX_COOKIE_LENGTH {
+		cookie = cookie[:MAX_COOKIE_LENGTH]
+	}
+	return cookie
+}
+
 func (x *ClientConnectionRequestPDU) Serialize() []byte {
 	buff := &bytes.Buffer{}
 	core.WriteUInt8(x.Len, buff)
@@ -98,11 +415,41 @@ func (x *ClientConnectionRequestPDU) Serialize() []byte {
 	core.WriteUInt16BE(x.Padding2, buff)
 	core.WriteUInt8(x.Padding3, buff)
 
-	buff.Write(x.Cookie)
-	if x.Len > 14 {
+	if len(x.Cookie) > 0 {
+		buff.Write(x.Cookie)
 		core.WriteUInt16LE(0x0A0D, buff)
 	}
-	struc.Pack(buff, x.ProtocolNeg)
+	struc.PackWithOptions(buff, x.ProtocolNeg, strucOptions)
+	if x.CorrelationInfo != nil {
+		buff.Write(x.CorrelationInfo.Serialize())
+	}
+	return buff.Bytes()
+}
+
+/**
+ * X224 disconnect request, DstRef is the reference of the peer from
+ * its connection confirm, SrcRef that of the connection request
+ * @see ITU-T X.224 13.3 and 13.5
+ */
+type DisconnectRequestPDU struct {
+	Len    uint8
+	Code   MessageType
+	DstRef uint16
+	SrcRef uint16
+	Reason uint8
+}
+
+func NewDisconnectRequestPDU(dstRef, srcRef uint16, reason uint8) *DisconnectRequestPDU {
+	return &DisconnectRequestPDU{6, TPDU_DISCONNECT_REQUEST, dstRef, srcRef, reason}
+}
+
+func (x *DisconnectRequestPDU) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(x.Len, buff)
+	core.WriteUInt8(uint8(x.Code), buff)
+	core.WriteUInt16BE(x.DstRef, buff)
+	core.WriteUInt16BE(x.SrcRef, buff)
+	core.WriteUInt8(x.Reason, buff)
 	return buff.Bytes()
 }
 
@@ -120,6 +467,63 @@ type ServerConnectionConfirm struct {
 	ProtocolNeg *Negotiation
 }
 
+/**
+ * dstRef is the source reference of the connection request, neg nil
+ * for a confirm without negotiation
+ */
+func NewServerConnectionConfirm(dstRef, srcRef uint16, neg *Negotiation) *ServerConnectionConfirm {
+	x := &ServerConnectionConfirm{6, TPDU_CONNECTION_CONFIRM, dstRef, srcRef, 0, neg}
+	if neg != nil {
+		x.Len = 14
+	}
+	return x
+}
+
+func (x *ServerConnectionConfirm) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(x.Len, buff)
+	core.WriteUInt8(uint8(x.Code), buff)
+	core.WriteUInt16BE(x.Padding1, buff)
+	core.WriteUInt16BE(x.Padding2, buff)
+	core.WriteUInt8(x.Padding3, buff)
+	if x.ProtocolNeg != nil {
+		struc.PackWithOptions(buff, x.ProtocolNeg, strucOptions)
+	}
+	return buff.Bytes()
+}
+
+/**
+ * Negotiation of the connection confirm s, from its length indicator
+ * up, nil when the server confirmed without one as RDP 4.0 servers and
+ * Windows Server 2003 do: it ignored the request and picked
+ * PROTOCOL_RDP. Len is checked against s before anything is unpacked
+ */
+func readConnectionConfirm(s []byte) (*Negotiation, error) {
+	if e := readDisconnect(s); e != nil {
+		return nil, e
+	}
+	if len(s) < 7 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if MessageType(s[1]&0xf0) != TPDU_CONNECTION_CONFIRM {
+		return nil, fmt.Errorf("x224 unexpected message type 0x%02x", s[1])
+	}
+	if int(s[0]) != len(s)-1 {
+		return nil, fmt.Errorf("x224 connection confirm length %d, %d bytes", s[0], len(s)-1)
+	}
+	switch s[0] {
+	case 6:
+		return nil, nil
+	case 14:
+		confirm := &ServerConnectionConfirm{}
+		if err := struc.UnpackWithOptions(bytes.NewReader(s), confirm, strucOptions); err != nil {
+			return nil, err
+		}
+		return confirm.ProtocolNeg, nil
+	}
+	return nil, fmt.Errorf("x224 connection confirm length %d", s[0])
+}
+
 /**
  * Header of each data message from x224 layer
  * @returns {type.Component}
@@ -134,6 +538,60 @@ func NewDataHeader() *DataHeader {
 	return &DataHeader{2, TPDU_DATA /* constant */, 0x80 /*constant*/}
 }
 
+// EOT bit of the data header, clear on all the fragments but the last
+const DATA_EOT = 0x80
+
+// bytes the fragments of one data TPDU may add up to, unless SetMaxDataLength
+const MAX_DATA_LENGTH = 1 << 20
+
+// a data TPDU of the server does not parse, test with errors.Is
+var ErrInvalidData = errors.New("x224 invalid data tpdu")
+
+/**
+ * A TPDU received after the connection confirm is not a data TPDU the
+ * client can read, emitted on "error" instead of "data". errors.Is
+ * matches ErrInvalidData, and io.ErrUnexpectedEOF when the TPDU is
+ * shorter than its header
+ */
+type DataError struct {
+	// the header received, 3 bytes at most
+	Header []byte
+	Reason string
+	short  bool
+}
+
+func (e *DataError) Error() string {
+	return fmt.Sprintf("%v % x: %s", ErrInvalidData, e.Header, e.Reason)
+}
+
+func (e *DataError) Is(target error) bool {
+	return target == ErrInvalidData || e.short && target == io.ErrUnexpectedEOF
+}
+
+/**
+ * Payload of the data TPDU s and its EOT bit, the header is checked
+ * against that of NewDataHeader
+ */
+func readData(s []byte) (payload []byte, eot bool, err error) {
+	header := s
+	if len(header) > 3 {
+		header = header[:3]
+	}
+	header = append([]byte{}, header...)
+	switch {
+	case len(s) < 3:
+		return nil, false, &DataError{header, "shorter than its header", true}
+	case s[0] != 2:
+		return nil, false, &DataError{header, fmt.Sprintf("length indicator %d", s[0]), false}
+	case MessageType(s[1]) != TPDU_DATA:
+		return nil, false, &DataError{header, fmt.Sprintf("unexpected message type 0x%02x", s[1]), false}
+	case s[2]&^DATA_EOT != 0:
+		// class 0 has no TPDU-NR
+		return nil, false, &DataError{header, fmt.Sprintf("tpdu number 0x%02x", s[2]), false}
+	}
+	return s[3:], s[2]&DATA_EOT != 0, nil
+}
+
 /**
  * Common X224 Automata
  * @param presentation {Layer} presentation layer
@@ -142,26 +600,77 @@ type X224 struct {
 	emission.Emitter
 	transport         core.Transport
 	requestedProtocol uint32
-	selectedProtocol  uint32
-	dataHeader        *DataHeader
-	host              string
+	requestFlags      uint8
+	cookie            string
+	routingToken      []byte
+	correlationID     *[16]byte
+	// of the connection confirm, written under mu
+	selectedProtocol uint32
+	selectedFlags    uint8
+	dataHeader       *DataHeader
+	host             string
+	log              glog.Logger
+	results          ResultWriter
+	mu               sync.Mutex
+	negotiation      *NegotiationResult
+	// source reference of the connection confirm
+	peerRef uint16
+	// payloads of the data TPDUs received without EOT, up to maxDataLength
+	fragments     []byte
+	maxDataLength int
+	// of the connection confirm, guarded by mu. confirmed is set once
+	// the wait ended, with the confirm or the timeout
+	confirmTimeout time.Duration
+	confirmTimer   *time.Timer
+	confirmed      bool
 }
 
-var (
-	FindSuccess = ""
-)
+/**
+ * Payload of the "connect" event, emitted once the transport is secured
+ * for the protocol the server selected
+ */
+type ProtocolSelection struct {
+	// PROTOCOL_* offered by the connection request
+	Requested uint32
+	// PROTOCOL_* picked by the server
+	Selected uint32
+	// EXTENDED_CLIENT_DATA_SUPPORTED... of the negotiation response, 0 without one
+	Flags uint8
+}
+
+// transport able to read the Early User Authorization Result of PROTOCOL_HYBRID_EX
+type earlyAuthTransport interface {
+	StartNLAEx() error
+}
 
-func New(t core.Transport) *X224 {
+func New(t core.Transport, log glog.Logger) *X224 {
 	x := &X224{
 		*emission.NewEmitter(),
 		t,
 		PROTOCOL_SSL | PROTOCOL_HYBRID,
+		0,
+		"",
+		nil,
+		nil,
 		PROTOCOL_SSL,
+		0,
 		NewDataHeader(),
 		"0",
+		log,
+		nil,
+		sync.Mutex{},
+		nil,
+		0,
+		nil,
+		MAX_DATA_LENGTH,
+		DefaultConfirmTimeout,
+		nil,
+		false,
 	}
 
 	t.On("close", func() {
+		// the peer closed, no confirm is coming
+		x.stopConfirmTimer()
 		x.Emit("close")
 	}).On("error", func(err error) {
 		x.Emit("error", err)
@@ -176,16 +685,85 @@ func (x *X224) Read(b []byte) (n int, err error) {
 
 func (x *X224) Write(b []byte) (n int, err error) {
 	buff := &bytes.Buffer{}
-	err = struc.Pack(buff, x.dataHeader)
+	err = struc.PackWithOptions(buff, x.dataHeader, strucOptions)
 	if err != nil {
 		return 0, err
 	}
 	buff.Write(b)
-	glog.Debug("x224 write", hex.EncodeToString(buff.Bytes()))
+	if x.log.IsDebug() {
+		// the payload is logged by the layer that sent it
+		x.log.Debug("x224 write", "data", core.Dump(buff.Bytes(), 3))
+	}
 	return x.transport.Write(buff.Bytes())
 }
 
+// payload of a data TPDU that fills a TPKT packet
+const MAX_FRAGMENT_LENGTH = tpkt.MAX_PAYLOAD_LENGTH - 3
+
+/**
+ * Write b in as many data TPDUs as it takes for each to fit a TPKT
+ * packet, the EOT bit is set on the last one only. For the payloads
+ * that may exceed a packet, as virtual channel data, Write fails on
+ * them with tpkt.ErrPDUTooLarge. n counts the bytes of b sent
+ */
+func (x *X224) WriteFragmented(b []byte) (n int, err error) {
+	for {
+		fragment, eot := b, true
+		if len(fragment) > MAX_FRAGMENT_LENGTH {
+			fragment, eot = fragment[:MAX_FRAGMENT_LENGTH], false
+		}
+		header := DataHeader{2, TPDU_DATA, 0}
+		if eot {
+			header.Separator = DATA_EOT
+		}
+		buff := &bytes.Buffer{}
+		if err = struc.PackWithOptions(buff, &header, strucOptions); err != nil {
+			return n, err
+		}
+		buff.Write(fragment)
+		if _, err = x.transport.Write(buff.Bytes()); err != nil {
+			return n, err
+		}
+		n += len(fragment)
+		b = b[len(fragment):]
+		if eot {
+			return n, nil
+		}
+	}
+}
+
+/**
+ * X224 disconnect request with REASON_NOT_SPECIFIED, the server then
+ * closes the connection
+ * @see ITU-T X.224 disconnect request TPDU
+ */
+func (x *X224) SendDisconnectRequest() error {
+	return x.sendDisconnectRequest(REASON_NOT_SPECIFIED)
+}
+
+func (x *X224) sendDisconnectRequest(reason uint8) error {
+	// the connection request was sent with a source reference of 0
+	message := NewDisconnectRequestPDU(x.peerRef, 0, reason)
+	_, err := x.transport.Write(message.Serialize())
+	return err
+}
+
+/**
+ * Send a disconnect request with reason, REASON_NORMAL..., then close
+ * the transport, even when the request could not be written. The
+ * error is that of the write, else of the close
+ */
+func (x *X224) Disconnect(reason uint8) error {
+	err := x.sendDisconnectRequest(reason)
+	if cerr := x.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// closes the transport, a connection confirm is not waited for anymore
 func (x *X224) Close() error {
+	x.stopConfirmTimer()
 	return x.transport.Close()
 }
 
@@ -193,100 +771,383 @@ func (x *X224) SetRequestedProtocol(p uint32) {
 	x.requestedProtocol = p
 }
 
+// PROTOCOL_* offered by the connection request
+func (x *X224) RequestedProtocols() uint32 {
+	return x.requestedProtocol
+}
+
+/**
+ * PROTOCOL_* picked by the server, PROTOCOL_RDP when it confirmed
+ * without negotiation. Only meaningful once "connect" was emitted
+ */
+func (x *X224) SelectedProtocol() uint32 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.selectedProtocol
+}
+
+/**
+ * how long Connect waits for the connection confirm: the transport is
+ * then closed and ErrNegotiationTimeout emitted. 0 waits for ever
+ */
+func (x *X224) SetConfirmTimeout(d time.Duration) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.confirmTimeout = d
+}
+
+/**
+ * bytes the fragments of a data TPDU, sent without EOT, may add up to
+ * before the transport is closed with an ErrInvalidData. MAX_DATA_LENGTH
+ * when n <= 0. Set it up before Connect
+ */
+func (x *X224) SetMaxDataLength(n int) {
+	if n <= 0 {
+		n = MAX_DATA_LENGTH
+	}
+	x.maxDataLength = n
+}
+
+/**
+ * RESTRICTED_ADMIN_MODE_REQUIRED... of the connection request,
+ * CORRELATION_INFO_PRESENT goes with SetCorrelationID
+ */
+func (x *X224) SetRequestFlags(flags uint8) {
+	x.requestFlags = flags
+}
+
+// "Cookie: mstshash=username" in the connection request, see RequestCookie
+func (x *X224) SetCookie(username string) {
+	x.cookie = username
+}
+
+// routing token of a connection broker in the connection request, instead of the cookie
+func (x *X224) SetRoutingToken(token []byte) {
+	x.routingToken = token
+}
+
+/**
+ * RDP_NEG_CORRELATION_INFO with id after the negotiation request, the
+ * cookie is then cut to leave room for it
+ */
+func (x *X224) SetCorrelationID(id [16]byte) {
+	x.correlationID = &id
+}
+
+// records the negotiation of the server, nothing is recorded without one
+func (x *X224) SetResultWriter(w ResultWriter) {
+	x.results = w
+}
+
+/**
+ * Negotiation answered by the server to the last Connect, false until
+ * the connection confirm was received or when it had no negotiation
+ */
+func (x *X224) Negotiation() (NegotiationResult, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.negotiation == nil {
+		return NegotiationResult{}, false
+	}
+	return *x.negotiation, true
+}
+
+// records the negotiation of the server then emits "negotiated"
+func (x *X224) negotiated(neg *Negotiation) {
+	result := NewNegotiationResult(x.host, neg)
+	x.mu.Lock()
+	x.negotiation = &result
+	x.mu.Unlock()
+	if x.results != nil {
+		if err := x.results.WriteResult(result); err != nil {
+			x.log.Error("x224 write result", "err", err)
+		}
+	}
+	x.Emit("negotiated", result)
+}
+
 func (x *X224) Connect(host string) error {
 
 	x.host = host
+	x.mu.Lock()
+	x.negotiation = nil
+	x.confirmed = false
+	if x.confirmTimer != nil {
+		x.confirmTimer.Stop()
+		x.confirmTimer = nil
+	}
+	x.mu.Unlock()
 	if x.transport == nil {
 		return errors.New("no transport")
 	}
-	message := NewClientConnectionRequestPDU(make([]byte, 0))
+	cookie := RequestCookie(x.cookie, x.routingToken)
+	if x.correlationID != nil && len(cookie) > MAX_COOKIE_LENGTH-CORRELATION_INFO_LENGTH {
+		cookie = cookie[:MAX_COOKIE_LENGTH-CORRELATION_INFO_LENGTH]
+	}
+	message := NewClientConnectionRequestPDU(cookie)
 	message.ProtocolNeg.Type = TYPE_RDP_NEG_REQ
+	message.ProtocolNeg.Flag = x.requestFlags &^ CORRELATION_INFO_PRESENT
 	message.ProtocolNeg.Result = uint32(x.requestedProtocol)
+	if x.correlationID != nil {
+		message.ProtocolNeg.Flag |= CORRELATION_INFO_PRESENT
+		message.CorrelationInfo = NewCorrelationInfo(*x.correlationID)
+		message.Len += CORRELATION_INFO_LENGTH
+	}
 
-	glog.Debug("x224 sendConnectionRequest", hex.EncodeToString(message.Serialize()))
+	if x.log.IsDebug() {
+		x.log.Debug("x224 sendConnectionRequest", "data", core.Dump(message.Serialize(), core.DumpMax))
+	}
+	// the confirm may arrive before Write returns
+	id := x.transport.ListenOnce("data", x.recvConnectionConfirm)
+	x.mu.Lock()
+	if x.confirmTimeout > 0 {
+		timeout := x.confirmTimeout
+		x.confirmTimer = time.AfterFunc(timeout, func() {
+			x.confirmTimedOut(id, timeout)
+		})
+	}
+	x.mu.Unlock()
 	_, err := x.transport.Write(message.Serialize())
-	x.transport.Once("data", x.recvConnectionConfirm)
+	if err != nil {
+		x.stopConfirmTimer()
+		x.transport.Remove(id)
+	}
 	return err
 }
 
-func savefile(str string) {
+// ends the wait for the confirm, false when it had ended already
+func (x *X224) stopConfirmTimer() bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.confirmed {
+		return false
+	}
+	x.confirmed = true
+	if x.confirmTimer != nil {
+		x.confirmTimer.Stop()
+		x.confirmTimer = nil
+	}
+	return true
+}
 
-	f, err := os.OpenFile("./结果.txt", os.O_WRONLY, 0644)
-	if err != nil {
-		// 打开文件失败处理
+func (x *X224) confirmTimedOut(id emission.ListenerID, timeout time.Duration) {
+	if !x.stopConfirmTimer() {
+		return
+	}
+	x.transport.Remove(id)
+	x.log.Info("x224 no connection confirm", "timeout", timeout)
+	x.fail(ErrNegotiationTimeout)
+}
 
-	} else {
+/**
+ * Synchronous connection request and confirm over a raw transport,
+ * for probes that do not run the whole stack. The negotiation is nil
+ * when the server confirmed without one, the error a *DisconnectError
+ * when it answered with a disconnect request or an error TPDU
+ */
+func Probe(rw io.ReadWriter, requestedProtocol uint32) (*Negotiation, error) {
+	return ProbeWithFlags(rw, requestedProtocol, 0)
+}
 
-		// 查找文件末尾的偏移量
-		n, _ := f.Seek(0, 2)
+// Probe with the RESTRICTED_ADMIN_MODE_REQUIRED... flags of the request
+func ProbeWithFlags(rw io.ReadWriter, requestedProtocol uint32, flags uint8) (*Negotiation, error) {
+	return ProbeWithCookie(rw, requestedProtocol, flags, nil)
+}
 
-		// 从末尾的偏移量开始写入内容
-		_, err = f.WriteAt([]byte(str+"\n"), n)
-	}
+// ProbeWithFlags with the cookie field of RequestCookie, nil for none
+func ProbeWithCookie(rw io.ReadWriter, requestedProtocol uint32, flags uint8, cookie []byte) (*Negotiation, error) {
+	message := NewClientConnectionRequestPDU(cookie)
+	message.ProtocolNeg.Type = TYPE_RDP_NEG_REQ
+	message.ProtocolNeg.Flag = flags
+	message.ProtocolNeg.Result = requestedProtocol
+	data := message.Serialize()
 
-	defer f.Close()
+	buff := &bytes.Buffer{}
+	core.WriteUInt8(tpkt.FASTPATH_ACTION_X224, buff)
+	core.WriteUInt8(0, buff)
+	core.WriteUInt16BE(uint16(len(data)+4), buff)
+	buff.Write(data)
+	if _, err := rw.Write(buff.Bytes()); err != nil {
+		return nil, err
+	}
 
+	header, err := core.ReadBytes(4, rw)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != tpkt.FASTPATH_ACTION_X224 {
+		return nil, errors.New("not a tpkt packet")
+	}
+	size := int(binary.BigEndian.Uint16(header[2:]))
+	// an error TPDU is the shortest answer
+	if size < 9 {
+		return nil, errors.New("x224 connection confirm too short")
+	}
+	s, err := core.ReadBytes(size-4, rw)
+	if err != nil {
+		return nil, err
+	}
+	return readConnectionConfirm(s)
 }
 
 func (x *X224) recvConnectionConfirm(s []byte) {
 
-	glog.Debug("x224 recvConnectionConfirm", hex.EncodeToString(s))
-	message := &ServerConnectionConfirm{}
-	if err := struc.Unpack(bytes.NewReader(s), message); err != nil {
-		glog.Error("ReadServerConnectionConfirm err", err)
+	if !x.stopConfirmTimer() {
 		return
 	}
-
-	if message.ProtocolNeg.Type == TYPE_RDP_NEG_FAILURE {
-		savefile(x.host)
-		FindSuccess = x.host
+	if x.log.IsDebug() {
+		x.log.Debug("x224 recvConnectionConfirm", "data", core.Dump(s, core.DumpMax))
+	}
+	neg, err := readConnectionConfirm(s)
+	var disconnect *DisconnectError
+	if errors.As(err, &disconnect) {
+		x.disconnected(disconnect)
 		return
 	}
-
-	if message.ProtocolNeg.Type == TYPE_RDP_NEG_RSP {
-		savefile(x.host)
-		FindSuccess = x.host
+	if err != nil {
+		x.fail(fmt.Errorf("x224 read connection confirm: %w", err))
 		return
-
 	}
+	x.peerRef = binary.BigEndian.Uint16(s[4:])
 
-	if x.selectedProtocol == PROTOCOL_HYBRID_EX {
-		glog.Error("NODE_RDP_PROTOCOL_HYBRID_EX_NOT_SUPPORTED")
+	if neg == nil {
+		// the server ignored the negotiation, it only speaks standard RDP security
+		x.selected(PROTOCOL_RDP, 0)
+		if x.requestedProtocol != PROTOCOL_RDP {
+			x.log.Info("*** server confirmed without negotiation ***")
+			x.fail(&StandardSecurityError{x.host, x.requestedProtocol})
+			return
+		}
+	} else if neg.Type == TYPE_RDP_NEG_FAILURE {
+		x.negotiated(neg)
+		x.fail(&NegotiationFailureError{x.host, neg.Result})
+		return
+	} else if neg.Type == TYPE_RDP_NEG_RSP {
+		x.negotiated(neg)
+		x.selected(neg.Result, neg.Flag)
+	} else {
+		x.fail(fmt.Errorf("x224 read connection confirm: negotiation type 0x%02x", uint8(neg.Type)))
 		return
 	}
 
 	x.transport.On("data", x.recvData)
 
+	secured, ok := x.transport.(core.SecureTransport)
+	if !ok && x.selectedProtocol != PROTOCOL_RDP {
+		x.fail(errors.New("x224 transport can not start tls"))
+		return
+	}
+
 	if x.selectedProtocol == PROTOCOL_RDP {
-		glog.Info("*** RDP security selected ***")
+		x.log.Info("*** RDP security selected ***")
 		return
 	}
 
 	if x.selectedProtocol == PROTOCOL_SSL {
-		glog.Info("*** SSL security selected ***")
-		err := x.transport.(*tpkt.TPKT).Conn.StartTLS()
+		x.log.Info("*** SSL security selected ***")
+		glog.SetPhase(x.log, core.PHASE_TLS)
+		err := secured.StartTLS()
 		if err != nil {
-			glog.Error("start tls failed", err)
+			x.fail(fmt.Errorf("x224 start tls: %w", err))
 			return
 		}
-		x.Emit("connect", x.selectedProtocol)
+		glog.SetPhase(x.log, core.PHASE_MCS)
+		x.Emit("connect", x.selection())
 		return
 	}
 
 	if x.selectedProtocol == PROTOCOL_HYBRID {
-		glog.Info("*** NLA Security selected ***")
-		err := x.transport.(*tpkt.TPKT).Conn.StartNLA()
+		x.log.Info("*** NLA Security selected ***")
+		glog.SetPhase(x.log, core.PHASE_NLA)
+		err := secured.StartNLA()
+		if err != nil {
+			x.fail(fmt.Errorf("x224 start nla: %w", err))
+			return
+		}
+		glog.SetPhase(x.log, core.PHASE_MCS)
+		x.Emit("connect", x.selection())
+		return
+	}
+
+	if x.selectedProtocol == PROTOCOL_HYBRID_EX {
+		x.log.Info("*** NLA Security with Early User Authorization selected ***")
+		earlyAuth, ok := x.transport.(earlyAuthTransport)
+		if !ok {
+			x.fail(errors.New("x224 transport can not start nla with early user authorization"))
+			return
+		}
+		glog.SetPhase(x.log, core.PHASE_NLA)
+		err := earlyAuth.StartNLAEx()
 		if err != nil {
-			glog.Error("start NLA failed", err)
+			x.fail(fmt.Errorf("x224 start nla: %w", err))
 			return
 		}
-		x.Emit("connect", x.selectedProtocol)
+		glog.SetPhase(x.log, core.PHASE_MCS)
+		x.Emit("connect", x.selection())
 		return
 	}
+
+	x.fail(fmt.Errorf("x224 server selected %s, not requested", ProtocolName(x.selectedProtocol)))
+}
+
+func (x *X224) selected(protocol uint32, flags uint8) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.selectedProtocol = protocol
+	x.selectedFlags = flags
+}
+
+// payload of "connect"
+func (x *X224) selection() ProtocolSelection {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return ProtocolSelection{x.requestedProtocol, x.selectedProtocol, x.selectedFlags}
+}
+
+/**
+ * Reports err to the upper layers then closes the transport, nothing
+ * the server sends after it is parsed
+ */
+func (x *X224) fail(err error) {
+	x.log.Error("x224 failed", "err", err)
+	x.Emit("error", err)
+	x.transport.Close()
+}
+
+// reports the disconnect request or error TPDU e then closes the transport
+func (x *X224) disconnected(e *DisconnectError) {
+	e.Host = x.host
+	x.log.Info("x224 disconnected by the server", "err", e)
+	x.Emit("disconnect", e)
+	x.Emit("error", e)
+	x.transport.Close()
 }
 
 func (x *X224) recvData(s []byte) {
-	glog.Debug("x224 recvData", hex.EncodeToString(s), "emit data")
-	// x224 header takes 3 bytes
-	x.Emit("data", s[3:])
+	if x.log.IsDebug() {
+		x.log.Debug("x224 recvData emit data", "data", core.Dump(s, core.DumpMax))
+	}
+	if e := readDisconnect(s); e != nil {
+		x.disconnected(e)
+		return
+	}
+	payload, eot, err := readData(s)
+	if err != nil {
+		x.fragments = nil
+		x.fail(err)
+		return
+	}
+	if !eot || x.fragments != nil {
+		if len(x.fragments)+len(payload) > x.maxDataLength {
+			x.fragments = nil
+			x.fail(&DataError{append([]byte{}, s[:3]...), fmt.Sprintf("fragments over %d bytes", x.maxDataLength), false})
+			return
+		}
+		x.fragments = append(x.fragments, payload...)
+		if !eot {
+			return
+		}
+		payload, x.fragments = x.fragments, nil
+	}
+	x.Emit("data", payload)
 }
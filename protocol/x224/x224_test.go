@@ -0,0 +1,1061 @@
+package x224_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/icodeface/grdp/core/testtransport"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/protocol/nla"
+	"github.com/icodeface/grdp/protocol/tpkt"
+	"github.com/icodeface/grdp/protocol/x224"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	glog.SetLogger(log.New(ioutil.Discard, "", 0))
+}
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+func TestProbeTruncated(t *testing.T) {
+	inputs := []string{
+		"",
+		"0300",
+		// connection confirm with negotiation response, cut in the middle
+		"030000130ed000001234000201",
+	}
+	for _, input := range inputs {
+		b, _ := hex.DecodeString(input)
+		_, err := x224.Probe(readWriter{bytes.NewReader(b), ioutil.Discard}, x224.PROTOCOL_SSL)
+		if err != io.ErrUnexpectedEOF {
+			t.Error(input, err, "not equal to", io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	b, _ := hex.DecodeString("030000130ed000001234000201080001000000")
+	neg, err := x224.Probe(readWriter{bytes.NewReader(b), ioutil.Discard}, x224.PROTOCOL_SSL)
+	if err != nil || neg == nil || neg.Result != x224.PROTOCOL_SSL {
+		t.Error(neg, err, "not equal to", x224.PROTOCOL_SSL)
+	}
+}
+
+// bare connection confirm laid out as Windows Server 2003 sends it
+const confirm2003 = "0300000b06d00000123400"
+
+func TestProbeWithoutNegotiation(t *testing.T) {
+	b, _ := hex.DecodeString(confirm2003)
+	neg, err := x224.Probe(readWriter{bytes.NewReader(b), ioutil.Discard}, x224.PROTOCOL_SSL|x224.PROTOCOL_HYBRID)
+	if err != nil || neg != nil {
+		t.Error(neg, err, "not equal to", nil)
+	}
+}
+
+func TestProbeConfirmLength(t *testing.T) {
+	inputs := []string{
+		// the length indicator of a negotiation, 7 bytes sent
+		"0300000b0ed00000123400",
+		// that of a bare confirm followed by a negotiation
+		"0300001306d00000123400020008000100000000",
+		// a negotiation cut short, the length indicator matching
+		"030000110cd000001234000201080001",
+		// a connection request
+		"0300000b06e00000123400",
+	}
+	for _, input := range inputs {
+		b, _ := hex.DecodeString(input)
+		if neg, err := x224.Probe(readWriter{bytes.NewReader(b), ioutil.Discard}, x224.PROTOCOL_SSL); err == nil {
+			t.Error(input, neg, "not an error")
+		}
+	}
+}
+
+func TestProbeWithFlags(t *testing.T) {
+	// negotiation response with EXTENDED_CLIENT_DATA_SUPPORTED and RESTRICTED_ADMIN_MODE_SUPPORTED
+	b, _ := hex.DecodeString("030000130ed000001234000209080002000000")
+	request := &bytes.Buffer{}
+	neg, err := x224.ProbeWithFlags(readWriter{bytes.NewReader(b), request}, x224.PROTOCOL_HYBRID, x224.RESTRICTED_ADMIN_MODE_REQUIRED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "030000130ee00000000000" + "0101080002000000"
+	if hex.EncodeToString(request.Bytes()) != expected {
+		t.Error(hex.EncodeToString(request.Bytes()), "not equal to", expected)
+	}
+	result := x224.NewNegotiationResult("host", neg)
+	if result.Flags != 0x09 || !result.RestrictedAdminSupported() || result.RedirectedAuthSupported() {
+		t.Errorf("flags 0x%02x", result.Flags)
+	}
+	// the flags of a failure are not response flags
+	failure := x224.NegotiationResult{Type: x224.TYPE_RDP_NEG_FAILURE, FailureCode: x224.HYBRID_REQUIRED_BY_SERVER,
+		Flags: x224.RESTRICTED_ADMIN_MODE_SUPPORTED}
+	if failure.RestrictedAdminSupported() {
+		t.Error(failure, "supports restricted admin")
+	}
+}
+
+func TestRequestCookie(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		username string
+		token    []byte
+		expected string
+	}{
+		{"", nil, ""},
+		{"eltons", nil, "Cookie: mstshash=eltons"},
+		{"", []byte("Cookie: msts=3640205228.15629.0000"), "Cookie: msts=3640205228.15629.0000"},
+		// the routing token replaces the cookie, its CR LF is not repeated
+		{"eltons", []byte("Cookie: msts=3640205228.15629.0000\r\n"), "Cookie: msts=3640205228.15629.0000"},
+		{"eltons\r\nX-Injected: 1", nil, "Cookie: mstshash=eltons"},
+		{long, nil, ("Cookie: mstshash=" + long)[:x224.MAX_COOKIE_LENGTH]},
+	}
+	for _, test := range tests {
+		if cookie := string(x224.RequestCookie(test.username, test.token)); cookie != test.expected {
+			t.Errorf("%q not equal to %q", cookie, test.expected)
+		}
+	}
+}
+
+func TestClientConnectionRequestCookie(t *testing.T) {
+	tests := []struct {
+		cookie   []byte
+		expected string
+	}{
+		// the Client X.224 Connection Request PDU of MS-RDPBCGR 4.1.1, PROTOCOL_RDP requested
+		{x224.RequestCookie("eltons", nil),
+			"0300002c27e00000000000" + hex.EncodeToString([]byte("Cookie: mstshash=eltons")) + "0d0a" + "0100080000000000"},
+		{x224.RequestCookie("", []byte("Cookie: msts=3640205228.15629.0000")),
+			"0300003732e00000000000" + hex.EncodeToString([]byte("Cookie: msts=3640205228.15629.0000")) + "0d0a" + "0100080000000000"},
+		{nil, "030000130ee00000000000" + "0100080000000000"},
+	}
+	for _, test := range tests {
+		request := &bytes.Buffer{}
+		// an RDP 4.0 confirm ends the probe
+		confirm, _ := hex.DecodeString("0300000b06d00000123400")
+		if _, err := x224.ProbeWithCookie(readWriter{bytes.NewReader(confirm), request}, x224.PROTOCOL_RDP, 0, test.cookie); err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(request.Bytes()) != test.expected {
+			t.Error(hex.EncodeToString(request.Bytes()), "not equal to", test.expected)
+		}
+	}
+
+	// the length indicator of the longest cookie still fits
+	pdu := x224.NewClientConnectionRequestPDU(x224.RequestCookie(strings.Repeat("a", 300), nil))
+	if b := pdu.Serialize(); pdu.Len != 254 || len(b) != 255 {
+		t.Error(pdu.Len, len(b), "not equal to", 254, 255)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	m := testtransport.New()
+	x := x224.New(m, glog.Default())
+	results := x224.NewMemoryResultWriter()
+	x.SetResultWriter(results)
+	x.SetRequestedProtocol(x224.PROTOCOL_SSL)
+	if err := x.Connect("host"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "0ee000000000000100080001000000"
+	if writes := m.Writes(); len(writes) != 1 || hex.EncodeToString(writes[0]) != expected {
+		t.Error(writes, "not equal to", expected)
+	}
+
+	// negotiation response, the scan records the host
+	confirm, _ := hex.DecodeString("0ed000001234000201080001000000")
+	m.Inject(confirm)
+	result, ok := results.Result("host")
+	if !ok || result.Failed() || result.SelectedProtocol != x224.PROTOCOL_SSL {
+		t.Error(results.Results(), "not equal to", "host PROTOCOL_SSL")
+	}
+	if started := m.Started(); len(started) != 1 || started[0] != "tls" {
+		t.Error(started, "not equal to", []string{"tls"})
+	}
+}
+
+func TestConnectCookie(t *testing.T) {
+	m := testtransport.New()
+	x := x224.New(m, glog.Default())
+	x.SetRequestedProtocol(x224.PROTOCOL_SSL)
+	x.SetCookie("eltons")
+	if err := x.Connect("host"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "27e00000000000" + hex.EncodeToString([]byte("Cookie: mstshash=eltons")) + "0d0a" + "0100080001000000"
+	if writes := m.Writes(); len(writes) != 1 || hex.EncodeToString(writes[0]) != expected {
+		t.Error(writes, "not equal to", expected)
+	}
+}
+
+func TestConnectCorrelationID(t *testing.T) {
+	id := [16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	m := testtransport.New()
+	x := x224.New(m, glog.Default())
+	x.SetCorrelationID(id)
+	if err := x.Connect("host"); err != nil {
+		t.Fatal(err)
+	}
+	// RDP_NEG_REQ with CORRELATION_INFO_PRESENT then RDP_NEG_CORRELATION_INFO, 36 bytes
+	expected := "32e00000000000" + "0108080003000000" + "06002400" + hex.EncodeToString(id[:]) + strings.Repeat("00", 16)
+	if writes := m.Writes(); len(writes) != 1 || hex.EncodeToString(writes[0]) != expected {
+		t.Error(writes, "not equal to", expected)
+	}
+
+	// the cookie is cut to leave room for it
+	m = testtransport.New()
+	x = x224.New(m, glog.Default())
+	x.SetCorrelationID(id)
+	x.SetCookie(strings.Repeat("a", 300))
+	x.SetRequestFlags(x224.RESTRICTED_ADMIN_MODE_REQUIRED)
+	if err := x.Connect("host"); err != nil {
+		t.Fatal(err)
+	}
+	writes := m.Writes()
+	if len(writes) != 1 {
+		t.Fatal(writes)
+	}
+	if request := writes[0]; request[0] != 254 || len(request) != 255 || request[len(request)-43] != 0x09 {
+		t.Error(hex.EncodeToString(request))
+	}
+}
+
+func TestConnectSelectedProtocol(t *testing.T) {
+	requested := uint32(x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID | x224.PROTOCOL_HYBRID_EX)
+	tests := []struct {
+		confirm string
+		started string
+		flags   uint8
+	}{
+		{"0ed000001234000200080001000000", "tls", 0},
+		{"0ed000001234000209080002000000", "nla", x224.EXTENDED_CLIENT_DATA_SUPPORTED | x224.RESTRICTED_ADMIN_MODE_SUPPORTED},
+		{"0ed000001234000201080008000000", "nla_ex", x224.EXTENDED_CLIENT_DATA_SUPPORTED},
+	}
+	for _, test := range tests {
+		m := testtransport.New()
+		x := x224.New(m, glog.Default())
+		var connected []x224.ProtocolSelection
+		x.On("connect", func(selection x224.ProtocolSelection) {
+			connected = append(connected, selection)
+		})
+		// all are requested, the server picks one
+		x.SetRequestedProtocol(requested)
+		if err := x.Connect("host"); err != nil {
+			t.Fatal(err)
+		}
+		confirm, _ := hex.DecodeString(test.confirm)
+		m.Inject(confirm)
+		if started := m.Started(); len(started) != 1 || started[0] != test.started {
+			t.Error(started, "not equal to", []string{test.started})
+		}
+		selected := binary.LittleEndian.Uint32(confirm[11:])
+		expected := x224.ProtocolSelection{Requested: requested, Selected: selected, Flags: test.flags}
+		if len(connected) != 1 || connected[0] != expected {
+			t.Errorf("%+v not equal to %+v", connected, expected)
+		}
+		if x.RequestedProtocols() != requested || x.SelectedProtocol() != selected {
+			t.Error(x.RequestedProtocols(), x.SelectedProtocol(), "not equal to", requested, selected)
+		}
+	}
+}
+
+func TestConnectMalformedConfirm(t *testing.T) {
+	tests := []struct {
+		name    string
+		confirm string
+		message string
+	}{
+		{"truncated", "0ed0000012340002010800", "x224 read connection confirm: x224 connection confirm length 14, 10 bytes"},
+		{"length", "0ad0000012340002010800", "x224 read connection confirm: x224 connection confirm length 10"},
+		{"message type", "0ee000001234000201080001000000", "x224 read connection confirm: x224 unexpected message type 0xe0"},
+		{"negotiation type", "0ed000001234000101080001000000", "x224 read connection confirm: negotiation type 0x01"},
+		{"protocol", "0ed000001234000201080010000000", "x224 server selected 0x00000010, not requested"},
+	}
+	for _, test := range tests {
+		m := testtransport.New()
+		x := x224.New(m, glog.Default())
+		var emitted []error
+		x.On("error", func(err error) {
+			emitted = append(emitted, err)
+		})
+		x.On("connect", func(selection x224.ProtocolSelection) {
+			t.Error(test.name, "connected with", x224.ProtocolName(selection.Selected))
+		})
+		if err := x.Connect("host"); err != nil {
+			t.Fatal(err)
+		}
+		confirm, _ := hex.DecodeString(test.confirm)
+		m.Inject(confirm)
+		if len(emitted) != 1 || emitted[0].Error() != test.message {
+			t.Error(test.name, emitted, "not equal to", test.message)
+		}
+		// nothing is parsed after the error
+		if !m.Closed() || len(m.Started()) != 0 {
+			t.Error(test.name, m.Closed(), m.Started())
+		}
+	}
+}
+
+func TestConnectStartFailure(t *testing.T) {
+	startErr := errors.New("handshake failure")
+	tests := []struct {
+		confirm string
+		set     func(m *testtransport.MockTransport)
+		message string
+	}{
+		{"0ed000001234000200080001000000", func(m *testtransport.MockTransport) { m.SetStartTLSError(startErr) }, "x224 start tls: handshake failure"},
+		{"0ed000001234000200080002000000", func(m *testtransport.MockTransport) { m.SetStartNLAError(startErr) }, "x224 start nla: handshake failure"},
+	}
+	for _, test := range tests {
+		m := testtransport.New()
+		test.set(m)
+		x := x224.New(m, glog.Default())
+		var emitted []error
+		x.On("error", func(err error) {
+			emitted = append(emitted, err)
+		}).On("connect", func(x224.ProtocolSelection) {
+			t.Error(test.message, "connected")
+		})
+		if err := x.Connect("host"); err != nil {
+			t.Fatal(err)
+		}
+		confirm, _ := hex.DecodeString(test.confirm)
+		m.Inject(confirm)
+		if len(emitted) != 1 || !errors.Is(emitted[0], startErr) || emitted[0].Error() != test.message || !m.Closed() {
+			t.Error(emitted, m.Closed(), "not equal to", test.message)
+		}
+	}
+}
+
+func TestConnectAuthorizationDenied(t *testing.T) {
+	m := testtransport.New()
+	m.SetStartNLAError(&nla.AuthorizationError{Result: nla.AUTHZ_ACCESS_DENIED})
+	x := x224.New(m, glog.Default())
+	var emitted error
+	x.On("error", func(err error) {
+		emitted = err
+	})
+	x.On("connect", func(selection x224.ProtocolSelection) {
+		t.Error("connected with", x224.ProtocolName(selection.Selected))
+	})
+	x.SetRequestedProtocol(x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID | x224.PROTOCOL_HYBRID_EX)
+	if err := x.Connect("host"); err != nil {
+		t.Fatal(err)
+	}
+	confirm, _ := hex.DecodeString("0ed000001234000201080008000000")
+	m.Inject(confirm)
+	if !errors.Is(emitted, nla.ErrAuthorizationDenied) {
+		t.Error(emitted, "not equal to", nla.ErrAuthorizationDenied)
+	}
+}
+
+func TestConnectWithoutNegotiation(t *testing.T) {
+	confirm, _ := hex.DecodeString(confirm2003[8:])
+	m := testtransport.New()
+	x := x224.New(m, glog.Default())
+	var emitted error
+	x.On("error", func(err error) {
+		emitted = err
+	})
+	results := x224.NewMemoryResultWriter()
+	x.SetResultWriter(results)
+	x.Connect("host")
+	m.Inject(confirm)
+	var standard *x224.StandardSecurityError
+	if !errors.Is(emitted, x224.ErrStandardSecurity) || !errors.As(emitted, &standard) ||
+		standard.Host != "host" || standard.Requested != x224.PROTOCOL_SSL|x224.PROTOCOL_HYBRID {
+		t.Error(emitted, "not equal to", x224.ErrStandardSecurity)
+	}
+	if _, ok := x.Negotiation(); ok || len(results.Results()) != 0 || len(m.Started()) != 0 {
+		t.Error(results.Results(), m.Started(), "not equal to", "no negotiation")
+	}
+
+	// standard RDP security was requested, the data follows
+	m = testtransport.New()
+	x = x224.New(m, glog.Default())
+	emitted = nil
+	var data []byte
+	x.On("error", func(err error) {
+		emitted = err
+	}).On("data", func(b []byte) {
+		data = b
+	})
+	x.SetRequestedProtocol(x224.PROTOCOL_RDP)
+	x.Connect("host")
+	m.Inject(confirm)
+	m.Inject([]byte{0x02, 0xf0, 0x80, 0x7f})
+	if emitted != nil || len(m.Started()) != 0 || !bytes.Equal(data, []byte{0x7f}) {
+		t.Error(emitted, m.Started(), data)
+	}
+}
+
+func TestConnectDisconnect(t *testing.T) {
+	tests := []struct {
+		tpdu     string
+		expected x224.DisconnectError
+		message  string
+	}{
+		{"06800000123488", x224.DisconnectError{"host", x224.TPDU_DISCONNECT_REQUEST, x224.REASON_CONNECTION_REFUSED},
+			"x224 disconnected by the server, REASON_CONNECTION_REFUSED"},
+		// the reason is left out
+		{"048000001234", x224.DisconnectError{"host", x224.TPDU_DISCONNECT_REQUEST, x224.REASON_NOT_SPECIFIED},
+			"x224 disconnected by the server, REASON_NOT_SPECIFIED"},
+		// with the invalid TPDU parameter
+		{"0870000002c1020ee0", x224.DisconnectError{"host", x224.TPDU_ERROR, x224.CAUSE_INVALID_TPDU_TYPE},
+			"x224 disconnected by the server, error CAUSE_INVALID_TPDU_TYPE"},
+	}
+	for _, test := range tests {
+		m := testtransport.New()
+		x := x224.New(m, glog.Default())
+		var disconnect *x224.DisconnectError
+		var emitted error
+		x.On("disconnect", func(e *x224.DisconnectError) {
+			disconnect = e
+		}).On("error", func(err error) {
+			emitted = err
+		})
+		results := x224.NewMemoryResultWriter()
+		x.SetResultWriter(results)
+		x.Connect("host")
+		tpdu, _ := hex.DecodeString(test.tpdu)
+		m.Inject(tpdu)
+		if disconnect == nil || *disconnect != test.expected {
+			t.Error(test.tpdu, disconnect, "not equal to", test.expected)
+		}
+		if !errors.Is(emitted, x224.ErrDisconnected) || emitted.Error() != test.message {
+			t.Error(test.tpdu, emitted, "not equal to", test.message)
+		}
+		if !m.Closed() || len(results.Results()) != 0 || len(m.Started()) != 0 {
+			t.Error(test.tpdu, m.Closed(), results.Results(), m.Started())
+		}
+	}
+}
+
+func TestDataDisconnect(t *testing.T) {
+	m := testtransport.New()
+	x := x224.New(m, glog.Default())
+	var emitted error
+	var data [][]byte
+	x.On("error", func(err error) {
+		emitted = err
+	}).On("data", func(b []byte) {
+		data = append(data, b)
+	})
+	x.Connect("host")
+	confirm, _ := hex.DecodeString("0ed000001234000201080001000000")
+	m.Inject(confirm)
+	m.Inject([]byte{0x02, 0xf0, 0x80, 0x7f})
+	m.Inject([]byte{0x06, 0x80, 0, 0, 0x12, 0x34, x224.REASON_NORMAL})
+	var disconnect *x224.DisconnectError
+	if !errors.As(emitted, &disconnect) || disconnect.Type != x224.TPDU_DISCONNECT_REQUEST || disconnect.Reason != x224.REASON_NORMAL {
+		t.Error(emitted, "not equal to", x224.REASON_NORMAL)
+	}
+	if len(data) != 1 || !m.Closed() {
+		t.Error(data, m.Closed())
+	}
+}
+
+func TestProbeDisconnect(t *testing.T) {
+	inputs := map[string]x224.DisconnectError{
+		"0300000b06800000123488": {Type: x224.TPDU_DISCONNECT_REQUEST, Reason: x224.REASON_CONNECTION_REFUSED},
+		"030000090470000003":     {Type: x224.TPDU_ERROR, Reason: x224.CAUSE_INVALID_PARAMETER_VALUE},
+	}
+	for input, expected := range inputs {
+		b, _ := hex.DecodeString(input)
+		_, err := x224.Probe(readWriter{bytes.NewReader(b), ioutil.Discard}, x224.PROTOCOL_SSL)
+		var disconnect *x224.DisconnectError
+		if !errors.As(err, &disconnect) || *disconnect != expected {
+			t.Error(input, err, "not equal to", expected)
+		}
+	}
+}
+
+func TestDisconnectRequestPDU(t *testing.T) {
+	// LI 6, DR 1000 0000, DST-REF, SRC-REF then REASON, X.224 13.5.2
+	expected := "0680123400008a"
+	pdu := x224.NewDisconnectRequestPDU(0x1234, 0, x224.REASON_INVALID_HEADER_LENGTH)
+	if b := hex.EncodeToString(pdu.Serialize()); b != expected {
+		t.Error(b, "not equal to", expected)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	m := testtransport.New()
+	x := x224.New(m, glog.Default())
+	x.Connect("host")
+	// the server references the connection with 0xabcd
+	m.Inject([]byte{0x0e, 0xd0, 0, 0, 0xab, 0xcd, 0, 0x02, 0, 0x08, 0, 0x01, 0, 0, 0})
+	if err := x.Disconnect(x224.REASON_NORMAL); err != nil {
+		t.Fatal(err)
+	}
+	expected := "0680abcd000080"
+	if writes := m.Writes(); len(writes) != 2 || hex.EncodeToString(writes[1]) != expected {
+		t.Error(writes, "not equal to", expected)
+	}
+	if !m.Closed() {
+		t.Error("transport not closed")
+	}
+
+	// closed though the request could not be written
+	m = testtransport.New()
+	x = x224.New(m, glog.Default())
+	m.SetWriteError(io.ErrClosedPipe)
+	if err := x.Disconnect(x224.REASON_NORMAL); err != io.ErrClosedPipe || !m.Closed() {
+		t.Error(err, m.Closed(), "not equal to", io.ErrClosedPipe, true)
+	}
+}
+
+// x224 connected with PROTOCOL_SSL, its "data" and "error" recorded
+func connected(t *testing.T) (m *testtransport.MockTransport, data *[][]byte, errs *[]error) {
+	m = testtransport.New()
+	x := x224.New(m, glog.Default())
+	data, errs = &[][]byte{}, &[]error{}
+	x.On("data", func(b []byte) {
+		*data = append(*data, b)
+	}).On("error", func(err error) {
+		*errs = append(*errs, err)
+	})
+	if err := x.Connect("host"); err != nil {
+		t.Fatal(err)
+	}
+	confirm, _ := hex.DecodeString("0ed000001234000201080001000000")
+	m.Inject(confirm)
+	return m, data, errs
+}
+
+func TestRecvDataInvalid(t *testing.T) {
+	tests := []struct {
+		tpdu    string
+		message string
+		short   bool
+	}{
+		{"", "x224 invalid data tpdu : shorter than its header", true},
+		{"02f0", "x224 invalid data tpdu 02 f0: shorter than its header", true},
+		{"03f08000", "x224 invalid data tpdu 03 f0 80: length indicator 3", false},
+		{"02e08001", "x224 invalid data tpdu 02 e0 80: unexpected message type 0xe0", false},
+		{"02f08101", "x224 invalid data tpdu 02 f0 81: tpdu number 0x81", false},
+	}
+	for _, test := range tests {
+		m, data, errs := connected(t)
+		tpdu, _ := hex.DecodeString(test.tpdu)
+		m.Inject(tpdu)
+		if len(*data) != 0 || len(*errs) != 1 {
+			t.Fatal(test.tpdu, *data, *errs)
+		}
+		err := (*errs)[0]
+		var dataErr *x224.DataError
+		if !errors.As(err, &dataErr) || !errors.Is(err, x224.ErrInvalidData) || err.Error() != test.message {
+			t.Error(test.tpdu, err, "not equal to", test.message)
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) != test.short {
+			t.Error(test.tpdu, err, "short", test.short)
+		}
+	}
+}
+
+func TestRecvDataFragments(t *testing.T) {
+	m, data, errs := connected(t)
+	m.Inject([]byte{0x02, 0xf0, 0x00, 0x01, 0x02})
+	m.Inject([]byte{0x02, 0xf0, 0x00})
+	m.Inject([]byte{0x02, 0xf0, 0x00, 0x03})
+	if len(*data) != 0 {
+		t.Error(*data, "emitted before the EOT")
+	}
+	m.Inject([]byte{0x02, 0xf0, 0x80, 0x04})
+	m.Inject([]byte{0x02, 0xf0, 0x80, 0x05})
+	expected := [][]byte{{0x01, 0x02, 0x03, 0x04}, {0x05}}
+	if len(*errs) != 0 || fmt.Sprint(*data) != fmt.Sprint(expected) {
+		t.Error(*data, *errs, "not equal to", expected)
+	}
+
+	// two fragments
+	m, data, errs = connected(t)
+	m.Inject([]byte{0x02, 0xf0, 0x00, 0x01})
+	m.Inject([]byte{0x02, 0xf0, 0x80, 0x02, 0x03})
+	expected = [][]byte{{0x01, 0x02, 0x03}}
+	if len(*errs) != 0 || fmt.Sprint(*data) != fmt.Sprint(expected) {
+		t.Error(*data, *errs, "not equal to", expected)
+	}
+
+	// fragments without end
+	m, data, errs = connected(t)
+	fragment := append([]byte{0x02, 0xf0, 0x00}, make([]byte, 0xfff0)...)
+	for i := 0; i <= x224.MAX_DATA_LENGTH/0xfff0; i++ {
+		m.Inject(fragment)
+	}
+	if len(*data) != 0 || len(*errs) != 1 || !errors.Is((*errs)[0], x224.ErrInvalidData) {
+		t.Error(len(*data), *errs, "not equal to", x224.ErrInvalidData)
+	}
+}
+
+func TestMaxDataLength(t *testing.T) {
+	m := testtransport.New()
+	x := x224.New(m, glog.Default())
+	x.SetMaxDataLength(4)
+	var data [][]byte
+	var errs []error
+	x.On("data", func(b []byte) {
+		data = append(data, b)
+	}).On("error", func(err error) {
+		errs = append(errs, err)
+	})
+	if err := x.Connect("host"); err != nil {
+		t.Fatal(err)
+	}
+	confirm, _ := hex.DecodeString("0ed000001234000201080001000000")
+	m.Inject(confirm)
+
+	// up to the limit
+	m.Inject([]byte{0x02, 0xf0, 0x00, 0x01, 0x02})
+	m.Inject([]byte{0x02, 0xf0, 0x80, 0x03, 0x04})
+	if len(errs) != 0 || len(data) != 1 {
+		t.Error(data, errs)
+	}
+	// one byte over: the fragments are dropped and the transport closed
+	m.Inject([]byte{0x02, 0xf0, 0x00, 0x01, 0x02})
+	m.Inject([]byte{0x02, 0xf0, 0x00, 0x03, 0x04})
+	m.Inject([]byte{0x02, 0xf0, 0x80, 0x05})
+	var invalid *x224.DataError
+	if len(data) != 1 || len(errs) != 1 || !errors.As(errs[0], &invalid) || !m.Closed() {
+		t.Error(data, errs, m.Closed())
+	}
+}
+
+func TestWriteFragmented(t *testing.T) {
+	sent := testtransport.New()
+	b := make([]byte, 1<<20)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	if n, err := x224.New(sent, glog.Default()).WriteFragmented(b); n != len(b) || err != nil {
+		t.Fatal(n, err)
+	}
+	writes := sent.Writes()
+	if expected := len(b)/x224.MAX_FRAGMENT_LENGTH + 1; len(writes) != expected {
+		t.Error(len(writes), "not equal to", expected)
+	}
+	// each fits a packet, the other side reassembles them
+	m, data, errs := connected(t)
+	for i, tpdu := range writes {
+		if len(tpdu) > tpkt.MAX_PAYLOAD_LENGTH || (tpdu[2] == x224.DATA_EOT) != (i == len(writes)-1) {
+			t.Error(i, len(tpdu), tpdu[:3])
+		}
+		m.Inject(tpdu)
+	}
+	if len(*errs) != 0 || len(*data) != 1 || !bytes.Equal((*data)[0], b) {
+		t.Error(len(*data), *errs)
+	}
+
+	// a payload that fits goes in one TPDU
+	sent = testtransport.New()
+	x224.New(sent, glog.Default()).WriteFragmented([]byte{1})
+	if writes = sent.Writes(); len(writes) != 1 || !bytes.Equal(writes[0], []byte{0x02, 0xf0, 0x80, 0x01}) {
+		t.Error(writes)
+	}
+}
+
+func TestConfirmTimeout(t *testing.T) {
+	m := testtransport.New()
+	x := x224.New(m, glog.Default())
+	errc := make(chan error, 1)
+	x.On("error", func(err error) {
+		errc <- err
+	}).On("negotiated", func(x224.NegotiationResult) {
+		t.Error("negotiated after the timeout")
+	})
+	x.SetConfirmTimeout(20 * time.Millisecond)
+	if err := x.Connect("host"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if err != x224.ErrNegotiationTimeout {
+			t.Error(err, "not equal to", x224.ErrNegotiationTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no timeout")
+	}
+	// closed by the timer goroutine once the error is emitted
+	deadline := time.Now().Add(5 * time.Second)
+	for !m.Closed() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !m.Closed() {
+		t.Error("transport not closed")
+	}
+	// too late, the confirm is not read anymore
+	confirm, _ := hex.DecodeString("0ed000001234000201080001000000")
+	m.Inject(confirm)
+	if _, ok := x.Negotiation(); ok || len(m.Started()) != 0 {
+		t.Error(m.Started(), "not equal to", "no negotiation")
+	}
+}
+
+func TestConfirmBeforeTimeout(t *testing.T) {
+	m := testtransport.New()
+	x := x224.New(m, glog.Default())
+	errc := make(chan error, 1)
+	x.On("error", func(err error) {
+		errc <- err
+	})
+	x.SetConfirmTimeout(20 * time.Millisecond)
+	x.Connect("host")
+	confirm, _ := hex.DecodeString("0ed000001234000201080001000000")
+	m.Inject(confirm)
+	select {
+	case err := <-errc:
+		t.Error(err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, ok := x.Negotiation(); !ok || m.Closed() {
+		t.Error(ok, m.Closed(), "not equal to", true, false)
+	}
+}
+
+func TestConnectBadConfirm(t *testing.T) {
+	m := testtransport.New()
+	x := x224.New(m, glog.Default())
+	var emitted error
+	x.On("error", func(err error) {
+		emitted = err
+	})
+	x.Connect("host")
+	m.Inject([]byte{0x06})
+	if emitted == nil || !strings.Contains(emitted.Error(), "x224 read connection confirm") {
+		t.Error(emitted, "not equal to", "x224 read connection confirm")
+	}
+}
+
+func TestConnectWriteError(t *testing.T) {
+	m := testtransport.New()
+	m.SetWriteError(io.ErrClosedPipe)
+	x := x224.New(m, glog.Default())
+	results := x224.NewMemoryResultWriter()
+	x.SetResultWriter(results)
+	if err := x.Connect("host"); err != io.ErrClosedPipe {
+		t.Error(err, "not equal to", io.ErrClosedPipe)
+	}
+	// no confirm is expected anymore
+	confirm, _ := hex.DecodeString("0ed000001234000201080001000000")
+	m.Inject(confirm)
+	if len(results.Results()) != 0 {
+		t.Error(results.Results(), "not equal to", "no result")
+	}
+}
+
+func TestLayerError(t *testing.T) {
+	m := testtransport.New()
+	x := x224.New(m, glog.Default())
+	var emitted error
+	closed := false
+	x.On("error", func(err error) {
+		emitted = err
+	}).On("close", func() {
+		closed = true
+	})
+	m.Fail(io.ErrUnexpectedEOF)
+	m.Close()
+	if emitted != io.ErrUnexpectedEOF || !closed {
+		t.Error(emitted, closed, "not equal to", io.ErrUnexpectedEOF, true)
+	}
+}
+
+func TestNegotiationFailure(t *testing.T) {
+	tests := []struct {
+		confirm string
+		code    uint32
+		name    string
+	}{
+		// server with TLS only, the client asked for standard RDP security
+		{"0ed000001234000300080001000000", x224.SSL_REQUIRED_BY_SERVER, "SSL_REQUIRED_BY_SERVER"},
+		// server without certificate configured for TLS
+		{"0ed000001234000300080002000000", x224.SSL_NOT_ALLOWED_BY_SERVER, "SSL_NOT_ALLOWED_BY_SERVER"},
+		// server requiring NLA, the client asked for TLS only
+		{"0ed000001234000300080005000000", x224.HYBRID_REQUIRED_BY_SERVER, "HYBRID_REQUIRED_BY_SERVER"},
+	}
+	for _, test := range tests {
+		m := testtransport.New()
+		x := x224.New(m, glog.Default())
+		results := x224.NewMemoryResultWriter()
+		x.SetResultWriter(results)
+		var emitted []x224.NegotiationResult
+		var errs []error
+		x.On("negotiated", func(result x224.NegotiationResult) {
+			emitted = append(emitted, result)
+		}).On("error", func(err error) {
+			errs = append(errs, err)
+		})
+		x.Connect("host")
+		if _, ok := x.Negotiation(); ok {
+			t.Error(test.name, "negotiation before the connection confirm")
+		}
+		confirm, _ := hex.DecodeString(test.confirm)
+		m.Inject(confirm)
+		expected := x224.NegotiationResult{Host: "host", Type: x224.TYPE_RDP_NEG_FAILURE, FailureCode: test.code}
+		if result, ok := x.Negotiation(); !ok || result != expected {
+			t.Error(test.name, result, "not equal to", expected)
+		}
+		if len(emitted) != 1 || emitted[0] != expected {
+			t.Error(test.name, emitted, "not equal to", expected)
+		}
+		if result, ok := results.Result("host"); !ok || result != expected {
+			t.Error(test.name, result, "not equal to", expected)
+		}
+		var failure *x224.NegotiationFailureError
+		if len(errs) != 1 || !errors.As(errs[0], &failure) || failure.Code != test.code || failure.Host != "host" {
+			t.Error(test.name, errs, "not equal to", test.name)
+		} else if !strings.HasSuffix(failure.Error(), test.name) {
+			t.Error(failure.Error(), "not ending with", test.name)
+		}
+		if err := expected.Err(); err == nil || err.Error() != "x224 negotiation failure "+test.name {
+			t.Error(test.name, err, "not equal to", test.name)
+		}
+	}
+}
+
+func TestFailureCodeName(t *testing.T) {
+	if name := x224.FailureCodeName(x224.SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER); name != "SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER" {
+		t.Error(name, "not equal to", "SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER")
+	}
+	if name := x224.FailureCodeName(0x42); name != "0x00000042" {
+		t.Error(name, "not equal to", "0x00000042")
+	}
+}
+
+func TestReasonName(t *testing.T) {
+	if name := x224.ReasonName(x224.REASON_PROTOCOL_ERROR); name != "REASON_PROTOCOL_ERROR" {
+		t.Error(name, "not equal to", "REASON_PROTOCOL_ERROR")
+	}
+	if name := x224.CauseName(0x42); name != "0x42" {
+		t.Error(name, "not equal to", "0x42")
+	}
+}
+
+func TestFileResultWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "x224")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.txt")
+	w := x224.NewFileResultWriter(path)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := w.WriteResult(x224.NegotiationResult{Host: fmt.Sprintf("10.0.0.%d:3389", i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 8 {
+		t.Error(lines, "not equal to", "8 hosts")
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "10.0.0.") || !strings.HasSuffix(line, ":3389") {
+			t.Error(line, "not equal to", "10.0.0.x:3389")
+		}
+	}
+}
+
+func TestCSVResultWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "x224")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.csv")
+	w, err := x224.NewCSVResultWriter(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []x224.NegotiationResult{
+		{Host: "10.0.0.1:3389", Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: x224.PROTOCOL_SSL},
+		// a zone is any interface name, commas included
+		{Host: "[fe80::1%eth,0]:3390", Type: x224.TYPE_RDP_NEG_FAILURE, FailureCode: x224.HYBRID_REQUIRED_BY_SERVER},
+	}
+	for _, result := range results {
+		if err := w.WriteResult(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "host,port,selected_protocol,nla_required,error\n" +
+		"10.0.0.1,3389,PROTOCOL_SSL,,\n" +
+		"\"fe80::1%eth,0\",3390,,true,HYBRID_REQUIRED_BY_SERVER\n"
+	if string(b) != expected {
+		t.Error(string(b), "not equal to", expected)
+	}
+
+	// appended without a second header
+	w, err = x224.NewCSVResultWriter(path, true, x224.CSV_HOST, x224.CSV_PORT, x224.CSV_SELECTED_PROTOCOL, x224.CSV_NLA_REQUIRED, x224.CSV_ERROR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteResult(results[0]); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(path)
+	if string(b) != expected+"10.0.0.1,3389,PROTOCOL_SSL,,\n" {
+		t.Error(string(b), "not equal to", expected, "and a record")
+	}
+
+	// truncated to the header of the columns
+	w, err = x224.NewCSVResultWriter(path, false, x224.CSV_HOST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteResult(results[1]); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadFile(path)
+	if string(b) != "host\n\"fe80::1%eth,0\"\n" {
+		t.Error(string(b), "not equal to", "host\n\"fe80::1%eth,0\"\n")
+	}
+
+	// nla_required of the scans checking the NLA mode
+	w, err = x224.NewCSVResultWriter(path, false, x224.CSV_HOST, x224.CSV_NLA_REQUIRED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []x224.NLAMode{x224.NLA_ENFORCED, x224.NLA_OPTIONAL} {
+		w.WriteResult(x224.NegotiationResult{Host: "10.0.0.2:3389", Type: x224.TYPE_RDP_NEG_RSP,
+			SelectedProtocol: x224.PROTOCOL_HYBRID, NLA: mode})
+	}
+	b, _ = ioutil.ReadFile(path)
+	if string(b) != "host,nla_required\n10.0.0.2,true\n10.0.0.2,false\n" {
+		t.Error(string(b), "not equal to", "host,nla_required\n10.0.0.2,true\n10.0.0.2,false\n")
+	}
+
+	w, err = x224.NewCSVResultWriter(path, false, x224.CSV_HOST, x224.CSV_RESTRICTED_ADMIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteResult(x224.NegotiationResult{Host: "10.0.0.3:3389", Type: x224.TYPE_RDP_NEG_RSP,
+		SelectedProtocol: x224.PROTOCOL_HYBRID, Flags: x224.RESTRICTED_ADMIN_MODE_SUPPORTED})
+	b, _ = ioutil.ReadFile(path)
+	if string(b) != "host,restricted_admin\n10.0.0.3,true\n" {
+		t.Error(string(b), "not equal to", "host,restricted_admin\n10.0.0.3,true\n")
+	}
+
+	// what a scan fingerprinting the server learned besides
+	w, err = x224.NewCSVResultWriter(path, false, x224.CSV_HOST, x224.CSV_PRODUCT_VERSION, x224.CSV_TLS_CN,
+		x224.CSV_NTLM_HOSTNAME, x224.CSV_LATENCY_MS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteResult(x224.NegotiationResult{Host: "10.0.0.4:3389", Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: x224.PROTOCOL_HYBRID,
+		RTT: 1500 * time.Microsecond, TLSCommonName: "srv, inc", NTLMHostname: "srv.example.com", ProductVersion: "10.0.20348"})
+	w.WriteResult(results[0])
+	b, _ = ioutil.ReadFile(path)
+	expected = "host,product_version,tls_cn,ntlm_hostname,latency_ms\n" +
+		"10.0.0.4,10.0.20348,\"srv, inc\",srv.example.com,1.5\n" +
+		"10.0.0.1,,,,\n"
+	if string(b) != expected {
+		t.Error(string(b), "not equal to", expected)
+	}
+
+	if _, err := x224.NewCSVResultWriter(path, true, "rtt"); err == nil {
+		t.Error("unknown column accepted")
+	}
+}
+
+func TestMultiResultWriter(t *testing.T) {
+	first, second := x224.NewMemoryResultWriter(), x224.NewMemoryResultWriter()
+	w := x224.MultiResultWriter(first, second)
+	if err := w.WriteResult(x224.NegotiationResult{Host: "10.0.0.1:3389"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*x224.MemoryResultWriter{first, second} {
+		if _, ok := m.Result("10.0.0.1:3389"); !ok {
+			t.Error("result not written")
+		}
+	}
+}
+
+func TestNLAModeOf(t *testing.T) {
+	response := func(protocol uint32) x224.NegotiationResult {
+		return x224.NegotiationResult{Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: protocol}
+	}
+	failure := func(code uint32) x224.NegotiationResult {
+		return x224.NegotiationResult{Type: x224.TYPE_RDP_NEG_FAILURE, FailureCode: code}
+	}
+	tests := []struct {
+		ssl, hybrid x224.NegotiationResult
+		expected    x224.NLAMode
+	}{
+		{failure(x224.HYBRID_REQUIRED_BY_SERVER), response(x224.PROTOCOL_HYBRID), x224.NLA_ENFORCED},
+		{failure(x224.HYBRID_REQUIRED_BY_SERVER), response(x224.PROTOCOL_HYBRID_EX), x224.NLA_ENFORCED},
+		{response(x224.PROTOCOL_SSL), response(x224.PROTOCOL_HYBRID), x224.NLA_OPTIONAL},
+		{response(x224.PROTOCOL_SSL), response(x224.PROTOCOL_SSL), x224.NLA_NOT_SUPPORTED},
+		{response(x224.PROTOCOL_SSL), failure(x224.SSL_NOT_ALLOWED_BY_SERVER), x224.NLA_NOT_SUPPORTED},
+		{x224.NegotiationResult{}, x224.NegotiationResult{}, x224.NLA_NOT_SUPPORTED},
+		// NLA required without being offered
+		{failure(x224.HYBRID_REQUIRED_BY_SERVER), response(x224.PROTOCOL_SSL), x224.NLA_UNKNOWN},
+		{x224.NegotiationResult{}, response(x224.PROTOCOL_HYBRID), x224.NLA_UNKNOWN},
+	}
+	for _, test := range tests {
+		if mode := x224.NLAModeOf(test.ssl, test.hybrid); mode != test.expected {
+			t.Error(test.ssl, test.hybrid, mode, "not equal to", test.expected)
+		}
+	}
+}
+
+func TestNLAModeColumns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "x224")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.csv")
+	w, err := x224.NewCSVResultWriter(path, false, x224.CSV_HOST, x224.CSV_NLA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := x224.NegotiationResult{Host: "10.0.0.1:3389", Type: x224.TYPE_RDP_NEG_RSP,
+		SelectedProtocol: x224.PROTOCOL_HYBRID, NLA: x224.NLA_OPTIONAL}
+	if err := w.WriteResult(result); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != "host,nla\n10.0.0.1,optional\n" {
+		t.Error(string(b), "not equal to", "host,nla\n10.0.0.1,optional\n")
+	}
+	b, err = json.Marshal(result)
+	if err != nil || !strings.Contains(string(b), `"NLA":"optional"`) {
+		t.Error(string(b), err, "not containing", `"NLA":"optional"`)
+	}
+	var decoded x224.NegotiationResult
+	if err = json.Unmarshal(b, &decoded); err != nil || decoded != result {
+		t.Error(decoded, err, "not equal to", result)
+	}
+	var mode x224.NLAMode
+	if err = mode.UnmarshalText([]byte("enabled")); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
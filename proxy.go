@@ -0,0 +1,110 @@
+package grdp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// how long the proxy has to answer CONNECT, the TCP dial has its own timeout
+var ProxyConnectTimeout = 10 * time.Second
+
+// the proxy answered CONNECT with 407, test with errors.Is
+var ErrProxyAuthRequired = errors.New("proxy authentication required")
+
+/**
+ * CONNECT refused by the HTTP proxy, errors.Is matches
+ * ErrProxyAuthRequired for a 407
+ */
+type ProxyError struct {
+	Proxy      string
+	StatusCode int
+	Status     string
+	// Proxy-Authenticate of a 407, the schemes the proxy accepts
+	Authenticate []string
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s CONNECT: %s", e.Proxy, e.Status)
+}
+
+func (e *ProxyError) Is(target error) bool {
+	return target == ErrProxyAuthRequired && e.StatusCode == http.StatusProxyAuthRequired
+}
+
+// connection whose first reads return what the proxy sent after its response
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+/**
+ * Tunnel to addr through an HTTP proxy reached with dialer, with basic
+ * auth when the proxy URL has a user
+ * @see https://tools.ietf.org/html/rfc7231#section-4.3.6
+ */
+func dialHTTPProxy(ctx context.Context, dialer Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+	if proxy.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+	conn.SetDeadline(time.Now().Add(ProxyConnectTimeout))
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s CONNECT: %w", proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &ProxyError{
+			Proxy:        proxyAddr,
+			StatusCode:   resp.StatusCode,
+			Status:       resp.Status,
+			Authenticate: resp.Header["Proxy-Authenticate"],
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		buffered, _ := br.Peek(br.Buffered())
+		return &bufferedConn{conn, io.MultiReader(bytes.NewReader(buffered), conn)}, nil
+	}
+	return conn, nil
+}
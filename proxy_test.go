@@ -0,0 +1,309 @@
+package grdp_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/protocol/x224"
+)
+
+/**
+ * HTTP proxy answering the first CONNECT with respond, a 200 tunnels to
+ * an echo server. It reports the request it received
+ */
+func startProxy(t *testing.T, respond func(req *http.Request) *http.Response) (*url.URL, <-chan *http.Request) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make(chan *http.Request, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		requests <- req
+		resp := respond(req)
+		resp.Write(conn)
+		if resp.StatusCode == http.StatusOK {
+			io.Copy(conn, br)
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}, requests
+}
+
+func status(code int, header http.Header) *http.Response {
+	return &http.Response{StatusCode: code, ProtoMajor: 1, ProtoMinor: 1, Header: header}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	proxy, requests := startProxy(t, func(req *http.Request) *http.Response {
+		if user, password, ok := parseProxyAuth(req); !ok || user != "scan" || password != "s3cret" {
+			return status(http.StatusProxyAuthRequired, nil)
+		}
+		return status(http.StatusOK, nil)
+	})
+	proxy.User = url.UserPassword("scan", "s3cret")
+	conn, err := grdp.DialHTTPProxy(proxy, "10.0.0.1:3389", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if req := <-requests; req.Method != "CONNECT" || req.Host != "10.0.0.1:3389" {
+		t.Error(req.Method, req.Host, "not equal to", "CONNECT 10.0.0.1:3389")
+	}
+	conn.Write([]byte{3, 0, 0, 4})
+	b := make([]byte, 4)
+	if _, err = io.ReadFull(conn, b); err != nil || b[0] != 3 {
+		t.Error(b, err, "not tunneled")
+	}
+}
+
+func TestHTTPProxyAuthRequired(t *testing.T) {
+	proxy, _ := startProxy(t, func(req *http.Request) *http.Response {
+		return status(http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {`Basic realm="corp"`}})
+	})
+	_, err := grdp.DialHTTPProxy(proxy, "10.0.0.1:3389", time.Second)
+	var proxyErr *grdp.ProxyError
+	if !errors.Is(err, grdp.ErrProxyAuthRequired) || !errors.As(err, &proxyErr) {
+		t.Fatal(err, "not equal to", grdp.ErrProxyAuthRequired)
+	}
+	if len(proxyErr.Authenticate) != 1 || proxyErr.Authenticate[0] != `Basic realm="corp"` {
+		t.Error(proxyErr.Authenticate)
+	}
+}
+
+func TestHTTPProxyRefused(t *testing.T) {
+	proxy, _ := startProxy(t, func(req *http.Request) *http.Response {
+		return status(http.StatusForbidden, nil)
+	})
+	_, err := grdp.DialHTTPProxy(proxy, "10.0.0.1:3389", time.Second)
+	var proxyErr *grdp.ProxyError
+	if !errors.As(err, &proxyErr) || proxyErr.StatusCode != http.StatusForbidden {
+		t.Fatal(err, "not equal to", http.StatusForbidden)
+	}
+	if errors.Is(err, grdp.ErrProxyAuthRequired) {
+		t.Error(err, "is", grdp.ErrProxyAuthRequired)
+	}
+}
+
+func parseProxyAuth(req *http.Request) (string, string, bool) {
+	r := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	return r.BasicAuth()
+}
+
+/**
+ * SOCKS5 proxy authenticating with user and password, it tunnels to the
+ * targets and reports them. Closing the listener stops it
+ */
+func startSOCKS5(t *testing.T, user, password string) (net.Listener, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, user, password, targets)
+		}
+	}()
+	return l, targets
+}
+
+func serveSOCKS5(conn net.Conn, user, password string, targets chan<- string) {
+	defer conn.Close()
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil
+		}
+		return b
+	}
+	greeting := read(2)
+	if greeting == nil || read(int(greeting[1])) == nil {
+		return
+	}
+	conn.Write([]byte{5, 2})
+	auth := read(2)
+	if auth == nil {
+		return
+	}
+	u := read(int(auth[1]))
+	size := read(1)
+	if u == nil || size == nil {
+		return
+	}
+	if p := read(int(size[0])); string(u) != user || string(p) != password {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+	request := read(4)
+	if request == nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		host = net.IP(read(4)).String()
+	case 4:
+		host = net.IP(read(16)).String()
+	case 3:
+		host = string(read(int(read(1)[0])))
+	}
+	port := read(2)
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	targets <- addr
+	target, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		conn.Write([]byte{5, grdp.SOCKS5_CONNECTION_REFUSED, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go func() {
+		io.Copy(target, conn)
+		target.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(conn, target)
+}
+
+func TestSOCKS5Login(t *testing.T) {
+	l, targets := startSOCKS5(t, "scan", "s3cret")
+	defer l.Close()
+	srv, err := rdptest.NewServer(append(sessionScenario, rdptest.ExpectDisconnect(), rdptest.ExpectClose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE, grdp.WithSOCKS5(l.Addr().String(), url.UserPassword("scan", "s3cret")))
+	if err = g.Login("alice", "secret"); err != nil {
+		t.Error(err)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	if target := <-targets; target != srv.Addr() {
+		t.Error(target, "not equal to", srv.Addr())
+	}
+	if session := srv.Sessions()[0]; !session.Disconnected || !session.Closed {
+		t.Error(session.Disconnected, session.Closed, "not equal to", true, true)
+	}
+}
+
+func TestSOCKS5NLA(t *testing.T) {
+	l, _ := startSOCKS5(t, "scan", "s3cret")
+	defer l.Close()
+	srv, err := rdptest.NewServer(nlaScenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE, grdp.WithSOCKS5(l.Addr().String(), url.UserPassword("scan", "s3cret")))
+	info, err := g.FingerprintNLA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NegotiateFlags != 0xe28a8235 {
+		t.Errorf("0x%08x not equal to 0x%08x", info.NegotiateFlags, 0xe28a8235)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSOCKS5Errors(t *testing.T) {
+	l, _ := startSOCKS5(t, "scan", "s3cret")
+	defer l.Close()
+	dialer := &grdp.SOCKS5Dialer{Proxy: l.Addr().String(), Auth: url.UserPassword("scan", "wrong"), Timeout: time.Second}
+	if _, err := dialer.DialContext(context.Background(), "tcp", "10.0.0.1:3389"); !errors.Is(err, grdp.ErrProxyAuthRequired) {
+		t.Error(err, "not equal to", grdp.ErrProxyAuthRequired)
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	dialer.Auth = url.UserPassword("scan", "s3cret")
+	_, err = dialer.DialContext(context.Background(), "tcp", closed.Addr().String())
+	var socksErr *grdp.SOCKS5Error
+	if !errors.As(err, &socksErr) || socksErr.Reply != grdp.SOCKS5_CONNECTION_REFUSED || !errors.Is(err, grdp.ErrConnRefused) {
+		t.Error(err, "not equal to", "connection refused")
+	}
+}
+
+func TestSOCKS5Timeout(t *testing.T) {
+	// accepts and never answers the greeting
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	dialer := &grdp.SOCKS5Dialer{Proxy: l.Addr().String(), Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	if _, err = dialer.DialContext(context.Background(), "tcp", "10.0.0.1:3389"); err != context.DeadlineExceeded {
+		t.Error(err, "not equal to", context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error(d, "not less than", time.Second)
+	}
+}
+
+func TestScanSOCKS5(t *testing.T) {
+	l, targets := startSOCKS5(t, "scan", "s3cret")
+	defer l.Close()
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := grdp.NewScanner()
+	scanner.Dialer = &grdp.SOCKS5Dialer{Proxy: l.Addr().String(), Auth: url.UserPassword("scan", "s3cret")}
+	hosts := make(chan string, 1)
+	hosts <- srv.Addr()
+	close(hosts)
+	for result := range scanner.Scan(context.Background(), hosts, 1) {
+		if result.Err != nil || result.SelectedProtocol() != x224.PROTOCOL_HYBRID {
+			t.Error(result.Err, result.SelectedProtocol(), "not equal to", x224.PROTOCOL_HYBRID)
+		}
+	}
+	if target := <-targets; target != srv.Addr() {
+		t.Error(target, "not equal to", srv.Addr())
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
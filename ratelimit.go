@@ -0,0 +1,120 @@
+package grdp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+ * Spaces the calls to wait by 1/rate seconds, the first one does not
+ * wait. A rate of 0 does not limit
+ */
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64
+	// when the next call may go
+	next time.Time
+}
+
+// the calls already waiting keep their time
+func (l *rateLimiter) setRate(rate float64) {
+	l.mu.Lock()
+	l.rate = rate
+	l.mu.Unlock()
+}
+
+// returns once the call may go, or with ctx.Err() once ctx is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	interval := time.Duration(float64(time.Second) / l.rate)
+	l.next = at.Add(interval)
+	l.mu.Unlock()
+
+	d := at.Sub(now)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		// give the slot back when no call took the next one
+		if l.next.Equal(at.Add(interval)) {
+			l.next = at
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// limiters of a scan, the global one and one per subnet
+type scanLimiter struct {
+	global     rateLimiter
+	mu         sync.Mutex
+	subnetRate float64
+	subnets    map[string]*rateLimiter
+}
+
+func (l *scanLimiter) setSubnetRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subnetRate = rate
+	for _, subnet := range l.subnets {
+		subnet.setRate(rate)
+	}
+}
+
+// nil while the subnets are not limited
+func (l *scanLimiter) subnet(host string) *rateLimiter {
+	key := subnetKey(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.subnetRate <= 0 {
+		return nil
+	}
+	if l.subnets == nil {
+		l.subnets = map[string]*rateLimiter{}
+	}
+	subnet, ok := l.subnets[key]
+	if !ok {
+		subnet = &rateLimiter{rate: l.subnetRate}
+		l.subnets[key] = subnet
+	}
+	return subnet
+}
+
+// waits for the subnet of host then for the global rate
+func (l *scanLimiter) wait(ctx context.Context, host string) error {
+	if subnet := l.subnet(host); subnet != nil {
+		if err := subnet.wait(ctx); err != nil {
+			return err
+		}
+	}
+	return l.global.wait(ctx)
+}
+
+// the /24 of an IPv4 host:port, the host itself otherwise
+func subnetKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		return ip.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return host
+}
@@ -0,0 +1,302 @@
+package grdp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// the checkpoint was saved by a scan of other addresses, or in another order
+	ErrCheckpointMismatch = errors.New("checkpoint of another target list")
+	// a file that is not a checkpoint or was damaged
+	ErrCheckpointCorrupt = errors.New("checkpoint corrupt")
+)
+
+/**
+ * Addresses of targets, see ParseTarget, each once in the order they
+ * first come. With shuffle they are in a random order drawn from seed,
+ * the same targets and seed give the same order
+ */
+func ExpandTargets(targets []string, shuffle bool, seed int64) ([]string, error) {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		expanded, err := ParseTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range expanded {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if shuffle {
+		r := rand.New(rand.NewSource(seed))
+		r.Shuffle(len(addrs), func(i, j int) {
+			addrs[i], addrs[j] = addrs[j], addrs[i]
+		})
+	}
+	return addrs, nil
+}
+
+/**
+ * checkpoint file: magic, version, address count, SHA-256 of the
+ * addresses in their order, the bitset of the probed ones by index then
+ * the CRC-32 of all that: 49 bytes plus 1 per 8 addresses
+ */
+const (
+	checkpointMagic   = "GRDPCKPT"
+	checkpointVersion = 1
+	checkpointHeader  = len(checkpointMagic) + 1 + 4 + sha256.Size
+)
+
+/**
+ * Addresses of a scan that were probed, saved to a file so that the
+ * scan started again skips them, see Scanner.ScanTargets. It belongs to
+ * an address list, the same targets in the same order
+ */
+type Checkpoint struct {
+	path string
+	mu   sync.Mutex
+	// the list of the checkpoint, read from the file or set by bind
+	sum   [sha256.Size]byte
+	count int
+	done  []byte
+	bound bool
+	index map[string]int
+	// of the last Save
+	err error
+}
+
+/**
+ * Checkpoint saved at path, read when the file exists: a scan of the
+ * same list then resumes. The file is only written by Save
+ */
+func OpenCheckpoint(path string) (*Checkpoint, error) {
+	c := &Checkpoint{path: path}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < checkpointHeader+4 || string(b[:len(checkpointMagic)]) != checkpointMagic {
+		return nil, fmt.Errorf("%w: %s", ErrCheckpointCorrupt, path)
+	}
+	body := b[:len(b)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(b[len(b)-4:]) {
+		return nil, fmt.Errorf("%w: %s, bad checksum", ErrCheckpointCorrupt, path)
+	}
+	if version := body[len(checkpointMagic)]; version != checkpointVersion {
+		return nil, fmt.Errorf("%w: %s, version %d", ErrCheckpointCorrupt, path, version)
+	}
+	c.count = int(binary.LittleEndian.Uint32(body[len(checkpointMagic)+1:]))
+	copy(c.sum[:], body[len(checkpointMagic)+5:])
+	c.done = append([]byte{}, body[checkpointHeader:]...)
+	if len(c.done) != (c.count+7)/8 {
+		return nil, fmt.Errorf("%w: %s, %d addresses in %d bytes", ErrCheckpointCorrupt, path, c.count, len(c.done))
+	}
+	c.bound = true
+	return c, nil
+}
+
+func addrsSum(addrs []string) [sha256.Size]byte {
+	h := sha256.New()
+	for _, addr := range addrs {
+		h.Write([]byte(addr))
+		h.Write([]byte{0})
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// the checkpoint is of addrs, ErrCheckpointMismatch when it was read for another list
+func (c *Checkpoint) bind(addrs []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sum := addrsSum(addrs)
+	if c.bound && (sum != c.sum || c.count != len(addrs)) {
+		return ErrCheckpointMismatch
+	}
+	if !c.bound {
+		c.sum, c.count, c.bound = sum, len(addrs), true
+		c.done = make([]byte, (len(addrs)+7)/8)
+	}
+	c.index = make(map[string]int, len(addrs))
+	for i, addr := range addrs {
+		c.index[addr] = i
+	}
+	return nil
+}
+
+// addr was probed, false for an address of another list
+func (c *Checkpoint) Done(addr string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.index[addr]
+	return ok && c.done[i/8]&(1<<uint(i%8)) != 0
+}
+
+func (c *Checkpoint) markDone(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i, ok := c.index[addr]; ok {
+		c.done[i/8] |= 1 << uint(i%8)
+	}
+}
+
+// addresses probed so far
+func (c *Checkpoint) Completed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, b := range c.done {
+		for ; b != 0; b &= b - 1 {
+			n++
+		}
+	}
+	return n
+}
+
+/**
+ * Write the checkpoint to a temporary file next to path then rename it,
+ * a crash while saving leaves the previous checkpoint. Nothing is
+ * written before the checkpoint is given its list
+ */
+func (c *Checkpoint) Save() error {
+	err := c.save()
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+	return err
+}
+
+// error of the last Save, those of ScanTargets included
+func (c *Checkpoint) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Checkpoint) save() error {
+	c.mu.Lock()
+	if !c.bound {
+		c.mu.Unlock()
+		return nil
+	}
+	buff := &bytes.Buffer{}
+	buff.WriteString(checkpointMagic)
+	buff.WriteByte(checkpointVersion)
+	binary.Write(buff, binary.LittleEndian, uint32(c.count))
+	buff.Write(c.sum[:])
+	buff.Write(c.done)
+	c.mu.Unlock()
+	binary.Write(buff, binary.LittleEndian, crc32.ChecksumIEEE(buff.Bytes()))
+
+	f, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buff.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// between two saves of Scanner.Checkpoint when CheckpointInterval is 0
+var DefaultCheckpointInterval = 5 * time.Second
+
+/**
+ * Scan the addresses of targets, see ExpandTargets, in a random order
+ * drawn from Seed with Shuffle. With a Checkpoint the addresses it has
+ * are skipped, the others are added once their result is read from
+ * the channel and it is saved every CheckpointInterval and once the
+ * scan ended. A scan cancelled through ctx or by Stop then resumes
+ * where it stopped, a crash probes again the results of the last
+ * interval. The error is that of a target that does not parse or of a
+ * checkpoint of another list
+ */
+func (s *Scanner) ScanTargets(ctx context.Context, targets []string, concurrency int) (<-chan ScanResult, error) {
+	addrs, err := ExpandTargets(targets, s.Shuffle, s.Seed)
+	if err != nil {
+		return nil, err
+	}
+	c := s.Checkpoint
+	if c == nil {
+		c = &Checkpoint{}
+	}
+	if err = c.bind(addrs); err != nil {
+		return nil, err
+	}
+	hosts := make(chan string, len(addrs))
+	for _, addr := range addrs {
+		if !c.Done(addr) {
+			hosts <- addr
+		}
+	}
+	close(hosts)
+	scanned := s.Scan(ctx, hosts, concurrency)
+	if s.Checkpoint == nil {
+		return scanned, nil
+	}
+
+	interval := s.CheckpointInterval
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+	results := make(chan ScanResult)
+	go func() {
+		defer close(results)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer c.Save()
+		for {
+			select {
+			case <-ticker.C:
+				c.Save()
+			case result, ok := <-scanned:
+				if !ok {
+					return
+				}
+				select {
+				case results <- result:
+					// a probe stopped by the cancelled scan, or aborted by Stop, is not done
+					if !errors.Is(result.Err, context.Canceled) && (ctx.Err() == nil || !errors.Is(result.Err, ctx.Err())) {
+						c.markDone(result.Host)
+					}
+				case <-ctx.Done():
+					// the scan stops, the results left are not read
+					for range scanned {
+					}
+					return
+				}
+			}
+		}
+	}()
+	return results, nil
+}
@@ -0,0 +1,195 @@
+package grdp_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp"
+)
+
+func TestExpandTargets(t *testing.T) {
+	addrs, err := grdp.ExpandTargets([]string{"10.0.0.1", "10.0.0.2:3389-3390", "10.0.0.1:3389"}, false, 0)
+	expected := []string{"10.0.0.1:3389", "10.0.0.2:3389", "10.0.0.2:3390"}
+	if err != nil || !reflect.DeepEqual(addrs, expected) {
+		t.Error(addrs, err, "not equal to", expected)
+	}
+	if _, err = grdp.ExpandTargets([]string{"10.0.0.1", "10.0.0.2:0"}, false, 0); err == nil {
+		t.Error("bad port accepted")
+	}
+
+	targets := []string{"10.0.0.1:1-100"}
+	ordered, _ := grdp.ExpandTargets(targets, false, 0)
+	first, _ := grdp.ExpandTargets(targets, true, 42)
+	again, _ := grdp.ExpandTargets(targets, true, 42)
+	other, _ := grdp.ExpandTargets(targets, true, 43)
+	if !reflect.DeepEqual(first, again) {
+		t.Error(first, "not equal to", again)
+	}
+	if reflect.DeepEqual(first, ordered) || reflect.DeepEqual(first, other) {
+		t.Error(first, "not shuffled by its seed")
+	}
+	sorted := append([]string{}, first...)
+	sort.Strings(sorted)
+	sort.Strings(ordered)
+	if !reflect.DeepEqual(sorted, ordered) {
+		t.Error(sorted, "not equal to", ordered)
+	}
+}
+
+// hosts dialed by a scan, each dial fails after a millisecond
+type dialRecorder struct {
+	mu     sync.Mutex
+	dialed map[string]int
+}
+
+func (r *dialRecorder) dialer() grdp.Dialer {
+	return grdp.DialFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		r.mu.Lock()
+		r.dialed[addr]++
+		r.mu.Unlock()
+		time.Sleep(time.Millisecond)
+		return nil, errors.New("unreachable")
+	})
+}
+
+func tempCheckpoint(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "grdp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "scan.ckpt"), func() { os.RemoveAll(dir) }
+}
+
+func TestScanTargetsResume(t *testing.T) {
+	path, remove := tempCheckpoint(t)
+	defer remove()
+	var targets []string
+	for i := 1; i <= 40; i++ {
+		targets = append(targets, fmt.Sprintf("10.0.0.%d", i))
+	}
+	completed := map[string]int{}
+	scan := func(stopAfter int) map[string]int {
+		checkpoint, err := grdp.OpenCheckpoint(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &dialRecorder{dialed: map[string]int{}}
+		scanner := grdp.NewScanner()
+		scanner.Dialer = r.dialer()
+		scanner.Shuffle = true
+		scanner.Seed = 7
+		scanner.Checkpoint = checkpoint
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		results, err := scanner.ScanTargets(ctx, targets, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for result := range results {
+			if result.Err == context.Canceled {
+				continue
+			}
+			completed[result.Host]++
+			if n++; n == stopAfter {
+				// the scan is stopped halfway
+				cancel()
+			}
+		}
+		return r.dialed
+	}
+
+	scan(15)
+	first := map[string]bool{}
+	for host := range completed {
+		first[host] = true
+	}
+	if len(first) < 15 || len(first) == len(targets) {
+		t.Fatal(len(first), "probes before the stop")
+	}
+	dialed := scan(0)
+	for host := range dialed {
+		if first[host] {
+			t.Error(host, "probed again")
+		}
+	}
+	if len(completed) != len(targets) {
+		t.Error(len(completed), "targets probed, not", len(targets))
+	}
+	for host, n := range completed {
+		if n != 1 {
+			t.Error(host, "probed", n, "times")
+		}
+	}
+	checkpoint, err := grdp.OpenCheckpoint(path)
+	if err != nil || checkpoint.Completed() != len(targets) {
+		t.Error(err, "not all completed")
+	}
+}
+
+func TestCheckpointMismatch(t *testing.T) {
+	path, remove := tempCheckpoint(t)
+	defer remove()
+	checkpoint, _ := grdp.OpenCheckpoint(path)
+	scanner := grdp.NewScanner()
+	scanner.Dialer = (&dialRecorder{dialed: map[string]int{}}).dialer()
+	scanner.Shuffle = true
+	scanner.Checkpoint = checkpoint
+	results, err := scanner.ScanTargets(context.Background(), []string{"10.0.0.1:1-10"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range results {
+	}
+	// another seed is another order
+	if scanner.Checkpoint, err = grdp.OpenCheckpoint(path); err != nil {
+		t.Fatal(err)
+	}
+	scanner.Seed = 1
+	if _, err = scanner.ScanTargets(context.Background(), []string{"10.0.0.1:1-10"}, 2); err != grdp.ErrCheckpointMismatch {
+		t.Error(err, "not equal to", grdp.ErrCheckpointMismatch)
+	}
+}
+
+func TestCheckpointCorrupt(t *testing.T) {
+	path, remove := tempCheckpoint(t)
+	defer remove()
+	checkpoint, _ := grdp.OpenCheckpoint(path)
+	scanner := grdp.NewScanner()
+	scanner.Dialer = (&dialRecorder{dialed: map[string]int{}}).dialer()
+	scanner.Checkpoint = checkpoint
+	results, err := scanner.ScanTargets(context.Background(), []string{"10.0.0.1:1-20"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range results {
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 45 bytes of header, 3 of bitset and the checksum
+	if len(b) != 45+3+4 {
+		t.Error(len(b), "not equal to", 45+3+4)
+	}
+	flipped := append([]byte{}, b...)
+	flipped[46] ^= 1
+	for _, damaged := range [][]byte{b[:len(b)-1], b[:10], flipped, []byte("not a checkpoint")} {
+		if err = ioutil.WriteFile(path, damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = grdp.OpenCheckpoint(path); !errors.Is(err, grdp.ErrCheckpointCorrupt) {
+			t.Error(err, "not equal to", grdp.ErrCheckpointCorrupt)
+		}
+	}
+}
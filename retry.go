@@ -0,0 +1,79 @@
+package grdp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+/**
+ * Retry of the probes that failed for a transient reason, a dial
+ * timeout or a connection reset before the confirm. The answers of a
+ * server, a negotiation failure or a refused connection unless
+ * RetryRefused, are not retried. The zero value does not retry
+ */
+type RetryPolicy struct {
+	// attempts of a host, first one included, 1 or less does not retry
+	MaxAttempts int
+	// wait before the second attempt
+	InitialBackoff time.Duration
+	// factor of the wait between two attempts, below 1 it is 1
+	Multiplier float64
+	// fraction of the wait drawn at random, 0.2 for ±20%
+	Jitter float64
+	// the port may only be closed for a while, a restarting server
+	RetryRefused bool
+}
+
+// wait before attempt n, 2 for the first retry
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 2; i < n && p.Multiplier > 1; i++ {
+		d *= p.Multiplier
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+/**
+ * The probe of result may succeed when tried again: its dial timed out,
+ * the connection was reset before the confirm, or it was refused and
+ * retryRefused. err is the error of Probe, context.DeadlineExceeded is
+ * the timeout of the attempt, the caller checks its own context before
+ */
+func retryable(result ProbeResult, err error, retryRefused bool) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return !result.Connected
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return retryRefused
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ETIMEDOUT) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial" && opErr.Timeout()
+	}
+	return false
+}
+
+// waits d, or returns ctx.Err() once ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,414 @@
+package grdp
+
+import (
+	"context"
+	"fmt"
+	"github.com/icodeface/grdp/protocol/x224"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// port of the targets that name none
+const DefaultPort = 3389
+
+/**
+ * Addresses of a scan target, "host", "host:3389,3390" or a range
+ * "host:13389-13391". An IPv6 host with ports is in brackets,
+ * "[fe80::1]:3389"
+ */
+func ParseTarget(target string) ([]string, error) {
+	host, ports := target, ""
+	if strings.HasPrefix(target, "[") {
+		end := strings.Index(target, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("target %q: missing ]", target)
+		}
+		host, ports = target[1:end], target[end+1:]
+	} else if strings.Count(target, ":") == 1 {
+		i := strings.Index(target, ":")
+		host, ports = target[:i], target[i:]
+	}
+	if host == "" {
+		return nil, fmt.Errorf("target %q: no host", target)
+	}
+	if ports == "" {
+		return []string{net.JoinHostPort(host, strconv.Itoa(DefaultPort))}, nil
+	}
+	if !strings.HasPrefix(ports, ":") {
+		return nil, fmt.Errorf("target %q: bad port list", target)
+	}
+	ports = ports[1:]
+	var addrs []string
+	for _, item := range strings.Split(ports, ",") {
+		first, last := item, item
+		if i := strings.Index(item, "-"); i >= 0 {
+			first, last = item[:i], item[i+1:]
+		}
+		from, err := parsePort(first)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %v", target, err)
+		}
+		to, err := parsePort(last)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %v", target, err)
+		}
+		if from > to {
+			return nil, fmt.Errorf("target %q: bad port range %s", target, item)
+		}
+		for port := from; port <= to; port++ {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	return addrs, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("bad port %q", s)
+	}
+	return port, nil
+}
+
+/**
+ * Probes many hosts concurrently, see Probe. Its fields are read by
+ * Scan, set them before, the rates may be changed while scanning
+ */
+type Scanner struct {
+	// offered in each connection request
+	Protocols uint32
+	// NEGOTIATE_DOWNGRADE offers DowngradeProtocols in turn instead of Protocols
+	Strategy NegotiationStrategy
+	// x224.RESTRICTED_ADMIN_MODE_REQUIRED... of each connection request,
+	// see ProbeResult.RestrictedAdmin
+	NegotiationFlags uint8
+	// "Cookie: mstshash=" user name, or routing token of a connection
+	// broker, of each connection request: a load balancer routes on it,
+	// see x224.RequestCookie
+	Cookie       string
+	RoutingToken []byte
+	// for each host, dial included
+	Timeout time.Duration
+	// records the hosts that answered with a negotiation, may be nil
+	Results x224.ResultWriter
+	// of the probes that failed for a transient reason
+	Retry RetryPolicy
+	// opens the connections, through a proxy or a pivot, nil for direct ones
+	Dialer Dialer
+	// start TLS with the servers that pick NLA and read their NTLM
+	// CHALLENGE, it names the machine and its domain without credentials
+	FingerprintNLA bool
+	// probe the servers that answered with a negotiation twice more to
+	// tell whether they enforce NLA, see CheckNLA. Written in
+	// Negotiation.NLA so that Results records it
+	CheckNLA bool
+	// ScanTargets probes the addresses in a random order drawn from
+	// Seed, the same targets and Seed give the same order
+	Shuffle bool
+	Seed    int64
+	// addresses ScanTargets skips then adds those it probes to, may be nil
+	Checkpoint *Checkpoint
+	// between two saves of Checkpoint, DefaultCheckpointInterval when 0
+	CheckpointInterval time.Duration
+	// the probes, their connections and failures, may be nil
+	Metrics Metrics
+	// called with the state of the scan, from a single goroutine, may be nil
+	Progress func(ScanProgress)
+	// between two Progress calls, DefaultProgressInterval when 0
+	ProgressInterval time.Duration
+	// Stop waits for the probes in flight before it aborts them,
+	// DefaultStopTimeout when 0
+	StopTimeout time.Duration
+	limiter     scanLimiter
+	stats       scanStats
+	control     scanControl
+}
+
+/**
+ * Probes started per second by the scans, 0 for no limit. It may be
+ * changed while scanning, the probes already waiting keep their time
+ */
+func (s *Scanner) SetRate(perSecond float64) {
+	s.limiter.global.setRate(perSecond)
+}
+
+/**
+ * Probes started per second in each IPv4 /24, or on each other host,
+ * 0 for no limit. It may be changed while scanning
+ */
+func (s *Scanner) SetSubnetRate(perSecond float64) {
+	s.limiter.setSubnetRate(perSecond)
+}
+
+var DefaultProgressInterval = time.Second
+
+/**
+ * State of a scan given to Scanner.Progress. Total counts the addresses
+ * read so far, it is final once the targets are all read. The last call
+ * is made once the scan ended
+ */
+type ScanProgress struct {
+	Total     int
+	Completed int
+	InFlight  int
+	// probes with a result without Err, Failed the others
+	Succeeded int
+	Failed    int
+	// for the addresses read so far, from the average probe duration
+	ETA time.Duration
+}
+
+// moving average weight of the last probe duration
+const progressAlpha = 0.1
+
+// counters of a scan, updated by its goroutines
+type scanProgress struct {
+	mu          sync.Mutex
+	state       ScanProgress
+	average     time.Duration
+	concurrency int
+}
+
+func (p *scanProgress) add(n int) {
+	p.mu.Lock()
+	p.state.Total += n
+	p.mu.Unlock()
+}
+
+func (p *scanProgress) start() {
+	p.mu.Lock()
+	p.state.InFlight++
+	p.mu.Unlock()
+}
+
+func (p *scanProgress) end(err error, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.InFlight--
+	p.state.Completed++
+	if err == nil {
+		p.state.Succeeded++
+	} else {
+		p.state.Failed++
+	}
+	if p.average == 0 {
+		p.average = d
+	} else {
+		p.average += time.Duration(progressAlpha * float64(d-p.average))
+	}
+}
+
+func (p *scanProgress) snapshot() ScanProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := p.state
+	// the probes left run concurrency at a time
+	rounds := (state.Total - state.Completed + p.concurrency - 1) / p.concurrency
+	state.ETA = time.Duration(rounds) * p.average
+	return state
+}
+
+// calls fn every interval until stop is closed, then a last time
+func (p *scanProgress) report(fn func(ScanProgress), interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fn(p.snapshot())
+		case <-stop:
+			fn(p.snapshot())
+			return
+		}
+	}
+}
+
+// scanner offering SSL and HYBRID, with ProbeTimeout for each host
+func NewScanner() *Scanner {
+	return &Scanner{
+		Protocols: x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID,
+		Timeout:   ProbeTimeout,
+	}
+}
+
+/**
+ * Probe of a host, Err is set when it did not answer the connection
+ * request or when Scanner.Results failed to record its answer
+ */
+type ScanResult struct {
+	ProbeResult
+	Err error
+	// probes of the host, more than 1 when retried, see Scanner.Retry
+	Attempts int
+}
+
+/**
+ * Probe the targets read from hosts, see ParseTarget, with at most
+ * concurrency probes at a time. Each port of a target has its result,
+ * a target that does not parse has one with Err. Results come in the
+ * order the probes end, the channel is closed once hosts is closed and
+ * its probes ended, or once ctx is done or Stop was called, after the
+ * last Progress call.
+ * The results must be read, or ctx cancelled, for the probes to go on
+ */
+func (s *Scanner) Scan(ctx context.Context, hosts <-chan string, concurrency int) <-chan ScanResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make(chan ScanResult)
+	addrs := make(chan string)
+	progress := &scanProgress{concurrency: concurrency}
+	ctx, cancel := context.WithCancel(ctx)
+	handle, stopping := s.control.start(cancel)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(addrs)
+		for {
+			var target string
+			var ok bool
+			select {
+			case <-stopping:
+				return
+			default:
+			}
+			select {
+			case target, ok = <-hosts:
+			case <-ctx.Done():
+				return
+			case <-stopping:
+				return
+			}
+			if !ok {
+				return
+			}
+			expanded, err := ParseTarget(target)
+			if err != nil {
+				progress.add(1)
+				progress.end(err, 0)
+				result := ScanResult{ProbeResult{Host: target}, err, 0}
+				s.stats.add(result)
+				select {
+				case results <- result:
+				case <-ctx.Done():
+					return
+				}
+			}
+			progress.add(len(expanded))
+			for _, addr := range expanded {
+				select {
+				case addrs <- addr:
+				case <-ctx.Done():
+					return
+				case <-stopping:
+					return
+				}
+			}
+		}
+	}()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var host string
+				var ok bool
+				select {
+				case host, ok = <-addrs:
+				case <-ctx.Done():
+					return
+				}
+				if !ok {
+					return
+				}
+				if s.limiter.wait(ctx, host) != nil {
+					return
+				}
+				select {
+				case <-stopping:
+					return
+				default:
+				}
+				progress.start()
+				start := time.Now()
+				result := s.probe(ctx, host)
+				progress.end(result.Err, time.Since(start))
+				if s.Metrics != nil {
+					s.Metrics.ProbeDone(probeOutcome(result))
+				}
+				s.stats.add(result)
+				select {
+				case results <- result:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	stop := make(chan struct{})
+	reported := make(chan struct{})
+	if s.Progress != nil {
+		interval := s.ProgressInterval
+		if interval <= 0 {
+			interval = DefaultProgressInterval
+		}
+		go func() {
+			defer close(reported)
+			progress.report(s.Progress, interval, stop)
+		}()
+	} else {
+		close(reported)
+	}
+	go func() {
+		wg.Wait()
+		close(stop)
+		<-reported
+		close(results)
+		s.control.end(handle)
+		cancel()
+	}()
+	return results
+}
+
+// probes host, its rate limit was waited for
+func (s *Scanner) probe(ctx context.Context, host string) ScanResult {
+	for attempt := 1; ; attempt++ {
+		result, err := s.attempt(ctx, host)
+		if ctx.Err() != nil || attempt >= s.Retry.MaxAttempts || !retryable(result, err, s.Retry.RetryRefused) {
+			if err == nil && result.Negotiated && s.Results != nil {
+				err = s.Results.WriteResult(result.record())
+			}
+			return ScanResult{result, err, attempt}
+		}
+		if err := sleepContext(ctx, s.Retry.backoff(attempt+1)); err != nil {
+			return ScanResult{result, err, attempt}
+		}
+		if err := s.limiter.wait(ctx, host); err != nil {
+			return ScanResult{result, err, attempt}
+		}
+	}
+}
+
+func (s *Scanner) attempt(ctx context.Context, host string) (ProbeResult, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	cookie := x224.RequestCookie(s.Cookie, s.RoutingToken)
+	var result ProbeResult
+	var err error
+	if s.Strategy == NEGOTIATE_DOWNGRADE {
+		result, err = probeDowngrade(ctx, s.Dialer, host, s.NegotiationFlags, cookie, s.FingerprintNLA, s.Metrics)
+	} else {
+		result, err = probe(ctx, s.Dialer, host, s.Protocols, s.NegotiationFlags, cookie, s.FingerprintNLA, s.Metrics)
+	}
+	if err == nil && s.CheckNLA && result.Negotiated {
+		result.Negotiation.NLA, result.CheckNLAErr = checkNLA(ctx, s.Dialer, host, cookie, s.Metrics)
+	}
+	return result, err
+}
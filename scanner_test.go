@@ -0,0 +1,539 @@
+package grdp_test
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp"
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/protocol/x224"
+)
+
+func TestScan(t *testing.T) {
+	scenarios := make([][]rdptest.Step, 20)
+	for i := range scenarios {
+		scenarios[i] = []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+			rdptest.ExpectClose(),
+		}
+	}
+	srv, err := rdptest.NewServer(scenarios...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := l.Addr().String()
+	l.Close()
+
+	hosts := make(chan string)
+	go func() {
+		defer close(hosts)
+		for i := 0; i < 30; i++ {
+			if i%3 == 2 {
+				hosts <- refused
+			} else {
+				hosts <- srv.Addr()
+			}
+		}
+	}()
+	scanner := grdp.NewScanner()
+	results := x224.NewMemoryResultWriter()
+	scanner.Results = results
+	counts := map[string]int{}
+	for result := range scanner.Scan(context.Background(), hosts, 4) {
+		switch {
+		case result.Host == refused && result.Err != nil:
+			counts[refused]++
+		case result.Host == srv.Addr() && result.Err == nil && result.SelectedProtocol() == x224.PROTOCOL_HYBRID:
+			counts[srv.Addr()]++
+		default:
+			t.Error(result, "not expected")
+		}
+	}
+	if counts[srv.Addr()] != 20 || counts[refused] != 10 {
+		t.Error(counts, "not equal to", 20, 10)
+	}
+	if n := len(results.Results()); n != 20 {
+		t.Error(n, "not equal to", 20)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScanCancel(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	scenarios := make([][]rdptest.Step, 4)
+	for i := range scenarios {
+		scenarios[i] = []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			// the server never confirms
+			rdptest.ExpectClose(),
+		}
+	}
+	srv, err := rdptest.NewServer(scenarios...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// never closed, the scan ends with ctx
+	hosts := make(chan string, len(scenarios))
+	for range scenarios {
+		hosts <- srv.Addr()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	results := grdp.NewScanner().Scan(ctx, hosts, len(scenarios))
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	for result := range results {
+		if result.Err != context.Canceled {
+			t.Error(result.Err, "not equal to", context.Canceled)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error(d, "longer than", time.Second)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Error(n, "goroutines left, expected", goroutines)
+	}
+}
+
+func TestScanTimeout(t *testing.T) {
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := make(chan string, 1)
+	hosts <- srv.Addr()
+	close(hosts)
+	scanner := grdp.NewScanner()
+	scanner.Timeout = 50 * time.Millisecond
+	for result := range scanner.Scan(context.Background(), hosts, 1) {
+		if result.Err != context.DeadlineExceeded {
+			t.Error(result.Err, "not equal to", context.DeadlineExceeded)
+		}
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	for _, c := range []struct {
+		target string
+		addrs  []string
+	}{
+		{"10.0.0.1", []string{"10.0.0.1:3389"}},
+		{"10.0.0.1:3390", []string{"10.0.0.1:3390"}},
+		{"host:3389,3390,13389", []string{"host:3389", "host:3390", "host:13389"}},
+		{"host:13389-13391,3389", []string{"host:13389", "host:13390", "host:13391", "host:3389"}},
+		{"fe80::1", []string{"[fe80::1]:3389"}},
+		{"[fe80::1]:3389,3390", []string{"[fe80::1]:3389", "[fe80::1]:3390"}},
+	} {
+		addrs, err := grdp.ParseTarget(c.target)
+		if err != nil {
+			t.Error(c.target, err)
+			continue
+		}
+		if !reflect.DeepEqual(addrs, c.addrs) {
+			t.Error(addrs, "not equal to", c.addrs)
+		}
+	}
+	for _, target := range []string{"", ":3389", "host:", "host:0", "host:65536", "host:3390-3389", "host:33a", "[fe80::1", "[fe80::1]3389"} {
+		if _, err := grdp.ParseTarget(target); err == nil {
+			t.Error(target, "parsed")
+		}
+	}
+}
+
+func TestScanPorts(t *testing.T) {
+	var srvs []*rdptest.Server
+	var ports []string
+	for _, protocol := range []uint32{x224.PROTOCOL_SSL, x224.PROTOCOL_HYBRID} {
+		srv, err := rdptest.NewServer([]rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.NegotiationResponse(protocol),
+			rdptest.ExpectClose(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(srv.Addr())
+		srvs = append(srvs, srv)
+		ports = append(ports, port)
+	}
+
+	hosts := make(chan string, 1)
+	hosts <- "127.0.0.1:" + strings.Join(ports, ",")
+	close(hosts)
+	scanner := grdp.NewScanner()
+	results := x224.NewMemoryResultWriter()
+	scanner.Results = results
+	selected := map[string]uint32{}
+	for result := range scanner.Scan(context.Background(), hosts, 2) {
+		if result.Err != nil {
+			t.Fatal(result.Host, result.Err)
+		}
+		if strconv.Itoa(result.Port) != result.Host[len("127.0.0.1:"):] {
+			t.Error(result.Port, "not the port of", result.Host)
+		}
+		selected[result.Host] = result.SelectedProtocol()
+	}
+	for i, protocol := range []uint32{x224.PROTOCOL_SSL, x224.PROTOCOL_HYBRID} {
+		addr := srvs[i].Addr()
+		if selected[addr] != protocol {
+			t.Error(addr, selected[addr], "not equal to", protocol)
+		}
+		result, ok := results.Result(addr)
+		if !ok || result.SelectedProtocol != protocol {
+			t.Error(addr, result, "not equal to", protocol)
+		}
+		if err := srvs[i].Wait(); err != nil {
+			t.Error(err)
+		}
+	}
+	if n := len(results.Results()); n != 2 {
+		t.Error(n, "not equal to", 2)
+	}
+}
+
+func TestScanProgress(t *testing.T) {
+	scenarios := make([][]rdptest.Step, 6)
+	for i := range scenarios {
+		scenarios[i] = []rdptest.Step{
+			rdptest.ReadConnectionRequest(),
+			rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+			rdptest.ExpectClose(),
+		}
+	}
+	srv, err := rdptest.NewServer(scenarios...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := l.Addr().String()
+	l.Close()
+
+	hosts := make(chan string)
+	go func() {
+		defer close(hosts)
+		for i := 0; i < 9; i++ {
+			if i%3 == 2 {
+				hosts <- refused
+			} else {
+				hosts <- srv.Addr()
+			}
+		}
+	}()
+	scanner := grdp.NewScanner()
+	scanner.ProgressInterval = time.Millisecond
+	// only called from one goroutine, read once the results are closed
+	var reports []grdp.ScanProgress
+	scanner.Progress = func(p grdp.ScanProgress) {
+		reports = append(reports, p)
+	}
+	for range scanner.Scan(context.Background(), hosts, 3) {
+	}
+	if len(reports) == 0 {
+		t.Fatal("no progress reported")
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i].Completed < reports[i-1].Completed {
+			t.Error(reports[i].Completed, "not greater or equal to", reports[i-1].Completed)
+		}
+	}
+	last := reports[len(reports)-1]
+	expected := grdp.ScanProgress{Total: 9, Completed: 9, Succeeded: 6, Failed: 3}
+	if last != expected {
+		t.Error(last, "not equal to", expected)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+}
+
+// n addresses of host on a port nothing listens on
+func refusedHosts(t *testing.T, host string, n int) []string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	hosts := make([]string, n)
+	for i := range hosts {
+		hosts[i] = net.JoinHostPort(host, port)
+	}
+	return hosts
+}
+
+func scanAll(ctx context.Context, scanner *grdp.Scanner, targets []string, concurrency int) int {
+	hosts := make(chan string, len(targets))
+	for _, target := range targets {
+		hosts <- target
+	}
+	close(hosts)
+	n := 0
+	for range scanner.Scan(ctx, hosts, concurrency) {
+		n++
+	}
+	return n
+}
+
+func TestScanRate(t *testing.T) {
+	scanner := grdp.NewScanner()
+	scanner.SetRate(100)
+	start := time.Now()
+	if n := scanAll(context.Background(), scanner, refusedHosts(t, "127.0.0.1", 20), 8); n != 20 {
+		t.Error(n, "not equal to", 20)
+	}
+	// the first probe does not wait
+	if d := time.Since(start); d < 190*time.Millisecond || d > time.Second {
+		t.Error(d, "not about", 190*time.Millisecond)
+	}
+
+	scanner.SetRate(0)
+	start = time.Now()
+	scanAll(context.Background(), scanner, refusedHosts(t, "127.0.0.1", 20), 8)
+	if d := time.Since(start); d > 150*time.Millisecond {
+		t.Error(d, "not less than", 150*time.Millisecond)
+	}
+}
+
+func TestScanSubnetRate(t *testing.T) {
+	scanner := grdp.NewScanner()
+	scanner.SetSubnetRate(100)
+	// two /24 of the loopback, limited independently
+	targets := append(refusedHosts(t, "127.0.0.1", 30), refusedHosts(t, "127.0.1.1", 30)...)
+	start := time.Now()
+	if n := scanAll(context.Background(), scanner, targets, 16); n != 60 {
+		t.Error(n, "not equal to", 60)
+	}
+	if d := time.Since(start); d < 290*time.Millisecond || d > 500*time.Millisecond {
+		t.Error(d, "not about", 290*time.Millisecond)
+	}
+}
+
+func TestScanRateCancel(t *testing.T) {
+	scanner := grdp.NewScanner()
+	scanner.SetRate(0.1)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	// the second probe would wait 10s
+	scanAll(ctx, scanner, refusedHosts(t, "127.0.0.1", 2), 2)
+	if d := time.Since(start); d > time.Second {
+		t.Error(d, "not less than", time.Second)
+	}
+}
+
+// net.Error of a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryable(t *testing.T) {
+	syscallErr := func(op string, errno syscall.Errno) error {
+		return &net.OpError{Op: op, Net: "tcp", Err: &os.SyscallError{Syscall: op, Err: errno}}
+	}
+	connected := grdp.ProbeResult{Connected: true}
+	tests := []struct {
+		name         string
+		result       grdp.ProbeResult
+		err          error
+		retryRefused bool
+		expected     bool
+	}{
+		{"nil", connected, nil, false, false},
+		{"dial timeout", grdp.ProbeResult{}, fmt.Errorf("[dial err] %w", &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}), false, true},
+		{"dial ETIMEDOUT", grdp.ProbeResult{}, fmt.Errorf("[dial err] %w", syscallErr("connect", syscall.ETIMEDOUT)), false, true},
+		{"attempt deadline", grdp.ProbeResult{}, context.DeadlineExceeded, false, true},
+		{"confirm deadline", connected, context.DeadlineExceeded, false, false},
+		{"read timeout", connected, fmt.Errorf("[x224 probe err] %w", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}), false, false},
+		{"read reset", connected, fmt.Errorf("[x224 probe err] %w", syscallErr("read", syscall.ECONNRESET)), false, true},
+		{"refused", grdp.ProbeResult{}, fmt.Errorf("[dial err] %w", syscallErr("connect", syscall.ECONNREFUSED)), false, false},
+		{"refused retried", grdp.ProbeResult{}, fmt.Errorf("[dial err] %w", syscallErr("connect", syscall.ECONNREFUSED)), true, true},
+		{"unreachable", grdp.ProbeResult{}, fmt.Errorf("[dial err] %w", syscallErr("connect", syscall.EHOSTUNREACH)), true, false},
+		{"eof", connected, fmt.Errorf("[x224 probe err] %w", io.EOF), false, false},
+		{"negotiation failure", connected, &x224.NegotiationFailureError{Code: x224.HYBRID_REQUIRED_BY_SERVER}, true, false},
+	}
+	for _, tt := range tests {
+		if retryable := grdp.Retryable(tt.result, tt.err, tt.retryRefused); retryable != tt.expected {
+			t.Error(tt.name, retryable, "not equal to", tt.expected)
+		}
+	}
+}
+
+func TestScanRetry(t *testing.T) {
+	// reset once, answered the second time
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.Reset(),
+	}, []rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := grdp.NewScanner()
+	scanner.Retry = grdp.RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, Multiplier: 2, Jitter: 0.2}
+	hosts := make(chan string, 1)
+	hosts <- srv.Addr()
+	close(hosts)
+	for result := range scanner.Scan(context.Background(), hosts, 1) {
+		if result.Err != nil || result.SelectedProtocol() != x224.PROTOCOL_SSL {
+			t.Error(result.Err, result.SelectedProtocol(), "not equal to", x224.PROTOCOL_SSL)
+		}
+		if result.Attempts != 2 {
+			t.Error(result.Attempts, "not equal to", 2)
+		}
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+
+	for _, retryRefused := range []bool{false, true} {
+		scanner.Retry.RetryRefused = retryRefused
+		hosts := make(chan string, 1)
+		hosts <- refusedHosts(t, "127.0.0.1", 1)[0]
+		close(hosts)
+		expected := 1
+		if retryRefused {
+			expected = 3
+		}
+		for result := range scanner.Scan(context.Background(), hosts, 1) {
+			if !errors.Is(result.Err, syscall.ECONNREFUSED) || result.Attempts != expected {
+				t.Error(result.Err, result.Attempts, "not equal to", syscall.ECONNREFUSED, expected)
+			}
+		}
+	}
+}
+
+func TestScanFingerprintNLA(t *testing.T) {
+	// CHALLENGE laid out as Windows Server 2022 sends it
+	challenge, _ := hex.DecodeString("4e544c4d53535000020000000e000e0038000000358289e2a1b2c3d4e5f60718000000000000000086008600460000000a007c4f0000000f43004f004e0054004f0053004f0002000e0043004f004e0054004f0053004f000100080044004300300031000400160063006f006e0074006f0073006f002e0063006f006d000300200064006300300031002e0063006f006e0074006f0073006f002e0063006f006d000500160063006f006e0074006f0073006f002e0063006f006d000700080000f4252ae95fda0100000000")
+	nlaSrv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID),
+		rdptest.StartTLS(nil),
+		rdptest.ReadNTLMNegotiate(),
+		rdptest.SendNTLMChallengeMessage(challenge),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// TLS only, nothing to fingerprint
+	sslSrv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := x224.NewMemoryResultWriter()
+	scanner := grdp.NewScanner()
+	scanner.FingerprintNLA = true
+	scanner.Results = results
+	hosts := make(chan string, 2)
+	hosts <- nlaSrv.Addr()
+	hosts <- sslSrv.Addr()
+	close(hosts)
+	for result := range scanner.Scan(context.Background(), hosts, 2) {
+		if result.Err != nil || result.FingerprintErr != nil {
+			t.Fatal(result.Host, result.Err, result.FingerprintErr)
+		}
+		switch result.Host {
+		case nlaSrv.Addr():
+			if result.ServerInfo == nil || result.ServerInfo.DNSComputerName != "dc01.contoso.com" || result.ServerInfo.Version.String() != "10.0.20348" {
+				t.Error(result.ServerInfo, "not equal to", "dc01.contoso.com 10.0.20348")
+			}
+			if result.Certificate == nil || result.Certificate.CommonName != "rdp" {
+				t.Error(result.Certificate, "not equal to", "rdp")
+			}
+			if result.TLSVersion == 0 {
+				t.Error("no tls version")
+			}
+			// recorded along the negotiation
+			recorded, _ := results.Result(nlaSrv.Addr())
+			if recorded.NTLMHostname != "dc01.contoso.com" || recorded.ProductVersion != "10.0.20348" ||
+				recorded.TLSCommonName != "rdp" || recorded.RTT != result.RTT || recorded.RTT <= 0 {
+				t.Errorf("%+v", recorded)
+			}
+		case sslSrv.Addr():
+			if result.ServerInfo != nil || result.Certificate != nil || result.TLSVersion != 0 {
+				t.Error(result.ServerInfo, result.Certificate, result.TLSVersion, "not equal to", nil)
+			}
+		}
+	}
+	for _, srv := range []*rdptest.Server{nlaSrv, sslSrv} {
+		if err = srv.Wait(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestScanCheckNLA(t *testing.T) {
+	srv, err := rdptest.NewServer(
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID), rdptest.ExpectClose()},
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER), rdptest.ExpectClose()},
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationResponse(x224.PROTOCOL_HYBRID), rdptest.ExpectClose()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := x224.NewMemoryResultWriter()
+	scanner := grdp.NewScanner()
+	scanner.CheckNLA = true
+	scanner.Results = results
+	hosts := make(chan string, 1)
+	hosts <- srv.Addr()
+	close(hosts)
+	for result := range scanner.Scan(context.Background(), hosts, 1) {
+		if result.Err != nil || result.CheckNLAErr != nil {
+			t.Fatal(result.Err, result.CheckNLAErr)
+		}
+		if result.Negotiation.NLA != x224.NLA_ENFORCED {
+			t.Error(result.Negotiation.NLA, "not equal to", x224.NLA_ENFORCED)
+		}
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	if recorded, ok := results.Result(srv.Addr()); !ok || recorded.NLA != x224.NLA_ENFORCED {
+		t.Error(recorded, "not equal to", x224.NLA_ENFORCED)
+	}
+}
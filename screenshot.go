@@ -0,0 +1,83 @@
+package grdp
+
+import (
+	"image"
+	"sync"
+	"time"
+
+	"github.com/icodeface/grdp/protocol/pdu"
+)
+
+/**
+ * Image of the whole desktop of the session kept by WithKeepSession.
+ * Waits for the server to activate the client, asks it to refresh the
+ * desktop then paints the bitmap updates until they covered it all.
+ * timeout bounds the whole capture. Uncompressed and interleaved RLE
+ * bitmaps up to 24 bpp are decoded, see pdu.BitmapData.RGBA
+ */
+func (g *Client) Screenshot(timeout time.Duration) (image.Image, error) {
+	g.mu.Lock()
+	s := g.session
+	g.mu.Unlock()
+	if s == nil {
+		return nil, ErrNoSession
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.ready:
+	case <-s.failed:
+		return nil, s.sessionErr()
+	case <-timer.C:
+		return nil, ErrScreenshotTimeout
+	}
+
+	width, height := s.pdu.DesktopSize()
+	img := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	covered := make([]bool, int(width)*int(height))
+	remaining := len(covered)
+	var mu sync.Mutex
+	finished := false
+	done := make(chan error, 1)
+	id := s.pdu.Listen("update", func(rectangles []pdu.BitmapData) {
+		mu.Lock()
+		defer mu.Unlock()
+		if finished {
+			return
+		}
+		for _, b := range rectangles {
+			if err := b.DrawOn(img); err != nil {
+				finished = true
+				done <- err
+				return
+			}
+			area := image.Rect(int(b.DestLeft), int(b.DestTop), int(b.DestRight)+1, int(b.DestBottom)+1).Intersect(img.Rect)
+			for y := area.Min.Y; y < area.Max.Y; y++ {
+				for x := area.Min.X; x < area.Max.X; x++ {
+					if i := y*int(width) + x; !covered[i] {
+						covered[i] = true
+						remaining--
+					}
+				}
+			}
+		}
+		if remaining == 0 {
+			finished = true
+			done <- nil
+		}
+	})
+	defer s.pdu.Remove(id)
+	s.pdu.RefreshRect(0, 0, width-1, height-1)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+		return img, nil
+	case <-s.failed:
+		return nil, s.sessionErr()
+	case <-timer.C:
+		return nil, ErrScreenshotTimeout
+	}
+}
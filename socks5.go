@@ -0,0 +1,257 @@
+package grdp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+/**
+ * Opens the TCP connections of a client or a scanner, see WithDialer
+ * and Scanner.Dialer. *net.Dialer, *SOCKS5Dialer and DialFunc satisfy it
+ */
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// a dial function as a Dialer, an SSH tunnel or a bound source address
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f DialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+/**
+ * SOCKS5 reply codes
+ * @see https://tools.ietf.org/html/rfc1928#section-6
+ */
+const (
+	SOCKS5_SUCCEEDED             = 0x00
+	SOCKS5_GENERAL_FAILURE       = 0x01
+	SOCKS5_NOT_ALLOWED           = 0x02
+	SOCKS5_NETWORK_UNREACHABLE   = 0x03
+	SOCKS5_HOST_UNREACHABLE      = 0x04
+	SOCKS5_CONNECTION_REFUSED    = 0x05
+	SOCKS5_TTL_EXPIRED           = 0x06
+	SOCKS5_COMMAND_NOT_SUPPORTED = 0x07
+	SOCKS5_ADDRESS_NOT_SUPPORTED = 0x08
+)
+
+const (
+	socks5Version = 0x05
+	// authentication methods
+	socks5NoAuth             = 0x00
+	socks5UserPassword       = 0x02
+	socks5NoAcceptableMethod = 0xff
+	socks5Connect            = 0x01
+	// address types
+	socks5IPv4       = 0x01
+	socks5DomainName = 0x03
+	socks5IPv6       = 0x04
+	// @see https://tools.ietf.org/html/rfc1929
+	socks5UserPasswordVersion = 0x01
+	socks5AuthSucceeded       = 0x00
+)
+
+var socks5Replies = map[byte]string{
+	SOCKS5_GENERAL_FAILURE:       "general failure",
+	SOCKS5_NOT_ALLOWED:           "connection not allowed by ruleset",
+	SOCKS5_NETWORK_UNREACHABLE:   "network unreachable",
+	SOCKS5_HOST_UNREACHABLE:      "host unreachable",
+	SOCKS5_CONNECTION_REFUSED:    "connection refused",
+	SOCKS5_TTL_EXPIRED:           "TTL expired",
+	SOCKS5_COMMAND_NOT_SUPPORTED: "command not supported",
+	SOCKS5_ADDRESS_NOT_SUPPORTED: "address type not supported",
+}
+
+/**
+ * CONNECT refused by the SOCKS5 proxy, errors.Is matches ErrConnRefused
+ * when the target refused the connection
+ */
+type SOCKS5Error struct {
+	Proxy string
+	// SOCKS5_HOST_UNREACHABLE...
+	Reply byte
+}
+
+func (e *SOCKS5Error) Error() string {
+	message, ok := socks5Replies[e.Reply]
+	if !ok {
+		message = fmt.Sprintf("reply 0x%02x", e.Reply)
+	}
+	return fmt.Sprintf("proxy %s SOCKS5 CONNECT: %s", e.Proxy, message)
+}
+
+func (e *SOCKS5Error) Is(target error) bool {
+	return target == ErrConnRefused && e.Reply == SOCKS5_CONNECTION_REFUSED
+}
+
+/**
+ * Connects through a SOCKS5 proxy with the CONNECT command, the proxy
+ * resolves the host names. A failed authentication matches
+ * ErrProxyAuthRequired, a refused CONNECT is a *SOCKS5Error
+ * @see https://tools.ietf.org/html/rfc1928
+ */
+type SOCKS5Dialer struct {
+	// host:port of the proxy
+	Proxy string
+	// username/password authentication when set
+	// @see https://tools.ietf.org/html/rfc1929
+	Auth *url.Userinfo
+	// for the dial of the proxy and the handshake, 0 leaves it to ctx
+	Timeout time.Duration
+}
+
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("SOCKS5 does not dial %s", network)
+	}
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", d.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	stop := closeOnDone(ctx, conn)
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+	err = d.handshake(conn, addr)
+	stop()
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	// the conn deadline is the one of ctx, its timeout may fire just before ctx is done
+	if hasDeadline && errors.Is(err, os.ErrDeadlineExceeded) {
+		conn.Close()
+		return nil, context.DeadlineExceeded
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *SOCKS5Dialer) handshake(conn net.Conn, addr string) error {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("bad port %q", portString)
+	}
+
+	methods := []byte{socks5NoAuth}
+	if d.Auth != nil {
+		methods = []byte{socks5UserPassword}
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err = conn.Write(greeting); err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		return fmt.Errorf("proxy %s SOCKS5 greeting: %w", d.Proxy, err)
+	}
+	if b[0] != socks5Version {
+		return fmt.Errorf("proxy %s is not SOCKS5, version %d", d.Proxy, b[0])
+	}
+	switch b[1] {
+	case socks5NoAuth:
+	case socks5UserPassword:
+		if d.Auth == nil {
+			return fmt.Errorf("proxy %s: %w", d.Proxy, ErrProxyAuthRequired)
+		}
+		if err = d.authenticate(conn); err != nil {
+			return err
+		}
+	case socks5NoAcceptableMethod:
+		return fmt.Errorf("proxy %s: %w", d.Proxy, ErrProxyAuthRequired)
+	default:
+		return fmt.Errorf("proxy %s SOCKS5 method 0x%02x not offered", d.Proxy, b[1])
+	}
+
+	request := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q too long for SOCKS5", host)
+		}
+		request = append(request, socks5DomainName, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5IPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socks5IPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+
+	// version, reply, reserved, address type then the bound address
+	reply := make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("proxy %s SOCKS5 CONNECT: %w", d.Proxy, err)
+	}
+	if reply[1] != SOCKS5_SUCCEEDED {
+		return &SOCKS5Error{Proxy: d.Proxy, Reply: reply[1]}
+	}
+	var size int
+	switch reply[3] {
+	case socks5IPv4:
+		size = net.IPv4len
+	case socks5IPv6:
+		size = net.IPv6len
+	case socks5DomainName:
+		if _, err = io.ReadFull(conn, b[:1]); err != nil {
+			return fmt.Errorf("proxy %s SOCKS5 CONNECT: %w", d.Proxy, err)
+		}
+		size = int(b[0])
+	default:
+		return fmt.Errorf("proxy %s SOCKS5 bound address type 0x%02x", d.Proxy, reply[3])
+	}
+	if _, err = io.ReadFull(conn, make([]byte, size+2)); err != nil {
+		return fmt.Errorf("proxy %s SOCKS5 CONNECT: %w", d.Proxy, err)
+	}
+	return nil
+}
+
+func (d *SOCKS5Dialer) authenticate(conn net.Conn) error {
+	user := d.Auth.Username()
+	password, _ := d.Auth.Password()
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("SOCKS5 user or password longer than 255 bytes")
+	}
+	request := []byte{socks5UserPasswordVersion, byte(len(user))}
+	request = append(request, user...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return fmt.Errorf("proxy %s SOCKS5 authentication: %w", d.Proxy, err)
+	}
+	if b[1] != socks5AuthSucceeded {
+		return fmt.Errorf("proxy %s: %w", d.Proxy, ErrProxyAuthRequired)
+	}
+	return nil
+}
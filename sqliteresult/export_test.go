@@ -0,0 +1,7 @@
+package sqliteresult
+
+import "time"
+
+func SetNow(w *Writer, now func() time.Time) {
+	w.now = now
+}
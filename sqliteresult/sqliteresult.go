@@ -0,0 +1,218 @@
+/**
+ * A x224.ResultWriter keeping the results in a SQLite database, a row per
+ * host and port. A scan of a host already recorded updates its row, the
+ * database then holds the last result of each host over all the runs.
+ * It is a package of its own so that the programs not using it do not
+ * link the driver
+ */
+package sqliteresult
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/icodeface/grdp/protocol/x224"
+	_ "modernc.org/sqlite"
+)
+
+/**
+ * Schema of each version of the database, the statements of a version
+ * upgrade the previous one. The version reached is kept in the
+ * user_version pragma, only append to the list
+ */
+var migrations = []string{
+	`CREATE TABLE results (
+		host TEXT NOT NULL,
+		port INTEGER NOT NULL,
+		type INTEGER NOT NULL,
+		selected_protocol INTEGER NOT NULL,
+		failure_code INTEGER NOT NULL,
+		nla_required INTEGER NOT NULL,
+		nla TEXT NOT NULL,
+		-- unix nanoseconds
+		first_seen INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		PRIMARY KEY (host, port)
+	);
+	CREATE INDEX results_last_seen ON results (last_seen);`,
+	// flags of the negotiation response
+	`ALTER TABLE results ADD COLUMN flags INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// the last result of a host, as read by QueryResults
+type Row struct {
+	Host string
+	// 0 when the result host had none
+	Port             int
+	Type             x224.NegotiationType
+	SelectedProtocol uint32
+	FailureCode      uint32
+	Flags            uint8
+	NLA              x224.NLAMode
+	// first and last scans of the host that got a result
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// the result recorded, its host is host:port again
+func (r Row) Result() x224.NegotiationResult {
+	host := r.Host
+	if r.Port != 0 {
+		host = net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+	}
+	return x224.NegotiationResult{Host: host, Type: r.Type, SelectedProtocol: r.SelectedProtocol,
+		FailureCode: r.FailureCode, Flags: r.Flags, NLA: r.NLA}
+}
+
+// rows read by QueryResults, the zero value of a field does not filter
+type Filter struct {
+	Host string
+	Port int
+	// hosts seen at or after Since
+	Since time.Time
+	// only the hosts refusing a connection without NLA
+	NLARequired bool
+	// at most Limit rows
+	Limit int
+}
+
+// a SQLite database of results, safe for concurrent use
+type Writer struct {
+	db *sql.DB
+	// clock of first_seen and last_seen, tests stub it
+	now func() time.Time
+}
+
+/**
+ * Open the database at path, created when missing, and migrate it to the
+ * last schema. A database of a newer schema is refused
+ */
+func Open(path string) (*Writer, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// a single connection, the writes of a scan then wait on each other
+	// rather than failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if err = migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Writer{db: db, now: time.Now}, nil
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("sqlite results schema version %d, newer than %d", version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(migrations[version]); err == nil {
+			// pragmas do not take parameters
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite results migration %d: %w", version+1, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insert the result, or replace the one of its host keeping first_seen
+func (w *Writer) WriteResult(result x224.NegotiationResult) error {
+	host, port := result.Host, 0
+	if h, p, err := net.SplitHostPort(result.Host); err == nil {
+		host = h
+		port, _ = strconv.Atoi(p)
+	}
+	nla, _ := result.NLA.MarshalText()
+	seen := w.now().UnixNano()
+	_, err := w.db.Exec(`INSERT INTO results (host, port, type, selected_protocol, failure_code, flags, nla_required, nla, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (host, port) DO UPDATE SET
+			type = excluded.type,
+			selected_protocol = excluded.selected_protocol,
+			failure_code = excluded.failure_code,
+			flags = excluded.flags,
+			nla_required = excluded.nla_required,
+			nla = excluded.nla,
+			last_seen = excluded.last_seen`,
+		host, port, int64(result.Type), int64(result.SelectedProtocol), int64(result.FailureCode), int64(result.Flags),
+		result.NLARequired(), string(nla), seen, seen)
+	return err
+}
+
+// rows matching filter, by host then port
+func (w *Writer) QueryResults(filter Filter) ([]Row, error) {
+	var where []string
+	var args []interface{}
+	if filter.Host != "" {
+		where = append(where, "host = ?")
+		args = append(args, filter.Host)
+	}
+	if filter.Port != 0 {
+		where = append(where, "port = ?")
+		args = append(args, filter.Port)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "last_seen >= ?")
+		args = append(args, filter.Since.UnixNano())
+	}
+	if filter.NLARequired {
+		where = append(where, "nla_required")
+	}
+	query := "SELECT host, port, type, selected_protocol, failure_code, flags, nla, first_seen, last_seen FROM results"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY host, port"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	rows, err := w.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []Row
+	for rows.Next() {
+		var r Row
+		var typ, selected, failure, flags, firstSeen, lastSeen int64
+		var nla string
+		if err = rows.Scan(&r.Host, &r.Port, &typ, &selected, &failure, &flags, &nla, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		if err = r.NLA.UnmarshalText([]byte(nla)); err != nil {
+			return nil, err
+		}
+		r.Type = x224.NegotiationType(typ)
+		r.SelectedProtocol = uint32(selected)
+		r.FailureCode = uint32(failure)
+		r.Flags = uint8(flags)
+		r.FirstSeen = time.Unix(0, firstSeen)
+		r.LastSeen = time.Unix(0, lastSeen)
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+func (w *Writer) Close() error {
+	return w.db.Close()
+}
@@ -0,0 +1,198 @@
+package sqliteresult_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp/protocol/x224"
+	"github.com/icodeface/grdp/sqliteresult"
+)
+
+// clock moving forward by a second at each reading
+func steppingClock() func() time.Time {
+	now := time.Unix(1700000000, 0)
+	return func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+}
+
+// path of a database in a new directory, removed by the returned func
+func tempDB(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "sqliteresult")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "results.db"), func() { os.RemoveAll(dir) }
+}
+
+func open(t *testing.T, path string) *sqliteresult.Writer {
+	w, err := sqliteresult.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqliteresult.SetNow(w, steppingClock())
+	return w
+}
+
+func TestWriteResultUpsert(t *testing.T) {
+	path, remove := tempDB(t)
+	defer remove()
+	w := open(t, path)
+	ssl := x224.NegotiationResult{Host: "10.0.0.1:3389", Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: x224.PROTOCOL_SSL}
+	refused := x224.NegotiationResult{Host: "10.0.0.1:3389", Type: x224.TYPE_RDP_NEG_FAILURE,
+		FailureCode: x224.HYBRID_REQUIRED_BY_SERVER, NLA: x224.NLA_ENFORCED}
+	other := x224.NegotiationResult{Host: "10.0.0.2:3390", Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: x224.PROTOCOL_HYBRID}
+	for _, result := range []x224.NegotiationResult{ssl, other, refused} {
+		if err := w.WriteResult(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rows are kept by another run
+	w = open(t, path)
+	defer w.Close()
+	rows, err := w.QueryResults(sqliteresult.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatal(len(rows), "not equal to", 2)
+	}
+	if rows[0].Result() != refused || rows[1].Result() != other {
+		t.Error(rows[0].Result(), rows[1].Result(), "not equal to", refused, other)
+	}
+	first := time.Unix(1700000001, 0)
+	if !rows[0].FirstSeen.Equal(first) || !rows[0].LastSeen.Equal(first.Add(2*time.Second)) {
+		t.Error(rows[0].FirstSeen, rows[0].LastSeen)
+	}
+	if !rows[1].FirstSeen.Equal(rows[1].LastSeen) {
+		t.Error(rows[1].FirstSeen, "not equal to", rows[1].LastSeen)
+	}
+	if err = w.WriteResult(ssl); err != nil {
+		t.Fatal(err)
+	}
+	rows, err = w.QueryResults(sqliteresult.Filter{Host: "10.0.0.1"})
+	if err != nil || len(rows) != 1 || rows[0].Result() != ssl || !rows[0].FirstSeen.Equal(first) {
+		t.Error(rows, err)
+	}
+}
+
+func TestQueryResultsFilter(t *testing.T) {
+	path, remove := tempDB(t)
+	defer remove()
+	w := open(t, path)
+	defer w.Close()
+	results := []x224.NegotiationResult{
+		{Host: "10.0.0.1:3389", Type: x224.TYPE_RDP_NEG_FAILURE, FailureCode: x224.HYBRID_REQUIRED_BY_SERVER},
+		{Host: "10.0.0.1:3390", Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: x224.PROTOCOL_SSL},
+		{Host: "10.0.0.2:3389", Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: x224.PROTOCOL_RDP},
+		{Host: "10.0.0.3", Type: x224.TYPE_RDP_NEG_FAILURE, FailureCode: x224.HYBRID_REQUIRED_BY_SERVER},
+	}
+	for _, result := range results {
+		if err := w.WriteResult(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		filter   sqliteresult.Filter
+		expected []string
+	}{
+		{sqliteresult.Filter{}, []string{"10.0.0.1:3389", "10.0.0.1:3390", "10.0.0.2:3389", "10.0.0.3"}},
+		{sqliteresult.Filter{Host: "10.0.0.1"}, []string{"10.0.0.1:3389", "10.0.0.1:3390"}},
+		{sqliteresult.Filter{Port: 3389}, []string{"10.0.0.1:3389", "10.0.0.2:3389"}},
+		{sqliteresult.Filter{Since: time.Unix(1700000003, 0)}, []string{"10.0.0.2:3389", "10.0.0.3"}},
+		{sqliteresult.Filter{NLARequired: true}, []string{"10.0.0.1:3389", "10.0.0.3"}},
+		{sqliteresult.Filter{Limit: 1}, []string{"10.0.0.1:3389"}},
+		{sqliteresult.Filter{Host: "10.0.0.9"}, []string{}},
+	}
+	for _, test := range tests {
+		rows, err := w.QueryResults(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts := []string{}
+		for _, row := range rows {
+			hosts = append(hosts, row.Result().Host)
+		}
+		if len(hosts) != len(test.expected) {
+			t.Error(test.filter, hosts, "not equal to", test.expected)
+			continue
+		}
+		for i := range hosts {
+			if hosts[i] != test.expected[i] {
+				t.Error(test.filter, hosts, "not equal to", test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestOpenMigrations(t *testing.T) {
+	path, remove := tempDB(t)
+	defer remove()
+	w := open(t, path)
+	w.Close()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	if err = db.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version != 2 {
+		t.Error(version, err, "not equal to", 2)
+	}
+	// a database written by a newer version is left alone
+	if _, err = db.Exec("PRAGMA user_version = 99"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err = sqliteresult.Open(path); err == nil {
+		t.Error("newer schema opened")
+	}
+}
+
+func TestOpenMigratesVersion1(t *testing.T) {
+	path, remove := tempDB(t)
+	defer remove()
+	// a database of the first schema, without the flags
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		`CREATE TABLE results (host TEXT NOT NULL, port INTEGER NOT NULL, type INTEGER NOT NULL,
+			selected_protocol INTEGER NOT NULL, failure_code INTEGER NOT NULL, nla_required INTEGER NOT NULL,
+			nla TEXT NOT NULL, first_seen INTEGER NOT NULL, last_seen INTEGER NOT NULL, PRIMARY KEY (host, port))`,
+		`CREATE INDEX results_last_seen ON results (last_seen)`,
+		`INSERT INTO results VALUES ('10.0.0.1', 3389, 2, 1, 0, 0, 'unknown', 1, 1)`,
+		`PRAGMA user_version = 1`,
+	} {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	w := open(t, path)
+	defer w.Close()
+	admin := x224.NegotiationResult{Host: "10.0.0.2:3389", Type: x224.TYPE_RDP_NEG_RSP,
+		SelectedProtocol: x224.PROTOCOL_HYBRID, Flags: x224.RESTRICTED_ADMIN_MODE_SUPPORTED}
+	if err = w.WriteResult(admin); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := w.QueryResults(sqliteresult.Filter{})
+	if err != nil || len(rows) != 2 {
+		t.Fatal(rows, err)
+	}
+	old := x224.NegotiationResult{Host: "10.0.0.1:3389", Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: x224.PROTOCOL_SSL}
+	if rows[0].Result() != old || rows[1].Result() != admin {
+		t.Error(rows[0].Result(), rows[1].Result(), "not equal to", old, admin)
+	}
+}
@@ -0,0 +1,223 @@
+package grdp
+
+import (
+	"fmt"
+	"github.com/icodeface/grdp/protocol/x224"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Totals of the results of the scans of a Scanner, see Scanner.Stats.
+ * Targets counts the results, a target that does not parse included
+ */
+type ScanStats struct {
+	Targets int
+	// the server answered the connection request, the results without Err
+	Responded int
+	// answers with an RDP_NEG_RSP, an RDP_NEG_FAILURE or neither
+	Negotiated         int
+	NegotiationFailed  int
+	WithoutNegotiation int
+	// results with Err
+	Errors int
+	// count of each x224.SSL_REQUIRED_BY_SERVER... failure code
+	FailureCodes map[uint32]int
+	// count of each tls.VersionTLS12... of the fingerprints, see Scanner.FingerprintNLA
+	TLSVersions map[uint16]int
+	// of the RTTs of the answers, estimated from LatencyBuckets
+	MedianRTT time.Duration
+}
+
+/**
+ * Upper bounds of the buckets the RTTs are counted in for MedianRTT,
+ * the last bucket holds the RTTs above them
+ */
+var LatencyBuckets = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second,
+}
+
+// counts of durations in buckets, bounds[i] is the upper bound of counts[i]
+type histogram struct {
+	bounds []time.Duration
+	counts []int
+	total  int
+	// of the last bucket, without an upper bound
+	max time.Duration
+}
+
+func newHistogram(bounds []time.Duration) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int, len(bounds)+1)}
+}
+
+func (h *histogram) add(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	h.counts[i]++
+	h.total++
+	if i == len(h.bounds) && d > h.max {
+		h.max = d
+	}
+}
+
+/**
+ * Duration under which a share q of those added are, interpolated
+ * within its bucket. 0 when none was added
+ */
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := q * float64(h.total)
+	seen := 0
+	for i, count := range h.counts {
+		if count == 0 || float64(seen+count) < rank {
+			seen += count
+			continue
+		}
+		var lower, upper time.Duration
+		if i > 0 {
+			lower = h.bounds[i-1]
+		}
+		if i < len(h.bounds) {
+			upper = h.bounds[i]
+		} else {
+			upper = h.max
+		}
+		return lower + time.Duration((rank-float64(seen))/float64(count)*float64(upper-lower))
+	}
+	return h.max
+}
+
+// ScanStats being counted, updated by the goroutines of the scans
+type scanStats struct {
+	mu      sync.Mutex
+	state   ScanStats
+	latency *histogram
+}
+
+func (s *scanStats) add(result ScanResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.latency == nil {
+		s.latency = newHistogram(LatencyBuckets)
+		s.state.FailureCodes = make(map[uint32]int)
+		s.state.TLSVersions = make(map[uint16]int)
+	}
+	s.state.Targets++
+	if result.Err != nil {
+		s.state.Errors++
+		return
+	}
+	s.state.Responded++
+	s.latency.add(result.RTT)
+	switch {
+	case !result.Negotiated:
+		s.state.WithoutNegotiation++
+	case result.Negotiation.Failed():
+		s.state.NegotiationFailed++
+		s.state.FailureCodes[result.Negotiation.FailureCode]++
+	default:
+		s.state.Negotiated++
+	}
+	if result.TLSVersion != 0 {
+		s.state.TLSVersions[result.TLSVersion]++
+	}
+}
+
+// copy of the totals, its maps are its own
+func (s *scanStats) snapshot() ScanStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	state.FailureCodes = make(map[uint32]int, len(s.state.FailureCodes))
+	for code, n := range s.state.FailureCodes {
+		state.FailureCodes[code] = n
+	}
+	state.TLSVersions = make(map[uint16]int, len(s.state.TLSVersions))
+	for version, n := range s.state.TLSVersions {
+		state.TLSVersions[version] = n
+	}
+	if s.latency != nil {
+		state.MedianRTT = s.latency.quantile(0.5)
+	}
+	return state
+}
+
+/**
+ * Totals of the results of the scans of s so far, those of several
+ * scans add up. Safe to call while scanning, a result is counted once
+ * its probe ended
+ */
+func (s *Scanner) Stats() ScanStats {
+	return s.stats.snapshot()
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case 0x0300:
+		return "SSL 3.0"
+	case 0x0301:
+		return "TLS 1.0"
+	case 0x0302:
+		return "TLS 1.1"
+	case 0x0303:
+		return "TLS 1.2"
+	case 0x0304:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+/**
+ * Lines to print at the end of a scan, the failure codes and TLS
+ * versions by name, the most frequent first
+ */
+func (s ScanStats) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%d targets, %d responded, %d errors\n", s.Targets, s.Responded, s.Errors)
+	fmt.Fprintf(b, "%d negotiated, %d negotiation failures, %d without negotiation\n",
+		s.Negotiated, s.NegotiationFailed, s.WithoutNegotiation)
+	if len(s.FailureCodes) > 0 {
+		var counts []nameCount
+		for code, n := range s.FailureCodes {
+			counts = append(counts, nameCount{x224.FailureCodeName(code), n})
+		}
+		fmt.Fprintf(b, "failures: %s\n", formatCounts(counts))
+	}
+	if len(s.TLSVersions) > 0 {
+		var counts []nameCount
+		for version, n := range s.TLSVersions {
+			counts = append(counts, nameCount{tlsVersionName(version), n})
+		}
+		fmt.Fprintf(b, "tls: %s\n", formatCounts(counts))
+	}
+	if s.Responded > 0 {
+		fmt.Fprintf(b, "median rtt %v\n", s.MedianRTT.Round(time.Microsecond))
+	}
+	return b.String()
+}
+
+type nameCount struct {
+	name  string
+	count int
+}
+
+// "A 3, B 1", by count then name
+func formatCounts(counts []nameCount) string {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count != counts[j].count {
+			return counts[i].count > counts[j].count
+		}
+		return counts[i].name < counts[j].name
+	})
+	parts := make([]string, len(counts))
+	for i, c := range counts {
+		parts[i] = fmt.Sprintf("%s %d", c.name, c.count)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,135 @@
+package grdp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp"
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/protocol/x224"
+	"github.com/icodeface/tls"
+)
+
+func negotiated(protocol uint32, rtt time.Duration, tlsVersion uint16) grdp.ScanResult {
+	return grdp.ScanResult{ProbeResult: grdp.ProbeResult{Connected: true, Negotiated: true, RTT: rtt, TLSVersion: tlsVersion,
+		Negotiation: x224.NegotiationResult{Type: x224.TYPE_RDP_NEG_RSP, SelectedProtocol: protocol}}}
+}
+
+func negotiationFailure(code uint32, rtt time.Duration) grdp.ScanResult {
+	return grdp.ScanResult{ProbeResult: grdp.ProbeResult{Connected: true, Negotiated: true, RTT: rtt,
+		Negotiation: x224.NegotiationResult{Type: x224.TYPE_RDP_NEG_FAILURE, FailureCode: code}}}
+}
+
+func TestScanStats(t *testing.T) {
+	s := grdp.NewScanner()
+	if stats := s.Stats(); stats.Targets != 0 || stats.MedianRTT != 0 || len(stats.FailureCodes) != 0 {
+		t.Errorf("%+v", stats)
+	}
+	results := []grdp.ScanResult{
+		negotiated(x224.PROTOCOL_HYBRID, 3*time.Millisecond, tls.VersionTLS12),
+		negotiated(x224.PROTOCOL_HYBRID, 4*time.Millisecond, tls.VersionTLS12),
+		negotiated(x224.PROTOCOL_SSL, 4*time.Millisecond, 0),
+		negotiated(x224.PROTOCOL_HYBRID, 30*time.Millisecond, tls.VersionTLS10),
+		negotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER, 8*time.Millisecond),
+		negotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER, 8*time.Millisecond),
+		negotiationFailure(x224.SSL_NOT_ALLOWED_BY_SERVER, 9*time.Millisecond),
+		{ProbeResult: grdp.ProbeResult{Connected: true, RTT: 500 * time.Microsecond}},
+		{ProbeResult: grdp.ProbeResult{Host: "10.0.0.1:3389"}, Err: errors.New("refused")},
+	}
+	// as the workers of a scan do
+	var wg sync.WaitGroup
+	for _, result := range results {
+		wg.Add(1)
+		go func(result grdp.ScanResult) {
+			defer wg.Done()
+			s.AddStats(result)
+		}(result)
+	}
+	wg.Wait()
+
+	stats := s.Stats()
+	expected := grdp.ScanStats{Targets: 9, Responded: 8, Negotiated: 4, NegotiationFailed: 3, WithoutNegotiation: 1, Errors: 1,
+		FailureCodes: map[uint32]int{x224.HYBRID_REQUIRED_BY_SERVER: 2, x224.SSL_NOT_ALLOWED_BY_SERVER: 1},
+		TLSVersions:  map[uint16]int{tls.VersionTLS12: 2, tls.VersionTLS10: 1},
+		// the 4th of 8 RTTs is the last of the 2-5ms bucket
+		MedianRTT: 5 * time.Millisecond}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("%+v not equal to %+v", stats, expected)
+	}
+	expectedString := "9 targets, 8 responded, 1 errors\n" +
+		"4 negotiated, 3 negotiation failures, 1 without negotiation\n" +
+		"failures: HYBRID_REQUIRED_BY_SERVER 2, SSL_NOT_ALLOWED_BY_SERVER 1\n" +
+		"tls: TLS 1.2 2, TLS 1.0 1\n" +
+		"median rtt 5ms\n"
+	if stats.String() != expectedString {
+		t.Error(stats.String(), "not equal to", expectedString)
+	}
+
+	// the snapshot is not changed by the results after it
+	stats.FailureCodes[x224.SSL_REQUIRED_BY_SERVER] = 1
+	s.AddStats(negotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER, time.Millisecond))
+	if stats.FailureCodes[x224.HYBRID_REQUIRED_BY_SERVER] != 2 || s.Stats().FailureCodes[x224.SSL_REQUIRED_BY_SERVER] != 0 {
+		t.Error(stats.FailureCodes, s.Stats().FailureCodes)
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	bounds := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}
+	tests := []struct {
+		durations []time.Duration
+		q         float64
+		expected  time.Duration
+	}{
+		{nil, 0.5, 0},
+		{[]time.Duration{5 * time.Millisecond}, 0.5, 5 * time.Millisecond},
+		{[]time.Duration{time.Millisecond, 15 * time.Millisecond}, 0.5, 10 * time.Millisecond},
+		{[]time.Duration{15 * time.Millisecond, 15 * time.Millisecond, 15 * time.Millisecond, 15 * time.Millisecond}, 0.5, 15 * time.Millisecond},
+		// above the bounds, up to the largest
+		{[]time.Duration{time.Second, 3 * time.Second}, 1, 3 * time.Second},
+		{[]time.Duration{time.Second, 3 * time.Second}, 0.5, 20*time.Millisecond + (3*time.Second-20*time.Millisecond)/2},
+	}
+	for _, test := range tests {
+		if q := grdp.Quantile(bounds, test.durations, test.q); q != test.expected {
+			t.Error(test.durations, test.q, q, "not equal to", test.expected)
+		}
+	}
+}
+
+func TestScanStatsOfScan(t *testing.T) {
+	srv, err := rdptest.NewServer(
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationResponse(x224.PROTOCOL_SSL), rdptest.ExpectClose()},
+		[]rdptest.Step{rdptest.ReadConnectionRequest(), rdptest.NegotiationFailure(x224.HYBRID_REQUIRED_BY_SERVER), rdptest.ExpectClose()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := l.Addr().String()
+	l.Close()
+
+	s := grdp.NewScanner()
+	hosts := make(chan string, 4)
+	hosts <- srv.Addr()
+	hosts <- srv.Addr()
+	hosts <- refused
+	hosts <- "10.0.0.1:99999"
+	close(hosts)
+	for range s.Scan(context.Background(), hosts, 1) {
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	stats := s.Stats()
+	if stats.Targets != 4 || stats.Responded != 2 || stats.Negotiated != 1 || stats.NegotiationFailed != 1 ||
+		stats.Errors != 2 || stats.FailureCodes[x224.HYBRID_REQUIRED_BY_SERVER] != 1 || stats.MedianRTT <= 0 {
+		t.Errorf("%+v", stats)
+	}
+}
@@ -0,0 +1,118 @@
+package grdp
+
+import (
+	"context"
+	"github.com/icodeface/grdp/protocol/x224"
+	"io"
+	"sync"
+	"time"
+)
+
+// how long Stop waits for the probes in flight when StopTimeout is 0
+var DefaultStopTimeout = 5 * time.Second
+
+// a running scan, its probes are aborted by cancel
+type scanHandle struct {
+	cancel context.CancelFunc
+	// closed once its results channel is
+	done chan struct{}
+}
+
+// the scans of a Scanner, for Stop
+type scanControl struct {
+	mu       sync.Mutex
+	stopping chan struct{}
+	stopped  bool
+	scans    map[*scanHandle]bool
+}
+
+func (c *scanControl) init() {
+	if c.stopping == nil {
+		c.stopping = make(chan struct{})
+		c.scans = make(map[*scanHandle]bool)
+	}
+}
+
+// a scan started, stopping is closed by Stop
+func (c *scanControl) start(cancel context.CancelFunc) (h *scanHandle, stopping <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	h = &scanHandle{cancel: cancel, done: make(chan struct{})}
+	c.scans[h] = true
+	return h, c.stopping
+}
+
+func (c *scanControl) end(h *scanHandle) {
+	c.mu.Lock()
+	delete(c.scans, h)
+	c.mu.Unlock()
+	close(h.done)
+}
+
+// the scans running, first is set for the first call
+func (c *scanControl) stop() (scans []*scanHandle, first bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	first = !c.stopped
+	if first {
+		c.stopped = true
+		close(c.stopping)
+	}
+	for h := range c.scans {
+		scans = append(scans, h)
+	}
+	return scans, first
+}
+
+/**
+ * End the scans of s: no target is probed anymore, the probes in flight
+ * have StopTimeout, DefaultStopTimeout when 0, to end before they are
+ * aborted. Their results are delivered meanwhile, they must be read
+ * from another goroutine. Results is then flushed and closed when it
+ * buffers, see httpresult.Writer, and its error returned. The scans
+ * started afterwards end at once, Stop may be called several times
+ */
+func (s *Scanner) Stop() error {
+	scans, first := s.control.stop()
+	timeout := s.StopTimeout
+	if timeout <= 0 {
+		timeout = DefaultStopTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	aborted := false
+	for _, h := range scans {
+		if !aborted {
+			select {
+			case <-h.done:
+				continue
+			case <-timer.C:
+				aborted = true
+				for _, h := range scans {
+					h.cancel()
+				}
+			}
+		}
+		<-h.done
+	}
+	if !first || s.Results == nil {
+		return nil
+	}
+	return closeResultWriter(s.Results)
+}
+
+// flush then close w, when it does either
+func closeResultWriter(w x224.ResultWriter) error {
+	var err error
+	if f, ok := w.(interface{ Flush() error }); ok {
+		err = f.Flush()
+	}
+	if c, ok := w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
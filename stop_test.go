@@ -0,0 +1,201 @@
+package grdp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp"
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/protocol/x224"
+)
+
+// result writer recording its Flush and Close calls
+type closingWriter struct {
+	*x224.MemoryResultWriter
+	mu      sync.Mutex
+	flushed int
+	closed  int
+}
+
+func (w *closingWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushed++
+	return nil
+}
+
+func (w *closingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed++
+	return nil
+}
+
+func (w *closingWriter) calls() (flushed, closed int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushed, w.closed
+}
+
+// listener accepting connections it never answers, until stop
+func hangingListener(t *testing.T) (addr string, accepted <-chan struct{}, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptc := make(chan struct{}, 100)
+	var mu sync.Mutex
+	var conns []net.Conn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			acceptc <- struct{}{}
+		}
+	}()
+	return l.Addr().String(), acceptc, func() {
+		l.Close()
+		<-done
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// waits for the goroutines to come back to n
+func waitGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runtime.NumGoroutine() > n {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%d goroutines, %d before\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestStopAborts(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	addr, accepted, closeListener := hangingListener(t)
+	writer := &closingWriter{MemoryResultWriter: x224.NewMemoryResultWriter()}
+	s := grdp.NewScanner()
+	s.Timeout = time.Minute
+	s.StopTimeout = 50 * time.Millisecond
+	s.Results = writer
+	hosts := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		hosts <- addr
+	}
+	close(hosts)
+	results := s.Scan(context.Background(), hosts, 2)
+	<-accepted
+	<-accepted
+
+	start := time.Now()
+	var received []grdp.ScanResult
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		for result := range results {
+			received = append(received, result)
+		}
+	}()
+	if err := s.Stop(); err != nil {
+		t.Error(err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Error("stopped after", d)
+	}
+	<-read
+	// the aborted probes are dropped, the other targets never probed
+	for _, result := range received {
+		if !errors.Is(result.Err, context.Canceled) {
+			t.Error(result.Err, "not equal to", context.Canceled)
+		}
+	}
+	if len(received) > 2 {
+		t.Error(len(received), "results")
+	}
+	if flushed, closed := writer.calls(); flushed != 1 || closed != 1 {
+		t.Error(flushed, closed, "not equal to", 1, 1)
+	}
+
+	// the scans after Stop end at once, the writer is not closed again
+	hosts = make(chan string, 1)
+	hosts <- addr
+	for result := range s.Scan(context.Background(), hosts, 1) {
+		t.Error(result)
+	}
+	if err := s.Stop(); err != nil {
+		t.Error(err)
+	}
+	if flushed, closed := writer.calls(); flushed != 1 || closed != 1 {
+		t.Error(flushed, closed, "not equal to", 1, 1)
+	}
+	closeListener()
+	waitGoroutines(t, goroutines)
+}
+
+func TestStopWaits(t *testing.T) {
+	requested := make(chan struct{})
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		func(s *rdptest.Session) error {
+			close(requested)
+			return nil
+		},
+		rdptest.Sleep(200 * time.Millisecond),
+		rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &closingWriter{MemoryResultWriter: x224.NewMemoryResultWriter()}
+	s := grdp.NewScanner()
+	s.StopTimeout = 5 * time.Second
+	s.Results = writer
+	// hosts is not closed, Stop ends the scan
+	hosts := make(chan string, 1)
+	hosts <- srv.Addr()
+	results := s.Scan(context.Background(), hosts, 1)
+	stopped := make(chan error, 1)
+	go func() {
+		<-requested
+		stopped <- s.Stop()
+	}()
+	var received []grdp.ScanResult
+	for result := range results {
+		received = append(received, result)
+	}
+	if err = <-stopped; err != nil {
+		t.Error(err)
+	}
+	if len(received) != 1 || received[0].Err != nil || received[0].Negotiation.SelectedProtocol != x224.PROTOCOL_SSL {
+		t.Error(received)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	// recorded before the writer was closed
+	if _, ok := writer.Result(srv.Addr()); !ok {
+		t.Error(srv.Addr(), "not recorded")
+	}
+	if _, closed := writer.calls(); closed != 1 {
+		t.Error(closed, "not equal to", 1)
+	}
+}
@@ -0,0 +1,94 @@
+package grdp
+
+import (
+	"bytes"
+	"github.com/icodeface/grdp/core"
+	"strconv"
+	"time"
+)
+
+// clock of the timings, tests stub it
+var now = time.Now
+
+/**
+ * Time spent in each phase of a connection, zero for the phases it did
+ * not go through or did not end
+ */
+type Timings struct {
+	// TCP connection, through the proxy of WithHTTPProxy
+	Dial time.Duration
+	// connection request to connection confirm
+	X224 time.Duration
+	TLS  time.Duration
+	// CredSSP, or the NTLM exchange of a fingerprint
+	NLA time.Duration
+	// connect initial to the channels joined
+	MCS time.Duration
+	// licensing, up to the server accepting the client
+	License time.Duration
+}
+
+func timingsOf(durations map[string]time.Duration) Timings {
+	return Timings{
+		Dial:    durations[core.PHASE_DIAL] + durations[core.PHASE_PROXY],
+		X224:    durations[core.PHASE_X224],
+		TLS:     durations[core.PHASE_TLS],
+		NLA:     durations[core.PHASE_NLA],
+		MCS:     durations[core.PHASE_MCS],
+		License: durations[core.PHASE_LICENSE],
+	}
+}
+
+// milliseconds of the phases gone through, {"dial":1.5,"x224":0.75}
+func (t Timings) MarshalJSON() ([]byte, error) {
+	phases := []struct {
+		name string
+		d    time.Duration
+	}{
+		{core.PHASE_DIAL, t.Dial},
+		{core.PHASE_X224, t.X224},
+		{core.PHASE_TLS, t.TLS},
+		{core.PHASE_NLA, t.NLA},
+		{core.PHASE_MCS, t.MCS},
+		{core.PHASE_LICENSE, t.License},
+	}
+	buff := &bytes.Buffer{}
+	buff.WriteByte('{')
+	for _, phase := range phases {
+		if phase.d == 0 {
+			continue
+		}
+		if buff.Len() > 1 {
+			buff.WriteByte(',')
+		}
+		buff.WriteString(strconv.Quote(phase.name))
+		buff.WriteByte(':')
+		buff.WriteString(strconv.FormatFloat(float64(phase.d)/float64(time.Millisecond), 'f', -1, 64))
+	}
+	buff.WriteByte('}')
+	return buff.Bytes(), nil
+}
+
+// timings of the last Login or FingerprintNLA, of its last attempt
+func (g *Client) Timings() Timings {
+	return g.timings
+}
+
+// timings of the attempt that ended, reported to the metrics
+func (g *Client) endTimings() {
+	g.timings = timingsOf(g.timer.Durations())
+	if g.metrics != nil {
+		reportPhases(g.metrics, g.timer)
+	}
+}
+
+// phases of the attempt, reported to the instrumentation and timed
+func (g *Client) phaseStarted(name string) {
+	g.instr.PhaseStarted(name)
+	g.timer.PhaseStarted(name)
+}
+
+func (g *Client) phaseEnded(name string) {
+	g.instr.PhaseEnded(name)
+	g.timer.PhaseEnded(name)
+}
@@ -0,0 +1,114 @@
+package grdp_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icodeface/grdp"
+	"github.com/icodeface/grdp/glog"
+	"github.com/icodeface/grdp/internal/rdptest"
+	"github.com/icodeface/grdp/protocol/x224"
+)
+
+// clock moving forward by 1ms at each reading, the phases then take a
+// millisecond each
+func steppingClock() func() time.Time {
+	var mu sync.Mutex
+	now := time.Unix(0, 0)
+	return func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(time.Millisecond)
+		return now
+	}
+}
+
+func TestLoginTimings(t *testing.T) {
+	defer grdp.StubNow(steppingClock())()
+	srv, err := rdptest.NewServer(append(sessionScenario, rdptest.ExpectDisconnect(), rdptest.ExpectClose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE)
+	if err = g.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	expected := grdp.Timings{Dial: time.Millisecond, X224: time.Millisecond, TLS: time.Millisecond,
+		MCS: time.Millisecond, License: time.Millisecond}
+	if g.Timings() != expected {
+		t.Errorf("%+v not equal to %+v", g.Timings(), expected)
+	}
+}
+
+func TestFingerprintTimings(t *testing.T) {
+	defer grdp.StubNow(steppingClock())()
+	srv, err := rdptest.NewServer(nlaScenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := grdp.NewClient(srv.Addr(), glog.NONE)
+	if _, err = g.FingerprintNLA(); err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	expected := grdp.Timings{Dial: time.Millisecond, X224: time.Millisecond, TLS: time.Millisecond, NLA: time.Millisecond}
+	if g.Timings() != expected {
+		t.Errorf("%+v not equal to %+v", g.Timings(), expected)
+	}
+}
+
+func TestProbeTimings(t *testing.T) {
+	defer grdp.StubNow(steppingClock())()
+	srv, err := rdptest.NewServer([]rdptest.Step{
+		rdptest.ReadConnectionRequest(),
+		rdptest.NegotiationResponse(x224.PROTOCOL_SSL),
+		rdptest.ExpectClose(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := grdp.Probe(context.Background(), srv.Addr(), x224.PROTOCOL_SSL|x224.PROTOCOL_HYBRID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Wait(); err != nil {
+		t.Error(err)
+	}
+	if expected := (grdp.Timings{Dial: time.Millisecond, X224: time.Millisecond}); result.Timings != expected {
+		t.Errorf("%+v not equal to %+v", result.Timings, expected)
+	}
+	b, err := json.Marshal(grdp.ScanResult{ProbeResult: result})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"timings":{"dial":1,"x224":1}`) {
+		t.Error(string(b), "without the timings")
+	}
+}
+
+func TestTimingsJSON(t *testing.T) {
+	tests := []struct {
+		timings  grdp.Timings
+		expected string
+	}{
+		{grdp.Timings{}, `{}`},
+		{grdp.Timings{Dial: 1500 * time.Microsecond, License: 2 * time.Millisecond}, `{"dial":1.5,"license":2}`},
+		{grdp.Timings{X224: time.Millisecond, TLS: 2 * time.Millisecond, NLA: 3 * time.Millisecond, MCS: 250 * time.Microsecond},
+			`{"x224":1,"tls":2,"nla":3,"mcs":0.25}`},
+	}
+	for _, test := range tests {
+		b, err := json.Marshal(test.timings)
+		if err != nil || string(b) != test.expected {
+			t.Error(string(b), err, "not equal to", test.expected)
+		}
+	}
+}